@@ -0,0 +1,289 @@
+// Package client provides a client for the headscale gRPC API.
+//
+// It takes care of setting up the connection to headscale, either
+// over the local unix socket or remotely over TCP authenticated with
+// an API key, and retries the calls which are safe to send again when
+// they fail because headscale is temporarily unavailable.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"strings"
+	"time"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	unixSocketPrefix = "unix://"
+
+	defaultMaxRetries   = 3
+	defaultRetryBackoff = 200 * time.Millisecond
+)
+
+var (
+	ErrNoAddress = errors.New("no address given")
+	ErrNoAPIKey  = errors.New("an API key is required to connect to a remote headscale")
+)
+
+// Options configures how the Client connects to headscale.
+type Options struct {
+	// Address is either the path to the headscale unix socket,
+	// optionally prefixed with unix://, or the host:port of the
+	// remote gRPC API.
+	Address string
+
+	// APIKey is used to authenticate against a remote headscale,
+	// it is not used when connecting over the unix socket.
+	APIKey string
+
+	// TLSConfig is used when connecting to a remote headscale.
+	// If nil, the system certificate pool is used to verify
+	// the server.
+	TLSConfig *tls.Config
+
+	// Insecure disables verification of the server certificate,
+	// the rest of TLSConfig, like client certificates, is still used.
+	Insecure bool
+
+	// Plaintext connects to a remote headscale without TLS, which
+	// is only possible if the server has grpc_allow_insecure set.
+	Plaintext bool
+
+	// MaxRetries is the number of times a call is retried if
+	// headscale is unavailable, see WithRetry for the calls which are
+	// retried. Zero uses the default, a negative value disables
+	// retries.
+	MaxRetries int
+
+	// RetryBackoff is the initial time to wait between retries,
+	// it is doubled for every attempt.
+	RetryBackoff time.Duration
+}
+
+// Client is a connection to the headscale gRPC API.
+type Client struct {
+	v1.HeadscaleServiceClient
+
+	conn *grpc.ClientConn
+}
+
+// New connects to headscale as described by opts. The context is
+// used to bound how long we wait for the connection to be established.
+func New(ctx context.Context, opts Options) (*Client, error) {
+	if opts.Address == "" {
+		return nil, ErrNoAddress
+	}
+
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = defaultMaxRetries
+	}
+
+	if opts.RetryBackoff == 0 {
+		opts.RetryBackoff = defaultRetryBackoff
+	}
+
+	grpcOptions := []grpc.DialOption{
+		grpc.WithBlock(),
+		grpc.WithUnaryInterceptor(unaryInterceptor(opts.MaxRetries, opts.RetryBackoff)),
+	}
+
+	address := opts.Address
+
+	if isUnixSocket(address) {
+		address = strings.TrimPrefix(address, unixSocketPrefix)
+
+		grpcOptions = append(
+			grpcOptions,
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithContextDialer(util.GrpcSocketDialer),
+		)
+	} else {
+		if opts.APIKey == "" {
+			return nil, ErrNoAPIKey
+		}
+
+		grpcOptions = append(grpcOptions,
+			grpc.WithPerRPCCredentials(tokenAuth{
+				token:      opts.APIKey,
+				requireTLS: !opts.Plaintext,
+			}),
+		)
+
+		switch {
+		case opts.Plaintext:
+			grpcOptions = append(grpcOptions,
+				grpc.WithTransportCredentials(insecure.NewCredentials()),
+			)
+		case opts.Insecure:
+			tlsConfig := &tls.Config{}
+			if opts.TLSConfig != nil {
+				tlsConfig = opts.TLSConfig.Clone()
+			}
+
+			// turn of gosec as we are intentionally setting
+			// insecure.
+			//nolint:gosec
+			tlsConfig.InsecureSkipVerify = true
+
+			grpcOptions = append(grpcOptions,
+				grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+			)
+		case opts.TLSConfig != nil:
+			grpcOptions = append(grpcOptions,
+				grpc.WithTransportCredentials(credentials.NewTLS(opts.TLSConfig)),
+			)
+		default:
+			grpcOptions = append(grpcOptions,
+				grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(nil, "")),
+			)
+		}
+	}
+
+	conn, err := grpc.DialContext(ctx, address, grpcOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		HeadscaleServiceClient: v1.NewHeadscaleServiceClient(conn),
+		conn:                   conn,
+	}, nil
+}
+
+// Close closes the underlying connection to headscale.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func isUnixSocket(address string) bool {
+	return strings.HasPrefix(address, unixSocketPrefix) ||
+		strings.HasPrefix(address, "/")
+}
+
+// retriedMethods are the methods retried by default: they only read,
+// or set a node to the same state when they are sent again. The others,
+// like creating a pre auth key, could be applied twice if headscale
+// became unavailable after handling the call.
+var retriedMethods = map[string]bool{
+	"GetUser":               true,
+	"ListUsers":             true,
+	"ListPreAuthKeys":       true,
+	"GetNode":               true,
+	"ListNodes":             true,
+	"LookupNode":            true,
+	"ListPendingNodes":      true,
+	"GetNodeHealth":         true,
+	"ListNodeShares":        true,
+	"GetRoutes":             true,
+	"GetNodeRoutes":         true,
+	"ListApiKeys":           true,
+	"ListDERPRegions":       true,
+	"GetPolicy":             true,
+	"ListPolicyVersions":    true,
+	"DiffPolicy":            true,
+	"CheckPolicy":           true,
+	"ListDNSRecords":        true,
+	"ListScopedNameservers": true,
+	"SetTags":               true,
+	"RenameNode":            true,
+	"MoveNode":              true,
+	"SetNodeLabels":         true,
+	"EnableRoute":           true,
+	"DisableRoute":          true,
+}
+
+// retryOption is the grpc.CallOption set by WithRetry.
+type retryOption struct {
+	grpc.EmptyCallOption
+
+	retry bool
+}
+
+// WithRetry overrides for a call if it is retried when headscale is
+// unavailable. By default only the calls which are safe to send again
+// are retried, WithRetry(true) opts in a call the caller knows is safe,
+// and WithRetry(false) opts out of the retries.
+func WithRetry(retry bool) grpc.CallOption {
+	return retryOption{retry: retry}
+}
+
+// shouldRetry reports if a call of method with opts is retried.
+func shouldRetry(method string, opts []grpc.CallOption) bool {
+	for _, opt := range opts {
+		if retry, ok := opt.(retryOption); ok {
+			return retry.retry
+		}
+	}
+
+	name, ok := strings.CutPrefix(method, "/"+v1.HeadscaleService_ServiceDesc.ServiceName+"/")
+
+	return ok && retriedMethods[name]
+}
+
+// unaryInterceptor retries the calls failing with codes.Unavailable
+// which are safe to send again, and converts the returned errors to
+// *Error.
+func unaryInterceptor(maxRetries int, backoff time.Duration) grpc.UnaryClientInterceptor {
+	return func(
+		ctx context.Context,
+		method string,
+		req, reply interface{},
+		cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption,
+	) error {
+		retries := maxRetries
+		if !shouldRetry(method, opts) {
+			retries = 0
+		}
+
+		var err error
+		for attempt := 0; ; attempt++ {
+			err = invoker(ctx, method, req, reply, cc, opts...)
+			if err == nil {
+				return nil
+			}
+
+			if attempt >= retries || status.Code(err) != codes.Unavailable {
+				return newError(err)
+			}
+
+			timer := time.NewTimer(backoff << attempt)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+
+				return newError(err)
+			case <-timer.C:
+			}
+		}
+	}
+}
+
+type tokenAuth struct {
+	token      string
+	requireTLS bool
+}
+
+// Return value is mapped to request headers.
+func (t tokenAuth) GetRequestMetadata(
+	ctx context.Context,
+	in ...string,
+) (map[string]string, error) {
+	return map[string]string{
+		"authorization": "Bearer " + t.token,
+	}, nil
+}
+
+func (t tokenAuth) RequireTransportSecurity() bool {
+	return t.requireTLS
+}
@@ -0,0 +1,211 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type fakeServer struct {
+	v1.UnimplementedHeadscaleServiceServer
+
+	failures int
+	calls    int
+	failWith codes.Code
+}
+
+func (s *fakeServer) ListUsers(
+	ctx context.Context,
+	req *v1.ListUsersRequest,
+) (*v1.ListUsersResponse, error) {
+	s.calls++
+	if s.calls <= s.failures {
+		return nil, status.Error(s.failWith, "failing on purpose")
+	}
+
+	return &v1.ListUsersResponse{
+		Users: []*v1.User{{Name: "test"}},
+	}, nil
+}
+
+func (s *fakeServer) CreatePreAuthKey(
+	ctx context.Context,
+	req *v1.CreatePreAuthKeyRequest,
+) (*v1.CreatePreAuthKeyResponse, error) {
+	s.calls++
+	if s.calls <= s.failures {
+		return nil, status.Error(s.failWith, "failing on purpose")
+	}
+
+	return &v1.CreatePreAuthKeyResponse{PreAuthKey: &v1.PreAuthKey{Key: "key"}}, nil
+}
+
+// ListNodes serves five nodes in pages, the page token is the index of
+// the next node.
+func (s *fakeServer) ListNodes(
+	ctx context.Context,
+	req *v1.ListNodesRequest,
+) (*v1.ListNodesResponse, error) {
+	s.calls++
+
+	start, _ := strconv.Atoi(req.GetPageToken())
+	end := min(start+int(req.GetPageSize()), 5)
+
+	resp := &v1.ListNodesResponse{}
+	for i := start; i < end; i++ {
+		resp.Nodes = append(resp.Nodes, &v1.Node{Id: uint64(i + 1), User: &v1.User{Name: req.GetUser()}})
+	}
+	if end < 5 {
+		resp.NextPageToken = strconv.Itoa(end)
+	}
+
+	return resp, nil
+}
+
+func newTestClient(t *testing.T, srv *fakeServer, opts Options) *Client {
+	t.Helper()
+
+	socket := filepath.Join(t.TempDir(), "headscale.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("listening on socket: %s", err)
+	}
+
+	grpcServer := grpc.NewServer()
+	v1.RegisterHeadscaleServiceServer(grpcServer, srv)
+	go grpcServer.Serve(listener) //nolint
+	t.Cleanup(grpcServer.Stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts.Address = "unix://" + socket
+	opts.RetryBackoff = time.Millisecond
+
+	c, err := New(ctx, opts)
+	if err != nil {
+		t.Fatalf("creating client: %s", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+func TestClientRetriesUnavailable(t *testing.T) {
+	srv := &fakeServer{failures: 2, failWith: codes.Unavailable}
+	c := newTestClient(t, srv, Options{})
+
+	resp, err := c.ListUsers(context.Background(), &v1.ListUsersRequest{})
+	if err != nil {
+		t.Fatalf("expected call to succeed after retries, got: %s", err)
+	}
+
+	if len(resp.GetUsers()) != 1 {
+		t.Errorf("expected one user, got %d", len(resp.GetUsers()))
+	}
+
+	if srv.calls != 3 {
+		t.Errorf("expected 3 calls, got %d", srv.calls)
+	}
+}
+
+func TestClientRetriesExhausted(t *testing.T) {
+	srv := &fakeServer{failures: 10, failWith: codes.Unavailable}
+	c := newTestClient(t, srv, Options{MaxRetries: 2})
+
+	_, err := c.ListUsers(context.Background(), &v1.ListUsersRequest{})
+	if !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("expected ErrUnavailable, got: %v", err)
+	}
+
+	if srv.calls != 3 {
+		t.Errorf("expected 3 calls, got %d", srv.calls)
+	}
+}
+
+func TestClientRetriesOnlySafeCalls(t *testing.T) {
+	srv := &fakeServer{failures: 2, failWith: codes.Unavailable}
+	c := newTestClient(t, srv, Options{})
+
+	// Creating a key again could create two keys, it is not retried
+	// unless the caller opts in.
+	_, err := c.CreatePreAuthKey(context.Background(), &v1.CreatePreAuthKeyRequest{User: "test"})
+	if !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("expected ErrUnavailable, got: %v", err)
+	}
+	if srv.calls != 1 {
+		t.Errorf("expected 1 call, got %d", srv.calls)
+	}
+
+	srv.calls = 0
+	if _, err := c.CreatePreAuthKey(context.Background(), &v1.CreatePreAuthKeyRequest{User: "test"}, WithRetry(true)); err != nil {
+		t.Fatalf("expected call to succeed after retries, got: %s", err)
+	}
+	if srv.calls != 3 {
+		t.Errorf("expected 3 calls, got %d", srv.calls)
+	}
+
+	srv.calls = 0
+	_, err = c.ListUsers(context.Background(), &v1.ListUsersRequest{}, WithRetry(false))
+	if !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("expected ErrUnavailable, got: %v", err)
+	}
+	if srv.calls != 1 {
+		t.Errorf("expected 1 call, got %d", srv.calls)
+	}
+}
+
+func TestClientTypedErrors(t *testing.T) {
+	srv := &fakeServer{failures: 1, failWith: codes.NotFound}
+	c := newTestClient(t, srv, Options{})
+
+	_, err := c.ListUsers(context.Background(), &v1.ListUsersRequest{})
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got: %v", err)
+	}
+
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected status code NotFound, got %s", status.Code(err))
+	}
+
+	if srv.calls != 1 {
+		t.Errorf("expected NotFound not to be retried, got %d calls", srv.calls)
+	}
+}
+
+func TestNewRequiresAPIKeyForRemote(t *testing.T) {
+	_, err := New(context.Background(), Options{Address: "headscale.example.com:50443"})
+	if !errors.Is(err, ErrNoAPIKey) {
+		t.Fatalf("expected ErrNoAPIKey, got: %v", err)
+	}
+}
+
+func TestListAllNodes(t *testing.T) {
+	srv := &fakeServer{}
+	c := newTestClient(t, srv, Options{})
+
+	request := &v1.ListNodesRequest{User: "test", PageSize: 2}
+	nodes, err := c.ListAllNodes(context.Background(), request)
+	if err != nil {
+		t.Fatalf("listing nodes: %s", err)
+	}
+
+	if len(nodes) != 5 || nodes[4].GetId() != 5 || nodes[4].GetUser().GetName() != "test" {
+		t.Errorf("unexpected nodes: %v", nodes)
+	}
+	if srv.calls != 3 {
+		t.Errorf("expected 3 pages to be read, got %d", srv.calls)
+	}
+	if request.GetPageToken() != "" {
+		t.Errorf("the request of the caller was modified")
+	}
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Errors that can be matched against errors returned by the Client
+// using errors.Is.
+var (
+	ErrNotFound         = errors.New("not found")
+	ErrAlreadyExists    = errors.New("already exists")
+	ErrInvalidArgument  = errors.New("invalid argument")
+	ErrUnauthenticated  = errors.New("unauthenticated")
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrUnavailable      = errors.New("headscale unavailable")
+)
+
+var codeErrors = map[codes.Code]error{
+	codes.NotFound:         ErrNotFound,
+	codes.AlreadyExists:    ErrAlreadyExists,
+	codes.InvalidArgument:  ErrInvalidArgument,
+	codes.Unauthenticated:  ErrUnauthenticated,
+	codes.PermissionDenied: ErrPermissionDenied,
+	codes.Unavailable:      ErrUnavailable,
+}
+
+// Error is returned by the Client when a call to headscale fails.
+type Error struct {
+	Code    codes.Code
+	Message string
+}
+
+func newError(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+
+	return &Error{
+		Code:    st.Code(),
+		Message: st.Message(),
+	}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is allows matching the Error against the Err* variables of this package.
+func (e *Error) Is(target error) bool {
+	codeErr, ok := codeErrors[e.Code]
+
+	return ok && codeErr == target
+}
+
+// GRPCStatus allows the Error to be used with the grpc status package.
+func (e *Error) GRPCStatus() *status.Status {
+	return status.New(e.Code, e.Message)
+}
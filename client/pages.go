@@ -0,0 +1,59 @@
+package client
+
+import (
+	"context"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultPageSize is the page size used by the ListAll helpers when the
+// request does not set one.
+const DefaultPageSize = 500
+
+// ListAllNodes returns the nodes matching the request, reading them a
+// page at a time.
+func (c *Client) ListAllNodes(ctx context.Context, request *v1.ListNodesRequest) ([]*v1.Node, error) {
+	request = proto.Clone(request).(*v1.ListNodesRequest)
+	if request.GetPageSize() == 0 {
+		request.PageSize = DefaultPageSize
+	}
+
+	return listAll(func(token string) ([]*v1.Node, string, error) {
+		request.PageToken = token
+		resp, err := c.ListNodes(ctx, request)
+
+		return resp.GetNodes(), resp.GetNextPageToken(), err
+	})
+}
+
+// ListAllUsers returns all the users, reading them a page at a time.
+func (c *Client) ListAllUsers(ctx context.Context) ([]*v1.User, error) {
+	request := &v1.ListUsersRequest{PageSize: DefaultPageSize}
+
+	return listAll(func(token string) ([]*v1.User, string, error) {
+		request.PageToken = token
+		resp, err := c.ListUsers(ctx, request)
+
+		return resp.GetUsers(), resp.GetNextPageToken(), err
+	})
+}
+
+// listAll calls list with the token of the next page until there is no
+// next page.
+func listAll[T any](list func(token string) ([]T, string, error)) ([]T, error) {
+	var all []T
+	token := ""
+	for {
+		page, next, err := list(token)
+		if err != nil {
+			return nil, err
+		}
+
+		all = append(all, page...)
+		if next == "" {
+			return all, nil
+		}
+		token = next
+	}
+}
@@ -3,6 +3,7 @@ package cli
 import (
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
@@ -25,6 +26,8 @@ func init() {
 
 	createAPIKeyCmd.Flags().
 		StringP("expiration", "e", DefaultAPIKeyExpiry, "Human-readable expiration of the key (e.g. 30m, 24h)")
+	createAPIKeyCmd.Flags().
+		StringSlice("scopes", []string{}, "Scopes of the key (e.g. read, nodes:read, routes:write, keys:admin), full access if not set")
 
 	apiKeysCmd.AddCommand(createAPIKeyCmd)
 
@@ -78,7 +81,7 @@ var listAPIKeys = &cobra.Command{
 		}
 
 		tableData := pterm.TableData{
-			{"ID", "Prefix", "Expiration", "Created"},
+			{"ID", "Prefix", "Expiration", "Created", "Scopes"},
 		}
 		for _, key := range response.GetApiKeys() {
 			expiration := "-"
@@ -92,6 +95,7 @@ var listAPIKeys = &cobra.Command{
 				key.GetPrefix(),
 				expiration,
 				key.GetCreatedAt().AsTime().Format(HeadscaleDateTimeFormat),
+				apiKeyScopes(key),
 			})
 
 		}
@@ -122,7 +126,8 @@ If you loose a key, create a new one and revoke (expire) the old one.`,
 		log.Trace().
 			Msg("Preparing to create ApiKey")
 
-		request := &v1.CreateApiKeyRequest{}
+		scopes, _ := cmd.Flags().GetStringSlice("scopes")
+		request := &v1.CreateApiKeyRequest{Scopes: scopes}
 
 		durationStr, _ := cmd.Flags().GetString("expiration")
 
@@ -223,6 +228,12 @@ var deleteAPIKeyCmd = &cobra.Command{
 			return
 		}
 
+		if !confirmAction(cmd, fmt.Sprintf("Do you want to delete the API key %s?", prefix)) {
+			SuccessOutput(map[string]string{"Result": "Key not deleted"}, "Key not deleted", output)
+
+			return
+		}
+
 		ctx, client, conn, cancel := getHeadscaleCLIClient()
 		defer cancel()
 		defer conn.Close()
@@ -245,3 +256,11 @@ var deleteAPIKeyCmd = &cobra.Command{
 		SuccessOutput(response, "Key deleted", output)
 	},
 }
+
+func apiKeyScopes(key *v1.ApiKey) string {
+	if len(key.GetScopes()) == 0 {
+		return "all"
+	}
+
+	return strings.Join(key.GetScopes(), ", ")
+}
@@ -0,0 +1,204 @@
+package cli
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+func init() {
+	rootCmd.AddCommand(commandsCmd)
+}
+
+// registerCompletions adds the completion of the node identifiers and
+// the user names, asked to the server, to the flags and arguments taking
+// them. It runs once all the commands are added to the tree.
+func registerCompletions() {
+	for _, parent := range []*cobra.Command{nodeCmd, routesCmd} {
+		for _, cmd := range parent.Commands() {
+			if cmd.Flag("identifier") != nil {
+				_ = cmd.RegisterFlagCompletionFunc("identifier", completeNodeIDs)
+			}
+		}
+	}
+
+	walkCommands(rootCmd, func(cmd *cobra.Command) {
+		if cmd.Flag("user") != nil {
+			// Commands inheriting the flag share the registration of
+			// their parent, registering it again fails.
+			_ = cmd.RegisterFlagCompletionFunc("user", completeUserNames)
+		}
+	})
+
+	for _, cmd := range []*cobra.Command{destroyUserCmd, getUserCmd, renameUserCmd} {
+		cmd.ValidArgsFunction = func(
+			cmd *cobra.Command,
+			args []string,
+			toComplete string,
+		) ([]string, cobra.ShellCompDirective) {
+			// Only the first argument is an existing user.
+			if len(args) > 0 {
+				return nil, cobra.ShellCompDirectiveNoFileComp
+			}
+
+			return completeUserNames(cmd, args, toComplete)
+		}
+	}
+}
+
+func walkCommands(cmd *cobra.Command, fn func(*cobra.Command)) {
+	fn(cmd)
+	for _, child := range cmd.Commands() {
+		walkCommands(child, fn)
+	}
+}
+
+// completeNodeIDs completes the identifiers of the nodes, described by
+// their name. Nothing is completed when the server cannot be reached.
+func completeNodeIDs(
+	cmd *cobra.Command,
+	args []string,
+	toComplete string,
+) ([]string, cobra.ShellCompDirective) {
+	ctx, conn, cancel, err := newHeadscaleCLIClient()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	defer cancel()
+	defer conn.Close()
+
+	nodes, err := conn.ListAllNodes(ctx, &v1.ListNodesRequest{})
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	var completions []string
+	for _, node := range nodes {
+		id := strconv.FormatUint(node.GetId(), 10)
+		if strings.HasPrefix(id, toComplete) {
+			completions = append(completions, id+"\t"+node.GetGivenName())
+		}
+	}
+
+	return completions, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeUserNames completes the names of the users. Nothing is
+// completed when the server cannot be reached.
+func completeUserNames(
+	cmd *cobra.Command,
+	args []string,
+	toComplete string,
+) ([]string, cobra.ShellCompDirective) {
+	ctx, conn, cancel, err := newHeadscaleCLIClient()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	defer cancel()
+	defer conn.Close()
+
+	users, err := conn.ListAllUsers(ctx)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	var completions []string
+	for _, user := range users {
+		if strings.HasPrefix(user.GetName(), toComplete) {
+			completions = append(completions, user.GetName())
+		}
+	}
+
+	return completions, cobra.ShellCompDirectiveNoFileComp
+}
+
+// commandTree is a command, its flags and its subcommands, as printed by
+// `headscale commands`.
+type commandTree struct {
+	Name        string            `json:"name"`
+	Path        string            `json:"path"`
+	Short       string            `json:"short,omitempty"`
+	Aliases     []string          `json:"aliases,omitempty"`
+	Flags       []commandTreeFlag `json:"flags,omitempty"`
+	Subcommands []commandTree     `json:"subcommands,omitempty"`
+}
+
+type commandTreeFlag struct {
+	Name      string `json:"name"`
+	Shorthand string `json:"shorthand,omitempty"`
+	Type      string `json:"type"`
+	Default   string `json:"default,omitempty"`
+	Usage     string `json:"usage"`
+}
+
+func newCommandTree(cmd *cobra.Command) commandTree {
+	tree := commandTree{
+		Name:    cmd.Name(),
+		Path:    cmd.CommandPath(),
+		Short:   cmd.Short,
+		Aliases: cmd.Aliases,
+	}
+
+	cmd.LocalFlags().VisitAll(func(flag *pflag.Flag) {
+		if flag.Hidden {
+			return
+		}
+
+		tree.Flags = append(tree.Flags, commandTreeFlag{
+			Name:      flag.Name,
+			Shorthand: flag.Shorthand,
+			Type:      flag.Value.Type(),
+			Default:   flag.DefValue,
+			Usage:     flag.Usage,
+		})
+	})
+
+	for _, child := range cmd.Commands() {
+		if child.Hidden || !child.IsAvailableCommand() {
+			continue
+		}
+
+		tree.Subcommands = append(tree.Subcommands, newCommandTree(child))
+	}
+
+	return tree
+}
+
+var commandsCmd = &cobra.Command{
+	Use:   "commands",
+	Short: "Print the tree of the commands and their flags",
+	Long: `
+Print the tree of the commands of headscale and their flags, for tools
+generating wrappers or documentation. Use --output json for a machine
+readable tree.
+
+Shell completion scripts are generated with 'headscale completion',
+e.g. 'headscale completion zsh'. The node identifiers and the user
+names are completed from the server when it can be reached.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		tree := newCommandTree(rootCmd)
+		if output != "" {
+			SuccessOutput(tree, "", output)
+
+			return
+		}
+
+		var lines []string
+		var printTree func(tree commandTree)
+		printTree = func(tree commandTree) {
+			lines = append(lines, fmt.Sprintf("%-40s %s", tree.Path, tree.Short))
+			for _, child := range tree.Subcommands {
+				printTree(child)
+			}
+		}
+		printTree(tree)
+
+		SuccessOutput(tree, strings.Join(lines, "\n"), output)
+	},
+}
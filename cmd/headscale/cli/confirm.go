@@ -0,0 +1,51 @@
+package cli
+
+import (
+	"errors"
+	"os"
+
+	survey "github.com/AlecAivazis/survey/v2"
+	"github.com/spf13/cobra"
+)
+
+var errConfirmationRequired = errors.New(
+	"confirmation required: stdin is not a terminal, pass --yes to proceed",
+)
+
+// confirmAction asks the user to confirm the action described by the
+// message, and reports if they did. With --yes or --force, the action is
+// confirmed without asking. When there is no terminal to ask on, the
+// command fails instead of waiting for an answer which will never come.
+func confirmAction(cmd *cobra.Command, message string) bool {
+	yes, _ := cmd.Flags().GetBool("yes")
+	force, _ := cmd.Flags().GetBool("force")
+	if yes || force {
+		return true
+	}
+
+	output, _ := cmd.Flags().GetString("output")
+
+	if !stdinIsTerminal() {
+		ErrorOutput(errConfirmationRequired, errConfirmationRequired.Error(), output)
+		os.Exit(1)
+	}
+
+	confirm := false
+	prompt := &survey.Confirm{
+		Message: message,
+	}
+	if err := survey.AskOne(prompt, &confirm); err != nil {
+		return false
+	}
+
+	return confirm
+}
+
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
@@ -1,17 +1,40 @@
 package cli
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/juanfont/headscale/hscontrol"
+	"github.com/juanfont/headscale/hscontrol/notifier"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/pterm/pterm"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc/status"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/health"
+	"tailscale.com/hostinfo"
+	"tailscale.com/net/netmon"
+	"tailscale.com/net/tsdial"
 	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
 )
 
 const (
 	errPreAuthKeyMalformed = Error("key is malformed. expected 64 hex characters with `nodekey` prefix")
+	errStateDumpRequest    = Error("state dump request failed")
 )
 
 // Error is used to compare errors as per https://dave.cheney.net/2016/04/07/constant-errors
@@ -47,6 +70,29 @@ func init() {
 		StringSliceP("route", "r", []string{}, "List (or repeated flags) of routes to advertise")
 
 	debugCmd.AddCommand(createNodeCmd)
+
+	simulateNodeCmd.Flags().String("server", "", "URL of the headscale server (defaults to server_url from the config)")
+	simulateNodeCmd.Flags().StringP("authkey", "k", "", "Pre-auth key used to register the simulated nodes")
+	err = simulateNodeCmd.MarkFlagRequired("authkey")
+	if err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	simulateNodeCmd.Flags().IntP("count", "c", 1, "Number of nodes to simulate")
+	simulateNodeCmd.Flags().String("hostname-prefix", "simulated", "Prefix of the hostname of the simulated nodes")
+	simulateNodeCmd.Flags().Bool("ephemeral", true, "Register the simulated nodes as ephemeral")
+	simulateNodeCmd.Flags().Duration("duration", 0, "How long to keep the map sessions open, 0 runs until interrupted")
+
+	debugCmd.AddCommand(simulateNodeCmd)
+
+	debugCmd.AddCommand(changesCmd)
+	debugCmd.AddCommand(capacityCmd)
+
+	stateDumpCmd.Flags().String("out", "state.json", "File to write the state dump to")
+	stateDumpCmd.Flags().Int("page-size", 100, "Number of nodes to fetch per request")
+	debugCmd.AddCommand(stateDumpCmd)
+
+	loadStateDumpCmd.Flags().String("in", "state.json", "State dump to load")
+	debugCmd.AddCommand(loadStateDumpCmd)
 }
 
 var debugCmd = &cobra.Command{
@@ -138,3 +184,491 @@ var createNodeCmd = &cobra.Command{
 		SuccessOutput(response.GetNode(), "Node created", output)
 	},
 }
+
+var simulateNodeCmd = &cobra.Command{
+	Use:   "simulate-node",
+	Short: "Simulate Tailscale nodes talking to a running headscale",
+	Long: `Simulate one or more Tailscale nodes against a running headscale.
+
+Each simulated node performs the TS2021 (Noise) handshake, registers
+using the given pre-auth key and keeps a streaming map session open,
+logging every network map it receives.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		serverURL, _ := cmd.Flags().GetString("server")
+		if serverURL == "" {
+			serverURL = viper.GetString("server_url")
+		}
+		if serverURL == "" {
+			ErrorOutput(
+				errNoServerURL,
+				"No server URL given, set --server or server_url in the config",
+				output,
+			)
+
+			return
+		}
+
+		authKey, _ := cmd.Flags().GetString("authkey")
+		count, _ := cmd.Flags().GetInt("count")
+		prefix, _ := cmd.Flags().GetString("hostname-prefix")
+		ephemeral, _ := cmd.Flags().GetBool("ephemeral")
+		duration, _ := cmd.Flags().GetDuration("duration")
+
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		if duration > 0 {
+			ctx, cancel = context.WithTimeout(ctx, duration)
+			defer cancel()
+		}
+
+		var errg errgroup.Group
+		for i := 0; i < count; i++ {
+			sim := simulatedNode{
+				serverURL: serverURL,
+				authKey:   authKey,
+				hostname:  fmt.Sprintf("%s-%d", prefix, i),
+				ephemeral: ephemeral,
+			}
+
+			errg.Go(func() error {
+				return sim.run(ctx)
+			})
+		}
+
+		if err := errg.Wait(); err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Simulated node failed: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(nil, "Simulation finished", output)
+	},
+}
+
+const errNoServerURL = Error("no server URL given")
+
+// simulatedNode drives a controlclient.Direct, the same control client
+// tailscaled uses, against headscale without running a data plane.
+type simulatedNode struct {
+	serverURL string
+	authKey   string
+	hostname  string
+	ephemeral bool
+}
+
+func (s *simulatedNode) run(ctx context.Context) error {
+	machineKey := key.NewMachine()
+
+	hi := hostinfo.New()
+	hi.Hostname = s.hostname
+
+	direct, err := controlclient.NewDirect(controlclient.Options{
+		GetMachinePrivateKey: func() (key.MachinePrivate, error) {
+			return machineKey, nil
+		},
+		ServerURL:      s.serverURL,
+		AuthKey:        s.authKey,
+		Hostinfo:       hi,
+		DiscoPublicKey: key.NewDisco().Public(),
+		Logf:           util.TSLogfWrapper(),
+		HealthTracker:  &health.Tracker{},
+		Dialer:         tsdial.NewDialer(netmon.NewStatic()),
+	})
+	if err != nil {
+		return fmt.Errorf("creating control client for %s: %w", s.hostname, err)
+	}
+	defer direct.Close()
+
+	flags := controlclient.LoginDefault
+	if s.ephemeral {
+		flags |= controlclient.LoginEphemeral
+	}
+
+	start := time.Now()
+	authURL, err := direct.TryLogin(ctx, nil, flags)
+	if err != nil {
+		return fmt.Errorf("registering %s: %w", s.hostname, err)
+	}
+
+	if authURL != "" {
+		return fmt.Errorf("registering %s: auth key was not accepted, server asked for interactive login", s.hostname)
+	}
+
+	log.Info().
+		Str("node", s.hostname).
+		Dur("took", time.Since(start)).
+		Msg("Simulated node registered")
+
+	err = direct.PollNetMap(ctx, &simulatedNetmapLogger{
+		hostname: s.hostname,
+		start:    time.Now(),
+	})
+	if err != nil && ctx.Err() == nil {
+		return fmt.Errorf("map session for %s: %w", s.hostname, err)
+	}
+
+	return nil
+}
+
+// simulatedNetmapLogger logs the network maps received by a simulated node.
+type simulatedNetmapLogger struct {
+	hostname string
+	start    time.Time
+	received int
+}
+
+func (l *simulatedNetmapLogger) UpdateFullNetmap(nm *netmap.NetworkMap) {
+	l.received++
+
+	log.Info().
+		Str("node", l.hostname).
+		Int("update", l.received).
+		Int("peers", len(nm.Peers)).
+		Int("packet_filter_rules", nm.PacketFilterRules.Len()).
+		Dur("since_start", time.Since(l.start)).
+		Msg("Simulated node received network map")
+}
+
+var changesCmd = &cobra.Command{
+	Use:   "changes",
+	Short: "List the most recent changes sent to the nodes",
+	Long: `List the most recent state changes headscale has sent to the nodes.
+
+The changes are read from the /debug/changes endpoint served on
+metrics_listen_addr, so the command must be run on a host that can
+reach it.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		addr := viper.GetString("metrics_listen_addr")
+		resp, err := http.Get(fmt.Sprintf("http://%s/debug/changes", addr))
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error fetching changes from %s: %s", addr, err),
+				output,
+			)
+
+			return
+		}
+		defer resp.Body.Close()
+
+		var changes []notifier.ChangeLogEntry
+		if err := json.NewDecoder(resp.Body).Decode(&changes); err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error decoding changes: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		if output != "" {
+			SuccessOutput(changes, "", output)
+
+			return
+		}
+
+		tableData := pterm.TableData{
+			{"Time", "Type", "Origin", "Hostname", "Target", "Changed", "Patched", "Removed"},
+		}
+		for _, change := range changes {
+			target := "-"
+			if change.Target != 0 {
+				target = change.Target.String()
+			}
+
+			tableData = append(tableData, []string{
+				change.Time.Format(HeadscaleDateTimeFormat),
+				change.Type,
+				change.Origin,
+				change.Hostname,
+				target,
+				nodeIDsString(change.ChangedNodes),
+				nodeIDsString(change.PatchedNodes),
+				nodeIDsString(change.RemovedNodes),
+			})
+		}
+
+		err = pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Failed to render pterm table: %s", err),
+				output,
+			)
+
+			return
+		}
+	},
+}
+
+func nodeIDsString(ids []types.NodeID) string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = id.String()
+	}
+
+	return strings.Join(strs, ",")
+}
+
+var capacityCmd = &cobra.Command{
+	Use:   "capacity",
+	Short: "Show the number of nodes compared to the configured limits",
+	Long: `Show how many nodes are registered compared to node_limits.soft
+and node_limits.hard.
+
+The report is read from the /debug/capacity endpoint served on
+metrics_listen_addr, so the command must be run on a host that can
+reach it.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		addr := viper.GetString("metrics_listen_addr")
+		resp, err := http.Get(fmt.Sprintf("http://%s/debug/capacity", addr))
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error fetching capacity from %s: %s", addr, err),
+				output,
+			)
+
+			return
+		}
+		defer resp.Body.Close()
+
+		var capacity hscontrol.NodeCapacity
+		if err := json.NewDecoder(resp.Body).Decode(&capacity); err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error decoding capacity: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		if output != "" {
+			SuccessOutput(capacity, "", output)
+
+			return
+		}
+
+		limitString := func(limit int) string {
+			if limit == 0 {
+				return "unlimited"
+			}
+
+			return strconv.Itoa(limit)
+		}
+
+		remaining := "unlimited"
+		if capacity.Remaining >= 0 {
+			remaining = strconv.FormatInt(capacity.Remaining, 10)
+		}
+
+		tableData := pterm.TableData{
+			{"Nodes", "Soft limit", "Hard limit", "Remaining"},
+			{
+				strconv.FormatInt(capacity.Nodes, 10),
+				limitString(capacity.SoftLimit),
+				limitString(capacity.HardLimit),
+				remaining,
+			},
+		}
+
+		err = pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Failed to render pterm table: %s", err),
+				output,
+			)
+
+			return
+		}
+	},
+}
+
+var stateDumpCmd = &cobra.Command{
+	Use:   "dump",
+	Short: "Write a sanitized snapshot of the state of headscale to a file",
+	Long: `Write a snapshot of the nodes, routes, users, policy hash, notifier
+state and configuration of headscale to a file which can be attached to
+bug reports. Secrets in the configuration are redacted, the policy file
+and auth keys are not part of the dump.
+
+The state is read from the /debug/state endpoint served on
+metrics_listen_addr, so the command must be run on a host that can
+reach it.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		out, _ := cmd.Flags().GetString("out")
+		pageSize, _ := cmd.Flags().GetInt("page-size")
+
+		addr := viper.GetString("metrics_listen_addr")
+
+		var dump *hscontrol.StateDump
+		for page := 1; page != 0; {
+			next, err := fetchStateDumpPage(addr, page, pageSize)
+			if err != nil {
+				ErrorOutput(
+					err,
+					fmt.Sprintf("Error fetching state from %s: %s", addr, err),
+					output,
+				)
+
+				return
+			}
+
+			if dump == nil {
+				dump = next
+			} else {
+				dump.Nodes = append(dump.Nodes, next.Nodes...)
+			}
+
+			page = next.NextPage
+		}
+		dump.Page, dump.PageSize, dump.NextPage = 0, 0, 0
+
+		data, err := json.MarshalIndent(dump, "", "  ")
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error encoding state dump: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		if err := os.WriteFile(out, data, 0o600); err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error writing state dump to %s: %s", out, err),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(
+			map[string]any{"file": out, "nodes": len(dump.Nodes)},
+			fmt.Sprintf("State of %d nodes written to %s", len(dump.Nodes), out),
+			output,
+		)
+	},
+}
+
+// fetchStateDumpPage fetches one page of the state dump, waiting and
+// retrying while the endpoint is rate limited.
+func fetchStateDumpPage(addr string, page, pageSize int) (*hscontrol.StateDump, error) {
+	url := fmt.Sprintf("http://%s/debug/state?page=%d&page_size=%d", addr, page, pageSize)
+
+	for {
+		resp, err := http.Get(url)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests {
+			resp.Body.Close()
+
+			wait := time.Second
+			if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+				wait = time.Duration(seconds) * time.Second
+			}
+			time.Sleep(wait)
+
+			continue
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+
+			return nil, fmt.Errorf("%w: %s", errStateDumpRequest, resp.Status)
+		}
+
+		var dump hscontrol.StateDump
+		err = json.NewDecoder(resp.Body).Decode(&dump)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		return &dump, nil
+	}
+}
+
+var loadStateDumpCmd = &cobra.Command{
+	Use:   "load-dump",
+	Short: "Load a state dump into an empty database to reproduce an issue",
+	Long: `Load the users, nodes and routes of a state dump written by
+"headscale debug dump" into the database of the configuration. The
+database must be empty.
+
+The dump does not contain the policy, the policy file of the
+configuration is used and a warning is logged if it does not match the
+policy the dump was taken with.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		in, _ := cmd.Flags().GetString("in")
+
+		data, err := os.ReadFile(in)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error reading state dump %s: %s", in, err),
+				output,
+			)
+
+			return
+		}
+
+		var dump hscontrol.StateDump
+		if err := json.Unmarshal(data, &dump); err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error decoding state dump %s: %s", in, err),
+				output,
+			)
+
+			return
+		}
+
+		app, err := getHeadscaleApp()
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error initializing headscale: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		if err := app.LoadStateDump(&dump); err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error loading state dump: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(
+			map[string]any{"users": len(dump.Users), "nodes": len(dump.Nodes)},
+			fmt.Sprintf("Loaded %d users and %d nodes", len(dump.Users), len(dump.Nodes)),
+			output,
+		)
+	},
+}
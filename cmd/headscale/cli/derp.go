@@ -0,0 +1,193 @@
+package cli
+
+import (
+	"fmt"
+	"strconv"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/pterm/pterm"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(derpCmd)
+	derpCmd.AddCommand(listDERPRegionsCmd)
+
+	addDERPRegionCmd.Flags().Int32P("region-id", "r", 0, "Region ID, must not be used by another region")
+	addDERPRegionCmd.Flags().StringP("code", "c", "", "Short region code, e.g. \"ams\"")
+	addDERPRegionCmd.Flags().String("name", "", "Long region name, e.g. \"Amsterdam\"")
+	addDERPRegionCmd.Flags().String("host", "", "Hostname of the DERP server")
+	addDERPRegionCmd.Flags().String("ipv4", "", "IPv4 address of the DERP server, resolved from the hostname if empty")
+	addDERPRegionCmd.Flags().String("ipv6", "", "IPv6 address of the DERP server, resolved from the hostname if empty")
+	addDERPRegionCmd.Flags().Int32("derp-port", 0, "DERP port of the server, 443 if 0")
+	addDERPRegionCmd.Flags().Int32("stun-port", 0, "STUN port of the server, 3478 if 0, disabled if -1")
+	for _, flag := range []string{"region-id", "code", "host"} {
+		if err := addDERPRegionCmd.MarkFlagRequired(flag); err != nil {
+			log.Fatal().Err(err).Msg("")
+		}
+	}
+	derpCmd.AddCommand(addDERPRegionCmd)
+
+	removeDERPRegionCmd.Flags().Int32P("region-id", "r", 0, "Region ID")
+	if err := removeDERPRegionCmd.MarkFlagRequired("region-id"); err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	derpCmd.AddCommand(removeDERPRegionCmd)
+}
+
+var derpCmd = &cobra.Command{
+	Use:   "derp",
+	Short: "Manage the regions of the DERP map",
+}
+
+var listDERPRegionsCmd = &cobra.Command{
+	Use:     "list",
+	Short:   "List the DERP regions and their health",
+	Aliases: []string{"ls", "show"},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.ListDERPRegions(ctx, &v1.ListDERPRegionsRequest{})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot get DERP regions: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		if output != "" {
+			SuccessOutput(response.GetRegions(), "", output)
+
+			return
+		}
+
+		tableData := pterm.TableData{
+			{"ID", "Code", "Name", "Nodes", "Custom", "Healthy", "Latency", "Last error"},
+		}
+		for _, region := range response.GetRegions() {
+			healthy := pterm.LightGreen("yes")
+			if !region.GetHealthy() {
+				healthy = pterm.LightRed("no")
+			}
+
+			latency := "-"
+			if region.GetLastProbe() != nil && region.GetLastError() == "" {
+				latency = fmt.Sprintf("%.1fms", region.GetLatencyMs())
+			}
+
+			tableData = append(tableData, []string{
+				strconv.FormatInt(int64(region.GetRegionId()), 10),
+				region.GetRegionCode(),
+				region.GetRegionName(),
+				strconv.Itoa(len(region.GetNodes())),
+				strconv.FormatBool(region.GetCustom()),
+				healthy,
+				latency,
+				region.GetLastError(),
+			})
+		}
+
+		err = pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Failed to render pterm table: %s", err),
+				output,
+			)
+
+			return
+		}
+	},
+}
+
+var addDERPRegionCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Add a custom DERP region with a single DERP server",
+	Long: `
+Add a custom DERP region with a single DERP server. The region is
+sent to all the nodes right away and kept across restarts.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		regionID, _ := cmd.Flags().GetInt32("region-id")
+		code, _ := cmd.Flags().GetString("code")
+		name, _ := cmd.Flags().GetString("name")
+		host, _ := cmd.Flags().GetString("host")
+		ipv4, _ := cmd.Flags().GetString("ipv4")
+		ipv6, _ := cmd.Flags().GetString("ipv6")
+		derpPort, _ := cmd.Flags().GetInt32("derp-port")
+		stunPort, _ := cmd.Flags().GetInt32("stun-port")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		request := &v1.AddDERPRegionRequest{
+			Region: &v1.DERPRegion{
+				RegionId:   regionID,
+				RegionCode: code,
+				RegionName: name,
+				Nodes: []*v1.DERPNode{
+					{
+						HostName: host,
+						Ipv4:     ipv4,
+						Ipv6:     ipv6,
+						DerpPort: derpPort,
+						StunPort: stunPort,
+					},
+				},
+			},
+		}
+
+		response, err := client.AddDERPRegion(ctx, request)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot add DERP region: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response.GetRegion(), "DERP region added", output)
+	},
+}
+
+var removeDERPRegionCmd = &cobra.Command{
+	Use:     "remove",
+	Short:   "Remove a custom DERP region",
+	Aliases: []string{"rm", "delete", "del"},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		regionID, _ := cmd.Flags().GetInt32("region-id")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.RemoveDERPRegion(ctx, &v1.RemoveDERPRegionRequest{
+			RegionId: regionID,
+		})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot remove DERP region: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response, "DERP region removed", output)
+	},
+}
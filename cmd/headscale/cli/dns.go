@@ -0,0 +1,314 @@
+package cli
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/pterm/pterm"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(dnsCmd)
+	dnsCmd.AddCommand(dnsRecordsCmd)
+	dnsRecordsCmd.AddCommand(listDNSRecordsCmd)
+
+	addDNSRecordCmd.Flags().StringP("name", "n", "", "Fully qualified name of the record, e.g. \"grafana.myvpn.example.com\"")
+	addDNSRecordCmd.Flags().StringP("type", "t", "A", "Type of the record: A, AAAA, CNAME or TXT")
+	addDNSRecordCmd.Flags().StringP("value", "v", "", "Value of the record, an IP address for A and AAAA records")
+	for _, flag := range []string{"name", "value"} {
+		if err := addDNSRecordCmd.MarkFlagRequired(flag); err != nil {
+			log.Fatal().Err(err).Msg("")
+		}
+	}
+	dnsRecordsCmd.AddCommand(addDNSRecordCmd)
+
+	deleteDNSRecordCmd.Flags().Uint64P("id", "i", 0, "ID of the record")
+	if err := deleteDNSRecordCmd.MarkFlagRequired("id"); err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	dnsRecordsCmd.AddCommand(deleteDNSRecordCmd)
+
+	dnsCmd.AddCommand(dnsNameserversCmd)
+	dnsNameserversCmd.AddCommand(listScopedNameserversCmd)
+
+	addScopedNameserversCmd.Flags().StringP("domain", "d", "", "Domain resolved by the nameservers, e.g. \"corp.example.com\"")
+	addScopedNameserversCmd.Flags().StringSliceP("nameserver", "n", nil, "IP address or DNS-over-HTTPS URL of a nameserver, can be repeated")
+	addScopedNameserversCmd.Flags().StringSlice("node", nil, "User or tag of the nodes using the nameservers, \"*\" for all, can be repeated")
+	for _, flag := range []string{"domain", "nameserver", "node"} {
+		if err := addScopedNameserversCmd.MarkFlagRequired(flag); err != nil {
+			log.Fatal().Err(err).Msg("")
+		}
+	}
+	dnsNameserversCmd.AddCommand(addScopedNameserversCmd)
+
+	deleteScopedNameserversCmd.Flags().Uint64P("id", "i", 0, "ID of the scoped nameservers")
+	if err := deleteScopedNameserversCmd.MarkFlagRequired("id"); err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	dnsNameserversCmd.AddCommand(deleteScopedNameserversCmd)
+}
+
+var dnsCmd = &cobra.Command{
+	Use:   "dns",
+	Short: "Manage the DNS configuration sent to the nodes",
+}
+
+var dnsRecordsCmd = &cobra.Command{
+	Use:     "records",
+	Short:   "Manage the extra DNS records",
+	Aliases: []string{"record"},
+}
+
+var listDNSRecordsCmd = &cobra.Command{
+	Use:     "list",
+	Short:   "List the extra DNS records added through the API",
+	Aliases: []string{"ls", "show"},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.ListDNSRecords(ctx, &v1.ListDNSRecordsRequest{})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot get DNS records: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		if output != "" {
+			SuccessOutput(response.GetRecords(), "", output)
+
+			return
+		}
+
+		tableData := pterm.TableData{
+			{"ID", "Name", "Type", "Value", "Created"},
+		}
+		for _, record := range response.GetRecords() {
+			tableData = append(tableData, []string{
+				strconv.FormatUint(record.GetId(), 10),
+				record.GetName(),
+				record.GetType(),
+				record.GetValue(),
+				record.GetCreatedAt().AsTime().Format(HeadscaleDateTimeFormat),
+			})
+		}
+
+		err = pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Failed to render pterm table: %s", err),
+				output,
+			)
+
+			return
+		}
+	},
+}
+
+var addDNSRecordCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Add an extra DNS record",
+	Long: `
+Add an extra DNS record to MagicDNS. The record is sent to all the
+nodes right away and kept across restarts. Tailscale clients only
+answer A and AAAA records at the moment.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		name, _ := cmd.Flags().GetString("name")
+		recordType, _ := cmd.Flags().GetString("type")
+		value, _ := cmd.Flags().GetString("value")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.AddDNSRecord(ctx, &v1.AddDNSRecordRequest{
+			Name:  name,
+			Type:  recordType,
+			Value: value,
+		})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot add DNS record: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response.GetRecord(), "DNS record added", output)
+	},
+}
+
+var deleteDNSRecordCmd = &cobra.Command{
+	Use:     "delete",
+	Short:   "Delete an extra DNS record",
+	Aliases: []string{"remove", "rm", "del"},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		id, _ := cmd.Flags().GetUint64("id")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.DeleteDNSRecord(ctx, &v1.DeleteDNSRecordRequest{Id: id})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot delete DNS record: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response, "DNS record deleted", output)
+	},
+}
+
+var dnsNameserversCmd = &cobra.Command{
+	Use:     "nameservers",
+	Short:   "Manage the nameservers of domains scoped to some of the nodes (split DNS)",
+	Aliases: []string{"nameserver", "ns"},
+}
+
+var listScopedNameserversCmd = &cobra.Command{
+	Use:     "list",
+	Short:   "List the scoped nameservers of the configuration and the API",
+	Aliases: []string{"ls", "show"},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.ListScopedNameservers(ctx, &v1.ListScopedNameserversRequest{})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot get scoped nameservers: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		if output != "" {
+			SuccessOutput(response.GetNameservers(), "", output)
+
+			return
+		}
+
+		tableData := pterm.TableData{
+			{"ID", "Domain", "Nameservers", "Nodes"},
+		}
+		for _, nameservers := range response.GetNameservers() {
+			// Nameservers of the configuration are not stored and
+			// cannot be deleted.
+			id := "config"
+			if nameservers.GetId() != 0 {
+				id = strconv.FormatUint(nameservers.GetId(), 10)
+			}
+
+			tableData = append(tableData, []string{
+				id,
+				nameservers.GetDomain(),
+				strings.Join(nameservers.GetNameservers(), ", "),
+				strings.Join(nameservers.GetNodes(), ", "),
+			})
+		}
+
+		err = pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Failed to render pterm table: %s", err),
+				output,
+			)
+
+			return
+		}
+	},
+}
+
+var addScopedNameserversCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Add nameservers of a domain scoped to some of the nodes",
+	Long: `
+Add nameservers resolving a domain for the nodes of the given users or
+with the given tags only. They are sent to the nodes right away and kept
+across restarts.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		domain, _ := cmd.Flags().GetString("domain")
+		nameservers, _ := cmd.Flags().GetStringSlice("nameserver")
+		nodes, _ := cmd.Flags().GetStringSlice("node")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.AddScopedNameservers(ctx, &v1.AddScopedNameserversRequest{
+			Domain:      domain,
+			Nameservers: nameservers,
+			Nodes:       nodes,
+		})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot add scoped nameservers: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response.GetNameservers(), "Scoped nameservers added", output)
+	},
+}
+
+var deleteScopedNameserversCmd = &cobra.Command{
+	Use:     "delete",
+	Short:   "Delete scoped nameservers added through the API",
+	Aliases: []string{"remove", "rm", "del"},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		id, _ := cmd.Flags().GetUint64("id")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.DeleteScopedNameservers(ctx, &v1.DeleteScopedNameserversRequest{Id: id})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot delete scoped nameservers: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response, "Scoped nameservers deleted", output)
+	},
+}
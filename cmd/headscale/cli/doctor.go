@@ -0,0 +1,489 @@
+package cli
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/derp"
+	"github.com/juanfont/headscale/hscontrol/notifier"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+	"tailscale.com/types/key"
+)
+
+const (
+	// doctorServerTimeout is how long the doctor waits for the debug
+	// endpoints of the running server.
+	doctorServerTimeout = 5 * time.Second
+
+	// certificateExpiryWarning is how long before its expiry a
+	// certificate is reported.
+	certificateExpiryWarning = 14 * 24 * time.Hour
+)
+
+type doctorStatus string
+
+const (
+	doctorOK   doctorStatus = "ok"
+	doctorWarn doctorStatus = "warn"
+	doctorFail doctorStatus = "fail"
+)
+
+// doctorResult is the outcome of one check of `headscale doctor`, with
+// how to fix the problem it found.
+type doctorResult struct {
+	Check   string       `json:"check"`
+	Status  doctorStatus `json:"status"`
+	Message string       `json:"message"`
+	Fix     string       `json:"fix,omitempty"`
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+}
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Diagnose the configuration and the running server",
+	Long: `
+Check the configuration, the database and its pending migrations, the
+noise private key, the DERP map sources, the TLS certificate and the
+listen addresses, and the health of the batcher of the running server,
+and report the problems found with how to fix them.
+
+The running server is reached on metrics_listen_addr, so the command
+must be run on a host that can reach it. The command exits with an
+error if a check fails.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		results := runDoctor()
+
+		if output == "" {
+			tableData := pterm.TableData{{"Check", "Status", "Message", "Fix"}}
+			for _, result := range results {
+				status := string(result.Status)
+				switch result.Status {
+				case doctorOK:
+					status = pterm.LightGreen(status)
+				case doctorWarn:
+					status = pterm.LightYellow(status)
+				case doctorFail:
+					status = pterm.LightRed(status)
+				}
+
+				tableData = append(tableData, []string{result.Check, status, result.Message, result.Fix})
+			}
+
+			err := pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+			if err != nil {
+				ErrorOutput(
+					err,
+					fmt.Sprintf("Failed to render pterm table: %s", err),
+					output,
+				)
+
+				return
+			}
+		} else {
+			SuccessOutput(results, "", output)
+		}
+
+		for _, result := range results {
+			if result.Status == doctorFail {
+				os.Exit(1)
+			}
+		}
+	},
+}
+
+// runDoctor runs the checks of `headscale doctor`. The checks needing
+// the configuration are skipped when it cannot be loaded.
+func runDoctor() []doctorResult {
+	if err := loadConfigFile(); err != nil {
+		return []doctorResult{{
+			Check:   "config",
+			Status:  doctorFail,
+			Message: err.Error(),
+			Fix:     "Pass the configuration with --config, or fix the file, see config-example.yaml",
+		}}
+	}
+
+	cfg, err := types.GetHeadscaleConfig()
+	if err != nil {
+		return []doctorResult{{
+			Check:   "config",
+			Status:  doctorFail,
+			Message: err.Error(),
+			Fix:     "Fix the configuration, see config-example.yaml",
+		}}
+	}
+
+	results := []doctorResult{{
+		Check:   "config",
+		Status:  doctorOK,
+		Message: "configuration is valid",
+	}}
+
+	results = append(results, doctorServerURL(cfg))
+	results = append(results, doctorDatabase(cfg))
+	results = append(results, doctorNoiseKey(cfg))
+	results = append(results, doctorDERP(cfg)...)
+	results = append(results, doctorTLS(cfg)...)
+
+	debugInfo, serverErr := fetchBatcherDebugInfo(cfg.MetricsAddr)
+	results = append(results, doctorListeners(cfg, serverErr == nil)...)
+	results = append(results, doctorBatcher(debugInfo, serverErr))
+
+	return results
+}
+
+func doctorServerURL(cfg *types.Config) doctorResult {
+	serverURL, err := url.Parse(cfg.ServerURL)
+	if err != nil || (serverURL.Scheme != "http" && serverURL.Scheme != "https") || serverURL.Host == "" {
+		return doctorResult{
+			Check:   "server_url",
+			Status:  doctorFail,
+			Message: fmt.Sprintf("%q is not an http or https URL", cfg.ServerURL),
+			Fix:     "Set server_url to the URL the nodes reach headscale on, e.g. https://headscale.example.com",
+		}
+	}
+
+	if serverURL.Scheme == "http" {
+		return doctorResult{
+			Check:   "server_url",
+			Status:  doctorWarn,
+			Message: fmt.Sprintf("%s is not served over https", cfg.ServerURL),
+			Fix:     "Use https, with tls_cert_path, tls_letsencrypt_hostname or a reverse proxy terminating TLS",
+		}
+	}
+
+	return doctorResult{
+		Check:   "server_url",
+		Status:  doctorOK,
+		Message: cfg.ServerURL,
+	}
+}
+
+func doctorDatabase(cfg *types.Config) doctorResult {
+	pending, err := db.PendingMigrations(cfg.Database)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return doctorResult{
+			Check:   "database",
+			Status:  doctorWarn,
+			Message: fmt.Sprintf("the database %s does not exist", cfg.Database.Sqlite.Path),
+			Fix:     "It is created when headscale starts, check database.sqlite.path if it should exist",
+		}
+	case err != nil:
+		return doctorResult{
+			Check:   "database",
+			Status:  doctorFail,
+			Message: err.Error(),
+			Fix:     "Check the database settings and that the database is reachable from this host",
+		}
+	case len(pending) > 0:
+		return doctorResult{
+			Check:   "database",
+			Status:  doctorWarn,
+			Message: fmt.Sprintf("%d migrations pending: %s", len(pending), strings.Join(pending, ", ")),
+			Fix:     "Back up the database, the migrations are applied when headscale starts",
+		}
+	}
+
+	return doctorResult{
+		Check:   "database",
+		Status:  doctorOK,
+		Message: fmt.Sprintf("%s database is reachable and migrated", cfg.Database.Type),
+	}
+}
+
+func doctorNoiseKey(cfg *types.Config) doctorResult {
+	data, err := os.ReadFile(cfg.NoisePrivateKeyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return doctorResult{
+			Check:   "noise_key",
+			Status:  doctorWarn,
+			Message: fmt.Sprintf("%s does not exist", cfg.NoisePrivateKeyPath),
+			Fix:     "It is created when headscale starts, the nodes must register again if an existing key was lost",
+		}
+	}
+	if err != nil {
+		return doctorResult{
+			Check:   "noise_key",
+			Status:  doctorFail,
+			Message: err.Error(),
+			Fix:     "Make noise.private_key_path readable by the user running headscale",
+		}
+	}
+
+	var machineKey key.MachinePrivate
+	if err := machineKey.UnmarshalText([]byte(strings.TrimSpace(string(data)))); err != nil {
+		return doctorResult{
+			Check:   "noise_key",
+			Status:  doctorFail,
+			Message: fmt.Sprintf("%s is not a private key: %s", cfg.NoisePrivateKeyPath, err),
+			Fix:     "Restore the key from a backup, or remove it to create a new one and register the nodes again",
+		}
+	}
+
+	return doctorResult{
+		Check:   "noise_key",
+		Status:  doctorOK,
+		Message: fmt.Sprintf("%s is a valid private key", cfg.NoisePrivateKeyPath),
+	}
+}
+
+func doctorDERP(cfg *types.Config) []doctorResult {
+	var results []doctorResult
+
+	regions := 0
+	for _, source := range derp.CheckSources(cfg.DERP) {
+		if source.Err != nil {
+			results = append(results, doctorResult{
+				Check:   "derp",
+				Status:  doctorFail,
+				Message: fmt.Sprintf("loading %s: %s", source.Source, source.Err),
+				Fix:     "Check that the DERP map source exists and is reachable from the server",
+			})
+
+			continue
+		}
+
+		regions += source.Regions
+		results = append(results, doctorResult{
+			Check:   "derp",
+			Status:  doctorOK,
+			Message: fmt.Sprintf("%s has %d regions", source.Source, source.Regions),
+		})
+	}
+
+	if cfg.DERP.ServerEnabled {
+		regions++
+
+		if cfg.DERP.STUNAddr == "" {
+			results = append(results, doctorResult{
+				Check:   "derp",
+				Status:  doctorFail,
+				Message: "the embedded DERP server has no STUN address",
+				Fix:     "Set derp.server.stun_listen_addr",
+			})
+		}
+	}
+
+	if regions == 0 {
+		results = append(results, doctorResult{
+			Check:   "derp",
+			Status:  doctorFail,
+			Message: "the DERP map has no regions, the nodes cannot relay their traffic",
+			Fix:     "Set derp.urls or derp.paths, or enable the embedded DERP server",
+		})
+	}
+
+	return results
+}
+
+func doctorTLS(cfg *types.Config) []doctorResult {
+	if cfg.TLS.LetsEncrypt.Hostname != "" {
+		result := doctorResult{
+			Check:   "tls",
+			Status:  doctorOK,
+			Message: fmt.Sprintf("certificate of %s from Let's Encrypt", cfg.TLS.LetsEncrypt.Hostname),
+		}
+
+		_, port, _ := net.SplitHostPort(cfg.Addr)
+		if cfg.TLS.LetsEncrypt.ChallengeType == types.TLSALPN01ChallengeType && port != "443" {
+			result.Status = doctorWarn
+			result.Message = fmt.Sprintf("the %s challenge is answered on %s, not on port 443", types.TLSALPN01ChallengeType, cfg.Addr)
+			result.Fix = "Listen on port 443, or use the HTTP-01 challenge"
+		}
+
+		return []doctorResult{result}
+	}
+
+	if cfg.TLS.CertPath == "" {
+		return []doctorResult{{
+			Check:   "tls",
+			Status:  doctorOK,
+			Message: "no certificate configured, TLS is expected to be terminated by a reverse proxy",
+		}}
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.TLS.CertPath, cfg.TLS.KeyPath)
+	if err != nil {
+		return []doctorResult{{
+			Check:   "tls",
+			Status:  doctorFail,
+			Message: err.Error(),
+			Fix:     "Check tls_cert_path and tls_key_path",
+		}}
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return []doctorResult{{
+			Check:   "tls",
+			Status:  doctorFail,
+			Message: err.Error(),
+			Fix:     "Check tls_cert_path",
+		}}
+	}
+
+	switch until := time.Until(leaf.NotAfter); {
+	case until <= 0:
+		return []doctorResult{{
+			Check:   "tls",
+			Status:  doctorFail,
+			Message: fmt.Sprintf("the certificate expired on %s", leaf.NotAfter.Format(HeadscaleDateTimeFormat)),
+			Fix:     "Renew the certificate",
+		}}
+	case until < certificateExpiryWarning:
+		return []doctorResult{{
+			Check:   "tls",
+			Status:  doctorWarn,
+			Message: fmt.Sprintf("the certificate expires on %s", leaf.NotAfter.Format(HeadscaleDateTimeFormat)),
+			Fix:     "Renew the certificate",
+		}}
+	}
+
+	return []doctorResult{{
+		Check:   "tls",
+		Status:  doctorOK,
+		Message: fmt.Sprintf("the certificate is valid until %s", leaf.NotAfter.Format(HeadscaleDateTimeFormat)),
+	}}
+}
+
+// doctorListeners checks that the listen addresses are distinct, and
+// that they are free when the server is not running.
+func doctorListeners(cfg *types.Config, serverRunning bool) []doctorResult {
+	var results []doctorResult
+
+	listeners := []struct{ name, addr string }{
+		{"listen_addr", cfg.Addr},
+		{"metrics_listen_addr", cfg.MetricsAddr},
+		{"grpc_listen_addr", cfg.GRPCAddr},
+	}
+	if network, addr := types.DebugListenAddr(cfg.DebugAddr); network == "tcp" && addr != "" {
+		listeners = append(listeners, struct{ name, addr string }{"debug_listen_addr", addr})
+	}
+
+	seen := map[string]string{}
+	for _, listener := range listeners {
+		if other, ok := seen[listener.addr]; ok {
+			results = append(results, doctorResult{
+				Check:   "listen",
+				Status:  doctorFail,
+				Message: fmt.Sprintf("%s and %s are both %s", other, listener.name, listener.addr),
+				Fix:     "Give every listener its own address",
+			})
+
+			continue
+		}
+		seen[listener.addr] = listener.name
+
+		if serverRunning {
+			continue
+		}
+
+		ln, err := net.Listen("tcp", listener.addr)
+		if err != nil {
+			results = append(results, doctorResult{
+				Check:   "listen",
+				Status:  doctorFail,
+				Message: fmt.Sprintf("cannot listen on %s %s: %s", listener.name, listener.addr, err),
+				Fix:     "Free the port, or change the address, ports below 1024 need privileges",
+			})
+
+			continue
+		}
+		ln.Close()
+	}
+
+	if len(results) == 0 {
+		results = append(results, doctorResult{
+			Check:   "listen",
+			Status:  doctorOK,
+			Message: "the listen addresses are usable",
+		})
+	}
+
+	return results
+}
+
+func fetchBatcherDebugInfo(addr string) (*notifier.DebugInfo, error) {
+	client := http.Client{Timeout: doctorServerTimeout}
+
+	resp, err := client.Get(fmt.Sprintf("http://%s/debug/batcher", addr))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var info notifier.DebugInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("decoding batcher state: %w", err)
+	}
+
+	return &info, nil
+}
+
+// doctorBatcher reports the nodes whose update queue is full, their map
+// session is stuck and they do not get updates anymore.
+func doctorBatcher(info *notifier.DebugInfo, err error) doctorResult {
+	if err != nil {
+		return doctorResult{
+			Check:   "server",
+			Status:  doctorWarn,
+			Message: fmt.Sprintf("the running server cannot be reached: %s", err),
+			Fix:     "Start headscale, or run the doctor where metrics_listen_addr is reachable",
+		}
+	}
+
+	connected := 0
+	var stuck []string
+	for _, node := range info.Nodes {
+		if !node.Connected {
+			continue
+		}
+		connected++
+
+		if node.QueueSize > 0 && node.QueueDepth >= node.QueueSize {
+			stuck = append(stuck, node.ID.String())
+		}
+	}
+
+	if len(stuck) > 0 {
+		return doctorResult{
+			Check:   "server",
+			Status:  doctorFail,
+			Message: fmt.Sprintf("the update queues of nodes %s are full", strings.Join(stuck, ", ")),
+			Fix:     "Check the connections of the nodes with 'headscale debug changes', restarting tailscaled on them reconnects them",
+		}
+	}
+
+	return doctorResult{
+		Check:  "server",
+		Status: doctorOK,
+		Message: fmt.Sprintf(
+			"%d nodes connected, %d changes and %d patches pending",
+			connected,
+			len(info.PendingChanges),
+			len(info.PendingPatches),
+		),
+	}
+}
@@ -0,0 +1,89 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func init() {
+	rootCmd.AddCommand(eventsCmd)
+
+	watchEventsCmd.Flags().
+		StringSliceP("event", "e", []string{}, "Event to watch, e.g. node.online, all events if not set")
+	eventsCmd.AddCommand(watchEventsCmd)
+}
+
+var eventsCmd = &cobra.Command{
+	Use:   "events",
+	Short: "Follow the events of the nodes and users",
+}
+
+var watchEventsCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Print the events as they happen, until interrupted",
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		eventTypes, _ := cmd.Flags().GetStringSlice("event")
+
+		_, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		// The stream is not bound by the timeout of the CLI.
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		stream, err := client.WatchEvents(ctx, &v1.WatchEventsRequest{Events: eventTypes})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot watch events: %s", status.Convert(err).Message()),
+				output,
+			)
+
+			return
+		}
+
+		for {
+			event, err := stream.Recv()
+			if errors.Is(err, io.EOF) || status.Code(err) == codes.Canceled {
+				return
+			}
+			if err != nil {
+				ErrorOutput(
+					err,
+					fmt.Sprintf("Cannot watch events: %s", status.Convert(err).Message()),
+					output,
+				)
+
+				return
+			}
+
+			subject := event.GetUser().GetName()
+			if event.GetNode() != nil {
+				subject = fmt.Sprintf("%s (%d)", event.GetNode().GetGivenName(), event.GetNode().GetId())
+			}
+
+			SuccessOutput(
+				event,
+				fmt.Sprintf(
+					"%s %s %s",
+					event.GetTime().AsTime().Format("2006-01-02 15:04:05"),
+					event.GetType(),
+					subject,
+				),
+				output,
+			)
+		}
+	},
+}
@@ -0,0 +1,606 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/prometheus/common/model"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// tailscaleAPITimeout is how long a request to the Tailscale API may
+	// take.
+	tailscaleAPITimeout = 30 * time.Second
+
+	// DefaultImportKeyExpiry is the default expiration of the pre auth
+	// keys created for the imported devices.
+	DefaultImportKeyExpiry = "24h"
+)
+
+var (
+	errTailscaleAPI      = errors.New("Tailscale API request failed")
+	errNoTailscaleAPIKey = errors.New("no Tailscale API key, set --api-key or TS_API_KEY")
+)
+
+type recordStatus string
+
+const (
+	recordPlanned recordStatus = "planned"
+	recordCreated recordStatus = "created"
+	recordUpdated recordStatus = "updated"
+	recordDeleted recordStatus = "deleted"
+	recordExists  recordStatus = "exists"
+	recordSkipped recordStatus = "skipped"
+	recordManual  recordStatus = "manual"
+	recordFailed  recordStatus = "failed"
+)
+
+// recordAction is one record of `headscale import` or `headscale apply`,
+// what is or would be done for it.
+type recordAction struct {
+	Kind    string       `json:"kind"`
+	Name    string       `json:"name"`
+	Status  recordStatus `json:"status"`
+	Message string       `json:"message"`
+}
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+
+	importTailscaleCmd.Flags().String("api-key", "", "Tailscale API access token, read from TS_API_KEY if not set")
+	importTailscaleCmd.Flags().String("tailnet", "-", "Name of the Tailscale tailnet, e.g. \"example.com\", \"-\" for the tailnet of the key")
+	importTailscaleCmd.Flags().String("api-url", "https://api.tailscale.com", "URL of the Tailscale API")
+	importTailscaleCmd.Flags().Bool("dry-run", false, "Only report what would be imported")
+	importTailscaleCmd.Flags().
+		StringP("expiration", "e", DefaultImportKeyExpiry, "Human-readable expiration of the pre auth keys of the devices (e.g. 30m, 24h)")
+	importCmd.AddCommand(importTailscaleCmd)
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Import the records of another coordination server",
+}
+
+var importTailscaleCmd = &cobra.Command{
+	Use:   "tailscale",
+	Short: "Import the users, devices, ACL policy and DNS settings of a Tailscale tailnet",
+	Long: `
+Import a tailnet of the Tailscale SaaS through the Tailscale API, to ease
+the migration to headscale:
+
+- a user is created for each member of the tailnet, named like the users
+  logging in with OIDC (see oidc.strip_email_domain),
+- the ACL policy is set, with acl_policy_mode set to database, after
+  replacing the login names of the members by the names of the users,
+- the split DNS nameservers are added as scoped nameservers,
+- a single use pre auth key is created for each device, with its tags
+  and its addresses as IP pools, so it keeps them once it logs in with
+  the key.
+
+The global nameservers, search domains and MagicDNS setting are part of
+the configuration file and are reported to be set by hand, as are the
+routes of the devices to enable once they are registered. The records
+which exist already are left unchanged. With --dry-run nothing is
+created and the report shows what would be.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		apiKey, _ := cmd.Flags().GetString("api-key")
+		tailnet, _ := cmd.Flags().GetString("tailnet")
+		apiURL, _ := cmd.Flags().GetString("api-url")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+		if apiKey == "" {
+			apiKey = os.Getenv("TS_API_KEY")
+		}
+		if apiKey == "" {
+			ErrorOutput(errNoTailscaleAPIKey, errNoTailscaleAPIKey.Error(), output)
+
+			return
+		}
+
+		durationStr, _ := cmd.Flags().GetString("expiration")
+		duration, err := model.ParseDuration(durationStr)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Could not parse duration: %s\n", err),
+				output,
+			)
+
+			return
+		}
+
+		api := &tailscaleAPI{
+			url:     strings.TrimSuffix(apiURL, "/"),
+			key:     apiKey,
+			tailnet: tailnet,
+			client:  &http.Client{Timeout: tailscaleAPITimeout},
+		}
+
+		tailnetData, err := api.fetch()
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot read the tailnet from the Tailscale API: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		importer := &tailscaleImporter{
+			recordActions: recordActions{dryRun: dryRun},
+			ctx:           ctx,
+			client:        client,
+			expiration:    time.Now().UTC().Add(time.Duration(duration)),
+		}
+
+		actions, err := importer.run(tailnetData)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot import the tailnet: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		printRecordActions(actions, output)
+	},
+}
+
+// recordActions collects the report of `headscale import` or `headscale
+// apply`.
+type recordActions struct {
+	dryRun  bool
+	actions []recordAction
+}
+
+func (r *recordActions) add(kind, name string, status recordStatus, message string) {
+	r.actions = append(r.actions, recordAction{
+		Kind:    kind,
+		Name:    name,
+		Status:  status,
+		Message: message,
+	})
+}
+
+// change runs change unless it is a dry run, and records the outcome
+// with status, or as planned or failed.
+func (r *recordActions) change(kind, name string, status recordStatus, message string, change func() error) bool {
+	if r.dryRun {
+		r.add(kind, name, recordPlanned, message)
+
+		return true
+	}
+
+	if err := change(); err != nil {
+		r.add(kind, name, recordFailed, err.Error())
+
+		return false
+	}
+
+	r.add(kind, name, status, message)
+
+	return true
+}
+
+// create is like change, for a new record.
+func (r *recordActions) create(kind, name, message string, create func() error) bool {
+	return r.change(kind, name, recordCreated, message, create)
+}
+
+// printRecordActions prints the report of `headscale import` or
+// `headscale apply`.
+func printRecordActions(actions []recordAction, output string) {
+	if output != "" {
+		SuccessOutput(actions, "", output)
+
+		return
+	}
+
+	tableData := pterm.TableData{{"Kind", "Name", "Status", "Message"}}
+	for _, action := range actions {
+		status := string(action.Status)
+		switch action.Status {
+		case recordCreated, recordUpdated, recordDeleted:
+			status = pterm.LightGreen(status)
+		case recordManual:
+			status = pterm.LightYellow(status)
+		case recordFailed:
+			status = pterm.LightRed(status)
+		}
+
+		tableData = append(tableData, []string{action.Kind, action.Name, status, action.Message})
+	}
+
+	err := pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+	if err != nil {
+		ErrorOutput(
+			err,
+			fmt.Sprintf("Failed to render pterm table: %s", err),
+			output,
+		)
+	}
+}
+
+// tailscaleAPI is a client of the v2 API of the Tailscale SaaS, reading
+// one tailnet.
+type tailscaleAPI struct {
+	url     string
+	key     string
+	tailnet string
+	client  *http.Client
+}
+
+type tailscaleUser struct {
+	ID          string `json:"id"`
+	LoginName   string `json:"loginName"`
+	DisplayName string `json:"displayName"`
+	Type        string `json:"type"`
+	Status      string `json:"status"`
+}
+
+type tailscaleDevice struct {
+	ID            string   `json:"id"`
+	Name          string   `json:"name"`
+	Hostname      string   `json:"hostname"`
+	User          string   `json:"user"`
+	Addresses     []string `json:"addresses"`
+	Tags          []string `json:"tags"`
+	IsExternal    bool     `json:"isExternal"`
+	EnabledRoutes []string `json:"enabledRoutes"`
+}
+
+// tailscaleTailnet holds what is imported from a tailnet.
+type tailscaleTailnet struct {
+	Users       []tailscaleUser
+	Devices     []tailscaleDevice
+	Policy      string
+	Nameservers []string
+	SearchPaths []string
+	MagicDNS    bool
+	SplitDNS    map[string][]string
+}
+
+// get reads the resource of the tailnet at path, decoding its JSON in
+// out, or returning it as is if out is nil.
+func (api *tailscaleAPI) get(path string, accept string, out interface{}) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), tailscaleAPITimeout)
+	defer cancel()
+
+	reqURL := fmt.Sprintf("%s/api/v2/tailnet/%s/%s", api.url, url.PathEscape(api.tailnet), path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+api.key)
+	req.Header.Set("Accept", accept)
+
+	resp, err := api.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("requesting %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s: %s: %s", errTailscaleAPI, path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(body, out); err != nil {
+			return nil, fmt.Errorf("decoding %s: %w", path, err)
+		}
+	}
+
+	return body, nil
+}
+
+// fetch reads the users, devices, ACL policy and DNS settings of the
+// tailnet.
+func (api *tailscaleAPI) fetch() (*tailscaleTailnet, error) {
+	var tailnet tailscaleTailnet
+
+	var users struct {
+		Users []tailscaleUser `json:"users"`
+	}
+	if _, err := api.get("users", "application/json", &users); err != nil {
+		return nil, err
+	}
+	tailnet.Users = users.Users
+
+	var devices struct {
+		Devices []tailscaleDevice `json:"devices"`
+	}
+	if _, err := api.get("devices?fields=all", "application/json", &devices); err != nil {
+		return nil, err
+	}
+	tailnet.Devices = devices.Devices
+
+	policy, err := api.get("acl", "application/hujson", nil)
+	if err != nil {
+		return nil, err
+	}
+	tailnet.Policy = string(policy)
+
+	var nameservers struct {
+		DNS []string `json:"dns"`
+	}
+	if _, err := api.get("dns/nameservers", "application/json", &nameservers); err != nil {
+		return nil, err
+	}
+	tailnet.Nameservers = nameservers.DNS
+
+	var searchPaths struct {
+		SearchPaths []string `json:"searchPaths"`
+	}
+	if _, err := api.get("dns/searchpaths", "application/json", &searchPaths); err != nil {
+		return nil, err
+	}
+	tailnet.SearchPaths = searchPaths.SearchPaths
+
+	var preferences struct {
+		MagicDNS bool `json:"magicDNS"`
+	}
+	if _, err := api.get("dns/preferences", "application/json", &preferences); err != nil {
+		return nil, err
+	}
+	tailnet.MagicDNS = preferences.MagicDNS
+
+	if _, err := api.get("dns/split-dns", "application/json", &tailnet.SplitDNS); err != nil {
+		return nil, err
+	}
+
+	return &tailnet, nil
+}
+
+// tailscaleImporter creates the records of a Tailscale tailnet through
+// the API of headscale.
+type tailscaleImporter struct {
+	recordActions
+
+	ctx        context.Context
+	client     v1.HeadscaleServiceClient
+	expiration time.Time
+}
+
+// run imports the tailnet and returns what was done for each record.
+func (i *tailscaleImporter) run(tailnet *tailscaleTailnet) ([]recordAction, error) {
+	users, err := i.importUsers(tailnet.Users)
+	if err != nil {
+		return nil, err
+	}
+
+	i.importPolicy(tailnet.Policy, users)
+	i.importDNS(tailnet)
+	i.importDevices(tailnet.Devices, users)
+
+	return i.actions, nil
+}
+
+// importUsers creates a user for each member of the tailnet, and returns
+// the names of the users by login name.
+func (i *tailscaleImporter) importUsers(members []tailscaleUser) (map[string]string, error) {
+	response, err := i.client.ListUsers(i.ctx, &v1.ListUsersRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("listing users: %w", err)
+	}
+
+	existing := make(map[string]bool, len(response.GetUsers()))
+	for _, user := range response.GetUsers() {
+		existing[user.GetName()] = true
+	}
+
+	users := make(map[string]string, len(members))
+	for _, member := range members {
+		// Shared users are members of another tailnet, their devices are
+		// not imported either.
+		if member.Type == "shared" {
+			i.add("user", member.LoginName, recordSkipped, "shared from another tailnet")
+
+			continue
+		}
+
+		name, err := util.NormalizeToFQDNRulesConfigFromViper(member.LoginName)
+		if err != nil {
+			i.add("user", member.LoginName, recordFailed, err.Error())
+
+			continue
+		}
+		users[member.LoginName] = name
+
+		if existing[name] {
+			i.add("user", name, recordExists, "login name "+member.LoginName)
+
+			continue
+		}
+
+		i.create("user", name, "login name "+member.LoginName, func() error {
+			_, err := i.client.CreateUser(i.ctx, &v1.CreateUserRequest{Name: name})
+
+			return err
+		})
+		existing[name] = true
+	}
+
+	return users, nil
+}
+
+// importPolicy sets the ACL policy of the tailnet, with the login names
+// of the members replaced by the names of their users.
+func (i *tailscaleImporter) importPolicy(policy string, users map[string]string) {
+	if strings.TrimSpace(policy) == "" {
+		return
+	}
+
+	policy = rewritePolicyUsers(policy, users)
+
+	i.create("policy", "acl", "the ACL policy of the tailnet", func() error {
+		_, err := i.client.SetPolicy(i.ctx, &v1.SetPolicyRequest{Policy: policy})
+
+		return err
+	})
+}
+
+// rewritePolicyUsers replaces the login names of the users in the
+// policy, alone or followed by ports, by their names in headscale.
+func rewritePolicyUsers(policy string, users map[string]string) string {
+	// The longest login names go first, so one which ends another is
+	// not replaced inside it.
+	logins := make([]string, 0, len(users))
+	for login := range users {
+		logins = append(logins, login)
+	}
+	sort.Slice(logins, func(a, b int) bool {
+		return len(logins[a]) > len(logins[b])
+	})
+
+	for _, login := range logins {
+		policy = strings.ReplaceAll(policy, `"`+login+`"`, `"`+users[login]+`"`)
+		policy = strings.ReplaceAll(policy, `"`+login+`:`, `"`+users[login]+`:`)
+	}
+
+	return policy
+}
+
+// importDNS adds the split DNS nameservers as scoped nameservers of all
+// the nodes, and reports the settings of the configuration file.
+func (i *tailscaleImporter) importDNS(tailnet *tailscaleTailnet) {
+	if len(tailnet.Nameservers) > 0 {
+		i.add("dns", "nameservers", recordManual,
+			"set dns_config.nameservers to "+strings.Join(tailnet.Nameservers, ", "))
+	}
+
+	if len(tailnet.SearchPaths) > 0 {
+		i.add("dns", "search domains", recordManual,
+			"add "+strings.Join(tailnet.SearchPaths, ", ")+" to dns_config.domains")
+	}
+
+	if tailnet.MagicDNS {
+		i.add("dns", "magic dns", recordManual, "set dns_config.magic_dns to true")
+	}
+
+	domains := make([]string, 0, len(tailnet.SplitDNS))
+	for domain := range tailnet.SplitDNS {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	for _, domain := range domains {
+		nameservers := tailnet.SplitDNS[domain]
+		if len(nameservers) == 0 {
+			continue
+		}
+
+		i.create("split dns", domain, strings.Join(nameservers, ", "), func() error {
+			_, err := i.client.AddScopedNameservers(i.ctx, &v1.AddScopedNameserversRequest{
+				Domain:      domain,
+				Nameservers: nameservers,
+				Nodes:       []string{"*"},
+			})
+
+			return err
+		})
+	}
+}
+
+// importDevices creates a single use pre auth key for each device of
+// the members of the tailnet, with its tags and its addresses as IP
+// pools.
+func (i *tailscaleImporter) importDevices(devices []tailscaleDevice, users map[string]string) {
+	serverURL := viper.GetString("server_url")
+	if serverURL == "" {
+		serverURL = "<server_url>"
+	}
+
+	for _, device := range devices {
+		// The name of a device is its MagicDNS name.
+		name, _, _ := strings.Cut(device.Name, ".")
+		if name == "" {
+			name = device.Hostname
+		}
+
+		user, ok := users[device.User]
+		if device.IsExternal || !ok {
+			i.add("device", name, recordSkipped, "owned by "+device.User+", not a member of the tailnet")
+
+			continue
+		}
+
+		var pools []string
+		for _, addr := range device.Addresses {
+			ip, err := netip.ParseAddr(addr)
+			if err != nil {
+				continue
+			}
+			pools = append(pools, netip.PrefixFrom(ip, ip.BitLen()).String())
+		}
+
+		message := fmt.Sprintf("user %s, addresses %s", user, strings.Join(device.Addresses, ", "))
+		if len(device.Tags) > 0 {
+			message += ", tags " + strings.Join(device.Tags, ", ")
+		}
+
+		if i.dryRun {
+			i.add("device", name, recordPlanned, message)
+		} else {
+			response, err := i.client.CreatePreAuthKey(i.ctx, &v1.CreatePreAuthKeyRequest{
+				User:       user,
+				Expiration: timestamppb.New(i.expiration),
+				AclTags:    device.Tags,
+				IpPools:    pools,
+			})
+			if err != nil {
+				i.add("device", name, recordFailed, err.Error())
+
+				continue
+			}
+
+			i.add("device", name, recordCreated, fmt.Sprintf(
+				"%s, run `tailscale up --login-server %s --auth-key %s --hostname %s`",
+				message,
+				serverURL,
+				response.GetPreAuthKey().GetKey(),
+				name,
+			))
+		}
+
+		routes := slices.DeleteFunc(slices.Clone(device.EnabledRoutes), func(route string) bool {
+			return route == "0.0.0.0/0" || route == "::/0"
+		})
+		if len(routes) < len(device.EnabledRoutes) {
+			routes = append(routes, "exit node")
+		}
+		if len(routes) > 0 {
+			i.add("routes", name, recordManual,
+				"enable "+strings.Join(routes, ", ")+" once the device is registered")
+		}
+	}
+}
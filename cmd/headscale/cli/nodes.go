@@ -1,19 +1,22 @@
 package cli
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/netip"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
-	survey "github.com/AlecAivazis/survey/v2"
 	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
 	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/prometheus/common/model"
 	"github.com/pterm/pterm"
 	"github.com/spf13/cobra"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"tailscale.com/types/key"
 )
 
@@ -21,12 +24,18 @@ func init() {
 	rootCmd.AddCommand(nodeCmd)
 	listNodesCmd.Flags().StringP("user", "u", "", "Filter by user")
 	listNodesCmd.Flags().BoolP("tags", "t", false, "Show tags")
+	listNodesCmd.Flags().String("tag", "", "Filter by tag")
+	listNodesCmd.Flags().Bool("online", false, "Only list the online nodes")
+	listNodesCmd.Flags().Bool("expired", false, "Only list the nodes with an expired key")
+	listNodesCmd.Flags().String("prefix", "", "Only list the nodes with an IP in the prefix")
+	listNodesCmd.Flags().String("label", "", "Only list the nodes with matching labels, e.g. env=prod,!legacy")
 
 	listNodesCmd.Flags().StringP("namespace", "n", "", "User")
 	listNodesNamespaceFlag := listNodesCmd.Flags().Lookup("namespace")
 	listNodesNamespaceFlag.Deprecated = deprecateNamespaceMessage
 	listNodesNamespaceFlag.Hidden = true
 
+	addTableFlags(listNodesCmd)
 	nodeCmd.AddCommand(listNodesCmd)
 
 	registerNodeCmd.Flags().StringP("user", "u", "", "User")
@@ -47,12 +56,20 @@ func init() {
 	}
 	nodeCmd.AddCommand(registerNodeCmd)
 
-	expireNodeCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
-	err = expireNodeCmd.MarkFlagRequired("identifier")
+	addNodeSelectorFlags(expireNodeCmd)
+	nodeCmd.AddCommand(expireNodeCmd)
+
+	setNodeExpiryCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	err = setNodeExpiryCmd.MarkFlagRequired("identifier")
 	if err != nil {
 		log.Fatalf(err.Error())
 	}
-	nodeCmd.AddCommand(expireNodeCmd)
+	setNodeExpiryCmd.Flags().StringP("duration", "d", "", "Time from now until the node key expires, e.g. 90d, 0 for no expiry")
+	err = setNodeExpiryCmd.MarkFlagRequired("duration")
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	nodeCmd.AddCommand(setNodeExpiryCmd)
 
 	renameNodeCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
 	err = renameNodeCmd.MarkFlagRequired("identifier")
@@ -61,60 +78,768 @@ func init() {
 	}
 	nodeCmd.AddCommand(renameNodeCmd)
 
-	deleteNodeCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
-	err = deleteNodeCmd.MarkFlagRequired("identifier")
+	addNodeSelectorFlags(deleteNodeCmd)
+	nodeCmd.AddCommand(deleteNodeCmd)
+
+	moveNodeCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+
+	err = moveNodeCmd.MarkFlagRequired("identifier")
 	if err != nil {
 		log.Fatalf(err.Error())
 	}
-	nodeCmd.AddCommand(deleteNodeCmd)
 
-	moveNodeCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	moveNodeCmd.Flags().StringP("user", "u", "", "New user")
+
+	moveNodeCmd.Flags().StringP("namespace", "n", "", "User")
+	moveNodeNamespaceFlag := moveNodeCmd.Flags().Lookup("namespace")
+	moveNodeNamespaceFlag.Deprecated = deprecateNamespaceMessage
+	moveNodeNamespaceFlag.Hidden = true
+
+	err = moveNodeCmd.MarkFlagRequired("user")
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	nodeCmd.AddCommand(moveNodeCmd)
+
+	tagCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+
+	err = tagCmd.MarkFlagRequired("identifier")
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	tagCmd.Flags().
+		StringSliceP("tags", "t", []string{}, "List of tags to add to the node")
+	nodeCmd.AddCommand(tagCmd)
+
+	nodeCmd.AddCommand(backfillNodeIPsCmd)
+
+	quarantineNodeCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	err = quarantineNodeCmd.MarkFlagRequired("identifier")
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	quarantineNodeCmd.Flags().Bool("release", false, "Release the node from quarantine")
+	nodeCmd.AddCommand(quarantineNodeCmd)
+
+	setPostureCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	err = setPostureCmd.MarkFlagRequired("identifier")
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	setPostureCmd.Flags().
+		StringToStringP("attribute", "a", map[string]string{}, "Posture attribute to set, as custom:name=value")
+	setPostureCmd.Flags().
+		StringSlice("remove", []string{}, "Posture attribute to remove")
+	nodeCmd.AddCommand(setPostureCmd)
+
+	labelNodeCmd.PersistentFlags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	err = labelNodeCmd.MarkPersistentFlagRequired("identifier")
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	labelNodeCmd.AddCommand(setNodeLabelsCmd)
+	labelNodeCmd.AddCommand(removeNodeLabelsCmd)
+	nodeCmd.AddCommand(labelNodeCmd)
+
+	nodeHealthCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	err = nodeHealthCmd.MarkFlagRequired("identifier")
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	nodeCmd.AddCommand(nodeHealthCmd)
+
+	for _, cmd := range []*cobra.Command{shareNodeCmd, unshareNodeCmd} {
+		cmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+		err = cmd.MarkFlagRequired("identifier")
+		if err != nil {
+			log.Fatalf(err.Error())
+		}
+		cmd.Flags().StringP("with", "w", "", "User the node is shared with")
+		err = cmd.MarkFlagRequired("with")
+		if err != nil {
+			log.Fatalf(err.Error())
+		}
+		nodeCmd.AddCommand(cmd)
+	}
+
+	listNodeSharesCmd.Flags().Uint64P("identifier", "i", 0, "Only list the shares of the node (ID)")
+	nodeCmd.AddCommand(listNodeSharesCmd)
+
+	nodeCmd.AddCommand(listPendingNodesCmd)
+
+	lookupNodeCmd.Flags().BoolP("prefix", "p", false, "Match the names starting with NAME")
+	nodeCmd.AddCommand(lookupNodeCmd)
+
+	approveNodeCmd.Flags().String("id", "", "Pending node identifier")
+	err = approveNodeCmd.MarkFlagRequired("id")
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	approveNodeCmd.Flags().
+		StringP("user", "u", "", "User to register the node to, not needed for nodes awaiting approval")
+	nodeCmd.AddCommand(approveNodeCmd)
+
+	rejectNodeCmd.Flags().String("id", "", "Pending node identifier")
+	err = rejectNodeCmd.MarkFlagRequired("id")
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	nodeCmd.AddCommand(rejectNodeCmd)
+}
+
+var nodeCmd = &cobra.Command{
+	Use:     "nodes",
+	Short:   "Manage the nodes of Headscale",
+	Aliases: []string{"node", "machine", "machines"},
+}
+
+var registerNodeCmd = &cobra.Command{
+	Use:   "register",
+	Short: "Registers a node to your network",
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		user, err := cmd.Flags().GetString("user")
+		if err != nil {
+			ErrorOutput(err, fmt.Sprintf("Error getting user: %s", err), output)
+
+			return
+		}
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		machineKey, err := cmd.Flags().GetString("key")
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error getting node key from flag: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		request := &v1.RegisterNodeRequest{
+			Key:  machineKey,
+			User: user,
+		}
+
+		response, err := client.RegisterNode(ctx, request)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf(
+					"Cannot register node: %s\n",
+					status.Convert(err).Message(),
+				),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(
+			response.GetNode(),
+			fmt.Sprintf("Node %s registered", response.GetNode().GetGivenName()), output)
+	},
+}
+
+var listNodesCmd = &cobra.Command{
+	Use:     "list",
+	Short:   "List nodes",
+	Aliases: []string{"ls", "show"},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		user, err := cmd.Flags().GetString("user")
+		if err != nil {
+			ErrorOutput(err, fmt.Sprintf("Error getting user: %s", err), output)
+
+			return
+		}
+		showTags, err := cmd.Flags().GetBool("tags")
+		if err != nil {
+			ErrorOutput(err, fmt.Sprintf("Error getting tags flag: %s", err), output)
+
+			return
+		}
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		tag, _ := cmd.Flags().GetString("tag")
+		onlineOnly, _ := cmd.Flags().GetBool("online")
+		expiredOnly, _ := cmd.Flags().GetBool("expired")
+		prefix, _ := cmd.Flags().GetString("prefix")
+		label, _ := cmd.Flags().GetString("label")
+
+		request := &v1.ListNodesRequest{
+			User:          user,
+			Tag:           tag,
+			OnlineOnly:    onlineOnly,
+			ExpiredOnly:   expiredOnly,
+			IpPrefix:      prefix,
+			LabelSelector: label,
+		}
+
+		response, err := client.ListNodes(ctx, request)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot get nodes: %s", status.Convert(err).Message()),
+				output,
+			)
+
+			return
+		}
+
+		if output != "" {
+			SuccessOutput(response.GetNodes(), "", output)
+
+			return
+		}
+
+		tableData, err := nodesToPtables(user, showTags, response.GetNodes())
+		if err != nil {
+			ErrorOutput(err, fmt.Sprintf("Error converting to table: %s", err), output)
+
+			return
+		}
+
+		err = renderTable(cmd, tableData)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Failed to render table: %s", err),
+				output,
+			)
+
+			return
+		}
+	},
+}
+
+var lookupNodeCmd = &cobra.Command{
+	Use:   "lookup NAME",
+	Short: "Finds a node by hostname or given name",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return errMissingParameter
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		prefix, _ := cmd.Flags().GetBool("prefix")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		request := &v1.LookupNodeRequest{
+			Name:   args[0],
+			Prefix: prefix,
+		}
+
+		response, err := client.LookupNode(ctx, request)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot find node: %s", status.Convert(err).Message()),
+				output,
+			)
+
+			return
+		}
+
+		if output != "" {
+			SuccessOutput(response.GetNode(), "", output)
+
+			return
+		}
+
+		tableData, err := nodesToPtables("", false, []*v1.Node{response.GetNode()})
+		if err != nil {
+			ErrorOutput(err, fmt.Sprintf("Error converting to table: %s", err), output)
+
+			return
+		}
+
+		err = pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Failed to render pterm table: %s", err),
+				output,
+			)
+
+			return
+		}
+	},
+}
+
+var expireNodeCmd = &cobra.Command{
+	Use:   "expire",
+	Short: "Expire (log out) a node in your network",
+	Long: `Expiring a node will keep the node in the database and force it to reauthenticate.
+
+With --label, all the nodes with matching labels are expired.`,
+	Aliases: []string{"logout", "exp", "e"},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		identifiers, err := getNodeSelection(ctx, client, cmd)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot select nodes: %s", status.Convert(err).Message()),
+				output,
+			)
+
+			return
+		}
+
+		nodes := make([]*v1.Node, 0, len(identifiers))
+		for _, identifier := range identifiers {
+			request := &v1.ExpireNodeRequest{
+				NodeId: identifier,
+			}
+
+			response, err := client.ExpireNode(ctx, request)
+			if err != nil {
+				ErrorOutput(
+					err,
+					fmt.Sprintf(
+						"Cannot expire node %d: %s\n",
+						identifier,
+						status.Convert(err).Message(),
+					),
+					output,
+				)
+
+				return
+			}
+
+			nodes = append(nodes, response.GetNode())
+		}
+
+		if !cmd.Flags().Changed("label") {
+			SuccessOutput(nodes[0], "Node expired", output)
+
+			return
+		}
+
+		SuccessOutput(nodes, fmt.Sprintf("%d nodes expired", len(nodes)), output)
+	},
+}
+
+var setNodeExpiryCmd = &cobra.Command{
+	Use:   "set-expiry",
+	Short: "Set when the key of a node expires",
+	Long: `Set the key of a node to expire after the given duration, or to not
+expire with a duration of 0. The node is warned node_expiry.warning before
+its key expires.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		identifier, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error converting ID to integer: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		durationStr, _ := cmd.Flags().GetString("duration")
+		duration, err := model.ParseDuration(durationStr)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Could not parse duration: %s\n", err),
+				output,
+			)
+
+			return
+		}
+
+		request := &v1.SetNodeExpiryRequest{
+			NodeId: identifier,
+		}
+		if duration > 0 {
+			request.Expiry = timestamppb.New(time.Now().Add(time.Duration(duration)))
+		}
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.SetNodeExpiry(ctx, request)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf(
+					"Cannot set node expiry: %s\n",
+					status.Convert(err).Message(),
+				),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response.GetNode(), "Node expiry set", output)
+	},
+}
+
+var quarantineNodeCmd = &cobra.Command{
+	Use:   "quarantine",
+	Short: "Cut a node off from all other nodes in your network",
+	Long: `Quarantining a node removes it from the peers of all other nodes and
+blocks all traffic to it, without deleting it. Use --release to add it
+back to the network.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		identifier, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error converting ID to integer: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		release, _ := cmd.Flags().GetBool("release")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		request := &v1.QuarantineNodeRequest{
+			NodeId:      identifier,
+			Quarantined: !release,
+		}
+
+		response, err := client.QuarantineNode(ctx, request)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf(
+					"Cannot quarantine node: %s\n",
+					status.Convert(err).Message(),
+				),
+				output,
+			)
+
+			return
+		}
+
+		if release {
+			SuccessOutput(response.GetNode(), "Node released from quarantine", output)
+		} else {
+			SuccessOutput(response.GetNode(), "Node quarantined", output)
+		}
+	},
+}
+
+var setPostureCmd = &cobra.Command{
+	Use:   "set-posture",
+	Short: "Set or remove custom posture attributes of a node",
+	Long: `Custom posture attributes, such as custom:managed=true, can be checked
+by the postures of the policy, to only allow the nodes satisfying them as
+sources of the ACLs and grants with srcPosture.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		identifier, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error converting ID to integer: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		attributes, _ := cmd.Flags().GetStringToString("attribute")
+		remove, _ := cmd.Flags().GetStringSlice("remove")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		request := &v1.SetPostureRequest{
+			NodeId:     identifier,
+			Attributes: attributes,
+			Remove:     remove,
+		}
+
+		response, err := client.SetPosture(ctx, request)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf(
+					"Cannot set posture attributes: %s\n",
+					status.Convert(err).Message(),
+				),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response.GetNode(), "Posture attributes updated", output)
+	},
+}
+
+var labelNodeCmd = &cobra.Command{
+	Use:   "label",
+	Short: "Set or remove labels of a node",
+	Long: `Labels are key/value pairs organising the nodes, such as env=prod.
+"headscale nodes list --label" lists the nodes with matching labels, and
+"headscale nodes expire --label" and "headscale nodes delete --label"
+apply to all of them. The label: alias of the policy selects them, such
+as label:env=prod,!legacy.`,
+}
+
+var setNodeLabelsCmd = &cobra.Command{
+	Use:   "set KEY=VALUE...",
+	Short: "Set labels of a node",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return errMissingParameter
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		identifier, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error converting ID to integer: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		labels := make(map[string]string, len(args))
+		for _, arg := range args {
+			key, value, _ := strings.Cut(arg, "=")
+			labels[key] = value
+		}
+
+		setNodeLabels(cmd, &v1.SetNodeLabelsRequest{
+			NodeId: identifier,
+			Labels: labels,
+		})
+	},
+}
+
+var removeNodeLabelsCmd = &cobra.Command{
+	Use:     "remove KEY...",
+	Short:   "Remove labels of a node",
+	Aliases: []string{"rm"},
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return errMissingParameter
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		identifier, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error converting ID to integer: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		setNodeLabels(cmd, &v1.SetNodeLabelsRequest{
+			NodeId: identifier,
+			Remove: args,
+		})
+	},
+}
+
+func setNodeLabels(cmd *cobra.Command, request *v1.SetNodeLabelsRequest) {
+	output, _ := cmd.Flags().GetString("output")
+
+	ctx, client, conn, cancel := getHeadscaleCLIClient()
+	defer cancel()
+	defer conn.Close()
+
+	response, err := client.SetNodeLabels(ctx, request)
+	if err != nil {
+		ErrorOutput(
+			err,
+			fmt.Sprintf(
+				"Cannot set node labels: %s\n",
+				status.Convert(err).Message(),
+			),
+			output,
+		)
+
+		return
+	}
+
+	SuccessOutput(response.GetNode(), "Node labels updated", output)
+}
+
+var nodeHealthCmd = &cobra.Command{
+	Use:   "health",
+	Short: "Show the network health and client metrics of a node",
+	Long: `Show the network report of a node, its preferred DERP region, the
+latency to the DERP regions and whether UDP and IPv6 work, and the client
+metrics it last sent, such as the magicsock and DERP counters.
+
+The client metrics are collected every client_metrics.interval, they are
+empty if the collection is disabled.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		identifier, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error converting ID to integer: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.GetNodeHealth(ctx, &v1.GetNodeHealthRequest{
+			NodeId: identifier,
+		})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot get node health: %s", status.Convert(err).Message()),
+				output,
+			)
+
+			return
+		}
+
+		health := response.GetHealth()
+		if output != "" {
+			SuccessOutput(health, "", output)
+
+			return
+		}
+
+		metricsUpdated := "never"
+		if health.GetClientMetricsUpdatedAt() != nil {
+			metricsUpdated = health.GetClientMetricsUpdatedAt().AsTime().Format(HeadscaleDateTimeFormat)
+		}
+
+		tables := []pterm.TableData{
+			{
+				{"Preferred DERP", "Working UDP", "Working IPv6", "Mapping varies by destination", "Metrics updated"},
+				{
+					strconv.Itoa(int(health.GetPreferredDerp())),
+					strconv.FormatBool(health.GetWorkingUdp()),
+					strconv.FormatBool(health.GetWorkingIpv6()),
+					strconv.FormatBool(health.GetMappingVariesByDestIp()),
+					metricsUpdated,
+				},
+			},
+			{{"DERP region", "Latency"}},
+			{{"Metric", "Value"}},
+		}
 
-	err = moveNodeCmd.MarkFlagRequired("identifier")
-	if err != nil {
-		log.Fatalf(err.Error())
-	}
+		for _, region := range sortedHealthKeys(health.GetDerpLatency()) {
+			latency := time.Duration(health.GetDerpLatency()[region] * float64(time.Second))
+			tables[1] = append(tables[1], []string{region, latency.Round(time.Microsecond).String()})
+		}
 
-	moveNodeCmd.Flags().StringP("user", "u", "", "New user")
+		for _, name := range sortedHealthKeys(health.GetClientMetrics()) {
+			tables[2] = append(tables[2], []string{
+				name,
+				strconv.FormatFloat(health.GetClientMetrics()[name], 'f', -1, 64),
+			})
+		}
 
-	moveNodeCmd.Flags().StringP("namespace", "n", "", "User")
-	moveNodeNamespaceFlag := moveNodeCmd.Flags().Lookup("namespace")
-	moveNodeNamespaceFlag.Deprecated = deprecateNamespaceMessage
-	moveNodeNamespaceFlag.Hidden = true
+		for _, tableData := range tables {
+			if len(tableData) == 1 {
+				continue
+			}
 
-	err = moveNodeCmd.MarkFlagRequired("user")
-	if err != nil {
-		log.Fatalf(err.Error())
-	}
-	nodeCmd.AddCommand(moveNodeCmd)
+			err = pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+			if err != nil {
+				ErrorOutput(
+					err,
+					fmt.Sprintf("Failed to render pterm table: %s", err),
+					output,
+				)
 
-	tagCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+				return
+			}
+		}
+	},
+}
 
-	err = tagCmd.MarkFlagRequired("identifier")
-	if err != nil {
-		log.Fatalf(err.Error())
+func sortedHealthKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
 	}
-	tagCmd.Flags().
-		StringSliceP("tags", "t", []string{}, "List of tags to add to the node")
-	nodeCmd.AddCommand(tagCmd)
+	sort.Strings(keys)
 
-	nodeCmd.AddCommand(backfillNodeIPsCmd)
+	return keys
 }
 
-var nodeCmd = &cobra.Command{
-	Use:     "nodes",
-	Short:   "Manage the nodes of Headscale",
-	Aliases: []string{"node", "machine", "machines"},
+// shareUser returns the user of the --with flag, written either as the
+// name of the user or as "user@".
+func shareUser(cmd *cobra.Command) string {
+	user, _ := cmd.Flags().GetString("with")
+
+	return strings.TrimSuffix(user, "@")
 }
 
-var registerNodeCmd = &cobra.Command{
-	Use:   "register",
-	Short: "Registers a node to your network",
+var shareNodeCmd = &cobra.Command{
+	Use:   "share",
+	Short: "Share a node with another user",
+	Long: `Share a node with a user other than its owner. The rules of the policy
+with the user, or a group of the user, as destination also cover the shared
+node, so it shows up in the netmap of the nodes of the user the policy lets
+reach it. Without a policy all the nodes already see each other.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		output, _ := cmd.Flags().GetString("output")
-		user, err := cmd.Flags().GetString("user")
+
+		identifier, err := cmd.Flags().GetUint64("identifier")
 		if err != nil {
-			ErrorOutput(err, fmt.Sprintf("Error getting user: %s", err), output)
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error converting ID to integer: %s", err),
+				output,
+			)
 
 			return
 		}
@@ -123,74 +848,186 @@ var registerNodeCmd = &cobra.Command{
 		defer cancel()
 		defer conn.Close()
 
-		machineKey, err := cmd.Flags().GetString("key")
+		response, err := client.ShareNode(ctx, &v1.ShareNodeRequest{
+			NodeId: identifier,
+			User:   shareUser(cmd),
+		})
 		if err != nil {
 			ErrorOutput(
 				err,
-				fmt.Sprintf("Error getting node key from flag: %s", err),
+				fmt.Sprintf("Cannot share node: %s", status.Convert(err).Message()),
 				output,
 			)
 
 			return
 		}
 
-		request := &v1.RegisterNodeRequest{
-			Key:  machineKey,
-			User: user,
+		SuccessOutput(response.GetShare(), "Node shared", output)
+	},
+}
+
+var unshareNodeCmd = &cobra.Command{
+	Use:   "unshare",
+	Short: "Stop sharing a node with another user",
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		identifier, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error converting ID to integer: %s", err),
+				output,
+			)
+
+			return
 		}
 
-		response, err := client.RegisterNode(ctx, request)
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.UnshareNode(ctx, &v1.UnshareNodeRequest{
+			NodeId: identifier,
+			User:   shareUser(cmd),
+		})
 		if err != nil {
 			ErrorOutput(
 				err,
-				fmt.Sprintf(
-					"Cannot register node: %s\n",
-					status.Convert(err).Message(),
-				),
+				fmt.Sprintf("Cannot unshare node: %s", status.Convert(err).Message()),
 				output,
 			)
 
 			return
 		}
 
-		SuccessOutput(
-			response.GetNode(),
-			fmt.Sprintf("Node %s registered", response.GetNode().GetGivenName()), output)
+		SuccessOutput(response, "Node unshared", output)
 	},
 }
 
-var listNodesCmd = &cobra.Command{
-	Use:     "list",
-	Short:   "List nodes",
-	Aliases: []string{"ls", "show"},
+var listNodeSharesCmd = &cobra.Command{
+	Use:   "shares",
+	Short: "List the nodes shared with other users",
 	Run: func(cmd *cobra.Command, args []string) {
 		output, _ := cmd.Flags().GetString("output")
-		user, err := cmd.Flags().GetString("user")
+
+		identifier, err := cmd.Flags().GetUint64("identifier")
 		if err != nil {
-			ErrorOutput(err, fmt.Sprintf("Error getting user: %s", err), output)
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error converting ID to integer: %s", err),
+				output,
+			)
 
 			return
 		}
-		showTags, err := cmd.Flags().GetBool("tags")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.ListNodeShares(ctx, &v1.ListNodeSharesRequest{
+			NodeId: identifier,
+		})
 		if err != nil {
-			ErrorOutput(err, fmt.Sprintf("Error getting tags flag: %s", err), output)
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot get node shares: %s", status.Convert(err).Message()),
+				output,
+			)
+
+			return
+		}
+
+		if output != "" {
+			SuccessOutput(response.GetShares(), "", output)
+
+			return
+		}
+
+		tableData := pterm.TableData{
+			{"Node ID", "Node", "Shared with", "Created"},
+		}
+		for _, share := range response.GetShares() {
+			tableData = append(tableData, []string{
+				strconv.FormatUint(share.GetNodeId(), util.Base10),
+				share.GetNodeName(),
+				share.GetUser().GetName(),
+				share.GetCreatedAt().AsTime().Format(HeadscaleDateTimeFormat),
+			})
+		}
+
+		err = pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Failed to render pterm table: %s", err),
+				output,
+			)
 
 			return
 		}
+	},
+}
+
+// addNodeSelectorFlags adds the flags selecting either a node by its
+// identifier, or the nodes by a label selector.
+func addNodeSelectorFlags(cmd *cobra.Command) {
+	cmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	cmd.Flags().String("label", "", "Select the nodes with matching labels instead, e.g. env=prod,!legacy")
+	cmd.MarkFlagsMutuallyExclusive("identifier", "label")
+	cmd.MarkFlagsOneRequired("identifier", "label")
+}
+
+// getNodeSelection returns the identifiers of the nodes selected by the
+// flags added by addNodeSelectorFlags.
+func getNodeSelection(
+	ctx context.Context,
+	client v1.HeadscaleServiceClient,
+	cmd *cobra.Command,
+) ([]uint64, error) {
+	if !cmd.Flags().Changed("label") {
+		identifier, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			return nil, err
+		}
+
+		return []uint64{identifier}, nil
+	}
+
+	label, _ := cmd.Flags().GetString("label")
+	response, err := client.ListNodes(ctx, &v1.ListNodesRequest{LabelSelector: label})
+	if err != nil {
+		return nil, err
+	}
+
+	identifiers := make([]uint64, 0, len(response.GetNodes()))
+	for _, node := range response.GetNodes() {
+		identifiers = append(identifiers, node.GetId())
+	}
+
+	return identifiers, nil
+}
+
+var listPendingNodesCmd = &cobra.Command{
+	Use:   "pending",
+	Short: "List the nodes waiting for their registration to be approved",
+	Long: `List the nodes which have started an interactive registration, without
+a pre-auth key, and the nodes registered while node_approval is enabled.
+They are waiting for an administrator to approve or reject them with
+"headscale nodes approve" or "headscale nodes reject".`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
 
 		ctx, client, conn, cancel := getHeadscaleCLIClient()
 		defer cancel()
 		defer conn.Close()
 
-		request := &v1.ListNodesRequest{
-			User: user,
-		}
-
-		response, err := client.ListNodes(ctx, request)
+		response, err := client.ListPendingNodes(ctx, &v1.ListPendingNodesRequest{})
 		if err != nil {
 			ErrorOutput(
 				err,
-				fmt.Sprintf("Cannot get nodes: %s", status.Convert(err).Message()),
+				fmt.Sprintf("Cannot get pending nodes: %s", status.Convert(err).Message()),
 				output,
 			)
 
@@ -203,11 +1040,28 @@ var listNodesCmd = &cobra.Command{
 			return
 		}
 
-		tableData, err := nodesToPtables(user, showTags, response.GetNodes())
-		if err != nil {
-			ErrorOutput(err, fmt.Sprintf("Error converting to table: %s", err), output)
+		tableData := pterm.TableData{
+			{"ID", "Hostname", "Machine key", "Requested", "Registered node", "User"},
+		}
+		for _, node := range response.GetNodes() {
+			requestedAt := ""
+			if node.GetRequestedAt() != nil {
+				requestedAt = node.GetRequestedAt().AsTime().Format(HeadscaleDateTimeFormat)
+			}
 
-			return
+			registered := "-"
+			if node.GetNodeId() != 0 {
+				registered = strconv.FormatUint(node.GetNodeId(), util.Base10)
+			}
+
+			tableData = append(tableData, []string{
+				node.GetId(),
+				node.GetHostname(),
+				node.GetMachineKey(),
+				requestedAt,
+				registered,
+				node.GetUser(),
+			})
 		}
 
 		err = pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
@@ -223,39 +1077,60 @@ var listNodesCmd = &cobra.Command{
 	},
 }
 
-var expireNodeCmd = &cobra.Command{
-	Use:     "expire",
-	Short:   "Expire (log out) a node in your network",
-	Long:    "Expiring a node will keep the node in the database and force it to reauthenticate.",
-	Aliases: []string{"logout", "exp", "e"},
+var approveNodeCmd = &cobra.Command{
+	Use:   "approve",
+	Short: "Approve the registration of a pending node",
 	Run: func(cmd *cobra.Command, args []string) {
 		output, _ := cmd.Flags().GetString("output")
+		id, _ := cmd.Flags().GetString("id")
+		user, _ := cmd.Flags().GetString("user")
 
-		identifier, err := cmd.Flags().GetUint64("identifier")
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.ApprovePendingNode(ctx, &v1.ApprovePendingNodeRequest{
+			Id:   id,
+			User: user,
+		})
 		if err != nil {
 			ErrorOutput(
 				err,
-				fmt.Sprintf("Error converting ID to integer: %s", err),
+				fmt.Sprintf(
+					"Cannot approve node: %s\n",
+					status.Convert(err).Message(),
+				),
 				output,
 			)
 
 			return
 		}
 
+		SuccessOutput(
+			response.GetNode(),
+			fmt.Sprintf("Node %s registered", response.GetNode().GetGivenName()), output)
+	},
+}
+
+var rejectNodeCmd = &cobra.Command{
+	Use:   "reject",
+	Short: "Reject the registration of a pending node",
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		id, _ := cmd.Flags().GetString("id")
+
 		ctx, client, conn, cancel := getHeadscaleCLIClient()
 		defer cancel()
 		defer conn.Close()
 
-		request := &v1.ExpireNodeRequest{
-			NodeId: identifier,
-		}
-
-		response, err := client.ExpireNode(ctx, request)
+		response, err := client.RejectPendingNode(ctx, &v1.RejectPendingNodeRequest{
+			Id: id,
+		})
 		if err != nil {
 			ErrorOutput(
 				err,
 				fmt.Sprintf(
-					"Cannot expire node: %s\n",
+					"Cannot reject node: %s\n",
 					status.Convert(err).Message(),
 				),
 				output,
@@ -264,7 +1139,7 @@ var expireNodeCmd = &cobra.Command{
 			return
 		}
 
-		SuccessOutput(response.GetNode(), "Node expired", output)
+		SuccessOutput(response, "Node registration rejected", output)
 	},
 }
 
@@ -317,71 +1192,75 @@ var renameNodeCmd = &cobra.Command{
 }
 
 var deleteNodeCmd = &cobra.Command{
-	Use:     "delete",
-	Short:   "Delete a node",
+	Use:   "delete",
+	Short: "Delete a node",
+	Long: `Delete a node from the database.
+
+With --label, all the nodes with matching labels are deleted.`,
 	Aliases: []string{"del"},
 	Run: func(cmd *cobra.Command, args []string) {
 		output, _ := cmd.Flags().GetString("output")
 
-		identifier, err := cmd.Flags().GetUint64("identifier")
-		if err != nil {
-			ErrorOutput(
-				err,
-				fmt.Sprintf("Error converting ID to integer: %s", err),
-				output,
-			)
-
-			return
-		}
-
 		ctx, client, conn, cancel := getHeadscaleCLIClient()
 		defer cancel()
 		defer conn.Close()
 
-		getRequest := &v1.GetNodeRequest{
-			NodeId: identifier,
-		}
-
-		getResponse, err := client.GetNode(ctx, getRequest)
+		identifiers, err := getNodeSelection(ctx, client, cmd)
 		if err != nil {
 			ErrorOutput(
 				err,
-				fmt.Sprintf(
-					"Error getting node node: %s",
-					status.Convert(err).Message(),
-				),
+				fmt.Sprintf("Cannot select nodes: %s", status.Convert(err).Message()),
 				output,
 			)
 
 			return
 		}
 
-		deleteRequest := &v1.DeleteNodeRequest{
-			NodeId: identifier,
-		}
-
-		confirm := false
-		force, _ := cmd.Flags().GetBool("force")
-		if !force {
-			prompt := &survey.Confirm{
-				Message: fmt.Sprintf(
-					"Do you want to remove the node %s?",
-					getResponse.GetNode().GetName(),
-				),
+		names := make([]string, 0, len(identifiers))
+		for _, identifier := range identifiers {
+			getRequest := &v1.GetNodeRequest{
+				NodeId: identifier,
 			}
-			err = survey.AskOne(prompt, &confirm)
+
+			getResponse, err := client.GetNode(ctx, getRequest)
 			if err != nil {
+				ErrorOutput(
+					err,
+					fmt.Sprintf(
+						"Error getting node node: %s",
+						status.Convert(err).Message(),
+					),
+					output,
+				)
+
 				return
 			}
+
+			names = append(names, getResponse.GetNode().GetName())
 		}
 
-		if confirm || force {
-			response, err := client.DeleteNode(ctx, deleteRequest)
-			if output != "" {
-				SuccessOutput(response, "", output)
+		if len(names) == 0 {
+			SuccessOutput(map[string]string{"Result": "No node matches the labels"}, "No node matches the labels", output)
 
-				return
+			return
+		}
+
+		message := fmt.Sprintf("Do you want to remove the node %s?", names[0])
+		if len(names) > 1 {
+			message = fmt.Sprintf("Do you want to remove the %d nodes %s?", len(names), strings.Join(names, ", "))
+		}
+		if !confirmAction(cmd, message) {
+			SuccessOutput(map[string]string{"Result": "Node not deleted"}, "Node not deleted", output)
+
+			return
+		}
+
+		for _, identifier := range identifiers {
+			deleteRequest := &v1.DeleteNodeRequest{
+				NodeId: identifier,
 			}
+
+			response, err := client.DeleteNode(ctx, deleteRequest)
 			if err != nil {
 				ErrorOutput(
 					err,
@@ -394,14 +1273,18 @@ var deleteNodeCmd = &cobra.Command{
 
 				return
 			}
-			SuccessOutput(
-				map[string]string{"Result": "Node deleted"},
-				"Node deleted",
-				output,
-			)
-		} else {
-			SuccessOutput(map[string]string{"Result": "Node not deleted"}, "Node not deleted", output)
+			if output != "" && !cmd.Flags().Changed("label") {
+				SuccessOutput(response, "", output)
+
+				return
+			}
 		}
+
+		SuccessOutput(
+			map[string]string{"Result": "Node deleted"},
+			fmt.Sprintf("%d node(s) deleted", len(identifiers)),
+			output,
+		)
 	},
 }
 
@@ -493,25 +1376,19 @@ all nodes that are missing.
 
 If you remove IPv4 or IPv6 prefixes from the config,
 it can be run to remove the IPs that should no longer
-be assigned to nodes.`,
+be assigned to nodes.
+
+If you add pools in prefixes.pools, it can be run to
+move the nodes with an IP outside of their pool into it.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		var err error
 		output, _ := cmd.Flags().GetString("output")
 
-		confirm := false
-		prompt := &survey.Confirm{
-			Message: "Are you sure that you want to assign/remove IPs to/from nodes?",
-		}
-		err = survey.AskOne(prompt, &confirm)
-		if err != nil {
-			return
-		}
-		if confirm {
+		if confirmAction(cmd, "Are you sure that you want to assign/remove IPs to/from nodes?") {
 			ctx, client, conn, cancel := getHeadscaleCLIClient()
 			defer cancel()
 			defer conn.Close()
 
-			changes, err := client.BackfillNodeIPs(ctx, &v1.BackfillNodeIPsRequest{Confirmed: confirm})
+			changes, err := client.BackfillNodeIPs(ctx, &v1.BackfillNodeIPsRequest{Confirmed: true})
 			if err != nil {
 				ErrorOutput(
 					err,
@@ -599,8 +1476,14 @@ func nodesToPtables(
 		var online string
 		if node.GetOnline() {
 			online = pterm.LightGreen("online")
+			if node.GetConnectedAt() != nil {
+				online += " since " + node.GetConnectedAt().AsTime().Format("2006-01-02 15:04:05")
+			}
 		} else {
 			online = pterm.LightRed("offline")
+			if node.GetDisconnectedAt() != nil {
+				online += " since " + node.GetDisconnectedAt().AsTime().Format("2006-01-02 15:04:05")
+			}
 		}
 
 		var expired string
@@ -0,0 +1,355 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/pterm/pterm"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(policyCmd)
+	policyCmd.AddCommand(getPolicyCmd)
+
+	setPolicyCmd.Flags().StringP("file", "f", "", "Path to a policy file in HuJSON format")
+	if err := setPolicyCmd.MarkFlagRequired("file"); err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	setPolicyCmd.Flags().Bool("if-not-exists", false, "Keep the current version if the policy is the same instead of storing a new one")
+	policyCmd.AddCommand(setPolicyCmd)
+
+	policyCmd.AddCommand(policyHistoryCmd)
+
+	diffPolicyCmd.Flags().StringP("file", "f", "", "Path to the candidate policy file in HuJSON format")
+	if err := diffPolicyCmd.MarkFlagRequired("file"); err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	policyCmd.AddCommand(diffPolicyCmd)
+
+	checkPolicyCmd.Flags().String("src", "", "Source of the traffic, e.g. \"user1@\", \"group:admins\" or an IP")
+	checkPolicyCmd.Flags().String("dst", "", "Destination of the traffic with a single port, e.g. \"tag:server:443\"")
+	checkPolicyCmd.Flags().String("proto", "tcp", "Protocol of the traffic")
+	checkPolicyCmd.Flags().StringP("file", "f", "", "Path to a candidate policy file in HuJSON format to check instead of the current policy")
+	for _, flag := range []string{"src", "dst"} {
+		if err := checkPolicyCmd.MarkFlagRequired(flag); err != nil {
+			log.Fatal().Err(err).Msg("")
+		}
+	}
+	policyCmd.AddCommand(checkPolicyCmd)
+
+	rollbackPolicyCmd.Flags().Uint64P("version", "v", 0, "Version of the policy to roll back to")
+	if err := rollbackPolicyCmd.MarkFlagRequired("version"); err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	policyCmd.AddCommand(rollbackPolicyCmd)
+}
+
+var policyCmd = &cobra.Command{
+	Use:   "policy",
+	Short: "Manage the ACL policy",
+}
+
+var getPolicyCmd = &cobra.Command{
+	Use:     "get",
+	Short:   "Print the current ACL policy",
+	Aliases: []string{"show", "view"},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.GetPolicy(ctx, &v1.GetPolicyRequest{})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot get the policy: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response.GetPolicy(), response.GetPolicy().GetPolicy(), output)
+	},
+}
+
+var setPolicyCmd = &cobra.Command{
+	Use:   "set",
+	Short: "Set the ACL policy stored in the database",
+	Long: `
+Set the ACL policy stored in the database, with acl_policy_mode set to
+database. The policy is only applied if it is valid, its tests pass and
+its rules compile for the current nodes. Every policy set is kept as a
+new version.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		path, _ := cmd.Flags().GetString("file")
+		ifNotExists, _ := cmd.Flags().GetBool("if-not-exists")
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error reading policy file %s: %s", path, err),
+				output,
+			)
+
+			return
+		}
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.SetPolicy(ctx, &v1.SetPolicyRequest{
+			Policy:      string(data),
+			IfNotExists: ifNotExists,
+		})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot set the policy: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(
+			response.GetPolicy(),
+			fmt.Sprintf("Policy set, version %d", response.GetPolicy().GetVersion()),
+			output,
+		)
+	},
+}
+
+var policyHistoryCmd = &cobra.Command{
+	Use:     "history",
+	Short:   "List the versions of the ACL policy stored in the database",
+	Aliases: []string{"versions"},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.ListPolicyVersions(ctx, &v1.ListPolicyVersionsRequest{})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot get the policy history: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		if output != "" {
+			SuccessOutput(response.GetVersions(), "", output)
+
+			return
+		}
+
+		tableData := pterm.TableData{
+			{"Version", "Created", "Lines", "Current"},
+		}
+		for index, version := range response.GetVersions() {
+			current := ""
+			if index == 0 {
+				current = pterm.LightGreen("yes")
+			}
+
+			tableData = append(tableData, []string{
+				strconv.FormatUint(version.GetVersion(), 10),
+				version.GetCreatedAt().AsTime().Format(HeadscaleDateTimeFormat),
+				strconv.Itoa(strings.Count(version.GetPolicy(), "\n") + 1),
+				current,
+			})
+		}
+
+		err = pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Failed to render pterm table: %s", err),
+				output,
+			)
+
+			return
+		}
+	},
+}
+
+var rollbackPolicyCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Roll the ACL policy back to a previous version",
+	Long: `
+Roll the ACL policy back to a previous version. The previous version is
+checked against the current nodes like a new policy, and stored as a new
+version.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		version, _ := cmd.Flags().GetUint64("version")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.RollbackPolicy(ctx, &v1.RollbackPolicyRequest{Version: version})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot roll back the policy: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(
+			response.GetPolicy(),
+			fmt.Sprintf("Policy rolled back to version %d, as version %d", version, response.GetPolicy().GetVersion()),
+			output,
+		)
+	},
+}
+
+var diffPolicyCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "Show the rules of each node a candidate ACL policy would change",
+	Long: `
+Compile a candidate ACL policy for the current users and nodes, and show
+the packet filter and SSH rules it would add (+) or remove (-) for each
+node compared to the current policy. Nothing is applied.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		path, _ := cmd.Flags().GetString("file")
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error reading policy file %s: %s", path, err),
+				output,
+			)
+
+			return
+		}
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.DiffPolicy(ctx, &v1.DiffPolicyRequest{Policy: string(data)})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot compile the candidate policy: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		if output != "" {
+			SuccessOutput(response.GetNodes(), "", output)
+
+			return
+		}
+
+		if len(response.GetNodes()) == 0 {
+			SuccessOutput(nil, "The rules of no node would change", output)
+
+			return
+		}
+
+		var diff strings.Builder
+		for _, node := range response.GetNodes() {
+			fmt.Fprintf(&diff, "%s (%s, ID %d)\n", node.GetNodeName(), node.GetUser(), node.GetNodeId())
+			writeRuleDiff(&diff, "filter", node.GetAddedRules(), node.GetRemovedRules())
+			writeRuleDiff(&diff, "ssh", node.GetAddedSshRules(), node.GetRemovedSshRules())
+		}
+		fmt.Print(diff.String())
+	},
+}
+
+func writeRuleDiff(diff *strings.Builder, kind string, added, removed []string) {
+	for _, rule := range removed {
+		fmt.Fprintln(diff, pterm.LightRed(fmt.Sprintf("  - %s %s", kind, rule)))
+	}
+	for _, rule := range added {
+		fmt.Fprintln(diff, pterm.LightGreen(fmt.Sprintf("  + %s %s", kind, rule)))
+	}
+}
+
+var checkPolicyCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Check if the ACL policy allows traffic from a source to a destination",
+	Long: `
+Check if the ACL policy allows traffic from a source to a destination
+port, for the current users and nodes, and show the ACLs and grants
+allowing it. The traffic is only allowed if all the IPs of the source
+can reach all the IPs of the destination.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		src, _ := cmd.Flags().GetString("src")
+		dst, _ := cmd.Flags().GetString("dst")
+		proto, _ := cmd.Flags().GetString("proto")
+		path, _ := cmd.Flags().GetString("file")
+
+		request := &v1.CheckPolicyRequest{Src: src, Dst: dst, Proto: proto}
+		if path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				ErrorOutput(
+					err,
+					fmt.Sprintf("Error reading policy file %s: %s", path, err),
+					output,
+				)
+
+				return
+			}
+			request.Policy = string(data)
+		}
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.CheckPolicy(ctx, request)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot check the policy: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		if output != "" {
+			SuccessOutput(response, "", output)
+
+			return
+		}
+
+		var result strings.Builder
+		if response.GetAllowed() {
+			fmt.Fprintln(&result, pterm.LightGreen(fmt.Sprintf("%s -> %s (%s) is allowed", src, dst, proto)))
+		} else {
+			fmt.Fprintln(&result, pterm.LightRed(fmt.Sprintf("%s -> %s (%s) is denied: %s", src, dst, proto, response.GetDenied())))
+		}
+		for _, match := range response.GetMatches() {
+			fmt.Fprintf(&result, "  %s\n", match)
+		}
+		fmt.Print(result.String())
+	},
+}
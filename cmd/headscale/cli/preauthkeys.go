@@ -11,6 +11,7 @@ import (
 	"github.com/pterm/pterm"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
@@ -31,6 +32,7 @@ func init() {
 	if err != nil {
 		log.Fatal().Err(err).Msg("")
 	}
+	addTableFlags(listPreAuthKeys)
 	preauthkeysCmd.AddCommand(listPreAuthKeys)
 	preauthkeysCmd.AddCommand(createPreAuthKeyCmd)
 	preauthkeysCmd.AddCommand(expirePreAuthKeyCmd)
@@ -42,6 +44,14 @@ func init() {
 		StringP("expiration", "e", DefaultPreAuthKeyExpiry, "Human-readable expiration of the key (e.g. 30m, 24h)")
 	createPreAuthKeyCmd.Flags().
 		StringSlice("tags", []string{}, "Tags to automatically assign to node")
+	createPreAuthKeyCmd.Flags().
+		Uint32("max-uses", 0, "Maximum number of uses of a reusable key, unlimited if 0")
+	createPreAuthKeyCmd.Flags().
+		String("expire-after-first-use", "", "Expire the key this long after it is first used (e.g. 30m, 24h)")
+	createPreAuthKeyCmd.Flags().
+		StringSlice("ip-pool", []string{}, "Prefixes to allocate the addresses of the nodes from, at most one IPv4 and one IPv6 (e.g. 100.64.10.0/24)")
+	createPreAuthKeyCmd.Flags().
+		Bool("if-not-exists", false, "Return a usable key of the user with the same settings instead of creating a new one")
 }
 
 var preauthkeysCmd = &cobra.Command{
@@ -96,6 +106,7 @@ var listPreAuthKeys = &cobra.Command{
 				"Reusable",
 				"Ephemeral",
 				"Used",
+				"Uses",
 				"Expiration",
 				"Created",
 				"Tags",
@@ -115,23 +126,29 @@ var listPreAuthKeys = &cobra.Command{
 
 			aclTags = strings.TrimLeft(aclTags, ",")
 
+			uses := strconv.FormatUint(uint64(key.GetUseCount()), 10)
+			if key.GetMaxUses() > 0 {
+				uses += "/" + strconv.FormatUint(uint64(key.GetMaxUses()), 10)
+			}
+
 			tableData = append(tableData, []string{
 				key.GetId(),
 				key.GetKey(),
 				strconv.FormatBool(key.GetReusable()),
 				strconv.FormatBool(key.GetEphemeral()),
 				strconv.FormatBool(key.GetUsed()),
+				uses,
 				expiration,
 				key.GetCreatedAt().AsTime().Format("2006-01-02 15:04:05"),
 				aclTags,
 			})
 
 		}
-		err = pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+		err = renderTable(cmd, tableData)
 		if err != nil {
 			ErrorOutput(
 				err,
-				fmt.Sprintf("Failed to render pterm table: %s", err),
+				fmt.Sprintf("Failed to render table: %s", err),
 				output,
 			)
 
@@ -157,6 +174,9 @@ var createPreAuthKeyCmd = &cobra.Command{
 		reusable, _ := cmd.Flags().GetBool("reusable")
 		ephemeral, _ := cmd.Flags().GetBool("ephemeral")
 		tags, _ := cmd.Flags().GetStringSlice("tags")
+		maxUses, _ := cmd.Flags().GetUint32("max-uses")
+		ipPools, _ := cmd.Flags().GetStringSlice("ip-pool")
+		ifNotExists, _ := cmd.Flags().GetBool("if-not-exists")
 
 		log.Trace().
 			Bool("reusable", reusable).
@@ -165,10 +185,28 @@ var createPreAuthKeyCmd = &cobra.Command{
 			Msg("Preparing to create preauthkey")
 
 		request := &v1.CreatePreAuthKeyRequest{
-			User:      user,
-			Reusable:  reusable,
-			Ephemeral: ephemeral,
-			AclTags:   tags,
+			User:        user,
+			Reusable:    reusable,
+			Ephemeral:   ephemeral,
+			AclTags:     tags,
+			MaxUses:     maxUses,
+			IpPools:     ipPools,
+			IfNotExists: ifNotExists,
+		}
+
+		if firstUseStr, _ := cmd.Flags().GetString("expire-after-first-use"); firstUseStr != "" {
+			firstUse, err := model.ParseDuration(firstUseStr)
+			if err != nil {
+				ErrorOutput(
+					err,
+					fmt.Sprintf("Could not parse duration: %s\n", err),
+					output,
+				)
+
+				return
+			}
+
+			request.ExpireAfterFirstUse = durationpb.New(time.Duration(firstUse))
 		}
 
 		durationStr, _ := cmd.Flags().GetString("expiration")
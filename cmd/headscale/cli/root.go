@@ -31,22 +31,40 @@ func init() {
 		StringP("output", "o", "", "Output format. Empty for human-readable, 'json', 'json-line' or 'yaml'")
 	rootCmd.PersistentFlags().
 		Bool("force", false, "Disable prompts and forces the execution")
+	rootCmd.PersistentFlags().
+		BoolP("yes", "y", false, "Answer yes to confirmation prompts, required when not running in a terminal")
 }
 
-func initConfig() {
+// loadConfigFile loads the configuration file given with --config or
+// HEADSCALE_CONFIG, or found in the default locations.
+func loadConfigFile() error {
 	if cfgFile == "" {
 		cfgFile = os.Getenv("HEADSCALE_CONFIG")
 	}
 	if cfgFile != "" {
-		err := types.LoadConfig(cfgFile, true)
-		if err != nil {
-			log.Fatal().Caller().Err(err).Msgf("Error loading config file %s", cfgFile)
-		}
-	} else {
-		err := types.LoadConfig("", false)
-		if err != nil {
-			log.Fatal().Caller().Err(err).Msgf("Error loading config")
+		if err := types.LoadConfig(cfgFile, true); err != nil {
+			return fmt.Errorf("loading config file %s: %w", cfgFile, err)
 		}
+
+		return nil
+	}
+
+	if err := types.LoadConfig("", false); err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+
+	return nil
+}
+
+func initConfig() {
+	// The doctor loads the configuration itself, to report its errors
+	// along with the other problems instead of exiting.
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		return
+	}
+
+	if err := loadConfigFile(); err != nil {
+		log.Fatal().Caller().Err(err).Msg("Error loading config")
 	}
 
 	cfg, err := types.GetHeadscaleConfig()
@@ -96,6 +114,8 @@ https://github.com/juanfont/headscale`,
 }
 
 func Execute() {
+	registerCompletions()
+
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -20,27 +20,16 @@ const (
 func init() {
 	rootCmd.AddCommand(routesCmd)
 	listRoutesCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	addTableFlags(listRoutesCmd)
 	routesCmd.AddCommand(listRoutesCmd)
 
-	enableRouteCmd.Flags().Uint64P("route", "r", 0, "Route identifier (ID)")
-	err := enableRouteCmd.MarkFlagRequired("route")
-	if err != nil {
-		log.Fatalf(err.Error())
-	}
+	addRouteSelectorFlags(enableRouteCmd)
 	routesCmd.AddCommand(enableRouteCmd)
 
-	disableRouteCmd.Flags().Uint64P("route", "r", 0, "Route identifier (ID)")
-	err = disableRouteCmd.MarkFlagRequired("route")
-	if err != nil {
-		log.Fatalf(err.Error())
-	}
+	addRouteSelectorFlags(disableRouteCmd)
 	routesCmd.AddCommand(disableRouteCmd)
 
-	deleteRouteCmd.Flags().Uint64P("route", "r", 0, "Route identifier (ID)")
-	err = deleteRouteCmd.MarkFlagRequired("route")
-	if err != nil {
-		log.Fatalf(err.Error())
-	}
+	addRouteSelectorFlags(deleteRouteCmd)
 	routesCmd.AddCommand(deleteRouteCmd)
 }
 
@@ -123,11 +112,11 @@ var listRoutesCmd = &cobra.Command{
 			return
 		}
 
-		err = pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+		err = renderTable(cmd, tableData)
 		if err != nil {
 			ErrorOutput(
 				err,
-				fmt.Sprintf("Failed to render pterm table: %s", err),
+				fmt.Sprintf("Failed to render table: %s", err),
 				output,
 			)
 
@@ -143,11 +132,11 @@ var enableRouteCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		output, _ := cmd.Flags().GetString("output")
 
-		routeID, err := cmd.Flags().GetUint64("route")
+		sel, err := getRouteSelector(cmd)
 		if err != nil {
 			ErrorOutput(
 				err,
-				fmt.Sprintf("Error getting machine id from flag: %s", err),
+				fmt.Sprintf("Error getting route from flags: %s", err),
 				output,
 			)
 
@@ -159,23 +148,25 @@ var enableRouteCmd = &cobra.Command{
 		defer conn.Close()
 
 		response, err := client.EnableRoute(ctx, &v1.EnableRouteRequest{
-			RouteId: routeID,
+			RouteId: sel.routeID,
+			NodeId:  sel.nodeID,
+			Prefix:  sel.prefix,
 		})
 		if err != nil {
 			ErrorOutput(
 				err,
-				fmt.Sprintf("Cannot enable route %d: %s", routeID, status.Convert(err).Message()),
+				fmt.Sprintf("Cannot enable %s: %s", sel, status.Convert(err).Message()),
 				output,
 			)
 
 			return
 		}
 
-		if output != "" {
-			SuccessOutput(response, "", output)
-
-			return
-		}
+		SuccessOutput(
+			response,
+			fmt.Sprintf("Enabled %s, %d nodes updated", sel, len(response.GetUpdatedNodeIds())),
+			output,
+		)
 	},
 }
 
@@ -186,11 +177,11 @@ var disableRouteCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		output, _ := cmd.Flags().GetString("output")
 
-		routeID, err := cmd.Flags().GetUint64("route")
+		sel, err := getRouteSelector(cmd)
 		if err != nil {
 			ErrorOutput(
 				err,
-				fmt.Sprintf("Error getting machine id from flag: %s", err),
+				fmt.Sprintf("Error getting route from flags: %s", err),
 				output,
 			)
 
@@ -202,23 +193,25 @@ var disableRouteCmd = &cobra.Command{
 		defer conn.Close()
 
 		response, err := client.DisableRoute(ctx, &v1.DisableRouteRequest{
-			RouteId: routeID,
+			RouteId: sel.routeID,
+			NodeId:  sel.nodeID,
+			Prefix:  sel.prefix,
 		})
 		if err != nil {
 			ErrorOutput(
 				err,
-				fmt.Sprintf("Cannot disable route %d: %s", routeID, status.Convert(err).Message()),
+				fmt.Sprintf("Cannot disable %s: %s", sel, status.Convert(err).Message()),
 				output,
 			)
 
 			return
 		}
 
-		if output != "" {
-			SuccessOutput(response, "", output)
-
-			return
-		}
+		SuccessOutput(
+			response,
+			fmt.Sprintf("Disabled %s, %d nodes updated", sel, len(response.GetUpdatedNodeIds())),
+			output,
+		)
 	},
 }
 
@@ -229,40 +222,99 @@ var deleteRouteCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		output, _ := cmd.Flags().GetString("output")
 
-		routeID, err := cmd.Flags().GetUint64("route")
+		sel, err := getRouteSelector(cmd)
 		if err != nil {
 			ErrorOutput(
 				err,
-				fmt.Sprintf("Error getting machine id from flag: %s", err),
+				fmt.Sprintf("Error getting route from flags: %s", err),
 				output,
 			)
 
 			return
 		}
 
+		if !confirmAction(cmd, fmt.Sprintf("Do you want to delete %s?", sel)) {
+			SuccessOutput(map[string]string{"Result": "Route not deleted"}, "Route not deleted", output)
+
+			return
+		}
+
 		ctx, client, conn, cancel := getHeadscaleCLIClient()
 		defer cancel()
 		defer conn.Close()
 
 		response, err := client.DeleteRoute(ctx, &v1.DeleteRouteRequest{
-			RouteId: routeID,
+			RouteId: sel.routeID,
+			NodeId:  sel.nodeID,
+			Prefix:  sel.prefix,
 		})
 		if err != nil {
 			ErrorOutput(
 				err,
-				fmt.Sprintf("Cannot delete route %d: %s", routeID, status.Convert(err).Message()),
+				fmt.Sprintf("Cannot delete %s: %s", sel, status.Convert(err).Message()),
 				output,
 			)
 
 			return
 		}
 
-		if output != "" {
-			SuccessOutput(response, "", output)
+		SuccessOutput(
+			response,
+			fmt.Sprintf("Deleted %s, %d nodes updated", sel, len(response.GetUpdatedNodeIds())),
+			output,
+		)
+	},
+}
 
-			return
+// routeSelector is a route given either by its ID, or by its node and
+// prefix.
+type routeSelector struct {
+	routeID uint64
+	nodeID  uint64
+	prefix  string
+}
+
+func (sel routeSelector) String() string {
+	if sel.routeID != 0 {
+		return fmt.Sprintf("route %d", sel.routeID)
+	}
+
+	return fmt.Sprintf("route %s of node %d", sel.prefix, sel.nodeID)
+}
+
+func addRouteSelectorFlags(cmd *cobra.Command) {
+	cmd.Flags().Uint64P("route", "r", 0, "Route identifier (ID)")
+	cmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID), with --prefix instead of --route")
+	cmd.Flags().StringP("prefix", "p", "", "Prefix of the route of the node")
+	cmd.MarkFlagsMutuallyExclusive("route", "identifier")
+	cmd.MarkFlagsMutuallyExclusive("route", "prefix")
+	cmd.MarkFlagsRequiredTogether("identifier", "prefix")
+	cmd.MarkFlagsOneRequired("route", "identifier")
+}
+
+func getRouteSelector(cmd *cobra.Command) (routeSelector, error) {
+	var sel routeSelector
+	var err error
+
+	if sel.routeID, err = cmd.Flags().GetUint64("route"); err != nil {
+		return sel, err
+	}
+
+	if sel.nodeID, err = cmd.Flags().GetUint64("identifier"); err != nil {
+		return sel, err
+	}
+
+	if sel.prefix, err = cmd.Flags().GetString("prefix"); err != nil {
+		return sel, err
+	}
+
+	if sel.prefix != "" {
+		if _, err := netip.ParsePrefix(sel.prefix); err != nil {
+			return sel, err
 		}
-	},
+	}
+
+	return sel, nil
 }
 
 // routesToPtables converts the list of routes to a nice table.
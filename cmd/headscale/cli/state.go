@@ -0,0 +1,628 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gopkg.in/yaml.v3"
+)
+
+// controlState is the declarative state of the control plane written by
+// `headscale export` and applied by `headscale apply`.
+type controlState struct {
+	// Policy is the ACL policy in HuJSON, left unchanged if empty.
+	Policy      string            `json:"policy,omitempty" yaml:"policy,omitempty"`
+	Users       []stateUser       `json:"users" yaml:"users"`
+	Nodes       []stateNode       `json:"nodes,omitempty" yaml:"nodes,omitempty"`
+	PreAuthKeys []statePreAuthKey `json:"preauthkeys,omitempty" yaml:"preauthkeys,omitempty"`
+}
+
+type stateUser struct {
+	Name    string `json:"name" yaml:"name"`
+	Tailnet string `json:"tailnet,omitempty" yaml:"tailnet,omitempty"`
+}
+
+// stateNode is a registered node, identified by its machine key. Nodes
+// cannot be created from the state, they must register.
+type stateNode struct {
+	MachineKey string            `json:"machine_key" yaml:"machine_key"`
+	Name       string            `json:"name" yaml:"name"`
+	User       string            `json:"user" yaml:"user"`
+	Tags       []string          `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Routes     []string          `json:"routes,omitempty" yaml:"routes,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+}
+
+// statePreAuthKey is a pre auth key which can still be used. The key
+// itself is not part of the state, an existing key of the user with the
+// same settings stands for it.
+type statePreAuthKey struct {
+	User       string    `json:"user" yaml:"user"`
+	Reusable   bool      `json:"reusable,omitempty" yaml:"reusable,omitempty"`
+	Ephemeral  bool      `json:"ephemeral,omitempty" yaml:"ephemeral,omitempty"`
+	Tags       []string  `json:"tags,omitempty" yaml:"tags,omitempty"`
+	MaxUses    uint32    `json:"max_uses,omitempty" yaml:"max_uses,omitempty"`
+	IPPools    []string  `json:"ip_pools,omitempty" yaml:"ip_pools,omitempty"`
+	Expiration time.Time `json:"expiration" yaml:"expiration"`
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.Flags().StringP("file", "f", "", "File to write the state to, standard output if not set")
+
+	rootCmd.AddCommand(applyCmd)
+	applyCmd.Flags().StringP("file", "f", "", "File with the state to apply, as written by `headscale export`")
+	if err := applyCmd.MarkFlagRequired("file"); err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	applyCmd.Flags().Bool("dry-run", false, "Only report what would be changed")
+	applyCmd.Flags().Bool("prune", false, "Delete the users and nodes, and expire the pre auth keys, which are not in the state")
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the users, nodes, pre auth keys and policy as declarative YAML",
+	Long: `
+Export the state of the control plane as YAML, to be kept in version
+control and applied with "headscale apply": the users, the nodes with
+their tags, approved routes and labels, the pre auth keys which can
+still be used, without the keys themselves, and the ACL policy.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		file, _ := cmd.Flags().GetString("file")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		state, err := exportState(ctx, client)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot export the state: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		data, err := yaml.Marshal(state)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot marshal the state: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		if file == "" {
+			//nolint
+			fmt.Print(string(data))
+
+			return
+		}
+
+		if err := os.WriteFile(file, data, 0o600); err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error writing the state to %s: %s", file, err),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(state, fmt.Sprintf("State exported to %s", file), output)
+	},
+}
+
+var errPruneNotConfirmed = errors.New("pruning was not confirmed")
+
+var applyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "Apply the users, nodes, pre auth keys and policy of a declarative YAML",
+	Long: `
+Apply a state written by "headscale export", changing the control plane
+to match it:
+
+- the missing users are created,
+- the policy is set, with acl_policy_mode set to database,
+- the registered nodes are renamed, moved to their user, and get the
+  tags, approved routes and labels of the state,
+- a pre auth key is created for each key of the state without an
+  existing key of its user with the same settings.
+
+The nodes of the state which are not registered are reported. With
+--prune, the nodes and users which are not in the state are deleted and
+the pre auth keys which are not in it are expired, after a confirmation
+which --yes skips. With --dry-run nothing is changed and the report
+shows what would be.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		file, _ := cmd.Flags().GetString("file")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		prune, _ := cmd.Flags().GetBool("prune")
+
+		data, err := os.ReadFile(file)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error reading state file %s: %s", file, err),
+				output,
+			)
+
+			return
+		}
+
+		var state controlState
+		if err := yaml.Unmarshal(data, &state); err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error parsing state file %s: %s", file, err),
+				output,
+			)
+
+			return
+		}
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		applier := &stateApplier{
+			recordActions: recordActions{dryRun: dryRun},
+			ctx:           ctx,
+			client:        client,
+			prune:         prune,
+			confirmPrune: func(message string) bool {
+				return confirmAction(cmd, message)
+			},
+		}
+
+		actions, err := applier.run(&state)
+		if errors.Is(err, errPruneNotConfirmed) {
+			SuccessOutput(map[string]string{"Result": "State not applied"}, "State not applied", output)
+
+			return
+		}
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot apply the state: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		printRecordActions(actions, output)
+	},
+}
+
+// liveKey reports if the pre auth key can still be used.
+func liveKey(key *v1.PreAuthKey) bool {
+	if key.GetExpiration() != nil && key.GetExpiration().AsTime().Before(time.Now()) {
+		return false
+	}
+
+	return key.GetReusable() || !key.GetUsed()
+}
+
+// exportState reads the state of the control plane.
+func exportState(ctx context.Context, client v1.HeadscaleServiceClient) (*controlState, error) {
+	var state controlState
+
+	policy, err := client.GetPolicy(ctx, &v1.GetPolicyRequest{})
+	switch {
+	case status.Code(err) == codes.NotFound:
+	case err != nil:
+		return nil, fmt.Errorf("getting the policy: %w", err)
+	default:
+		state.Policy = policy.GetPolicy().GetPolicy()
+	}
+
+	users, err := client.ListUsers(ctx, &v1.ListUsersRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("listing users: %w", err)
+	}
+
+	for _, user := range users.GetUsers() {
+		state.Users = append(state.Users, stateUser{
+			Name:    user.GetName(),
+			Tailnet: user.GetTailnet(),
+		})
+
+		keys, err := client.ListPreAuthKeys(ctx, &v1.ListPreAuthKeysRequest{User: user.GetName()})
+		if err != nil {
+			return nil, fmt.Errorf("listing pre auth keys of %s: %w", user.GetName(), err)
+		}
+
+		for _, key := range keys.GetPreAuthKeys() {
+			if !liveKey(key) {
+				continue
+			}
+
+			state.PreAuthKeys = append(state.PreAuthKeys, statePreAuthKey{
+				User:       user.GetName(),
+				Reusable:   key.GetReusable(),
+				Ephemeral:  key.GetEphemeral(),
+				Tags:       key.GetAclTags(),
+				MaxUses:    key.GetMaxUses(),
+				IPPools:    key.GetIpPools(),
+				Expiration: key.GetExpiration().AsTime().UTC(),
+			})
+		}
+	}
+
+	nodes, err := client.ListNodes(ctx, &v1.ListNodesRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("listing nodes: %w", err)
+	}
+
+	for _, node := range nodes.GetNodes() {
+		var routes []string
+		for _, route := range node.GetRoutes() {
+			if route.GetApproved() {
+				routes = append(routes, route.GetPrefix())
+			}
+		}
+
+		state.Nodes = append(state.Nodes, stateNode{
+			MachineKey: node.GetMachineKey(),
+			Name:       node.GetGivenName(),
+			User:       node.GetUser().GetName(),
+			Tags:       node.GetForcedTags(),
+			Routes:     routes,
+			Labels:     node.GetLabels(),
+		})
+	}
+
+	return &state, nil
+}
+
+// sameStrings reports if a and b hold the same strings, in any order.
+func sameStrings(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	sort.Strings(a)
+	sort.Strings(b)
+
+	return slices.Equal(a, b)
+}
+
+// stateApplier changes the control plane to match a state through the
+// API of headscale.
+type stateApplier struct {
+	recordActions
+
+	ctx    context.Context
+	client v1.HeadscaleServiceClient
+	prune  bool
+
+	// confirmPrune asks to confirm the deletions of --prune before
+	// anything is changed.
+	confirmPrune func(message string) bool
+}
+
+// run applies the state and returns what was done for each record.
+func (a *stateApplier) run(state *controlState) ([]recordAction, error) {
+	users, err := a.client.ListUsers(a.ctx, &v1.ListUsersRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("listing users: %w", err)
+	}
+
+	nodes, err := a.client.ListNodes(a.ctx, &v1.ListNodesRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("listing nodes: %w", err)
+	}
+
+	if a.prune && !a.dryRun && a.confirmPrune != nil {
+		stale := 0
+		for _, node := range nodes.GetNodes() {
+			if !slices.ContainsFunc(state.Nodes, func(n stateNode) bool { return n.MachineKey == node.GetMachineKey() }) {
+				stale++
+			}
+		}
+
+		message := fmt.Sprintf(
+			"Do you want to delete the %d nodes and %d users, and expire the pre auth keys, which are not in the state?",
+			stale,
+			len(staleUsers(state, users.GetUsers())),
+		)
+		if !a.confirmPrune(message) {
+			return nil, errPruneNotConfirmed
+		}
+	}
+
+	a.applyUsers(state.Users, users.GetUsers())
+	a.applyPolicy(state.Policy)
+
+	kept := a.applyNodes(state.Nodes, nodes.GetNodes())
+	if err := a.applyPreAuthKeys(state.PreAuthKeys, users.GetUsers()); err != nil {
+		return nil, err
+	}
+
+	if a.prune {
+		for _, node := range nodes.GetNodes() {
+			if kept[node.GetId()] {
+				continue
+			}
+
+			a.change("node", node.GetGivenName(), recordDeleted, "not in the state", func() error {
+				_, err := a.client.DeleteNode(a.ctx, &v1.DeleteNodeRequest{NodeId: node.GetId()})
+
+				return err
+			})
+		}
+
+		for _, user := range staleUsers(state, users.GetUsers()) {
+			a.change("user", user.GetName(), recordDeleted, "not in the state", func() error {
+				_, err := a.client.DeleteUser(a.ctx, &v1.DeleteUserRequest{Name: user.GetName()})
+
+				return err
+			})
+		}
+	}
+
+	return a.actions, nil
+}
+
+// staleUsers returns the users which are not in the state.
+func staleUsers(state *controlState, users []*v1.User) []*v1.User {
+	return slices.DeleteFunc(slices.Clone(users), func(user *v1.User) bool {
+		return slices.ContainsFunc(state.Users, func(u stateUser) bool { return u.Name == user.GetName() })
+	})
+}
+
+// applyUsers creates the users of the state which do not exist.
+func (a *stateApplier) applyUsers(want []stateUser, users []*v1.User) {
+	for _, user := range want {
+		index := slices.IndexFunc(users, func(u *v1.User) bool { return u.GetName() == user.Name })
+		if index < 0 {
+			a.create("user", user.Name, "", func() error {
+				_, err := a.client.CreateUser(a.ctx, &v1.CreateUserRequest{
+					Name:    user.Name,
+					Tailnet: user.Tailnet,
+				})
+
+				return err
+			})
+
+			continue
+		}
+
+		// The tailnet of a user cannot change.
+		if tailnet := users[index].GetTailnet(); tailnet != user.Tailnet {
+			a.add("user", user.Name, recordManual, fmt.Sprintf("in tailnet %q instead of %q", tailnet, user.Tailnet))
+		}
+	}
+}
+
+// applyPolicy sets the policy of the state if it differs.
+func (a *stateApplier) applyPolicy(policy string) {
+	if strings.TrimSpace(policy) == "" {
+		return
+	}
+
+	current, err := a.client.GetPolicy(a.ctx, &v1.GetPolicyRequest{})
+	if err == nil && strings.TrimSpace(current.GetPolicy().GetPolicy()) == strings.TrimSpace(policy) {
+		return
+	}
+
+	a.change("policy", "acl", recordUpdated, "", func() error {
+		_, err := a.client.SetPolicy(a.ctx, &v1.SetPolicyRequest{Policy: policy})
+
+		return err
+	})
+}
+
+// applyNodes changes the registered nodes to match the state, and
+// returns the IDs of the nodes in it.
+func (a *stateApplier) applyNodes(want []stateNode, nodes []*v1.Node) map[uint64]bool {
+	kept := make(map[uint64]bool, len(want))
+
+	for _, wantNode := range want {
+		index := slices.IndexFunc(nodes, func(n *v1.Node) bool { return n.GetMachineKey() == wantNode.MachineKey })
+		if index < 0 {
+			a.add("node", wantNode.Name, recordManual, "not registered, register it with a pre auth key of "+wantNode.User)
+
+			continue
+		}
+		node := nodes[index]
+		kept[node.GetId()] = true
+
+		if node.GetUser().GetName() != wantNode.User {
+			a.change("node", wantNode.Name, recordUpdated, "moved to "+wantNode.User, func() error {
+				_, err := a.client.MoveNode(a.ctx, &v1.MoveNodeRequest{NodeId: node.GetId(), User: wantNode.User})
+
+				return err
+			})
+		}
+
+		if node.GetGivenName() != wantNode.Name {
+			a.change("node", wantNode.Name, recordUpdated, "renamed from "+node.GetGivenName(), func() error {
+				_, err := a.client.RenameNode(a.ctx, &v1.RenameNodeRequest{NodeId: node.GetId(), NewName: wantNode.Name})
+
+				return err
+			})
+		}
+
+		if !sameStrings(node.GetForcedTags(), wantNode.Tags) {
+			a.change("node", wantNode.Name, recordUpdated, "tags "+strings.Join(wantNode.Tags, ", "), func() error {
+				_, err := a.client.SetTags(a.ctx, &v1.SetTagsRequest{NodeId: node.GetId(), Tags: wantNode.Tags})
+
+				return err
+			})
+		}
+
+		a.applyRoutes(node, wantNode)
+		a.applyLabels(node, wantNode)
+	}
+
+	return kept
+}
+
+// applyRoutes approves the routes of the state of the node, and disables
+// the others.
+func (a *stateApplier) applyRoutes(node *v1.Node, want stateNode) {
+	for _, prefix := range want.Routes {
+		if !slices.ContainsFunc(node.GetRoutes(), func(r *v1.NodeRoute) bool { return r.GetPrefix() == prefix }) {
+			a.add("route", want.Name, recordManual, prefix+" is not advertised by the node")
+		}
+	}
+
+	for _, route := range node.GetRoutes() {
+		approve := slices.Contains(want.Routes, route.GetPrefix())
+		if approve == route.GetApproved() {
+			continue
+		}
+
+		if approve {
+			a.change("route", want.Name, recordUpdated, "enabled "+route.GetPrefix(), func() error {
+				_, err := a.client.EnableRoute(a.ctx, &v1.EnableRouteRequest{RouteId: route.GetId()})
+
+				return err
+			})
+		} else {
+			a.change("route", want.Name, recordUpdated, "disabled "+route.GetPrefix(), func() error {
+				_, err := a.client.DisableRoute(a.ctx, &v1.DisableRouteRequest{RouteId: route.GetId()})
+
+				return err
+			})
+		}
+	}
+}
+
+// applyLabels sets the labels of the state of the node, and removes the
+// others.
+func (a *stateApplier) applyLabels(node *v1.Node, want stateNode) {
+	set := make(map[string]string)
+	for key, value := range want.Labels {
+		if current, ok := node.GetLabels()[key]; !ok || current != value {
+			set[key] = value
+		}
+	}
+
+	var remove []string
+	for key := range node.GetLabels() {
+		if _, ok := want.Labels[key]; !ok {
+			remove = append(remove, key)
+		}
+	}
+	sort.Strings(remove)
+
+	if len(set) == 0 && len(remove) == 0 {
+		return
+	}
+
+	a.change("node", want.Name, recordUpdated, "labels", func() error {
+		_, err := a.client.SetNodeLabels(a.ctx, &v1.SetNodeLabelsRequest{
+			NodeId: node.GetId(),
+			Labels: set,
+			Remove: remove,
+		})
+
+		return err
+	})
+}
+
+// samePreAuthKey reports if the existing key has the settings of the
+// key of the state.
+func samePreAuthKey(key *v1.PreAuthKey, want statePreAuthKey) bool {
+	return key.GetReusable() == want.Reusable &&
+		key.GetEphemeral() == want.Ephemeral &&
+		key.GetMaxUses() == want.MaxUses &&
+		sameStrings(key.GetAclTags(), want.Tags) &&
+		sameStrings(key.GetIpPools(), want.IPPools)
+}
+
+// applyPreAuthKeys creates the pre auth keys of the state without an
+// existing key of their user with the same settings, and with --prune
+// expires the keys which are not in the state.
+func (a *stateApplier) applyPreAuthKeys(want []statePreAuthKey, users []*v1.User) error {
+	live := make(map[string][]*v1.PreAuthKey)
+	for _, user := range users {
+		keys, err := a.client.ListPreAuthKeys(a.ctx, &v1.ListPreAuthKeysRequest{User: user.GetName()})
+		if err != nil {
+			return fmt.Errorf("listing pre auth keys of %s: %w", user.GetName(), err)
+		}
+
+		for _, key := range keys.GetPreAuthKeys() {
+			if liveKey(key) {
+				live[user.GetName()] = append(live[user.GetName()], key)
+			}
+		}
+	}
+
+	for _, wantKey := range want {
+		keys := live[wantKey.User]
+		index := slices.IndexFunc(keys, func(key *v1.PreAuthKey) bool { return samePreAuthKey(key, wantKey) })
+		if index >= 0 {
+			live[wantKey.User] = slices.Delete(keys, index, index+1)
+
+			continue
+		}
+
+		if wantKey.Expiration.Before(time.Now()) {
+			a.add("preauthkey", wantKey.User, recordSkipped, "expired on "+wantKey.Expiration.Format(time.RFC3339))
+
+			continue
+		}
+
+		message := "expires on " + wantKey.Expiration.Format(time.RFC3339)
+		if a.dryRun {
+			a.add("preauthkey", wantKey.User, recordPlanned, message)
+
+			continue
+		}
+
+		response, err := a.client.CreatePreAuthKey(a.ctx, &v1.CreatePreAuthKeyRequest{
+			User:       wantKey.User,
+			Reusable:   wantKey.Reusable,
+			Ephemeral:  wantKey.Ephemeral,
+			Expiration: timestamppb.New(wantKey.Expiration),
+			AclTags:    wantKey.Tags,
+			MaxUses:    wantKey.MaxUses,
+			IpPools:    wantKey.IPPools,
+		})
+		if err != nil {
+			a.add("preauthkey", wantKey.User, recordFailed, err.Error())
+
+			continue
+		}
+
+		a.add("preauthkey", wantKey.User, recordCreated, fmt.Sprintf("key %s, %s", response.GetPreAuthKey().GetKey(), message))
+	}
+
+	if !a.prune {
+		return nil
+	}
+
+	for _, user := range users {
+		for _, key := range live[user.GetName()] {
+			a.change("preauthkey", user.GetName(), recordDeleted, "expired, not in the state", func() error {
+				_, err := a.client.ExpirePreAuthKey(a.ctx, &v1.ExpirePreAuthKeyRequest{
+					User: user.GetName(),
+					Key:  key.GetKey(),
+				})
+
+				return err
+			})
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package cli
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+// addTableFlags adds the flags shaping the table printed by a list
+// command, see renderTable.
+func addTableFlags(cmd *cobra.Command) {
+	cmd.Flags().
+		StringSlice("columns", nil, "Columns to show, in order, by header name (e.g. --columns id,hostname,last-seen)")
+	cmd.Flags().
+		String("sort-by", "", "Column to sort the rows by, prefixed with - for descending order (e.g. --sort-by -last-seen)")
+	cmd.Flags().
+		Bool("no-header", false, "Print the rows as tab separated values, without header, borders or colours")
+}
+
+// renderTable prints the table, whose first row is the header, with the
+// columns and the order of the rows chosen by the table flags of the
+// command.
+func renderTable(cmd *cobra.Command, tableData pterm.TableData) error {
+	columns, _ := cmd.Flags().GetStringSlice("columns")
+	sortBy, _ := cmd.Flags().GetString("sort-by")
+	noHeader, _ := cmd.Flags().GetBool("no-header")
+
+	if sortBy != "" {
+		if err := sortTable(tableData, sortBy); err != nil {
+			return err
+		}
+	}
+
+	if len(columns) > 0 {
+		var err error
+		tableData, err = selectColumns(tableData, columns)
+		if err != nil {
+			return err
+		}
+	}
+
+	if noHeader {
+		for _, row := range tableData[1:] {
+			values := make([]string, len(row))
+			for index, value := range row {
+				values[index] = pterm.RemoveColorFromString(value)
+			}
+
+			//nolint
+			fmt.Println(strings.Join(values, "\t"))
+		}
+
+		return nil
+	}
+
+	return pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+}
+
+// columnIndex returns the index of the column in the header. Names are
+// matched ignoring case, spaces, dashes and underscores, so "last-seen"
+// selects "Last seen".
+func columnIndex(header []string, name string) (int, error) {
+	normalise := strings.NewReplacer(" ", "", "-", "", "_", "")
+
+	index := slices.IndexFunc(header, func(column string) bool {
+		return strings.EqualFold(normalise.Replace(column), normalise.Replace(name))
+	})
+	if index < 0 {
+		return 0, fmt.Errorf("unknown column %q, available columns: %s", name, strings.Join(header, ", "))
+	}
+
+	return index, nil
+}
+
+func selectColumns(tableData pterm.TableData, columns []string) (pterm.TableData, error) {
+	indexes := make([]int, len(columns))
+	for position, name := range columns {
+		index, err := columnIndex(tableData[0], name)
+		if err != nil {
+			return nil, err
+		}
+		indexes[position] = index
+	}
+
+	selected := make(pterm.TableData, len(tableData))
+	for rowIndex, row := range tableData {
+		selected[rowIndex] = make([]string, len(indexes))
+		for position, index := range indexes {
+			selected[rowIndex][position] = row[index]
+		}
+	}
+
+	return selected, nil
+}
+
+// sortTable sorts the rows of the table, keeping the header first, by the
+// column. Numbers are compared as numbers, other values as text without
+// their colours.
+func sortTable(tableData pterm.TableData, sortBy string) error {
+	descending := strings.HasPrefix(sortBy, "-")
+
+	index, err := columnIndex(tableData[0], strings.TrimPrefix(sortBy, "-"))
+	if err != nil {
+		return err
+	}
+
+	slices.SortStableFunc(tableData[1:], func(a, b []string) int {
+		x := pterm.RemoveColorFromString(a[index])
+		y := pterm.RemoveColorFromString(b[index])
+
+		result := strings.Compare(strings.ToLower(x), strings.ToLower(y))
+		if xn, err := strconv.ParseFloat(x, 64); err == nil {
+			if yn, err := strconv.ParseFloat(y, 64); err == nil {
+				result = cmp.Compare(xn, yn)
+			}
+		}
+
+		if descending {
+			return -result
+		}
+
+		return result
+	})
+
+	return nil
+}
@@ -4,7 +4,6 @@ import (
 	"errors"
 	"fmt"
 
-	survey "github.com/AlecAivazis/survey/v2"
 	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
 	"github.com/pterm/pterm"
 	"github.com/rs/zerolog/log"
@@ -15,7 +14,12 @@ import (
 func init() {
 	rootCmd.AddCommand(userCmd)
 	userCmd.AddCommand(createUserCmd)
+	createUserCmd.Flags().String("tailnet", "", "Tailnet of the multi-tailnet mode the user belongs to")
+	createUserCmd.Flags().Bool("if-not-exists", false, "Return the user if it exists already instead of failing")
+	addTableFlags(listUsersCmd)
 	userCmd.AddCommand(listUsersCmd)
+	userCmd.AddCommand(getUserCmd)
+	getUserCmd.Flags().Uint64P("identifier", "i", 0, "User identifier (ID)")
 	userCmd.AddCommand(destroyUserCmd)
 	userCmd.AddCommand(renameUserCmd)
 }
@@ -50,7 +54,10 @@ var createUserCmd = &cobra.Command{
 
 		log.Trace().Interface("client", client).Msg("Obtained gRPC client")
 
-		request := &v1.CreateUserRequest{Name: userName}
+		tailnet, _ := cmd.Flags().GetString("tailnet")
+		ifNotExists, _ := cmd.Flags().GetBool("if-not-exists")
+
+		request := &v1.CreateUserRequest{Name: userName, Tailnet: tailnet, IfNotExists: ifNotExists}
 
 		log.Trace().Interface("request", request).Msg("Sending CreateUser request")
 		response, err := client.CreateUser(ctx, request)
@@ -88,7 +95,7 @@ var destroyUserCmd = &cobra.Command{
 		userName := args[0]
 
 		request := &v1.GetUserRequest{
-			Name: userName,
+			Selector: &v1.GetUserRequest_Name{Name: userName},
 		}
 
 		ctx, client, conn, cancel := getHeadscaleCLIClient()
@@ -106,22 +113,10 @@ var destroyUserCmd = &cobra.Command{
 			return
 		}
 
-		confirm := false
-		force, _ := cmd.Flags().GetBool("force")
-		if !force {
-			prompt := &survey.Confirm{
-				Message: fmt.Sprintf(
-					"Do you want to remove the user '%s' and any associated preauthkeys?",
-					userName,
-				),
-			}
-			err := survey.AskOne(prompt, &confirm)
-			if err != nil {
-				return
-			}
-		}
-
-		if confirm || force {
+		if confirmAction(cmd, fmt.Sprintf(
+			"Do you want to remove the user '%s' and any associated preauthkeys?",
+			userName,
+		)) {
 			request := &v1.DeleteUserRequest{Name: userName}
 
 			response, err := client.DeleteUser(ctx, request)
@@ -174,7 +169,7 @@ var listUsersCmd = &cobra.Command{
 			return
 		}
 
-		tableData := pterm.TableData{{"ID", "Name", "Created"}}
+		tableData := pterm.TableData{{"ID", "Name", "Created", "Tailnet"}}
 		for _, user := range response.GetUsers() {
 			tableData = append(
 				tableData,
@@ -182,9 +177,75 @@ var listUsersCmd = &cobra.Command{
 					user.GetId(),
 					user.GetName(),
 					user.GetCreatedAt().AsTime().Format("2006-01-02 15:04:05"),
+					user.GetTailnet(),
 				},
 			)
 		}
+		err = renderTable(cmd, tableData)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Failed to render table: %s", err),
+				output,
+			)
+
+			return
+		}
+	},
+}
+
+var getUserCmd = &cobra.Command{
+	Use:   "get [NAME]",
+	Short: "Shows a user by name or identifier",
+	Args: func(cmd *cobra.Command, args []string) error {
+		identifier, _ := cmd.Flags().GetUint64("identifier")
+		if len(args) < 1 && identifier == 0 {
+			return errMissingParameter
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		request := &v1.GetUserRequest{}
+		if identifier, _ := cmd.Flags().GetUint64("identifier"); identifier != 0 {
+			request.Selector = &v1.GetUserRequest_Id{Id: identifier}
+		} else {
+			request.Selector = &v1.GetUserRequest_Name{Name: args[0]}
+		}
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.GetUser(ctx, request)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot get user: %s", status.Convert(err).Message()),
+				output,
+			)
+
+			return
+		}
+
+		if output != "" {
+			SuccessOutput(response.GetUser(), "", output)
+
+			return
+		}
+
+		user := response.GetUser()
+		tableData := pterm.TableData{
+			{"ID", "Name", "Created", "Tailnet"},
+			{
+				user.GetId(),
+				user.GetName(),
+				user.GetCreatedAt().AsTime().Format("2006-01-02 15:04:05"),
+				user.GetTailnet(),
+			},
+		}
 		err = pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
 		if err != nil {
 			ErrorOutput(
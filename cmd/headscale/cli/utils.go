@@ -4,19 +4,16 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"reflect"
 
+	"github.com/juanfont/headscale/client"
 	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
 	"github.com/juanfont/headscale/hscontrol"
-	"github.com/juanfont/headscale/hscontrol/policy"
 	"github.com/juanfont/headscale/hscontrol/types"
-	"github.com/juanfont/headscale/hscontrol/util"
 	"github.com/rs/zerolog/log"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/credentials/insecure"
 	"gopkg.in/yaml.v3"
 )
 
@@ -41,110 +38,95 @@ func getHeadscaleApp() (*hscontrol.Headscale, error) {
 
 	// We are doing this here, as in the future could be cool to have it also hot-reload
 
-	if cfg.ACL.PolicyPath != "" {
-		aclPath := util.AbsolutePathFromConfigPath(cfg.ACL.PolicyPath)
-		pol, err := policy.LoadACLPolicyFromPath(aclPath)
-		if err != nil {
+	if cfg.ACL.PolicyPath != "" || cfg.ACL.Mode == types.PolicyModeDB || len(cfg.Tailnets) > 0 {
+		if err := app.LoadACLPolicy(); err != nil {
 			log.Fatal().
-				Str("path", aclPath).
 				Err(err).
 				Msg("Could not load the ACL policy")
 		}
-
-		app.ACLPolicy = pol
 	}
 
 	return app, nil
 }
 
-func getHeadscaleCLIClient() (context.Context, v1.HeadscaleServiceClient, *grpc.ClientConn, context.CancelFunc) {
-	cfg, err := types.GetHeadscaleConfig()
+func getHeadscaleCLIClient() (context.Context, v1.HeadscaleServiceClient, *client.Client, context.CancelFunc) {
+	ctx, conn, cancel, err := newHeadscaleCLIClient()
 	if err != nil {
-		log.Fatal().
-			Err(err).
-			Caller().
-			Msgf("Failed to load configuration")
+		log.Fatal().Caller().Err(err).Msgf("Could not connect: %v", err)
 		os.Exit(-1) // we get here if logging is suppressed (i.e., json output)
 	}
 
+	return ctx, conn, conn, cancel
+}
+
+// newHeadscaleCLIClient is like getHeadscaleCLIClient, but returns an
+// error instead of exiting when the client cannot be created, for the
+// callers which can do without the server, like shell completion.
+func newHeadscaleCLIClient() (context.Context, *client.Client, context.CancelFunc, error) {
+	cfg, err := types.GetHeadscaleConfig()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("loading configuration: %w", err)
+	}
+
 	log.Debug().
 		Dur("timeout", cfg.CLI.Timeout).
 		Msgf("Setting timeout")
 
-	ctx, cancel := context.WithTimeout(context.Background(), cfg.CLI.Timeout)
-
-	grpcOptions := []grpc.DialOption{
-		grpc.WithBlock(),
+	opts := client.Options{
+		Address:  cfg.CLI.Address,
+		APIKey:   cfg.CLI.APIKey,
+		Insecure: cfg.CLI.Insecure,
 	}
 
-	address := cfg.CLI.Address
+	if cfg.CLI.CertPath != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CLI.CertPath, cfg.CLI.KeyPath)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+
+		opts.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
 
 	// If the address is not set, we assume that we are on the server hosting hscontrol.
-	if address == "" {
+	if opts.Address == "" {
 		log.Debug().
 			Str("socket", cfg.UnixSocket).
 			Msgf("HEADSCALE_CLI_ADDRESS environment is not set, connecting to unix socket.")
 
-		address = cfg.UnixSocket
+		opts.Address = "unix://" + cfg.UnixSocket
 
 		// Try to give the user better feedback if we cannot write to the headscale
 		// socket.
 		socket, err := os.OpenFile(cfg.UnixSocket, os.O_WRONLY, SocketWritePermissions) //nolint
 		if err != nil {
 			if os.IsPermission(err) {
-				log.Fatal().
-					Err(err).
-					Str("socket", cfg.UnixSocket).
-					Msgf("Unable to read/write to headscale socket, do you have the correct permissions?")
+				return nil, nil, nil, fmt.Errorf(
+					"unable to read/write to headscale socket %s, do you have the correct permissions?: %w",
+					cfg.UnixSocket,
+					err,
+				)
 			}
 		}
 		socket.Close()
-
-		grpcOptions = append(
-			grpcOptions,
-			grpc.WithTransportCredentials(insecure.NewCredentials()),
-			grpc.WithContextDialer(util.GrpcSocketDialer),
-		)
-	} else {
+	} else if opts.APIKey == "" {
 		// If we are not connecting to a local server, require an API key for authentication
-		apiKey := cfg.CLI.APIKey
-		if apiKey == "" {
-			log.Fatal().Caller().Msgf("HEADSCALE_CLI_API_KEY environment variable needs to be set.")
-		}
-		grpcOptions = append(grpcOptions,
-			grpc.WithPerRPCCredentials(tokenAuth{
-				token: apiKey,
-			}),
-		)
-
-		if cfg.CLI.Insecure {
-			tlsConfig := &tls.Config{
-				// turn of gosec as we are intentionally setting
-				// insecure.
-				//nolint:gosec
-				InsecureSkipVerify: true,
-			}
-
-			grpcOptions = append(grpcOptions,
-				grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
-			)
-		} else {
-			grpcOptions = append(grpcOptions,
-				grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(nil, "")),
-			)
-		}
+		return nil, nil, nil, errors.New("HEADSCALE_CLI_API_KEY environment variable needs to be set")
 	}
 
-	log.Trace().Caller().Str("address", address).Msg("Connecting via gRPC")
-	conn, err := grpc.DialContext(ctx, address, grpcOptions...)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.CLI.Timeout)
+
+	log.Trace().Caller().Str("address", opts.Address).Msg("Connecting via gRPC")
+	conn, err := client.New(ctx, opts)
 	if err != nil {
-		log.Fatal().Caller().Err(err).Msgf("Could not connect: %v", err)
-		os.Exit(-1) // we get here if logging is suppressed (i.e., json output)
-	}
+		cancel()
 
-	client := v1.NewHeadscaleServiceClient(conn)
+		return nil, nil, nil, err
+	}
 
-	return ctx, client, conn, cancel
+	return ctx, conn, cancel, nil
 }
 
 func SuccessOutput(result interface{}, override string, outputFormat string) {
@@ -195,24 +177,6 @@ func HasMachineOutputFlag() bool {
 	return false
 }
 
-type tokenAuth struct {
-	token string
-}
-
-// Return value is mapped to request headers.
-func (t tokenAuth) GetRequestMetadata(
-	ctx context.Context,
-	in ...string,
-) (map[string]string, error) {
-	return map[string]string{
-		"authorization": "Bearer " + t.token,
-	}, nil
-}
-
-func (tokenAuth) RequireTransportSecurity() bool {
-	return true
-}
-
 func contains[T string](ts []T, t T) bool {
 	for _, v := range ts {
 		if reflect.DeepEqual(v, t) {
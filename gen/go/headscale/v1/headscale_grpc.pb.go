@@ -19,33 +19,61 @@ import (
 const _ = grpc.SupportPackageIsVersion7
 
 const (
-	HeadscaleService_GetUser_FullMethodName          = "/headscale.v1.HeadscaleService/GetUser"
-	HeadscaleService_CreateUser_FullMethodName       = "/headscale.v1.HeadscaleService/CreateUser"
-	HeadscaleService_RenameUser_FullMethodName       = "/headscale.v1.HeadscaleService/RenameUser"
-	HeadscaleService_DeleteUser_FullMethodName       = "/headscale.v1.HeadscaleService/DeleteUser"
-	HeadscaleService_ListUsers_FullMethodName        = "/headscale.v1.HeadscaleService/ListUsers"
-	HeadscaleService_CreatePreAuthKey_FullMethodName = "/headscale.v1.HeadscaleService/CreatePreAuthKey"
-	HeadscaleService_ExpirePreAuthKey_FullMethodName = "/headscale.v1.HeadscaleService/ExpirePreAuthKey"
-	HeadscaleService_ListPreAuthKeys_FullMethodName  = "/headscale.v1.HeadscaleService/ListPreAuthKeys"
-	HeadscaleService_DebugCreateNode_FullMethodName  = "/headscale.v1.HeadscaleService/DebugCreateNode"
-	HeadscaleService_GetNode_FullMethodName          = "/headscale.v1.HeadscaleService/GetNode"
-	HeadscaleService_SetTags_FullMethodName          = "/headscale.v1.HeadscaleService/SetTags"
-	HeadscaleService_RegisterNode_FullMethodName     = "/headscale.v1.HeadscaleService/RegisterNode"
-	HeadscaleService_DeleteNode_FullMethodName       = "/headscale.v1.HeadscaleService/DeleteNode"
-	HeadscaleService_ExpireNode_FullMethodName       = "/headscale.v1.HeadscaleService/ExpireNode"
-	HeadscaleService_RenameNode_FullMethodName       = "/headscale.v1.HeadscaleService/RenameNode"
-	HeadscaleService_ListNodes_FullMethodName        = "/headscale.v1.HeadscaleService/ListNodes"
-	HeadscaleService_MoveNode_FullMethodName         = "/headscale.v1.HeadscaleService/MoveNode"
-	HeadscaleService_BackfillNodeIPs_FullMethodName  = "/headscale.v1.HeadscaleService/BackfillNodeIPs"
-	HeadscaleService_GetRoutes_FullMethodName        = "/headscale.v1.HeadscaleService/GetRoutes"
-	HeadscaleService_EnableRoute_FullMethodName      = "/headscale.v1.HeadscaleService/EnableRoute"
-	HeadscaleService_DisableRoute_FullMethodName     = "/headscale.v1.HeadscaleService/DisableRoute"
-	HeadscaleService_GetNodeRoutes_FullMethodName    = "/headscale.v1.HeadscaleService/GetNodeRoutes"
-	HeadscaleService_DeleteRoute_FullMethodName      = "/headscale.v1.HeadscaleService/DeleteRoute"
-	HeadscaleService_CreateApiKey_FullMethodName     = "/headscale.v1.HeadscaleService/CreateApiKey"
-	HeadscaleService_ExpireApiKey_FullMethodName     = "/headscale.v1.HeadscaleService/ExpireApiKey"
-	HeadscaleService_ListApiKeys_FullMethodName      = "/headscale.v1.HeadscaleService/ListApiKeys"
-	HeadscaleService_DeleteApiKey_FullMethodName     = "/headscale.v1.HeadscaleService/DeleteApiKey"
+	HeadscaleService_GetUser_FullMethodName                 = "/headscale.v1.HeadscaleService/GetUser"
+	HeadscaleService_CreateUser_FullMethodName              = "/headscale.v1.HeadscaleService/CreateUser"
+	HeadscaleService_RenameUser_FullMethodName              = "/headscale.v1.HeadscaleService/RenameUser"
+	HeadscaleService_DeleteUser_FullMethodName              = "/headscale.v1.HeadscaleService/DeleteUser"
+	HeadscaleService_ListUsers_FullMethodName               = "/headscale.v1.HeadscaleService/ListUsers"
+	HeadscaleService_CreatePreAuthKey_FullMethodName        = "/headscale.v1.HeadscaleService/CreatePreAuthKey"
+	HeadscaleService_ExpirePreAuthKey_FullMethodName        = "/headscale.v1.HeadscaleService/ExpirePreAuthKey"
+	HeadscaleService_ListPreAuthKeys_FullMethodName         = "/headscale.v1.HeadscaleService/ListPreAuthKeys"
+	HeadscaleService_DebugCreateNode_FullMethodName         = "/headscale.v1.HeadscaleService/DebugCreateNode"
+	HeadscaleService_GetNode_FullMethodName                 = "/headscale.v1.HeadscaleService/GetNode"
+	HeadscaleService_SetTags_FullMethodName                 = "/headscale.v1.HeadscaleService/SetTags"
+	HeadscaleService_RegisterNode_FullMethodName            = "/headscale.v1.HeadscaleService/RegisterNode"
+	HeadscaleService_DeleteNode_FullMethodName              = "/headscale.v1.HeadscaleService/DeleteNode"
+	HeadscaleService_ExpireNode_FullMethodName              = "/headscale.v1.HeadscaleService/ExpireNode"
+	HeadscaleService_SetNodeExpiry_FullMethodName           = "/headscale.v1.HeadscaleService/SetNodeExpiry"
+	HeadscaleService_RenameNode_FullMethodName              = "/headscale.v1.HeadscaleService/RenameNode"
+	HeadscaleService_ListNodes_FullMethodName               = "/headscale.v1.HeadscaleService/ListNodes"
+	HeadscaleService_LookupNode_FullMethodName              = "/headscale.v1.HeadscaleService/LookupNode"
+	HeadscaleService_MoveNode_FullMethodName                = "/headscale.v1.HeadscaleService/MoveNode"
+	HeadscaleService_QuarantineNode_FullMethodName          = "/headscale.v1.HeadscaleService/QuarantineNode"
+	HeadscaleService_ListPendingNodes_FullMethodName        = "/headscale.v1.HeadscaleService/ListPendingNodes"
+	HeadscaleService_ApprovePendingNode_FullMethodName      = "/headscale.v1.HeadscaleService/ApprovePendingNode"
+	HeadscaleService_RejectPendingNode_FullMethodName       = "/headscale.v1.HeadscaleService/RejectPendingNode"
+	HeadscaleService_SetPosture_FullMethodName              = "/headscale.v1.HeadscaleService/SetPosture"
+	HeadscaleService_SetNodeLabels_FullMethodName           = "/headscale.v1.HeadscaleService/SetNodeLabels"
+	HeadscaleService_GetNodeHealth_FullMethodName           = "/headscale.v1.HeadscaleService/GetNodeHealth"
+	HeadscaleService_ShareNode_FullMethodName               = "/headscale.v1.HeadscaleService/ShareNode"
+	HeadscaleService_UnshareNode_FullMethodName             = "/headscale.v1.HeadscaleService/UnshareNode"
+	HeadscaleService_ListNodeShares_FullMethodName          = "/headscale.v1.HeadscaleService/ListNodeShares"
+	HeadscaleService_BackfillNodeIPs_FullMethodName         = "/headscale.v1.HeadscaleService/BackfillNodeIPs"
+	HeadscaleService_GetRoutes_FullMethodName               = "/headscale.v1.HeadscaleService/GetRoutes"
+	HeadscaleService_EnableRoute_FullMethodName             = "/headscale.v1.HeadscaleService/EnableRoute"
+	HeadscaleService_DisableRoute_FullMethodName            = "/headscale.v1.HeadscaleService/DisableRoute"
+	HeadscaleService_GetNodeRoutes_FullMethodName           = "/headscale.v1.HeadscaleService/GetNodeRoutes"
+	HeadscaleService_DeleteRoute_FullMethodName             = "/headscale.v1.HeadscaleService/DeleteRoute"
+	HeadscaleService_CreateApiKey_FullMethodName            = "/headscale.v1.HeadscaleService/CreateApiKey"
+	HeadscaleService_ExpireApiKey_FullMethodName            = "/headscale.v1.HeadscaleService/ExpireApiKey"
+	HeadscaleService_ListApiKeys_FullMethodName             = "/headscale.v1.HeadscaleService/ListApiKeys"
+	HeadscaleService_DeleteApiKey_FullMethodName            = "/headscale.v1.HeadscaleService/DeleteApiKey"
+	HeadscaleService_ListDERPRegions_FullMethodName         = "/headscale.v1.HeadscaleService/ListDERPRegions"
+	HeadscaleService_AddDERPRegion_FullMethodName           = "/headscale.v1.HeadscaleService/AddDERPRegion"
+	HeadscaleService_RemoveDERPRegion_FullMethodName        = "/headscale.v1.HeadscaleService/RemoveDERPRegion"
+	HeadscaleService_GetPolicy_FullMethodName               = "/headscale.v1.HeadscaleService/GetPolicy"
+	HeadscaleService_SetPolicy_FullMethodName               = "/headscale.v1.HeadscaleService/SetPolicy"
+	HeadscaleService_ListPolicyVersions_FullMethodName      = "/headscale.v1.HeadscaleService/ListPolicyVersions"
+	HeadscaleService_RollbackPolicy_FullMethodName          = "/headscale.v1.HeadscaleService/RollbackPolicy"
+	HeadscaleService_DiffPolicy_FullMethodName              = "/headscale.v1.HeadscaleService/DiffPolicy"
+	HeadscaleService_CheckPolicy_FullMethodName             = "/headscale.v1.HeadscaleService/CheckPolicy"
+	HeadscaleService_ListDNSRecords_FullMethodName          = "/headscale.v1.HeadscaleService/ListDNSRecords"
+	HeadscaleService_AddDNSRecord_FullMethodName            = "/headscale.v1.HeadscaleService/AddDNSRecord"
+	HeadscaleService_DeleteDNSRecord_FullMethodName         = "/headscale.v1.HeadscaleService/DeleteDNSRecord"
+	HeadscaleService_ListScopedNameservers_FullMethodName   = "/headscale.v1.HeadscaleService/ListScopedNameservers"
+	HeadscaleService_AddScopedNameservers_FullMethodName    = "/headscale.v1.HeadscaleService/AddScopedNameservers"
+	HeadscaleService_DeleteScopedNameservers_FullMethodName = "/headscale.v1.HeadscaleService/DeleteScopedNameservers"
+	HeadscaleService_WatchEvents_FullMethodName             = "/headscale.v1.HeadscaleService/WatchEvents"
 )
 
 // HeadscaleServiceClient is the client API for HeadscaleService service.
@@ -69,9 +97,21 @@ type HeadscaleServiceClient interface {
 	RegisterNode(ctx context.Context, in *RegisterNodeRequest, opts ...grpc.CallOption) (*RegisterNodeResponse, error)
 	DeleteNode(ctx context.Context, in *DeleteNodeRequest, opts ...grpc.CallOption) (*DeleteNodeResponse, error)
 	ExpireNode(ctx context.Context, in *ExpireNodeRequest, opts ...grpc.CallOption) (*ExpireNodeResponse, error)
+	SetNodeExpiry(ctx context.Context, in *SetNodeExpiryRequest, opts ...grpc.CallOption) (*SetNodeExpiryResponse, error)
 	RenameNode(ctx context.Context, in *RenameNodeRequest, opts ...grpc.CallOption) (*RenameNodeResponse, error)
 	ListNodes(ctx context.Context, in *ListNodesRequest, opts ...grpc.CallOption) (*ListNodesResponse, error)
+	LookupNode(ctx context.Context, in *LookupNodeRequest, opts ...grpc.CallOption) (*LookupNodeResponse, error)
 	MoveNode(ctx context.Context, in *MoveNodeRequest, opts ...grpc.CallOption) (*MoveNodeResponse, error)
+	QuarantineNode(ctx context.Context, in *QuarantineNodeRequest, opts ...grpc.CallOption) (*QuarantineNodeResponse, error)
+	ListPendingNodes(ctx context.Context, in *ListPendingNodesRequest, opts ...grpc.CallOption) (*ListPendingNodesResponse, error)
+	ApprovePendingNode(ctx context.Context, in *ApprovePendingNodeRequest, opts ...grpc.CallOption) (*ApprovePendingNodeResponse, error)
+	RejectPendingNode(ctx context.Context, in *RejectPendingNodeRequest, opts ...grpc.CallOption) (*RejectPendingNodeResponse, error)
+	SetPosture(ctx context.Context, in *SetPostureRequest, opts ...grpc.CallOption) (*SetPostureResponse, error)
+	SetNodeLabels(ctx context.Context, in *SetNodeLabelsRequest, opts ...grpc.CallOption) (*SetNodeLabelsResponse, error)
+	GetNodeHealth(ctx context.Context, in *GetNodeHealthRequest, opts ...grpc.CallOption) (*GetNodeHealthResponse, error)
+	ShareNode(ctx context.Context, in *ShareNodeRequest, opts ...grpc.CallOption) (*ShareNodeResponse, error)
+	UnshareNode(ctx context.Context, in *UnshareNodeRequest, opts ...grpc.CallOption) (*UnshareNodeResponse, error)
+	ListNodeShares(ctx context.Context, in *ListNodeSharesRequest, opts ...grpc.CallOption) (*ListNodeSharesResponse, error)
 	BackfillNodeIPs(ctx context.Context, in *BackfillNodeIPsRequest, opts ...grpc.CallOption) (*BackfillNodeIPsResponse, error)
 	// --- Route start ---
 	GetRoutes(ctx context.Context, in *GetRoutesRequest, opts ...grpc.CallOption) (*GetRoutesResponse, error)
@@ -84,6 +124,26 @@ type HeadscaleServiceClient interface {
 	ExpireApiKey(ctx context.Context, in *ExpireApiKeyRequest, opts ...grpc.CallOption) (*ExpireApiKeyResponse, error)
 	ListApiKeys(ctx context.Context, in *ListApiKeysRequest, opts ...grpc.CallOption) (*ListApiKeysResponse, error)
 	DeleteApiKey(ctx context.Context, in *DeleteApiKeyRequest, opts ...grpc.CallOption) (*DeleteApiKeyResponse, error)
+	// --- DERP start ---
+	ListDERPRegions(ctx context.Context, in *ListDERPRegionsRequest, opts ...grpc.CallOption) (*ListDERPRegionsResponse, error)
+	AddDERPRegion(ctx context.Context, in *AddDERPRegionRequest, opts ...grpc.CallOption) (*AddDERPRegionResponse, error)
+	RemoveDERPRegion(ctx context.Context, in *RemoveDERPRegionRequest, opts ...grpc.CallOption) (*RemoveDERPRegionResponse, error)
+	// --- Policy start ---
+	GetPolicy(ctx context.Context, in *GetPolicyRequest, opts ...grpc.CallOption) (*GetPolicyResponse, error)
+	SetPolicy(ctx context.Context, in *SetPolicyRequest, opts ...grpc.CallOption) (*SetPolicyResponse, error)
+	ListPolicyVersions(ctx context.Context, in *ListPolicyVersionsRequest, opts ...grpc.CallOption) (*ListPolicyVersionsResponse, error)
+	RollbackPolicy(ctx context.Context, in *RollbackPolicyRequest, opts ...grpc.CallOption) (*RollbackPolicyResponse, error)
+	DiffPolicy(ctx context.Context, in *DiffPolicyRequest, opts ...grpc.CallOption) (*DiffPolicyResponse, error)
+	CheckPolicy(ctx context.Context, in *CheckPolicyRequest, opts ...grpc.CallOption) (*CheckPolicyResponse, error)
+	// --- DNS start ---
+	ListDNSRecords(ctx context.Context, in *ListDNSRecordsRequest, opts ...grpc.CallOption) (*ListDNSRecordsResponse, error)
+	AddDNSRecord(ctx context.Context, in *AddDNSRecordRequest, opts ...grpc.CallOption) (*AddDNSRecordResponse, error)
+	DeleteDNSRecord(ctx context.Context, in *DeleteDNSRecordRequest, opts ...grpc.CallOption) (*DeleteDNSRecordResponse, error)
+	ListScopedNameservers(ctx context.Context, in *ListScopedNameserversRequest, opts ...grpc.CallOption) (*ListScopedNameserversResponse, error)
+	AddScopedNameservers(ctx context.Context, in *AddScopedNameserversRequest, opts ...grpc.CallOption) (*AddScopedNameserversResponse, error)
+	DeleteScopedNameservers(ctx context.Context, in *DeleteScopedNameserversRequest, opts ...grpc.CallOption) (*DeleteScopedNameserversResponse, error)
+	// --- Events start ---
+	WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (HeadscaleService_WatchEventsClient, error)
 }
 
 type headscaleServiceClient struct {
@@ -220,6 +280,15 @@ func (c *headscaleServiceClient) ExpireNode(ctx context.Context, in *ExpireNodeR
 	return out, nil
 }
 
+func (c *headscaleServiceClient) SetNodeExpiry(ctx context.Context, in *SetNodeExpiryRequest, opts ...grpc.CallOption) (*SetNodeExpiryResponse, error) {
+	out := new(SetNodeExpiryResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_SetNodeExpiry_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *headscaleServiceClient) RenameNode(ctx context.Context, in *RenameNodeRequest, opts ...grpc.CallOption) (*RenameNodeResponse, error) {
 	out := new(RenameNodeResponse)
 	err := c.cc.Invoke(ctx, HeadscaleService_RenameNode_FullMethodName, in, out, opts...)
@@ -238,6 +307,15 @@ func (c *headscaleServiceClient) ListNodes(ctx context.Context, in *ListNodesReq
 	return out, nil
 }
 
+func (c *headscaleServiceClient) LookupNode(ctx context.Context, in *LookupNodeRequest, opts ...grpc.CallOption) (*LookupNodeResponse, error) {
+	out := new(LookupNodeResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_LookupNode_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *headscaleServiceClient) MoveNode(ctx context.Context, in *MoveNodeRequest, opts ...grpc.CallOption) (*MoveNodeResponse, error) {
 	out := new(MoveNodeResponse)
 	err := c.cc.Invoke(ctx, HeadscaleService_MoveNode_FullMethodName, in, out, opts...)
@@ -247,6 +325,96 @@ func (c *headscaleServiceClient) MoveNode(ctx context.Context, in *MoveNodeReque
 	return out, nil
 }
 
+func (c *headscaleServiceClient) QuarantineNode(ctx context.Context, in *QuarantineNodeRequest, opts ...grpc.CallOption) (*QuarantineNodeResponse, error) {
+	out := new(QuarantineNodeResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_QuarantineNode_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *headscaleServiceClient) ListPendingNodes(ctx context.Context, in *ListPendingNodesRequest, opts ...grpc.CallOption) (*ListPendingNodesResponse, error) {
+	out := new(ListPendingNodesResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_ListPendingNodes_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *headscaleServiceClient) ApprovePendingNode(ctx context.Context, in *ApprovePendingNodeRequest, opts ...grpc.CallOption) (*ApprovePendingNodeResponse, error) {
+	out := new(ApprovePendingNodeResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_ApprovePendingNode_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *headscaleServiceClient) RejectPendingNode(ctx context.Context, in *RejectPendingNodeRequest, opts ...grpc.CallOption) (*RejectPendingNodeResponse, error) {
+	out := new(RejectPendingNodeResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_RejectPendingNode_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *headscaleServiceClient) SetPosture(ctx context.Context, in *SetPostureRequest, opts ...grpc.CallOption) (*SetPostureResponse, error) {
+	out := new(SetPostureResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_SetPosture_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *headscaleServiceClient) SetNodeLabels(ctx context.Context, in *SetNodeLabelsRequest, opts ...grpc.CallOption) (*SetNodeLabelsResponse, error) {
+	out := new(SetNodeLabelsResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_SetNodeLabels_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *headscaleServiceClient) GetNodeHealth(ctx context.Context, in *GetNodeHealthRequest, opts ...grpc.CallOption) (*GetNodeHealthResponse, error) {
+	out := new(GetNodeHealthResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_GetNodeHealth_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *headscaleServiceClient) ShareNode(ctx context.Context, in *ShareNodeRequest, opts ...grpc.CallOption) (*ShareNodeResponse, error) {
+	out := new(ShareNodeResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_ShareNode_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *headscaleServiceClient) UnshareNode(ctx context.Context, in *UnshareNodeRequest, opts ...grpc.CallOption) (*UnshareNodeResponse, error) {
+	out := new(UnshareNodeResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_UnshareNode_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *headscaleServiceClient) ListNodeShares(ctx context.Context, in *ListNodeSharesRequest, opts ...grpc.CallOption) (*ListNodeSharesResponse, error) {
+	out := new(ListNodeSharesResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_ListNodeShares_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *headscaleServiceClient) BackfillNodeIPs(ctx context.Context, in *BackfillNodeIPsRequest, opts ...grpc.CallOption) (*BackfillNodeIPsResponse, error) {
 	out := new(BackfillNodeIPsResponse)
 	err := c.cc.Invoke(ctx, HeadscaleService_BackfillNodeIPs_FullMethodName, in, out, opts...)
@@ -337,6 +505,173 @@ func (c *headscaleServiceClient) DeleteApiKey(ctx context.Context, in *DeleteApi
 	return out, nil
 }
 
+func (c *headscaleServiceClient) ListDERPRegions(ctx context.Context, in *ListDERPRegionsRequest, opts ...grpc.CallOption) (*ListDERPRegionsResponse, error) {
+	out := new(ListDERPRegionsResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_ListDERPRegions_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *headscaleServiceClient) AddDERPRegion(ctx context.Context, in *AddDERPRegionRequest, opts ...grpc.CallOption) (*AddDERPRegionResponse, error) {
+	out := new(AddDERPRegionResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_AddDERPRegion_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *headscaleServiceClient) RemoveDERPRegion(ctx context.Context, in *RemoveDERPRegionRequest, opts ...grpc.CallOption) (*RemoveDERPRegionResponse, error) {
+	out := new(RemoveDERPRegionResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_RemoveDERPRegion_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *headscaleServiceClient) GetPolicy(ctx context.Context, in *GetPolicyRequest, opts ...grpc.CallOption) (*GetPolicyResponse, error) {
+	out := new(GetPolicyResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_GetPolicy_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *headscaleServiceClient) SetPolicy(ctx context.Context, in *SetPolicyRequest, opts ...grpc.CallOption) (*SetPolicyResponse, error) {
+	out := new(SetPolicyResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_SetPolicy_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *headscaleServiceClient) ListPolicyVersions(ctx context.Context, in *ListPolicyVersionsRequest, opts ...grpc.CallOption) (*ListPolicyVersionsResponse, error) {
+	out := new(ListPolicyVersionsResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_ListPolicyVersions_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *headscaleServiceClient) RollbackPolicy(ctx context.Context, in *RollbackPolicyRequest, opts ...grpc.CallOption) (*RollbackPolicyResponse, error) {
+	out := new(RollbackPolicyResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_RollbackPolicy_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *headscaleServiceClient) DiffPolicy(ctx context.Context, in *DiffPolicyRequest, opts ...grpc.CallOption) (*DiffPolicyResponse, error) {
+	out := new(DiffPolicyResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_DiffPolicy_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *headscaleServiceClient) CheckPolicy(ctx context.Context, in *CheckPolicyRequest, opts ...grpc.CallOption) (*CheckPolicyResponse, error) {
+	out := new(CheckPolicyResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_CheckPolicy_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *headscaleServiceClient) ListDNSRecords(ctx context.Context, in *ListDNSRecordsRequest, opts ...grpc.CallOption) (*ListDNSRecordsResponse, error) {
+	out := new(ListDNSRecordsResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_ListDNSRecords_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *headscaleServiceClient) AddDNSRecord(ctx context.Context, in *AddDNSRecordRequest, opts ...grpc.CallOption) (*AddDNSRecordResponse, error) {
+	out := new(AddDNSRecordResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_AddDNSRecord_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *headscaleServiceClient) DeleteDNSRecord(ctx context.Context, in *DeleteDNSRecordRequest, opts ...grpc.CallOption) (*DeleteDNSRecordResponse, error) {
+	out := new(DeleteDNSRecordResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_DeleteDNSRecord_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *headscaleServiceClient) ListScopedNameservers(ctx context.Context, in *ListScopedNameserversRequest, opts ...grpc.CallOption) (*ListScopedNameserversResponse, error) {
+	out := new(ListScopedNameserversResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_ListScopedNameservers_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *headscaleServiceClient) AddScopedNameservers(ctx context.Context, in *AddScopedNameserversRequest, opts ...grpc.CallOption) (*AddScopedNameserversResponse, error) {
+	out := new(AddScopedNameserversResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_AddScopedNameservers_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *headscaleServiceClient) DeleteScopedNameservers(ctx context.Context, in *DeleteScopedNameserversRequest, opts ...grpc.CallOption) (*DeleteScopedNameserversResponse, error) {
+	out := new(DeleteScopedNameserversResponse)
+	err := c.cc.Invoke(ctx, HeadscaleService_DeleteScopedNameservers_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *headscaleServiceClient) WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (HeadscaleService_WatchEventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &HeadscaleService_ServiceDesc.Streams[0], HeadscaleService_WatchEvents_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &headscaleServiceWatchEventsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type HeadscaleService_WatchEventsClient interface {
+	Recv() (*WatchEventsResponse, error)
+	grpc.ClientStream
+}
+
+type headscaleServiceWatchEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *headscaleServiceWatchEventsClient) Recv() (*WatchEventsResponse, error) {
+	m := new(WatchEventsResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // HeadscaleServiceServer is the server API for HeadscaleService service.
 // All implementations must embed UnimplementedHeadscaleServiceServer
 // for forward compatibility
@@ -358,9 +693,21 @@ type HeadscaleServiceServer interface {
 	RegisterNode(context.Context, *RegisterNodeRequest) (*RegisterNodeResponse, error)
 	DeleteNode(context.Context, *DeleteNodeRequest) (*DeleteNodeResponse, error)
 	ExpireNode(context.Context, *ExpireNodeRequest) (*ExpireNodeResponse, error)
+	SetNodeExpiry(context.Context, *SetNodeExpiryRequest) (*SetNodeExpiryResponse, error)
 	RenameNode(context.Context, *RenameNodeRequest) (*RenameNodeResponse, error)
 	ListNodes(context.Context, *ListNodesRequest) (*ListNodesResponse, error)
+	LookupNode(context.Context, *LookupNodeRequest) (*LookupNodeResponse, error)
 	MoveNode(context.Context, *MoveNodeRequest) (*MoveNodeResponse, error)
+	QuarantineNode(context.Context, *QuarantineNodeRequest) (*QuarantineNodeResponse, error)
+	ListPendingNodes(context.Context, *ListPendingNodesRequest) (*ListPendingNodesResponse, error)
+	ApprovePendingNode(context.Context, *ApprovePendingNodeRequest) (*ApprovePendingNodeResponse, error)
+	RejectPendingNode(context.Context, *RejectPendingNodeRequest) (*RejectPendingNodeResponse, error)
+	SetPosture(context.Context, *SetPostureRequest) (*SetPostureResponse, error)
+	SetNodeLabels(context.Context, *SetNodeLabelsRequest) (*SetNodeLabelsResponse, error)
+	GetNodeHealth(context.Context, *GetNodeHealthRequest) (*GetNodeHealthResponse, error)
+	ShareNode(context.Context, *ShareNodeRequest) (*ShareNodeResponse, error)
+	UnshareNode(context.Context, *UnshareNodeRequest) (*UnshareNodeResponse, error)
+	ListNodeShares(context.Context, *ListNodeSharesRequest) (*ListNodeSharesResponse, error)
 	BackfillNodeIPs(context.Context, *BackfillNodeIPsRequest) (*BackfillNodeIPsResponse, error)
 	// --- Route start ---
 	GetRoutes(context.Context, *GetRoutesRequest) (*GetRoutesResponse, error)
@@ -373,6 +720,26 @@ type HeadscaleServiceServer interface {
 	ExpireApiKey(context.Context, *ExpireApiKeyRequest) (*ExpireApiKeyResponse, error)
 	ListApiKeys(context.Context, *ListApiKeysRequest) (*ListApiKeysResponse, error)
 	DeleteApiKey(context.Context, *DeleteApiKeyRequest) (*DeleteApiKeyResponse, error)
+	// --- DERP start ---
+	ListDERPRegions(context.Context, *ListDERPRegionsRequest) (*ListDERPRegionsResponse, error)
+	AddDERPRegion(context.Context, *AddDERPRegionRequest) (*AddDERPRegionResponse, error)
+	RemoveDERPRegion(context.Context, *RemoveDERPRegionRequest) (*RemoveDERPRegionResponse, error)
+	// --- Policy start ---
+	GetPolicy(context.Context, *GetPolicyRequest) (*GetPolicyResponse, error)
+	SetPolicy(context.Context, *SetPolicyRequest) (*SetPolicyResponse, error)
+	ListPolicyVersions(context.Context, *ListPolicyVersionsRequest) (*ListPolicyVersionsResponse, error)
+	RollbackPolicy(context.Context, *RollbackPolicyRequest) (*RollbackPolicyResponse, error)
+	DiffPolicy(context.Context, *DiffPolicyRequest) (*DiffPolicyResponse, error)
+	CheckPolicy(context.Context, *CheckPolicyRequest) (*CheckPolicyResponse, error)
+	// --- DNS start ---
+	ListDNSRecords(context.Context, *ListDNSRecordsRequest) (*ListDNSRecordsResponse, error)
+	AddDNSRecord(context.Context, *AddDNSRecordRequest) (*AddDNSRecordResponse, error)
+	DeleteDNSRecord(context.Context, *DeleteDNSRecordRequest) (*DeleteDNSRecordResponse, error)
+	ListScopedNameservers(context.Context, *ListScopedNameserversRequest) (*ListScopedNameserversResponse, error)
+	AddScopedNameservers(context.Context, *AddScopedNameserversRequest) (*AddScopedNameserversResponse, error)
+	DeleteScopedNameservers(context.Context, *DeleteScopedNameserversRequest) (*DeleteScopedNameserversResponse, error)
+	// --- Events start ---
+	WatchEvents(*WatchEventsRequest, HeadscaleService_WatchEventsServer) error
 	mustEmbedUnimplementedHeadscaleServiceServer()
 }
 
@@ -422,15 +789,51 @@ func (UnimplementedHeadscaleServiceServer) DeleteNode(context.Context, *DeleteNo
 func (UnimplementedHeadscaleServiceServer) ExpireNode(context.Context, *ExpireNodeRequest) (*ExpireNodeResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ExpireNode not implemented")
 }
+func (UnimplementedHeadscaleServiceServer) SetNodeExpiry(context.Context, *SetNodeExpiryRequest) (*SetNodeExpiryResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetNodeExpiry not implemented")
+}
 func (UnimplementedHeadscaleServiceServer) RenameNode(context.Context, *RenameNodeRequest) (*RenameNodeResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method RenameNode not implemented")
 }
 func (UnimplementedHeadscaleServiceServer) ListNodes(context.Context, *ListNodesRequest) (*ListNodesResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ListNodes not implemented")
 }
+func (UnimplementedHeadscaleServiceServer) LookupNode(context.Context, *LookupNodeRequest) (*LookupNodeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method LookupNode not implemented")
+}
 func (UnimplementedHeadscaleServiceServer) MoveNode(context.Context, *MoveNodeRequest) (*MoveNodeResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method MoveNode not implemented")
 }
+func (UnimplementedHeadscaleServiceServer) QuarantineNode(context.Context, *QuarantineNodeRequest) (*QuarantineNodeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method QuarantineNode not implemented")
+}
+func (UnimplementedHeadscaleServiceServer) ListPendingNodes(context.Context, *ListPendingNodesRequest) (*ListPendingNodesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListPendingNodes not implemented")
+}
+func (UnimplementedHeadscaleServiceServer) ApprovePendingNode(context.Context, *ApprovePendingNodeRequest) (*ApprovePendingNodeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ApprovePendingNode not implemented")
+}
+func (UnimplementedHeadscaleServiceServer) RejectPendingNode(context.Context, *RejectPendingNodeRequest) (*RejectPendingNodeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RejectPendingNode not implemented")
+}
+func (UnimplementedHeadscaleServiceServer) SetPosture(context.Context, *SetPostureRequest) (*SetPostureResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetPosture not implemented")
+}
+func (UnimplementedHeadscaleServiceServer) SetNodeLabels(context.Context, *SetNodeLabelsRequest) (*SetNodeLabelsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetNodeLabels not implemented")
+}
+func (UnimplementedHeadscaleServiceServer) GetNodeHealth(context.Context, *GetNodeHealthRequest) (*GetNodeHealthResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetNodeHealth not implemented")
+}
+func (UnimplementedHeadscaleServiceServer) ShareNode(context.Context, *ShareNodeRequest) (*ShareNodeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ShareNode not implemented")
+}
+func (UnimplementedHeadscaleServiceServer) UnshareNode(context.Context, *UnshareNodeRequest) (*UnshareNodeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UnshareNode not implemented")
+}
+func (UnimplementedHeadscaleServiceServer) ListNodeShares(context.Context, *ListNodeSharesRequest) (*ListNodeSharesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListNodeShares not implemented")
+}
 func (UnimplementedHeadscaleServiceServer) BackfillNodeIPs(context.Context, *BackfillNodeIPsRequest) (*BackfillNodeIPsResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method BackfillNodeIPs not implemented")
 }
@@ -461,6 +864,54 @@ func (UnimplementedHeadscaleServiceServer) ListApiKeys(context.Context, *ListApi
 func (UnimplementedHeadscaleServiceServer) DeleteApiKey(context.Context, *DeleteApiKeyRequest) (*DeleteApiKeyResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method DeleteApiKey not implemented")
 }
+func (UnimplementedHeadscaleServiceServer) ListDERPRegions(context.Context, *ListDERPRegionsRequest) (*ListDERPRegionsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListDERPRegions not implemented")
+}
+func (UnimplementedHeadscaleServiceServer) AddDERPRegion(context.Context, *AddDERPRegionRequest) (*AddDERPRegionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddDERPRegion not implemented")
+}
+func (UnimplementedHeadscaleServiceServer) RemoveDERPRegion(context.Context, *RemoveDERPRegionRequest) (*RemoveDERPRegionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveDERPRegion not implemented")
+}
+func (UnimplementedHeadscaleServiceServer) GetPolicy(context.Context, *GetPolicyRequest) (*GetPolicyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetPolicy not implemented")
+}
+func (UnimplementedHeadscaleServiceServer) SetPolicy(context.Context, *SetPolicyRequest) (*SetPolicyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetPolicy not implemented")
+}
+func (UnimplementedHeadscaleServiceServer) ListPolicyVersions(context.Context, *ListPolicyVersionsRequest) (*ListPolicyVersionsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListPolicyVersions not implemented")
+}
+func (UnimplementedHeadscaleServiceServer) RollbackPolicy(context.Context, *RollbackPolicyRequest) (*RollbackPolicyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RollbackPolicy not implemented")
+}
+func (UnimplementedHeadscaleServiceServer) DiffPolicy(context.Context, *DiffPolicyRequest) (*DiffPolicyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DiffPolicy not implemented")
+}
+func (UnimplementedHeadscaleServiceServer) CheckPolicy(context.Context, *CheckPolicyRequest) (*CheckPolicyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CheckPolicy not implemented")
+}
+func (UnimplementedHeadscaleServiceServer) ListDNSRecords(context.Context, *ListDNSRecordsRequest) (*ListDNSRecordsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListDNSRecords not implemented")
+}
+func (UnimplementedHeadscaleServiceServer) AddDNSRecord(context.Context, *AddDNSRecordRequest) (*AddDNSRecordResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddDNSRecord not implemented")
+}
+func (UnimplementedHeadscaleServiceServer) DeleteDNSRecord(context.Context, *DeleteDNSRecordRequest) (*DeleteDNSRecordResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteDNSRecord not implemented")
+}
+func (UnimplementedHeadscaleServiceServer) ListScopedNameservers(context.Context, *ListScopedNameserversRequest) (*ListScopedNameserversResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListScopedNameservers not implemented")
+}
+func (UnimplementedHeadscaleServiceServer) AddScopedNameservers(context.Context, *AddScopedNameserversRequest) (*AddScopedNameserversResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddScopedNameservers not implemented")
+}
+func (UnimplementedHeadscaleServiceServer) DeleteScopedNameservers(context.Context, *DeleteScopedNameserversRequest) (*DeleteScopedNameserversResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteScopedNameservers not implemented")
+}
+func (UnimplementedHeadscaleServiceServer) WatchEvents(*WatchEventsRequest, HeadscaleService_WatchEventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchEvents not implemented")
+}
 func (UnimplementedHeadscaleServiceServer) mustEmbedUnimplementedHeadscaleServiceServer() {}
 
 // UnsafeHeadscaleServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -726,6 +1177,24 @@ func _HeadscaleService_ExpireNode_Handler(srv interface{}, ctx context.Context,
 	return interceptor(ctx, in, info, handler)
 }
 
+func _HeadscaleService_SetNodeExpiry_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetNodeExpiryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).SetNodeExpiry(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_SetNodeExpiry_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).SetNodeExpiry(ctx, req.(*SetNodeExpiryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _HeadscaleService_RenameNode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(RenameNodeRequest)
 	if err := dec(in); err != nil {
@@ -762,115 +1231,313 @@ func _HeadscaleService_ListNodes_Handler(srv interface{}, ctx context.Context, d
 	return interceptor(ctx, in, info, handler)
 }
 
-func _HeadscaleService_MoveNode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(MoveNodeRequest)
+func _HeadscaleService_LookupNode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LookupNodeRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(HeadscaleServiceServer).MoveNode(ctx, in)
+		return srv.(HeadscaleServiceServer).LookupNode(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: HeadscaleService_MoveNode_FullMethodName,
+		FullMethod: HeadscaleService_LookupNode_FullMethodName,
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(HeadscaleServiceServer).MoveNode(ctx, req.(*MoveNodeRequest))
+		return srv.(HeadscaleServiceServer).LookupNode(ctx, req.(*LookupNodeRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
-func _HeadscaleService_BackfillNodeIPs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(BackfillNodeIPsRequest)
+func _HeadscaleService_MoveNode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MoveNodeRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(HeadscaleServiceServer).BackfillNodeIPs(ctx, in)
+		return srv.(HeadscaleServiceServer).MoveNode(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: HeadscaleService_BackfillNodeIPs_FullMethodName,
+		FullMethod: HeadscaleService_MoveNode_FullMethodName,
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(HeadscaleServiceServer).BackfillNodeIPs(ctx, req.(*BackfillNodeIPsRequest))
+		return srv.(HeadscaleServiceServer).MoveNode(ctx, req.(*MoveNodeRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
-func _HeadscaleService_GetRoutes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(GetRoutesRequest)
+func _HeadscaleService_QuarantineNode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QuarantineNodeRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(HeadscaleServiceServer).GetRoutes(ctx, in)
+		return srv.(HeadscaleServiceServer).QuarantineNode(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: HeadscaleService_GetRoutes_FullMethodName,
+		FullMethod: HeadscaleService_QuarantineNode_FullMethodName,
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(HeadscaleServiceServer).GetRoutes(ctx, req.(*GetRoutesRequest))
+		return srv.(HeadscaleServiceServer).QuarantineNode(ctx, req.(*QuarantineNodeRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
-func _HeadscaleService_EnableRoute_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(EnableRouteRequest)
+func _HeadscaleService_ListPendingNodes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListPendingNodesRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(HeadscaleServiceServer).EnableRoute(ctx, in)
+		return srv.(HeadscaleServiceServer).ListPendingNodes(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: HeadscaleService_EnableRoute_FullMethodName,
+		FullMethod: HeadscaleService_ListPendingNodes_FullMethodName,
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(HeadscaleServiceServer).EnableRoute(ctx, req.(*EnableRouteRequest))
+		return srv.(HeadscaleServiceServer).ListPendingNodes(ctx, req.(*ListPendingNodesRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
-func _HeadscaleService_DisableRoute_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(DisableRouteRequest)
+func _HeadscaleService_ApprovePendingNode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ApprovePendingNodeRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(HeadscaleServiceServer).DisableRoute(ctx, in)
+		return srv.(HeadscaleServiceServer).ApprovePendingNode(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: HeadscaleService_DisableRoute_FullMethodName,
+		FullMethod: HeadscaleService_ApprovePendingNode_FullMethodName,
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(HeadscaleServiceServer).DisableRoute(ctx, req.(*DisableRouteRequest))
+		return srv.(HeadscaleServiceServer).ApprovePendingNode(ctx, req.(*ApprovePendingNodeRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
-func _HeadscaleService_GetNodeRoutes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(GetNodeRoutesRequest)
+func _HeadscaleService_RejectPendingNode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RejectPendingNodeRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(HeadscaleServiceServer).GetNodeRoutes(ctx, in)
+		return srv.(HeadscaleServiceServer).RejectPendingNode(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: HeadscaleService_GetNodeRoutes_FullMethodName,
+		FullMethod: HeadscaleService_RejectPendingNode_FullMethodName,
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(HeadscaleServiceServer).GetNodeRoutes(ctx, req.(*GetNodeRoutesRequest))
+		return srv.(HeadscaleServiceServer).RejectPendingNode(ctx, req.(*RejectPendingNodeRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
-func _HeadscaleService_DeleteRoute_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+func _HeadscaleService_SetPosture_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetPostureRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).SetPosture(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_SetPosture_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).SetPosture(ctx, req.(*SetPostureRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_SetNodeLabels_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetNodeLabelsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).SetNodeLabels(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_SetNodeLabels_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).SetNodeLabels(ctx, req.(*SetNodeLabelsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_GetNodeHealth_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetNodeHealthRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).GetNodeHealth(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_GetNodeHealth_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).GetNodeHealth(ctx, req.(*GetNodeHealthRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_ShareNode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ShareNodeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).ShareNode(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_ShareNode_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).ShareNode(ctx, req.(*ShareNodeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_UnshareNode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UnshareNodeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).UnshareNode(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_UnshareNode_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).UnshareNode(ctx, req.(*UnshareNodeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_ListNodeShares_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListNodeSharesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).ListNodeShares(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_ListNodeShares_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).ListNodeShares(ctx, req.(*ListNodeSharesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_BackfillNodeIPs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BackfillNodeIPsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).BackfillNodeIPs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_BackfillNodeIPs_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).BackfillNodeIPs(ctx, req.(*BackfillNodeIPsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_GetRoutes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRoutesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).GetRoutes(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_GetRoutes_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).GetRoutes(ctx, req.(*GetRoutesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_EnableRoute_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EnableRouteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).EnableRoute(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_EnableRoute_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).EnableRoute(ctx, req.(*EnableRouteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_DisableRoute_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DisableRouteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).DisableRoute(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_DisableRoute_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).DisableRoute(ctx, req.(*DisableRouteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_GetNodeRoutes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetNodeRoutesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).GetNodeRoutes(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_GetNodeRoutes_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).GetNodeRoutes(ctx, req.(*GetNodeRoutesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_DeleteRoute_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(DeleteRouteRequest)
 	if err := dec(in); err != nil {
 		return nil, err
@@ -960,6 +1627,297 @@ func _HeadscaleService_DeleteApiKey_Handler(srv interface{}, ctx context.Context
 	return interceptor(ctx, in, info, handler)
 }
 
+func _HeadscaleService_ListDERPRegions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListDERPRegionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).ListDERPRegions(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_ListDERPRegions_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).ListDERPRegions(ctx, req.(*ListDERPRegionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_AddDERPRegion_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddDERPRegionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).AddDERPRegion(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_AddDERPRegion_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).AddDERPRegion(ctx, req.(*AddDERPRegionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_RemoveDERPRegion_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemoveDERPRegionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).RemoveDERPRegion(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_RemoveDERPRegion_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).RemoveDERPRegion(ctx, req.(*RemoveDERPRegionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_GetPolicy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetPolicyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).GetPolicy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_GetPolicy_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).GetPolicy(ctx, req.(*GetPolicyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_SetPolicy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetPolicyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).SetPolicy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_SetPolicy_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).SetPolicy(ctx, req.(*SetPolicyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_ListPolicyVersions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListPolicyVersionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).ListPolicyVersions(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_ListPolicyVersions_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).ListPolicyVersions(ctx, req.(*ListPolicyVersionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_RollbackPolicy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RollbackPolicyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).RollbackPolicy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_RollbackPolicy_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).RollbackPolicy(ctx, req.(*RollbackPolicyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_DiffPolicy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DiffPolicyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).DiffPolicy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_DiffPolicy_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).DiffPolicy(ctx, req.(*DiffPolicyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_CheckPolicy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CheckPolicyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).CheckPolicy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_CheckPolicy_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).CheckPolicy(ctx, req.(*CheckPolicyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_ListDNSRecords_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListDNSRecordsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).ListDNSRecords(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_ListDNSRecords_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).ListDNSRecords(ctx, req.(*ListDNSRecordsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_AddDNSRecord_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddDNSRecordRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).AddDNSRecord(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_AddDNSRecord_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).AddDNSRecord(ctx, req.(*AddDNSRecordRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_DeleteDNSRecord_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteDNSRecordRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).DeleteDNSRecord(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_DeleteDNSRecord_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).DeleteDNSRecord(ctx, req.(*DeleteDNSRecordRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_ListScopedNameservers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListScopedNameserversRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).ListScopedNameservers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_ListScopedNameservers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).ListScopedNameservers(ctx, req.(*ListScopedNameserversRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_AddScopedNameservers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddScopedNameserversRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).AddScopedNameservers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_AddScopedNameservers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).AddScopedNameservers(ctx, req.(*AddScopedNameserversRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_DeleteScopedNameservers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteScopedNameserversRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeadscaleServiceServer).DeleteScopedNameservers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HeadscaleService_DeleteScopedNameservers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeadscaleServiceServer).DeleteScopedNameservers(ctx, req.(*DeleteScopedNameserversRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HeadscaleService_WatchEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(HeadscaleServiceServer).WatchEvents(m, &headscaleServiceWatchEventsServer{stream})
+}
+
+type HeadscaleService_WatchEventsServer interface {
+	Send(*WatchEventsResponse) error
+	grpc.ServerStream
+}
+
+type headscaleServiceWatchEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *headscaleServiceWatchEventsServer) Send(m *WatchEventsResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 // HeadscaleService_ServiceDesc is the grpc.ServiceDesc for HeadscaleService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -1023,6 +1981,10 @@ var HeadscaleService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "ExpireNode",
 			Handler:    _HeadscaleService_ExpireNode_Handler,
 		},
+		{
+			MethodName: "SetNodeExpiry",
+			Handler:    _HeadscaleService_SetNodeExpiry_Handler,
+		},
 		{
 			MethodName: "RenameNode",
 			Handler:    _HeadscaleService_RenameNode_Handler,
@@ -1031,10 +1993,54 @@ var HeadscaleService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "ListNodes",
 			Handler:    _HeadscaleService_ListNodes_Handler,
 		},
+		{
+			MethodName: "LookupNode",
+			Handler:    _HeadscaleService_LookupNode_Handler,
+		},
 		{
 			MethodName: "MoveNode",
 			Handler:    _HeadscaleService_MoveNode_Handler,
 		},
+		{
+			MethodName: "QuarantineNode",
+			Handler:    _HeadscaleService_QuarantineNode_Handler,
+		},
+		{
+			MethodName: "ListPendingNodes",
+			Handler:    _HeadscaleService_ListPendingNodes_Handler,
+		},
+		{
+			MethodName: "ApprovePendingNode",
+			Handler:    _HeadscaleService_ApprovePendingNode_Handler,
+		},
+		{
+			MethodName: "RejectPendingNode",
+			Handler:    _HeadscaleService_RejectPendingNode_Handler,
+		},
+		{
+			MethodName: "SetPosture",
+			Handler:    _HeadscaleService_SetPosture_Handler,
+		},
+		{
+			MethodName: "SetNodeLabels",
+			Handler:    _HeadscaleService_SetNodeLabels_Handler,
+		},
+		{
+			MethodName: "GetNodeHealth",
+			Handler:    _HeadscaleService_GetNodeHealth_Handler,
+		},
+		{
+			MethodName: "ShareNode",
+			Handler:    _HeadscaleService_ShareNode_Handler,
+		},
+		{
+			MethodName: "UnshareNode",
+			Handler:    _HeadscaleService_UnshareNode_Handler,
+		},
+		{
+			MethodName: "ListNodeShares",
+			Handler:    _HeadscaleService_ListNodeShares_Handler,
+		},
 		{
 			MethodName: "BackfillNodeIPs",
 			Handler:    _HeadscaleService_BackfillNodeIPs_Handler,
@@ -1075,7 +2081,73 @@ var HeadscaleService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "DeleteApiKey",
 			Handler:    _HeadscaleService_DeleteApiKey_Handler,
 		},
+		{
+			MethodName: "ListDERPRegions",
+			Handler:    _HeadscaleService_ListDERPRegions_Handler,
+		},
+		{
+			MethodName: "AddDERPRegion",
+			Handler:    _HeadscaleService_AddDERPRegion_Handler,
+		},
+		{
+			MethodName: "RemoveDERPRegion",
+			Handler:    _HeadscaleService_RemoveDERPRegion_Handler,
+		},
+		{
+			MethodName: "GetPolicy",
+			Handler:    _HeadscaleService_GetPolicy_Handler,
+		},
+		{
+			MethodName: "SetPolicy",
+			Handler:    _HeadscaleService_SetPolicy_Handler,
+		},
+		{
+			MethodName: "ListPolicyVersions",
+			Handler:    _HeadscaleService_ListPolicyVersions_Handler,
+		},
+		{
+			MethodName: "RollbackPolicy",
+			Handler:    _HeadscaleService_RollbackPolicy_Handler,
+		},
+		{
+			MethodName: "DiffPolicy",
+			Handler:    _HeadscaleService_DiffPolicy_Handler,
+		},
+		{
+			MethodName: "CheckPolicy",
+			Handler:    _HeadscaleService_CheckPolicy_Handler,
+		},
+		{
+			MethodName: "ListDNSRecords",
+			Handler:    _HeadscaleService_ListDNSRecords_Handler,
+		},
+		{
+			MethodName: "AddDNSRecord",
+			Handler:    _HeadscaleService_AddDNSRecord_Handler,
+		},
+		{
+			MethodName: "DeleteDNSRecord",
+			Handler:    _HeadscaleService_DeleteDNSRecord_Handler,
+		},
+		{
+			MethodName: "ListScopedNameservers",
+			Handler:    _HeadscaleService_ListScopedNameservers_Handler,
+		},
+		{
+			MethodName: "AddScopedNameservers",
+			Handler:    _HeadscaleService_AddScopedNameservers_Handler,
+		},
+		{
+			MethodName: "DeleteScopedNameservers",
+			Handler:    _HeadscaleService_DeleteScopedNameservers_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchEvents",
+			Handler:       _HeadscaleService_WatchEvents_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "headscale/v1/headscale.proto",
 }
@@ -0,0 +1,110 @@
+package hscontrol
+
+import (
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// apiPermission is the access to a resource a call to the API needs.
+type apiPermission struct {
+	resource string
+	write    bool
+}
+
+func apiRead(resource string) apiPermission {
+	return apiPermission{resource: resource}
+}
+
+func apiWrite(resource string) apiPermission {
+	return apiPermission{resource: resource, write: true}
+}
+
+// apiPermissions is the permission needed by each method of the API,
+// methods missing from it are refused to keys with scopes.
+var apiPermissions = map[string]apiPermission{
+	v1.HeadscaleService_GetUser_FullMethodName:    apiRead(types.APIResourceUsers),
+	v1.HeadscaleService_ListUsers_FullMethodName:  apiRead(types.APIResourceUsers),
+	v1.HeadscaleService_CreateUser_FullMethodName: apiWrite(types.APIResourceUsers),
+	v1.HeadscaleService_RenameUser_FullMethodName: apiWrite(types.APIResourceUsers),
+	v1.HeadscaleService_DeleteUser_FullMethodName: apiWrite(types.APIResourceUsers),
+
+	v1.HeadscaleService_ListPreAuthKeys_FullMethodName:  apiRead(types.APIResourcePreAuthKeys),
+	v1.HeadscaleService_CreatePreAuthKey_FullMethodName: apiWrite(types.APIResourcePreAuthKeys),
+	v1.HeadscaleService_ExpirePreAuthKey_FullMethodName: apiWrite(types.APIResourcePreAuthKeys),
+
+	v1.HeadscaleService_GetNode_FullMethodName:            apiRead(types.APIResourceNodes),
+	v1.HeadscaleService_ListNodes_FullMethodName:          apiRead(types.APIResourceNodes),
+	v1.HeadscaleService_LookupNode_FullMethodName:         apiRead(types.APIResourceNodes),
+	v1.HeadscaleService_ListPendingNodes_FullMethodName:   apiRead(types.APIResourceNodes),
+	v1.HeadscaleService_DebugCreateNode_FullMethodName:    apiWrite(types.APIResourceNodes),
+	v1.HeadscaleService_SetTags_FullMethodName:            apiWrite(types.APIResourceNodes),
+	v1.HeadscaleService_RegisterNode_FullMethodName:       apiWrite(types.APIResourceNodes),
+	v1.HeadscaleService_DeleteNode_FullMethodName:         apiWrite(types.APIResourceNodes),
+	v1.HeadscaleService_ExpireNode_FullMethodName:         apiWrite(types.APIResourceNodes),
+	v1.HeadscaleService_SetNodeExpiry_FullMethodName:      apiWrite(types.APIResourceNodes),
+	v1.HeadscaleService_RenameNode_FullMethodName:         apiWrite(types.APIResourceNodes),
+	v1.HeadscaleService_MoveNode_FullMethodName:           apiWrite(types.APIResourceNodes),
+	v1.HeadscaleService_QuarantineNode_FullMethodName:     apiWrite(types.APIResourceNodes),
+	v1.HeadscaleService_SetPosture_FullMethodName:         apiWrite(types.APIResourceNodes),
+	v1.HeadscaleService_SetNodeLabels_FullMethodName:      apiWrite(types.APIResourceNodes),
+	v1.HeadscaleService_GetNodeHealth_FullMethodName:      apiRead(types.APIResourceNodes),
+	v1.HeadscaleService_ShareNode_FullMethodName:          apiWrite(types.APIResourceNodes),
+	v1.HeadscaleService_UnshareNode_FullMethodName:        apiWrite(types.APIResourceNodes),
+	v1.HeadscaleService_ListNodeShares_FullMethodName:     apiRead(types.APIResourceNodes),
+	v1.HeadscaleService_ApprovePendingNode_FullMethodName: apiWrite(types.APIResourceNodes),
+	v1.HeadscaleService_RejectPendingNode_FullMethodName:  apiWrite(types.APIResourceNodes),
+	v1.HeadscaleService_BackfillNodeIPs_FullMethodName:    apiWrite(types.APIResourceNodes),
+
+	v1.HeadscaleService_GetRoutes_FullMethodName:     apiRead(types.APIResourceRoutes),
+	v1.HeadscaleService_GetNodeRoutes_FullMethodName: apiRead(types.APIResourceRoutes),
+	v1.HeadscaleService_EnableRoute_FullMethodName:   apiWrite(types.APIResourceRoutes),
+	v1.HeadscaleService_DisableRoute_FullMethodName:  apiWrite(types.APIResourceRoutes),
+	v1.HeadscaleService_DeleteRoute_FullMethodName:   apiWrite(types.APIResourceRoutes),
+
+	v1.HeadscaleService_ListApiKeys_FullMethodName:  apiRead(types.APIResourceAPIKeys),
+	v1.HeadscaleService_CreateApiKey_FullMethodName: apiWrite(types.APIResourceAPIKeys),
+	v1.HeadscaleService_ExpireApiKey_FullMethodName: apiWrite(types.APIResourceAPIKeys),
+	v1.HeadscaleService_DeleteApiKey_FullMethodName: apiWrite(types.APIResourceAPIKeys),
+
+	v1.HeadscaleService_ListDERPRegions_FullMethodName:  apiRead(types.APIResourceDERP),
+	v1.HeadscaleService_AddDERPRegion_FullMethodName:    apiWrite(types.APIResourceDERP),
+	v1.HeadscaleService_RemoveDERPRegion_FullMethodName: apiWrite(types.APIResourceDERP),
+
+	v1.HeadscaleService_GetPolicy_FullMethodName:          apiRead(types.APIResourcePolicy),
+	v1.HeadscaleService_CheckPolicy_FullMethodName:        apiRead(types.APIResourcePolicy),
+	v1.HeadscaleService_DiffPolicy_FullMethodName:         apiRead(types.APIResourcePolicy),
+	v1.HeadscaleService_ListPolicyVersions_FullMethodName: apiRead(types.APIResourcePolicy),
+	v1.HeadscaleService_SetPolicy_FullMethodName:          apiWrite(types.APIResourcePolicy),
+	v1.HeadscaleService_RollbackPolicy_FullMethodName:     apiWrite(types.APIResourcePolicy),
+
+	v1.HeadscaleService_ListDNSRecords_FullMethodName:          apiRead(types.APIResourceDNS),
+	v1.HeadscaleService_ListScopedNameservers_FullMethodName:   apiRead(types.APIResourceDNS),
+	v1.HeadscaleService_AddDNSRecord_FullMethodName:            apiWrite(types.APIResourceDNS),
+	v1.HeadscaleService_DeleteDNSRecord_FullMethodName:         apiWrite(types.APIResourceDNS),
+	v1.HeadscaleService_AddScopedNameservers_FullMethodName:    apiWrite(types.APIResourceDNS),
+	v1.HeadscaleService_DeleteScopedNameservers_FullMethodName: apiWrite(types.APIResourceDNS),
+
+	v1.HeadscaleService_WatchEvents_FullMethodName: apiRead(types.APIResourceEvents),
+}
+
+// authorizeAPIKey checks that the scopes of the key allow calling the
+// method.
+func authorizeAPIKey(key *types.APIKey, fullMethod string) error {
+	if len(key.Scopes) == 0 {
+		return nil
+	}
+
+	perm, ok := apiPermissions[fullMethod]
+	if !ok || !key.Allows(perm.resource, perm.write) {
+		return status.Errorf(
+			codes.PermissionDenied,
+			"the API key %s does not allow calling %s",
+			key.Prefix,
+			fullMethod,
+		)
+	}
+
+	return nil
+}
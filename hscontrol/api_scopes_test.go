@@ -0,0 +1,96 @@
+package hscontrol
+
+import (
+	"testing"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAPIPermissionsCoverAllMethods(t *testing.T) {
+	desc := v1.HeadscaleService_ServiceDesc
+
+	var methods []string
+	for _, method := range desc.Methods {
+		methods = append(methods, method.MethodName)
+	}
+	for _, stream := range desc.Streams {
+		methods = append(methods, stream.StreamName)
+	}
+
+	for _, method := range methods {
+		fullMethod := "/" + desc.ServiceName + "/" + method
+		if _, ok := apiPermissions[fullMethod]; !ok {
+			t.Errorf("no permission for %s", fullMethod)
+		}
+	}
+}
+
+func TestAuthorizeAPIKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []string
+		method string
+		want   codes.Code
+	}{
+		{
+			name:   "no-scopes",
+			method: v1.HeadscaleService_DeleteUser_FullMethodName,
+			want:   codes.OK,
+		},
+		{
+			name:   "read-all",
+			scopes: []string{"read"},
+			method: v1.HeadscaleService_ListNodes_FullMethodName,
+			want:   codes.OK,
+		},
+		{
+			name:   "read-all-cannot-write",
+			scopes: []string{"read"},
+			method: v1.HeadscaleService_DeleteNode_FullMethodName,
+			want:   codes.PermissionDenied,
+		},
+		{
+			name:   "write-includes-read",
+			scopes: []string{"routes:write"},
+			method: v1.HeadscaleService_GetRoutes_FullMethodName,
+			want:   codes.OK,
+		},
+		{
+			name:   "other-resource",
+			scopes: []string{"nodes:read", "routes:write"},
+			method: v1.HeadscaleService_CreateUser_FullMethodName,
+			want:   codes.PermissionDenied,
+		},
+		{
+			name:   "keys-admin",
+			scopes: []string{"keys:admin"},
+			method: v1.HeadscaleService_CreateApiKey_FullMethodName,
+			want:   codes.OK,
+		},
+		{
+			name:   "stream",
+			scopes: []string{"events:read"},
+			method: v1.HeadscaleService_WatchEvents_FullMethodName,
+			want:   codes.OK,
+		},
+		{
+			name:   "unknown-method",
+			scopes: []string{"read"},
+			method: "/headscale.v1.HeadscaleService/Unknown",
+			want:   codes.PermissionDenied,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := &types.APIKey{Prefix: "prefix", Scopes: tt.scopes}
+			err := authorizeAPIKey(key, tt.method)
+			if got := status.Code(err); got != tt.want {
+				t.Errorf("authorizeAPIKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
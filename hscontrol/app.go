@@ -8,13 +8,14 @@ import (
 	"io"
 	"net"
 	"net/http"
-	_ "net/http/pprof" //nolint
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -33,14 +34,13 @@ import (
 	"github.com/juanfont/headscale/hscontrol/policy"
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/juanfont/headscale/hscontrol/webhook"
 	"github.com/patrickmn/go-cache"
 	zerolog "github.com/philip-bui/grpc-zerolog"
 	"github.com/pkg/profile"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	zl "github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"golang.org/x/crypto/acme"
-	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/oauth2"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
@@ -91,18 +91,43 @@ type Headscale struct {
 	ipAlloc         *db.IPAllocator
 	noisePrivateKey *key.MachinePrivate
 
-	DERPMap    *tailcfg.DERPMap
-	DERPServer *derpServer.DERPServer
+	DERPMap     *tailcfg.DERPMap
+	DERPServer  *derpServer.DERPServer
+	derpManager *derp.Manager
 
 	ACLPolicy *policy.ACLPolicy
+	policyMu  sync.Mutex
+
+	// tailnetPolicies are the policies of the tailnets of the
+	// multi-tailnet mode, by name. ACLPolicy is the policy of the
+	// default tailnet.
+	tailnetPolicies map[string]*policy.ACLPolicy
+
+	// aclHostsRefresh asks the refresher to load the external IP sets
+	// of the policies which were just loaded.
+	aclHostsRefresh chan struct{}
+
+	// reloadMu serialises the reloads of the configuration, on SIGHUP
+	// and when its file changes.
+	reloadMu sync.Mutex
 
 	mapper       *mapper.Mapper
 	nodeNotifier *notifier.Notifier
+	webhooks     *webhook.Dispatcher
+	ephemeralGC  *db.EphemeralGarbageCollector
+	routeManager *routeManager
+	nodeStatus   *db.NodeStatusWriter
+	ha           *haCoordinator
+	// clusterKeys authenticate the changes exchanged with the other
+	// instances, with HA or a NATS or Redis change bus.
+	clusterKeys *types.ClusterKeyring
 
 	oidcProvider *oidc.Provider
-	oauth2Config *oauth2.Config
+	// oauth2Config is replaced when the client secret is reloaded.
+	oauth2Config atomic.Pointer[oauth2.Config]
 
 	registrationCache *cache.Cache
+	sshCheckCache     *cache.Cache
 
 	pollNetMapStreamWG sync.WaitGroup
 }
@@ -136,8 +161,30 @@ func NewHeadscale(cfg *types.Config) (*Headscale, error) {
 		cfg:                cfg,
 		noisePrivateKey:    noisePrivateKey,
 		registrationCache:  registrationCache,
+		sshCheckCache:      cache.New(sshCheckExpiration, sshCheckCleanup),
 		pollNetMapStreamWG: sync.WaitGroup{},
 		nodeNotifier:       notifier.NewNotifier(cfg),
+		aclHostsRefresh:    make(chan struct{}, 1),
+	}
+	if cfg.HA.Enabled || cfg.ChangeBus.Shared() {
+		app.clusterKeys, err = types.LoadClusterKeyring(cfg.HA.ClusterKeyPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	changeBus, err := notifier.NewChangeBus(cfg.ChangeBus, app.clusterKeys)
+	if err != nil {
+		return nil, err
+	}
+	app.nodeNotifier.SetBus(changeBus)
+
+	app.ephemeralGC = db.NewEphemeralGarbageCollector(app.deleteEphemeralNode)
+	app.routeManager = newRouteManager(&app)
+
+	app.webhooks, err = webhook.NewDispatcher(cfg.Webhooks)
+	if err != nil {
+		return nil, err
 	}
 
 	app.db, err = db.NewHeadscaleDatabase(
@@ -147,11 +194,21 @@ func NewHeadscale(cfg *types.Config) (*Headscale, error) {
 		return nil, err
 	}
 
-	app.ipAlloc, err = db.NewIPAllocator(app.db, cfg.PrefixV4, cfg.PrefixV6, cfg.IPAllocation)
+	app.ipAlloc, err = db.NewIPAllocator(app.db, cfg.PrefixV4, cfg.PrefixV6, cfg.IPAllocation, cfg.IPPools)
 	if err != nil {
 		return nil, err
 	}
 
+	app.nodeStatus = db.NewNodeStatusWriter(app.db, cfg.Database.NodeStatusWriteInterval)
+
+	if cfg.HA.Enabled {
+		app.ha = newHACoordinator(&app, cfg.HA, app.clusterKeys)
+
+		// The other instances write to the database too, the nodes
+		// cannot be kept in memory.
+		app.db.NodeStore().Disable()
+	}
+
 	if cfg.OIDC.Issuer != "" {
 		err = app.initOIDC()
 		if err != nil {
@@ -163,25 +220,7 @@ func NewHeadscale(cfg *types.Config) (*Headscale, error) {
 		}
 	}
 
-	if app.cfg.DNSConfig != nil && app.cfg.DNSConfig.Proxied { // if MagicDNS
-		// TODO(kradalby): revisit why this takes a list.
-
-		var magicDNSDomains []dnsname.FQDN
-		if cfg.PrefixV4 != nil {
-			magicDNSDomains = append(magicDNSDomains, util.GenerateIPv4DNSRootDomain(*cfg.PrefixV4)...)
-		}
-		if cfg.PrefixV6 != nil {
-			magicDNSDomains = append(magicDNSDomains, util.GenerateIPv6DNSRootDomain(*cfg.PrefixV6)...)
-		}
-
-		// we might have routes already from Split DNS
-		if app.cfg.DNSConfig.Routes == nil {
-			app.cfg.DNSConfig.Routes = make(map[string][]*dnstype.Resolver)
-		}
-		for _, d := range magicDNSDomains {
-			app.cfg.DNSConfig.Routes[d.WithoutTrailingDot()] = nil
-		}
-	}
+	addMagicDNSRoutes(cfg)
 
 	if cfg.DERP.ServerEnabled {
 		derpServerKey, err := readOrCreatePrivateKey(cfg.DERP.ServerPrivateKeyPath)
@@ -204,57 +243,207 @@ func NewHeadscale(cfg *types.Config) (*Headscale, error) {
 		if err != nil {
 			return nil, err
 		}
+
+		if cfg.DERP.ServerVerifyClients {
+			if err := embeddedDERPServer.VerifyClients(app.verifyDERPClient); err != nil {
+				return nil, fmt.Errorf("setting up DERP client verification: %w", err)
+			}
+		}
+
 		app.DERPServer = embeddedDERPServer
 	}
 
 	return &app, nil
 }
 
+// addMagicDNSRoutes adds the reverse DNS domains of the prefixes of
+// the tailnet to the routes of the DNS configuration, if MagicDNS is
+// enabled.
+func addMagicDNSRoutes(cfg *types.Config) {
+	if cfg.DNSConfig == nil || !cfg.DNSConfig.Proxied {
+		return
+	}
+
+	// TODO(kradalby): revisit why this takes a list.
+	var magicDNSDomains []dnsname.FQDN
+	if cfg.PrefixV4 != nil {
+		magicDNSDomains = append(magicDNSDomains, util.GenerateIPv4DNSRootDomain(*cfg.PrefixV4)...)
+	}
+	if cfg.PrefixV6 != nil {
+		magicDNSDomains = append(magicDNSDomains, util.GenerateIPv6DNSRootDomain(*cfg.PrefixV6)...)
+	}
+
+	// we might have routes already from Split DNS
+	if cfg.DNSConfig.Routes == nil {
+		cfg.DNSConfig.Routes = make(map[string][]*dnstype.Resolver)
+	}
+	for _, d := range magicDNSDomains {
+		cfg.DNSConfig.Routes[d.WithoutTrailingDot()] = nil
+	}
+}
+
 // Redirect to our TLS url.
+// LoadACLPolicy loads the policy from the configured path and runs its
+// tests against the current nodes. The policy is only used if it is
+// valid and all its tests pass. In the database policy mode, the latest
+// version stored in the database is loaded. The policies of the
+// tailnets of the multi-tailnet mode are loaded from their paths.
+func (h *Headscale) LoadACLPolicy() error {
+	if err := h.loadTailnetPolicies(); err != nil {
+		return err
+	}
+
+	if h.cfg.ACL.Mode == types.PolicyModeDB {
+		if err := h.loadDBPolicy(); err != nil {
+			return err
+		}
+
+		h.autoApproveRoutes()
+
+		return nil
+	}
+
+	// Only the tailnets have a policy.
+	if h.cfg.ACL.PolicyPath == "" {
+		h.autoApproveRoutes()
+
+		return nil
+	}
+
+	aclPath := util.AbsolutePathFromConfigPath(h.cfg.ACL.PolicyPath)
+	pol, err := policy.LoadACLPolicyFromPath(aclPath)
+	if err != nil {
+		return fmt.Errorf("loading ACL policy from %s: %w", aclPath, err)
+	}
+
+	if _, err := h.applyIdPGroups(pol); err != nil {
+		return fmt.Errorf("adding the identity provider groups to the ACL policy: %w", err)
+	}
+
+	if _, err := h.applyNodeShares(pol); err != nil {
+		return fmt.Errorf("adding the node shares to the ACL policy: %w", err)
+	}
+
+	pol.KeepHostSources(h.ACLPolicy)
+
+	nodes, err := h.db.ListNodes()
+	if err != nil {
+		return fmt.Errorf("listing nodes to run policy tests: %w", err)
+	}
+
+	if err := pol.RunTests(nodes.InTailnet("")); err != nil {
+		return fmt.Errorf("running tests of ACL policy %s: %w", aclPath, err)
+	}
+
+	h.ACLPolicy = pol
+	h.refreshACLHostsSoon()
+	h.autoApproveRoutes()
+
+	return nil
+}
+
 func (h *Headscale) redirect(w http.ResponseWriter, req *http.Request) {
 	target := h.cfg.ServerURL + req.URL.RequestURI()
 	http.Redirect(w, req, target, http.StatusFound)
 }
 
-// deleteExpireEphemeralNodes deletes ephemeral node records that have not been
-// seen for longer than h.cfg.EphemeralNodeInactivityTimeout.
-func (h *Headscale) deleteExpireEphemeralNodes(ctx context.Context, every time.Duration) {
-	ticker := time.NewTicker(every)
+// deleteNode deletes the node, fails over its routes and tells the
+// peers.
+func (h *Headscale) deleteNode(ctx context.Context, node *types.Node) error {
+	changedNodes, err := h.db.DeleteNode(
+		node,
+		h.nodeNotifier.LikelyConnectedMap(),
+	)
+	if err != nil {
+		return err
+	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			ticker.Stop()
-			return
-		case <-ticker.C:
-			var removed []types.NodeID
-			var changed []types.NodeID
-			if err := h.db.Write(func(tx *gorm.DB) error {
-				removed, changed = db.DeleteExpiredEphemeralNodes(tx, h.cfg.EphemeralNodeInactivityTimeout)
+	h.sendNodeEvent(webhook.EventNodeDeleted, node)
 
-				return nil
-			}); err != nil {
-				log.Error().Err(err).Msg("database error while expiring ephemeral nodes")
-				continue
-			}
+	ctx = types.NotifyCtx(ctx, "deletenode", node.Hostname)
+	h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+		Type:    types.StatePeerRemoved,
+		Removed: []types.NodeID{node.ID},
+	})
 
-			if removed != nil {
-				ctx := types.NotifyCtx(context.Background(), "expire-ephemeral", "na")
-				h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
-					Type:    types.StatePeerRemoved,
-					Removed: removed,
-				})
-			}
+	if changedNodes != nil {
+		h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+			Type:        types.StatePeerChanged,
+			ChangeNodes: changedNodes,
+		})
+	}
 
-			if changed != nil {
-				ctx := types.NotifyCtx(context.Background(), "expire-ephemeral", "na")
-				h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
-					Type:        types.StatePeerChanged,
-					ChangeNodes: changed,
-				})
-			}
+	return nil
+}
+
+// deleteEphemeralNode deletes an ephemeral node that has been disconnected
+// for longer than h.cfg.EphemeralNodeInactivityTimeout, fails over its
+// routes and tells the peers.
+func (h *Headscale) deleteEphemeralNode(nodeID types.NodeID) {
+	// The node might have reconnected just as the timeout passed.
+	if h.nodeNotifier.IsConnected(nodeID) {
+		return
+	}
+
+	node, err := h.db.GetNodeByID(nodeID)
+	if err != nil {
+		// The node has already been deleted, e.g. by logging out.
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Error().Err(err).Uint64("node.id", nodeID.Uint64()).Msg("database error while deleting ephemeral node")
+		}
+
+		return
+	}
+
+	if !node.IsEphemeral() {
+		return
+	}
+
+	changed, err := h.db.DeleteNode(node, h.nodeNotifier.LikelyConnectedMap())
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("node", node.Hostname).
+			Msg("Cannot delete ephemeral node from the database")
+
+		return
+	}
+
+	log.Info().
+		Str("node", node.Hostname).
+		Msg("Ephemeral client removed from database")
+	h.sendNodeEvent(webhook.EventNodeDeleted, node)
+
+	ctx := types.NotifyCtx(context.Background(), "expire-ephemeral", node.Hostname)
+	h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+		Type:    types.StatePeerRemoved,
+		Removed: []types.NodeID{node.ID},
+	})
+
+	if changed != nil {
+		h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+			Type:        types.StatePeerChanged,
+			ChangeNodes: changed,
+		})
+		h.sendNodeEventsByID(webhook.EventRoutesChanged, changed...)
+	}
+}
+
+// scheduleEphemeralNodes schedules the deletion of all the ephemeral
+// nodes, none of them are connected when headscale starts.
+func (h *Headscale) scheduleEphemeralNodes() error {
+	nodes, err := h.db.ListNodes()
+	if err != nil {
+		return err
+	}
+
+	for _, node := range nodes {
+		if node.IsEphemeral() {
+			h.ephemeralGC.Schedule(node.ID, h.cfg.EphemeralNodeInactivityTimeout)
 		}
 	}
+
+	return nil
 }
 
 // expireExpiredNodes expires nodes that have an explicit expiry set
@@ -266,12 +455,19 @@ func (h *Headscale) expireExpiredNodes(ctx context.Context, every time.Duration)
 	var update types.StateUpdate
 	var changed bool
 
+	warned := make(map[types.NodeID]time.Time)
+
 	for {
 		select {
 		case <-ctx.Done():
 			ticker.Stop()
 			return
 		case <-ticker.C:
+			// With HA, only the leader expires the nodes.
+			if !h.isLeader() {
+				continue
+			}
+
 			if err := h.db.Write(func(tx *gorm.DB) error {
 				lastCheck, update, changed = db.ExpireExpiredNodes(tx, lastCheck)
 
@@ -286,7 +482,109 @@ func (h *Headscale) expireExpiredNodes(ctx context.Context, every time.Duration)
 
 				ctx := types.NotifyCtx(context.Background(), "expire-expired", "na")
 				h.nodeNotifier.NotifyAll(ctx, update)
+
+				for _, patch := range update.ChangePatches {
+					h.sendNodeEventsByID(webhook.EventNodeExpired, types.NodeID(patch.NodeID))
+				}
+			}
+
+			h.warnExpiringNodes(warned)
+		}
+	}
+}
+
+// warnExpiringNodes sends a self update to the nodes whose key entered
+// the node_expiry.warning period, for their map response to carry the
+// expiry warning. warned holds the expiry each node was warned about.
+func (h *Headscale) warnExpiringNodes(warned map[types.NodeID]time.Time) {
+	if h.cfg.NodeExpiry.Warning <= 0 {
+		return
+	}
+
+	nodes, err := h.db.ListNodes()
+	if err != nil {
+		log.Error().Err(err).Msg("database error while warning about expiring nodes")
+
+		return
+	}
+
+	now := time.Now()
+	for _, node := range nodes {
+		if node.Expiry == nil || node.Expiry.IsZero() {
+			continue
+		}
+
+		until := node.Expiry.Sub(now)
+		if until <= 0 || until > h.cfg.NodeExpiry.Warning {
+			continue
+		}
+
+		if expiry, ok := warned[node.ID]; ok && expiry.Equal(*node.Expiry) {
+			continue
+		}
+		warned[node.ID] = *node.Expiry
+
+		log.Info().
+			Str("node", node.Hostname).
+			Time("expiry", *node.Expiry).
+			Msg("node key expires soon, warning the node")
+
+		ctx := types.NotifyCtx(context.Background(), "expiry-warning", node.Hostname)
+		h.nodeNotifier.NotifyByNodeID(
+			ctx,
+			types.StateUpdate{
+				Type:        types.StateSelfUpdate,
+				ChangeNodes: []types.NodeID{node.ID},
+			},
+			node.ID)
+	}
+}
+
+// refreshACLHostsSoon asks the refresher to load the external IP sets
+// of the policies, after they were loaded.
+func (h *Headscale) refreshACLHostsSoon() {
+	select {
+	case h.aclHostsRefresh <- struct{}{}:
+	default:
+	}
+}
+
+// refreshACLHosts reloads the external IP sets referenced in the hosts
+// section of the ACL policy when a policy is loaded and every interval,
+// if it is not 0, and sends a full update to all nodes if any of them
+// changed.
+func (h *Headscale) refreshACLHosts(ctx context.Context, every time.Duration) {
+	var tick <-chan time.Time
+	if every > 0 {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+		case <-h.aclHostsRefresh:
+		}
+
+		changed := false
+		for tailnet, pol := range h.policies() {
+			polChanged, err := pol.RefreshHostSources(ctx, h.cfg.ACL.HostsDir)
+			if err != nil {
+				log.Error().Err(err).Str("tailnet", tailnet).Msg("failed to refresh ACL hosts, keeping previous IP sets")
 			}
+			changed = changed || polChanged
+		}
+
+		if changed {
+			log.Info().Msg("ACL hosts changed, notifying nodes of change")
+
+			ctx := types.NotifyCtx(context.Background(), "acl-hosts-refresh", "na")
+			h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+				Type: types.StateFullUpdate,
+			})
 		}
 	}
 }
@@ -306,26 +604,178 @@ func (h *Headscale) scheduledDERPMapUpdateWorker(cancelChan <-chan struct{}) {
 
 		case <-ticker.C:
 			log.Info().Msg("Fetching DERPMap updates")
-			h.DERPMap = derp.GetDERPMap(h.cfg.DERP)
-			if h.cfg.DERP.ServerEnabled && h.cfg.DERP.AutomaticallyAddEmbeddedDerpRegion {
-				region, _ := h.DERPServer.GenerateRegion()
-				h.DERPMap.Regions[region.RegionID] = &region
-			}
-
-			ctx := types.NotifyCtx(context.Background(), "derpmap-update", "na")
-			h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
-				Type:    types.StateDERPUpdated,
-				DERPMap: h.DERPMap,
-			})
+			h.updateDERPMap(h.mapper.Config().DERP)
 		}
 	}
 }
 
+// updateDERPMap loads the DERP map from the paths and URLs of the
+// configuration, with the region of the embedded DERP server, and gives
+// it to the DERP manager.
+func (h *Headscale) updateDERPMap(cfg types.DERPConfig) {
+	derpMap := derp.GetDERPMap(cfg)
+	if cfg.ServerEnabled && cfg.AutomaticallyAddEmbeddedDerpRegion {
+		region, _ := h.DERPServer.GenerateRegion()
+		derpMap.Regions[region.RegionID] = &region
+	}
+
+	h.derpManager.SetBase(derpMap)
+}
+
+// derpMapChanged sends the new DERPMap to all the nodes, it is called
+// by the DERP manager when regions are added, removed or change health.
+func (h *Headscale) derpMapChanged(derpMap *tailcfg.DERPMap) {
+	h.DERPMap = derpMap
+
+	ctx := types.NotifyCtx(context.Background(), "derpmap-update", "na")
+	h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+		Type:    types.StateDERPUpdated,
+		DERPMap: derpMap,
+	})
+}
+
+// loadDNSRecords gives the extra DNS records stored in the database to
+// the mapper, to be sent to the nodes.
+func (h *Headscale) loadDNSRecords() error {
+	records, err := h.db.ListDNSRecords()
+	if err != nil {
+		return fmt.Errorf("loading DNS records: %w", err)
+	}
+
+	extraRecords := make([]tailcfg.DNSRecord, len(records))
+	for index := range records {
+		extraRecords[index] = records[index].Tailcfg()
+	}
+	h.mapper.SetExtraRecords(extraRecords)
+
+	return nil
+}
+
+// loadScopedNameservers gives the scoped nameservers of the
+// configuration and the ones stored in the database to the mapper, to
+// be sent to the nodes they apply to.
+func (h *Headscale) loadScopedNameservers() error {
+	stored, err := h.db.ListScopedNameservers()
+	if err != nil {
+		return fmt.Errorf("loading scoped nameservers: %w", err)
+	}
+
+	h.mapper.SetScopedNameservers(append(slices.Clone(h.mapper.Config().DNSScopedNameservers), stored...))
+
+	return nil
+}
+
+// dnsConfigChanged sends the extra DNS records and the scoped
+// nameservers to all the nodes, it is called when they are added or
+// deleted through the API.
+func (h *Headscale) dnsConfigChanged() error {
+	if err := h.loadDNSRecords(); err != nil {
+		return err
+	}
+	if err := h.loadScopedNameservers(); err != nil {
+		return err
+	}
+
+	ctx := types.NotifyCtx(context.Background(), "dns-config-update", "na")
+	h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+		Type: types.StateFullUpdate,
+	})
+
+	return nil
+}
+
+// verifyDERPClient only lets the nodes registered to headscale, and not
+// expired, connect to the embedded DERP server.
+func (h *Headscale) verifyDERPClient(_ context.Context, nodeKey key.NodePublic) (bool, error) {
+	node, err := h.db.GetNodeByNodeKey(nodeKey)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return !node.IsExpired(), nil
+}
+
 func (h *Headscale) grpcAuthenticationInterceptor(ctx context.Context,
 	req interface{},
 	info *grpc.UnaryServerInfo,
 	handler grpc.UnaryHandler,
 ) (interface{}, error) {
+	key, err := h.grpcAuthenticate(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	if err := authorizeAPIKey(key, info.FullMethod); err != nil {
+		return ctx, err
+	}
+
+	return handler(ctx, req)
+}
+
+func (h *Headscale) grpcStreamAuthenticationInterceptor(srv interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	key, err := h.grpcAuthenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	if err := authorizeAPIKey(key, info.FullMethod); err != nil {
+		return err
+	}
+
+	return handler(srv, stream)
+}
+
+// grpcSocketAuthorizationInterceptor enforces the scopes of the API key
+// on the calls the REST gateway forwards to the local gRPC socket. Calls
+// without an API key come from the on-server CLI and are allowed.
+func (h *Headscale) grpcSocketAuthorizationInterceptor(ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	if err := h.grpcSocketAuthorize(ctx, info.FullMethod); err != nil {
+		return ctx, err
+	}
+
+	return handler(ctx, req)
+}
+
+func (h *Headscale) grpcSocketStreamAuthorizationInterceptor(srv interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	if err := h.grpcSocketAuthorize(stream.Context(), info.FullMethod); err != nil {
+		return err
+	}
+
+	return handler(srv, stream)
+}
+
+func (h *Headscale) grpcSocketAuthorize(ctx context.Context, fullMethod string) error {
+	meta, _ := metadata.FromIncomingContext(ctx)
+	if len(meta["authorization"]) == 0 {
+		return nil
+	}
+
+	key, err := h.grpcAuthenticate(ctx)
+	if err != nil {
+		return err
+	}
+
+	return authorizeAPIKey(key, fullMethod)
+}
+
+// grpcAuthenticate checks the API key of a call to the gRPC API and
+// returns it.
+func (h *Headscale) grpcAuthenticate(ctx context.Context) (*types.APIKey, error) {
 	// Check if the request is coming from the on-server client.
 	// This is not secure, but it is to maintain maintainability
 	// with the "legacy" database-based client
@@ -340,7 +790,7 @@ func (h *Headscale) grpcAuthenticationInterceptor(ctx context.Context,
 
 	meta, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
-		return ctx, status.Errorf(
+		return nil, status.Errorf(
 			codes.InvalidArgument,
 			"Retrieving metadata is failed",
 		)
@@ -348,7 +798,7 @@ func (h *Headscale) grpcAuthenticationInterceptor(ctx context.Context,
 
 	authHeader, ok := meta["authorization"]
 	if !ok {
-		return ctx, status.Errorf(
+		return nil, status.Errorf(
 			codes.Unauthenticated,
 			"Authorization token is not supplied",
 		)
@@ -357,26 +807,26 @@ func (h *Headscale) grpcAuthenticationInterceptor(ctx context.Context,
 	token := authHeader[0]
 
 	if !strings.HasPrefix(token, AuthPrefix) {
-		return ctx, status.Error(
+		return nil, status.Error(
 			codes.Unauthenticated,
 			`missing "Bearer " prefix in "Authorization" header`,
 		)
 	}
 
-	valid, err := h.db.ValidateAPIKey(strings.TrimPrefix(token, AuthPrefix))
+	key, err := h.db.AuthenticateAPIKey(strings.TrimPrefix(token, AuthPrefix))
 	if err != nil {
-		return ctx, status.Error(codes.Internal, "failed to validate token")
+		return nil, status.Error(codes.Internal, "failed to validate token")
 	}
 
-	if !valid {
+	if key == nil {
 		log.Info().
 			Str("client_address", client.Addr.String()).
 			Msg("invalid token")
 
-		return ctx, status.Error(codes.Unauthenticated, "invalid token")
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
 	}
 
-	return handler(ctx, req)
+	return key, nil
 }
 
 func (h *Headscale) httpAuthenticationMiddleware(next http.Handler) http.Handler {
@@ -472,6 +922,7 @@ func (h *Headscale) createRouter(grpcMux *grpcRuntime.ServeMux) *mux.Router {
 
 	router.HandleFunc("/oidc/register/{mkey}", h.RegisterOIDC).Methods(http.MethodGet)
 	router.HandleFunc("/oidc/callback", h.OIDCCallback).Methods(http.MethodGet)
+	router.HandleFunc("/ssh/check/{id}", h.SSHCheckHandler).Methods(http.MethodGet)
 	router.HandleFunc("/apple", h.AppleConfigMessage).Methods(http.MethodGet)
 	router.HandleFunc("/apple/{platform}", h.ApplePlatformConfig).
 		Methods(http.MethodGet)
@@ -483,6 +934,10 @@ func (h *Headscale) createRouter(grpcMux *grpcRuntime.ServeMux) *mux.Router {
 	router.HandleFunc("/swagger", headscale.SwaggerUI).Methods(http.MethodGet)
 	router.HandleFunc("/swagger/v1/openapiv2.json", headscale.SwaggerAPIv1).
 		Methods(http.MethodGet)
+	// The definition of the REST API is public, like the one above, the
+	// API it describes requires an API key.
+	router.HandleFunc("/api/v1/openapi.json", headscale.SwaggerAPIv1).
+		Methods(http.MethodGet)
 
 	if h.cfg.DERP.ServerEnabled {
 		router.HandleFunc("/derp", h.DERPServer.DERPHandler)
@@ -494,6 +949,10 @@ func (h *Headscale) createRouter(grpcMux *grpcRuntime.ServeMux) *mux.Router {
 	apiRouter.Use(h.httpAuthenticationMiddleware)
 	apiRouter.PathPrefix("/v1/").HandlerFunc(grpcMux.ServeHTTP)
 
+	if h.cfg.SCIM.Enabled {
+		h.registerSCIMRoutes(router)
+	}
+
 	router.PathPrefix("/").HandlerFunc(notFoundHandler)
 
 	return router
@@ -516,13 +975,36 @@ func (h *Headscale) Serve() error {
 
 	var err error
 
+	util.SetLogLevels(
+		h.cfg.Log.Level,
+		h.cfg.Log.Subsystems,
+		h.cfg.Log.SamplingBurst,
+		h.cfg.Log.SamplingPeriod,
+	)
+
 	if dumpConfig {
 		spew.Dump(h.cfg)
 	}
 
+	shutdownTracing := func(context.Context) error { return nil }
+	if h.cfg.Tracing.Enabled {
+		shutdownTracing, err = setupTracing(
+			context.Background(),
+			h.cfg.Tracing,
+			h.cfg.HA.InstanceID,
+		)
+		if err != nil {
+			return fmt.Errorf("setting up tracing: %w", err)
+		}
+
+		log.Info().
+			Str("endpoint", h.cfg.Tracing.Endpoint).
+			Float64("sample_ratio", h.cfg.Tracing.SampleRatio).
+			Msg("Exporting traces")
+	}
+
 	// Fetch an initial DERP Map before we start serving
-	h.DERPMap = derp.GetDERPMap(h.cfg.DERP)
-	h.mapper = mapper.NewMapper(h.db, h.cfg, h.DERPMap, h.nodeNotifier)
+	derpMap := derp.GetDERPMap(h.cfg.DERP)
 
 	if h.cfg.DERP.ServerEnabled {
 		// When embedded DERP is enabled we always need a STUN server
@@ -536,10 +1018,37 @@ func (h *Headscale) Serve() error {
 		}
 
 		if h.cfg.DERP.AutomaticallyAddEmbeddedDerpRegion {
-			h.DERPMap.Regions[region.RegionID] = &region
+			derpMap.Regions[region.RegionID] = &region
 		}
 
 		go h.DERPServer.ServeSTUN()
+
+		derpMeshCtx, derpMeshCancel := context.WithCancel(context.Background())
+		defer derpMeshCancel()
+		if err := h.DERPServer.StartMesh(derpMeshCtx); err != nil {
+			return fmt.Errorf("setting up DERP mesh: %w", err)
+		}
+	}
+
+	h.derpManager = derp.NewManager(h.cfg.DERP, derpMap, h.derpMapChanged)
+
+	customRegions, err := h.db.GetCustomDERPRegions()
+	if err != nil {
+		return fmt.Errorf("loading custom DERP regions: %w", err)
+	}
+	h.derpManager.SetCustomRegions(customRegions)
+
+	h.DERPMap = h.derpManager.DERPMap()
+	h.mapper = mapper.NewMapper(h.db, h.cfg, h.DERPMap, h.nodeNotifier)
+
+	if err := h.loadDNSRecords(); err != nil {
+		return err
+	}
+	if err := h.loadScopedNameservers(); err != nil {
+		return err
+	}
+	if err := h.loadTKAInfo(); err != nil {
+		return err
 	}
 
 	if h.cfg.DERP.AutoUpdate {
@@ -548,18 +1057,61 @@ func (h *Headscale) Serve() error {
 		go h.scheduledDERPMapUpdateWorker(derpMapCancelChannel)
 	}
 
+	if h.cfg.DERP.ProbeInterval > 0 {
+		derpProbeCtx, derpProbeCancel := context.WithCancel(context.Background())
+		defer derpProbeCancel()
+		go h.derpManager.ProbeWorker(derpProbeCtx)
+	}
+
 	if len(h.DERPMap.Regions) == 0 {
 		return errEmptyInitialDERPMap
 	}
 
-	expireEphemeralCtx, expireEphemeralCancel := context.WithCancel(context.Background())
-	defer expireEphemeralCancel()
-	go h.deleteExpireEphemeralNodes(expireEphemeralCtx, updateInterval)
+	if err := h.scheduleEphemeralNodes(); err != nil {
+		return fmt.Errorf("scheduling ephemeral nodes for deletion: %w", err)
+	}
+	go h.ephemeralGC.Start()
+	defer h.ephemeralGC.Close()
+
+	go h.nodeStatus.Start()
+	defer h.nodeStatus.Close()
 
 	expireNodeCtx, expireNodeCancel := context.WithCancel(context.Background())
 	defer expireNodeCancel()
 	go h.expireExpiredNodes(expireNodeCtx, updateInterval)
 
+	routeManagerCtx, routeManagerCancel := context.WithCancel(context.Background())
+	defer routeManagerCancel()
+	go h.routeManager.Run(routeManagerCtx)
+
+	haCtx, haCancel := context.WithCancel(context.Background())
+	defer haCancel()
+	if h.ha != nil {
+		go h.ha.Run(haCtx)
+	}
+
+	refreshACLHostsCtx, refreshACLHostsCancel := context.WithCancel(context.Background())
+	defer refreshACLHostsCancel()
+	go h.refreshACLHosts(refreshACLHostsCtx, h.cfg.ACL.HostsRefreshInterval)
+
+	watchConfigCtx, watchConfigCancel := context.WithCancel(context.Background())
+	defer watchConfigCancel()
+	if h.cfg.WatchConfig {
+		go h.watchConfig(watchConfigCtx)
+	}
+
+	revalidateOIDCCtx, revalidateOIDCCancel := context.WithCancel(context.Background())
+	defer revalidateOIDCCancel()
+	if h.oauth2Config.Load() != nil && h.cfg.OIDC.RevalidateInterval > 0 {
+		go h.revalidateOIDCSessions(revalidateOIDCCtx, h.cfg.OIDC.RevalidateInterval)
+	}
+
+	clientMetricsCtx, clientMetricsCancel := context.WithCancel(context.Background())
+	defer clientMetricsCancel()
+	if h.cfg.ClientMetrics.Interval > 0 {
+		go h.collectClientMetrics(clientMetricsCtx, h.cfg.ClientMetrics.Interval)
+	}
+
 	if zl.GlobalLevel() == zl.TraceLevel {
 		zerolog.RespLog = true
 	} else {
@@ -620,10 +1172,13 @@ func (h *Headscale) Serve() error {
 		return fmt.Errorf("registering Headscale API service to gRPC: %w", err)
 	}
 
-	// Start the local gRPC server without TLS and without authentication
+	// Start the local gRPC server without TLS, only the API keys forwarded
+	// by the REST gateway are checked, to enforce their scopes
 	grpcSocket := grpc.NewServer(
-	// Uncomment to debug grpc communication.
-	// zerolog.UnaryInterceptor(),
+		// Uncomment to debug grpc communication.
+		// zerolog.UnaryInterceptor(),
+		grpc.UnaryInterceptor(h.grpcSocketAuthorizationInterceptor),
+		grpc.StreamInterceptor(h.grpcSocketStreamAuthorizationInterceptor),
 	)
 
 	v1.RegisterHeadscaleServiceServer(grpcSocket, newHeadscaleV1APIServer(h))
@@ -636,11 +1191,20 @@ func (h *Headscale) Serve() error {
 	// Set up REMOTE listeners
 	//
 
-	tlsConfig, err := h.getTLSSettings()
+	challenges := make(acmeHTTPChallenges)
+
+	tlsConfig, err := h.getTLSSettings(challenges)
 	if err != nil {
 		return fmt.Errorf("configuring TLS settings: %w", err)
 	}
 
+	grpcTLSConfig, err := h.getGRPCTLSSettings(tlsConfig, challenges)
+	if err != nil {
+		return fmt.Errorf("configuring gRPC TLS settings: %w", err)
+	}
+
+	h.serveACMEHTTPChallenges(challenges)
+
 	//
 	//
 	// gRPC setup
@@ -655,7 +1219,7 @@ func (h *Headscale) Serve() error {
 
 	var grpcServer *grpc.Server
 	var grpcListener net.Listener
-	if tlsConfig != nil || h.cfg.GRPCAllowInsecure {
+	if grpcTLSConfig != nil || h.cfg.GRPCAllowInsecure {
 		log.Info().Msgf("Enabling remote gRPC at %s", h.cfg.GRPCAddr)
 
 		grpcOptions := []grpc.ServerOption{
@@ -666,11 +1230,16 @@ func (h *Headscale) Serve() error {
 					// zerolog.NewUnaryServerInterceptor(),
 				),
 			),
+			grpc.StreamInterceptor(
+				grpcMiddleware.ChainStreamServer(
+					h.grpcStreamAuthenticationInterceptor,
+				),
+			),
 		}
 
-		if tlsConfig != nil {
+		if grpcTLSConfig != nil {
 			grpcOptions = append(grpcOptions,
-				grpc.Creds(credentials.NewTLS(tlsConfig)),
+				grpc.Creds(credentials.NewTLS(grpcTLSConfig)),
 			)
 		} else {
 			log.Warn().Msg("gRPC is running without security")
@@ -726,13 +1295,17 @@ func (h *Headscale) Serve() error {
 	log.Info().
 		Msgf("listening and serving HTTP on: %s", h.cfg.Addr)
 
-	debugMux := http.NewServeMux()
-	debugMux.Handle("/debug/pprof/", http.DefaultServeMux)
-	debugMux.HandleFunc("/debug/notifier", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(h.nodeNotifier.String()))
-	})
-	debugMux.Handle("/metrics", promhttp.Handler())
+	debugMux := h.debugMux()
+	metricsHandler := promhttp.Handler()
+	debugMux.Handle("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Refresh the node count so it does not go stale between
+		// registrations.
+		if _, err := h.nodeCapacity(); err != nil {
+			log.Error().Err(err).Msg("failed to update node capacity metrics")
+		}
+
+		metricsHandler.ServeHTTP(w, r)
+	}))
 
 	debugHTTPServer := &http.Server{
 		Addr:         h.cfg.MetricsAddr,
@@ -751,6 +1324,25 @@ func (h *Headscale) Serve() error {
 	log.Info().
 		Msgf("listening and serving debug and metrics on: %s", h.cfg.MetricsAddr)
 
+	var localDebugServer *http.Server
+	if h.cfg.DebugAddr != "" {
+		localDebugListener, err := h.listenDebug()
+		if err != nil {
+			return fmt.Errorf("listening on debug_listen_addr: %w", err)
+		}
+
+		localDebugServer = &http.Server{
+			Handler:      h.debugMux(),
+			ReadTimeout:  types.HTTPTimeout,
+			WriteTimeout: 0,
+		}
+
+		errorGroup.Go(func() error { return localDebugServer.Serve(localDebugListener) })
+
+		log.Info().
+			Msgf("listening and serving local debug on: %s", h.cfg.DebugAddr)
+	}
+
 	var tailsqlContext context.Context
 	if tailsqlEnabled {
 		if h.cfg.Database.Type != types.DatabaseSqlite {
@@ -783,25 +1375,7 @@ func (h *Headscale) Serve() error {
 					Str("signal", sig.String()).
 					Msg("Received SIGHUP, reloading ACL and Config")
 
-				// TODO(kradalby): Reload config on SIGHUP
-
-				if h.cfg.ACL.PolicyPath != "" {
-					aclPath := util.AbsolutePathFromConfigPath(h.cfg.ACL.PolicyPath)
-					pol, err := policy.LoadACLPolicyFromPath(aclPath)
-					if err != nil {
-						log.Error().Err(err).Msg("Failed to reload ACL policy")
-					}
-
-					h.ACLPolicy = pol
-					log.Info().
-						Str("path", aclPath).
-						Msg("ACL policy successfully reloaded, notifying nodes of change")
-
-					ctx := types.NotifyCtx(context.Background(), "acl-sighup", "na")
-					h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
-						Type: types.StateFullUpdate,
-					})
-				}
+				h.reloadConfig()
 
 			default:
 				trace := log.Trace().Msgf
@@ -810,11 +1384,41 @@ func (h *Headscale) Serve() error {
 					Msg("Received signal to stop, shutting down gracefully")
 
 				expireNodeCancel()
-				expireEphemeralCancel()
+				h.ephemeralGC.Close()
+				refreshACLHostsCancel()
+				revalidateOIDCCancel()
+
+				trace("draining node notifier")
+				drainCtx, drainCancel := context.WithTimeout(
+					context.Background(),
+					h.cfg.Tuning.DrainTimeout,
+				)
+				if err := h.nodeNotifier.Drain(drainCtx); err != nil {
+					log.Warn().Err(err).Msg("Nodes did not disconnect before the drain timeout")
+				}
+				drainCancel()
+
+				trace("closing the change bus")
+				if err := h.nodeNotifier.Bus().Close(); err != nil {
+					log.Error().Err(err).Msg("Failed to close the change bus")
+				}
+
+				trace("saving the change log")
+				if err := h.nodeNotifier.SaveChanges(); err != nil {
+					log.Error().Err(err).Msg("Failed to save the change log")
+				}
 
 				trace("waiting for netmap stream to close")
 				h.pollNetMapStreamWG.Wait()
 
+				trace("writing pending node status updates")
+				if err := h.nodeStatus.Close(); err != nil {
+					log.Error().Err(err).Msg("Failed to write pending node status updates")
+				}
+
+				trace("closing webhooks")
+				h.webhooks.Close()
+
 				// Gracefully shut down servers
 				ctx, cancel := context.WithTimeout(
 					context.Background(),
@@ -824,11 +1428,22 @@ func (h *Headscale) Serve() error {
 				if err := debugHTTPServer.Shutdown(ctx); err != nil {
 					log.Error().Err(err).Msg("Failed to shutdown prometheus http")
 				}
+				if localDebugServer != nil {
+					trace("shutting down local debug http server")
+					if err := localDebugServer.Shutdown(ctx); err != nil {
+						log.Error().Err(err).Msg("Failed to shutdown local debug http")
+					}
+				}
 				trace("shutting down main http server")
 				if err := httpServer.Shutdown(ctx); err != nil {
 					log.Error().Err(err).Msg("Failed to shutdown http")
 				}
 
+				trace("sending pending traces")
+				if err := shutdownTracing(ctx); err != nil {
+					log.Error().Err(err).Msg("Failed to send pending traces")
+				}
+
 				trace("shutting down grpc server (socket)")
 				grpcSocket.GracefulStop()
 
@@ -843,9 +1458,6 @@ func (h *Headscale) Serve() error {
 					tailsqlContext.Done()
 				}
 
-				trace("closing node notifier")
-				h.nodeNotifier.Close()
-
 				// Close network listeners
 				trace("closing network listeners")
 				debugHTTPListener.Close()
@@ -882,78 +1494,6 @@ func (h *Headscale) Serve() error {
 	return errorGroup.Wait()
 }
 
-func (h *Headscale) getTLSSettings() (*tls.Config, error) {
-	var err error
-	if h.cfg.TLS.LetsEncrypt.Hostname != "" {
-		if !strings.HasPrefix(h.cfg.ServerURL, "https://") {
-			log.Warn().
-				Msg("Listening with TLS but ServerURL does not start with https://")
-		}
-
-		certManager := autocert.Manager{
-			Prompt:     autocert.AcceptTOS,
-			HostPolicy: autocert.HostWhitelist(h.cfg.TLS.LetsEncrypt.Hostname),
-			Cache:      autocert.DirCache(h.cfg.TLS.LetsEncrypt.CacheDir),
-			Client: &acme.Client{
-				DirectoryURL: h.cfg.ACMEURL,
-			},
-			Email: h.cfg.ACMEEmail,
-		}
-
-		switch h.cfg.TLS.LetsEncrypt.ChallengeType {
-		case types.TLSALPN01ChallengeType:
-			// Configuration via autocert with TLS-ALPN-01 (https://tools.ietf.org/html/rfc8737)
-			// The RFC requires that the validation is done on port 443; in other words, headscale
-			// must be reachable on port 443.
-			return certManager.TLSConfig(), nil
-
-		case types.HTTP01ChallengeType:
-			// Configuration via autocert with HTTP-01. This requires listening on
-			// port 80 for the certificate validation in addition to the headscale
-			// service, which can be configured to run on any other port.
-
-			server := &http.Server{
-				Addr:        h.cfg.TLS.LetsEncrypt.Listen,
-				Handler:     certManager.HTTPHandler(http.HandlerFunc(h.redirect)),
-				ReadTimeout: types.HTTPTimeout,
-			}
-
-			go func() {
-				err := server.ListenAndServe()
-				log.Fatal().
-					Caller().
-					Err(err).
-					Msg("failed to set up a HTTP server")
-			}()
-
-			return certManager.TLSConfig(), nil
-
-		default:
-			return nil, errUnsupportedLetsEncryptChallengeType
-		}
-	} else if h.cfg.TLS.CertPath == "" {
-		if !strings.HasPrefix(h.cfg.ServerURL, "http://") {
-			log.Warn().Msg("Listening without TLS but ServerURL does not start with http://")
-		}
-
-		return nil, err
-	} else {
-		if !strings.HasPrefix(h.cfg.ServerURL, "https://") {
-			log.Warn().Msg("Listening with TLS but ServerURL does not start with https://")
-		}
-
-		tlsConfig := &tls.Config{
-			NextProtos:   []string{"http/1.1"},
-			Certificates: make([]tls.Certificate, 1),
-			MinVersion:   tls.VersionTLS12,
-		}
-
-		tlsConfig.Certificates[0], err = tls.LoadX509KeyPair(h.cfg.TLS.CertPath, h.cfg.TLS.KeyPath)
-
-		return tlsConfig, err
-	}
-}
-
 func notFoundHandler(
 	writer http.ResponseWriter,
 	req *http.Request,
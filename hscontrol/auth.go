@@ -6,12 +6,15 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/netip"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/juanfont/headscale/hscontrol/db"
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/juanfont/headscale/hscontrol/webhook"
 	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
 	"tailscale.com/tailcfg"
@@ -58,6 +61,22 @@ func logAuthFunc(
 		}
 }
 
+// nodeExpiry returns the key expiry of a node registering, the one
+// requested by the client, or else node_expiry.default.
+func (h *Headscale) nodeExpiry(requested time.Time) *time.Time {
+	if !requested.IsZero() {
+		return &requested
+	}
+
+	if h.cfg.NodeExpiry.Default > 0 {
+		expiry := time.Now().Add(h.cfg.NodeExpiry.Default)
+
+		return &expiry
+	}
+
+	return &time.Time{}
+}
+
 // handleRegister is the logic for registering a client.
 func (h *Headscale) handleRegister(
 	writer http.ResponseWriter,
@@ -78,6 +97,12 @@ func (h *Headscale) handleRegister(
 			return
 		}
 
+		if reason, rejected := h.registrationRejection(machineKey); rejected {
+			h.handleRejectedNode(writer, regReq, machineKey, reason)
+
+			return
+		}
+
 		// Check if the node is waiting for interactive login.
 		//
 		// TODO(juan): We could use this field to improve our protocol implementation,
@@ -123,13 +148,9 @@ func (h *Headscale) handleRegister(
 			Hostname:   regReq.Hostinfo.Hostname,
 			GivenName:  givenName,
 			NodeKey:    regReq.NodeKey,
+			Hostinfo:   regReq.Hostinfo,
 			LastSeen:   &now,
-			Expiry:     &time.Time{},
-		}
-
-		if !regReq.Expiry.IsZero() {
-			logTrace("Non-zero expiry time requested")
-			newNode.Expiry = &regReq.Expiry
+			Expiry:     h.nodeExpiry(regReq.Expiry),
 		}
 
 		h.registrationCache.Set(
@@ -222,17 +243,23 @@ func (h *Headscale) handleRegister(
 			}
 		}
 
+		if reason, rejected := h.registrationRejection(machineKey); rejected {
+			h.handleRejectedNode(writer, regReq, machineKey, reason)
+
+			return
+		}
+
 		// The node has expired or it is logged out
 		h.handleNodeExpiredOrLoggedOut(writer, regReq, *node, machineKey)
 
-		// TODO(juan): RegisterRequest includes an Expiry time, that we could optionally use
-		node.Expiry = &time.Time{}
+		node.Expiry = h.nodeExpiry(regReq.Expiry)
 
 		// If we are here it means the client needs to be reauthorized,
 		// we need to make sure the NodeKey matches the one in the request
 		// TODO(juan): What happens when using fast user switching between two
 		// headscale-managed tailnets?
 		node.NodeKey = regReq.NodeKey
+		node.Hostinfo = regReq.Hostinfo
 		h.registrationCache.Set(
 			machineKey.String(),
 			*node,
@@ -300,6 +327,15 @@ func (h *Headscale) handleAuthKey(
 		Str("node", registerRequest.Hostinfo.Hostname).
 		Msg("Authentication key was valid, proceeding to acquire IP addresses")
 
+	// The user of the key must own the tags of the key, and the tags
+	// the node advertises.
+	requestedTags := append(slices.Clone(registerRequest.Hostinfo.RequestTags), pak.Proto().GetAclTags()...)
+	if err := h.tailnetPolicy(pak.User.Tailnet).CheckRequestedTags(pak.User.Name, requestedTags); err != nil {
+		h.handleRejectedNode(writer, registerRequest, machineKey, err.Error())
+
+		return
+	}
+
 	nodeKey := registerRequest.NodeKey
 
 	// retrieve node information if it exist
@@ -319,7 +355,7 @@ func (h *Headscale) handleAuthKey(
 			node.AuthKeyID = &pakID
 		}
 
-		node.Expiry = &registerRequest.Expiry
+		node.Expiry = h.nodeExpiry(registerRequest.Expiry)
 		node.User = pak.User
 		node.UserID = pak.UserID
 		err := h.db.DB.Save(node).Error
@@ -374,32 +410,71 @@ func (h *Headscale) handleAuthKey(
 			User:           pak.User,
 			MachineKey:     machineKey,
 			RegisterMethod: util.RegisterMethodAuthKey,
-			Expiry:         &registerRequest.Expiry,
+			Expiry:         h.nodeExpiry(registerRequest.Expiry),
 			NodeKey:        nodeKey,
 			LastSeen:       &now,
 			ForcedTags:     pak.Proto().GetAclTags(),
 		}
 
-		ipv4, ipv6, err := h.ipAlloc.Next()
-		if err != nil {
-			log.Error().
-				Caller().
-				Str("func", "RegistrationHandler").
-				Str("hostinfo.name", registerRequest.Hostinfo.Hostname).
-				Err(err).
-				Msg("failed to allocate IP	")
+		if err := h.checkNodeLimit(h.db.DB, machineKey); err != nil {
+			if !errors.Is(err, ErrNodeLimitReached) {
+				log.Error().
+					Caller().
+					Err(err).
+					Msg("could not check node limit")
+				http.Error(writer, "Internal server error", http.StatusInternalServerError)
+
+				return
+			}
+
+			// The client shows the error to the user, which tells
+			// them why they cannot join instead of a generic failure.
+			h.handleRejectedNode(writer, registerRequest, machineKey, err.Error())
 
 			return
 		}
 
+		// A new node awaiting approval gets its addresses when it is
+		// approved.
+		var ipv4, ipv6 *netip.Addr
+		if h.cfg.NodeApproval {
+			nodeToRegister.AwaitingApproval = true
+		} else {
+			// The key, the user and the tags of the node can pin its
+			// addresses to pools.
+			candidate := nodeToRegister
+			candidate.AuthKey = pak
+			candidate.Hostinfo = registerRequest.Hostinfo
+
+			ipv4, ipv6, err = h.ipAlloc.NextForNode(h.policyOf(&candidate), &candidate)
+			if err != nil {
+				log.Error().
+					Caller().
+					Str("func", "RegistrationHandler").
+					Str("hostinfo.name", registerRequest.Hostinfo.Hostname).
+					Err(err).
+					Msg("failed to allocate IP	")
+
+				return
+			}
+		}
+
 		pakID := uint(pak.ID)
 		if pakID != 0 {
 			nodeToRegister.AuthKeyID = &pakID
 		}
-		node, err = h.db.RegisterNode(
-			nodeToRegister,
-			ipv4, ipv6,
-		)
+		node, err = db.Write(h.db.DB, func(tx *gorm.DB) (*types.Node, error) {
+			if err := h.checkNodeLimit(tx, machineKey); err != nil {
+				return nil, err
+			}
+
+			return db.RegisterNode(tx, nodeToRegister, ipv4, ipv6)
+		})
+		if errors.Is(err, ErrNodeLimitReached) {
+			h.handleRejectedNode(writer, registerRequest, machineKey, err.Error())
+
+			return
+		}
 		if err != nil {
 			log.Error().
 				Caller().
@@ -411,7 +486,10 @@ func (h *Headscale) handleAuthKey(
 		}
 	}
 
-	h.db.Write(func(tx *gorm.DB) error {
+	// A wrapped pre auth key signs the node key for network lock.
+	h.storeRegisterKeySignature(node, registerRequest)
+
+	err = h.db.Write(func(tx *gorm.DB) error {
 		return db.UsePreAuthKey(tx, pak)
 	})
 	if err != nil {
@@ -424,7 +502,13 @@ func (h *Headscale) handleAuthKey(
 		return
 	}
 
-	resp.MachineAuthorized = true
+	// A node awaiting approval is told it is not authorized yet, the
+	// client shows that it waits for an administrator to approve it.
+	if !node.AwaitingApproval {
+		h.sendNodeEvent(webhook.EventNodeRegistered, node)
+	}
+
+	resp.MachineAuthorized = !node.AwaitingApproval
 	resp.User = *pak.User.TailscaleUser()
 	// Provide LoginName when registering with pre-auth key
 	// Otherwise it will need to exec `tailscale up` twice to fetch the *LoginName*
@@ -457,6 +541,26 @@ func (h *Headscale) handleAuthKey(
 		Msg("Successfully authenticated via AuthKey")
 }
 
+// storeRegisterKeySignature stores the network lock signature of the
+// node key sent by the node when it registers, if it is valid.
+func (h *Headscale) storeRegisterKeySignature(
+	node *types.Node,
+	registerRequest tailcfg.RegisterRequest,
+) {
+	if len(registerRequest.NodeKeySignature) == 0 {
+		return
+	}
+
+	err := h.setNodeKeySignature(node.ID, registerRequest.NodeKey, registerRequest.NodeKeySignature)
+	if err != nil {
+		log.Warn().
+			Caller().
+			Str("node", node.Hostname).
+			Err(err).
+			Msg("ignoring node key signature")
+	}
+}
+
 // handleNewNode returns the authorisation URL to the client based on what type
 // of registration headscale is configured with.
 // This url is then showed to the user by the local Tailscale client.
@@ -472,7 +576,7 @@ func (h *Headscale) handleNewNode(
 	// The node registration is new, redirect the client to the registration URL
 	logTrace("The node seems to be new, sending auth url")
 
-	if h.oauth2Config != nil {
+	if h.oauth2Config.Load() != nil {
 		resp.AuthURL = fmt.Sprintf(
 			"%s/oidc/register/%s",
 			strings.TrimSuffix(h.cfg.ServerURL, "/"),
@@ -502,6 +606,38 @@ func (h *Headscale) handleNewNode(
 	logInfo(fmt.Sprintf("Successfully sent auth url: %s", resp.AuthURL))
 }
 
+// handleRejectedNode tells a node its registration was rejected, and
+// why. The client shows the reason to the user.
+func (h *Headscale) handleRejectedNode(
+	writer http.ResponseWriter,
+	registerRequest tailcfg.RegisterRequest,
+	machineKey key.MachinePublic,
+	reason string,
+) {
+	logInfo, _, logErr := logAuthFunc(registerRequest, machineKey)
+
+	resp := tailcfg.RegisterResponse{
+		Error: reason,
+	}
+
+	respBody, err := json.Marshal(resp)
+	if err != nil {
+		logErr(err, "Cannot encode message")
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.WriteHeader(http.StatusOK)
+	_, err = writer.Write(respBody)
+	if err != nil {
+		logErr(err, "Failed to write response")
+	}
+
+	logInfo("Registration was rejected, sent error: " + reason)
+}
+
 func (h *Headscale) handleNodeLogOut(
 	writer http.ResponseWriter,
 	node types.Node,
@@ -528,6 +664,9 @@ func (h *Headscale) handleNodeLogOut(
 	ctx := types.NotifyCtx(context.Background(), "logout-expiry", "na")
 	h.nodeNotifier.NotifyWithIgnore(ctx, types.StateUpdateExpire(node.ID, now), node.ID)
 
+	node.Expiry = &now
+	h.sendNodeEvent(webhook.EventNodeExpired, &node)
+
 	resp.AuthURL = ""
 	resp.MachineAuthorized = false
 	resp.NodeKeyExpired = true
@@ -556,12 +695,16 @@ func (h *Headscale) handleNodeLogOut(
 	}
 
 	if node.IsEphemeral() {
+		h.ephemeralGC.Cancel(node.ID)
+
 		changedNodes, err := h.db.DeleteNode(&node, h.nodeNotifier.LikelyConnectedMap())
 		if err != nil {
 			log.Error().
 				Err(err).
 				Str("node", node.Hostname).
 				Msg("Cannot delete ephemeral node from the database")
+		} else {
+			h.sendNodeEvent(webhook.EventNodeDeleted, &node)
 		}
 
 		ctx := types.NotifyCtx(context.Background(), "logout-ephemeral", "na")
@@ -599,7 +742,7 @@ func (h *Headscale) handleNodeWithValidRegistration(
 		Msg("Client is registered and we have the current NodeKey. All clear to /map")
 
 	resp.AuthURL = ""
-	resp.MachineAuthorized = true
+	resp.MachineAuthorized = !node.AwaitingApproval
 	resp.User = *node.User.TailscaleUser()
 	resp.Login = *node.User.TailscaleLogin()
 
@@ -656,6 +799,9 @@ func (h *Headscale) handleNodeKeyRefresh(
 		return
 	}
 
+	// The node signs its new node key with its network lock key.
+	h.storeRegisterKeySignature(&node, registerRequest)
+
 	resp.AuthURL = ""
 	resp.User = *node.User.TailscaleUser()
 	respBody, err := json.Marshal(resp)
@@ -710,7 +856,7 @@ func (h *Headscale) handleNodeExpiredOrLoggedOut(
 		Str("node_key_old", regReq.OldNodeKey.ShortString()).
 		Msg("Node registration has expired or logged out. Sending a auth url to register")
 
-	if h.oauth2Config != nil {
+	if h.oauth2Config.Load() != nil {
 		resp.AuthURL = fmt.Sprintf("%s/oidc/register/%s",
 			strings.TrimSuffix(h.cfg.ServerURL, "/"),
 			machineKey.String())
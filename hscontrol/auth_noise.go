@@ -50,6 +50,22 @@ func (ns *noiseServer) NoiseRegistrationHandler(
 		return
 	}
 
+	var hostname string
+	if registerRequest.Hostinfo != nil {
+		hostname = registerRequest.Hostinfo.Hostname
+	}
+	if ns.headscale.checkClientVersion(registerRequest.Version, hostname) {
+		// The client shows the error of the response to the user.
+		ns.headscale.handleRejectedNode(
+			writer,
+			registerRequest,
+			ns.conn.Peer(),
+			ns.headscale.cfg.ClientVersions.Message(registerRequest.Version),
+		)
+
+		return
+	}
+
 	ns.nodeKey = registerRequest.NodeKey
 
 	ns.headscale.handleRegister(writer, req, registerRequest, ns.conn.Peer())
@@ -0,0 +1,154 @@
+package hscontrol
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/policy"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gopkg.in/check.v1"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/ptr"
+)
+
+func (s *Suite) TestRegisterAuthKeyChecksTagOwners(c *check.C) {
+	app.ACLPolicy = &policy.ACLPolicy{
+		TagOwners: policy.TagOwners{
+			"tag:server": []string{"user1"},
+		},
+	}
+
+	_, err := app.db.CreateUser("user1")
+	c.Assert(err, check.IsNil)
+
+	register := func(authKey string, requestTags ...string) tailcfg.RegisterResponse {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/machine/register", nil)
+		app.handleRegister(rec, req, tailcfg.RegisterRequest{
+			NodeKey: key.NewNode().Public(),
+			Auth:    &tailcfg.RegisterResponseAuth{AuthKey: authKey},
+			Hostinfo: &tailcfg.Hostinfo{
+				Hostname:    "server",
+				RequestTags: requestTags,
+			},
+		}, key.NewMachine().Public())
+		c.Assert(rec.Code, check.Equals, http.StatusOK)
+
+		var resp tailcfg.RegisterResponse
+		c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+
+		return resp
+	}
+
+	pak, err := app.db.CreatePreAuthKey("user1", true, false, nil, nil, nil)
+	c.Assert(err, check.IsNil)
+
+	resp := register(pak.Key, "tag:server")
+	c.Assert(resp.Error, check.Equals, "")
+	c.Assert(resp.MachineAuthorized, check.Equals, true)
+
+	resp = register(pak.Key, "tag:server", "tag:other")
+	c.Assert(resp.Error, check.Equals, "requested tags [tag:other] are invalid or not permitted")
+	c.Assert(resp.MachineAuthorized, check.Equals, false)
+
+	// The tags of the key are checked like the advertised ones.
+	taggedPak, err := app.db.CreatePreAuthKey("user1", true, false, nil, []string{"tag:other"}, nil)
+	c.Assert(err, check.IsNil)
+
+	resp = register(taggedPak.Key)
+	c.Assert(resp.Error, check.Equals, "requested tags [tag:other] are invalid or not permitted")
+
+	nodes, err := app.db.ListNodes()
+	c.Assert(err, check.IsNil)
+	c.Assert(nodes, check.HasLen, 1)
+}
+
+func (s *Suite) TestRegisterAuthKeyIPPool(c *check.C) {
+	var err error
+	app.ipAlloc, err = db.NewIPAllocator(
+		app.db,
+		ptr.To(netip.MustParsePrefix("100.64.0.0/10")),
+		nil,
+		types.IPAllocationStrategySequential,
+		nil,
+	)
+	c.Assert(err, check.IsNil)
+
+	_, err = app.db.CreateUser("user1")
+	c.Assert(err, check.IsNil)
+
+	pak, err := app.db.CreatePreAuthKey("user1", true, false, nil, nil, &types.PreAuthKeyLimits{
+		MaxUses: 2,
+		IPPools: []string{"100.64.10.0/24"},
+	})
+	c.Assert(err, check.IsNil)
+
+	for range 3 {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/machine/register", nil)
+		app.handleRegister(rec, req, tailcfg.RegisterRequest{
+			NodeKey:  key.NewNode().Public(),
+			Auth:     &tailcfg.RegisterResponseAuth{AuthKey: pak.Key},
+			Hostinfo: &tailcfg.Hostinfo{Hostname: "pinned"},
+		}, key.NewMachine().Public())
+	}
+
+	// The key registers two nodes, in the pool.
+	nodes, err := app.db.ListNodes()
+	c.Assert(err, check.IsNil)
+	c.Assert(nodes, check.HasLen, 2)
+	for _, node := range nodes {
+		c.Assert(netip.MustParsePrefix("100.64.10.0/24").Contains(*node.IPv4), check.Equals, true)
+	}
+}
+
+func (s *Suite) TestRegisterAuthKeyUserIPPool(c *check.C) {
+	var err error
+	app.ipAlloc, err = db.NewIPAllocator(
+		app.db,
+		ptr.To(netip.MustParsePrefix("100.64.0.0/10")),
+		nil,
+		types.IPAllocationStrategySequential,
+		[]types.IPPool{
+			{
+				Nodes:   []string{"tag:server"},
+				Prefix4: ptr.To(netip.MustParsePrefix("100.80.0.0/16")),
+			},
+			{
+				Nodes:   []string{"laptops"},
+				Prefix4: ptr.To(netip.MustParsePrefix("100.90.0.0/16")),
+			},
+		},
+	)
+	c.Assert(err, check.IsNil)
+
+	_, err = app.db.CreateUser("laptops")
+	c.Assert(err, check.IsNil)
+
+	pak, err := app.db.CreatePreAuthKey("laptops", true, false, nil, nil, nil)
+	c.Assert(err, check.IsNil)
+
+	taggedPak, err := app.db.CreatePreAuthKey("laptops", true, false, nil, []string{"tag:server"}, nil)
+	c.Assert(err, check.IsNil)
+
+	for _, authKey := range []string{pak.Key, taggedPak.Key} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/machine/register", nil)
+		app.handleRegister(rec, req, tailcfg.RegisterRequest{
+			NodeKey:  key.NewNode().Public(),
+			Auth:     &tailcfg.RegisterResponseAuth{AuthKey: authKey},
+			Hostinfo: &tailcfg.Hostinfo{Hostname: "pooled"},
+		}, key.NewMachine().Public())
+	}
+
+	// The pool of the first matching tag or user is used.
+	nodes, err := app.db.ListNodes()
+	c.Assert(err, check.IsNil)
+	c.Assert(nodes, check.HasLen, 2)
+	c.Assert(*nodes[0].IPv4, check.Equals, netip.MustParseAddr("100.90.0.0"))
+	c.Assert(*nodes[1].IPv4, check.Equals, netip.MustParseAddr("100.80.0.0"))
+}
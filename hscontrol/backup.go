@@ -0,0 +1,395 @@
+package hscontrol
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/rs/zerolog/log"
+)
+
+// The files of a backup archive.
+const (
+	backupManifestFile = "manifest.json"
+	backupSQLiteFile   = "headscale.db"
+	backupPostgresFile = "headscale.pgdump"
+	backupNoiseKeyFile = "noise_private.key"
+	backupDERPKeyFile  = "derp_server_private.key"
+	backupPolicyFile   = "policy"
+)
+
+var backupFiles = []string{
+	backupManifestFile,
+	backupSQLiteFile,
+	backupPostgresFile,
+	backupNoiseKeyFile,
+	backupDERPKeyFile,
+	backupPolicyFile,
+}
+
+var (
+	ErrBackupInvalid      = errors.New("invalid backup")
+	ErrBackupDatabaseType = errors.New("the backup is of another database type")
+	ErrBackupNewerSchema  = errors.New("the backup was taken by a newer version of headscale")
+)
+
+// BackupManifest describes a backup archive written by WriteBackup.
+type BackupManifest struct {
+	CreatedAt    time.Time `json:"created_at"`
+	DatabaseType string    `json:"database_type"`
+
+	// Migrations are the schema migrations applied to the database of
+	// the backup. It can only be restored by a version of headscale
+	// knowing all of them, the older schemas are migrated on start.
+	Migrations []string `json:"migrations"`
+
+	Files []string `json:"files"`
+}
+
+// backupFile is a file of the backup archive, and its path on disk.
+type backupFile struct {
+	name string
+	path string
+}
+
+// WriteBackup writes a tar.gz archive of the database, the noise and
+// DERP private keys, and the policy file of the configuration to w.
+// The SQLite database is copied consistently while headscale runs, the
+// postgres database is dumped with pg_dump.
+func WriteBackup(
+	ctx context.Context,
+	cfg *types.Config,
+	w io.Writer,
+) (*BackupManifest, error) {
+	tmpDir, err := os.MkdirTemp("", "headscale-backup")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	manifest := &BackupManifest{
+		CreatedAt:    time.Now().UTC(),
+		DatabaseType: cfg.Database.Type,
+	}
+
+	var files []backupFile
+	switch cfg.Database.Type {
+	case types.DatabaseSqlite:
+		path := filepath.Join(tmpDir, backupSQLiteFile)
+		if err := db.BackupSQLite(cfg.Database, path); err != nil {
+			return nil, err
+		}
+
+		// The schema version is read from the copy, the database
+		// can be migrated meanwhile.
+		manifest.Migrations, err = db.AppliedMigrations(sqliteConfig(path))
+		if err != nil {
+			return nil, fmt.Errorf("reading schema version: %w", err)
+		}
+
+		files = append(files, backupFile{backupSQLiteFile, path})
+
+	case types.DatabasePostgres:
+		manifest.Migrations, err = db.AppliedMigrations(cfg.Database)
+		if err != nil {
+			return nil, fmt.Errorf("reading schema version: %w", err)
+		}
+
+		path := filepath.Join(tmpDir, backupPostgresFile)
+		dump, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+
+		err = db.DumpPostgres(ctx, cfg.Database.Postgres, dump)
+		dump.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, backupFile{backupPostgresFile, path})
+
+	default:
+		return nil, fmt.Errorf("database of type %s cannot be backed up", cfg.Database.Type)
+	}
+
+	files = append(files, backupFile{backupNoiseKeyFile, cfg.NoisePrivateKeyPath})
+
+	if cfg.DERP.ServerPrivateKeyPath != "" {
+		if _, err := os.Stat(cfg.DERP.ServerPrivateKeyPath); err == nil {
+			files = append(files, backupFile{backupDERPKeyFile, cfg.DERP.ServerPrivateKeyPath})
+		}
+	}
+
+	if cfg.ACL.Mode == types.PolicyModeFile && cfg.ACL.PolicyPath != "" {
+		files = append(files, backupFile{backupPolicyFile, cfg.ACL.PolicyPath})
+	}
+
+	for _, file := range files {
+		manifest.Files = append(manifest.Files, file.name)
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+
+	if err := archive.WriteHeader(&tar.Header{
+		Name:    backupManifestFile,
+		Mode:    0o600,
+		Size:    int64(len(manifestData)),
+		ModTime: manifest.CreatedAt,
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := archive.Write(manifestData); err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if err := addBackupFile(archive, file); err != nil {
+			return nil, fmt.Errorf("adding %s to the backup: %w", file.path, err)
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+func addBackupFile(archive *tar.Writer, file backupFile) error {
+	f, err := os.Open(file.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := archive.WriteHeader(&tar.Header{
+		Name:    file.name,
+		Mode:    0o600,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(archive, f)
+
+	return err
+}
+
+// RestoreBackup restores a backup written by WriteBackup. The database
+// of the configuration is replaced, and the keys and the policy file
+// are written to their paths in the configuration. The backup is
+// rejected if it is of another database type, or if its schema is
+// newer than the one of this version of headscale. headscale must not
+// be running.
+func RestoreBackup(
+	ctx context.Context,
+	cfg *types.Config,
+	r io.Reader,
+) (*BackupManifest, error) {
+	tmpDir, err := os.MkdirTemp("", "headscale-restore")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := extractBackup(r, tmpDir); err != nil {
+		return nil, err
+	}
+
+	manifestData, err := os.ReadFile(filepath.Join(tmpDir, backupManifestFile))
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading manifest: %w", ErrBackupInvalid, err)
+	}
+
+	var manifest BackupManifest
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return nil, fmt.Errorf("%w: decoding manifest: %w", ErrBackupInvalid, err)
+	}
+
+	if manifest.DatabaseType != cfg.Database.Type {
+		return nil, fmt.Errorf(
+			"%w: %s, the configuration uses %s",
+			ErrBackupDatabaseType,
+			manifest.DatabaseType,
+			cfg.Database.Type,
+		)
+	}
+
+	migrations := manifest.Migrations
+	sqlitePath := filepath.Join(tmpDir, backupSQLiteFile)
+	if cfg.Database.Type == types.DatabaseSqlite {
+		// The migrations of the database itself are checked, it
+		// also ensures it is a database headscale can open.
+		migrations, err = db.AppliedMigrations(sqliteConfig(sqlitePath))
+		if err != nil {
+			return nil, fmt.Errorf("%w: reading schema version: %w", ErrBackupInvalid, err)
+		}
+	}
+
+	known := db.SchemaMigrationIDs(cfg.Database)
+	for _, migration := range migrations {
+		if !slices.Contains(known, migration) {
+			return nil, fmt.Errorf("%w: unknown migration %s", ErrBackupNewerSchema, migration)
+		}
+	}
+
+	switch cfg.Database.Type {
+	case types.DatabaseSqlite:
+		if err := restoreSQLite(sqlitePath, cfg.Database.Sqlite.Path); err != nil {
+			return nil, fmt.Errorf("restoring sqlite database: %w", err)
+		}
+
+	case types.DatabasePostgres:
+		dump, err := os.Open(filepath.Join(tmpDir, backupPostgresFile))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrBackupInvalid, err)
+		}
+		defer dump.Close()
+
+		if err := db.RestorePostgres(ctx, cfg.Database.Postgres, dump); err != nil {
+			return nil, fmt.Errorf("restoring postgres database: %w", err)
+		}
+	}
+
+	for _, file := range []backupFile{
+		{backupNoiseKeyFile, cfg.NoisePrivateKeyPath},
+		{backupDERPKeyFile, cfg.DERP.ServerPrivateKeyPath},
+		{backupPolicyFile, cfg.ACL.PolicyPath},
+	} {
+		if !slices.Contains(manifest.Files, file.name) {
+			continue
+		}
+
+		if file.path == "" {
+			log.Warn().
+				Str("file", file.name).
+				Msg("The backup has a file with no path in the configuration, it is not restored")
+
+			continue
+		}
+
+		if err := copyFile(filepath.Join(tmpDir, file.name), file.path); err != nil {
+			return nil, fmt.Errorf("restoring %s: %w", file.path, err)
+		}
+	}
+
+	return &manifest, nil
+}
+
+// extractBackup extracts the files of a backup archive to dir, the
+// archive must only contain the files of a backup.
+func extractBackup(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrBackupInvalid, err)
+	}
+	defer gz.Close()
+
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrBackupInvalid, err)
+		}
+
+		if header.Typeflag != tar.TypeReg || !slices.Contains(backupFiles, header.Name) {
+			return fmt.Errorf("%w: unexpected file %s", ErrBackupInvalid, header.Name)
+		}
+
+		f, err := os.OpenFile(filepath.Join(dir, header.Name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(f, archive)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrBackupInvalid, err)
+		}
+	}
+}
+
+// restoreSQLite replaces the SQLite database at path with the one at
+// from. The write-ahead log of the database being replaced is removed,
+// it must not be applied to the restored one.
+func restoreSQLite(from, path string) error {
+	restored := path + ".restore"
+	if err := copyFile(from, restored); err != nil {
+		return err
+	}
+
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(path + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return os.Rename(restored, path)
+}
+
+// copyFile copies the file at from to path, readable only by the
+// owner, and creates its directory.
+func copyFile(from, path string) error {
+	if err := util.EnsureDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+
+		return err
+	}
+
+	return dst.Close()
+}
+
+func sqliteConfig(path string) types.DatabaseConfig {
+	return types.DatabaseConfig{
+		Type: types.DatabaseSqlite,
+		Sqlite: types.SqliteConfig{
+			Path: path,
+		},
+	}
+}
@@ -0,0 +1,129 @@
+package hscontrol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/types"
+)
+
+func backupTestConfig(dir string) *types.Config {
+	return &types.Config{
+		NoisePrivateKeyPath: filepath.Join(dir, "noise_private.key"),
+		Database:            sqliteConfig(filepath.Join(dir, "headscale.db")),
+		ACL: types.ACLConfig{
+			Mode:       types.PolicyModeFile,
+			PolicyPath: filepath.Join(dir, "policy.hujson"),
+		},
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	src := backupTestConfig(t.TempDir())
+
+	hsdb, err := db.NewHeadscaleDatabase(src.Database, "")
+	if err != nil {
+		t.Fatalf("setting up database: %s", err)
+	}
+	if _, err := hsdb.CreateUser("backup"); err != nil {
+		t.Fatalf("creating user: %s", err)
+	}
+
+	if err := os.WriteFile(src.NoisePrivateKeyPath, []byte("privkey:noise"), 0o600); err != nil {
+		t.Fatalf("writing noise key: %s", err)
+	}
+	policy := []byte(`{"acls": []}`)
+	if err := os.WriteFile(src.ACL.PolicyPath, policy, 0o600); err != nil {
+		t.Fatalf("writing policy: %s", err)
+	}
+
+	// The backup is taken while the database is open.
+	var backup bytes.Buffer
+	manifest, err := WriteBackup(context.Background(), src, &backup)
+	if err != nil {
+		t.Fatalf("WriteBackup() error = %s", err)
+	}
+	hsdb.Close()
+
+	wantFiles := []string{backupSQLiteFile, backupNoiseKeyFile, backupPolicyFile}
+	if diff := cmp.Diff(wantFiles, manifest.Files); diff != "" {
+		t.Errorf("unexpected backup files (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(db.SchemaMigrationIDs(src.Database), manifest.Migrations); diff != "" {
+		t.Errorf("unexpected backup migrations (-want +got):\n%s", diff)
+	}
+
+	dst := backupTestConfig(t.TempDir())
+	if _, err := RestoreBackup(context.Background(), dst, bytes.NewReader(backup.Bytes())); err != nil {
+		t.Fatalf("RestoreBackup() error = %s", err)
+	}
+
+	restored, err := db.NewHeadscaleDatabase(dst.Database, "")
+	if err != nil {
+		t.Fatalf("opening restored database: %s", err)
+	}
+	defer restored.Close()
+	if _, err := restored.GetUser("backup"); err != nil {
+		t.Errorf("user not restored: %s", err)
+	}
+
+	for path, want := range map[string][]byte{
+		dst.NoisePrivateKeyPath: []byte("privkey:noise"),
+		dst.ACL.PolicyPath:      policy,
+	} {
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("reading restored file: %s", err)
+		}
+		if !bytes.Equal(want, got) {
+			t.Errorf("restored %s = %q, want %q", path, got, want)
+		}
+	}
+
+	postgres := backupTestConfig(t.TempDir())
+	postgres.Database = types.DatabaseConfig{Type: types.DatabasePostgres}
+	_, err = RestoreBackup(context.Background(), postgres, bytes.NewReader(backup.Bytes()))
+	if !errors.Is(err, ErrBackupDatabaseType) {
+		t.Errorf("RestoreBackup() into postgres error = %v, want %v", err, ErrBackupDatabaseType)
+	}
+}
+
+func TestRestoreBackupNewerSchema(t *testing.T) {
+	src := backupTestConfig(t.TempDir())
+
+	hsdb, err := db.NewHeadscaleDatabase(src.Database, "")
+	if err != nil {
+		t.Fatalf("setting up database: %s", err)
+	}
+	// A migration of a future version of headscale.
+	if err := hsdb.DB.Exec("INSERT INTO migrations (id) VALUES (?)", "209912312359").Error; err != nil {
+		t.Fatalf("adding migration: %s", err)
+	}
+	hsdb.Close()
+
+	if err := os.WriteFile(src.NoisePrivateKeyPath, []byte("privkey:noise"), 0o600); err != nil {
+		t.Fatalf("writing noise key: %s", err)
+	}
+	src.ACL.PolicyPath = ""
+
+	var backup bytes.Buffer
+	if _, err := WriteBackup(context.Background(), src, &backup); err != nil {
+		t.Fatalf("WriteBackup() error = %s", err)
+	}
+
+	dst := backupTestConfig(t.TempDir())
+	_, err = RestoreBackup(context.Background(), dst, &backup)
+	if !errors.Is(err, ErrBackupNewerSchema) {
+		t.Fatalf("RestoreBackup() error = %v, want %v", err, ErrBackupNewerSchema)
+	}
+
+	if _, err := os.Stat(dst.Database.Sqlite.Path); !os.IsNotExist(err) {
+		t.Errorf("database restored from a newer schema: %v", err)
+	}
+}
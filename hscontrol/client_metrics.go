@@ -0,0 +1,154 @@
+package hscontrol
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/rs/zerolog/log"
+	"tailscale.com/tailcfg"
+)
+
+// The client metrics are fetched with a c2n (control to node) ping
+// request: the node runs the HTTP request of the ping on its c2n
+// handler, and posts the response to the URL of the ping over Noise.
+const (
+	clientMetricsPath = "/machine/c2n/metrics/"
+
+	// maxClientMetricsSize bounds the c2n response of a node, which
+	// holds a few hundred metrics.
+	maxClientMetricsSize = 1 << 20
+)
+
+// collectClientMetrics regularly asks the nodes connected to this
+// instance for their client metrics.
+func (h *Headscale) collectClientMetrics(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+
+	for {
+		select {
+		case <-ctx.Done():
+			ticker.Stop()
+			return
+		case <-ticker.C:
+			for _, nodeID := range h.nodeNotifier.LocalConnectedNodes() {
+				h.requestClientMetrics(nodeID)
+			}
+		}
+	}
+}
+
+// requestClientMetrics sends the node a c2n ping request for its client
+// metrics, which it answers in ClientMetricsHandler.
+func (h *Headscale) requestClientMetrics(nodeID types.NodeID) {
+	pingRequest, err := h.clientMetricsPingRequest()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to create the client metrics request")
+
+		return
+	}
+
+	ctx := types.NotifyCtx(context.Background(), "client-metrics", "na")
+	h.nodeNotifier.NotifyByNodeID(
+		ctx,
+		types.StateUpdate{
+			Type:        types.StatePingRequest,
+			PingRequest: pingRequest,
+		},
+		nodeID)
+}
+
+// clientMetricsPingRequest returns a c2n ping request for the client
+// metrics. The nodes ignore a ping request with the URL of the previous
+// one, so every URL ends with a random nonce.
+func (h *Headscale) clientMetricsPingRequest() (*tailcfg.PingRequest, error) {
+	nonce, err := util.GenerateRandomStringDNSSafe(16)
+	if err != nil {
+		return nil, err
+	}
+
+	metricsReq, err := http.NewRequest(http.MethodGet, "http://tailscaled/debug/metrics", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload bytes.Buffer
+	if err := metricsReq.Write(&payload); err != nil {
+		return nil, err
+	}
+
+	return &tailcfg.PingRequest{
+		URL:     strings.TrimSuffix(h.cfg.ServerURL, "/") + clientMetricsPath + nonce,
+		Types:   "c2n",
+		Payload: payload.Bytes(),
+	}, nil
+}
+
+// ClientMetricsHandler stores the client metrics a node sends in answer
+// to the c2n ping request of requestClientMetrics, the body being the
+// HTTP response of its c2n handler.
+// Listens in /machine/c2n/metrics/:nonce.
+func (ns *noiseServer) ClientMetricsHandler(
+	writer http.ResponseWriter,
+	req *http.Request,
+) {
+	node, err := ns.headscale.db.GetNodeByMachineKey(ns.machineKey)
+	if err != nil {
+		http.Error(writer, "unknown node", http.StatusForbidden)
+
+		return
+	}
+
+	resp, err := http.ReadResponse(
+		bufio.NewReader(io.LimitReader(req.Body, maxClientMetricsSize)),
+		nil,
+	)
+	if err != nil {
+		http.Error(writer, "invalid c2n response", http.StatusBadRequest)
+
+		return
+	}
+	defer resp.Body.Close()
+
+	// Clients too old to serve their metrics over c2n answer with an
+	// error, they are only missing from the health of the node.
+	if resp.StatusCode != http.StatusOK {
+		log.Debug().
+			Str("node", node.Hostname).
+			Int("status", resp.StatusCode).
+			Msg("node did not send its client metrics")
+		writer.WriteHeader(http.StatusOK)
+
+		return
+	}
+
+	metrics, err := types.ParseClientMetrics(resp.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if err := ns.headscale.db.SetNodeClientMetrics(&types.NodeClientMetrics{
+		NodeID:    node.ID,
+		Metrics:   metrics,
+		UpdatedAt: time.Now(),
+	}); err != nil {
+		log.Error().
+			Caller().
+			Err(err).
+			Str("node", node.Hostname).
+			Msg("failed to store the client metrics")
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+
+		return
+	}
+
+	writer.WriteHeader(http.StatusOK)
+}
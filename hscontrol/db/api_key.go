@@ -18,10 +18,16 @@ const (
 
 var ErrAPIKeyFailedToParse = errors.New("failed to parse ApiKey")
 
-// CreateAPIKey creates a new ApiKey in a user, and returns it.
+// CreateAPIKey creates a new ApiKey, limited to the given scopes, and
+// returns it.
 func (hsdb *HSDatabase) CreateAPIKey(
 	expiration *time.Time,
+	scopes ...string,
 ) (string, *types.APIKey, error) {
+	if err := types.ValidateAPIScopes(scopes); err != nil {
+		return "", nil, err
+	}
+
 	prefix, err := util.GenerateRandomStringURLSafe(apiPrefixLength)
 	if err != nil {
 		return "", nil, err
@@ -44,6 +50,7 @@ func (hsdb *HSDatabase) CreateAPIKey(
 		Prefix:     prefix,
 		Hash:       hash,
 		Expiration: expiration,
+		Scopes:     scopes,
 	}
 
 	if err := hsdb.DB.Save(&key).Error; err != nil {
@@ -103,23 +110,31 @@ func (hsdb *HSDatabase) ExpireAPIKey(key *types.APIKey) error {
 }
 
 func (hsdb *HSDatabase) ValidateAPIKey(keyStr string) (bool, error) {
+	key, err := hsdb.AuthenticateAPIKey(keyStr)
+
+	return key != nil, err
+}
+
+// AuthenticateAPIKey returns the ApiKey matching the key, or nil if it
+// has expired.
+func (hsdb *HSDatabase) AuthenticateAPIKey(keyStr string) (*types.APIKey, error) {
 	prefix, hash, found := strings.Cut(keyStr, ".")
 	if !found {
-		return false, ErrAPIKeyFailedToParse
+		return nil, ErrAPIKeyFailedToParse
 	}
 
 	key, err := hsdb.GetAPIKey(prefix)
 	if err != nil {
-		return false, fmt.Errorf("failed to validate api key: %w", err)
+		return nil, fmt.Errorf("failed to validate api key: %w", err)
 	}
 
 	if key.Expiration.Before(time.Now()) {
-		return false, nil
+		return nil, nil
 	}
 
 	if err := bcrypt.CompareHashAndPassword(key.Hash, []byte(hash)); err != nil {
-		return false, err
+		return nil, err
 	}
 
-	return true, nil
+	return key, nil
 }
@@ -1,8 +1,10 @@
 package db
 
 import (
+	"errors"
 	"time"
 
+	"github.com/juanfont/headscale/hscontrol/types"
 	"gopkg.in/check.v1"
 )
 
@@ -87,3 +89,25 @@ func (*Suite) TestExpireAPIKey(c *check.C) {
 	c.Assert(err, check.IsNil)
 	c.Assert(notValid, check.Equals, false)
 }
+
+func (*Suite) TestCreateAPIKeyScopes(c *check.C) {
+	nowPlus2 := time.Now().Add(2 * time.Hour)
+	apiKeyStr, _, err := db.CreateAPIKey(&nowPlus2, "nodes:read", "routes:write")
+	c.Assert(err, check.IsNil)
+
+	key, err := db.AuthenticateAPIKey(apiKeyStr)
+	c.Assert(err, check.IsNil)
+	c.Assert(key, check.NotNil)
+	c.Assert([]string(key.Scopes), check.DeepEquals, []string{"nodes:read", "routes:write"})
+
+	c.Assert(key.Allows(types.APIResourceNodes, false), check.Equals, true)
+	c.Assert(key.Allows(types.APIResourceNodes, true), check.Equals, false)
+	c.Assert(key.Allows(types.APIResourceRoutes, true), check.Equals, true)
+	c.Assert(key.Allows(types.APIResourceUsers, false), check.Equals, false)
+
+	_, _, err = db.CreateAPIKey(nil, "nodes:admin")
+	c.Assert(errors.Is(err, types.ErrInvalidAPIScope), check.Equals, true)
+
+	_, _, err = db.CreateAPIKey(nil, "keys:write")
+	c.Assert(errors.Is(err, types.ErrInvalidAPIScope), check.Equals, true)
+}
@@ -0,0 +1,121 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+)
+
+// BackupSQLite writes a consistent copy of the SQLite database of the
+// configuration to path. It can run while headscale is using the
+// database, the copy is made in a read transaction.
+func BackupSQLite(cfg types.DatabaseConfig, path string) error {
+	if _, err := os.Stat(cfg.Sqlite.Path); err != nil {
+		return fmt.Errorf("opening sqlite database: %w", err)
+	}
+
+	dbConn, err := openDB(cfg)
+	if err != nil {
+		return err
+	}
+
+	sqlDB, err := dbConn.DB()
+	if err != nil {
+		return err
+	}
+	defer sqlDB.Close()
+
+	if err := dbConn.Exec("VACUUM INTO ?", path).Error; err != nil {
+		return fmt.Errorf("copying sqlite database: %w", err)
+	}
+
+	return nil
+}
+
+// DumpPostgres writes an archive of the postgres database of the
+// configuration to w with pg_dump, which must be installed.
+func DumpPostgres(ctx context.Context, cfg types.PostgresConfig, w io.Writer) error {
+	cmd := postgresCommand(ctx, cfg, "pg_dump",
+		"--format=custom",
+		"--no-owner",
+	)
+	cmd.Stdout = w
+
+	return runPostgresCommand(cmd)
+}
+
+// RestorePostgres restores an archive written by DumpPostgres into the
+// postgres database of the configuration with pg_restore, which must be
+// installed. The tables of the archive are replaced in a single
+// transaction, the database is left untouched if it fails.
+func RestorePostgres(ctx context.Context, cfg types.PostgresConfig, r io.Reader) error {
+	cmd := postgresCommand(ctx, cfg, "pg_restore",
+		"--clean",
+		"--if-exists",
+		"--no-owner",
+		"--single-transaction",
+		"--dbname="+cfg.Name,
+	)
+	cmd.Stdin = r
+
+	return runPostgresCommand(cmd)
+}
+
+// postgresCommand returns the command running a postgres client tool
+// connecting to the database of the configuration, the connection
+// settings are passed in the environment.
+func postgresCommand(
+	ctx context.Context,
+	cfg types.PostgresConfig,
+	name string,
+	args ...string,
+) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = append(os.Environ(),
+		"PGHOST="+cfg.Host,
+		"PGDATABASE="+cfg.Name,
+		"PGUSER="+cfg.User,
+	)
+
+	if cfg.Port != 0 {
+		cmd.Env = append(cmd.Env, "PGPORT="+strconv.Itoa(cfg.Port))
+	}
+
+	if cfg.Pass != "" {
+		cmd.Env = append(cmd.Env, "PGPASSWORD="+cfg.Pass)
+	}
+
+	if sslEnabled, err := strconv.ParseBool(cfg.Ssl); err == nil {
+		if !sslEnabled {
+			cmd.Env = append(cmd.Env, "PGSSLMODE=disable")
+		}
+	} else if cfg.Ssl != "" {
+		cmd.Env = append(cmd.Env, "PGSSLMODE="+cfg.Ssl)
+	}
+
+	return cmd
+}
+
+func runPostgresCommand(cmd *exec.Cmd) error {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf(
+			"running %s: %w: %s",
+			filepath.Base(cmd.Path),
+			err,
+			strings.TrimSpace(stderr.String()),
+		)
+	}
+
+	return nil
+}
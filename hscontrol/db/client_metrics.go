@@ -0,0 +1,46 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gorm.io/gorm"
+)
+
+func (hsdb *HSDatabase) SetNodeClientMetrics(metrics *types.NodeClientMetrics) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return SetNodeClientMetrics(tx, metrics)
+	})
+}
+
+// SetNodeClientMetrics stores the client metrics of a node, replacing
+// the previous ones.
+func SetNodeClientMetrics(tx *gorm.DB, metrics *types.NodeClientMetrics) error {
+	return tx.Save(metrics).Error
+}
+
+func (hsdb *HSDatabase) GetNodeClientMetrics(nodeID types.NodeID) (*types.NodeClientMetrics, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (*types.NodeClientMetrics, error) {
+		return GetNodeClientMetrics(rx, nodeID)
+	})
+}
+
+// GetNodeClientMetrics returns the client metrics a node last sent, nil
+// if it never sent them.
+func GetNodeClientMetrics(tx *gorm.DB, nodeID types.NodeID) (*types.NodeClientMetrics, error) {
+	var metrics types.NodeClientMetrics
+	err := tx.Where("node_id = ?", nodeID).Take(&metrics).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &metrics, nil
+}
+
+// DeleteNodeClientMetrics deletes the client metrics of a node, if any.
+func DeleteNodeClientMetrics(tx *gorm.DB, nodeID types.NodeID) error {
+	return tx.Delete(&types.NodeClientMetrics{}, "node_id = ?", nodeID).Error
+}
@@ -6,14 +6,17 @@ import (
 	"errors"
 	"fmt"
 	"net/netip"
+	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/glebarez/sqlite"
 	"github.com/go-gormigrate/gormigrate/v2"
-	"github.com/rs/zerolog/log"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
@@ -34,6 +37,11 @@ type KV struct {
 type HSDatabase struct {
 	DB *gorm.DB
 
+	// replica is the read replica of the postgres database, if any.
+	replica *gorm.DB
+
+	nodes *NodeStore
+
 	baseDomain string
 }
 
@@ -48,367 +56,724 @@ func NewHeadscaleDatabase(
 		return nil, err
 	}
 
+	nodes := newNodeStore()
+	if err := dbConn.Use(nodes); err != nil {
+		return nil, fmt.Errorf("setting up node store: %w", err)
+	}
+
 	migrations := gormigrate.New(
 		dbConn,
 		gormigrate.DefaultOptions,
-		[]*gormigrate.Migration{
-			// New migrations should be added as transactions at the end of this list.
-			// The initial commit here is quite messy, completely out of order and
-			// has no versioning and is the tech debt of not having versioned migrations
-			// prior to this point. This first migration is all DB changes to bring a DB
-			// up to 0.23.0.
-			{
-				ID: "202312101416",
-				Migrate: func(tx *gorm.DB) error {
-					if cfg.Type == types.DatabasePostgres {
-						tx.Exec(`create extension if not exists "uuid-ossp";`)
-					}
+		schemaMigrations(dbConn, cfg),
+	)
 
-					_ = tx.Migrator().RenameTable("namespaces", "users")
+	if err = migrations.Migrate(); err != nil {
+		util.LogDB.Fatal().Err(err).Msgf("Migration failed: %v", err)
+	}
 
-					// the big rename from Machine to Node
-					_ = tx.Migrator().RenameTable("machines", "nodes")
-					_ = tx.Migrator().
-						RenameColumn(&types.Route{}, "machine_id", "node_id")
+	db := HSDatabase{
+		DB:    dbConn,
+		nodes: nodes,
 
-					err = tx.AutoMigrate(types.User{})
-					if err != nil {
-						return err
-					}
+		baseDomain: baseDomain,
+	}
 
-					_ = tx.Migrator().
-						RenameColumn(&types.Node{}, "namespace_id", "user_id")
-					_ = tx.Migrator().
-						RenameColumn(&types.PreAuthKey{}, "namespace_id", "user_id")
-
-					_ = tx.Migrator().
-						RenameColumn(&types.Node{}, "ip_address", "ip_addresses")
-					_ = tx.Migrator().RenameColumn(&types.Node{}, "name", "hostname")
-
-					// GivenName is used as the primary source of DNS names, make sure
-					// the field is populated and normalized if it was not when the
-					// node was registered.
-					_ = tx.Migrator().
-						RenameColumn(&types.Node{}, "nickname", "given_name")
-
-					dbConn.Model(&types.Node{}).Where("auth_key_id = ?", 0).Update("auth_key_id", nil)
-					// If the Node table has a column for registered,
-					// find all occourences of "false" and drop them. Then
-					// remove the column.
-					if tx.Migrator().HasColumn(&types.Node{}, "registered") {
-						log.Info().
-							Msg(`Database has legacy "registered" column in node, removing...`)
-
-						nodes := types.Nodes{}
-						if err := tx.Not("registered").Find(&nodes).Error; err != nil {
-							log.Error().Err(err).Msg("Error accessing db")
-						}
+	if cfg.Type == types.DatabasePostgres && cfg.Postgres.ReadDSN != "" {
+		util.LogDB.Info().
+			Str("database", types.DatabasePostgres).
+			Msg("Opening read replica")
 
-						for _, node := range nodes {
-							log.Info().
+		db.replica, err = openPostgres(cfg.Postgres.ReadDSN, cfg.Postgres, dbConn.Config.Logger)
+		if err != nil {
+			return nil, fmt.Errorf("opening read replica: %w", err)
+		}
+	}
+
+	return &db, err
+}
+
+// schemaMigrations returns the migrations of the database schema, in the
+// order they are applied.
+func schemaMigrations(dbConn *gorm.DB, cfg types.DatabaseConfig) []*gormigrate.Migration {
+	return []*gormigrate.Migration{
+		// New migrations should be added as transactions at the end of this list.
+		// The initial commit here is quite messy, completely out of order and
+		// has no versioning and is the tech debt of not having versioned migrations
+		// prior to this point. This first migration is all DB changes to bring a DB
+		// up to 0.23.0.
+		{
+			ID: "202312101416",
+			Migrate: func(tx *gorm.DB) error {
+				if cfg.Type == types.DatabasePostgres {
+					tx.Exec(`create extension if not exists "uuid-ossp";`)
+				}
+
+				_ = tx.Migrator().RenameTable("namespaces", "users")
+
+				// the big rename from Machine to Node
+				_ = tx.Migrator().RenameTable("machines", "nodes")
+				_ = tx.Migrator().
+					RenameColumn(&types.Route{}, "machine_id", "node_id")
+
+				err := tx.AutoMigrate(types.User{})
+				if err != nil {
+					return err
+				}
+
+				_ = tx.Migrator().
+					RenameColumn(&types.Node{}, "namespace_id", "user_id")
+				_ = tx.Migrator().
+					RenameColumn(&types.PreAuthKey{}, "namespace_id", "user_id")
+
+				_ = tx.Migrator().
+					RenameColumn(&types.Node{}, "ip_address", "ip_addresses")
+				_ = tx.Migrator().RenameColumn(&types.Node{}, "name", "hostname")
+
+				// GivenName is used as the primary source of DNS names, make sure
+				// the field is populated and normalized if it was not when the
+				// node was registered.
+				_ = tx.Migrator().
+					RenameColumn(&types.Node{}, "nickname", "given_name")
+
+				dbConn.Model(&types.Node{}).Where("auth_key_id = ?", 0).Update("auth_key_id", nil)
+				// If the Node table has a column for registered,
+				// find all occourences of "false" and drop them. Then
+				// remove the column.
+				if tx.Migrator().HasColumn(&types.Node{}, "registered") {
+					util.LogDB.Info().
+						Msg(`Database has legacy "registered" column in node, removing...`)
+
+					nodes := types.Nodes{}
+					if err := tx.Not("registered").Find(&nodes).Error; err != nil {
+						util.LogDB.Error().Err(err).Msg("Error accessing db")
+					}
+
+					for _, node := range nodes {
+						util.LogDB.Info().
+							Str("node", node.Hostname).
+							Str("machine_key", node.MachineKey.ShortString()).
+							Msg("Deleting unregistered node")
+						if err := tx.Delete(&types.Node{}, node.ID).Error; err != nil {
+							util.LogDB.Error().
+								Err(err).
 								Str("node", node.Hostname).
 								Str("machine_key", node.MachineKey.ShortString()).
-								Msg("Deleting unregistered node")
-							if err := tx.Delete(&types.Node{}, node.ID).Error; err != nil {
-								log.Error().
-									Err(err).
-									Str("node", node.Hostname).
-									Str("machine_key", node.MachineKey.ShortString()).
-									Msg("Error deleting unregistered node")
-							}
-						}
-
-						err := tx.Migrator().DropColumn(&types.Node{}, "registered")
-						if err != nil {
-							log.Error().Err(err).Msg("Error dropping registered column")
+								Msg("Error deleting unregistered node")
 						}
 					}
 
-					err = tx.AutoMigrate(&types.Route{})
+					err := tx.Migrator().DropColumn(&types.Node{}, "registered")
 					if err != nil {
-						return err
+						util.LogDB.Error().Err(err).Msg("Error dropping registered column")
+					}
+				}
+
+				err = tx.AutoMigrate(&types.Route{})
+				if err != nil {
+					return err
+				}
+
+				err = tx.AutoMigrate(&types.Node{})
+				if err != nil {
+					return err
+				}
+
+				// Ensure all keys have correct prefixes
+				// https://github.com/tailscale/tailscale/blob/main/types/key/node.go#L35
+				type result struct {
+					ID         uint64
+					MachineKey string
+					NodeKey    string
+					DiscoKey   string
+				}
+				var results []result
+				err = tx.Raw("SELECT id, node_key, machine_key, disco_key FROM nodes").
+					Find(&results).
+					Error
+				if err != nil {
+					return err
+				}
+
+				for _, node := range results {
+					mKey := node.MachineKey
+					if !strings.HasPrefix(node.MachineKey, "mkey:") {
+						mKey = "mkey:" + node.MachineKey
+					}
+					nKey := node.NodeKey
+					if !strings.HasPrefix(node.NodeKey, "nodekey:") {
+						nKey = "nodekey:" + node.NodeKey
+					}
+
+					dKey := node.DiscoKey
+					if !strings.HasPrefix(node.DiscoKey, "discokey:") {
+						dKey = "discokey:" + node.DiscoKey
 					}
 
-					err = tx.AutoMigrate(&types.Node{})
+					err := tx.Exec(
+						"UPDATE nodes SET machine_key = @mKey, node_key = @nKey, disco_key = @dKey WHERE ID = @id",
+						sql.Named("mKey", mKey),
+						sql.Named("nKey", nKey),
+						sql.Named("dKey", dKey),
+						sql.Named("id", node.ID),
+					).Error
 					if err != nil {
 						return err
 					}
+				}
+
+				if tx.Migrator().HasColumn(&types.Node{}, "enabled_routes") {
+					util.LogDB.Info().
+						Msgf("Database has legacy enabled_routes column in node, migrating...")
 
-					// Ensure all keys have correct prefixes
-					// https://github.com/tailscale/tailscale/blob/main/types/key/node.go#L35
-					type result struct {
-						ID         uint64
-						MachineKey string
-						NodeKey    string
-						DiscoKey   string
+					type NodeAux struct {
+						ID            uint64
+						EnabledRoutes types.IPPrefixes
 					}
-					var results []result
-					err = tx.Raw("SELECT id, node_key, machine_key, disco_key FROM nodes").
-						Find(&results).
+
+					nodesAux := []NodeAux{}
+					err := tx.Table("nodes").
+						Select("id, enabled_routes").
+						Scan(&nodesAux).
 						Error
 					if err != nil {
-						return err
+						util.LogDB.Fatal().Err(err).Msg("Error accessing db")
 					}
+					for _, node := range nodesAux {
+						for _, prefix := range node.EnabledRoutes {
+							if err != nil {
+								util.LogDB.Error().
+									Err(err).
+									Str("enabled_route", prefix.String()).
+									Msg("Error parsing enabled_route")
 
-					for _, node := range results {
-						mKey := node.MachineKey
-						if !strings.HasPrefix(node.MachineKey, "mkey:") {
-							mKey = "mkey:" + node.MachineKey
-						}
-						nKey := node.NodeKey
-						if !strings.HasPrefix(node.NodeKey, "nodekey:") {
-							nKey = "nodekey:" + node.NodeKey
-						}
+								continue
+							}
 
-						dKey := node.DiscoKey
-						if !strings.HasPrefix(node.DiscoKey, "discokey:") {
-							dKey = "discokey:" + node.DiscoKey
-						}
+							err = tx.Preload("Node").
+								Where("node_id = ? AND prefix = ?", node.ID, types.IPPrefix(prefix)).
+								First(&types.Route{}).
+								Error
+							if err == nil {
+								util.LogDB.Info().
+									Str("enabled_route", prefix.String()).
+									Msg("Route already migrated to new table, skipping")
 
-						err := tx.Exec(
-							"UPDATE nodes SET machine_key = @mKey, node_key = @nKey, disco_key = @dKey WHERE ID = @id",
-							sql.Named("mKey", mKey),
-							sql.Named("nKey", nKey),
-							sql.Named("dKey", dKey),
-							sql.Named("id", node.ID),
-						).Error
-						if err != nil {
-							return err
+								continue
+							}
+
+							route := types.Route{
+								NodeID:     node.ID,
+								Advertised: true,
+								Enabled:    true,
+								Prefix:     types.IPPrefix(prefix),
+							}
+							if err := tx.Create(&route).Error; err != nil {
+								util.LogDB.Error().Err(err).Msg("Error creating route")
+							} else {
+								util.LogDB.Info().
+									Uint64("node_id", route.NodeID).
+									Str("prefix", prefix.String()).
+									Msg("Route migrated")
+							}
 						}
 					}
 
-					if tx.Migrator().HasColumn(&types.Node{}, "enabled_routes") {
-						log.Info().
-							Msgf("Database has legacy enabled_routes column in node, migrating...")
+					err = tx.Migrator().DropColumn(&types.Node{}, "enabled_routes")
+					if err != nil {
+						util.LogDB.Error().
+							Err(err).
+							Msg("Error dropping enabled_routes column")
+					}
+				}
+
+				if tx.Migrator().HasColumn(&types.Node{}, "given_name") {
+					nodes := types.Nodes{}
+					if err := tx.Find(&nodes).Error; err != nil {
+						util.LogDB.Error().Err(err).Msg("Error accessing db")
+					}
+
+					for item, node := range nodes {
+						if node.GivenName == "" {
+							normalizedHostname, err := util.NormalizeToFQDNRulesConfigFromViper(
+								node.Hostname,
+							)
+							if err != nil {
+								util.LogDB.Error().
+									Caller().
+									Str("hostname", node.Hostname).
+									Err(err).
+									Msg("Failed to normalize node hostname in DB migration")
+							}
 
-						type NodeAux struct {
-							ID            uint64
-							EnabledRoutes types.IPPrefixes
+							err = tx.Model(nodes[item]).Updates(types.Node{
+								GivenName: normalizedHostname,
+							}).Error
+							if err != nil {
+								util.LogDB.Error().
+									Caller().
+									Str("hostname", node.Hostname).
+									Err(err).
+									Msg("Failed to save normalized node name in DB migration")
+							}
 						}
+					}
+				}
+
+				err = tx.AutoMigrate(&KV{})
+				if err != nil {
+					return err
+				}
 
-						nodesAux := []NodeAux{}
-						err := tx.Table("nodes").
-							Select("id, enabled_routes").
-							Scan(&nodesAux).
-							Error
+				err = tx.AutoMigrate(&types.PreAuthKey{})
+				if err != nil {
+					return err
+				}
+
+				err = tx.AutoMigrate(&types.PreAuthKeyACLTag{})
+				if err != nil {
+					return err
+				}
+
+				_ = tx.Migrator().DropTable("shared_machines")
+
+				err = tx.AutoMigrate(&types.APIKey{})
+				if err != nil {
+					return err
+				}
+
+				return nil
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return nil
+			},
+		},
+		{
+			// drop key-value table, it is not used, and has not contained
+			// useful data for a long time or ever.
+			ID: "202312101430",
+			Migrate: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable("kvs")
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return nil
+			},
+		},
+		{
+			// remove last_successful_update from node table,
+			// no longer used.
+			ID: "202402151347",
+			Migrate: func(tx *gorm.DB) error {
+				_ = tx.Migrator().DropColumn(&types.Node{}, "last_successful_update")
+				return nil
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return nil
+			},
+		},
+		{
+			// Replace column with IP address list with dedicated
+			// IP v4 and v6 column.
+			// Note that previously, the list _could_ contain more
+			// than two addresses, which should not really happen.
+			// In that case, the first occurence of each type will
+			// be kept.
+			ID: "2024041121742",
+			Migrate: func(tx *gorm.DB) error {
+				_ = tx.Migrator().AddColumn(&types.Node{}, "ipv4")
+				_ = tx.Migrator().AddColumn(&types.Node{}, "ipv6")
+
+				type node struct {
+					ID        uint64 `gorm:"column:id"`
+					Addresses string `gorm:"column:ip_addresses"`
+				}
+
+				var nodes []node
+
+				_ = tx.Raw("SELECT id, ip_addresses FROM nodes").Scan(&nodes).Error
+
+				for _, node := range nodes {
+					addrs := strings.Split(node.Addresses, ",")
+
+					if len(addrs) == 0 {
+						return fmt.Errorf("no addresses found for node(%d)", node.ID)
+					}
+
+					var v4 *netip.Addr
+					var v6 *netip.Addr
+
+					for _, addrStr := range addrs {
+						addr, err := netip.ParseAddr(addrStr)
 						if err != nil {
-							log.Fatal().Err(err).Msg("Error accessing db")
+							return fmt.Errorf("parsing IP for node(%d) from database: %w", node.ID, err)
 						}
-						for _, node := range nodesAux {
-							for _, prefix := range node.EnabledRoutes {
-								if err != nil {
-									log.Error().
-										Err(err).
-										Str("enabled_route", prefix.String()).
-										Msg("Error parsing enabled_route")
-
-									continue
-								}
-
-								err = tx.Preload("Node").
-									Where("node_id = ? AND prefix = ?", node.ID, types.IPPrefix(prefix)).
-									First(&types.Route{}).
-									Error
-								if err == nil {
-									log.Info().
-										Str("enabled_route", prefix.String()).
-										Msg("Route already migrated to new table, skipping")
-
-									continue
-								}
-
-								route := types.Route{
-									NodeID:     node.ID,
-									Advertised: true,
-									Enabled:    true,
-									Prefix:     types.IPPrefix(prefix),
-								}
-								if err := tx.Create(&route).Error; err != nil {
-									log.Error().Err(err).Msg("Error creating route")
-								} else {
-									log.Info().
-										Uint64("node_id", route.NodeID).
-										Str("prefix", prefix.String()).
-										Msg("Route migrated")
-								}
-							}
+
+						if addr.Is4() && v4 == nil {
+							v4 = &addr
 						}
 
-						err = tx.Migrator().DropColumn(&types.Node{}, "enabled_routes")
-						if err != nil {
-							log.Error().
-								Err(err).
-								Msg("Error dropping enabled_routes column")
+						if addr.Is6() && v6 == nil {
+							v6 = &addr
 						}
 					}
 
-					if tx.Migrator().HasColumn(&types.Node{}, "given_name") {
-						nodes := types.Nodes{}
-						if err := tx.Find(&nodes).Error; err != nil {
-							log.Error().Err(err).Msg("Error accessing db")
+					if v4 != nil {
+						err := tx.Model(&types.Node{}).Where("id = ?", node.ID).Update("ipv4", v4.String()).Error
+						if err != nil {
+							return fmt.Errorf("saving ip addresses to new columns: %w", err)
 						}
+					}
 
-						for item, node := range nodes {
-							if node.GivenName == "" {
-								normalizedHostname, err := util.NormalizeToFQDNRulesConfigFromViper(
-									node.Hostname,
-								)
-								if err != nil {
-									log.Error().
-										Caller().
-										Str("hostname", node.Hostname).
-										Err(err).
-										Msg("Failed to normalize node hostname in DB migration")
-								}
-
-								err = tx.Model(nodes[item]).Updates(types.Node{
-									GivenName: normalizedHostname,
-								}).Error
-								if err != nil {
-									log.Error().
-										Caller().
-										Str("hostname", node.Hostname).
-										Err(err).
-										Msg("Failed to save normalized node name in DB migration")
-								}
-							}
+					if v6 != nil {
+						err := tx.Model(&types.Node{}).Where("id = ?", node.ID).Update("ipv6", v6.String()).Error
+						if err != nil {
+							return fmt.Errorf("saving ip addresses to new columns: %w", err)
 						}
 					}
+				}
 
-					err = tx.AutoMigrate(&KV{})
-					if err != nil {
+				_ = tx.Migrator().DropColumn(&types.Node{}, "ip_addresses")
+
+				return nil
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return nil
+			},
+		},
+		{
+			// Add quarantined column to node table.
+			ID: "202406211105",
+			Migrate: func(tx *gorm.DB) error {
+				if tx.Migrator().HasColumn(&types.Node{}, "quarantined") {
+					return nil
+				}
+
+				return tx.Migrator().AddColumn(&types.Node{}, "quarantined")
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return nil
+			},
+		},
+		{
+			// Add posture attributes column to node table.
+			ID: "202406281020",
+			Migrate: func(tx *gorm.DB) error {
+				if tx.Migrator().HasColumn(&types.Node{}, "posture_attributes") {
+					return nil
+				}
+
+				return tx.Migrator().AddColumn(&types.Node{}, "posture_attributes")
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return nil
+			},
+		},
+		{
+			// Add the table of the custom DERP regions added through
+			// the API.
+			ID: "202407021315",
+			Migrate: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(&types.DERPRegion{})
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&types.DERPRegion{})
+			},
+		},
+		{
+			// Add the table of the versions of the policy, for the
+			// database policy mode.
+			ID: "202407081140",
+			Migrate: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(&types.Policy{})
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&types.Policy{})
+			},
+		},
+		{
+			// Add the table of the extra DNS records managed
+			// through the API.
+			ID: "202407101030",
+			Migrate: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(&types.DNSRecord{})
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&types.DNSRecord{})
+			},
+		},
+		{
+			// Add the table of the scoped nameservers managed
+			// through the API.
+			ID: "202407111415",
+			Migrate: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(&types.ScopedNameservers{})
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&types.ScopedNameservers{})
+			},
+		},
+		{
+			// Add the tables coordinating the instances
+			// sharing the database, with ha.enabled.
+			ID: "202407121000",
+			Migrate: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(
+					&types.HAInstance{},
+					&types.HALease{},
+					&types.HANodeConnection{},
+					&types.HAChange{},
+				)
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(
+					&types.HAInstance{},
+					&types.HALease{},
+					&types.HANodeConnection{},
+					&types.HAChange{},
+				)
+			},
+		},
+		{
+			// Add scopes column to api key table.
+			ID: "202407151200",
+			Migrate: func(tx *gorm.DB) error {
+				if tx.Migrator().HasColumn(&types.APIKey{}, "scopes") {
+					return nil
+				}
+
+				return tx.Migrator().AddColumn(&types.APIKey{}, "scopes")
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return nil
+			},
+		},
+		{
+			// Add the groups given by the OIDC provider to the user table.
+			ID: "202407161200",
+			Migrate: func(tx *gorm.DB) error {
+				if tx.Migrator().HasColumn(&types.User{}, "oidc_groups") {
+					return nil
+				}
+
+				return tx.Migrator().AddColumn(&types.User{}, "OIDCGroups")
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return nil
+			},
+		},
+		{
+			// Add the table of the OIDC sessions of the nodes.
+			ID: "202407171200",
+			Migrate: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(&types.OIDCSession{})
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&types.OIDCSession{})
+			},
+		},
+		{
+			// Add the deactivated column to the user table and the
+			// tables of the groups provisioned with SCIM.
+			ID: "202407181200",
+			Migrate: func(tx *gorm.DB) error {
+				if !tx.Migrator().HasColumn(&types.User{}, "deactivated") {
+					if err := tx.Migrator().AddColumn(&types.User{}, "Deactivated"); err != nil {
 						return err
 					}
+				}
 
-					err = tx.AutoMigrate(&types.PreAuthKey{})
-					if err != nil {
-						return err
+				return tx.AutoMigrate(&types.SCIMGroup{})
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&types.SCIMGroup{}, "scim_group_members")
+			},
+		},
+		{
+			// Add the usage limits and IP pools to the pre auth key
+			// table.
+			ID: "202407191200",
+			Migrate: func(tx *gorm.DB) error {
+				for _, field := range []string{"MaxUses", "UseCount", "ExpireAfterFirstUse", "IPPools"} {
+					if tx.Migrator().HasColumn(&types.PreAuthKey{}, field) {
+						continue
 					}
 
-					err = tx.AutoMigrate(&types.PreAuthKeyACLTag{})
-					if err != nil {
+					if err := tx.Migrator().AddColumn(&types.PreAuthKey{}, field); err != nil {
 						return err
 					}
+				}
 
-					_ = tx.Migrator().DropTable("shared_machines")
+				return nil
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return nil
+			},
+		},
+		{
+			// Add the awaiting approval column to the node table.
+			ID: "202407201200",
+			Migrate: func(tx *gorm.DB) error {
+				if tx.Migrator().HasColumn(&types.Node{}, "awaiting_approval") {
+					return nil
+				}
 
-					err = tx.AutoMigrate(&types.APIKey{})
-					if err != nil {
+				return tx.Migrator().AddColumn(&types.Node{}, "AwaitingApproval")
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return nil
+			},
+		},
+		{
+			// Add the tables of the tailnet key authority of network
+			// lock, and the key signature column to the node table.
+			ID: "202407211200",
+			Migrate: func(tx *gorm.DB) error {
+				if !tx.Migrator().HasColumn(&types.Node{}, "key_signature") {
+					if err := tx.Migrator().AddColumn(&types.Node{}, "KeySignature"); err != nil {
 						return err
 					}
+				}
 
+				return tx.AutoMigrate(&types.TKAState{}, &types.TKAUpdate{})
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&types.TKAState{}, &types.TKAUpdate{})
+			},
+		},
+		{
+			// Add the labels column to the node table.
+			ID: "202407221200",
+			Migrate: func(tx *gorm.DB) error {
+				if tx.Migrator().HasColumn(&types.Node{}, "labels") {
 					return nil
-				},
-				Rollback: func(tx *gorm.DB) error {
-					return nil
-				},
-			},
-			{
-				// drop key-value table, it is not used, and has not contained
-				// useful data for a long time or ever.
-				ID: "202312101430",
-				Migrate: func(tx *gorm.DB) error {
-					return tx.Migrator().DropTable("kvs")
-				},
-				Rollback: func(tx *gorm.DB) error {
-					return nil
-				},
-			},
-			{
-				// remove last_successful_update from node table,
-				// no longer used.
-				ID: "202402151347",
-				Migrate: func(tx *gorm.DB) error {
-					_ = tx.Migrator().DropColumn(&types.Node{}, "last_successful_update")
-					return nil
-				},
-				Rollback: func(tx *gorm.DB) error {
-					return nil
-				},
-			},
-			{
-				// Replace column with IP address list with dedicated
-				// IP v4 and v6 column.
-				// Note that previously, the list _could_ contain more
-				// than two addresses, which should not really happen.
-				// In that case, the first occurence of each type will
-				// be kept.
-				ID: "2024041121742",
-				Migrate: func(tx *gorm.DB) error {
-					_ = tx.Migrator().AddColumn(&types.Node{}, "ipv4")
-					_ = tx.Migrator().AddColumn(&types.Node{}, "ipv6")
-
-					type node struct {
-						ID        uint64 `gorm:"column:id"`
-						Addresses string `gorm:"column:ip_addresses"`
-					}
-
-					var nodes []node
+				}
 
-					_ = tx.Raw("SELECT id, ip_addresses FROM nodes").Scan(&nodes).Error
-
-					for _, node := range nodes {
-						addrs := strings.Split(node.Addresses, ",")
+				return tx.Migrator().AddColumn(&types.Node{}, "Labels")
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return nil
+			},
+		},
+		{
+			// Add the table of the client metrics sent by the nodes.
+			ID: "202407231200",
+			Migrate: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(&types.NodeClientMetrics{})
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&types.NodeClientMetrics{})
+			},
+		},
+		{
+			// Add the table of the nodes shared with other users.
+			ID: "202407301200",
+			Migrate: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(&types.NodeShare{})
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&types.NodeShare{})
+			},
+		},
+		{
+			// Add the tailnet column to the user table, for the
+			// multi-tailnet mode.
+			ID: "202408011200",
+			Migrate: func(tx *gorm.DB) error {
+				if tx.Migrator().HasColumn(&types.User{}, "tailnet") {
+					return nil
+				}
 
-						if len(addrs) == 0 {
-							return fmt.Errorf("no addresses found for node(%d)", node.ID)
-						}
+				return tx.Migrator().AddColumn(&types.User{}, "Tailnet")
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return nil
+			},
+		},
+		{
+			// Add the MAC authenticating the HA changes with the
+			// cluster keys.
+			ID: "202408021200",
+			Migrate: func(tx *gorm.DB) error {
+				if tx.Migrator().HasColumn(&types.HAChange{}, "mac") {
+					return nil
+				}
 
-						var v4 *netip.Addr
-						var v6 *netip.Addr
+				return tx.Migrator().AddColumn(&types.HAChange{}, "MAC")
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return nil
+			},
+		},
+	}
+}
 
-						for _, addrStr := range addrs {
-							addr, err := netip.ParseAddr(addrStr)
-							if err != nil {
-								return fmt.Errorf("parsing IP for node(%d) from database: %w", node.ID, err)
-							}
+// PendingMigrations connects to the database of the configuration, without
+// migrating it, and returns the IDs of the migrations headscale applies
+// on its next start. A SQLite database which does not exist is not
+// created.
+func PendingMigrations(cfg types.DatabaseConfig) ([]string, error) {
+	applied, err := AppliedMigrations(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-							if addr.Is4() && v4 == nil {
-								v4 = &addr
-							}
+	var pending []string
+	for _, id := range SchemaMigrationIDs(cfg) {
+		if !slices.Contains(applied, id) {
+			pending = append(pending, id)
+		}
+	}
 
-							if addr.Is6() && v6 == nil {
-								v6 = &addr
-							}
-						}
+	return pending, nil
+}
 
-						if v4 != nil {
-							err = tx.Model(&types.Node{}).Where("id = ?", node.ID).Update("ipv4", v4.String()).Error
-							if err != nil {
-								return fmt.Errorf("saving ip addresses to new columns: %w", err)
-							}
-						}
+// AppliedMigrations connects to the database of the configuration,
+// without migrating it, and returns the IDs of the migrations applied
+// to it. A SQLite database which does not exist is not created.
+func AppliedMigrations(cfg types.DatabaseConfig) ([]string, error) {
+	if cfg.Type == types.DatabaseSqlite {
+		if _, err := os.Stat(cfg.Sqlite.Path); err != nil {
+			return nil, fmt.Errorf("opening sqlite database: %w", err)
+		}
+	}
 
-						if v6 != nil {
-							err = tx.Model(&types.Node{}).Where("id = ?", node.ID).Update("ipv6", v6.String()).Error
-							if err != nil {
-								return fmt.Errorf("saving ip addresses to new columns: %w", err)
-							}
-						}
-					}
+	dbConn, err := openDB(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-					_ = tx.Migrator().DropColumn(&types.Node{}, "ip_addresses")
+	sqlDB, err := dbConn.DB()
+	if err != nil {
+		return nil, err
+	}
+	defer sqlDB.Close()
 
-					return nil
-				},
-				Rollback: func(tx *gorm.DB) error {
-					return nil
-				},
-			},
-		},
-	)
+	if err := sqlDB.Ping(); err != nil {
+		return nil, fmt.Errorf("connecting to database: %w", err)
+	}
 
-	if err = migrations.Migrate(); err != nil {
-		log.Fatal().Err(err).Msgf("Migration failed: %v", err)
+	var applied []string
+	if dbConn.Migrator().HasTable(gormigrate.DefaultOptions.TableName) {
+		err := dbConn.
+			Table(gormigrate.DefaultOptions.TableName).
+			Pluck(gormigrate.DefaultOptions.IDColumnName, &applied).Error
+		if err != nil {
+			return nil, fmt.Errorf("reading applied migrations: %w", err)
+		}
 	}
 
-	db := HSDatabase{
-		DB: dbConn,
+	return applied, nil
+}
 
-		baseDomain: baseDomain,
+// SchemaMigrationIDs returns the IDs of the migrations of the schema
+// known to this version of headscale, in the order they are applied.
+func SchemaMigrationIDs(cfg types.DatabaseConfig) []string {
+	migrations := schemaMigrations(nil, cfg)
+	ids := make([]string, 0, len(migrations))
+	for _, migration := range migrations {
+		ids = append(ids, migration.ID)
 	}
 
-	return &db, err
+	return ids
 }
 
 func openDB(cfg types.DatabaseConfig) (*gorm.DB, error) {
@@ -428,7 +793,7 @@ func openDB(cfg types.DatabaseConfig) (*gorm.DB, error) {
 			return nil, fmt.Errorf("creating directory for sqlite: %w", err)
 		}
 
-		log.Info().
+		util.LogDB.Info().
 			Str("database", types.DatabaseSqlite).
 			Str("path", cfg.Sqlite.Path).
 			Msg("Opening database")
@@ -476,7 +841,7 @@ func openDB(cfg types.DatabaseConfig) (*gorm.DB, error) {
 			cfg.Postgres.User,
 		)
 
-		log.Info().
+		util.LogDB.Info().
 			Str("database", types.DatabasePostgres).
 			Str("path", dbString).
 			Msg("Opening database")
@@ -497,21 +862,7 @@ func openDB(cfg types.DatabaseConfig) (*gorm.DB, error) {
 			dbString += fmt.Sprintf(" password=%s", cfg.Postgres.Pass)
 		}
 
-		db, err := gorm.Open(postgres.Open(dbString), &gorm.Config{
-			Logger: dbLogger,
-		})
-		if err != nil {
-			return nil, err
-		}
-
-		sqlDB, _ := db.DB()
-		sqlDB.SetMaxIdleConns(cfg.Postgres.MaxIdleConnections)
-		sqlDB.SetMaxOpenConns(cfg.Postgres.MaxOpenConnections)
-		sqlDB.SetConnMaxIdleTime(
-			time.Duration(cfg.Postgres.ConnMaxIdleTimeSecs) * time.Second,
-		)
-
-		return db, nil
+		return openPostgres(dbString, cfg.Postgres, dbLogger)
 	}
 
 	return nil, fmt.Errorf(
@@ -521,6 +872,52 @@ func openDB(cfg types.DatabaseConfig) (*gorm.DB, error) {
 	)
 }
 
+// openPostgres connects to the postgres database of the DSN, with the
+// pool and statement timeout of the config.
+func openPostgres(
+	dsn string,
+	cfg types.PostgresConfig,
+	dbLogger logger.Interface,
+) (*gorm.DB, error) {
+	connConfig, err := postgresConnConfig(dsn, cfg.StatementTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	sqlDB := stdlib.OpenDB(*connConfig)
+	sqlDB.SetMaxIdleConns(cfg.MaxIdleConnections)
+	sqlDB.SetMaxOpenConns(cfg.MaxOpenConnections)
+	sqlDB.SetConnMaxIdleTime(
+		time.Duration(cfg.ConnMaxIdleTimeSecs) * time.Second,
+	)
+
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{
+		Logger: dbLogger,
+	})
+	if err != nil {
+		sqlDB.Close()
+
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// postgresConnConfig parses the DSN, in the URL or the key/value
+// format, and sets the statement timeout of the connections.
+func postgresConnConfig(dsn string, statementTimeout time.Duration) (*pgx.ConnConfig, error) {
+	connConfig, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("parsing postgres connection string: %w", err)
+	}
+
+	if statementTimeout > 0 {
+		connConfig.RuntimeParams["statement_timeout"] = strconv.FormatInt(statementTimeout.Milliseconds(), 10)
+	}
+
+	return connConfig, nil
+}
+
 func (hsdb *HSDatabase) PingDB(ctx context.Context) error {
 	ctx, cancel := context.WithTimeout(ctx, time.Second)
 	defer cancel()
@@ -533,6 +930,12 @@ func (hsdb *HSDatabase) PingDB(ctx context.Context) error {
 }
 
 func (hsdb *HSDatabase) Close() error {
+	if hsdb.replica != nil {
+		if replica, err := hsdb.replica.DB(); err == nil {
+			replica.Close()
+		}
+	}
+
 	db, err := hsdb.DB.DB()
 	if err != nil {
 		return err
@@ -541,8 +944,20 @@ func (hsdb *HSDatabase) Close() error {
 	return db.Close()
 }
 
+// ReadDB returns the read replica, or the primary database without
+// one. The replica can lag behind the writes, it is only used for the
+// heavy reads which can be slightly stale, like listing the nodes.
+func (hsdb *HSDatabase) ReadDB() *gorm.DB {
+	if hsdb.replica != nil {
+		return hsdb.replica
+	}
+
+	return hsdb.DB
+}
+
+// Read runs fn in a read transaction on the read replica, if any.
 func (hsdb *HSDatabase) Read(fn func(rx *gorm.DB) error) error {
-	rx := hsdb.DB.Begin()
+	rx := hsdb.ReadDB().Begin()
 	defer rx.Rollback()
 	return fn(rx)
 }
@@ -559,17 +974,20 @@ func Read[T any](db *gorm.DB, fn func(rx *gorm.DB) (T, error)) (T, error) {
 }
 
 func (hsdb *HSDatabase) Write(fn func(tx *gorm.DB) error) error {
-	tx := hsdb.DB.Begin()
-	defer tx.Rollback()
-	if err := fn(tx); err != nil {
-		return err
-	}
+	_, err := Write(hsdb.DB, func(tx *gorm.DB) (struct{}, error) {
+		return struct{}{}, fn(tx)
+	})
 
-	return tx.Commit().Error
+	return err
 }
 
 func Write[T any](db *gorm.DB, fn func(tx *gorm.DB) (T, error)) (T, error) {
-	tx := db.Begin()
+	// The nodes written in the transaction are marked again in the
+	// store once it is committed.
+	writes := &nodeStoreWrites{}
+	defer nodeStoreOf(db).committed(writes)
+
+	tx := db.WithContext(context.WithValue(db.Statement.Context, nodeStoreWritesKey{}, writes)).Begin()
 	defer tx.Rollback()
 	ret, err := fn(tx)
 	if err != nil {
@@ -578,3 +996,8 @@ func Write[T any](db *gorm.DB, fn func(tx *gorm.DB) (T, error)) (T, error) {
 	}
 	return ret, tx.Commit().Error
 }
+
+// NodeStore returns the in-memory store of the nodes.
+func (hsdb *HSDatabase) NodeStore() *NodeStore {
+	return hsdb.nodes
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gorm.io/gorm"
+	"tailscale.com/tailcfg"
+)
+
+func (hsdb *HSDatabase) GetCustomDERPRegions() ([]*tailcfg.DERPRegion, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) ([]*tailcfg.DERPRegion, error) {
+		return GetCustomDERPRegions(rx)
+	})
+}
+
+// GetCustomDERPRegions returns the custom DERP regions stored in the
+// database, sorted by ID.
+func GetCustomDERPRegions(tx *gorm.DB) ([]*tailcfg.DERPRegion, error) {
+	var stored []types.DERPRegion
+	if err := tx.Order("region_id").Find(&stored).Error; err != nil {
+		return nil, err
+	}
+
+	regions := make([]*tailcfg.DERPRegion, len(stored))
+	for index := range stored {
+		region := tailcfg.DERPRegion(stored[index].Region)
+		regions[index] = &region
+	}
+
+	return regions, nil
+}
+
+func (hsdb *HSDatabase) SetCustomDERPRegions(regions []*tailcfg.DERPRegion) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return SetCustomDERPRegions(tx, regions)
+	})
+}
+
+// SetCustomDERPRegions replaces the custom DERP regions stored in the
+// database.
+func SetCustomDERPRegions(tx *gorm.DB, regions []*tailcfg.DERPRegion) error {
+	if err := tx.Where("1 = 1").Delete(&types.DERPRegion{}).Error; err != nil {
+		return err
+	}
+
+	for _, region := range regions {
+		stored := types.DERPRegion{
+			RegionID: region.RegionID,
+			Region:   types.DERPRegionData(*region),
+		}
+		if err := tx.Create(&stored).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
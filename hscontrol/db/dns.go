@@ -0,0 +1,141 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrDNSRecordExists   = errors.New("DNS record already exists")
+	ErrDNSRecordNotFound = errors.New("DNS record not found")
+
+	ErrScopedNameserversNotFound = errors.New("scoped nameservers not found")
+)
+
+func (hsdb *HSDatabase) ListDNSRecords() ([]types.DNSRecord, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) ([]types.DNSRecord, error) {
+		return ListDNSRecords(rx)
+	})
+}
+
+// ListDNSRecords returns the extra DNS records, sorted by name.
+func ListDNSRecords(tx *gorm.DB) ([]types.DNSRecord, error) {
+	var records []types.DNSRecord
+	if err := tx.Order("name, id").Find(&records).Error; err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func (hsdb *HSDatabase) CreateDNSRecord(record types.DNSRecord) (*types.DNSRecord, error) {
+	return Write(hsdb.DB, func(tx *gorm.DB) (*types.DNSRecord, error) {
+		return CreateDNSRecord(tx, record)
+	})
+}
+
+// CreateDNSRecord validates and stores an extra DNS record, a record
+// with the same name, type and value must not exist.
+func CreateDNSRecord(tx *gorm.DB, record types.DNSRecord) (*types.DNSRecord, error) {
+	if err := record.Validate(); err != nil {
+		return nil, err
+	}
+
+	var count int64
+	err := tx.Model(&types.DNSRecord{}).
+		Where("name = ? AND type = ? AND value = ?", record.Name, record.Type, record.Value).
+		Count(&count).Error
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrDNSRecordExists
+	}
+
+	if err := tx.Create(&record).Error; err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+func (hsdb *HSDatabase) DeleteDNSRecord(id uint64) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return DeleteDNSRecord(tx, id)
+	})
+}
+
+// DeleteDNSRecord deletes an extra DNS record.
+func DeleteDNSRecord(tx *gorm.DB, id uint64) error {
+	result := tx.Delete(&types.DNSRecord{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrDNSRecordNotFound
+	}
+
+	return nil
+}
+
+func (hsdb *HSDatabase) ListScopedNameservers() ([]types.ScopedNameservers, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) ([]types.ScopedNameservers, error) {
+		return ListScopedNameservers(rx)
+	})
+}
+
+// ListScopedNameservers returns the scoped nameservers, sorted by
+// domain.
+func ListScopedNameservers(tx *gorm.DB) ([]types.ScopedNameservers, error) {
+	var nameservers []types.ScopedNameservers
+	if err := tx.Order("domain, id").Find(&nameservers).Error; err != nil {
+		return nil, err
+	}
+
+	return nameservers, nil
+}
+
+func (hsdb *HSDatabase) CreateScopedNameservers(
+	nameservers types.ScopedNameservers,
+) (*types.ScopedNameservers, error) {
+	return Write(hsdb.DB, func(tx *gorm.DB) (*types.ScopedNameservers, error) {
+		return CreateScopedNameservers(tx, nameservers)
+	})
+}
+
+// CreateScopedNameservers validates and stores scoped nameservers.
+func CreateScopedNameservers(
+	tx *gorm.DB,
+	nameservers types.ScopedNameservers,
+) (*types.ScopedNameservers, error) {
+	if err := nameservers.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Create(&nameservers).Error; err != nil {
+		return nil, err
+	}
+
+	return &nameservers, nil
+}
+
+func (hsdb *HSDatabase) DeleteScopedNameservers(id uint64) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return DeleteScopedNameservers(tx, id)
+	})
+}
+
+// DeleteScopedNameservers deletes scoped nameservers.
+func DeleteScopedNameservers(tx *gorm.DB, id uint64) error {
+	result := tx.Delete(&types.ScopedNameservers{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrScopedNameserversNotFound
+	}
+
+	return nil
+}
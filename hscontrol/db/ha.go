@@ -0,0 +1,178 @@
+package db
+
+import (
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// HeartbeatInstance records that the instance is alive.
+func HeartbeatInstance(tx *gorm.DB, instanceID string, now time.Time) error {
+	return tx.Save(&types.HAInstance{ID: instanceID, LastSeen: now}).Error
+}
+
+// AcquireLease takes, or renews, the lease for the holder until
+// now+ttl, and reports if the holder has it. A lease held by another
+// instance can only be taken once it has expired.
+func AcquireLease(tx *gorm.DB, name string, holder string, now time.Time, ttl time.Duration) (bool, error) {
+	res := tx.Model(&types.HALease{}).
+		Where("name = ? AND (holder = ? OR expires_at < ?)", name, holder, now).
+		Updates(map[string]any{"holder": holder, "expires_at": now.Add(ttl)})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected > 0 {
+		return true, nil
+	}
+
+	// The lease does not exist yet, or another instance holds it.
+	res = tx.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&types.HALease{Name: name, Holder: holder, ExpiresAt: now.Add(ttl)})
+	if res.Error != nil {
+		return false, res.Error
+	}
+
+	return res.RowsAffected > 0, nil
+}
+
+// ReleaseLease gives up the lease if the holder has it, so another
+// instance can take it without waiting for it to expire.
+func ReleaseLease(tx *gorm.DB, name string, holder string) error {
+	return tx.Where("name = ? AND holder = ?", name, holder).Delete(&types.HALease{}).Error
+}
+
+// UpdateNodeConnections records the nodes connected to the instance
+// and disconnected from it since the last update.
+func UpdateNodeConnections(
+	tx *gorm.DB,
+	instanceID string,
+	connected []types.NodeID,
+	disconnected []types.NodeID,
+) error {
+	if len(disconnected) > 0 {
+		err := tx.Where("instance_id = ? AND node_id IN ?", instanceID, disconnected).
+			Delete(&types.HANodeConnection{}).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, nodeID := range connected {
+		err := tx.Save(&types.HANodeConnection{NodeID: nodeID, InstanceID: instanceID}).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RemoteConnectedNodes returns the nodes connected to the other
+// instances which have been seen since the given time.
+func RemoteConnectedNodes(tx *gorm.DB, instanceID string, aliveSince time.Time) ([]types.NodeID, error) {
+	var nodeIDs []types.NodeID
+	err := tx.Model(&types.HANodeConnection{}).
+		Where("instance_id <> ?", instanceID).
+		Where("instance_id IN (?)", tx.Model(&types.HAInstance{}).Select("id").Where("last_seen >= ?", aliveSince)).
+		Order("node_id").
+		Pluck("node_id", &nodeIDs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return nodeIDs, nil
+}
+
+// DeleteDeadInstances removes the instances which have not been seen
+// since the given time, and the connections of their nodes. It returns
+// the nodes which were connected to them.
+func DeleteDeadInstances(tx *gorm.DB, aliveSince time.Time) ([]types.NodeID, error) {
+	var dead []string
+	err := tx.Model(&types.HAInstance{}).
+		Where("last_seen < ?", aliveSince).
+		Pluck("id", &dead).Error
+	if err != nil || len(dead) == 0 {
+		return nil, err
+	}
+
+	var nodeIDs []types.NodeID
+	err = tx.Model(&types.HANodeConnection{}).
+		Where("instance_id IN ?", dead).
+		Order("node_id").
+		Pluck("node_id", &nodeIDs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Where("instance_id IN ?", dead).Delete(&types.HANodeConnection{}).Error; err != nil {
+		return nil, err
+	}
+
+	if err := tx.Where("id IN ?", dead).Delete(&types.HAInstance{}).Error; err != nil {
+		return nil, err
+	}
+
+	return nodeIDs, nil
+}
+
+// Now returns the time of the database, the instances compare the
+// times of the changes they publish with it rather than with their own
+// clocks, which can be skewed. SQLite is only used by one instance, its
+// time is the one of the host.
+func Now(tx *gorm.DB) (time.Time, error) {
+	if tx.Dialector.Name() != "postgres" {
+		return time.Now(), nil
+	}
+
+	var now time.Time
+	if err := tx.Raw("SELECT now()").Scan(&now).Error; err != nil {
+		return time.Time{}, err
+	}
+
+	return now, nil
+}
+
+// PublishChange stores a change for the other instances, created at the
+// time of the database.
+func PublishChange(tx *gorm.DB, change *types.HAChange) error {
+	now, err := Now(tx)
+	if err != nil {
+		return err
+	}
+	change.CreatedAt = now
+
+	return tx.Create(change).Error
+}
+
+// ListChanges returns the changes of the other instances created in the
+// window before the time of the database, oldest first.
+func ListChanges(tx *gorm.DB, instanceID string, window time.Duration) ([]types.HAChange, error) {
+	now, err := Now(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []types.HAChange
+	err = tx.
+		Where("instance_id <> ? AND created_at >= ?", instanceID, now.Add(-window)).
+		Order("id").
+		Find(&changes).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// DeleteChangesOlderThan removes the changes created before the time of
+// the database minus the given age.
+func DeleteChangesOlderThan(tx *gorm.DB, age time.Duration) error {
+	now, err := Now(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Where("created_at < ?", now.Add(-age)).Delete(&types.HAChange{}).Error
+}
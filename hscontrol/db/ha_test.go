@@ -0,0 +1,102 @@
+package db
+
+import (
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gopkg.in/check.v1"
+)
+
+func (*Suite) TestHALease(c *check.C) {
+	now := time.Now()
+	ttl := 10 * time.Second
+
+	held, err := AcquireLease(db.DB, "leader", "a", now, ttl)
+	c.Assert(err, check.IsNil)
+	c.Assert(held, check.Equals, true)
+
+	// Only the holder can renew the lease before it expires.
+	held, err = AcquireLease(db.DB, "leader", "b", now, ttl)
+	c.Assert(err, check.IsNil)
+	c.Assert(held, check.Equals, false)
+
+	held, err = AcquireLease(db.DB, "leader", "a", now.Add(5*time.Second), ttl)
+	c.Assert(err, check.IsNil)
+	c.Assert(held, check.Equals, true)
+
+	// Once expired, another instance takes it over.
+	held, err = AcquireLease(db.DB, "leader", "b", now.Add(16*time.Second), ttl)
+	c.Assert(err, check.IsNil)
+	c.Assert(held, check.Equals, true)
+
+	held, err = AcquireLease(db.DB, "leader", "a", now.Add(17*time.Second), ttl)
+	c.Assert(err, check.IsNil)
+	c.Assert(held, check.Equals, false)
+
+	// A released lease can be taken right away.
+	c.Assert(ReleaseLease(db.DB, "leader", "b"), check.IsNil)
+	held, err = AcquireLease(db.DB, "leader", "a", now.Add(18*time.Second), ttl)
+	c.Assert(err, check.IsNil)
+	c.Assert(held, check.Equals, true)
+}
+
+func (*Suite) TestHANodeConnections(c *check.C) {
+	now := time.Now()
+
+	c.Assert(HeartbeatInstance(db.DB, "a", now), check.IsNil)
+	c.Assert(HeartbeatInstance(db.DB, "b", now), check.IsNil)
+
+	c.Assert(UpdateNodeConnections(db.DB, "a", []types.NodeID{1, 2}, nil), check.IsNil)
+	c.Assert(UpdateNodeConnections(db.DB, "b", []types.NodeID{3}, nil), check.IsNil)
+
+	remote, err := RemoteConnectedNodes(db.DB, "a", now.Add(-time.Minute))
+	c.Assert(err, check.IsNil)
+	c.Assert(remote, check.DeepEquals, []types.NodeID{3})
+
+	// Node 2 moves to the other instance.
+	c.Assert(UpdateNodeConnections(db.DB, "a", nil, []types.NodeID{2}), check.IsNil)
+	c.Assert(UpdateNodeConnections(db.DB, "b", []types.NodeID{2}, nil), check.IsNil)
+
+	remote, err = RemoteConnectedNodes(db.DB, "b", now.Add(-time.Minute))
+	c.Assert(err, check.IsNil)
+	c.Assert(remote, check.DeepEquals, []types.NodeID{1})
+
+	// Instance a stops sending heartbeats, its nodes are offline.
+	c.Assert(HeartbeatInstance(db.DB, "b", now.Add(time.Minute)), check.IsNil)
+
+	remote, err = RemoteConnectedNodes(db.DB, "b", now.Add(30*time.Second))
+	c.Assert(err, check.IsNil)
+	c.Assert(remote, check.HasLen, 0)
+
+	dead, err := DeleteDeadInstances(db.DB, now.Add(30*time.Second))
+	c.Assert(err, check.IsNil)
+	c.Assert(dead, check.DeepEquals, []types.NodeID{1})
+
+	remote, err = RemoteConnectedNodes(db.DB, "a", now.Add(30*time.Second))
+	c.Assert(err, check.IsNil)
+	c.Assert(remote, check.DeepEquals, []types.NodeID{2, 3})
+}
+
+func (*Suite) TestHAChanges(c *check.C) {
+	c.Assert(PublishChange(db.DB, &types.HAChange{InstanceID: "a", Update: "1"}), check.IsNil)
+	c.Assert(PublishChange(db.DB, &types.HAChange{InstanceID: "b", Update: "2", NodeID: 4}), check.IsNil)
+	// The time set by the publisher, which can have a skewed clock, is
+	// replaced with the one of the database.
+	c.Assert(PublishChange(db.DB, &types.HAChange{
+		InstanceID: "b",
+		Update:     "3",
+		CreatedAt:  time.Now().Add(-time.Hour),
+	}), check.IsNil)
+
+	changes, err := ListChanges(db.DB, "a", time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(changes, check.HasLen, 2)
+	c.Assert(changes[0].Update, check.Equals, "2")
+	c.Assert(changes[0].NodeID, check.Equals, types.NodeID(4))
+	c.Assert(changes[1].Update, check.Equals, "3")
+
+	c.Assert(DeleteChangesOlderThan(db.DB, -time.Second), check.IsNil)
+	changes, err = ListChanges(db.DB, "a", time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(changes, check.HasLen, 0)
+}
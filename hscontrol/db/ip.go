@@ -9,9 +9,9 @@ import (
 	"net/netip"
 	"sync"
 
+	"github.com/juanfont/headscale/hscontrol/policy"
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
-	"github.com/rs/zerolog/log"
 	"go4.org/netipx"
 	"gorm.io/gorm"
 )
@@ -34,6 +34,13 @@ type IPAllocator struct {
 	// strategy used for handing out IP addresses.
 	strategy types.IPAllocationStrategy
 
+	// pools of the addresses of some of the nodes, see NodePools.
+	pools []types.IPPool
+
+	// tailnets are the prefixes of the tailnets of the multi-tailnet
+	// mode, the addresses in them are only for the nodes of the tailnet.
+	tailnets []netip.Prefix
+
 	// Set of all IPs handed out.
 	// This might not be in sync with the database,
 	// but it is more conservative. If saves to the
@@ -44,35 +51,47 @@ type IPAllocator struct {
 
 // NewIPAllocator returns a new IPAllocator singleton which
 // can be used to hand out unique IP addresses within the
-// provided IPv4 and IPv6 prefix. It needs to be created
-// when headscale starts and needs to finish its read
-// transaction before any writes to the database occur.
+// provided IPv4 and IPv6 prefix, or within the pools of
+// the nodes. It needs to be created when headscale starts
+// and needs to finish its read transaction before any
+// writes to the database occur.
 func NewIPAllocator(
 	db *HSDatabase,
 	prefix4, prefix6 *netip.Prefix,
 	strategy types.IPAllocationStrategy,
+	pools []types.IPPool,
 ) (*IPAllocator, error) {
 	ret := IPAllocator{
 		prefix4: prefix4,
 		prefix6: prefix6,
 
 		strategy: strategy,
+		pools:    pools,
+	}
+
+	for _, pool := range pools {
+		if pool.Tailnet == "" {
+			continue
+		}
+		for _, prefix := range []*netip.Prefix{pool.Prefix4, pool.Prefix6} {
+			if prefix != nil {
+				ret.tailnets = append(ret.tailnets, *prefix)
+			}
+		}
 	}
 
 	var v4s []sql.NullString
 	var v6s []sql.NullString
 
 	if db != nil {
-		err := db.Read(func(rx *gorm.DB) error {
-			return rx.Model(&types.Node{}).Pluck("ipv4", &v4s).Error
-		})
+		// The addresses are read from the primary database, the replica
+		// might not have all of them yet.
+		err := db.DB.Model(&types.Node{}).Pluck("ipv4", &v4s).Error
 		if err != nil {
 			return nil, fmt.Errorf("reading IPv4 addresses from database: %w", err)
 		}
 
-		err = db.Read(func(rx *gorm.DB) error {
-			return rx.Model(&types.Node{}).Pluck("ipv6", &v6s).Error
-		})
+		err = db.DB.Model(&types.Node{}).Pluck("ipv6", &v6s).Error
 		if err != nil {
 			return nil, fmt.Errorf("reading IPv6 addresses from database: %w", err)
 		}
@@ -130,39 +149,210 @@ func NewIPAllocator(
 }
 
 func (i *IPAllocator) Next() (*netip.Addr, *netip.Addr, error) {
+	return i.NextInPools(nil, nil)
+}
+
+// NextInPools is like Next, but the addresses of the families with a
+// pool are taken from the pool instead of the whole prefix.
+func (i *IPAllocator) NextInPools(pool4, pool6 *netip.Prefix) (*netip.Addr, *netip.Addr, error) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
+	if err := i.checkPools(pool4, pool6); err != nil {
+		return nil, nil, err
+	}
+
 	var err error
 	var ret4 *netip.Addr
 	var ret6 *netip.Addr
 
 	if i.prefix4 != nil {
-		ret4, err = i.next(i.prev4, i.prefix4)
+		if pool4 != nil {
+			ret4, err = i.next(pool4.Addr().Prev(), pool4)
+		} else {
+			ret4, err = i.next(i.prev4, i.prefix4)
+		}
 		if err != nil {
 			return nil, nil, fmt.Errorf("allocating IPv4 address: %w", err)
 		}
-		i.prev4 = *ret4
+		if pool4 == nil {
+			i.prev4 = *ret4
+		}
 	}
 
 	if i.prefix6 != nil {
-		ret6, err = i.next(i.prev6, i.prefix6)
+		if pool6 != nil {
+			ret6, err = i.next(pool6.Addr().Prev(), pool6)
+		} else {
+			ret6, err = i.next(i.prev6, i.prefix6)
+		}
 		if err != nil {
 			return nil, nil, fmt.Errorf("allocating IPv6 address: %w", err)
 		}
-		i.prev6 = *ret6
+		if pool6 == nil {
+			i.prev6 = *ret6
+		}
 	}
 
 	return ret4, ret6, nil
 }
 
+// NextForNode is like NextInPools, with the pools of the node.
+func (i *IPAllocator) NextForNode(pol *policy.ACLPolicy, node *types.Node) (*netip.Addr, *netip.Addr, error) {
+	pool4, pool6, err := i.NodePools(pol, node)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return i.NextInPools(pool4, pool6)
+}
+
+// NodePools returns the pools the addresses of the node are allocated
+// from, nil for the families without a pool: the IP pools of its pre
+// auth key, or else the first pool of the configuration applying to its
+// user or its tags. The nodes of a tailnet of the multi-tailnet mode
+// only get addresses in the prefixes of the tailnet, the IP pools of
+// their pre auth key must be in them.
+func (i *IPAllocator) NodePools(pol *policy.ACLPolicy, node *types.Node) (*netip.Prefix, *netip.Prefix, error) {
+	var pool4, pool6 *netip.Prefix
+
+	tailnet := i.tailnetPool(node.User.Tailnet)
+	if tailnet != nil {
+		pool4, pool6 = tailnet.Prefix4, tailnet.Prefix6
+	} else {
+		var tags []string
+		if pol != nil {
+			tags, _ = pol.TagsOfNode(node)
+		}
+		tags = append(tags, node.ForcedTags...)
+
+		for index := range i.pools {
+			if i.pools[index].Tailnet == "" && i.pools[index].Applies(node.User.Name, tags) {
+				pool4, pool6 = i.pools[index].Prefix4, i.pools[index].Prefix6
+
+				break
+			}
+		}
+	}
+
+	if node.AuthKey != nil {
+		key4, key6, err := types.ParseIPPools(node.AuthKey.IPPools)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing IP pools of the pre auth key: %w", err)
+		}
+
+		// The tailnet may only have a prefix for one family, its nodes
+		// then get the addresses of the other one from the prefix of
+		// the configuration.
+		if tailnet != nil {
+			prefix4, prefix6 := i.prefix4, i.prefix6
+			if pool4 != nil {
+				prefix4 = pool4
+			}
+			if pool6 != nil {
+				prefix6 = pool6
+			}
+
+			if err := checkPoolsIn(key4, key6, prefix4, prefix6); err != nil {
+				return nil, nil, fmt.Errorf("IP pools of the pre auth key in tailnet %s: %w", tailnet.Tailnet, err)
+			}
+		}
+
+		if key4 != nil {
+			pool4 = key4
+		}
+		if key6 != nil {
+			pool6 = key6
+		}
+	}
+
+	return pool4, pool6, nil
+}
+
+// tailnetPool returns the pool of the tailnet of the multi-tailnet mode,
+// nil for the default tailnet.
+func (i *IPAllocator) tailnetPool(tailnet string) *types.IPPool {
+	if tailnet == "" {
+		return nil
+	}
+
+	for index := range i.pools {
+		if i.pools[index].Tailnet == tailnet {
+			return &i.pools[index]
+		}
+	}
+
+	return nil
+}
+
+// otherTailnet returns the prefix of a tailnet of the multi-tailnet mode
+// in which ip is, if addresses are allocated from a larger prefix, such
+// as the prefix of the configuration.
+func (i *IPAllocator) otherTailnet(ip netip.Addr, prefix *netip.Prefix) *netip.Prefix {
+	for index, tailnet := range i.tailnets {
+		if tailnet.Bits() > prefix.Bits() && tailnet.Contains(ip) {
+			return &i.tailnets[index]
+		}
+	}
+
+	return nil
+}
+
+var ErrIPPoolOutsidePrefix = errors.New("IP pool is not in the prefixes of the tailnet")
+
+// CheckPools checks that the pools are in the prefixes the addresses
+// are allocated from.
+func (i *IPAllocator) CheckPools(pool4, pool6 *netip.Prefix) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.checkPools(pool4, pool6)
+}
+
+func (i *IPAllocator) checkPools(pool4, pool6 *netip.Prefix) error {
+	return checkPoolsIn(pool4, pool6, i.prefix4, i.prefix6)
+}
+
+// checkPoolsIn checks that the pools are in the prefixes of their
+// family.
+func checkPoolsIn(pool4, pool6, prefix4, prefix6 *netip.Prefix) error {
+	for _, pair := range []struct{ pool, prefix *netip.Prefix }{
+		{pool4, prefix4},
+		{pool6, prefix6},
+	} {
+		if pair.pool == nil {
+			continue
+		}
+
+		if pair.prefix == nil ||
+			pair.pool.Bits() < pair.prefix.Bits() ||
+			!pair.prefix.Contains(pair.pool.Addr()) {
+			return fmt.Errorf("%w: %s", ErrIPPoolOutsidePrefix, pair.pool)
+		}
+	}
+
+	return nil
+}
+
 var ErrCouldNotAllocateIP = errors.New("failed to allocate IP")
 
-func (i *IPAllocator) nextLocked(prev netip.Addr, prefix *netip.Prefix) (*netip.Addr, error) {
+// nextIn returns the next address in the pool, or in the prefix after
+// prev if there is no pool.
+func (i *IPAllocator) nextIn(pool *netip.Prefix, prev *netip.Addr, prefix *netip.Prefix) (*netip.Addr, error) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	return i.next(prev, prefix)
+	if pool != nil {
+		return i.next(pool.Addr().Prev(), pool)
+	}
+
+	ip, err := i.next(*prev, prefix)
+	if err != nil {
+		return nil, err
+	}
+	*prev = *ip
+
+	return ip, nil
 }
 
 func (i *IPAllocator) next(prev netip.Addr, prefix *netip.Prefix) (*netip.Addr, error) {
@@ -191,6 +381,22 @@ func (i *IPAllocator) next(prev netip.Addr, prefix *netip.Prefix) (*netip.Addr,
 			return nil, ErrCouldNotAllocateIP
 		}
 
+		// The addresses of the tailnets are skipped at once, their
+		// prefixes can be large.
+		if tailnet := i.otherTailnet(ip, prefix); tailnet != nil {
+			switch i.strategy {
+			case types.IPAllocationStrategySequential:
+				ip = netipx.PrefixLastIP(*tailnet).Next()
+			case types.IPAllocationStrategyRandom:
+				ip, err = randomNext(*prefix)
+				if err != nil {
+					return nil, fmt.Errorf("getting random IP: %w", err)
+				}
+			}
+
+			continue
+		}
+
 		// Check if the IP has already been allocated.
 		if set.Contains(ip) {
 			switch i.strategy {
@@ -226,6 +432,11 @@ func randomNext(pfx netip.Prefix) (netip.Addr, error) {
 	// after.
 	tempMax := big.NewInt(0).Sub(&to, &from)
 
+	// A pool of a single address.
+	if tempMax.Sign() == 0 {
+		return fromIP, nil
+	}
+
 	out, err := rand.Int(rand.Reader, tempMax)
 	if err != nil {
 		return netip.Addr{}, fmt.Errorf("generating random IP: %w", err)
@@ -258,7 +469,9 @@ func randomNext(pfx netip.Prefix) (netip.Addr, error) {
 // it will be added.
 // If a prefix type has been removed (IPv4 or IPv6), it
 // will remove the IPs in that family from the node.
-func (db *HSDatabase) BackfillNodeIPs(i *IPAllocator) ([]string, error) {
+// Nodes with an IP outside of their pool are given a new
+// one in the pool.
+func (db *HSDatabase) BackfillNodeIPs(i *IPAllocator, pol *policy.ACLPolicy) ([]string, error) {
 	var err error
 	var ret []string
 	err = db.Write(func(tx *gorm.DB) error {
@@ -266,7 +479,7 @@ func (db *HSDatabase) BackfillNodeIPs(i *IPAllocator) ([]string, error) {
 			return errors.New("backfilling IPs: ip allocator was nil")
 		}
 
-		log.Trace().Msgf("starting to backfill IPs")
+		util.LogDB.Trace().Msgf("starting to backfill IPs")
 
 		nodes, err := ListNodes(tx)
 		if err != nil {
@@ -274,12 +487,22 @@ func (db *HSDatabase) BackfillNodeIPs(i *IPAllocator) ([]string, error) {
 		}
 
 		for _, node := range nodes {
-			log.Trace().Uint64("node.id", node.ID.Uint64()).Msg("checking if need backfill")
+			// The addresses of a node are allocated when it is approved.
+			if node.AwaitingApproval {
+				continue
+			}
+
+			util.LogDB.Trace().Uint64("node.id", node.ID.Uint64()).Msg("checking if need backfill")
+
+			pool4, pool6, err := i.NodePools(pol, node)
+			if err != nil {
+				return fmt.Errorf("getting IP pools of node(%d): %w", node.ID, err)
+			}
 
 			changed := false
 			// IPv4 prefix is set, but node ip is missing, alloc
 			if i.prefix4 != nil && node.IPv4 == nil {
-				ret4, err := i.nextLocked(i.prev4, i.prefix4)
+				ret4, err := i.nextIn(pool4, &i.prev4, i.prefix4)
 				if err != nil {
 					return fmt.Errorf("failed to allocate ipv4 for node(%d): %w", node.ID, err)
 				}
@@ -291,7 +514,7 @@ func (db *HSDatabase) BackfillNodeIPs(i *IPAllocator) ([]string, error) {
 
 			// IPv6 prefix is set, but node ip is missing, alloc
 			if i.prefix6 != nil && node.IPv6 == nil {
-				ret6, err := i.nextLocked(i.prev6, i.prefix6)
+				ret6, err := i.nextIn(pool6, &i.prev6, i.prefix6)
 				if err != nil {
 					return fmt.Errorf("failed to allocate ipv6 for node(%d): %w", node.ID, err)
 				}
@@ -301,6 +524,30 @@ func (db *HSDatabase) BackfillNodeIPs(i *IPAllocator) ([]string, error) {
 				ret = append(ret, fmt.Sprintf("assigned IPv6 %q to Node(%d) %q", ret6.String(), node.ID, node.Hostname))
 			}
 
+			// IPv4 pool is set, but node ip is outside of it, move
+			if i.prefix4 != nil && pool4 != nil && !pool4.Contains(*node.IPv4) {
+				ret4, err := i.nextIn(pool4, &i.prev4, i.prefix4)
+				if err != nil {
+					return fmt.Errorf("failed to allocate ipv4 in pool for node(%d): %w", node.ID, err)
+				}
+
+				ret = append(ret, fmt.Sprintf("moving IPv4 %q of Node(%d) %q to %q in pool %s", node.IPv4.String(), node.ID, node.Hostname, ret4.String(), pool4))
+				node.IPv4 = ret4
+				changed = true
+			}
+
+			// IPv6 pool is set, but node ip is outside of it, move
+			if i.prefix6 != nil && pool6 != nil && !pool6.Contains(*node.IPv6) {
+				ret6, err := i.nextIn(pool6, &i.prev6, i.prefix6)
+				if err != nil {
+					return fmt.Errorf("failed to allocate ipv6 in pool for node(%d): %w", node.ID, err)
+				}
+
+				ret = append(ret, fmt.Sprintf("moving IPv6 %q of Node(%d) %q to %q in pool %s", node.IPv6.String(), node.ID, node.Hostname, ret6.String(), pool6))
+				node.IPv6 = ret6
+				changed = true
+			}
+
 			// IPv4 prefix is not set, but node has IP, remove
 			if i.prefix4 == nil && node.IPv4 != nil {
 				ret = append(ret, fmt.Sprintf("removing IPv4 %q from Node(%d) %q", node.IPv4.String(), node.ID, node.Hostname))
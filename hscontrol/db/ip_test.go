@@ -2,6 +2,7 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"net/netip"
 	"strings"
@@ -152,6 +153,7 @@ func TestIPAllocatorSequential(t *testing.T) {
 				tt.prefix4,
 				tt.prefix6,
 				types.IPAllocationStrategySequential,
+				nil,
 			)
 
 			spew.Dump(alloc)
@@ -256,7 +258,7 @@ func TestIPAllocatorRandom(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			db := tt.dbFunc()
 
-			alloc, _ := NewIPAllocator(db, tt.prefix4, tt.prefix6, types.IPAllocationStrategyRandom)
+			alloc, _ := NewIPAllocator(db, tt.prefix4, tt.prefix6, types.IPAllocationStrategyRandom, nil)
 
 			spew.Dump(alloc)
 
@@ -284,6 +286,172 @@ func TestIPAllocatorRandom(t *testing.T) {
 	}
 }
 
+func TestIPAllocatorPools(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy types.IPAllocationStrategy
+
+		pool4    *netip.Prefix
+		pool6    *netip.Prefix
+		getCount int
+		want4    []netip.Addr
+		want6    []netip.Addr
+		wantErr  error
+	}{
+		{
+			name:     "v4-pool",
+			strategy: types.IPAllocationStrategySequential,
+			pool4:    mpp("100.64.10.0/30"),
+			getCount: 2,
+			want4: []netip.Addr{
+				na("100.64.10.0"),
+				na("100.64.10.1"),
+			},
+			want6: []netip.Addr{
+				na("fd7a:115c:a1e0::1"),
+				na("fd7a:115c:a1e0::2"),
+			},
+		},
+		{
+			name:     "skips-network-of-prefix",
+			strategy: types.IPAllocationStrategySequential,
+			pool4:    mpp("100.64.0.0/31"),
+			pool6:    mpp("fd7a:115c:a1e0:1::/127"),
+			getCount: 1,
+			want4: []netip.Addr{
+				na("100.64.0.1"),
+			},
+			want6: []netip.Addr{
+				na("fd7a:115c:a1e0:1::"),
+			},
+		},
+		{
+			name:     "single-address-random",
+			strategy: types.IPAllocationStrategyRandom,
+			pool4:    mpp("100.64.10.10/32"),
+			getCount: 1,
+			want4: []netip.Addr{
+				na("100.64.10.10"),
+			},
+		},
+		{
+			name:     "pool-exhausted",
+			strategy: types.IPAllocationStrategySequential,
+			pool4:    mpp("100.64.10.10/32"),
+			getCount: 2,
+			want4: []netip.Addr{
+				na("100.64.10.10"),
+			},
+			wantErr: ErrCouldNotAllocateIP,
+		},
+		{
+			name:     "outside-prefix",
+			strategy: types.IPAllocationStrategySequential,
+			pool4:    mpp("10.0.0.0/24"),
+			getCount: 1,
+			wantErr:  ErrIPPoolOutsidePrefix,
+		},
+		{
+			name:     "larger-than-prefix",
+			strategy: types.IPAllocationStrategySequential,
+			pool6:    mpp("fd7a:115c::/32"),
+			getCount: 1,
+			wantErr:  ErrIPPoolOutsidePrefix,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alloc, _ := NewIPAllocator(nil, mpp("100.64.0.0/10"), mpp("fd7a:115c:a1e0::/48"), tt.strategy, nil)
+
+			var got4s []netip.Addr
+			var got6s []netip.Addr
+			var err error
+
+			for range tt.getCount {
+				var got4, got6 *netip.Addr
+				got4, got6, err = alloc.NextInPools(tt.pool4, tt.pool6)
+				if err != nil {
+					break
+				}
+
+				got4s = append(got4s, *got4)
+				got6s = append(got6s, *got6)
+			}
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NextInPools() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if tt.want4 != nil {
+				if diff := cmp.Diff(tt.want4, got4s, util.Comparers...); diff != "" {
+					t.Errorf("IPv4 addresses unexpected result (-want +got):\n%s", diff)
+				}
+			}
+
+			if tt.want6 != nil {
+				if diff := cmp.Diff(tt.want6, got6s, util.Comparers...); diff != "" {
+					t.Errorf("IPv6 addresses unexpected result (-want +got):\n%s", diff)
+				}
+			}
+		})
+	}
+}
+
+func TestIPAllocatorTailnets(t *testing.T) {
+	pools := []types.IPPool{
+		{
+			Prefix4: mpp("100.64.0.0/30"),
+			Nodes:   types.StringList{"*"},
+			Tailnet: "acme",
+		},
+	}
+	alloc, _ := NewIPAllocator(
+		nil,
+		mpp("100.64.0.0/10"),
+		mpp("fd7a:115c:a1e0::/48"),
+		types.IPAllocationStrategySequential,
+		pools,
+	)
+
+	acme := &types.Node{User: types.User{Name: "bob", Tailnet: "acme"}}
+	got4, got6, err := alloc.NextForNode(nil, acme)
+	if err != nil {
+		t.Fatalf("NextForNode() of the tailnet node: %s", err)
+	}
+	if diff := cmp.Diff(na("100.64.0.1"), *got4, util.Comparers...); diff != "" {
+		t.Errorf("IPv4 address of the tailnet node unexpected result (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(na("fd7a:115c:a1e0::1"), *got6, util.Comparers...); diff != "" {
+		t.Errorf("IPv6 address of the tailnet node unexpected result (-want +got):\n%s", diff)
+	}
+
+	// The nodes of the default tailnet skip the prefix of the tailnet.
+	got4, _, err = alloc.NextForNode(nil, &types.Node{User: types.User{Name: "alice"}})
+	if err != nil {
+		t.Fatalf("NextForNode() of the default node: %s", err)
+	}
+	if diff := cmp.Diff(na("100.64.0.4"), *got4, util.Comparers...); diff != "" {
+		t.Errorf("IPv4 address of the default node unexpected result (-want +got):\n%s", diff)
+	}
+
+	// The IP pools of a pre auth key must be in the tailnet.
+	acme.AuthKey = &types.PreAuthKey{IPPools: types.StringList{"100.64.10.0/24"}}
+	_, _, err = alloc.NodePools(nil, acme)
+	if !errors.Is(err, ErrIPPoolOutsidePrefix) {
+		t.Errorf("NodePools() error = %v, want %v", err, ErrIPPoolOutsidePrefix)
+	}
+
+	acme.AuthKey = &types.PreAuthKey{IPPools: types.StringList{"fd7a:115c:a1e0:10::/64"}}
+	_, pool6, err := alloc.NodePools(nil, acme)
+	if err != nil {
+		t.Fatalf("NodePools() with an IPv6 pool: %s", err)
+	}
+	if diff := cmp.Diff(mpp("fd7a:115c:a1e0:10::/64"), pool6, util.Comparers...); diff != "" {
+		t.Errorf("IPv6 pool unexpected result (-want +got):\n%s", diff)
+	}
+}
+
 func TestBackfillIPAddresses(t *testing.T) {
 	fullNodeP := func(i int) *types.Node {
 		v4 := fmt.Sprintf("100.64.0.%d", i)
@@ -307,6 +475,7 @@ func TestBackfillIPAddresses(t *testing.T) {
 
 		prefix4 *netip.Prefix
 		prefix6 *netip.Prefix
+		pools   []types.IPPool
 		want    types.Nodes
 	}{
 		{
@@ -468,6 +637,54 @@ func TestBackfillIPAddresses(t *testing.T) {
 				fullNodeP(4),
 			},
 		},
+		{
+			name: "move-into-pool",
+			dbFunc: func() *HSDatabase {
+				db := dbForTest(t, "move-into-pool")
+				alice := types.User{Name: "alice"}
+				db.DB.Save(&alice)
+				bob := types.User{Name: "bob"}
+				db.DB.Save(&bob)
+
+				db.DB.Save(&types.Node{
+					User: alice,
+					IPv4: nap("100.64.0.1"),
+					IPv6: nap("fd7a:115c:a1e0::1"),
+				})
+				db.DB.Save(&types.Node{
+					User: bob,
+					IPv4: nap("100.64.0.2"),
+					IPv6: nap("fd7a:115c:a1e0::2"),
+				})
+
+				return db
+			},
+
+			prefix4: mpp("100.64.0.0/10"),
+			prefix6: mpp("fd7a:115c:a1e0::/48"),
+			pools: []types.IPPool{
+				{
+					Nodes:   []string{"alice"},
+					Prefix4: mpp("100.80.0.0/16"),
+				},
+			},
+
+			want: types.Nodes{
+				&types.Node{
+					IPv4DatabaseField: sql.NullString{
+						Valid:  true,
+						String: "100.80.0.0",
+					},
+					IPv4: nap("100.80.0.0"),
+					IPv6DatabaseField: sql.NullString{
+						Valid:  true,
+						String: "fd7a:115c:a1e0::1",
+					},
+					IPv6: nap("fd7a:115c:a1e0::1"),
+				},
+				fullNodeP(2),
+			},
+		},
 	}
 
 	comps := append(util.Comparers, cmpopts.IgnoreFields(types.Node{},
@@ -489,12 +706,12 @@ func TestBackfillIPAddresses(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			db := tt.dbFunc()
 
-			alloc, err := NewIPAllocator(db, tt.prefix4, tt.prefix6, types.IPAllocationStrategySequential)
+			alloc, err := NewIPAllocator(db, tt.prefix4, tt.prefix6, types.IPAllocationStrategySequential, tt.pools)
 			if err != nil {
 				t.Fatalf("failed to set up ip alloc: %s", err)
 			}
 
-			logs, err := db.BackfillNodeIPs(alloc)
+			logs, err := db.BackfillNodeIPs(alloc, nil)
 			if err != nil {
 				t.Fatalf("failed to backfill: %s", err)
 			}
@@ -0,0 +1,62 @@
+package db
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const prometheusNamespace = "headscale"
+
+var (
+	routePrefixUnreachable = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: prometheusNamespace,
+		Name:      "route_prefix_unreachable",
+		Help:      "1 if the primary router of the prefix is offline and no other router could take over",
+	}, []string{"prefix"})
+	routePrefixUnreachableTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "route_prefix_unreachable_total",
+		Help:      "total count of failovers which found no online router for the prefix",
+	}, []string{"prefix"})
+	routeFailovers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "route_failovers_total",
+		Help:      "total count of primary route failovers",
+	}, []string{"prefix"})
+	routeFailoversDampened = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "route_failovers_dampened_total",
+		Help:      "total count of failovers which passed over a router held down after flapping",
+	}, []string{"prefix"})
+	nodeStoreLoads = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "node_store_loads_total",
+		Help:      "total count of times the nodes were read from the database into the node store",
+	})
+	nodeStoreNodeLoads = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "node_store_node_loads_total",
+		Help:      "total count of times a written node was read from the database into the node store",
+	})
+	nodeStatusPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: prometheusNamespace,
+		Name:      "node_status_pending",
+		Help:      "number of nodes with a status update waiting to be written",
+	})
+	nodeStatusWrites = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "node_status_writes_total",
+		Help:      "total count of node status updates written",
+	})
+	nodeStatusFlushes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "node_status_flushes_total",
+		Help:      "total count of node status update flushes",
+	}, []string{"status"})
+	nodeStatusFlushDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: prometheusNamespace,
+		Name:      "node_status_flush_duration_seconds",
+		Help:      "time taken to write a batch of node status updates",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 12),
+	})
+)
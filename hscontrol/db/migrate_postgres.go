@@ -0,0 +1,245 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/go-gormigrate/gormigrate/v2"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+)
+
+const migrateBatchSize = 500
+
+var (
+	ErrMigrateSourceType       = errors.New("only a sqlite database can be migrated to postgres")
+	ErrMigrateSourceNotCurrent = errors.New("the sqlite database has pending migrations, start headscale once to apply them")
+	ErrMigrateTargetNotEmpty   = errors.New("the postgres database is not empty")
+	ErrMigrateRowCount         = errors.New("row counts differ after copying")
+	ErrMigrateForeignKey       = errors.New("rows reference missing rows after copying")
+)
+
+// TableCopy is the number of rows of a table copied by
+// MigrateToPostgres.
+type TableCopy struct {
+	Table string `json:"table"`
+	Rows  int64  `json:"rows"`
+}
+
+// scimGroupMember is a row of the join table of the SCIM groups and
+// their members, which has no type of its own.
+type scimGroupMember struct {
+	SCIMGroupID uint64 `gorm:"column:scim_group_id"`
+	UserID      uint64
+}
+
+func (scimGroupMember) TableName() string {
+	return "scim_group_members"
+}
+
+// migrateTable copies a table, serial is set if its primary key is the
+// serial id column.
+type migrateTable struct {
+	name   string
+	serial bool
+	copy   func(rx, tx *gorm.DB) error
+}
+
+// migrateTables are the tables copied to postgres, in an order
+// satisfying their foreign keys. The tables of the HA instances only
+// hold runtime state and are not copied.
+var migrateTables = []migrateTable{
+	{"users", true, copyRows[types.User]},
+	{"scim_groups", true, copyRows[types.SCIMGroup]},
+	{"scim_group_members", false, copyJoinRows[scimGroupMember]},
+	{"api_keys", true, copyRows[types.APIKey]},
+	{"pre_auth_keys", true, copyRows[types.PreAuthKey]},
+	{"pre_auth_key_acl_tags", true, copyRows[types.PreAuthKeyACLTag]},
+	{"nodes", true, copyRows[types.Node]},
+	{"routes", true, copyRows[types.Route]},
+	{"oidc_sessions", false, copyRows[types.OIDCSession]},
+	{"node_client_metrics", false, copyRows[types.NodeClientMetrics]},
+	{"node_shares", true, copyRows[types.NodeShare]},
+	{"policies", true, copyRows[types.Policy]},
+	{"derp_regions", false, copyRows[types.DERPRegion]},
+	{"dns_records", true, copyRows[types.DNSRecord]},
+	{"scoped_nameservers", true, copyRows[types.ScopedNameservers]},
+	{"tka_states", true, copyRows[types.TKAState]},
+	{"tka_updates", false, copyRows[types.TKAUpdate]},
+}
+
+// migrateForeignKeys are the references between the copied tables,
+// checked once they are copied.
+var migrateForeignKeys = []struct {
+	table, column, references string
+}{
+	{"scim_group_members", "scim_group_id", "scim_groups"},
+	{"scim_group_members", "user_id", "users"},
+	{"pre_auth_keys", "user_id", "users"},
+	{"pre_auth_key_acl_tags", "pre_auth_key_id", "pre_auth_keys"},
+	{"nodes", "user_id", "users"},
+	{"nodes", "auth_key_id", "pre_auth_keys"},
+	{"routes", "node_id", "nodes"},
+	{"oidc_sessions", "node_id", "nodes"},
+	{"node_client_metrics", "node_id", "nodes"},
+	{"node_shares", "node_id", "nodes"},
+	{"node_shares", "user_id", "users"},
+}
+
+// MigrateToPostgres copies the SQLite database of the configuration to
+// the empty postgres database of the DSN, whose schema is created. The
+// rows are copied in a single transaction, which is rolled back unless
+// the row counts of every table match and every foreign key references
+// a copied row. headscale must be stopped while migrating.
+func MigrateToPostgres(cfg types.DatabaseConfig, dsn string) ([]TableCopy, error) {
+	if cfg.Type != types.DatabaseSqlite {
+		return nil, ErrMigrateSourceType
+	}
+
+	pending, err := PendingMigrations(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) > 0 {
+		return nil, ErrMigrateSourceNotCurrent
+	}
+
+	src, err := openDB(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if srcDB, err := src.DB(); err == nil {
+		defer srcDB.Close()
+	}
+
+	dst, err := openPostgres(dsn, types.PostgresConfig{}, logger.Default.LogMode(logger.Silent))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to postgres: %w", err)
+	}
+	if dstDB, err := dst.DB(); err == nil {
+		defer dstDB.Close()
+	}
+
+	migrations := gormigrate.New(
+		dst,
+		gormigrate.DefaultOptions,
+		schemaMigrations(dst, types.DatabaseConfig{Type: types.DatabasePostgres}),
+	)
+	if err := migrations.Migrate(); err != nil {
+		return nil, fmt.Errorf("creating postgres schema: %w", err)
+	}
+
+	var copied []TableCopy
+	err = src.Transaction(func(rx *gorm.DB) error {
+		return dst.Transaction(func(tx *gorm.DB) error {
+			copied, err = migrateRows(rx, tx)
+
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return copied, nil
+}
+
+// migrateRows copies the rows of the read transaction of the SQLite
+// database to the write transaction of the postgres database, and
+// verifies the copy.
+func migrateRows(rx, tx *gorm.DB) ([]TableCopy, error) {
+	copied := make([]TableCopy, 0, len(migrateTables))
+	for _, table := range migrateTables {
+		var existing int64
+		if err := tx.Table(table.name).Count(&existing).Error; err != nil {
+			return nil, fmt.Errorf("counting rows of %s: %w", table.name, err)
+		}
+		if existing > 0 {
+			return nil, fmt.Errorf("%w: %s has %d rows", ErrMigrateTargetNotEmpty, table.name, existing)
+		}
+
+		if err := table.copy(rx, tx); err != nil {
+			return nil, fmt.Errorf("copying %s: %w", table.name, err)
+		}
+
+		var want, got int64
+		if err := rx.Table(table.name).Count(&want).Error; err != nil {
+			return nil, fmt.Errorf("counting rows of %s: %w", table.name, err)
+		}
+		if err := tx.Table(table.name).Count(&got).Error; err != nil {
+			return nil, fmt.Errorf("counting rows of %s: %w", table.name, err)
+		}
+		if want != got {
+			return nil, fmt.Errorf("%w: %s has %d rows, %d copied", ErrMigrateRowCount, table.name, want, got)
+		}
+
+		// The ids are copied, the sequence must continue after them.
+		if table.serial {
+			err := tx.Exec(fmt.Sprintf(
+				"SELECT setval(pg_get_serial_sequence('%[1]s', 'id'), COALESCE((SELECT MAX(id) FROM %[1]s), 0) + 1, false)",
+				table.name,
+			)).Error
+			if err != nil {
+				return nil, fmt.Errorf("resetting id sequence of %s: %w", table.name, err)
+			}
+		}
+
+		copied = append(copied, TableCopy{Table: table.name, Rows: got})
+	}
+
+	for _, fk := range migrateForeignKeys {
+		var orphans int64
+		err := tx.Raw(fmt.Sprintf(
+			"SELECT COUNT(*) FROM %s WHERE %s IS NOT NULL AND %[2]s NOT IN (SELECT id FROM %s)",
+			fk.table,
+			fk.column,
+			fk.references,
+		)).Scan(&orphans).Error
+		if err != nil {
+			return nil, fmt.Errorf("checking %s.%s: %w", fk.table, fk.column, err)
+		}
+		if orphans > 0 {
+			return nil, fmt.Errorf(
+				"%w: %d rows of %s reference a missing row of %s",
+				ErrMigrateForeignKey,
+				orphans,
+				fk.table,
+				fk.references,
+			)
+		}
+	}
+
+	return copied, nil
+}
+
+// copyRows copies the rows of a table in batches, with their ids. The
+// soft deleted rows are copied, and the hooks are skipped so the columns
+// are copied as stored.
+func copyRows[T any](rx, tx *gorm.DB) error {
+	var batch []T
+
+	return rx.Session(&gorm.Session{SkipHooks: true}).
+		Unscoped().
+		FindInBatches(&batch, migrateBatchSize, func(_ *gorm.DB, _ int) error {
+			return tx.Session(&gorm.Session{SkipHooks: true}).
+				Omit(clause.Associations).
+				Create(&batch).Error
+		}).Error
+}
+
+// copyJoinRows copies the rows of a join table, which has no primary
+// key to copy it in batches by.
+func copyJoinRows[T any](rx, tx *gorm.DB) error {
+	var rows []T
+	if err := rx.Find(&rows).Error; err != nil {
+		return err
+	}
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	return tx.CreateInBatches(&rows, migrateBatchSize).Error
+}
@@ -0,0 +1,35 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+)
+
+func TestMigrateToPostgresSource(t *testing.T) {
+	// The source is checked before connecting to postgres.
+	const dsn = "host=localhost port=1 dbname=headscale connect_timeout=1"
+
+	_, err := MigrateToPostgres(types.DatabaseConfig{Type: types.DatabasePostgres}, dsn)
+	if !errors.Is(err, ErrMigrateSourceType) {
+		t.Errorf("MigrateToPostgres() from postgres error = %v, want %v", err, ErrMigrateSourceType)
+	}
+
+	cfg := types.DatabaseConfig{
+		Type: types.DatabaseSqlite,
+		Sqlite: types.SqliteConfig{
+			Path: filepath.Join(t.TempDir(), "headscale.db"),
+		},
+	}
+	if err := os.WriteFile(cfg.Sqlite.Path, nil, 0o600); err != nil {
+		t.Fatalf("creating database: %s", err)
+	}
+
+	_, err = MigrateToPostgres(cfg, dsn)
+	if !errors.Is(err, ErrMigrateSourceNotCurrent) {
+		t.Errorf("MigrateToPostgres() from an unmigrated database error = %v, want %v", err, ErrMigrateSourceNotCurrent)
+	}
+}
@@ -5,13 +5,14 @@ import (
 	"fmt"
 	"net/netip"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
 	"github.com/patrickmn/go-cache"
 	"github.com/puzpuzpuz/xsync/v3"
-	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
@@ -34,12 +35,42 @@ var (
 	)
 )
 
-func (hsdb *HSDatabase) ListPeers(nodeID types.NodeID) (types.Nodes, error) {
-	return Read(hsdb.DB, func(rx *gorm.DB) (types.Nodes, error) {
-		return ListPeers(rx, nodeID)
+func (hsdb *HSDatabase) CountNodes() (int64, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (int64, error) {
+		return CountNodes(rx)
 	})
 }
 
+// CountNodes returns the total number of registered nodes.
+func CountNodes(tx *gorm.DB) (int64, error) {
+	var count int64
+	if err := tx.Model(&types.Node{}).Count(&count).Error; err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// nodeRegistrationsLock is the key of the PostgreSQL advisory lock
+// held by the transactions registering nodes.
+const nodeRegistrationsLock = 0x6873_6e6f_6465
+
+// LockNodeRegistrations holds the registrations of nodes in the other
+// transactions until tx ends, so that the nodes it counts do not change
+// before it registers one. SQLite runs a single transaction at a time,
+// so it only locks on PostgreSQL.
+func LockNodeRegistrations(tx *gorm.DB) error {
+	if tx.Dialector.Name() != "postgres" {
+		return nil
+	}
+
+	return tx.Exec("SELECT pg_advisory_xact_lock(?)", nodeRegistrationsLock).Error
+}
+
+func (hsdb *HSDatabase) ListPeers(nodeID types.NodeID) (types.Nodes, error) {
+	return hsdb.nodes.ListPeers(hsdb.DB, nodeID)
+}
+
 // ListPeers returns all peers of node, regardless of any Policy or if the node is expired.
 func ListPeers(tx *gorm.DB, nodeID types.NodeID) (types.Nodes, error) {
 	nodes := types.Nodes{}
@@ -59,9 +90,7 @@ func ListPeers(tx *gorm.DB, nodeID types.NodeID) (types.Nodes, error) {
 }
 
 func (hsdb *HSDatabase) ListNodes() (types.Nodes, error) {
-	return Read(hsdb.DB, func(rx *gorm.DB) (types.Nodes, error) {
-		return ListNodes(rx)
-	})
+	return hsdb.nodes.ListNodes(hsdb.DB)
 }
 
 func ListNodes(tx *gorm.DB) (types.Nodes, error) {
@@ -78,6 +107,49 @@ func ListNodes(tx *gorm.DB) (types.Nodes, error) {
 	return nodes, nil
 }
 
+// NodeFilter selects the nodes returned by ListNodesPage.
+type NodeFilter struct {
+	// User keeps the nodes of the named user.
+	User string
+
+	// ExpiredAt keeps the nodes whose key has expired at that time.
+	ExpiredAt time.Time
+}
+
+// ListNodesPage returns up to limit nodes matching the filter, with an
+// ID above after, ordered by ID. A limit of zero returns all of them.
+func ListNodesPage(tx *gorm.DB, filter NodeFilter, after types.NodeID, limit int) (types.Nodes, error) {
+	query := tx.
+		Preload("AuthKey").
+		Preload("AuthKey.User").
+		Preload("User").
+		Preload("Routes").
+		Where("id > ?", after)
+
+	if filter.User != "" {
+		user, err := GetUser(tx, filter.User)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where("user_id = ?", user.ID)
+	}
+
+	if !filter.ExpiredAt.IsZero() {
+		query = query.Where("expiry IS NOT NULL AND expiry < ?", filter.ExpiredAt)
+	}
+
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+
+	nodes := types.Nodes{}
+	if err := query.Order("id").Find(&nodes).Error; err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
 func listNodesByGivenName(tx *gorm.DB, givenName string) (types.Nodes, error) {
 	nodes := types.Nodes{}
 	if err := tx.
@@ -92,6 +164,42 @@ func listNodesByGivenName(tx *gorm.DB, givenName string) (types.Nodes, error) {
 	return nodes, nil
 }
 
+func (hsdb *HSDatabase) LookupNodes(name string, prefix bool) (types.Nodes, error) {
+	return Read(hsdb.ReadDB(), func(rx *gorm.DB) (types.Nodes, error) {
+		return LookupNodes(rx, name, prefix)
+	})
+}
+
+// LookupNodes returns the nodes whose hostname or given name is name,
+// ignoring case, or starts with it if prefix is set.
+func LookupNodes(tx *gorm.DB, name string, prefix bool) (types.Nodes, error) {
+	query := tx.
+		Preload("AuthKey").
+		Preload("AuthKey.User").
+		Preload("User").
+		Preload("Routes")
+
+	name = strings.ToLower(name)
+	if prefix {
+		pattern := likeEscaper.Replace(name) + "%"
+		query = query.Where(
+			`LOWER(hostname) LIKE ? ESCAPE '\' OR LOWER(given_name) LIKE ? ESCAPE '\'`,
+			pattern, pattern,
+		)
+	} else {
+		query = query.Where("LOWER(hostname) = ? OR LOWER(given_name) = ?", name, name)
+	}
+
+	nodes := types.Nodes{}
+	if err := query.Order("id").Find(&nodes).Error; err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
 func (hsdb *HSDatabase) getNode(user string, name string) (*types.Node, error) {
 	return Read(hsdb.DB, func(rx *gorm.DB) (*types.Node, error) {
 		return getNode(rx, user, name)
@@ -115,9 +223,7 @@ func getNode(tx *gorm.DB, user string, name string) (*types.Node, error) {
 }
 
 func (hsdb *HSDatabase) GetNodeByID(id types.NodeID) (*types.Node, error) {
-	return Read(hsdb.DB, func(rx *gorm.DB) (*types.Node, error) {
-		return GetNodeByID(rx, id)
-	})
+	return hsdb.nodes.GetNodeByID(hsdb.DB, id)
 }
 
 // GetNodeByID finds a Node by ID and returns the Node struct.
@@ -136,9 +242,7 @@ func GetNodeByID(tx *gorm.DB, id types.NodeID) (*types.Node, error) {
 }
 
 func (hsdb *HSDatabase) GetNodeByMachineKey(machineKey key.MachinePublic) (*types.Node, error) {
-	return Read(hsdb.DB, func(rx *gorm.DB) (*types.Node, error) {
-		return GetNodeByMachineKey(rx, machineKey)
-	})
+	return hsdb.nodes.GetNodeByMachineKey(hsdb.DB, machineKey)
 }
 
 // GetNodeByMachineKey finds a Node by its MachineKey and returns the Node struct.
@@ -159,6 +263,28 @@ func GetNodeByMachineKey(
 	return &mach, nil
 }
 
+func (hsdb *HSDatabase) GetNodeByNodeKey(nodeKey key.NodePublic) (*types.Node, error) {
+	return hsdb.nodes.GetNodeByNodeKey(hsdb.DB, nodeKey)
+}
+
+// GetNodeByNodeKey finds a Node by its current NodeKey and returns the Node struct.
+func GetNodeByNodeKey(
+	tx *gorm.DB,
+	nodeKey key.NodePublic,
+) (*types.Node, error) {
+	node := types.Node{}
+	if result := tx.
+		Preload("AuthKey").
+		Preload("AuthKey.User").
+		Preload("User").
+		Preload("Routes").
+		First(&node, "node_key = ?", nodeKey.String()); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &node, nil
+}
+
 func (hsdb *HSDatabase) GetNodeByAnyKey(
 	machineKey key.MachinePublic,
 	nodeKey key.NodePublic,
@@ -261,6 +387,91 @@ func NodeSetExpiry(tx *gorm.DB,
 	return tx.Model(&types.Node{}).Where("id = ?", nodeID).Update("expiry", expiry).Error
 }
 
+func (hsdb *HSDatabase) NodeSetQuarantined(nodeID types.NodeID, quarantined bool) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return NodeSetQuarantined(tx, nodeID, quarantined)
+	})
+}
+
+// NodeSetQuarantined sets if a node is quarantined.
+// Caller is responsible for notifying all of change.
+func NodeSetQuarantined(tx *gorm.DB,
+	nodeID types.NodeID, quarantined bool,
+) error {
+	return tx.Model(&types.Node{}).Where("id = ?", nodeID).Update("quarantined", quarantined).Error
+}
+
+func (hsdb *HSDatabase) ListNodesAwaitingApproval() (types.Nodes, error) {
+	return Read(hsdb.DB, ListNodesAwaitingApproval)
+}
+
+// ListNodesAwaitingApproval returns the nodes waiting for an
+// administrator to approve them.
+func ListNodesAwaitingApproval(tx *gorm.DB) (types.Nodes, error) {
+	nodes := types.Nodes{}
+	if err := tx.
+		Preload("AuthKey").
+		Preload("User").
+		Where("awaiting_approval = ?", true).
+		Order("id").
+		Find(&nodes).Error; err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+// ApproveNode lets a node awaiting approval in the tailnet, with the
+// addresses allocated for it.
+// Caller is responsible for notifying all of change.
+func ApproveNode(tx *gorm.DB,
+	nodeID types.NodeID, ipv4 *netip.Addr, ipv6 *netip.Addr,
+) (*types.Node, error) {
+	node, err := GetNodeByID(tx, nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	node.AwaitingApproval = false
+	node.IPv4 = ipv4
+	node.IPv6 = ipv6
+
+	if err := tx.Save(node).Error; err != nil {
+		return nil, fmt.Errorf("saving approved node(%d): %w", nodeID, err)
+	}
+
+	return node, nil
+}
+
+func (hsdb *HSDatabase) NodeSetPostureAttributes(nodeID types.NodeID, attrs types.PostureAttributes) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return NodeSetPostureAttributes(tx, nodeID, attrs)
+	})
+}
+
+// NodeSetPostureAttributes replaces the custom posture attributes of a
+// node.
+// Caller is responsible for notifying all of change.
+func NodeSetPostureAttributes(tx *gorm.DB,
+	nodeID types.NodeID, attrs types.PostureAttributes,
+) error {
+	return tx.Model(&types.Node{}).Where("id = ?", nodeID).Update("posture_attributes", attrs).Error
+}
+
+func (hsdb *HSDatabase) NodeSetLabels(nodeID types.NodeID, labels types.NodeLabels) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return NodeSetLabels(tx, nodeID, labels)
+	})
+}
+
+// NodeSetLabels replaces the labels of a node.
+// Caller is responsible for notifying all of change.
+func NodeSetLabels(tx *gorm.DB,
+	nodeID types.NodeID, labels types.NodeLabels,
+) error {
+	return tx.Model(&types.Node{}).Where("id = ?", nodeID).Update("labels", labels).Error
+}
+
 func (hsdb *HSDatabase) DeleteNode(node *types.Node, isLikelyConnected *xsync.MapOf[types.NodeID, bool]) ([]types.NodeID, error) {
 	return Write(hsdb.DB, func(tx *gorm.DB) ([]types.NodeID, error) {
 		return DeleteNode(tx, node, isLikelyConnected)
@@ -278,6 +489,18 @@ func DeleteNode(tx *gorm.DB,
 		return changed, err
 	}
 
+	if err := DeleteOIDCSession(tx, node.ID); err != nil {
+		return changed, err
+	}
+
+	if err := DeleteNodeClientMetrics(tx, node.ID); err != nil {
+		return changed, err
+	}
+
+	if err := DeleteNodeShares(tx, node.ID); err != nil {
+		return changed, err
+	}
+
 	// Unscoped causes the node to be fully removed from the database.
 	if err := tx.Unscoped().Delete(&types.Node{}, node.ID).Error; err != nil {
 		return changed, err
@@ -302,7 +525,7 @@ func RegisterNodeFromAuthCallback(
 	ipv4 *netip.Addr,
 	ipv6 *netip.Addr,
 ) (*types.Node, error) {
-	log.Debug().
+	util.LogDB.Debug().
 		Str("machine_key", mkey.ShortString()).
 		Str("userName", userName).
 		Str("registrationMethod", registrationMethod).
@@ -360,7 +583,7 @@ func (hsdb *HSDatabase) RegisterNode(node types.Node, ipv4 *netip.Addr, ipv6 *ne
 
 // RegisterNode is executed from the CLI to register a new Node using its MachineKey.
 func RegisterNode(tx *gorm.DB, node types.Node, ipv4 *netip.Addr, ipv6 *netip.Addr) (*types.Node, error) {
-	log.Debug().
+	util.LogDB.Debug().
 		Str("node", node.Hostname).
 		Str("machine_key", node.MachineKey.ShortString()).
 		Str("node_key", node.NodeKey.ShortString()).
@@ -375,7 +598,7 @@ func RegisterNode(tx *gorm.DB, node types.Node, ipv4 *netip.Addr, ipv6 *netip.Ad
 			return nil, fmt.Errorf("failed register existing node in the database: %w", err)
 		}
 
-		log.Trace().
+		util.LogDB.Trace().
 			Caller().
 			Str("node", node.Hostname).
 			Str("machine_key", node.MachineKey.ShortString()).
@@ -393,7 +616,7 @@ func RegisterNode(tx *gorm.DB, node types.Node, ipv4 *netip.Addr, ipv6 *netip.Ad
 		return nil, fmt.Errorf("failed register(save) node in the database: %w", err)
 	}
 
-	log.Trace().
+	util.LogDB.Trace().
 		Caller().
 		Str("node", node.Hostname).
 		Msg("Node registered with the database")
@@ -548,6 +771,7 @@ func enableRoutes(tx *gorm.DB,
 	for _, prefix := range newRoutes {
 		route := types.Route{}
 		err := tx.Preload("Node").
+			Preload("Node.User").
 			Where("node_id = ? AND prefix = ?", node.ID, types.IPPrefix(prefix)).
 			First(&route).Error
 		if err == nil {
@@ -556,7 +780,7 @@ func enableRoutes(tx *gorm.DB,
 			// Mark already as primary if there is only this node offering this subnet
 			// (and is not an exit route)
 			if !route.IsExitRoute() {
-				route.IsPrimary = isUniquePrefix(tx, route)
+				route.IsPrimary = isUniquePrefix(tx, route, route.Node.User.Tailnet)
 			}
 
 			err = tx.Save(&route).Error
@@ -577,7 +801,7 @@ func enableRoutes(tx *gorm.DB,
 
 	node.Routes = nRoutes
 
-	log.Trace().
+	util.LogDB.Trace().
 		Caller().
 		Str("node", node.Hostname).
 		Strs("routes", routeStrs).
@@ -660,49 +884,106 @@ func GenerateGivenName(
 	return givenName, nil
 }
 
-func DeleteExpiredEphemeralNodes(tx *gorm.DB,
-	inactivityThreshold time.Duration,
-) ([]types.NodeID, []types.NodeID) {
-	users, err := ListUsers(tx)
-	if err != nil {
-		return nil, nil
+// EphemeralGarbageCollector deletes ephemeral nodes once they have been
+// disconnected for longer than their inactivity timeout. A node is
+// scheduled when it disconnects and cancelled if it reconnects in time.
+type EphemeralGarbageCollector struct {
+	mu sync.Mutex
+
+	deleteFunc  func(types.NodeID)
+	toBeDeleted map[types.NodeID]*ephemeralDeletion
+
+	deleteCh chan *ephemeralDeletion
+	cancelCh chan struct{}
+}
+
+type ephemeralDeletion struct {
+	nodeID types.NodeID
+	timer  *time.Timer
+}
+
+// NewEphemeralGarbageCollector creates a garbage collector calling
+// deleteFunc for every node that stays disconnected past its timeout.
+func NewEphemeralGarbageCollector(deleteFunc func(types.NodeID)) *EphemeralGarbageCollector {
+	return &EphemeralGarbageCollector{
+		deleteFunc:  deleteFunc,
+		toBeDeleted: make(map[types.NodeID]*ephemeralDeletion),
+		deleteCh:    make(chan *ephemeralDeletion, 10),
+		cancelCh:    make(chan struct{}),
 	}
+}
 
-	var expired []types.NodeID
-	var changedNodes []types.NodeID
-	for _, user := range users {
-		nodes, err := ListNodesByUser(tx, user.Name)
-		if err != nil {
-			return nil, nil
-		}
+// Close stops the garbage collector and all the scheduled deletions.
+func (e *EphemeralGarbageCollector) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 
-		for idx, node := range nodes {
-			if node.IsEphemeral() && node.LastSeen != nil &&
-				time.Now().
-					After(node.LastSeen.Add(inactivityThreshold)) {
-				expired = append(expired, node.ID)
-
-				log.Info().
-					Str("node", node.Hostname).
-					Msg("Ephemeral client removed from database")
-
-					// empty isConnected map as ephemeral nodes are not routes
-				changed, err := DeleteNode(tx, nodes[idx], nil)
-				if err != nil {
-					log.Error().
-						Err(err).
-						Str("node", node.Hostname).
-						Msg("🤮 Cannot delete ephemeral node from the database")
-				}
-
-				changedNodes = append(changedNodes, changed...)
-			}
+	select {
+	case <-e.cancelCh:
+		return
+	default:
+	}
+
+	for nodeID, del := range e.toBeDeleted {
+		del.timer.Stop()
+		delete(e.toBeDeleted, nodeID)
+	}
+
+	close(e.cancelCh)
+}
+
+// Schedule schedules the node for deletion after the given timeout,
+// replacing a deletion that is already scheduled for it.
+func (e *EphemeralGarbageCollector) Schedule(nodeID types.NodeID, timeout time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if del, ok := e.toBeDeleted[nodeID]; ok {
+		del.timer.Stop()
+	}
+
+	del := &ephemeralDeletion{nodeID: nodeID}
+	del.timer = time.AfterFunc(timeout, func() {
+		select {
+		case e.deleteCh <- del:
+		case <-e.cancelCh:
 		}
+	})
+	e.toBeDeleted[nodeID] = del
+}
 
-		// TODO(kradalby): needs to be moved out of transaction
+// Cancel cancels the scheduled deletion of the node, if any.
+func (e *EphemeralGarbageCollector) Cancel(nodeID types.NodeID) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if del, ok := e.toBeDeleted[nodeID]; ok {
+		del.timer.Stop()
+		delete(e.toBeDeleted, nodeID)
 	}
+}
 
-	return expired, changedNodes
+// Start runs the garbage collector until it is closed.
+func (e *EphemeralGarbageCollector) Start() {
+	for {
+		select {
+		case <-e.cancelCh:
+			return
+		case del := <-e.deleteCh:
+			e.mu.Lock()
+			// The timer might have fired just before the node was
+			// cancelled or scheduled again, only the current one counts.
+			current := e.toBeDeleted[del.nodeID] == del
+			if current {
+				delete(e.toBeDeleted, del.nodeID)
+			}
+			e.mu.Unlock()
+
+			if current {
+				e.deleteFunc(del.nodeID)
+			}
+		}
+	}
 }
 
 func ExpireExpiredNodes(tx *gorm.DB,
@@ -0,0 +1,117 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrNodeShareExists   = errors.New("node is already shared with the user")
+	ErrNodeShareNotFound = errors.New("node is not shared with the user")
+	ErrNodeShareOwner    = errors.New("node cannot be shared with its owner")
+)
+
+func (hsdb *HSDatabase) ShareNode(nodeID types.NodeID, userName string) (*types.NodeShare, error) {
+	return Write(hsdb.DB, func(tx *gorm.DB) (*types.NodeShare, error) {
+		return ShareNode(tx, nodeID, userName)
+	})
+}
+
+// ShareNode shares a node with a user other than its owner, in the same
+// tailnet.
+func ShareNode(tx *gorm.DB, nodeID types.NodeID, userName string) (*types.NodeShare, error) {
+	node, err := GetNodeByID(tx, nodeID)
+	if err != nil {
+		return nil, ErrNodeNotFound
+	}
+
+	user, err := GetUser(tx, userName)
+	if err != nil {
+		return nil, err
+	}
+
+	if node.UserID == user.ID {
+		return nil, ErrNodeShareOwner
+	}
+	if node.User.Tailnet != user.Tailnet {
+		return nil, ErrUserOtherTailnet
+	}
+
+	var count int64
+	err = tx.Model(&types.NodeShare{}).
+		Where("node_id = ? AND user_id = ?", node.ID, user.ID).
+		Count(&count).Error
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrNodeShareExists
+	}
+
+	share := types.NodeShare{
+		NodeID: node.ID,
+		UserID: user.ID,
+	}
+	if err := tx.Omit(clause.Associations).Create(&share).Error; err != nil {
+		return nil, err
+	}
+
+	share.Node = *node
+	share.User = *user
+
+	return &share, nil
+}
+
+func (hsdb *HSDatabase) UnshareNode(nodeID types.NodeID, userName string) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return UnshareNode(tx, nodeID, userName)
+	})
+}
+
+// UnshareNode stops sharing a node with a user.
+func UnshareNode(tx *gorm.DB, nodeID types.NodeID, userName string) error {
+	user, err := GetUser(tx, userName)
+	if err != nil {
+		return err
+	}
+
+	result := tx.Delete(&types.NodeShare{}, "node_id = ? AND user_id = ?", nodeID, user.ID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNodeShareNotFound
+	}
+
+	return nil
+}
+
+func (hsdb *HSDatabase) ListNodeShares(nodeID types.NodeID) ([]types.NodeShare, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) ([]types.NodeShare, error) {
+		return ListNodeShares(rx, nodeID)
+	})
+}
+
+// ListNodeShares returns the shares of a node, or of all the nodes if
+// nodeID is zero, sorted by node and user.
+func ListNodeShares(tx *gorm.DB, nodeID types.NodeID) ([]types.NodeShare, error) {
+	query := tx.Preload("Node").Preload("User")
+	if nodeID != 0 {
+		query = query.Where("node_id = ?", nodeID)
+	}
+
+	var shares []types.NodeShare
+	if err := query.Order("node_id, user_id").Find(&shares).Error; err != nil {
+		return nil, err
+	}
+
+	return shares, nil
+}
+
+// DeleteNodeShares deletes the shares of a node, if any.
+func DeleteNodeShares(tx *gorm.DB, nodeID types.NodeID) error {
+	return tx.Delete(&types.NodeShare{}, "node_id = ?", nodeID).Error
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestShareNode(c *check.C) {
+	alice, err := db.CreateUser("alice")
+	c.Assert(err, check.IsNil)
+	_, err = db.CreateUser("bob")
+	c.Assert(err, check.IsNil)
+
+	node := types.Node{
+		Hostname:       "laptop",
+		GivenName:      "laptop",
+		UserID:         alice.ID,
+		RegisterMethod: util.RegisterMethodAuthKey,
+	}
+	c.Assert(db.DB.Save(&node).Error, check.IsNil)
+
+	_, err = db.ShareNode(node.ID, "alice")
+	c.Assert(err, check.Equals, ErrNodeShareOwner)
+
+	_, err = db.ShareNode(node.ID, "nobody")
+	c.Assert(err, check.Equals, ErrUserNotFound)
+
+	share, err := db.ShareNode(node.ID, "bob")
+	c.Assert(err, check.IsNil)
+	c.Assert(share.Node.Hostname, check.Equals, "laptop")
+	c.Assert(share.User.Name, check.Equals, "bob")
+
+	_, err = db.ShareNode(node.ID, "bob")
+	c.Assert(err, check.Equals, ErrNodeShareExists)
+
+	shares, err := db.ListNodeShares(node.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(shares), check.Equals, 1)
+	c.Assert(shares[0].User.Name, check.Equals, "bob")
+	c.Assert(shares[0].Node.GivenName, check.Equals, "laptop")
+
+	// Moving the node to the user it is shared with drops the share.
+	c.Assert(db.AssignNodeToUser(&node, "bob"), check.IsNil)
+	shares, err = db.ListNodeShares(0)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(shares), check.Equals, 0)
+
+	_, err = db.ShareNode(node.ID, "alice")
+	c.Assert(err, check.IsNil)
+
+	c.Assert(db.UnshareNode(node.ID, "alice"), check.IsNil)
+	c.Assert(db.UnshareNode(node.ID, "alice"), check.Equals, ErrNodeShareNotFound)
+}
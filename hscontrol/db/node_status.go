@@ -0,0 +1,235 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"gorm.io/gorm"
+)
+
+// NodeStatusWriter coalesces the status updates the nodes send in their
+// map requests (endpoints, disco key, Hostinfo and last seen) and writes
+// them in a single transaction per interval, instead of one write per
+// request. Only the status columns are written, so a pending update
+// never overwrites the other changes to the node.
+//
+// The pending updates are written when the writer is closed, a crash
+// loses at most one interval of them, which the nodes send again when
+// they reconnect.
+type NodeStatusWriter struct {
+	hsdb     *HSDatabase
+	interval time.Duration
+
+	mu      sync.Mutex
+	pending map[types.NodeID]*nodeStatus
+
+	// writeMu is held while writing, so an update discarded for a newer
+	// write of the node cannot be in the middle of being written.
+	writeMu sync.Mutex
+
+	closeOnce sync.Once
+	cancelCh  chan struct{}
+}
+
+// nodeStatus is a pending status update of a node, and the functions to
+// call once it has been written.
+type nodeStatus struct {
+	discoKey  string
+	endpoints types.StringList
+	hostinfo  string
+	lastSeen  *time.Time
+
+	onWrite []func()
+}
+
+// NewNodeStatusWriter returns a writer flushing the status updates every
+// interval, they are written right away if the interval is zero.
+func NewNodeStatusWriter(hsdb *HSDatabase, interval time.Duration) *NodeStatusWriter {
+	return &NodeStatusWriter{
+		hsdb:     hsdb,
+		interval: interval,
+		pending:  make(map[types.NodeID]*nodeStatus),
+		cancelCh: make(chan struct{}),
+	}
+}
+
+// Queue records the status of the node, replacing the pending one, and
+// calls onWrite once it has been written. onWrite can be nil.
+func (w *NodeStatusWriter) Queue(node *types.Node, onWrite func()) error {
+	status, err := newNodeStatus(node)
+	if err != nil {
+		return err
+	}
+
+	if w.interval <= 0 {
+		w.writeMu.Lock()
+		err := w.hsdb.Write(func(tx *gorm.DB) error {
+			return writeNodeStatus(tx, node.ID, status)
+		})
+		w.writeMu.Unlock()
+		if err != nil {
+			return err
+		}
+
+		if onWrite != nil {
+			onWrite()
+		}
+
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if prev, ok := w.pending[node.ID]; ok {
+		status.onWrite = prev.onWrite
+	}
+	if onWrite != nil {
+		status.onWrite = append(status.onWrite, onWrite)
+	}
+	w.pending[node.ID] = status
+	nodeStatusPending.Set(float64(len(w.pending)))
+
+	return nil
+}
+
+// Discard drops the pending status of the node, before the whole node is
+// written with a newer status. Once it returns, the dropped status is not
+// being written either.
+func (w *NodeStatusWriter) Discard(nodeID types.NodeID) {
+	w.mu.Lock()
+	delete(w.pending, nodeID)
+	nodeStatusPending.Set(float64(len(w.pending)))
+	w.mu.Unlock()
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+}
+
+// Start writes the pending updates every interval until the writer is
+// closed.
+func (w *NodeStatusWriter) Start() {
+	if w.interval <= 0 {
+		<-w.cancelCh
+
+		return
+	}
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.cancelCh:
+			return
+		case <-ticker.C:
+			if err := w.Flush(); err != nil {
+				util.LogDB.Error().Err(err).Msg("failed to write node status updates, retrying")
+			}
+		}
+	}
+}
+
+// Close stops writing periodically, and writes the pending updates.
+func (w *NodeStatusWriter) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.cancelCh)
+	})
+
+	return w.Flush()
+}
+
+// Flush writes the pending updates in a single transaction. If it fails,
+// they are kept for the next flush unless a newer status was queued.
+func (w *NodeStatusWriter) Flush() error {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	w.mu.Lock()
+	batch := w.pending
+	w.pending = make(map[types.NodeID]*nodeStatus)
+	nodeStatusPending.Set(0)
+	w.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	err := w.hsdb.Write(func(tx *gorm.DB) error {
+		for nodeID, status := range batch {
+			if err := writeNodeStatus(tx, nodeID, status); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	nodeStatusFlushDuration.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		nodeStatusFlushes.WithLabelValues("error").Inc()
+
+		w.mu.Lock()
+		for nodeID, status := range batch {
+			if _, ok := w.pending[nodeID]; !ok {
+				w.pending[nodeID] = status
+			}
+		}
+		nodeStatusPending.Set(float64(len(w.pending)))
+		w.mu.Unlock()
+
+		return err
+	}
+
+	nodeStatusFlushes.WithLabelValues("ok").Inc()
+	nodeStatusWrites.Add(float64(len(batch)))
+
+	for _, status := range batch {
+		for _, onWrite := range status.onWrite {
+			onWrite()
+		}
+	}
+
+	return nil
+}
+
+func newNodeStatus(node *types.Node) (*nodeStatus, error) {
+	var endpoints types.StringList
+	for _, addrPort := range node.Endpoints {
+		endpoints = append(endpoints, addrPort.String())
+	}
+
+	hostinfo, err := json.Marshal(node.Hostinfo)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling Hostinfo to store in db: %w", err)
+	}
+
+	status := &nodeStatus{
+		discoKey:  node.DiscoKey.String(),
+		endpoints: endpoints,
+		hostinfo:  string(hostinfo),
+	}
+	if node.LastSeen != nil {
+		lastSeen := *node.LastSeen
+		status.lastSeen = &lastSeen
+	}
+
+	return status, nil
+}
+
+func writeNodeStatus(tx *gorm.DB, nodeID types.NodeID, status *nodeStatus) error {
+	return tx.Session(&gorm.Session{SkipHooks: true}).
+		Model(&types.Node{}).
+		Where("id = ?", nodeID).
+		Updates(map[string]any{
+			"disco_key": status.discoKey,
+			"endpoints": status.endpoints,
+			"host_info": status.hostinfo,
+			"last_seen": status.lastSeen,
+		}).Error
+}
@@ -0,0 +1,117 @@
+package db
+
+import (
+	"errors"
+	"net/netip"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"gopkg.in/check.v1"
+	"gorm.io/gorm"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func (s *Suite) TestNodeStatusWriter(c *check.C) {
+	user, err := db.CreateUser("test")
+	c.Assert(err, check.IsNil)
+
+	node := types.Node{
+		MachineKey:     key.NewMachine().Public(),
+		NodeKey:        key.NewNode().Public(),
+		Hostname:       "testnode",
+		GivenName:      "testnode",
+		UserID:         user.ID,
+		RegisterMethod: util.RegisterMethodAuthKey,
+		Hostinfo:       &tailcfg.Hostinfo{},
+	}
+	c.Assert(db.DB.Save(&node).Error, check.IsNil)
+
+	writer := NewNodeStatusWriter(db, time.Hour)
+
+	var written int
+	onWrite := func() { written++ }
+
+	// The updates of the node are coalesced, and only written on flush.
+	first := netip.MustParseAddrPort("192.0.2.1:41641")
+	second := netip.MustParseAddrPort("192.0.2.2:41641")
+	now := time.Now().Round(time.Second)
+
+	node.Endpoints = []netip.AddrPort{first}
+	c.Assert(writer.Queue(&node, onWrite), check.IsNil)
+	node.Endpoints = []netip.AddrPort{second}
+	node.Hostinfo = &tailcfg.Hostinfo{OS: "linux"}
+	node.LastSeen = &now
+	c.Assert(writer.Queue(&node, onWrite), check.IsNil)
+
+	stored, err := db.GetNodeByID(node.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(stored.Endpoints, check.HasLen, 0)
+
+	// Other changes to the node are not overwritten.
+	c.Assert(RenameNode(db.DB, node.ID.Uint64(), "renamed"), check.IsNil)
+
+	c.Assert(writer.Flush(), check.IsNil)
+	c.Assert(written, check.Equals, 2)
+
+	stored, err = db.GetNodeByID(node.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(stored.Endpoints, check.DeepEquals, []netip.AddrPort{second})
+	c.Assert(stored.Hostinfo.OS, check.Equals, "linux")
+	c.Assert(stored.LastSeen.Equal(now), check.Equals, true)
+	c.Assert(stored.GivenName, check.Equals, "renamed")
+
+	// A discarded update is not written.
+	node.Endpoints = []netip.AddrPort{first}
+	c.Assert(writer.Queue(&node, onWrite), check.IsNil)
+	writer.Discard(node.ID)
+	c.Assert(writer.Flush(), check.IsNil)
+	c.Assert(written, check.Equals, 2)
+
+	stored, err = db.GetNodeByID(node.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(stored.Endpoints, check.DeepEquals, []netip.AddrPort{second})
+
+	// Closing writes the pending updates.
+	c.Assert(writer.Queue(&node, onWrite), check.IsNil)
+	c.Assert(writer.Close(), check.IsNil)
+	c.Assert(written, check.Equals, 3)
+
+	stored, err = db.GetNodeByID(node.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(stored.Endpoints, check.DeepEquals, []netip.AddrPort{first})
+}
+
+func (s *Suite) TestNodeStatusWriterRetry(c *check.C) {
+	user, err := db.CreateUser("test")
+	c.Assert(err, check.IsNil)
+
+	node := types.Node{
+		MachineKey:     key.NewMachine().Public(),
+		NodeKey:        key.NewNode().Public(),
+		Hostname:       "testnode",
+		GivenName:      "testnode",
+		UserID:         user.ID,
+		RegisterMethod: util.RegisterMethodAuthKey,
+	}
+	c.Assert(db.DB.Save(&node).Error, check.IsNil)
+
+	writer := NewNodeStatusWriter(db, time.Hour)
+	node.Endpoints = []netip.AddrPort{netip.MustParseAddrPort("192.0.2.1:41641")}
+	c.Assert(writer.Queue(&node, nil), check.IsNil)
+
+	// A failed flush keeps the updates for the next one.
+	failing := errors.New("failing")
+	c.Assert(db.DB.Callback().Update().Before("gorm:update").Register("fail", func(tx *gorm.DB) {
+		tx.AddError(failing)
+	}), check.IsNil)
+	c.Assert(errors.Is(writer.Flush(), failing), check.Equals, true)
+	c.Assert(db.DB.Callback().Update().Remove("fail"), check.IsNil)
+
+	c.Assert(writer.Flush(), check.IsNil)
+
+	stored, err := db.GetNodeByID(node.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(stored.Endpoints, check.DeepEquals, node.Endpoints)
+}
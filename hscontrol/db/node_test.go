@@ -8,6 +8,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/juanfont/headscale/hscontrol/policy"
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
@@ -21,7 +22,7 @@ func (s *Suite) TestGetNode(c *check.C) {
 	user, err := db.CreateUser("test")
 	c.Assert(err, check.IsNil)
 
-	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil)
+	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	_, err = db.getNode("test", "testnode")
@@ -51,7 +52,7 @@ func (s *Suite) TestGetNodeByID(c *check.C) {
 	user, err := db.CreateUser("test")
 	c.Assert(err, check.IsNil)
 
-	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil)
+	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	_, err = db.GetNodeByID(0)
@@ -77,11 +78,48 @@ func (s *Suite) TestGetNodeByID(c *check.C) {
 	c.Assert(err, check.IsNil)
 }
 
+func (s *Suite) TestLookupNodes(c *check.C) {
+	user, err := db.CreateUser("test")
+	c.Assert(err, check.IsNil)
+
+	for i, name := range []string{"web", "Web-1", "web_2", "db"} {
+		node := types.Node{
+			MachineKey:     key.NewMachine().Public(),
+			NodeKey:        key.NewNode().Public(),
+			Hostname:       name,
+			GivenName:      fmt.Sprintf("given-%d", i),
+			UserID:         user.ID,
+			RegisterMethod: util.RegisterMethodAuthKey,
+		}
+		c.Assert(db.DB.Save(&node).Error, check.IsNil)
+	}
+
+	hostnames := func(name string, prefix bool) []string {
+		nodes, err := db.LookupNodes(name, prefix)
+		c.Assert(err, check.IsNil)
+
+		names := []string{}
+		for _, node := range nodes {
+			names = append(names, node.Hostname)
+		}
+
+		return names
+	}
+
+	c.Assert(hostnames("WEB", false), check.DeepEquals, []string{"web"})
+	c.Assert(hostnames("given-3", false), check.DeepEquals, []string{"db"})
+	c.Assert(hostnames("web", true), check.DeepEquals, []string{"web", "Web-1", "web_2"})
+	c.Assert(hostnames("web_", true), check.DeepEquals, []string{"web_2"})
+	c.Assert(hostnames("given-", true), check.HasLen, 4)
+	c.Assert(hostnames("%", true), check.HasLen, 0)
+	c.Assert(hostnames("nope", false), check.HasLen, 0)
+}
+
 func (s *Suite) TestGetNodeByAnyNodeKey(c *check.C) {
 	user, err := db.CreateUser("test")
 	c.Assert(err, check.IsNil)
 
-	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil)
+	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	_, err = db.GetNodeByID(0)
@@ -138,7 +176,7 @@ func (s *Suite) TestListPeers(c *check.C) {
 	user, err := db.CreateUser("test")
 	c.Assert(err, check.IsNil)
 
-	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil)
+	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	_, err = db.GetNodeByID(0)
@@ -185,7 +223,7 @@ func (s *Suite) TestGetACLFilteredPeers(c *check.C) {
 	for _, name := range []string{"test", "admin"} {
 		user, err := db.CreateUser(name)
 		c.Assert(err, check.IsNil)
-		pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil)
+		pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil, nil)
 		c.Assert(err, check.IsNil)
 		stor = append(stor, base{user, pak})
 	}
@@ -217,7 +255,7 @@ func (s *Suite) TestGetACLFilteredPeers(c *check.C) {
 		Groups: map[string][]string{
 			"group:test": {"admin"},
 		},
-		Hosts:     map[string]netip.Prefix{},
+		Hosts:     policy.Hosts{},
 		TagOwners: map[string][]string{},
 		ACLs: []policy.ACL{
 			{
@@ -274,7 +312,7 @@ func (s *Suite) TestExpireNode(c *check.C) {
 	user, err := db.CreateUser("test")
 	c.Assert(err, check.IsNil)
 
-	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil)
+	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	_, err = db.getNode("test", "testnode")
@@ -316,7 +354,7 @@ func (s *Suite) TestGenerateGivenName(c *check.C) {
 	user1, err := db.CreateUser("user-1")
 	c.Assert(err, check.IsNil)
 
-	pak, err := db.CreatePreAuthKey(user1.Name, false, false, nil, nil)
+	pak, err := db.CreatePreAuthKey(user1.Name, false, false, nil, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	_, err = db.getNode("user-1", "testnode")
@@ -362,7 +400,7 @@ func (s *Suite) TestSetTags(c *check.C) {
 	user, err := db.CreateUser("test")
 	c.Assert(err, check.IsNil)
 
-	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil)
+	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	_, err = db.getNode("test", "testnode")
@@ -552,7 +590,7 @@ func (s *Suite) TestAutoApproveRoutes(c *check.C) {
 	user, err := db.CreateUser("test")
 	c.Assert(err, check.IsNil)
 
-	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil)
+	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	nodeKey := key.NewNode()
@@ -599,3 +637,41 @@ func (s *Suite) TestAutoApproveRoutes(c *check.C) {
 	c.Assert(err, check.IsNil)
 	c.Assert(enabledRoutes, check.HasLen, 4)
 }
+
+func TestEphemeralGarbageCollector(t *testing.T) {
+	deleted := make(chan types.NodeID, 10)
+	gc := NewEphemeralGarbageCollector(func(ni types.NodeID) {
+		deleted <- ni
+	})
+	go gc.Start()
+	defer gc.Close()
+
+	gc.Schedule(1, 10*time.Millisecond)
+	gc.Schedule(2, 10*time.Millisecond)
+	gc.Schedule(3, 10*time.Millisecond)
+
+	// Node 2 reconnects, and node 3 disconnects again later.
+	gc.Cancel(2)
+	gc.Schedule(3, 100*time.Millisecond)
+
+	var got []types.NodeID
+	timeout := time.After(time.Second)
+	for len(got) < 2 {
+		select {
+		case ni := <-deleted:
+			got = append(got, ni)
+		case <-timeout:
+			t.Fatalf("timed out waiting for deletions, got %v", got)
+		}
+	}
+
+	if diff := cmp.Diff([]types.NodeID{1, 3}, got); diff != "" {
+		t.Errorf("deleted nodes unexpected result (-want +got):\n%s", diff)
+	}
+
+	select {
+	case ni := <-deleted:
+		t.Errorf("node %d deleted more than once or after cancel", ni)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,436 @@
+package db
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"tailscale.com/types/key"
+)
+
+const nodeStorePluginName = "headscale:nodestore"
+
+// NodeStore keeps all the nodes in memory, so generating the maps of a
+// large tailnet does not read every node from the database for every
+// node. It is a gorm plugin: the writes to the nodes and their routes,
+// through gorm or through HSDatabase.Write, mark the nodes they wrote,
+// and only these nodes are read again from the database on the next
+// read. The writes which cannot be told apart, to the users and pre auth
+// keys, raw statements and bulk updates, read all the nodes again.
+//
+// The nodes it returns are copies, they can be changed by the caller.
+type NodeStore struct {
+	disabled atomic.Bool
+
+	// pending are the nodes written since they were last read, all
+	// is set when all of them must be read again.
+	pendingMu sync.Mutex
+	pending   map[types.NodeID]bool
+	all       bool
+
+	mu           sync.Mutex
+	loaded       bool
+	nodes        types.Nodes
+	byID         map[types.NodeID]*types.Node
+	byMachineKey map[key.MachinePublic]*types.Node
+	byNodeKey    map[key.NodePublic]*types.Node
+}
+
+func newNodeStore() *NodeStore {
+	return &NodeStore{}
+}
+
+// Name implements gorm.Plugin.
+func (s *NodeStore) Name() string {
+	return nodeStorePluginName
+}
+
+// Initialize implements gorm.Plugin, it marks the nodes written by the
+// writes to their tables. The writes made in a transaction mark them
+// again once committed, see Write.
+func (s *NodeStore) Initialize(db *gorm.DB) error {
+	written := func(tx *gorm.DB) {
+		ids, all := writtenNodes(tx.Statement)
+		s.markWritten(tx.Statement.Context, ids, all)
+	}
+
+	callbacks := db.Callback()
+	for _, register := range []func() error{
+		func() error {
+			return callbacks.Create().After("gorm:commit_or_rollback_transaction").Register(nodeStorePluginName, written)
+		},
+		func() error {
+			return callbacks.Update().After("gorm:commit_or_rollback_transaction").Register(nodeStorePluginName, written)
+		},
+		func() error {
+			return callbacks.Delete().After("gorm:commit_or_rollback_transaction").Register(nodeStorePluginName, written)
+		},
+		func() error {
+			// Raw statements cannot be told apart, they always
+			// read all the nodes again.
+			return callbacks.Raw().After("gorm:raw").Register(nodeStorePluginName, func(tx *gorm.DB) {
+				s.markWritten(tx.Statement.Context, nil, true)
+			})
+		},
+	} {
+		if err := register(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writtenNodes returns the IDs of the nodes written by the statement,
+// from the nodes or routes it wrote or its condition on their ID. all is
+// true when they cannot be told.
+func writtenNodes(stmt *gorm.Statement) ([]types.NodeID, bool) {
+	var column string
+	switch stmt.Table {
+	case "nodes":
+		column = "id"
+	case "routes":
+		column = "node_id"
+	case "users", "pre_auth_keys":
+		// Saving a node creates its user and pre auth key if they do
+		// not exist, which does not change the other nodes.
+		if conflict, ok := stmt.Clauses["ON CONFLICT"].Expression.(clause.OnConflict); ok && conflict.DoNothing {
+			return nil, false
+		}
+
+		return nil, true
+	case "":
+		return nil, true
+	default:
+		return nil, false
+	}
+
+	var ids []types.NodeID
+	valid := true
+	add := func(value reflect.Value) {
+		var id types.NodeID
+		switch value := reflect.Indirect(value).Interface().(type) {
+		case types.Node:
+			id = value.ID
+		case types.Route:
+			id = types.NodeID(value.NodeID)
+		}
+		if id == 0 {
+			valid = false
+		}
+		ids = append(ids, id)
+	}
+
+	switch value := reflect.Indirect(stmt.ReflectValue); value.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := range value.Len() {
+			add(value.Index(i))
+		}
+	case reflect.Struct:
+		add(value)
+	default:
+		valid = false
+	}
+	if valid && len(ids) > 0 {
+		return ids, false
+	}
+
+	// The updates of a model without ID, like
+	// Model(&types.Node{}).Where("id = ?", id).
+	if id, ok := whereNodeID(stmt, column); ok {
+		return []types.NodeID{id}, false
+	}
+
+	return nil, true
+}
+
+// whereNodeID returns the node ID of a statement with a condition like
+// "id = ?", or "node_id = ? AND ..." for the routes.
+func whereNodeID(stmt *gorm.Statement, column string) (types.NodeID, bool) {
+	where, ok := stmt.Clauses["WHERE"].Expression.(clause.Where)
+	if !ok {
+		return 0, false
+	}
+
+	for _, expr := range where.Exprs {
+		expr, ok := expr.(clause.Expr)
+		if !ok || len(expr.Vars) == 0 {
+			continue
+		}
+		if expr.SQL != column+" = ?" && !strings.HasPrefix(expr.SQL, column+" = ? AND ") {
+			continue
+		}
+
+		switch id := expr.Vars[0].(type) {
+		case types.NodeID:
+			return id, true
+		case uint64:
+			return types.NodeID(id), true
+		}
+	}
+
+	return 0, false
+}
+
+type nodeStoreWritesKey struct{}
+
+// nodeStoreWrites collects the nodes written in a transaction, to mark
+// them again once it is committed.
+type nodeStoreWrites struct {
+	mu  sync.Mutex
+	ids []types.NodeID
+	all bool
+}
+
+// nodeStoreOf returns the store of the database, or nil.
+func nodeStoreOf(db *gorm.DB) *NodeStore {
+	if plugin, ok := db.Config.Plugins[nodeStorePluginName]; ok {
+		return plugin.(*NodeStore)
+	}
+
+	return nil
+}
+
+// markWritten marks the nodes to be read again, all of them if all is
+// set. The writes of a transaction started by Write are also collected
+// in its context.
+func (s *NodeStore) markWritten(ctx context.Context, ids []types.NodeID, all bool) {
+	if s == nil || (len(ids) == 0 && !all) {
+		return
+	}
+
+	if ctx != nil {
+		if writes, ok := ctx.Value(nodeStoreWritesKey{}).(*nodeStoreWrites); ok {
+			writes.mu.Lock()
+			writes.ids = append(writes.ids, ids...)
+			writes.all = writes.all || all
+			writes.mu.Unlock()
+		}
+	}
+
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+
+	if all {
+		s.all = true
+
+		return
+	}
+
+	if s.pending == nil {
+		s.pending = make(map[types.NodeID]bool)
+	}
+	for _, id := range ids {
+		s.pending[id] = true
+	}
+}
+
+// committed marks the nodes written by a transaction again after it is
+// committed, as the reads made during the transaction could have read
+// them before the commit.
+func (s *NodeStore) committed(writes *nodeStoreWrites) {
+	writes.mu.Lock()
+	defer writes.mu.Unlock()
+
+	s.markWritten(nil, writes.ids, writes.all)
+}
+
+// takePending returns the nodes to read again, and clears them.
+func (s *NodeStore) takePending() (map[types.NodeID]bool, bool) {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+
+	pending, all := s.pending, s.all
+	s.pending, s.all = nil, false
+
+	return pending, all
+}
+
+// Invalidate drops the nodes, they are all read again on the next read.
+func (s *NodeStore) Invalidate() {
+	s.markWritten(nil, nil, true)
+}
+
+// Disable makes the store read from the database every time, for when
+// other processes write to the database, like the other instances with
+// HA.
+func (s *NodeStore) Disable() {
+	s.disabled.Store(true)
+}
+
+// load makes sure the nodes are current, and calls fn with them while
+// holding the lock.
+func (s *NodeStore) load(db *gorm.DB, fn func()) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending, all := s.takePending()
+	if s.disabled.Load() || !s.loaded || all {
+		if err := s.loadAll(db); err != nil {
+			s.markWritten(nil, nil, true)
+
+			return err
+		}
+	} else {
+		for id := range pending {
+			if err := s.loadNode(db, id); err != nil {
+				ids := make([]types.NodeID, 0, len(pending))
+				for id := range pending {
+					ids = append(ids, id)
+				}
+				s.markWritten(nil, ids, false)
+
+				return err
+			}
+		}
+	}
+
+	fn()
+
+	return nil
+}
+
+// loadAll reads all the nodes from the database.
+func (s *NodeStore) loadAll(db *gorm.DB) error {
+	nodes, err := ListNodes(db)
+	if err != nil {
+		return err
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+
+	s.nodes = nodes
+	s.byID = make(map[types.NodeID]*types.Node, len(nodes))
+	s.byMachineKey = make(map[key.MachinePublic]*types.Node, len(nodes))
+	s.byNodeKey = make(map[key.NodePublic]*types.Node, len(nodes))
+	for _, node := range nodes {
+		s.byID[node.ID] = node
+		s.byMachineKey[node.MachineKey] = node
+		s.byNodeKey[node.NodeKey] = node
+	}
+
+	s.loaded = true
+	nodeStoreLoads.Inc()
+
+	return nil
+}
+
+// loadNode reads the node with the ID from the database, and replaces
+// it in the store, or removes it if it was deleted.
+func (s *NodeStore) loadNode(db *gorm.DB, id types.NodeID) error {
+	node, err := GetNodeByID(db, id)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	index, found := sort.Find(len(s.nodes), func(i int) int {
+		return cmp.Compare(id, s.nodes[i].ID)
+	})
+	if found {
+		previous := s.nodes[index]
+		delete(s.byMachineKey, previous.MachineKey)
+		delete(s.byNodeKey, previous.NodeKey)
+		delete(s.byID, id)
+	}
+
+	switch {
+	case node == nil && found:
+		s.nodes = slices.Delete(s.nodes, index, index+1)
+	case node != nil && found:
+		s.nodes[index] = node
+	case node != nil:
+		s.nodes = slices.Insert(s.nodes, index, node)
+	}
+
+	if node != nil {
+		s.byID[node.ID] = node
+		s.byMachineKey[node.MachineKey] = node
+		s.byNodeKey[node.NodeKey] = node
+	}
+	nodeStoreNodeLoads.Inc()
+
+	return nil
+}
+
+// ListNodes returns all the nodes, sorted by ID.
+func (s *NodeStore) ListNodes(db *gorm.DB) (types.Nodes, error) {
+	var ret types.Nodes
+	err := s.load(db, func() {
+		ret = make(types.Nodes, 0, len(s.nodes))
+		for _, node := range s.nodes {
+			ret = append(ret, node.Clone())
+		}
+	})
+
+	return ret, err
+}
+
+// ListPeers returns all the nodes except the given one, sorted by ID.
+func (s *NodeStore) ListPeers(db *gorm.DB, nodeID types.NodeID) (types.Nodes, error) {
+	var ret types.Nodes
+	err := s.load(db, func() {
+		ret = make(types.Nodes, 0, len(s.nodes))
+		for _, node := range s.nodes {
+			if node.ID != nodeID {
+				ret = append(ret, node.Clone())
+			}
+		}
+	})
+
+	return ret, err
+}
+
+// GetNodeByID returns the node with the ID.
+func (s *NodeStore) GetNodeByID(db *gorm.DB, id types.NodeID) (*types.Node, error) {
+	return s.get(db,
+		func() *types.Node { return s.byID[id] },
+		func() (*types.Node, error) { return GetNodeByID(db, id) },
+	)
+}
+
+// GetNodeByMachineKey returns the node with the machine key.
+func (s *NodeStore) GetNodeByMachineKey(db *gorm.DB, machineKey key.MachinePublic) (*types.Node, error) {
+	return s.get(db,
+		func() *types.Node { return s.byMachineKey[machineKey] },
+		func() (*types.Node, error) { return GetNodeByMachineKey(db, machineKey) },
+	)
+}
+
+// GetNodeByNodeKey returns the node with the node key.
+func (s *NodeStore) GetNodeByNodeKey(db *gorm.DB, nodeKey key.NodePublic) (*types.Node, error) {
+	return s.get(db,
+		func() *types.Node { return s.byNodeKey[nodeKey] },
+		func() (*types.Node, error) { return GetNodeByNodeKey(db, nodeKey) },
+	)
+}
+
+// get returns a copy of the node found by lookup, the nodes which are
+// not in the store are looked up in the database with query.
+func (s *NodeStore) get(
+	db *gorm.DB,
+	lookup func() *types.Node,
+	query func() (*types.Node, error),
+) (*types.Node, error) {
+	var ret *types.Node
+	err := s.load(db, func() {
+		if node := lookup(); node != nil {
+			ret = node.Clone()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ret == nil {
+		return query()
+	}
+
+	return ret, nil
+}
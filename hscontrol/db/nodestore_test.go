@@ -0,0 +1,87 @@
+package db
+
+import (
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"gopkg.in/check.v1"
+	"gorm.io/gorm"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func (s *Suite) TestNodeStore(c *check.C) {
+	user, err := db.CreateUser("test")
+	c.Assert(err, check.IsNil)
+
+	for _, name := range []string{"first", "second"} {
+		node := types.Node{
+			MachineKey:     key.NewMachine().Public(),
+			NodeKey:        key.NewNode().Public(),
+			Hostname:       name,
+			GivenName:      name,
+			UserID:         user.ID,
+			RegisterMethod: util.RegisterMethodAuthKey,
+			Hostinfo:       &tailcfg.Hostinfo{},
+		}
+		c.Assert(db.DB.Save(&node).Error, check.IsNil)
+	}
+
+	store := db.NodeStore()
+	stored := func(id types.NodeID) *types.Node {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+
+		return store.byID[id]
+	}
+
+	nodes, err := db.ListNodes()
+	c.Assert(err, check.IsNil)
+	c.Assert(nodes, check.HasLen, 2)
+	c.Assert(nodes[0].User.Name, check.Equals, "test")
+	first, second := stored(nodes[0].ID), stored(nodes[1].ID)
+
+	// Reading again does not reload, and changing the returned nodes
+	// does not change the store.
+	nodes[0].Hostinfo.OS = "changed"
+	peers, err := db.ListPeers(nodes[0].ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(peers, check.HasLen, 1)
+	c.Assert(peers[0].Hostname, check.Equals, "second")
+
+	node, err := db.GetNodeByMachineKey(nodes[0].MachineKey)
+	c.Assert(err, check.IsNil)
+	c.Assert(node.Hostinfo.OS, check.Equals, "")
+	c.Assert(stored(nodes[0].ID) == first, check.Equals, true)
+
+	// A write through gorm is read back, only the node it wrote is
+	// read again.
+	c.Assert(RenameNode(db.DB, nodes[0].ID.Uint64(), "renamed"), check.IsNil)
+	node, err = db.GetNodeByID(nodes[0].ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(node.GivenName, check.Equals, "renamed")
+	c.Assert(stored(nodes[0].ID) == first, check.Equals, false)
+	c.Assert(stored(nodes[1].ID) == second, check.Equals, true)
+
+	// A write in a transaction to the users of the nodes reads all the
+	// nodes again.
+	err = db.Write(func(tx *gorm.DB) error {
+		return RenameUser(tx, "test", "renamed")
+	})
+	c.Assert(err, check.IsNil)
+	node, err = db.GetNodeByNodeKey(nodes[1].NodeKey)
+	c.Assert(err, check.IsNil)
+	c.Assert(node.User.Name, check.Equals, "renamed")
+	c.Assert(stored(nodes[1].ID) == second, check.Equals, false)
+
+	// A deleted node is removed from the store.
+	c.Assert(db.DB.Unscoped().Delete(&types.Node{ID: nodes[1].ID}).Error, check.IsNil)
+	nodes, err = db.ListNodes()
+	c.Assert(err, check.IsNil)
+	c.Assert(nodes, check.HasLen, 1)
+	_, err = db.GetNodeByNodeKey(node.NodeKey)
+	c.Assert(err, check.Equals, gorm.ErrRecordNotFound)
+
+	// The nodes unknown to the store are looked up in the database.
+	_, err = db.GetNodeByID(42)
+	c.Assert(err, check.Equals, gorm.ErrRecordNotFound)
+}
@@ -0,0 +1,43 @@
+package db
+
+import (
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gorm.io/gorm"
+)
+
+func (hsdb *HSDatabase) SetOIDCSession(session *types.OIDCSession) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return SetOIDCSession(tx, session)
+	})
+}
+
+// SetOIDCSession stores the OIDC session of a node, replacing the
+// previous one.
+func SetOIDCSession(tx *gorm.DB, session *types.OIDCSession) error {
+	return tx.Save(session).Error
+}
+
+func (hsdb *HSDatabase) ListOIDCSessions() ([]types.OIDCSession, error) {
+	return Read(hsdb.DB, ListOIDCSessions)
+}
+
+// ListOIDCSessions returns the OIDC sessions of all the nodes.
+func ListOIDCSessions(tx *gorm.DB) ([]types.OIDCSession, error) {
+	var sessions []types.OIDCSession
+	if err := tx.Order("node_id").Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+func (hsdb *HSDatabase) DeleteOIDCSession(nodeID types.NodeID) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return DeleteOIDCSession(tx, nodeID)
+	})
+}
+
+// DeleteOIDCSession deletes the OIDC session of a node, if any.
+func DeleteOIDCSession(tx *gorm.DB, nodeID types.NodeID) error {
+	return tx.Delete(&types.OIDCSession{}, "node_id = ?", nodeID).Error
+}
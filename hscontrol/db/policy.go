@@ -0,0 +1,66 @@
+package db
+
+import (
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gorm.io/gorm"
+)
+
+func (hsdb *HSDatabase) GetPolicy() (*types.Policy, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (*types.Policy, error) {
+		return GetPolicy(rx)
+	})
+}
+
+// GetPolicy returns the latest version of the policy, or
+// gorm.ErrRecordNotFound if no policy was set.
+func GetPolicy(tx *gorm.DB) (*types.Policy, error) {
+	var pol types.Policy
+	if err := tx.Order("id DESC").First(&pol).Error; err != nil {
+		return nil, err
+	}
+
+	return &pol, nil
+}
+
+func (hsdb *HSDatabase) GetPolicyVersion(version uint64) (*types.Policy, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (*types.Policy, error) {
+		return GetPolicyVersion(rx, version)
+	})
+}
+
+// GetPolicyVersion returns the given version of the policy.
+func GetPolicyVersion(tx *gorm.DB, version uint64) (*types.Policy, error) {
+	var pol types.Policy
+	if err := tx.First(&pol, "id = ?", version).Error; err != nil {
+		return nil, err
+	}
+
+	return &pol, nil
+}
+
+func (hsdb *HSDatabase) ListPolicyVersions() ([]types.Policy, error) {
+	return Read(hsdb.ReadDB(), func(rx *gorm.DB) ([]types.Policy, error) {
+		return ListPolicyVersions(rx)
+	})
+}
+
+// ListPolicyVersions returns all the versions of the policy, the
+// latest first.
+func ListPolicyVersions(tx *gorm.DB) ([]types.Policy, error) {
+	var versions []types.Policy
+	if err := tx.Order("id DESC").Find(&versions).Error; err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// SetPolicy stores a new version of the policy.
+func SetPolicy(tx *gorm.DB, data string) (*types.Policy, error) {
+	pol := types.Policy{Data: data}
+	if err := tx.Create(&pol).Error; err != nil {
+		return nil, err
+	}
+
+	return &pol, nil
+}
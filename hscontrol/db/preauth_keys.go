@@ -5,6 +5,8 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"net/netip"
+	"slices"
 	"strings"
 	"time"
 
@@ -18,6 +20,8 @@ var (
 	ErrSingleUseAuthKeyHasBeenUsed = errors.New("AuthKey has already been used")
 	ErrUserMismatch                = errors.New("user mismatch")
 	ErrPreAuthKeyACLTagInvalid     = errors.New("AuthKey tag is invalid")
+	ErrPreAuthKeyLimitInvalid      = errors.New("AuthKey limit is invalid")
+	ErrPreAuthKeyUsesExhausted     = errors.New("AuthKey has reached its maximum number of uses")
 )
 
 func (hsdb *HSDatabase) CreatePreAuthKey(
@@ -26,13 +30,15 @@ func (hsdb *HSDatabase) CreatePreAuthKey(
 	ephemeral bool,
 	expiration *time.Time,
 	aclTags []string,
+	limits *types.PreAuthKeyLimits,
 ) (*types.PreAuthKey, error) {
 	return Write(hsdb.DB, func(tx *gorm.DB) (*types.PreAuthKey, error) {
-		return CreatePreAuthKey(tx, userName, reusable, ephemeral, expiration, aclTags)
+		return CreatePreAuthKey(tx, userName, reusable, ephemeral, expiration, aclTags, limits)
 	})
 }
 
 // CreatePreAuthKey creates a new PreAuthKey in a user, and returns it.
+// The limits are optional.
 func CreatePreAuthKey(
 	tx *gorm.DB,
 	userName string,
@@ -40,12 +46,25 @@ func CreatePreAuthKey(
 	ephemeral bool,
 	expiration *time.Time,
 	aclTags []string,
+	limits *types.PreAuthKeyLimits,
 ) (*types.PreAuthKey, error) {
 	user, err := GetUser(tx, userName)
 	if err != nil {
 		return nil, err
 	}
 
+	if limits == nil {
+		limits = &types.PreAuthKeyLimits{}
+	}
+	if err := validatePreAuthKeyLimits(reusable, limits); err != nil {
+		return nil, err
+	}
+
+	ipPools, err := keyIPPools(limits.IPPools)
+	if err != nil {
+		return nil, err
+	}
+
 	for _, tag := range aclTags {
 		if !strings.HasPrefix(tag, "tag:") {
 			return nil, fmt.Errorf(
@@ -70,6 +89,10 @@ func CreatePreAuthKey(
 		Ephemeral:  ephemeral,
 		CreatedAt:  &now,
 		Expiration: expiration,
+
+		MaxUses:             limits.MaxUses,
+		ExpireAfterFirstUse: limits.ExpireAfterFirstUse,
+		IPPools:             ipPools,
 	}
 
 	if err := tx.Save(&key).Error; err != nil {
@@ -95,8 +118,121 @@ func CreatePreAuthKey(
 	return &key, nil
 }
 
+// keyIPPools returns the IP pools of a key, in the form they are stored.
+func keyIPPools(pools []string) (types.StringList, error) {
+	pool4, pool6, err := types.ParseIPPools(pools)
+	if err != nil {
+		return nil, err
+	}
+
+	var ipPools types.StringList
+	for _, pool := range []*netip.Prefix{pool4, pool6} {
+		if pool != nil {
+			ipPools = append(ipPools, pool.String())
+		}
+	}
+
+	return ipPools, nil
+}
+
+func (hsdb *HSDatabase) CreatePreAuthKeyIfNotExists(
+	userName string,
+	reusable bool,
+	ephemeral bool,
+	expiration *time.Time,
+	aclTags []string,
+	limits *types.PreAuthKeyLimits,
+) (*types.PreAuthKey, error) {
+	return Write(hsdb.DB, func(tx *gorm.DB) (*types.PreAuthKey, error) {
+		key, err := FindPreAuthKey(tx, userName, reusable, ephemeral, aclTags, limits)
+		if !errors.Is(err, ErrPreAuthKeyNotFound) {
+			return key, err
+		}
+
+		return CreatePreAuthKey(tx, userName, reusable, ephemeral, expiration, aclTags, limits)
+	})
+}
+
+// FindPreAuthKey returns a PreAuthKey of a user with the settings which
+// can still be used, or ErrPreAuthKeyNotFound. The expiration is not
+// one of the settings.
+func FindPreAuthKey(
+	tx *gorm.DB,
+	userName string,
+	reusable bool,
+	ephemeral bool,
+	aclTags []string,
+	limits *types.PreAuthKeyLimits,
+) (*types.PreAuthKey, error) {
+	if limits == nil {
+		limits = &types.PreAuthKeyLimits{}
+	}
+
+	ipPools, err := keyIPPools(limits.IPPools)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := ListPreAuthKeys(tx, userName)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := sortedUnique(aclTags)
+	for index := range keys {
+		key := &keys[index]
+		if key.Reusable != reusable ||
+			key.Ephemeral != ephemeral ||
+			key.MaxUses != limits.MaxUses ||
+			key.ExpireAfterFirstUse != limits.ExpireAfterFirstUse ||
+			!slices.Equal(key.IPPools, ipPools) {
+			continue
+		}
+
+		keyTags := make([]string, len(key.ACLTags))
+		for index, tag := range key.ACLTags {
+			keyTags[index] = tag.Tag
+		}
+		if !slices.Equal(sortedUnique(keyTags), tags) {
+			continue
+		}
+
+		if _, err := ValidatePreAuthKey(tx, key.Key); err != nil {
+			continue
+		}
+
+		return key, nil
+	}
+
+	return nil, ErrPreAuthKeyNotFound
+}
+
+// sortedUnique returns the strings sorted, without duplicates.
+func sortedUnique(values []string) []string {
+	values = slices.Clone(values)
+	slices.Sort(values)
+
+	return slices.Compact(values)
+}
+
+func validatePreAuthKeyLimits(reusable bool, limits *types.PreAuthKeyLimits) error {
+	if limits.MaxUses < 0 {
+		return fmt.Errorf("%w: the maximum number of uses is negative", ErrPreAuthKeyLimitInvalid)
+	}
+
+	if limits.MaxUses > 0 && !reusable {
+		return fmt.Errorf("%w: only reusable keys have a maximum number of uses", ErrPreAuthKeyLimitInvalid)
+	}
+
+	if limits.ExpireAfterFirstUse < 0 {
+		return fmt.Errorf("%w: the expiration after the first use is negative", ErrPreAuthKeyLimitInvalid)
+	}
+
+	return nil
+}
+
 func (hsdb *HSDatabase) ListPreAuthKeys(userName string) ([]types.PreAuthKey, error) {
-	return Read(hsdb.DB, func(rx *gorm.DB) ([]types.PreAuthKey, error) {
+	return Read(hsdb.ReadDB(), func(rx *gorm.DB) ([]types.PreAuthKey, error) {
 		return ListPreAuthKeys(rx, userName)
 	})
 }
@@ -161,11 +297,39 @@ func ExpirePreAuthKey(tx *gorm.DB, k *types.PreAuthKey) error {
 	return nil
 }
 
-// UsePreAuthKey marks a PreAuthKey as used.
+// UsePreAuthKey marks a PreAuthKey as used and counts the use. The key
+// starts expiring on its first use if it has ExpireAfterFirstUse.
 func UsePreAuthKey(tx *gorm.DB, k *types.PreAuthKey) error {
+	// The count is checked in the update, concurrent registrations
+	// cannot use the key more than allowed.
+	query := tx.Model(&types.PreAuthKey{}).Where("id = ?", k.ID)
+	if k.MaxUses > 0 {
+		query = query.Where("use_count < ?", k.MaxUses)
+	}
+
+	result := query.Updates(map[string]interface{}{
+		"used":      true,
+		"use_count": gorm.Expr("use_count + 1"),
+	})
+	if result.Error != nil {
+		return fmt.Errorf("failed to update key used status in the database: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrPreAuthKeyUsesExhausted
+	}
+
+	firstUse := !k.Used
 	k.Used = true
-	if err := tx.Save(k).Error; err != nil {
-		return fmt.Errorf("failed to update key used status in the database: %w", err)
+	k.UseCount++
+
+	if firstUse && k.ExpireAfterFirstUse > 0 {
+		expiration := time.Now().Add(k.ExpireAfterFirstUse)
+		if k.Expiration == nil || expiration.Before(*k.Expiration) {
+			if err := tx.Model(k).Update("expiration", expiration).Error; err != nil {
+				return fmt.Errorf("failed to update key expiration in the database: %w", err)
+			}
+			k.Expiration = &expiration
+		}
 	}
 
 	return nil
@@ -192,7 +356,15 @@ func ValidatePreAuthKey(tx *gorm.DB, k string) (*types.PreAuthKey, error) {
 		return nil, ErrPreAuthKeyExpired
 	}
 
+	if pak.User.Deactivated {
+		return nil, ErrUserDeactivated
+	}
+
 	if pak.Reusable { // we don't need to check if has been used before
+		if pak.MaxUses > 0 && pak.UseCount >= pak.MaxUses {
+			return nil, ErrPreAuthKeyUsesExhausted
+		}
+
 		return &pak, nil
 	}
 
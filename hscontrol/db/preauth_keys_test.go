@@ -1,23 +1,25 @@
 package db
 
 import (
+	"errors"
 	"time"
 
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/puzpuzpuz/xsync/v3"
 	"gopkg.in/check.v1"
 	"gorm.io/gorm"
 )
 
 func (*Suite) TestCreatePreAuthKey(c *check.C) {
-	_, err := db.CreatePreAuthKey("bogus", true, false, nil, nil)
+	_, err := db.CreatePreAuthKey("bogus", true, false, nil, nil, nil)
 
 	c.Assert(err, check.NotNil)
 
 	user, err := db.CreateUser("test")
 	c.Assert(err, check.IsNil)
 
-	key, err := db.CreatePreAuthKey(user.Name, true, false, nil, nil)
+	key, err := db.CreatePreAuthKey(user.Name, true, false, nil, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	// Did we get a valid key?
@@ -43,7 +45,7 @@ func (*Suite) TestExpiredPreAuthKey(c *check.C) {
 	c.Assert(err, check.IsNil)
 
 	now := time.Now().Add(-5 * time.Second)
-	pak, err := db.CreatePreAuthKey(user.Name, true, false, &now, nil)
+	pak, err := db.CreatePreAuthKey(user.Name, true, false, &now, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	key, err := db.ValidatePreAuthKey(pak.Key)
@@ -61,7 +63,7 @@ func (*Suite) TestValidateKeyOk(c *check.C) {
 	user, err := db.CreateUser("test3")
 	c.Assert(err, check.IsNil)
 
-	pak, err := db.CreatePreAuthKey(user.Name, true, false, nil, nil)
+	pak, err := db.CreatePreAuthKey(user.Name, true, false, nil, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	key, err := db.ValidatePreAuthKey(pak.Key)
@@ -69,11 +71,26 @@ func (*Suite) TestValidateKeyOk(c *check.C) {
 	c.Assert(key.ID, check.Equals, pak.ID)
 }
 
+func (*Suite) TestValidateKeyDeactivatedUser(c *check.C) {
+	user, err := db.CreateUser("test-deactivated")
+	c.Assert(err, check.IsNil)
+
+	pak, err := db.CreatePreAuthKey(user.Name, true, false, nil, nil, nil)
+	c.Assert(err, check.IsNil)
+
+	_, err = db.SetUserDeactivated(user.Name, true)
+	c.Assert(err, check.IsNil)
+
+	key, err := db.ValidatePreAuthKey(pak.Key)
+	c.Assert(err, check.Equals, ErrUserDeactivated)
+	c.Assert(key, check.IsNil)
+}
+
 func (*Suite) TestAlreadyUsedKey(c *check.C) {
 	user, err := db.CreateUser("test4")
 	c.Assert(err, check.IsNil)
 
-	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil)
+	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	pakID := uint(pak.ID)
@@ -96,7 +113,7 @@ func (*Suite) TestReusableBeingUsedKey(c *check.C) {
 	user, err := db.CreateUser("test5")
 	c.Assert(err, check.IsNil)
 
-	pak, err := db.CreatePreAuthKey(user.Name, true, false, nil, nil)
+	pak, err := db.CreatePreAuthKey(user.Name, true, false, nil, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	pakID := uint(pak.ID)
@@ -115,11 +132,96 @@ func (*Suite) TestReusableBeingUsedKey(c *check.C) {
 	c.Assert(key.ID, check.Equals, pak.ID)
 }
 
+func (*Suite) TestPreAuthKeyMaxUses(c *check.C) {
+	user, err := db.CreateUser("test-max-uses")
+	c.Assert(err, check.IsNil)
+
+	pak, err := db.CreatePreAuthKey(user.Name, true, false, nil, nil, &types.PreAuthKeyLimits{MaxUses: 2})
+	c.Assert(err, check.IsNil)
+
+	for range 2 {
+		key, err := db.ValidatePreAuthKey(pak.Key)
+		c.Assert(err, check.IsNil)
+
+		err = db.Write(func(tx *gorm.DB) error {
+			return UsePreAuthKey(tx, key)
+		})
+		c.Assert(err, check.IsNil)
+	}
+
+	key, err := db.ValidatePreAuthKey(pak.Key)
+	c.Assert(err, check.Equals, ErrPreAuthKeyUsesExhausted)
+	c.Assert(key, check.IsNil)
+
+	// A key validated before the last use cannot be used again.
+	err = db.Write(func(tx *gorm.DB) error {
+		return UsePreAuthKey(tx, pak)
+	})
+	c.Assert(err, check.Equals, ErrPreAuthKeyUsesExhausted)
+
+	keys, err := db.ListPreAuthKeys(user.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(keys[0].UseCount, check.Equals, 2)
+}
+
+func (*Suite) TestPreAuthKeyExpireAfterFirstUse(c *check.C) {
+	user, err := db.CreateUser("test-first-use")
+	c.Assert(err, check.IsNil)
+
+	expiration := time.Now().Add(24 * time.Hour)
+	pak, err := db.CreatePreAuthKey(user.Name, true, false, &expiration, nil, &types.PreAuthKeyLimits{
+		ExpireAfterFirstUse: time.Hour,
+	})
+	c.Assert(err, check.IsNil)
+
+	err = db.Write(func(tx *gorm.DB) error {
+		return UsePreAuthKey(tx, pak)
+	})
+	c.Assert(err, check.IsNil)
+
+	key, err := db.ValidatePreAuthKey(pak.Key)
+	c.Assert(err, check.IsNil)
+	c.Assert(key.Expiration.Before(time.Now().Add(time.Hour+time.Minute)), check.Equals, true)
+
+	// Later uses do not move the expiration.
+	firstExpiration := *key.Expiration
+	err = db.Write(func(tx *gorm.DB) error {
+		return UsePreAuthKey(tx, key)
+	})
+	c.Assert(err, check.IsNil)
+
+	key, err = db.ValidatePreAuthKey(pak.Key)
+	c.Assert(err, check.IsNil)
+	c.Assert(key.Expiration.Equal(firstExpiration), check.Equals, true)
+}
+
+func (*Suite) TestPreAuthKeyInvalidLimits(c *check.C) {
+	user, err := db.CreateUser("test-limits")
+	c.Assert(err, check.IsNil)
+
+	_, err = db.CreatePreAuthKey(user.Name, false, false, nil, nil, &types.PreAuthKeyLimits{MaxUses: 2})
+	c.Assert(errors.Is(err, ErrPreAuthKeyLimitInvalid), check.Equals, true)
+
+	_, err = db.CreatePreAuthKey(user.Name, true, false, nil, nil, &types.PreAuthKeyLimits{MaxUses: -1})
+	c.Assert(errors.Is(err, ErrPreAuthKeyLimitInvalid), check.Equals, true)
+
+	_, err = db.CreatePreAuthKey(user.Name, true, false, nil, nil, &types.PreAuthKeyLimits{
+		IPPools: []string{"100.64.1.0/24", "100.64.2.0/24"},
+	})
+	c.Assert(errors.Is(err, types.ErrPreAuthKeyIPPoolInvalid), check.Equals, true)
+
+	pak, err := db.CreatePreAuthKey(user.Name, true, false, nil, nil, &types.PreAuthKeyLimits{
+		IPPools: []string{"fd7a:115c:a1e0:1::/64", "100.64.1.7/24"},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert([]string(pak.IPPools), check.DeepEquals, []string{"100.64.1.0/24", "fd7a:115c:a1e0:1::/64"})
+}
+
 func (*Suite) TestNotReusableNotBeingUsedKey(c *check.C) {
 	user, err := db.CreateUser("test6")
 	c.Assert(err, check.IsNil)
 
-	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil)
+	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	key, err := db.ValidatePreAuthKey(pak.Key)
@@ -131,7 +233,7 @@ func (*Suite) TestEphemeralKeyReusable(c *check.C) {
 	user, err := db.CreateUser("test7")
 	c.Assert(err, check.IsNil)
 
-	pak, err := db.CreatePreAuthKey(user.Name, true, true, nil, nil)
+	pak, err := db.CreatePreAuthKey(user.Name, true, true, nil, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	now := time.Now().Add(-time.Second * 30)
@@ -153,10 +255,7 @@ func (*Suite) TestEphemeralKeyReusable(c *check.C) {
 	_, err = db.getNode("test7", "testest")
 	c.Assert(err, check.IsNil)
 
-	db.Write(func(tx *gorm.DB) error {
-		DeleteExpiredEphemeralNodes(tx, time.Second*20)
-		return nil
-	})
+	collectEphemeralNode(c, node.ID)
 
 	// The machine record should have been deleted
 	_, err = db.getNode("test7", "testest")
@@ -167,7 +266,7 @@ func (*Suite) TestEphemeralKeyNotReusable(c *check.C) {
 	user, err := db.CreateUser("test7")
 	c.Assert(err, check.IsNil)
 
-	pak, err := db.CreatePreAuthKey(user.Name, false, true, nil, nil)
+	pak, err := db.CreatePreAuthKey(user.Name, false, true, nil, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	now := time.Now().Add(-time.Second * 30)
@@ -188,10 +287,7 @@ func (*Suite) TestEphemeralKeyNotReusable(c *check.C) {
 	_, err = db.getNode("test7", "testest")
 	c.Assert(err, check.IsNil)
 
-	db.Write(func(tx *gorm.DB) error {
-		DeleteExpiredEphemeralNodes(tx, time.Second*20)
-		return nil
-	})
+	collectEphemeralNode(c, node.ID)
 
 	// The machine record should have been deleted
 	_, err = db.getNode("test7", "testest")
@@ -202,7 +298,7 @@ func (*Suite) TestExpirePreauthKey(c *check.C) {
 	user, err := db.CreateUser("test3")
 	c.Assert(err, check.IsNil)
 
-	pak, err := db.CreatePreAuthKey(user.Name, true, false, nil, nil)
+	pak, err := db.CreatePreAuthKey(user.Name, true, false, nil, nil, nil)
 	c.Assert(err, check.IsNil)
 	c.Assert(pak.Expiration, check.IsNil)
 
@@ -219,7 +315,7 @@ func (*Suite) TestNotReusableMarkedAsUsed(c *check.C) {
 	user, err := db.CreateUser("test6")
 	c.Assert(err, check.IsNil)
 
-	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil)
+	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil, nil)
 	c.Assert(err, check.IsNil)
 	pak.Used = true
 	db.DB.Save(&pak)
@@ -232,15 +328,64 @@ func (*Suite) TestPreAuthKeyACLTags(c *check.C) {
 	user, err := db.CreateUser("test8")
 	c.Assert(err, check.IsNil)
 
-	_, err = db.CreatePreAuthKey(user.Name, false, false, nil, []string{"badtag"})
+	_, err = db.CreatePreAuthKey(user.Name, false, false, nil, []string{"badtag"}, nil)
 	c.Assert(err, check.NotNil) // Confirm that malformed tags are rejected
 
 	tags := []string{"tag:test1", "tag:test2"}
 	tagsWithDuplicate := []string{"tag:test1", "tag:test2", "tag:test2"}
-	_, err = db.CreatePreAuthKey(user.Name, false, false, nil, tagsWithDuplicate)
+	_, err = db.CreatePreAuthKey(user.Name, false, false, nil, tagsWithDuplicate, nil)
 	c.Assert(err, check.IsNil)
 
 	listedPaks, err := db.ListPreAuthKeys("test8")
 	c.Assert(err, check.IsNil)
 	c.Assert(listedPaks[0].Proto().GetAclTags(), check.DeepEquals, tags)
 }
+
+func (*Suite) TestCreatePreAuthKeyIfNotExists(c *check.C) {
+	user, err := db.CreateUser("test9")
+	c.Assert(err, check.IsNil)
+
+	tags := []string{"tag:test1"}
+	pak, err := db.CreatePreAuthKeyIfNotExists(user.Name, true, false, nil, tags, nil)
+	c.Assert(err, check.IsNil)
+
+	existing, err := db.CreatePreAuthKeyIfNotExists(user.Name, true, false, nil, tags, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(existing.ID, check.Equals, pak.ID)
+
+	otherTags, err := db.CreatePreAuthKeyIfNotExists(user.Name, true, false, nil, []string{"tag:test2"}, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(otherTags.ID, check.Not(check.Equals), pak.ID)
+
+	notReusable, err := db.CreatePreAuthKeyIfNotExists(user.Name, false, false, nil, tags, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(notReusable.ID, check.Not(check.Equals), pak.ID)
+
+	err = db.ExpirePreAuthKey(pak)
+	c.Assert(err, check.IsNil)
+
+	renewed, err := db.CreatePreAuthKeyIfNotExists(user.Name, true, false, nil, tags, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(renewed.ID, check.Not(check.Equals), pak.ID)
+}
+
+// collectEphemeralNode runs the node through an ephemeral garbage
+// collector deleting it from the database.
+func collectEphemeralNode(c *check.C, nodeID types.NodeID) {
+	done := make(chan error)
+	gc := NewEphemeralGarbageCollector(func(ni types.NodeID) {
+		node, err := db.GetNodeByID(ni)
+		if err != nil {
+			done <- err
+			return
+		}
+
+		_, err = db.DeleteNode(node, xsync.NewMapOf[types.NodeID, bool]())
+		done <- err
+	})
+	go gc.Start()
+	defer gc.Close()
+
+	gc.Schedule(nodeID, 0)
+	c.Assert(<-done, check.IsNil)
+}
@@ -4,12 +4,13 @@ import (
 	"errors"
 	"fmt"
 	"net/netip"
+	"slices"
 	"sort"
 
 	"github.com/juanfont/headscale/hscontrol/policy"
 	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
 	"github.com/puzpuzpuz/xsync/v3"
-	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
 	"tailscale.com/util/set"
 )
@@ -43,7 +44,9 @@ func getAdvertisedAndEnabledRoutes(tx *gorm.DB) (types.Routes, error) {
 	return routes, nil
 }
 
-func getRoutesByPrefix(tx *gorm.DB, pref netip.Prefix) (types.Routes, error) {
+// getRoutesByPrefix returns the routes for the prefix of the nodes of
+// the tailnet, the routers of the other tailnets are not failed over to.
+func getRoutesByPrefix(tx *gorm.DB, pref netip.Prefix, tailnet string) (types.Routes, error) {
 	var routes types.Routes
 	err := tx.
 		Preload("Node").
@@ -54,7 +57,9 @@ func getRoutesByPrefix(tx *gorm.DB, pref netip.Prefix) (types.Routes, error) {
 		return nil, err
 	}
 
-	return routes, nil
+	return slices.DeleteFunc(routes, func(route types.Route) bool {
+		return route.Node.User.Tailnet != tailnet
+	}), nil
 }
 
 func GetNodeAdvertisedRoutes(tx *gorm.DB, node *types.Node) (types.Routes, error) {
@@ -104,6 +109,21 @@ func GetRoute(tx *gorm.DB, id uint64) (*types.Route, error) {
 	return &route, nil
 }
 
+// GetRouteByNodePrefix returns the route of the node for the prefix.
+func GetRouteByNodePrefix(tx *gorm.DB, nodeID types.NodeID, pref netip.Prefix) (*types.Route, error) {
+	var route types.Route
+	err := tx.
+		Preload("Node").
+		Preload("Node.User").
+		Where("node_id = ? AND prefix = ?", nodeID, types.IPPrefix(pref)).
+		First(&route).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &route, nil
+}
+
 func EnableRoute(tx *gorm.DB, id uint64) (*types.StateUpdate, error) {
 	route, err := GetRoute(tx, id)
 	if err != nil {
@@ -280,16 +300,17 @@ func deleteNodeRoutes(tx *gorm.DB, node *types.Node, isLikelyConnected *xsync.Ma
 	return changed, nil
 }
 
-// isUniquePrefix returns if there is another node providing the same route already.
-func isUniquePrefix(tx *gorm.DB, route types.Route) bool {
-	var count int64
-	tx.Model(&types.Route{}).
-		Where("prefix = ? AND node_id != ? AND advertised = ? AND enabled = ?",
-			route.Prefix,
-			route.NodeID,
-			true, true).Count(&count)
+// isUniquePrefix returns if there is another node of the tailnet
+// providing the same route already.
+func isUniquePrefix(tx *gorm.DB, route types.Route, tailnet string) bool {
+	routes, err := getRoutesByPrefix(tx, netip.Prefix(route.Prefix), tailnet)
+	if err != nil {
+		return true
+	}
 
-	return count == 0
+	return !slices.ContainsFunc(routes, func(other types.Route) bool {
+		return other.NodeID != route.NodeID && other.Advertised && other.Enabled
+	})
 }
 
 func getPrimaryRoute(tx *gorm.DB, prefix netip.Prefix) (*types.Route, error) {
@@ -354,7 +375,7 @@ func SaveNodeRoutes(tx *gorm.DB, node *types.Node) (bool, error) {
 		advertisedRoutes[prefix] = false
 	}
 
-	log.Trace().
+	util.LogDB.Trace().
 		Str("node", node.Hostname).
 		Interface("advertisedRoutes", advertisedRoutes).
 		Interface("currentRoutes", currentRoutes).
@@ -408,10 +429,13 @@ func SaveNodeRoutes(tx *gorm.DB, node *types.Node) (bool, error) {
 // FailoverNodeRoutesIfNeccessary takes a node and checks if the node's route
 // need to be failed over to another host.
 // If needed, the failover will be attempted.
+// The routes of the nodes held down by heldDown, which can be nil, only
+// become primary if no other route is available.
 func FailoverNodeRoutesIfNeccessary(
 	tx *gorm.DB,
 	isLikelyConnected *xsync.MapOf[types.NodeID, bool],
 	node *types.Node,
+	heldDown func(types.NodeID) bool,
 ) (*types.StateUpdate, error) {
 	nodeRoutes, err := GetNodeRoutes(tx, node)
 	if err != nil {
@@ -422,21 +446,25 @@ func FailoverNodeRoutesIfNeccessary(
 
 nodeRouteLoop:
 	for _, nodeRoute := range nodeRoutes {
-		routes, err := getRoutesByPrefix(tx, netip.Prefix(nodeRoute.Prefix))
+		routes, err := getRoutesByPrefix(tx, netip.Prefix(nodeRoute.Prefix), nodeRoute.Node.User.Tailnet)
 		if err != nil {
 			return nil, fmt.Errorf("getting routes by prefix: %w", err)
 		}
 
 		for _, route := range routes {
 			if route.IsPrimary {
+				prefix := netip.Prefix(route.Prefix).String()
+
 				// if we have a primary route, and the node is connected
-				// nothing needs to be done.
-				if val, ok := isLikelyConnected.Load(route.Node.ID); ok && val {
+				// and not isolated, nothing needs to be done.
+				if val, ok := isLikelyConnected.Load(route.Node.ID); ok && val && !route.Node.IsIsolated() {
+					routePrefixUnreachable.WithLabelValues(prefix).Set(0)
+
 					continue nodeRouteLoop
 				}
 
 				// if not, we need to failover the route
-				failover := failoverRoute(isLikelyConnected, &route, routes)
+				failover := failoverRoute(isLikelyConnected, &route, routes, heldDown)
 				if failover != nil {
 					err := failover.save(tx)
 					if err != nil {
@@ -445,9 +473,24 @@ nodeRouteLoop:
 
 					changedNodes.Add(failover.old.Node.ID)
 					changedNodes.Add(failover.new.Node.ID)
+					routePrefixUnreachable.WithLabelValues(prefix).Set(0)
 
 					continue nodeRouteLoop
 				}
+
+				// The primary is offline and there is nothing to
+				// fail over to, the dead primary is kept, but the
+				// prefix cannot be reached by anyone.
+				if !route.IsExitRoute() {
+					util.LogDB.Warn().
+						Uint64("route", uint64(route.ID)).
+						Str("hostname", route.Node.Hostname).
+						Msgf("prefix %s has no reachable router", prefix)
+					routePrefixUnreachable.WithLabelValues(prefix).Set(1)
+					routePrefixUnreachableTotal.WithLabelValues(prefix).Inc()
+				}
+
+				continue nodeRouteLoop
 			}
 		}
 	}
@@ -496,12 +539,12 @@ func failoverRouteTx(
 		return nil, nil
 	}
 
-	routes, err := getRoutesByPrefix(tx, netip.Prefix(r.Prefix))
+	routes, err := getRoutesByPrefix(tx, netip.Prefix(r.Prefix), r.Node.User.Tailnet)
 	if err != nil {
 		return nil, fmt.Errorf("getting routes by prefix: %w", err)
 	}
 
-	fo := failoverRoute(isLikelyConnected, r, routes)
+	fo := failoverRoute(isLikelyConnected, r, routes, nil)
 	if fo == nil {
 		return nil, nil
 	}
@@ -511,7 +554,7 @@ func failoverRouteTx(
 		return nil, fmt.Errorf("saving failover route: %w", err)
 	}
 
-	log.Trace().
+	util.LogDB.Trace().
 		Str("hostname", fo.new.Node.Hostname).
 		Msgf("set primary to new route, was: id(%d), host(%s), now: id(%d), host(%s)", fo.old.ID, fo.old.Node.Hostname, fo.new.ID, fo.new.Node.Hostname)
 
@@ -535,14 +578,20 @@ func (f *failover) save(tx *gorm.DB) error {
 		return fmt.Errorf("saving new primary: %w", err)
 	}
 
+	routeFailovers.WithLabelValues(netip.Prefix(f.new.Prefix).String()).Inc()
+
 	return nil
 }
 
+// failoverRoute returns the failover of the primary route to the first
+// enabled route of a connected node which is not isolated. The routes of the nodes held down
+// by heldDown, which can be nil, are only chosen if no other route is
+// available.
 func failoverRoute(
 	isLikelyConnected *xsync.MapOf[types.NodeID, bool],
 	routeToReplace *types.Route,
 	altRoutes types.Routes,
-
+	heldDown func(types.NodeID) bool,
 ) *failover {
 	if routeToReplace == nil {
 		return nil
@@ -559,7 +608,7 @@ func failoverRoute(
 		return nil
 	}
 
-	var newPrimary *types.Route
+	var newPrimary, heldDownPrimary *types.Route
 
 	// Find a new suitable route
 	for idx, route := range altRoutes {
@@ -571,14 +620,35 @@ func failoverRoute(
 			continue
 		}
 
+		// The isolated nodes are cut off from the tailnet, they
+		// cannot serve the route.
+		if route.Node.IsIsolated() {
+			continue
+		}
+
 		if isLikelyConnected != nil {
 			if val, ok := isLikelyConnected.Load(route.Node.ID); ok && val {
+				if heldDown != nil && heldDown(route.Node.ID) {
+					if heldDownPrimary == nil {
+						heldDownPrimary = &altRoutes[idx]
+					}
+
+					continue
+				}
+
 				newPrimary = &altRoutes[idx]
 				break
 			}
 		}
 	}
 
+	// A held down route is better than no route at all.
+	if newPrimary == nil && heldDownPrimary != nil {
+		newPrimary = heldDownPrimary
+	} else if newPrimary != nil && heldDownPrimary != nil {
+		routeFailoversDampened.WithLabelValues(netip.Prefix(newPrimary.Prefix).String()).Inc()
+	}
+
 	// If a new route was not found/available,
 	// return without an error.
 	// We do not want to update the database as
@@ -612,16 +682,28 @@ func EnableAutoApprovedRoutes(
 	aclPolicy *policy.ACLPolicy,
 	node *types.Node,
 ) error {
+	_, err := enableAutoApprovedRoutes(tx, aclPolicy, node)
+
+	return err
+}
+
+// enableAutoApprovedRoutes enables the approved routes of the node and
+// reports if any route was enabled.
+func enableAutoApprovedRoutes(
+	tx *gorm.DB,
+	aclPolicy *policy.ACLPolicy,
+	node *types.Node,
+) (bool, error) {
 	if node.IPv4 == nil && node.IPv6 == nil {
-		return nil // This node has no IPAddresses, so can't possibly match any autoApprovers ACLs
+		return false, nil // This node has no IPAddresses, so can't possibly match any autoApprovers ACLs
 	}
 
 	routes, err := GetNodeAdvertisedRoutes(tx, node)
 	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
-		return fmt.Errorf("getting advertised routes for node(%s %d): %w", node.Hostname, node.ID, err)
+		return false, fmt.Errorf("getting advertised routes for node(%s %d): %w", node.Hostname, node.ID, err)
 	}
 
-	log.Trace().Interface("routes", routes).Msg("routes for autoapproving")
+	util.LogDB.Trace().Interface("routes", routes).Msg("routes for autoapproving")
 
 	var approvedRoutes types.Routes
 
@@ -630,44 +712,67 @@ func EnableAutoApprovedRoutes(
 			continue
 		}
 
-		routeApprovers, err := aclPolicy.AutoApprovers.GetRouteApprovers(
-			netip.Prefix(advertisedRoute.Prefix),
-		)
+		approved, err := aclPolicy.ApprovesRoute(node, netip.Prefix(advertisedRoute.Prefix))
 		if err != nil {
-			return fmt.Errorf("failed to resolve autoApprovers for route(%d) for node(%s %d): %w", advertisedRoute.ID, node.Hostname, node.ID, err)
+			return false, fmt.Errorf("resolving autoApprovers for route(%d) for node(%s %d): %w", advertisedRoute.ID, node.Hostname, node.ID, err)
 		}
 
-		log.Trace().
+		util.LogDB.Trace().
 			Str("node", node.Hostname).
 			Str("user", node.User.Name).
-			Strs("routeApprovers", routeApprovers).
+			Bool("approved", approved).
 			Str("prefix", netip.Prefix(advertisedRoute.Prefix).String()).
 			Msg("looking up route for autoapproving")
 
-		for _, approvedAlias := range routeApprovers {
-			if approvedAlias == node.User.Name {
-				approvedRoutes = append(approvedRoutes, advertisedRoute)
-			} else {
-				// TODO(kradalby): figure out how to get this to depend on less stuff
-				approvedIps, err := aclPolicy.ExpandAlias(types.Nodes{node}, approvedAlias)
-				if err != nil {
-					return fmt.Errorf("expanding alias %q for autoApprovers: %w", approvedAlias, err)
-				}
-
-				// approvedIPs should contain all of node's IPs if it matches the rule, so check for first
-				if approvedIps.Contains(*node.IPv4) {
-					approvedRoutes = append(approvedRoutes, advertisedRoute)
-				}
-			}
+		if approved {
+			approvedRoutes = append(approvedRoutes, advertisedRoute)
 		}
 	}
 
 	for _, approvedRoute := range approvedRoutes {
 		_, err := EnableRoute(tx, uint64(approvedRoute.ID))
 		if err != nil {
-			return fmt.Errorf("enabling approved route(%d): %w", approvedRoute.ID, err)
+			return false, fmt.Errorf("enabling approved route(%d): %w", approvedRoute.ID, err)
 		}
 	}
 
-	return nil
+	return len(approvedRoutes) > 0, nil
+}
+
+func (hsdb *HSDatabase) EnableAllAutoApprovedRoutes(
+	aclPolicy *policy.ACLPolicy,
+	tailnet string,
+) ([]types.NodeID, error) {
+	return Write(hsdb.DB, func(tx *gorm.DB) ([]types.NodeID, error) {
+		return EnableAllAutoApprovedRoutes(tx, aclPolicy, tailnet)
+	})
+}
+
+// EnableAllAutoApprovedRoutes enables the approved routes of all the
+// nodes of the tailnet the policy is for, so approvers added to a policy
+// take effect for the routes which are already advertised. It returns
+// the nodes with routes enabled.
+func EnableAllAutoApprovedRoutes(
+	tx *gorm.DB,
+	aclPolicy *policy.ACLPolicy,
+	tailnet string,
+) ([]types.NodeID, error) {
+	nodes, err := ListNodes(tx)
+	if err != nil {
+		return nil, fmt.Errorf("listing nodes for autoapproving: %w", err)
+	}
+
+	var changed []types.NodeID
+	for _, node := range nodes.InTailnet(tailnet) {
+		enabled, err := enableAutoApprovedRoutes(tx, aclPolicy, node)
+		if err != nil {
+			return nil, err
+		}
+
+		if enabled {
+			changed = append(changed, node.ID)
+		}
+	}
+
+	return changed, nil
 }
@@ -3,6 +3,7 @@ package db
 import (
 	"net/netip"
 	"os"
+	"slices"
 	"testing"
 	"time"
 
@@ -10,6 +11,7 @@ import (
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/puzpuzpuz/xsync/v3"
 	"gopkg.in/check.v1"
 	"gorm.io/gorm"
@@ -30,7 +32,7 @@ func (s *Suite) TestGetRoutes(c *check.C) {
 	user, err := db.CreateUser("test")
 	c.Assert(err, check.IsNil)
 
-	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil)
+	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	_, err = db.getNode("test", "test_get_route_node")
@@ -75,7 +77,7 @@ func (s *Suite) TestGetEnableRoutes(c *check.C) {
 	user, err := db.CreateUser("test")
 	c.Assert(err, check.IsNil)
 
-	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil)
+	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	_, err = db.getNode("test", "test_enable_route_node")
@@ -150,7 +152,7 @@ func (s *Suite) TestIsUniquePrefix(c *check.C) {
 	user, err := db.CreateUser("test")
 	c.Assert(err, check.IsNil)
 
-	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil)
+	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	_, err = db.getNode("test", "test_enable_route_node")
@@ -232,7 +234,7 @@ func (s *Suite) TestDeleteRoutes(c *check.C) {
 	user, err := db.CreateUser("test")
 	c.Assert(err, check.IsNil)
 
-	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil)
+	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	_, err = db.getNode("test", "test_enable_route_node")
@@ -646,7 +648,7 @@ func TestFailoverNodeRoutesIfNeccessary(t *testing.T) {
 				want := tt.want[step]
 
 				got, err := Write(db.DB, func(tx *gorm.DB) (*types.StateUpdate, error) {
-					return FailoverNodeRoutesIfNeccessary(tx, smap(isConnected), node)
+					return FailoverNodeRoutesIfNeccessary(tx, smap(isConnected), node, nil)
 				})
 
 				if (err != nil) != tt.wantErr {
@@ -663,6 +665,71 @@ func TestFailoverNodeRoutesIfNeccessary(t *testing.T) {
 	}
 }
 
+func TestFailoverNodeRoutesNoReachableRouter(t *testing.T) {
+	db := dbForTest(t, "no-reachable-router")
+
+	user := types.User{Name: "no-reachable-router"}
+	if err := db.DB.Save(&user).Error; err != nil {
+		t.Fatalf("failed to create user: %s", err)
+	}
+
+	routes := types.Routes{
+		r(1, 1, ipp("10.99.0.0/24"), true, true),
+		r(2, 2, ipp("10.99.0.0/24"), true, false),
+	}
+	for _, route := range routes {
+		route.Node.User = user
+		if err := db.DB.Save(&route.Node).Error; err != nil {
+			t.Fatalf("failed to create node: %s", err)
+		}
+		if err := db.DB.Save(&route).Error; err != nil {
+			t.Fatalf("failed to create route: %s", err)
+		}
+	}
+
+	unreachable := func() float64 {
+		return testutil.ToFloat64(routePrefixUnreachable.WithLabelValues("10.99.0.0/24"))
+	}
+	unreachableTotal := func() float64 {
+		return testutil.ToFloat64(routePrefixUnreachableTotal.WithLabelValues("10.99.0.0/24"))
+	}
+
+	steps := []struct {
+		node            *types.Node
+		isConnected     map[types.NodeID]bool
+		wantUnreachable float64
+		wantTotal       float64
+	}{
+		// both down, the dead primary is kept
+		{np(1), map[types.NodeID]bool{1: false, 2: false}, 1, 1},
+		// still down, reported again
+		{np(1), map[types.NodeID]bool{1: false, 2: false}, 1, 2},
+		// n2 comes up and takes over
+		{np(1), map[types.NodeID]bool{1: false, 2: true}, 0, 2},
+	}
+
+	for i, step := range steps {
+		got, err := Write(db.DB, func(tx *gorm.DB) (*types.StateUpdate, error) {
+			return FailoverNodeRoutesIfNeccessary(tx, smap(step.isConnected), step.node, nil)
+		})
+		if err != nil {
+			t.Fatalf("step %d: failover: %s", i, err)
+		}
+
+		if step.wantUnreachable == 1 && got != nil {
+			t.Errorf("step %d: expected no update when no router is reachable, got %v", i, got)
+		}
+
+		if v := unreachable(); v != step.wantUnreachable {
+			t.Errorf("step %d: route_prefix_unreachable = %v, want %v", i, v, step.wantUnreachable)
+		}
+
+		if v := unreachableTotal(); v != step.wantTotal {
+			t.Errorf("step %d: route_prefix_unreachable_total = %v, want %v", i, v, step.wantTotal)
+		}
+	}
+}
+
 func TestFailoverRouteTx(t *testing.T) {
 	tests := []struct {
 		name         string
@@ -1085,6 +1152,7 @@ func TestFailoverRoute(t *testing.T) {
 		failingRoute types.Route
 		routes       types.Routes
 		isConnected  map[types.NodeID]bool
+		heldDown     []types.NodeID
 		want         *failover
 	}{
 		{
@@ -1197,6 +1265,65 @@ func TestFailoverRoute(t *testing.T) {
 			},
 			want: nil,
 		},
+		{
+			name:         "failover-primary-skip-held-down",
+			failingRoute: r(1, 1, ipp("10.0.0.0/24"), true, true),
+			routes: types.Routes{
+				r(1, 1, ipp("10.0.0.0/24"), true, true),
+				r(2, 2, ipp("10.0.0.0/24"), true, false),
+				r(3, 3, ipp("10.0.0.0/24"), true, false),
+			},
+			isConnected: map[types.NodeID]bool{
+				1: false,
+				2: true,
+				3: true,
+			},
+			heldDown: []types.NodeID{2},
+			want: &failover{
+				old: rp(1, 1, ipp("10.0.0.0/24"), true, false),
+				new: rp(3, 3, ipp("10.0.0.0/24"), true, true),
+			},
+		},
+		{
+			name:         "failover-primary-skip-isolated",
+			failingRoute: r(1, 1, ipp("10.0.0.0/24"), true, true),
+			routes: types.Routes{
+				r(1, 1, ipp("10.0.0.0/24"), true, true),
+				{
+					Model:   gorm.Model{ID: 2},
+					Node:    types.Node{ID: 2, Quarantined: true},
+					Prefix:  ipp("10.0.0.0/24"),
+					Enabled: true,
+				},
+				r(3, 3, ipp("10.0.0.0/24"), true, false),
+			},
+			isConnected: map[types.NodeID]bool{
+				1: false,
+				2: true,
+				3: true,
+			},
+			want: &failover{
+				old: rp(1, 1, ipp("10.0.0.0/24"), true, false),
+				new: rp(3, 3, ipp("10.0.0.0/24"), true, true),
+			},
+		},
+		{
+			name:         "failover-primary-only-held-down",
+			failingRoute: r(1, 1, ipp("10.0.0.0/24"), true, true),
+			routes: types.Routes{
+				r(1, 1, ipp("10.0.0.0/24"), true, true),
+				r(2, 2, ipp("10.0.0.0/24"), true, false),
+			},
+			isConnected: map[types.NodeID]bool{
+				1: false,
+				2: true,
+			},
+			heldDown: []types.NodeID{2},
+			want: &failover{
+				old: rp(1, 1, ipp("10.0.0.0/24"), true, false),
+				new: rp(2, 2, ipp("10.0.0.0/24"), true, true),
+			},
+		},
 	}
 
 	cmps := append(
@@ -1208,7 +1335,11 @@ func TestFailoverRoute(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotf := failoverRoute(smap(tt.isConnected), &tt.failingRoute, tt.routes)
+			heldDown := func(nodeID types.NodeID) bool {
+				return slices.Contains(tt.heldDown, nodeID)
+			}
+
+			gotf := failoverRoute(smap(tt.isConnected), &tt.failingRoute, tt.routes, heldDown)
 
 			if tt.want == nil && gotf != nil {
 				t.Fatalf("expected nil, got %+v", gotf)
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrSCIMGroupExists   = errors.New("group already exists")
+	ErrSCIMGroupNotFound = errors.New("group not found")
+)
+
+func (hsdb *HSDatabase) ListSCIMGroups() ([]types.SCIMGroup, error) {
+	return Read(hsdb.DB, ListSCIMGroups)
+}
+
+// ListSCIMGroups returns the groups provisioned with SCIM, with their
+// members.
+func ListSCIMGroups(tx *gorm.DB) ([]types.SCIMGroup, error) {
+	var groups []types.SCIMGroup
+	if err := tx.Preload("Members").Order("id").Find(&groups).Error; err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+func (hsdb *HSDatabase) GetSCIMGroup(id uint64) (*types.SCIMGroup, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (*types.SCIMGroup, error) {
+		return GetSCIMGroup(rx, id)
+	})
+}
+
+func GetSCIMGroup(tx *gorm.DB, id uint64) (*types.SCIMGroup, error) {
+	var group types.SCIMGroup
+	err := tx.Preload("Members").First(&group, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrSCIMGroupNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &group, nil
+}
+
+func (hsdb *HSDatabase) SaveSCIMGroup(group *types.SCIMGroup, memberIDs []uint) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return SaveSCIMGroup(tx, group, memberIDs)
+	})
+}
+
+// SaveSCIMGroup creates or updates a group provisioned with SCIM, and
+// sets its members to the users with the IDs. The name of the group must
+// be unique and its members must exist.
+func SaveSCIMGroup(tx *gorm.DB, group *types.SCIMGroup, memberIDs []uint) error {
+	var count int64
+	if err := tx.Model(&types.SCIMGroup{}).
+		Where("display_name = ? AND id != ?", group.DisplayName, group.ID).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("%w: %q", ErrSCIMGroupExists, group.DisplayName)
+	}
+
+	members := make([]types.User, 0, len(memberIDs))
+	for _, id := range memberIDs {
+		user, err := GetUserByID(tx, id)
+		if err != nil {
+			return fmt.Errorf("member %d: %w", id, err)
+		}
+		members = append(members, *user)
+	}
+
+	group.Members = nil
+	if err := tx.Save(group).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Model(group).Association("Members").Replace(members); err != nil {
+		return err
+	}
+	group.Members = members
+
+	return nil
+}
+
+func (hsdb *HSDatabase) DeleteSCIMGroup(id uint64) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return DeleteSCIMGroup(tx, id)
+	})
+}
+
+// DeleteSCIMGroup deletes a group provisioned with SCIM, its members are
+// kept.
+func DeleteSCIMGroup(tx *gorm.DB, id uint64) error {
+	group, err := GetSCIMGroup(tx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Model(group).Association("Members").Clear(); err != nil {
+		return err
+	}
+
+	return tx.Delete(group).Error
+}
@@ -0,0 +1,49 @@
+package db
+
+import (
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestSCIMGroups(c *check.C) {
+	alice, err := db.CreateUser("alice")
+	c.Assert(err, check.IsNil)
+	bob, err := db.CreateUser("bob")
+	c.Assert(err, check.IsNil)
+
+	group := &types.SCIMGroup{DisplayName: "engineering", ExternalID: "ext-1"}
+	err = db.SaveSCIMGroup(group, []uint{alice.ID, bob.ID})
+	c.Assert(err, check.IsNil)
+
+	err = db.SaveSCIMGroup(&types.SCIMGroup{DisplayName: "engineering"}, nil)
+	c.Assert(err, check.ErrorMatches, ".*group already exists.*")
+
+	err = db.SaveSCIMGroup(&types.SCIMGroup{DisplayName: "ops"}, []uint{4242})
+	c.Assert(err, check.ErrorMatches, ".*user not found.*")
+
+	group.DisplayName = "developers"
+	err = db.SaveSCIMGroup(group, []uint{bob.ID})
+	c.Assert(err, check.IsNil)
+
+	groups, err := db.ListSCIMGroups()
+	c.Assert(err, check.IsNil)
+	c.Assert(groups, check.HasLen, 1)
+	c.Assert(groups[0].DisplayName, check.Equals, "developers")
+	c.Assert(groups[0].ExternalID, check.Equals, "ext-1")
+	c.Assert(groups[0].Members, check.HasLen, 1)
+	c.Assert(groups[0].Members[0].Name, check.Equals, "bob")
+
+	// Destroying a user removes it from the groups.
+	err = db.DestroyUser("bob")
+	c.Assert(err, check.IsNil)
+
+	found, err := db.GetSCIMGroup(group.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(found.Members, check.HasLen, 0)
+
+	err = db.DeleteSCIMGroup(group.ID)
+	c.Assert(err, check.IsNil)
+
+	_, err = db.GetSCIMGroup(group.ID)
+	c.Assert(err, check.Equals, ErrSCIMGroupNotFound)
+}
@@ -0,0 +1,227 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"tailscale.com/tka"
+	"tailscale.com/types/tkatype"
+)
+
+var ErrTKANotEnabled = errors.New("network lock is not enabled")
+
+// TKAChonk stores the AUMs of the tailnet key authority in the
+// database, it implements tka.Chonk for the transaction it is created
+// with.
+type TKAChonk struct {
+	tx *gorm.DB
+}
+
+var _ tka.Chonk = (*TKAChonk)(nil)
+
+func NewTKAChonk(tx *gorm.DB) *TKAChonk {
+	return &TKAChonk{tx: tx}
+}
+
+func decodeTKAUpdates(updates []types.TKAUpdate) ([]tka.AUM, error) {
+	aums := make([]tka.AUM, len(updates))
+	for index, update := range updates {
+		if err := aums[index].Unserialize(update.Data); err != nil {
+			return nil, fmt.Errorf("decoding AUM %s: %w", update.Hash, err)
+		}
+	}
+
+	return aums, nil
+}
+
+// AUM returns the AUM with the hash, or os.ErrNotExist.
+func (c *TKAChonk) AUM(hash tka.AUMHash) (tka.AUM, error) {
+	var update types.TKAUpdate
+	if err := c.tx.First(&update, "hash = ?", hash.String()).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return tka.AUM{}, os.ErrNotExist
+		}
+
+		return tka.AUM{}, err
+	}
+
+	aums, err := decodeTKAUpdates([]types.TKAUpdate{update})
+	if err != nil {
+		return tka.AUM{}, err
+	}
+
+	return aums[0], nil
+}
+
+// ChildAUMs returns the AUMs with the given parent.
+func (c *TKAChonk) ChildAUMs(prevAUMHash tka.AUMHash) ([]tka.AUM, error) {
+	var updates []types.TKAUpdate
+	if err := c.tx.Where("prev_hash = ?", prevAUMHash.String()).Find(&updates).Error; err != nil {
+		return nil, err
+	}
+
+	return decodeTKAUpdates(updates)
+}
+
+// CommitVerifiedAUMs stores the AUMs, the ones already stored are left
+// as they are.
+func (c *TKAChonk) CommitVerifiedAUMs(aums []tka.AUM) error {
+	if len(aums) == 0 {
+		return nil
+	}
+
+	updates := make([]types.TKAUpdate, len(aums))
+	for index, aum := range aums {
+		updates[index] = types.TKAUpdate{
+			Hash: aum.Hash().String(),
+			Data: aum.Serialize(),
+		}
+		if parent, ok := aum.Parent(); ok {
+			updates[index].PrevHash = parent.String()
+		}
+	}
+
+	return c.tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&updates).Error
+}
+
+// Heads returns the AUMs without children.
+func (c *TKAChonk) Heads() ([]tka.AUM, error) {
+	var updates []types.TKAUpdate
+	if err := c.tx.
+		Where("hash NOT IN (?)", c.tx.Model(&types.TKAUpdate{}).Select("prev_hash")).
+		Find(&updates).Error; err != nil {
+		return nil, err
+	}
+
+	return decodeTKAUpdates(updates)
+}
+
+func (c *TKAChonk) SetLastActiveAncestor(hash tka.AUMHash) error {
+	return c.tx.Model(&types.TKAState{}).
+		Where("1 = 1").
+		Update("last_active_ancestor", hash.String()).Error
+}
+
+func (c *TKAChonk) LastActiveAncestor() (*tka.AUMHash, error) {
+	state, err := GetTKAState(c.tx)
+	if err != nil {
+		return nil, err
+	}
+
+	if state.LastActiveAncestor == "" {
+		return nil, nil
+	}
+
+	var hash tka.AUMHash
+	if err := hash.UnmarshalText([]byte(state.LastActiveAncestor)); err != nil {
+		return nil, err
+	}
+
+	return &hash, nil
+}
+
+func (hsdb *HSDatabase) GetTKAState() (*types.TKAState, error) {
+	return Read(hsdb.DB, GetTKAState)
+}
+
+// GetTKAState returns the state of the tailnet key authority, or
+// gorm.ErrRecordNotFound if network lock was never enabled.
+func GetTKAState(tx *gorm.DB) (*types.TKAState, error) {
+	var state types.TKAState
+	if err := tx.First(&state).Error; err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+// OpenTKA opens the tailnet key authority stored in the database, it
+// returns ErrTKANotEnabled if network lock is not enabled.
+func OpenTKA(tx *gorm.DB) (*tka.Authority, *TKAChonk, error) {
+	state, err := GetTKAState(tx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrTKANotEnabled
+		}
+
+		return nil, nil, err
+	}
+
+	if state.Disabled {
+		return nil, nil, ErrTKANotEnabled
+	}
+
+	chonk := NewTKAChonk(tx)
+	authority, err := tka.Open(chonk)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening tailnet key authority: %w", err)
+	}
+
+	return authority, chonk, nil
+}
+
+// EnableTKA enables network lock with the genesis AUM, replacing the
+// authority if it was disabled before, and stores the signatures of the
+// node keys.
+func EnableTKA(
+	tx *gorm.DB,
+	genesis tka.AUM,
+	signatures map[types.NodeID]tkatype.MarshaledSignature,
+) (*tka.Authority, error) {
+	if err := tx.Where("1 = 1").Delete(&types.TKAState{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Where("1 = 1").Delete(&types.TKAUpdate{}).Error; err != nil {
+		return nil, err
+	}
+
+	state := types.TKAState{GenesisAUM: genesis.Serialize()}
+	if err := tx.Create(&state).Error; err != nil {
+		return nil, err
+	}
+
+	authority, err := tka.Bootstrap(NewTKAChonk(tx), genesis)
+	if err != nil {
+		return nil, fmt.Errorf("bootstrapping tailnet key authority: %w", err)
+	}
+
+	for nodeID, signature := range signatures {
+		if err := NodeSetKeySignature(tx, nodeID, signature); err != nil {
+			return nil, err
+		}
+	}
+
+	return authority, nil
+}
+
+// DisableTKA disables network lock, keeping the disablement secret for
+// the nodes still having it enabled. The signatures of the nodes are
+// removed.
+func DisableTKA(tx *gorm.DB, disablementSecret []byte) error {
+	if err := tx.Model(&types.TKAState{}).Where("1 = 1").Updates(map[string]any{
+		"disabled":           true,
+		"disablement_secret": disablementSecret,
+	}).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Where("1 = 1").Delete(&types.TKAUpdate{}).Error; err != nil {
+		return err
+	}
+
+	return tx.Model(&types.Node{}).
+		Where("key_signature IS NOT NULL").
+		Update("key_signature", nil).Error
+}
+
+// NodeSetKeySignature sets the network lock signature of the node key of
+// a node.
+func NodeSetKeySignature(tx *gorm.DB, nodeID types.NodeID, signature tkatype.MarshaledSignature) error {
+	return tx.Model(&types.Node{}).
+		Where("id = ?", nodeID).
+		Update("key_signature", []byte(signature)).Error
+}
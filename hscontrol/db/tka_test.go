@@ -0,0 +1,73 @@
+package db
+
+import (
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gopkg.in/check.v1"
+	"gorm.io/gorm"
+	"tailscale.com/tka"
+	"tailscale.com/types/key"
+	"tailscale.com/types/tkatype"
+)
+
+func (*Suite) TestTKA(c *check.C) {
+	_, _, err := OpenTKA(db.DB)
+	c.Assert(err, check.Equals, ErrTKANotEnabled)
+
+	signer := key.NewNLPrivate()
+	disablementSecret := []byte("disablement secret")
+	trusted := tka.Key{Kind: tka.Key25519, Public: signer.Public().Verifier(), Votes: 1}
+
+	nodeAuthority, genesis, err := tka.Create(&tka.Mem{}, tka.State{
+		Keys:               []tka.Key{trusted},
+		DisablementSecrets: [][]byte{tka.DisablementKDF(disablementSecret)},
+	}, signer)
+	c.Assert(err, check.IsNil)
+
+	authority, err := Write(db.DB, func(tx *gorm.DB) (*tka.Authority, error) {
+		return EnableTKA(tx, genesis, map[types.NodeID]tkatype.MarshaledSignature{})
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(authority.Head(), check.Equals, nodeAuthority.Head())
+
+	// The AUMs of the nodes are applied to the stored authority.
+	nodeStorage := &tka.Mem{}
+	c.Assert(nodeStorage.CommitVerifiedAUMs([]tka.AUM{genesis}), check.IsNil)
+	nodeAuthority, err = tka.Open(nodeStorage)
+	c.Assert(err, check.IsNil)
+
+	updater := nodeAuthority.NewUpdater(signer)
+	second := key.NewNLPrivate()
+	c.Assert(updater.AddKey(tka.Key{Kind: tka.Key25519, Public: second.Public().Verifier(), Votes: 1}), check.IsNil)
+	updates, err := updater.Finalize(nodeStorage)
+	c.Assert(err, check.IsNil)
+	c.Assert(nodeAuthority.Inform(nodeStorage, updates), check.IsNil)
+
+	err = db.Write(func(tx *gorm.DB) error {
+		authority, chonk, err := OpenTKA(tx)
+		if err != nil {
+			return err
+		}
+
+		return authority.Inform(chonk, updates)
+	})
+	c.Assert(err, check.IsNil)
+
+	authority, _, err = OpenTKA(db.DB)
+	c.Assert(err, check.IsNil)
+	c.Assert(authority.Head(), check.Equals, nodeAuthority.Head())
+	c.Assert(authority.KeyTrusted(second.KeyID()), check.Equals, true)
+	c.Assert(authority.ValidDisablement(disablementSecret), check.Equals, true)
+
+	err = db.Write(func(tx *gorm.DB) error {
+		return DisableTKA(tx, disablementSecret)
+	})
+	c.Assert(err, check.IsNil)
+
+	_, _, err = OpenTKA(db.DB)
+	c.Assert(err, check.Equals, ErrTKANotEnabled)
+
+	state, err := db.GetTKAState()
+	c.Assert(err, check.IsNil)
+	c.Assert(state.Disabled, check.Equals, true)
+	c.Assert(state.DisablementSecret, check.DeepEquals, disablementSecret)
+}
@@ -3,6 +3,8 @@ package db
 import (
 	"errors"
 	"fmt"
+	"slices"
+	"time"
 
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
@@ -13,6 +15,8 @@ var (
 	ErrUserExists        = errors.New("user already exists")
 	ErrUserNotFound      = errors.New("user not found")
 	ErrUserStillHasNodes = errors.New("user not empty: node(s) found")
+	ErrUserDeactivated   = errors.New("user is deactivated")
+	ErrUserOtherTailnet  = errors.New("user is in another tailnet")
 )
 
 func (hsdb *HSDatabase) CreateUser(name string) (*types.User, error) {
@@ -24,6 +28,19 @@ func (hsdb *HSDatabase) CreateUser(name string) (*types.User, error) {
 // CreateUser creates a new User. Returns error if could not be created
 // or another user already exists.
 func CreateUser(tx *gorm.DB, name string) (*types.User, error) {
+	return CreateTailnetUser(tx, name, "")
+}
+
+func (hsdb *HSDatabase) CreateTailnetUser(name, tailnet string) (*types.User, error) {
+	return Write(hsdb.DB, func(tx *gorm.DB) (*types.User, error) {
+		return CreateTailnetUser(tx, name, tailnet)
+	})
+}
+
+// CreateTailnetUser creates a new User in a tailnet of the multi-tailnet
+// mode, or in the default tailnet if it is empty. The names of the users
+// are unique across the tailnets.
+func CreateTailnetUser(tx *gorm.DB, name, tailnet string) (*types.User, error) {
 	err := util.CheckForFQDNRules(name)
 	if err != nil {
 		return nil, err
@@ -33,6 +50,7 @@ func CreateUser(tx *gorm.DB, name string) (*types.User, error) {
 		return nil, ErrUserExists
 	}
 	user.Name = name
+	user.Tailnet = tailnet
 	if err := tx.Create(&user).Error; err != nil {
 		return nil, fmt.Errorf("creating user: %w", err)
 	}
@@ -73,6 +91,14 @@ func DestroyUser(tx *gorm.DB, name string) error {
 		}
 	}
 
+	if err := tx.Exec("DELETE FROM scim_group_members WHERE user_id = ?", user.ID).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Delete(&types.NodeShare{}, "user_id = ?", user.ID).Error; err != nil {
+		return err
+	}
+
 	if result := tx.Unscoped().Delete(&user); result.Error != nil {
 		return result.Error
 	}
@@ -115,6 +141,79 @@ func RenameUser(tx *gorm.DB, oldName, newName string) error {
 	return nil
 }
 
+func (hsdb *HSDatabase) SetUserOIDCGroups(name string, groups []string) (bool, error) {
+	return Write(hsdb.DB, func(tx *gorm.DB) (bool, error) {
+		return SetUserOIDCGroups(tx, name, groups)
+	})
+}
+
+// SetUserOIDCGroups sets the groups given by the OIDC provider to the
+// User, and reports if they changed.
+func SetUserOIDCGroups(tx *gorm.DB, name string, groups []string) (bool, error) {
+	user, err := GetUser(tx, name)
+	if err != nil {
+		return false, err
+	}
+
+	groups = slices.Clone(groups)
+	slices.Sort(groups)
+	groups = slices.Compact(groups)
+
+	if slices.Equal(groups, user.OIDCGroups) {
+		return false, nil
+	}
+
+	if err := tx.Model(user).Update("oidc_groups", types.StringList(groups)).Error; err != nil {
+		return false, fmt.Errorf("failed to update the OIDC groups of user %q: %w", name, err)
+	}
+
+	return true, nil
+}
+
+func (hsdb *HSDatabase) SetUserDeactivated(name string, deactivated bool) ([]types.NodeID, error) {
+	return Write(hsdb.DB, func(tx *gorm.DB) ([]types.NodeID, error) {
+		return SetUserDeactivated(tx, name, deactivated)
+	})
+}
+
+// SetUserDeactivated deactivates or reactivates a User. Deactivating
+// expires the nodes of the User, their IDs are returned. Caller is
+// responsible for notifying all of change.
+func SetUserDeactivated(tx *gorm.DB, name string, deactivated bool) ([]types.NodeID, error) {
+	user, err := GetUser(tx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Model(user).Update("deactivated", deactivated).Error; err != nil {
+		return nil, fmt.Errorf("failed to update user %q: %w", name, err)
+	}
+
+	if !deactivated {
+		return nil, nil
+	}
+
+	nodes, err := ListNodesByUser(tx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var expired []types.NodeID
+	for _, node := range nodes {
+		if node.IsExpired() {
+			continue
+		}
+
+		if err := NodeSetExpiry(tx, node.ID, now); err != nil {
+			return nil, err
+		}
+		expired = append(expired, node.ID)
+	}
+
+	return expired, nil
+}
+
 func (hsdb *HSDatabase) GetUser(name string) (*types.User, error) {
 	return Read(hsdb.DB, func(rx *gorm.DB) (*types.User, error) {
 		return GetUser(rx, name)
@@ -133,8 +232,26 @@ func GetUser(tx *gorm.DB, name string) (*types.User, error) {
 	return &user, nil
 }
 
+func (hsdb *HSDatabase) GetUserByID(id uint) (*types.User, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (*types.User, error) {
+		return GetUserByID(rx, id)
+	})
+}
+
+func GetUserByID(tx *gorm.DB, id uint) (*types.User, error) {
+	user := types.User{}
+	if result := tx.First(&user, "id = ?", id); errors.Is(
+		result.Error,
+		gorm.ErrRecordNotFound,
+	) {
+		return nil, ErrUserNotFound
+	}
+
+	return &user, nil
+}
+
 func (hsdb *HSDatabase) ListUsers() ([]types.User, error) {
-	return Read(hsdb.DB, func(rx *gorm.DB) ([]types.User, error) {
+	return Read(hsdb.ReadDB(), func(rx *gorm.DB) ([]types.User, error) {
 		return ListUsers(rx)
 	})
 }
@@ -149,6 +266,28 @@ func ListUsers(tx *gorm.DB) ([]types.User, error) {
 	return users, nil
 }
 
+// ListUsersPage returns up to limit users with an ID above after,
+// ordered by ID. A limit of zero returns all of them.
+func ListUsersPage(tx *gorm.DB, after uint, limit int) ([]types.User, error) {
+	query := tx.Where("id > ?", after).Order("id")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+
+	users := []types.User{}
+	if err := query.Find(&users).Error; err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (hsdb *HSDatabase) ListNodesByUser(name string) (types.Nodes, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (types.Nodes, error) {
+		return ListNodesByUser(rx, name)
+	})
+}
+
 // ListNodesByUser gets all the nodes in a given user.
 func ListNodesByUser(tx *gorm.DB, name string) (types.Nodes, error) {
 	err := util.CheckForFQDNRules(name)
@@ -184,10 +323,26 @@ func AssignNodeToUser(tx *gorm.DB, node *types.Node, username string) error {
 	if err != nil {
 		return err
 	}
+
+	// The addresses and the peers of the node depend on its tailnet, it
+	// cannot move to another one.
+	owner, err := GetUserByID(tx, node.UserID)
+	if err != nil {
+		return err
+	}
+	if owner.Tailnet != user.Tailnet {
+		return ErrUserOtherTailnet
+	}
+
 	node.User = *user
 	if result := tx.Save(&node); result.Error != nil {
 		return result.Error
 	}
 
+	// The node is no longer shared with its new owner.
+	if err := tx.Delete(&types.NodeShare{}, "node_id = ? AND user_id = ?", node.ID, user.ID).Error; err != nil {
+		return err
+	}
+
 	return nil
 }
@@ -1,6 +1,8 @@
 package db
 
 import (
+	"time"
+
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
 	"gopkg.in/check.v1"
@@ -30,7 +32,7 @@ func (s *Suite) TestDestroyUserErrors(c *check.C) {
 	user, err := db.CreateUser("test")
 	c.Assert(err, check.IsNil)
 
-	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil)
+	pak, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	err = db.DestroyUser("test")
@@ -43,7 +45,7 @@ func (s *Suite) TestDestroyUserErrors(c *check.C) {
 	user, err = db.CreateUser("test")
 	c.Assert(err, check.IsNil)
 
-	pak, err = db.CreatePreAuthKey(user.Name, false, false, nil, nil)
+	pak, err = db.CreatePreAuthKey(user.Name, false, false, nil, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	pakID := uint(pak.ID)
@@ -97,7 +99,7 @@ func (s *Suite) TestSetMachineUser(c *check.C) {
 	newUser, err := db.CreateUser("new")
 	c.Assert(err, check.IsNil)
 
-	pak, err := db.CreatePreAuthKey(oldUser.Name, false, false, nil, nil)
+	pak, err := db.CreatePreAuthKey(oldUser.Name, false, false, nil, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	pakID := uint(pak.ID)
@@ -125,3 +127,91 @@ func (s *Suite) TestSetMachineUser(c *check.C) {
 	c.Assert(node.UserID, check.Equals, newUser.ID)
 	c.Assert(node.User.Name, check.Equals, newUser.Name)
 }
+
+func (s *Suite) TestTailnetUsers(c *check.C) {
+	alice, err := db.CreateUser("alice")
+	c.Assert(err, check.IsNil)
+	c.Assert(alice.Tailnet, check.Equals, "")
+
+	bob, err := db.CreateTailnetUser("bob", "acme")
+	c.Assert(err, check.IsNil)
+	c.Assert(bob.Tailnet, check.Equals, "acme")
+
+	_, err = db.CreateTailnetUser("carol", "acme")
+	c.Assert(err, check.IsNil)
+
+	_, err = db.CreateTailnetUser("alice", "acme")
+	c.Assert(err, check.Equals, ErrUserExists)
+
+	node := types.Node{
+		Hostname:       "laptop",
+		GivenName:      "laptop",
+		UserID:         bob.ID,
+		RegisterMethod: util.RegisterMethodCLI,
+	}
+	c.Assert(db.DB.Save(&node).Error, check.IsNil)
+
+	// The node can only move or be shared within its tailnet.
+	c.Assert(db.AssignNodeToUser(&node, "alice"), check.Equals, ErrUserOtherTailnet)
+	_, err = db.ShareNode(node.ID, "alice")
+	c.Assert(err, check.Equals, ErrUserOtherTailnet)
+
+	_, err = db.ShareNode(node.ID, "carol")
+	c.Assert(err, check.IsNil)
+	c.Assert(db.AssignNodeToUser(&node, "carol"), check.IsNil)
+	c.Assert(node.User.Tailnet, check.Equals, "acme")
+}
+
+func (s *Suite) TestSetUserOIDCGroups(c *check.C) {
+	_, err := db.CreateUser("test")
+	c.Assert(err, check.IsNil)
+
+	changed, err := db.SetUserOIDCGroups("test", []string{"ops", "dev", "ops"})
+	c.Assert(err, check.IsNil)
+	c.Assert(changed, check.Equals, true)
+
+	user, err := db.GetUser("test")
+	c.Assert(err, check.IsNil)
+	c.Assert([]string(user.OIDCGroups), check.DeepEquals, []string{"dev", "ops"})
+
+	changed, err = db.SetUserOIDCGroups("test", []string{"ops", "dev"})
+	c.Assert(err, check.IsNil)
+	c.Assert(changed, check.Equals, false)
+
+	_, err = db.SetUserOIDCGroups("does-not-exist", nil)
+	c.Assert(err, check.Equals, ErrUserNotFound)
+}
+
+func (s *Suite) TestSetUserDeactivated(c *check.C) {
+	user, err := db.CreateUser("test")
+	c.Assert(err, check.IsNil)
+
+	expired := time.Now().Add(-time.Hour)
+	nodes := []types.Node{
+		{Hostname: "active", UserID: user.ID, RegisterMethod: util.RegisterMethodCLI},
+		{Hostname: "expired", UserID: user.ID, RegisterMethod: util.RegisterMethodCLI, Expiry: &expired},
+	}
+	for index := range nodes {
+		c.Assert(db.DB.Save(&nodes[index]).Error, check.IsNil)
+	}
+
+	expiredIDs, err := db.SetUserDeactivated("test", true)
+	c.Assert(err, check.IsNil)
+	c.Assert(expiredIDs, check.DeepEquals, []types.NodeID{nodes[0].ID})
+
+	user, err = db.GetUser("test")
+	c.Assert(err, check.IsNil)
+	c.Assert(user.Deactivated, check.Equals, true)
+
+	node, err := db.GetNodeByID(nodes[0].ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(node.IsExpired(), check.Equals, true)
+
+	expiredIDs, err = db.SetUserDeactivated("test", false)
+	c.Assert(err, check.IsNil)
+	c.Assert(expiredIDs, check.HasLen, 0)
+
+	user, err = db.GetUser("test")
+	c.Assert(err, check.IsNil)
+	c.Assert(user.Deactivated, check.Equals, false)
+}
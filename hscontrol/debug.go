@@ -0,0 +1,461 @@
+package hscontrol
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/notifier"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+const (
+	defaultStateDumpPageSize = 100
+	maxStateDumpPageSize     = 1000
+
+	// The state dump reads every node from the database, it is rate
+	// limited so it cannot be used to load the server.
+	stateDumpRate  = rate.Limit(2)
+	stateDumpBurst = 10
+
+	redactedValue = "REDACTED"
+
+	debugSocketPermission = 0o600
+)
+
+var ErrStateDumpNotEmpty = errors.New("state dumps can only be loaded into an empty database")
+
+// secretConfigKeys are the parts of a configuration key which mark its
+// value as a secret that must not be part of a state dump.
+var secretConfigKeys = []string{
+	"secret",
+	"password",
+	"private_key",
+	"api_key",
+	"token",
+	"key_path",
+	"client_id",
+}
+
+// StateDump is a sanitized snapshot of the state of headscale, used to
+// attach to bug reports and reproduce issues locally. The nodes are
+// paginated, every page carries the rest of the state.
+type StateDump struct {
+	Time time.Time `json:"time"`
+
+	// Config is the configuration headscale is running with, with all
+	// secrets redacted.
+	Config map[string]any `json:"config"`
+
+	// PolicyHash is the SHA256 of the policy file, the policy itself
+	// is not part of the dump.
+	PolicyHash string `json:"policy_hash,omitempty"`
+
+	Notifier string                    `json:"notifier"`
+	Changes  []notifier.ChangeLogEntry `json:"changes"`
+
+	Users []StateDumpUser `json:"users"`
+	Nodes []StateDumpNode `json:"nodes"`
+
+	Page       int `json:"page"`
+	PageSize   int `json:"page_size"`
+	TotalNodes int `json:"total_nodes"`
+
+	// NextPage is the page to request for the next nodes, 0 if this
+	// is the last page.
+	NextPage int `json:"next_page,omitempty"`
+}
+
+type StateDumpUser struct {
+	ID        uint      `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// StateDumpNode is a node in a StateDump. Auth keys are left out.
+type StateDumpNode struct {
+	ID             types.NodeID      `json:"id"`
+	MachineKey     key.MachinePublic `json:"machine_key"`
+	NodeKey        key.NodePublic    `json:"node_key"`
+	DiscoKey       key.DiscoPublic   `json:"disco_key"`
+	IPv4           *netip.Addr       `json:"ipv4,omitempty"`
+	IPv6           *netip.Addr       `json:"ipv6,omitempty"`
+	Hostname       string            `json:"hostname"`
+	GivenName      string            `json:"given_name"`
+	UserID         uint              `json:"user_id"`
+	RegisterMethod string            `json:"register_method"`
+	ForcedTags     []string          `json:"forced_tags,omitempty"`
+	Hostinfo       *tailcfg.Hostinfo `json:"hostinfo,omitempty"`
+	Endpoints      []netip.AddrPort  `json:"endpoints,omitempty"`
+	LastSeen       *time.Time        `json:"last_seen,omitempty"`
+	Expiry         *time.Time        `json:"expiry,omitempty"`
+	Quarantined    bool              `json:"quarantined,omitempty"`
+	Online         bool              `json:"online"`
+	CreatedAt      time.Time         `json:"created_at"`
+	Routes         []StateDumpRoute  `json:"routes,omitempty"`
+}
+
+type StateDumpRoute struct {
+	ID         uint         `json:"id"`
+	Prefix     netip.Prefix `json:"prefix"`
+	Advertised bool         `json:"advertised"`
+	Enabled    bool         `json:"enabled"`
+	IsPrimary  bool         `json:"is_primary"`
+}
+
+// redactConfig returns a copy of settings with the values of all keys
+// which look like they hold a secret replaced.
+func redactConfig(settings map[string]any) map[string]any {
+	redacted := make(map[string]any, len(settings))
+	for name, value := range settings {
+		if sub, ok := value.(map[string]any); ok {
+			redacted[name] = redactConfig(sub)
+
+			continue
+		}
+
+		redacted[name] = value
+
+		lower := strings.ToLower(name)
+		for _, secret := range secretConfigKeys {
+			if strings.Contains(lower, secret) {
+				redacted[name] = redactedValue
+
+				break
+			}
+		}
+	}
+
+	return redacted
+}
+
+// policyHash returns the SHA-256 of the policy file, or of the latest
+// version in the database policy mode. It is empty without a policy.
+func (h *Headscale) policyHash() (string, error) {
+	var data []byte
+	policyPath := h.policyPath()
+	switch {
+	case h.cfg.ACL.Mode == types.PolicyModeDB:
+		stored, err := h.db.GetPolicy()
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		data = []byte(stored.Data)
+
+	case policyPath != "":
+		var err error
+		data, err = os.ReadFile(util.AbsolutePathFromConfigPath(policyPath))
+		if err != nil {
+			return "", err
+		}
+
+	default:
+		return "", nil
+	}
+
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// stateDump returns the given page of nodes, pages start at 1.
+func (h *Headscale) stateDump(page, pageSize int) (*StateDump, error) {
+	hash, err := h.policyHash()
+	if err != nil {
+		return nil, fmt.Errorf("hashing policy: %w", err)
+	}
+
+	users, err := h.db.ListUsers()
+	if err != nil {
+		return nil, fmt.Errorf("listing users: %w", err)
+	}
+
+	nodes, err := h.db.ListNodes()
+	if err != nil {
+		return nil, fmt.Errorf("listing nodes: %w", err)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+
+	dump := &StateDump{
+		Time:       time.Now(),
+		Config:     redactConfig(viper.AllSettings()),
+		PolicyHash: hash,
+		Notifier:   h.nodeNotifier.String(),
+		Changes:    h.nodeNotifier.Changes(),
+		Page:       page,
+		PageSize:   pageSize,
+		TotalNodes: len(nodes),
+	}
+
+	for _, user := range users {
+		dump.Users = append(dump.Users, StateDumpUser{
+			ID:        user.ID,
+			Name:      user.Name,
+			CreatedAt: user.CreatedAt,
+		})
+	}
+
+	start := min((page-1)*pageSize, len(nodes))
+	end := min(start+pageSize, len(nodes))
+	if end < len(nodes) {
+		dump.NextPage = page + 1
+	}
+
+	for _, node := range nodes[start:end] {
+		dumpNode := StateDumpNode{
+			ID:             node.ID,
+			MachineKey:     node.MachineKey,
+			NodeKey:        node.NodeKey,
+			DiscoKey:       node.DiscoKey,
+			IPv4:           node.IPv4,
+			IPv6:           node.IPv6,
+			Hostname:       node.Hostname,
+			GivenName:      node.GivenName,
+			UserID:         node.UserID,
+			RegisterMethod: node.RegisterMethod,
+			ForcedTags:     node.ForcedTags,
+			Hostinfo:       node.Hostinfo,
+			Endpoints:      node.Endpoints,
+			LastSeen:       node.LastSeen,
+			Expiry:         node.Expiry,
+			Quarantined:    node.Quarantined,
+			Online:         h.nodeNotifier.IsConnected(node.ID),
+			CreatedAt:      node.CreatedAt,
+		}
+
+		for _, route := range node.Routes {
+			dumpNode.Routes = append(dumpNode.Routes, StateDumpRoute{
+				ID:         route.ID,
+				Prefix:     netip.Prefix(route.Prefix),
+				Advertised: route.Advertised,
+				Enabled:    route.Enabled,
+				IsPrimary:  route.IsPrimary,
+			})
+		}
+
+		dump.Nodes = append(dump.Nodes, dumpNode)
+	}
+
+	return dump, nil
+}
+
+// debugMux serves the debug endpoints: pprof, expvar, and the state of
+// the notifier and its batcher. It is served on the metrics listener,
+// and on the local debug listener if it is configured.
+func (h *Headscale) debugMux() *http.ServeMux {
+	debugMux := http.NewServeMux()
+	debugMux.HandleFunc("/debug/pprof/", pprof.Index)
+	debugMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	debugMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	debugMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	debugMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	debugMux.Handle("/debug/vars", expvar.Handler())
+	debugMux.HandleFunc("/debug/notifier", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(h.nodeNotifier.String()))
+	})
+	debugMux.HandleFunc("/debug/batcher", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(h.nodeNotifier.Debug())
+	})
+	debugMux.HandleFunc("/debug/changes", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(h.nodeNotifier.Changes())
+	})
+	debugMux.HandleFunc("/debug/capacity", func(w http.ResponseWriter, r *http.Request) {
+		capacity, err := h.nodeCapacity()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(capacity)
+	})
+	debugMux.HandleFunc("/debug/state", h.stateDumpHandler())
+
+	return debugMux
+}
+
+// listenDebug listens on debug_listen_addr. A unix socket replaces a
+// stale one left by a previous run, and only the user running headscale
+// can connect to it.
+func (h *Headscale) listenDebug() (net.Listener, error) {
+	network, addr := types.DebugListenAddr(h.cfg.DebugAddr)
+	if network != "unix" {
+		return net.Listen(network, addr)
+	}
+
+	if err := os.Remove(addr); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("removing stale debug socket: %w", err)
+	}
+
+	if err := util.EnsureDir(filepath.Dir(addr)); err != nil {
+		return nil, fmt.Errorf("creating debug socket directory: %w", err)
+	}
+
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(addr, debugSocketPermission); err != nil {
+		listener.Close()
+
+		return nil, fmt.Errorf("setting debug socket permission: %w", err)
+	}
+
+	return listener, nil
+}
+
+// stateDumpHandler serves the state dump on the debug listener. The page
+// and page_size query parameters select the nodes in the dump.
+func (h *Headscale) stateDumpHandler() http.HandlerFunc {
+	limiter := rate.NewLimiter(stateDumpRate, stateDumpBurst)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !limiter.Allow() {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many state dump requests", http.StatusTooManyRequests)
+
+			return
+		}
+
+		page, pageSize := 1, defaultStateDumpPageSize
+		if value := r.URL.Query().Get("page"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 {
+				http.Error(w, "invalid page", http.StatusBadRequest)
+
+				return
+			}
+			page = parsed
+		}
+		if value := r.URL.Query().Get("page_size"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 || parsed > maxStateDumpPageSize {
+				http.Error(w, "invalid page_size", http.StatusBadRequest)
+
+				return
+			}
+			pageSize = parsed
+		}
+
+		dump, err := h.stateDump(page, pageSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(dump)
+	}
+}
+
+// LoadStateDump writes the users, nodes and routes of a state dump to the
+// database so an issue can be reproduced against it. The database must
+// not have any users.
+func (h *Headscale) LoadStateDump(dump *StateDump) error {
+	hash, err := h.policyHash()
+	if err != nil {
+		return fmt.Errorf("hashing policy: %w", err)
+	}
+	if dump.PolicyHash != "" && hash != dump.PolicyHash {
+		log.Warn().
+			Str("dump", dump.PolicyHash).
+			Str("local", hash).
+			Msg("The policy does not match the policy the dump was taken with")
+	}
+
+	return h.db.Write(func(tx *gorm.DB) error {
+		users, err := db.ListUsers(tx)
+		if err != nil {
+			return err
+		}
+		if len(users) > 0 {
+			return ErrStateDumpNotEmpty
+		}
+
+		for _, dumpUser := range dump.Users {
+			user := types.User{
+				Model: gorm.Model{ID: dumpUser.ID, CreatedAt: dumpUser.CreatedAt},
+				Name:  dumpUser.Name,
+			}
+			if err := tx.Create(&user).Error; err != nil {
+				return fmt.Errorf("creating user %q: %w", dumpUser.Name, err)
+			}
+		}
+
+		for _, dumpNode := range dump.Nodes {
+			node := types.Node{
+				ID:             dumpNode.ID,
+				MachineKey:     dumpNode.MachineKey,
+				NodeKey:        dumpNode.NodeKey,
+				DiscoKey:       dumpNode.DiscoKey,
+				IPv4:           dumpNode.IPv4,
+				IPv6:           dumpNode.IPv6,
+				Hostname:       dumpNode.Hostname,
+				GivenName:      dumpNode.GivenName,
+				UserID:         dumpNode.UserID,
+				RegisterMethod: dumpNode.RegisterMethod,
+				ForcedTags:     dumpNode.ForcedTags,
+				Hostinfo:       dumpNode.Hostinfo,
+				Endpoints:      dumpNode.Endpoints,
+				LastSeen:       dumpNode.LastSeen,
+				Expiry:         dumpNode.Expiry,
+				Quarantined:    dumpNode.Quarantined,
+				CreatedAt:      dumpNode.CreatedAt,
+			}
+			if err := tx.Omit(clause.Associations).Create(&node).Error; err != nil {
+				return fmt.Errorf("creating node %q: %w", dumpNode.Hostname, err)
+			}
+
+			for _, dumpRoute := range dumpNode.Routes {
+				route := types.Route{
+					Model:      gorm.Model{ID: dumpRoute.ID},
+					NodeID:     node.ID.Uint64(),
+					Prefix:     types.IPPrefix(dumpRoute.Prefix),
+					Advertised: dumpRoute.Advertised,
+					Enabled:    dumpRoute.Enabled,
+					IsPrimary:  dumpRoute.IsPrimary,
+				}
+				if err := tx.Omit(clause.Associations).Create(&route).Error; err != nil {
+					return fmt.Errorf("creating route %s of node %q: %w", dumpRoute.Prefix, dumpNode.Hostname, err)
+				}
+			}
+		}
+
+		return nil
+	})
+}
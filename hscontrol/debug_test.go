@@ -0,0 +1,187 @@
+package hscontrol
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"gopkg.in/check.v1"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func TestRedactConfig(t *testing.T) {
+	settings := map[string]any{
+		"server_url": "https://headscale.example.com",
+		"oidc": map[string]any{
+			"issuer":        "https://sso.example.com",
+			"client_id":     "headscale",
+			"client_secret": "hunter2",
+		},
+		"database": map[string]any{
+			"postgres": map[string]any{
+				"user":     "headscale",
+				"password": "hunter2",
+			},
+		},
+		"private_key_path": "/var/lib/headscale/private.key",
+		"cli": map[string]any{
+			"api_key": "secret",
+		},
+	}
+
+	want := map[string]any{
+		"server_url": "https://headscale.example.com",
+		"oidc": map[string]any{
+			"issuer":        "https://sso.example.com",
+			"client_id":     redactedValue,
+			"client_secret": redactedValue,
+		},
+		"database": map[string]any{
+			"postgres": map[string]any{
+				"user":     "headscale",
+				"password": redactedValue,
+			},
+		},
+		"private_key_path": redactedValue,
+		"cli": map[string]any{
+			"api_key": redactedValue,
+		},
+	}
+
+	if diff := cmp.Diff(want, redactConfig(settings)); diff != "" {
+		t.Errorf("redactConfig() unexpected result (-want +got):\n%s", diff)
+	}
+}
+
+func (s *Suite) TestStateDumpRoundTrip(c *check.C) {
+	user, err := app.db.CreateUser("test")
+	c.Assert(err, check.IsNil)
+
+	for index := 0; index < 3; index++ {
+		ipv4 := netip.MustParseAddr(fmt.Sprintf("100.64.0.%d", index+1))
+		node := types.Node{
+			ID:             types.NodeID(index + 1),
+			MachineKey:     key.NewMachine().Public(),
+			NodeKey:        key.NewNode().Public(),
+			DiscoKey:       key.NewDisco().Public(),
+			Hostname:       fmt.Sprintf("testnode%d", index),
+			GivenName:      fmt.Sprintf("testnode%d", index),
+			UserID:         user.ID,
+			RegisterMethod: util.RegisterMethodAuthKey,
+			IPv4:           &ipv4,
+			Hostinfo:       &tailcfg.Hostinfo{OS: "linux"},
+		}
+		c.Assert(app.db.DB.Save(&node).Error, check.IsNil)
+
+		route := types.Route{
+			NodeID:     node.ID.Uint64(),
+			Prefix:     types.IPPrefix(netip.MustParsePrefix(fmt.Sprintf("10.%d.0.0/16", index))),
+			Advertised: true,
+			Enabled:    index == 0,
+			IsPrimary:  index == 0,
+		}
+		c.Assert(app.db.DB.Save(&route).Error, check.IsNil)
+	}
+
+	// Two pages with a page size of two.
+	handler := app.stateDumpHandler()
+	var dump *StateDump
+	for page := 1; page != 0; {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/debug/state?page=%d&page_size=2", page), nil))
+		c.Assert(rec.Code, check.Equals, http.StatusOK)
+
+		var next StateDump
+		c.Assert(json.Unmarshal(rec.Body.Bytes(), &next), check.IsNil)
+		c.Assert(next.TotalNodes, check.Equals, 3)
+
+		if dump == nil {
+			dump = &next
+		} else {
+			dump.Nodes = append(dump.Nodes, next.Nodes...)
+		}
+		page = next.NextPage
+	}
+	c.Assert(dump.Users, check.HasLen, 1)
+	c.Assert(dump.Nodes, check.HasLen, 3)
+
+	s.ResetDB(c)
+	c.Assert(app.LoadStateDump(dump), check.IsNil)
+
+	nodes, err := app.db.ListNodes()
+	c.Assert(err, check.IsNil)
+	c.Assert(nodes, check.HasLen, 3)
+	for index, node := range nodes {
+		c.Assert(node.Hostname, check.Equals, dump.Nodes[index].Hostname)
+		c.Assert(node.NodeKey, check.Equals, dump.Nodes[index].NodeKey)
+		c.Assert(*node.IPv4, check.Equals, *dump.Nodes[index].IPv4)
+		c.Assert(node.User.Name, check.Equals, "test")
+		c.Assert(node.Routes, check.HasLen, 1)
+		c.Assert(netip.Prefix(node.Routes[0].Prefix), check.Equals, dump.Nodes[index].Routes[0].Prefix)
+		c.Assert(node.Routes[0].IsPrimary, check.Equals, index == 0)
+	}
+
+	// A database which is in use cannot be overwritten.
+	c.Assert(app.LoadStateDump(dump), check.Equals, ErrStateDumpNotEmpty)
+}
+
+func (s *Suite) TestStateDumpRateLimit(c *check.C) {
+	handler := app.stateDumpHandler()
+
+	var limited bool
+	for range stateDumpBurst + 1 {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/debug/state", nil))
+		if rec.Code == http.StatusTooManyRequests {
+			limited = true
+			c.Assert(rec.Header().Get("Retry-After"), check.Not(check.Equals), "")
+		}
+	}
+	c.Assert(limited, check.Equals, true)
+}
+
+func (s *Suite) TestLocalDebugListener(c *check.C) {
+	socket := filepath.Join(tmpDir, "debug", "debug.sock")
+	app.cfg.DebugAddr = "unix:" + socket
+
+	// A socket left by a previous run is replaced.
+	c.Assert(os.MkdirAll(filepath.Dir(socket), 0o700), check.IsNil)
+	c.Assert(os.WriteFile(socket, nil, 0o600), check.IsNil)
+
+	listener, err := app.listenDebug()
+	c.Assert(err, check.IsNil)
+
+	server := &http.Server{Handler: app.debugMux()}
+	go server.Serve(listener)
+	defer server.Close()
+
+	info, err := os.Stat(socket)
+	c.Assert(err, check.IsNil)
+	c.Assert(info.Mode().Perm(), check.Equals, os.FileMode(debugSocketPermission))
+
+	client := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	for _, path := range []string{"/debug/vars", "/debug/batcher", "/debug/pprof/"} {
+		resp, err := client.Get("http://headscale" + path)
+		c.Assert(err, check.IsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, check.Equals, http.StatusOK, check.Commentf("path %s", path))
+	}
+}
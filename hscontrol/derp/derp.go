@@ -60,6 +60,47 @@ func loadDERPMapFromURL(addr url.URL) (*tailcfg.DERPMap, error) {
 	return &derpMap, err
 }
 
+// SourceStatus is the result of loading the DERP map of one of the
+// paths or URLs of the configuration.
+type SourceStatus struct {
+	Source  string
+	Regions int
+	Err     error
+}
+
+// CheckSources loads the DERP map of every path and URL of the
+// configuration, unlike GetDERPMap it does not stop at the first one
+// failing.
+func CheckSources(cfg types.DERPConfig) []SourceStatus {
+	var statuses []SourceStatus
+
+	for _, path := range cfg.Paths {
+		status := SourceStatus{Source: path}
+		derpMap, err := loadDERPMapFromPath(path)
+		if err != nil {
+			status.Err = err
+		} else {
+			status.Regions = len(derpMap.Regions)
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	for _, addr := range cfg.URLs {
+		status := SourceStatus{Source: addr.String()}
+		derpMap, err := loadDERPMapFromURL(addr)
+		if err != nil {
+			status.Err = err
+		} else {
+			status.Regions = len(derpMap.Regions)
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
 // mergeDERPMaps naively merges a list of DERPMaps into a single
 // DERPMap, it will _only_ look at the Regions, an integer.
 // If a region exists in two of the given DERPMaps, the region
@@ -0,0 +1,574 @@
+package derp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"tailscale.com/tailcfg"
+)
+
+var (
+	ErrInvalidRegion     = errors.New("invalid DERP region")
+	ErrRegionExists      = errors.New("DERP region already exists")
+	ErrRegionNotFound    = errors.New("DERP region not found")
+	ErrRegionNotCustom   = errors.New("DERP region is not a custom region")
+	errProbeUnexpectedRC = errors.New("unexpected status code")
+)
+
+// RegionStatus describes a region of the DERP map and the result of its
+// health probes.
+type RegionStatus struct {
+	Region *tailcfg.DERPRegion
+
+	// Custom regions were added at runtime and can be removed.
+	Custom bool
+
+	// Healthy is false if the region failed enough probes in a row to
+	// be left out of the DERP map sent to the clients.
+	Healthy   bool
+	Latency   time.Duration
+	LastProbe time.Time
+	LastError string
+}
+
+func (status RegionStatus) Proto() *v1.DERPRegion {
+	region := &v1.DERPRegion{
+		RegionId:   int32(status.Region.RegionID),
+		RegionCode: status.Region.RegionCode,
+		RegionName: status.Region.RegionName,
+		Custom:     status.Custom,
+		Healthy:    status.Healthy,
+		LatencyMs:  float64(status.Latency) / float64(time.Millisecond),
+		LastError:  status.LastError,
+	}
+
+	if !status.LastProbe.IsZero() {
+		region.LastProbe = timestamppb.New(status.LastProbe)
+	}
+
+	for _, node := range status.Region.Nodes {
+		region.Nodes = append(region.Nodes, &v1.DERPNode{
+			Name:     node.Name,
+			HostName: node.HostName,
+			Ipv4:     node.IPv4,
+			Ipv6:     node.IPv6,
+			StunPort: int32(node.STUNPort),
+			DerpPort: int32(node.DERPPort),
+			StunOnly: node.STUNOnly,
+		})
+	}
+
+	return region
+}
+
+// RegionFromProto returns the DERP region described by a region of
+// the API. The health fields are ignored.
+func RegionFromProto(region *v1.DERPRegion) *tailcfg.DERPRegion {
+	if region == nil {
+		return nil
+	}
+
+	derpRegion := &tailcfg.DERPRegion{
+		RegionID:   int(region.GetRegionId()),
+		RegionCode: region.GetRegionCode(),
+		RegionName: region.GetRegionName(),
+	}
+
+	for _, node := range region.GetNodes() {
+		derpRegion.Nodes = append(derpRegion.Nodes, &tailcfg.DERPNode{
+			Name:     node.GetName(),
+			RegionID: derpRegion.RegionID,
+			HostName: node.GetHostName(),
+			IPv4:     node.GetIpv4(),
+			IPv6:     node.GetIpv6(),
+			STUNPort: int(node.GetStunPort()),
+			DERPPort: int(node.GetDerpPort()),
+			STUNOnly: node.GetStunOnly(),
+		})
+	}
+
+	return derpRegion
+}
+
+type regionHealth struct {
+	failures  int
+	latency   time.Duration
+	lastProbe time.Time
+	lastError string
+}
+
+// Manager holds the DERP map sent to the clients. It merges the regions
+// loaded from the configured sources with the custom regions added at
+// runtime, and leaves out the regions failing their health probes.
+//
+// onChange is called with the new DERP map every time it changes.
+type Manager struct {
+	cfg      types.DERPConfig
+	onChange func(*tailcfg.DERPMap)
+
+	client         *http.Client
+	insecureClient *http.Client
+
+	mu      sync.Mutex
+	base    *tailcfg.DERPMap
+	custom  map[int]*tailcfg.DERPRegion
+	health  map[int]*regionHealth
+	derpMap *tailcfg.DERPMap
+}
+
+func NewManager(
+	cfg types.DERPConfig,
+	base *tailcfg.DERPMap,
+	onChange func(*tailcfg.DERPMap),
+) *Manager {
+	insecureTransport := http.DefaultTransport.(*http.Transport).Clone()
+	insecureTransport.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: true, //nolint:gosec // only used for DERP nodes with InsecureForTests
+	}
+
+	m := &Manager{
+		cfg:            cfg,
+		onChange:       onChange,
+		client:         &http.Client{},
+		insecureClient: &http.Client{Transport: insecureTransport},
+		base:           base,
+		custom:         make(map[int]*tailcfg.DERPRegion),
+		health:         make(map[int]*regionHealth),
+	}
+	m.derpMap = m.build()
+
+	return m
+}
+
+// DERPMap returns the DERP map sent to the clients.
+func (m *Manager) DERPMap() *tailcfg.DERPMap {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.derpMap
+}
+
+// SetBase replaces the regions loaded from the configured sources.
+func (m *Manager) SetBase(base *tailcfg.DERPMap) {
+	m.mu.Lock()
+	m.base = base
+	m.mu.Unlock()
+
+	m.update(true)
+}
+
+// SetCustomRegions replaces the custom regions, without notifying of
+// the change. It is used to restore the regions when starting.
+func (m *Manager) SetCustomRegions(regions []*tailcfg.DERPRegion) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.custom = make(map[int]*tailcfg.DERPRegion, len(regions))
+	for _, region := range regions {
+		m.custom[region.RegionID] = region
+	}
+	m.derpMap = m.build()
+}
+
+// CustomRegions returns the custom regions, sorted by ID.
+func (m *Manager) CustomRegions() []*tailcfg.DERPRegion {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	regions := make([]*tailcfg.DERPRegion, 0, len(m.custom))
+	for _, region := range m.custom {
+		regions = append(regions, region)
+	}
+	sort.Slice(regions, func(i, j int) bool {
+		return regions[i].RegionID < regions[j].RegionID
+	})
+
+	return regions
+}
+
+// AddRegion adds a custom region. The region ID must not be used by
+// another region.
+func (m *Manager) AddRegion(region *tailcfg.DERPRegion) error {
+	if err := validateRegion(region); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	if _, ok := m.allRegions()[region.RegionID]; ok {
+		m.mu.Unlock()
+
+		return fmt.Errorf("%w: %d", ErrRegionExists, region.RegionID)
+	}
+
+	for index, node := range region.Nodes {
+		node.RegionID = region.RegionID
+		if node.Name == "" {
+			node.Name = strconv.Itoa(region.RegionID) + string(rune('a'+index))
+		}
+	}
+
+	m.custom[region.RegionID] = region
+	m.mu.Unlock()
+
+	m.update(true)
+
+	return nil
+}
+
+// RemoveRegion removes a custom region.
+func (m *Manager) RemoveRegion(regionID int) error {
+	m.mu.Lock()
+	if _, ok := m.custom[regionID]; !ok {
+		_, inBase := m.allRegions()[regionID]
+		m.mu.Unlock()
+
+		if inBase {
+			return fmt.Errorf("%w: %d", ErrRegionNotCustom, regionID)
+		}
+
+		return fmt.Errorf("%w: %d", ErrRegionNotFound, regionID)
+	}
+
+	delete(m.custom, regionID)
+	delete(m.health, regionID)
+	m.mu.Unlock()
+
+	m.update(true)
+
+	return nil
+}
+
+// Regions returns all the regions, including the unhealthy ones which
+// are not sent to the clients, sorted by ID.
+func (m *Manager) Regions() []RegionStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	regions := m.allRegions()
+	statuses := make([]RegionStatus, 0, len(regions))
+	for id, region := range regions {
+		status := RegionStatus{
+			Region:  region,
+			Healthy: m.healthy(id),
+		}
+		_, status.Custom = m.custom[id]
+
+		if health, ok := m.health[id]; ok {
+			status.Latency = health.latency
+			status.LastProbe = health.lastProbe
+			status.LastError = health.lastError
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Region.RegionID < statuses[j].Region.RegionID
+	})
+
+	return statuses
+}
+
+// ProbeWorker probes the regions at the configured interval, until the
+// context is done.
+func (m *Manager) ProbeWorker(ctx context.Context) {
+	log.Info().
+		Dur("interval", m.cfg.ProbeInterval).
+		Int("failure_threshold", m.cfg.ProbeFailureThreshold).
+		Msg("Setting up DERP region probes")
+
+	ticker := time.NewTicker(m.cfg.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		m.Probe(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Probe checks all the regions once. A region is healthy if one of its
+// nodes answers, and is left out of the DERP map after failing
+// ProbeFailureThreshold probes in a row.
+func (m *Manager) Probe(ctx context.Context) {
+	m.mu.Lock()
+	regions := m.allRegions()
+	m.mu.Unlock()
+
+	type result struct {
+		latency time.Duration
+		err     error
+	}
+
+	results := make(map[int]result, len(regions))
+	var resultsMu sync.Mutex
+	var wg sync.WaitGroup
+	for id, region := range regions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			latency, err := m.probeRegion(ctx, region)
+
+			resultsMu.Lock()
+			results[id] = result{latency: latency, err: err}
+			resultsMu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	now := time.Now()
+
+	m.mu.Lock()
+	current := m.allRegions()
+	changed := false
+	for id, res := range results {
+		// The region was removed while it was probed.
+		if _, ok := current[id]; !ok {
+			continue
+		}
+
+		health, ok := m.health[id]
+		if !ok {
+			health = &regionHealth{}
+			m.health[id] = health
+		}
+
+		wasHealthy := m.healthy(id)
+
+		health.lastProbe = now
+		if res.err != nil {
+			health.failures++
+			health.lastError = res.err.Error()
+		} else {
+			health.failures = 0
+			health.latency = res.latency
+			health.lastError = ""
+		}
+
+		regionCode := regions[id].RegionCode
+		if m.healthy(id) {
+			derpRegionHealthy.WithLabelValues(strconv.Itoa(id), regionCode).Set(1)
+		} else {
+			derpRegionHealthy.WithLabelValues(strconv.Itoa(id), regionCode).Set(0)
+		}
+		if res.err == nil {
+			derpRegionLatency.WithLabelValues(strconv.Itoa(id), regionCode).Set(res.latency.Seconds())
+		}
+
+		if wasHealthy != m.healthy(id) {
+			changed = true
+			logger := log.With().
+				Int("region_id", id).
+				Str("region_code", regionCode).
+				Logger()
+			if wasHealthy {
+				logger.Warn().
+					Str("error", health.lastError).
+					Int("failures", health.failures).
+					Msg("DERP region is unhealthy, removing it from the DERP map")
+			} else {
+				logger.Info().Msg("DERP region is healthy again, adding it back to the DERP map")
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	m.update(changed)
+}
+
+// probeRegion returns the latency of the fastest node of the region
+// answering its probe. Regions with only STUN nodes cannot be probed
+// and are always healthy.
+func (m *Manager) probeRegion(ctx context.Context, region *tailcfg.DERPRegion) (time.Duration, error) {
+	var lastErr error
+	var best time.Duration
+	probed := false
+
+	for _, node := range region.Nodes {
+		if node.STUNOnly {
+			continue
+		}
+		probed = true
+
+		latency, err := m.probeNode(ctx, node)
+		if err != nil {
+			lastErr = fmt.Errorf("node %s: %w", node.Name, err)
+
+			continue
+		}
+
+		if best == 0 || latency < best {
+			best = latency
+		}
+	}
+
+	if probed && best == 0 {
+		return 0, lastErr
+	}
+
+	return best, nil
+}
+
+// probeNode requests the probe endpoint of the DERP server of a node,
+// which is served by Tailscale's derper and by the embedded DERP
+// server.
+func (m *Manager) probeNode(ctx context.Context, node *tailcfg.DERPNode) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.cfg.ProbeTimeout)
+	defer cancel()
+
+	host := node.HostName
+	if node.DERPPort != 0 {
+		host = net.JoinHostPort(host, strconv.Itoa(node.DERPPort))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+host+"/derp/probe", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	client := m.client
+	if node.InsecureForTests {
+		client = m.insecureClient
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	latency := time.Since(start)
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%w: %s", errProbeUnexpectedRC, resp.Status)
+	}
+
+	// A zero latency is used for "no answer".
+	return max(latency, time.Nanosecond), nil
+}
+
+// update rebuilds the DERP map and calls onChange if it changed.
+func (m *Manager) update(changed bool) {
+	if !changed {
+		return
+	}
+
+	m.mu.Lock()
+	m.derpMap = m.build()
+	derpMap := m.derpMap
+	m.mu.Unlock()
+
+	if m.onChange != nil {
+		m.onChange(derpMap)
+	}
+}
+
+// healthy reports if the region has not failed too many probes in a
+// row. The caller must hold m.mu.
+func (m *Manager) healthy(regionID int) bool {
+	health, ok := m.health[regionID]
+	if !ok {
+		return true
+	}
+
+	return health.failures < max(m.cfg.ProbeFailureThreshold, 1)
+}
+
+// allRegions returns the regions from the sources and the custom
+// regions. The caller must hold m.mu.
+func (m *Manager) allRegions() map[int]*tailcfg.DERPRegion {
+	regions := make(map[int]*tailcfg.DERPRegion)
+	if m.base != nil {
+		for id, region := range m.base.Regions {
+			regions[id] = region
+		}
+	}
+	for id, region := range m.custom {
+		regions[id] = region
+	}
+
+	return regions
+}
+
+// build returns the DERP map without the unhealthy regions. If no
+// region is healthy, they are all kept, clients are better off trying
+// them than having no DERP server at all. The caller must hold m.mu.
+func (m *Manager) build() *tailcfg.DERPMap {
+	derpMap := &tailcfg.DERPMap{
+		Regions: m.allRegions(),
+	}
+	if m.base != nil {
+		derpMap.OmitDefaultRegions = m.base.OmitDefaultRegions
+	}
+
+	var unhealthy []int
+	for id := range derpMap.Regions {
+		if !m.healthy(id) {
+			unhealthy = append(unhealthy, id)
+		}
+	}
+
+	if len(unhealthy) < len(derpMap.Regions) {
+		for _, id := range unhealthy {
+			delete(derpMap.Regions, id)
+		}
+	} else if len(unhealthy) > 0 {
+		log.Warn().
+			Ints("regions", unhealthy).
+			Msg("All DERP regions are unhealthy, keeping them in the DERP map")
+	}
+
+	return derpMap
+}
+
+func validateRegion(region *tailcfg.DERPRegion) error {
+	if region == nil {
+		return fmt.Errorf("%w: region is empty", ErrInvalidRegion)
+	}
+
+	if region.RegionID <= 0 {
+		return fmt.Errorf("%w: region ID must be positive, got %d", ErrInvalidRegion, region.RegionID)
+	}
+
+	if region.RegionCode == "" {
+		return fmt.Errorf("%w: region code is required", ErrInvalidRegion)
+	}
+
+	if len(region.Nodes) == 0 {
+		return fmt.Errorf("%w: at least one node is required", ErrInvalidRegion)
+	}
+
+	var names []string
+	for _, node := range region.Nodes {
+		if node.HostName == "" {
+			return fmt.Errorf("%w: node host name is required", ErrInvalidRegion)
+		}
+
+		if node.Name != "" {
+			if slices.Contains(names, node.Name) {
+				return fmt.Errorf("%w: duplicate node name %q", ErrInvalidRegion, node.Name)
+			}
+			names = append(names, node.Name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,191 @@
+package derp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+// testRegion returns a region with a single node probed on the server.
+func testRegion(t *testing.T, id int, server *httptest.Server) *tailcfg.DERPRegion {
+	t.Helper()
+
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	derpPort, _ := strconv.Atoi(port)
+
+	return &tailcfg.DERPRegion{
+		RegionID:   id,
+		RegionCode: "test" + strconv.Itoa(id),
+		Nodes: []*tailcfg.DERPNode{
+			{
+				HostName:         host,
+				DERPPort:         derpPort,
+				InsecureForTests: true,
+			},
+		},
+	}
+}
+
+func probeServer(healthy *atomic.Bool) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/derp/probe" || !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func TestManagerAddRemoveRegion(t *testing.T) {
+	base := &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {RegionID: 1, RegionCode: "base", Nodes: []*tailcfg.DERPNode{{HostName: "derp.example.com"}}},
+		},
+	}
+
+	var notified int
+	m := NewManager(types.DERPConfig{}, base, func(*tailcfg.DERPMap) { notified++ })
+
+	custom := &tailcfg.DERPRegion{
+		RegionID:   900,
+		RegionCode: "custom",
+		Nodes:      []*tailcfg.DERPNode{{HostName: "derp.custom.example.com"}},
+	}
+	if err := m.AddRegion(custom); err != nil {
+		t.Fatalf("AddRegion() error: %s", err)
+	}
+	if _, ok := m.DERPMap().Regions[900]; !ok {
+		t.Errorf("region 900 is missing from the DERP map")
+	}
+	if got := custom.Nodes[0].Name; got != "900a" {
+		t.Errorf("node name = %q, want 900a", got)
+	}
+
+	tests := []struct {
+		name    string
+		err     error
+		wantErr error
+	}{
+		{
+			name:    "existing-region",
+			err:     m.AddRegion(&tailcfg.DERPRegion{RegionID: 1, RegionCode: "dup", Nodes: custom.Nodes}),
+			wantErr: ErrRegionExists,
+		},
+		{
+			name:    "invalid-region",
+			err:     m.AddRegion(&tailcfg.DERPRegion{RegionID: 901, RegionCode: "empty"}),
+			wantErr: ErrInvalidRegion,
+		},
+		{
+			name:    "remove-base-region",
+			err:     m.RemoveRegion(1),
+			wantErr: ErrRegionNotCustom,
+		},
+		{
+			name:    "remove-unknown-region",
+			err:     m.RemoveRegion(2),
+			wantErr: ErrRegionNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !errors.Is(tt.err, tt.wantErr) {
+				t.Errorf("error = %v, want %v", tt.err, tt.wantErr)
+			}
+		})
+	}
+
+	if err := m.RemoveRegion(900); err != nil {
+		t.Fatalf("RemoveRegion() error: %s", err)
+	}
+	if _, ok := m.DERPMap().Regions[900]; ok {
+		t.Errorf("region 900 is still in the DERP map")
+	}
+
+	if notified != 2 {
+		t.Errorf("onChange called %d times, want 2", notified)
+	}
+}
+
+func TestManagerProbe(t *testing.T) {
+	var healthyA, healthyB atomic.Bool
+	healthyA.Store(true)
+	healthyB.Store(true)
+
+	serverA := probeServer(&healthyA)
+	defer serverA.Close()
+	serverB := probeServer(&healthyB)
+	defer serverB.Close()
+
+	base := &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: testRegion(t, 1, serverA),
+			2: testRegion(t, 2, serverB),
+		},
+	}
+
+	cfg := types.DERPConfig{
+		ProbeInterval:         time.Minute,
+		ProbeTimeout:          5 * time.Second,
+		ProbeFailureThreshold: 2,
+	}
+
+	var notified int
+	m := NewManager(cfg, base, func(*tailcfg.DERPMap) { notified++ })
+	ctx := context.Background()
+
+	m.Probe(ctx)
+	if got := len(m.DERPMap().Regions); got != 2 {
+		t.Fatalf("DERP map has %d regions, want 2", got)
+	}
+	for _, status := range m.Regions() {
+		if !status.Healthy || status.Latency <= 0 || status.LastProbe.IsZero() {
+			t.Errorf("region %d: unexpected status %+v", status.Region.RegionID, status)
+		}
+	}
+
+	// The region is only removed once it reaches the failure threshold.
+	healthyB.Store(false)
+	m.Probe(ctx)
+	if got := len(m.DERPMap().Regions); got != 2 {
+		t.Fatalf("DERP map has %d regions after one failure, want 2", got)
+	}
+
+	m.Probe(ctx)
+	if _, ok := m.DERPMap().Regions[2]; ok {
+		t.Fatalf("unhealthy region 2 is still in the DERP map")
+	}
+	if notified != 1 {
+		t.Errorf("onChange called %d times, want 1", notified)
+	}
+
+	// All the regions are kept when none of them is healthy.
+	healthyA.Store(false)
+	m.Probe(ctx)
+	m.Probe(ctx)
+	if got := len(m.DERPMap().Regions); got != 2 {
+		t.Fatalf("DERP map has %d regions with all regions unhealthy, want 2", got)
+	}
+
+	healthyA.Store(true)
+	healthyB.Store(true)
+	m.Probe(ctx)
+	for _, status := range m.Regions() {
+		if !status.Healthy || status.LastError != "" {
+			t.Errorf("region %d: unexpected status %+v", status.Region.RegionID, status)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package derp
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const prometheusNamespace = "headscale"
+
+var (
+	derpRegionHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: prometheusNamespace,
+		Name:      "derp_region_healthy",
+		Help:      "1 if the DERP region passes its probes and is sent to the clients, 0 otherwise",
+	}, []string{"region_id", "region_code"})
+	derpRegionLatency = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: prometheusNamespace,
+		Name:      "derp_region_probe_latency_seconds",
+		Help:      "latency of the last successful probe of the DERP region",
+	}, []string{"region_id", "region_code"})
+)
@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/juanfont/headscale/hscontrol/types"
@@ -32,6 +33,9 @@ type DERPServer struct {
 	key           key.NodePrivate
 	cfg           *types.DERPConfig
 	tailscaleDERP *derp.Server
+
+	// meshPeers are the keys of the other DERP servers of the mesh.
+	meshPeers sync.Map
 }
 
 func NewDERPServer(
@@ -42,6 +46,14 @@ func NewDERPServer(
 	log.Trace().Caller().Msg("Creating new embedded DERP server")
 	server := derp.NewServer(derpKey, util.TSLogfWrapper()) // nolint // zerolinter complains
 
+	if cfg.ServerMeshKeyPath != "" {
+		meshKey, err := readMeshKey(cfg.ServerMeshKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		server.SetMeshKey(meshKey)
+	}
+
 	return &DERPServer{
 		serverURL:     serverURL,
 		key:           derpKey,
@@ -55,22 +67,38 @@ func (d *DERPServer) GenerateRegion() (tailcfg.DERPRegion, error) {
 	if err != nil {
 		return tailcfg.DERPRegion{}, err
 	}
-	var host string
+	// Hostname and Port strip the brackets from IPv6 literals,
+	// which the DERP client expects to be absent.
+	host := serverURL.Hostname()
 	var port int
-	host, portStr, err := net.SplitHostPort(serverURL.Host)
-	if err != nil {
-		if serverURL.Scheme == "https" {
-			host = serverURL.Host
-			port = 443
-		} else {
-			host = serverURL.Host
-			port = 80
-		}
-	} else {
+	if portStr := serverURL.Port(); portStr != "" {
 		port, err = strconv.Atoi(portStr)
 		if err != nil {
 			return tailcfg.DERPRegion{}, err
 		}
+	} else if serverURL.Scheme == "https" {
+		port = 443
+	} else {
+		port = 80
+	}
+
+	ipv4, ipv6 := d.cfg.IPv4, d.cfg.IPv6
+
+	// If headscale is addressed by an IP literal, tell the clients
+	// directly so they do not attempt to resolve it, or fall back to
+	// an address family the server is not reachable on.
+	if addr, err := netip.ParseAddr(host); err == nil {
+		switch {
+		case addr.Is4() && ipv4 == "":
+			ipv4 = addr.String()
+		case addr.Is6() && ipv6 == "":
+			ipv6 = addr.String()
+			// Only advertise IPv4 when it is explicitly configured,
+			// "none" disables the family on the client.
+			if d.cfg.IPv4 == "" {
+				ipv4 = "none"
+			}
+		}
 	}
 
 	localDERPregion := tailcfg.DERPRegion{
@@ -84,8 +112,8 @@ func (d *DERPServer) GenerateRegion() (tailcfg.DERPRegion, error) {
 				RegionID: d.cfg.ServerRegionID,
 				HostName: host,
 				DERPPort: port,
-				IPv4:     d.cfg.IPv4,
-				IPv6:     d.cfg.IPv6,
+				IPv4:     ipv4,
+				IPv6:     ipv6,
 			},
 		},
 	}
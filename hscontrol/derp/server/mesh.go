@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/rs/zerolog/log"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/net/netmon"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+)
+
+const meshConnectRetryInterval = 5 * time.Second
+
+var (
+	errInvalidMeshKey = errors.New("mesh key must contain exactly 64 hex digits")
+	meshKeyRegexp     = regexp.MustCompile(`(?i)^[0-9a-f]{64}$`)
+)
+
+// readMeshKey reads the mesh key from a file, in the format of the
+// --mesh-psk-file of Tailscale's derper so the same file can be used
+// for both.
+func readMeshKey(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading DERP mesh key: %w", err)
+	}
+
+	meshKey := strings.TrimSpace(string(content))
+	if !meshKeyRegexp.MatchString(meshKey) {
+		return "", errInvalidMeshKey
+	}
+
+	return meshKey, nil
+}
+
+// StartMesh connects to the other DERP servers of the region, to
+// forward them the packets for the clients connected to them, until
+// the context is done.
+func (d *DERPServer) StartMesh(ctx context.Context) error {
+	for _, host := range d.cfg.ServerMeshWith {
+		if err := d.meshWith(ctx, host); err != nil {
+			return fmt.Errorf("meshing with %s: %w", host, err)
+		}
+	}
+
+	return nil
+}
+
+func (d *DERPServer) meshWith(ctx context.Context, host string) error {
+	logf := logger.WithPrefix(util.TSLogfWrapper(), fmt.Sprintf("mesh(%q): ", host))
+
+	client, err := derphttp.NewClient(d.key, "https://"+host+"/derp", logf, netmon.NewStatic())
+	if err != nil {
+		return err
+	}
+	client.MeshKey = d.tailscaleDERP.MeshKey()
+	client.WatchConnectionChanges = true
+
+	// The other server connects to this one with the key it serves
+	// with, which is only known once connected to it.
+	go func() {
+		for {
+			err := client.Connect(ctx)
+			if err == nil {
+				d.meshPeers.Store(client.ServerPublicKey(), struct{}{})
+				log.Info().
+					Str("host", host).
+					Msg("Connected to DERP mesh peer")
+
+				return
+			}
+
+			log.Debug().
+				Err(err).
+				Str("host", host).
+				Msg("Failed to connect to DERP mesh peer, retrying")
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(meshConnectRetryInterval):
+			}
+		}
+	}()
+
+	add := func(peer key.NodePublic, _ netip.AddrPort) { d.tailscaleDERP.AddPacketForwarder(peer, client) }
+	remove := func(peer key.NodePublic) { d.tailscaleDERP.RemovePacketForwarder(peer, client) }
+	go client.RunWatchConnectionLoop(ctx, d.key.Public(), logf, add, remove)
+
+	return nil
+}
+
+// isMeshPeer reports if the key is the key of another DERP server of
+// the mesh.
+func (d *DERPServer) isMeshPeer(nodeKey key.NodePublic) bool {
+	_, ok := d.meshPeers.Load(nodeKey)
+
+	return ok
+}
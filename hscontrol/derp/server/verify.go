@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// verifyScheme is the URL scheme of the admission requests sent by the
+// embedded DERP server to verify its clients. The DERP server sends them
+// with http.DefaultClient, verifyTransport answers them in process.
+const verifyScheme = "headscale-derp-verify"
+
+var errVerifyTransport = errors.New("http.DefaultTransport is not an *http.Transport")
+
+// VerifyFunc reports if the node key belongs to a node allowed to connect
+// to the DERP server.
+type VerifyFunc func(ctx context.Context, nodeKey key.NodePublic) (bool, error)
+
+var (
+	registerVerifyOnce sync.Once
+	verifiers          sync.Map // URL host to VerifyFunc
+	verifierCount      atomic.Int64
+)
+
+type verifyTransport struct{}
+
+func (verifyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	verify, ok := verifiers.Load(req.URL.Host)
+	if !ok {
+		return nil, fmt.Errorf("no DERP client verifier for %q", req.URL.Host)
+	}
+
+	var admit tailcfg.DERPAdmitClientRequest
+	if err := json.NewDecoder(req.Body).Decode(&admit); err != nil {
+		return nil, fmt.Errorf("decoding DERP admission request: %w", err)
+	}
+
+	allow, err := verify.(VerifyFunc)(req.Context(), admit.NodePublic)
+	if err != nil {
+		return nil, err
+	}
+
+	if !allow {
+		log.Debug().
+			Str("node_key", admit.NodePublic.ShortString()).
+			Str("source", admit.Source.String()).
+			Msg("Rejecting unknown client of the embedded DERP server")
+	}
+
+	body, err := json.Marshal(tailcfg.DERPAdmitClientResponse{Allow: allow})
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// VerifyClients makes the DERP server only accept the clients verify
+// allows, and the other DERP servers of the mesh. Clients are rejected
+// if verify fails.
+func (d *DERPServer) VerifyClients(verify VerifyFunc) error {
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return errVerifyTransport
+	}
+	registerVerifyOnce.Do(func() {
+		transport.RegisterProtocol(verifyScheme, verifyTransport{})
+	})
+
+	host := strconv.FormatInt(verifierCount.Add(1), 10)
+	verifiers.Store(host, VerifyFunc(func(ctx context.Context, nodeKey key.NodePublic) (bool, error) {
+		if d.isMeshPeer(nodeKey) {
+			return true, nil
+		}
+
+		return verify(ctx, nodeKey)
+	}))
+
+	d.tailscaleDERP.SetVerifyClientURL(verifyScheme + "://" + host + "/verify")
+	d.tailscaleDERP.SetVerifyClientURLFailOpen(false)
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func TestVerifyClients(t *testing.T) {
+	known := key.NewNode().Public()
+	meshPeer := key.NewNode().Public()
+
+	d, err := NewDERPServer("https://headscale.example.com", key.NewNode(), &types.DERPConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.meshPeers.Store(meshPeer, struct{}{})
+
+	err = d.VerifyClients(func(_ context.Context, nodeKey key.NodePublic) (bool, error) {
+		return nodeKey == known, nil
+	})
+	if err != nil {
+		t.Fatalf("VerifyClients() error: %s", err)
+	}
+	url := verifyScheme + "://" + strconv.FormatInt(verifierCount.Load(), 10) + "/verify"
+
+	tests := []struct {
+		name    string
+		nodeKey key.NodePublic
+		want    bool
+	}{
+		{name: "known-node", nodeKey: known, want: true},
+		{name: "mesh-peer", nodeKey: meshPeer, want: true},
+		{name: "unknown-node", nodeKey: key.NewNode().Public(), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(tailcfg.DERPAdmitClientRequest{
+				NodePublic: tt.nodeKey,
+				Source:     netip.MustParseAddr("192.0.2.1"),
+			})
+
+			// The DERP server sends its admission requests with
+			// http.DefaultClient.
+			resp, err := http.DefaultClient.Post(url, "application/json", bytes.NewReader(body))
+			if err != nil {
+				t.Fatalf("admission request: %s", err)
+			}
+			defer resp.Body.Close()
+
+			var admit tailcfg.DERPAdmitClientResponse
+			if err := json.NewDecoder(resp.Body).Decode(&admit); err != nil {
+				t.Fatal(err)
+			}
+
+			if admit.Allow != tt.want {
+				t.Errorf("Allow = %t, want %t", admit.Allow, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadMeshKey(t *testing.T) {
+	dir := t.TempDir()
+	valid := strings.Repeat("0123456789abcdef", 4)
+
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		wantErr bool
+	}{
+		{name: "valid", content: valid + "\n", want: valid},
+		{name: "too-short", content: valid[:32], wantErr: true},
+		{name: "not-hex", content: strings.Repeat("z", 64), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readMeshKey(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readMeshKey() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("readMeshKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -4,23 +4,38 @@ package hscontrol
 import (
 	"context"
 	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"os"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"gorm.io/gorm"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
 
 	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
 	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/derp"
+	"github.com/juanfont/headscale/hscontrol/notifier"
+	"github.com/juanfont/headscale/hscontrol/policy"
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/juanfont/headscale/hscontrol/webhook"
 )
 
+// listNodesBatchSize is the minimum number of nodes read at a time when
+// listing a page of nodes.
+const listNodesBatchSize = 100
+
 type headscaleV1APIServer struct { // v1.HeadscaleServiceServer
 	v1.UnimplementedHeadscaleServiceServer
 	h *Headscale
@@ -36,7 +51,19 @@ func (api headscaleV1APIServer) GetUser(
 	ctx context.Context,
 	request *v1.GetUserRequest,
 ) (*v1.GetUserResponse, error) {
-	user, err := api.h.db.GetUser(request.GetName())
+	var user *types.User
+	var err error
+	switch selector := request.GetSelector().(type) {
+	case *v1.GetUserRequest_Name:
+		user, err = api.h.db.GetUser(selector.Name)
+	case *v1.GetUserRequest_Id:
+		user, err = api.h.db.GetUserByID(uint(selector.Id))
+	default:
+		return nil, status.Error(codes.InvalidArgument, "a user name or id is required")
+	}
+	if errors.Is(err, db.ErrUserNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -48,11 +75,38 @@ func (api headscaleV1APIServer) CreateUser(
 	ctx context.Context,
 	request *v1.CreateUserRequest,
 ) (*v1.CreateUserResponse, error) {
-	user, err := api.h.db.CreateUser(request.GetName())
+	if tailnet := request.GetTailnet(); tailnet != "" && api.h.cfg.Tailnet(tailnet) == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%s: %s", ErrTailnetNotFound, tailnet)
+	}
+
+	user, err := api.h.db.CreateTailnetUser(request.GetName(), request.GetTailnet())
+	if errors.Is(err, db.ErrUserExists) {
+		if !request.GetIfNotExists() {
+			return nil, status.Error(codes.AlreadyExists, err.Error())
+		}
+
+		user, err = api.h.db.GetUser(request.GetName())
+		if err != nil {
+			return nil, err
+		}
+		if user.Tailnet != request.GetTailnet() {
+			return nil, status.Errorf(
+				codes.FailedPrecondition,
+				"%s: %s is in tailnet %q",
+				db.ErrUserOtherTailnet,
+				user.Name,
+				user.Tailnet,
+			)
+		}
+
+		return &v1.CreateUserResponse{User: user.Proto()}, nil
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	api.h.sendUserEvent(webhook.EventUserCreated, user)
+
 	return &v1.CreateUserResponse{User: user.Proto()}, nil
 }
 
@@ -70,6 +124,13 @@ func (api headscaleV1APIServer) RenameUser(
 		return nil, err
 	}
 
+	api.h.sendUserEvent(webhook.EventUserRenamed, user)
+
+	// The groups given by the identity provider and the node shares list
+	// the users by name.
+	api.h.refreshIdPGroups()
+	api.h.refreshNodeShares()
+
 	return &v1.RenameUserResponse{User: user.Proto()}, nil
 }
 
@@ -77,11 +138,19 @@ func (api headscaleV1APIServer) DeleteUser(
 	ctx context.Context,
 	request *v1.DeleteUserRequest,
 ) (*v1.DeleteUserResponse, error) {
-	err := api.h.db.DestroyUser(request.GetName())
+	user, err := api.h.db.GetUser(request.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	err = api.h.db.DestroyUser(request.GetName())
 	if err != nil {
 		return nil, err
 	}
 
+	api.h.sendUserEvent(webhook.EventUserDeleted, user)
+	api.h.refreshNodeShares()
+
 	return &v1.DeleteUserResponse{}, nil
 }
 
@@ -89,23 +158,39 @@ func (api headscaleV1APIServer) ListUsers(
 	ctx context.Context,
 	request *v1.ListUsersRequest,
 ) (*v1.ListUsersResponse, error) {
-	users, err := api.h.db.ListUsers()
+	after, err := parsePageToken(request.GetPageToken())
 	if err != nil {
 		return nil, err
 	}
 
+	// One more user than the page holds tells if there is a next page.
+	pageSize := int(request.GetPageSize())
+	limit := 0
+	if pageSize > 0 {
+		limit = pageSize + 1
+	}
+
+	users, err := db.Read(api.h.db.ReadDB(), func(rx *gorm.DB) ([]types.User, error) {
+		return db.ListUsersPage(rx, uint(after), limit)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var nextPageToken string
+	if pageSize > 0 && len(users) > pageSize {
+		users = users[:pageSize]
+		nextPageToken = pageToken(uint64(users[pageSize-1].ID))
+	}
+
 	response := make([]*v1.User, len(users))
 	for index, user := range users {
 		response[index] = user.Proto()
 	}
 
-	sort.Slice(response, func(i, j int) bool {
-		return response[i].Id < response[j].Id
-	})
-
 	log.Trace().Caller().Interface("users", response).Msg("")
 
-	return &v1.ListUsersResponse{Users: response}, nil
+	return &v1.ListUsersResponse{Users: response, NextPageToken: nextPageToken}, nil
 }
 
 func (api headscaleV1APIServer) CreatePreAuthKey(
@@ -126,13 +211,37 @@ func (api headscaleV1APIServer) CreatePreAuthKey(
 		}
 	}
 
-	preAuthKey, err := api.h.db.CreatePreAuthKey(
+	pool4, pool6, err := types.ParseIPPools(request.GetIpPools())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := api.h.ipAlloc.CheckPools(pool4, pool6); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// An existing key with the same settings is returned instead of a
+	// new one if asked, so the key can be managed declaratively.
+	create := api.h.db.CreatePreAuthKey
+	if request.GetIfNotExists() {
+		create = api.h.db.CreatePreAuthKeyIfNotExists
+	}
+
+	preAuthKey, err := create(
 		request.GetUser(),
 		request.GetReusable(),
 		request.GetEphemeral(),
 		&expiration,
 		request.AclTags,
+		&types.PreAuthKeyLimits{
+			MaxUses:             int(request.GetMaxUses()),
+			ExpireAfterFirstUse: request.GetExpireAfterFirstUse().AsDuration(),
+			IPPools:             request.GetIpPools(),
+		},
 	)
+	if errors.Is(err, db.ErrPreAuthKeyLimitInvalid) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -195,12 +304,28 @@ func (api headscaleV1APIServer) RegisterNode(
 		return nil, err
 	}
 
-	ipv4, ipv6, err := api.h.ipAlloc.Next()
+	if err := api.h.checkNodeLimit(api.h.db.DB, mkey); err != nil {
+		if errors.Is(err, ErrNodeLimitReached) {
+			return nil, status.Error(codes.ResourceExhausted, err.Error())
+		}
+
+		return nil, err
+	}
+
+	if err := api.h.checkPendingNodeTags(mkey, request.GetUser()); err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	ipv4, ipv6, err := api.h.nextRegistrationIPs(mkey, request.GetUser())
 	if err != nil {
 		return nil, err
 	}
 
 	node, err := db.Write(api.h.db.DB, func(tx *gorm.DB) (*types.Node, error) {
+		if err := api.h.checkNodeLimit(tx, mkey); err != nil {
+			return nil, err
+		}
+
 		return db.RegisterNodeFromAuthCallback(
 			tx,
 			api.h.registrationCache,
@@ -211,10 +336,15 @@ func (api headscaleV1APIServer) RegisterNode(
 			ipv4, ipv6,
 		)
 	})
+	if errors.Is(err, ErrNodeLimitReached) {
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	api.h.sendNodeEvent(webhook.EventNodeRegistered, node)
+
 	return &v1.RegisterNodeResponse{Node: node.Proto()}, nil
 }
 
@@ -231,11 +361,61 @@ func (api headscaleV1APIServer) GetNode(
 
 	// Populate the online field based on
 	// currently connected nodes.
-	resp.Online = api.h.nodeNotifier.IsConnected(node.ID)
+	types.SetNodeProtoOnline(resp, api.h.nodeNotifier.IsConnected(node.ID))
+	setNodeProtoConnection(resp, api.h.nodeNotifier.Connection(node.ID))
 
 	return &v1.GetNodeResponse{Node: resp}, nil
 }
 
+func (api headscaleV1APIServer) LookupNode(
+	ctx context.Context,
+	request *v1.LookupNodeRequest,
+) (*v1.LookupNodeResponse, error) {
+	if request.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "a node name is required")
+	}
+
+	nodes, err := api.h.db.LookupNodes(request.GetName(), request.GetPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	// A name matching a node exactly is not ambiguous because it is also
+	// the prefix of other names.
+	if request.GetPrefix() {
+		exact := slices.DeleteFunc(slices.Clone(nodes), func(node *types.Node) bool {
+			return !strings.EqualFold(node.Hostname, request.GetName()) &&
+				!strings.EqualFold(node.GivenName, request.GetName())
+		})
+		if len(exact) > 0 {
+			nodes = exact
+		}
+	}
+
+	switch len(nodes) {
+	case 0:
+		return nil, status.Errorf(codes.NotFound, "no node matches %q", request.GetName())
+	case 1:
+	default:
+		matches := make([]string, len(nodes))
+		for i, node := range nodes {
+			matches[i] = fmt.Sprintf("%s (%d)", node.GivenName, node.ID)
+		}
+
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"%q matches %d nodes: %s",
+			request.GetName(), len(nodes), strings.Join(matches, ", "),
+		)
+	}
+
+	resp := nodes[0].Proto()
+	types.SetNodeProtoOnline(resp, api.h.nodeNotifier.IsConnected(nodes[0].ID))
+	setNodeProtoConnection(resp, api.h.nodeNotifier.Connection(nodes[0].ID))
+
+	return &v1.LookupNodeResponse{Node: resp}, nil
+}
+
 func (api headscaleV1APIServer) SetTags(
 	ctx context.Context,
 	request *v1.SetTagsRequest,
@@ -266,6 +446,7 @@ func (api headscaleV1APIServer) SetTags(
 		Type:        types.StatePeerChanged,
 		ChangeNodes: []types.NodeID{node.ID},
 		Message:     "called from api.SetTags",
+		Interactive: true,
 	}, node.ID)
 
 	log.Trace().
@@ -298,27 +479,10 @@ func (api headscaleV1APIServer) DeleteNode(
 		return nil, err
 	}
 
-	changedNodes, err := api.h.db.DeleteNode(
-		node,
-		api.h.nodeNotifier.LikelyConnectedMap(),
-	)
-	if err != nil {
+	if err := api.h.deleteNode(ctx, node); err != nil {
 		return nil, err
 	}
 
-	ctx = types.NotifyCtx(ctx, "cli-deletenode", node.Hostname)
-	api.h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
-		Type:    types.StatePeerRemoved,
-		Removed: []types.NodeID{node.ID},
-	})
-
-	if changedNodes != nil {
-		api.h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
-			Type:        types.StatePeerChanged,
-			ChangeNodes: changedNodes,
-		})
-	}
-
 	return &v1.DeleteNodeResponse{}, nil
 }
 
@@ -351,7 +515,11 @@ func (api headscaleV1APIServer) ExpireNode(
 		node.ID)
 
 	ctx = types.NotifyCtx(ctx, "cli-expirenode-peers", node.Hostname)
-	api.h.nodeNotifier.NotifyWithIgnore(ctx, types.StateUpdateExpire(node.ID, now), node.ID)
+	update := types.StateUpdateExpire(node.ID, now)
+	update.Interactive = true
+	api.h.nodeNotifier.NotifyWithIgnore(ctx, update, node.ID)
+
+	api.h.sendNodeEvent(webhook.EventNodeExpired, node)
 
 	log.Trace().
 		Str("node", node.Hostname).
@@ -361,6 +529,55 @@ func (api headscaleV1APIServer) ExpireNode(
 	return &v1.ExpireNodeResponse{Node: node.Proto()}, nil
 }
 
+func (api headscaleV1APIServer) SetNodeExpiry(
+	ctx context.Context,
+	request *v1.SetNodeExpiryRequest,
+) (*v1.SetNodeExpiryResponse, error) {
+	expiry := time.Time{}
+	if request.GetExpiry() != nil {
+		expiry = request.GetExpiry().AsTime()
+		if !expiry.After(time.Now()) {
+			return nil, status.Error(
+				codes.InvalidArgument,
+				"expiry must be in the future, use expire to expire a node now",
+			)
+		}
+	}
+
+	node, err := db.Write(api.h.db.DB, func(tx *gorm.DB) (*types.Node, error) {
+		if err := db.NodeSetExpiry(tx, types.NodeID(request.GetNodeId()), expiry); err != nil {
+			return nil, err
+		}
+
+		return db.GetNodeByID(tx, types.NodeID(request.GetNodeId()))
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, status.Error(codes.NotFound, "node not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = types.NotifyCtx(ctx, "cli-setnodeexpiry-self", node.Hostname)
+	api.h.nodeNotifier.NotifyByNodeID(
+		ctx,
+		types.StateUpdate{
+			Type:        types.StateSelfUpdate,
+			ChangeNodes: []types.NodeID{node.ID},
+		},
+		node.ID)
+
+	ctx = types.NotifyCtx(ctx, "cli-setnodeexpiry-peers", node.Hostname)
+	api.h.nodeNotifier.NotifyWithIgnore(ctx, types.StateUpdateExpire(node.ID, expiry), node.ID)
+
+	log.Trace().
+		Str("node", node.Hostname).
+		Time("expiry", expiry).
+		Msg("node expiry set")
+
+	return &v1.SetNodeExpiryResponse{Node: node.Proto()}, nil
+}
+
 func (api headscaleV1APIServer) RenameNode(
 	ctx context.Context,
 	request *v1.RenameNodeRequest,
@@ -386,6 +603,7 @@ func (api headscaleV1APIServer) RenameNode(
 		Type:        types.StatePeerChanged,
 		ChangeNodes: []types.NodeID{node.ID},
 		Message:     "called from api.RenameNode",
+		Interactive: true,
 	}, node.ID)
 
 	log.Trace().
@@ -400,59 +618,98 @@ func (api headscaleV1APIServer) ListNodes(
 	ctx context.Context,
 	request *v1.ListNodesRequest,
 ) (*v1.ListNodesResponse, error) {
+	after, err := parsePageToken(request.GetPageToken())
+	if err != nil {
+		return nil, err
+	}
+
+	var prefix netip.Prefix
+	if request.GetIpPrefix() != "" {
+		prefix, err = netip.ParsePrefix(request.GetIpPrefix())
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid IP prefix: %s", err)
+		}
+	}
+
+	var selector types.LabelSelector
+	if request.GetLabelSelector() != "" {
+		selector, err = types.ParseLabelSelector(request.GetLabelSelector())
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	filter := db.NodeFilter{User: request.GetUser()}
+	if request.GetExpiredOnly() {
+		filter.ExpiredAt = time.Now()
+	}
+
+	// The nodes are read in batches until the page is full, as the online,
+	// tag, prefix and label filters are not applied by the database.
+	pageSize := int(request.GetPageSize())
+	batchSize := 0
+	if pageSize > 0 {
+		batchSize = max(pageSize+1, listNodesBatchSize)
+	}
+
 	isLikelyConnected := api.h.nodeNotifier.LikelyConnectedMap()
-	if request.GetUser() != "" {
-		nodes, err := db.Read(api.h.db.DB, func(rx *gorm.DB) (types.Nodes, error) {
-			return db.ListNodesByUser(rx, request.GetUser())
+	connections := api.h.nodeNotifier.Connections()
+	response := []*v1.Node{}
+	for {
+		nodes, err := db.Read(api.h.db.ReadDB(), func(rx *gorm.DB) (types.Nodes, error) {
+			return db.ListNodesPage(rx, filter, types.NodeID(after), batchSize)
 		})
 		if err != nil {
 			return nil, err
 		}
 
-		response := make([]*v1.Node, len(nodes))
-		for index, node := range nodes {
-			resp := node.Proto()
+		for _, node := range nodes {
+			after = node.ID.Uint64()
 
 			// Populate the online field based on
 			// currently connected nodes.
-			if val, ok := isLikelyConnected.Load(node.ID); ok && val {
-				resp.Online = true
+			val, ok := isLikelyConnected.Load(node.ID)
+			online := ok && val
+			if request.GetOnlineOnly() && !online {
+				continue
 			}
 
-			response[index] = resp
-		}
-
-		return &v1.ListNodesResponse{Nodes: response}, nil
-	}
+			if prefix.IsValid() && !slices.ContainsFunc(node.IPs(), prefix.Contains) {
+				continue
+			}
 
-	nodes, err := api.h.db.ListNodes()
-	if err != nil {
-		return nil, err
-	}
+			if selector != nil && !selector.Matches(node.Labels) {
+				continue
+			}
 
-	sort.Slice(nodes, func(i, j int) bool {
-		return nodes[i].ID < nodes[j].ID
-	})
+			validTags, invalidTags := api.h.policyOf(node).TagsOfNode(
+				node,
+			)
+			if tag := request.GetTag(); tag != "" &&
+				!slices.Contains(validTags, tag) && !slices.Contains(node.ForcedTags, tag) {
+				continue
+			}
 
-	response := make([]*v1.Node, len(nodes))
-	for index, node := range nodes {
-		resp := node.Proto()
+			resp := node.Proto()
+			types.SetNodeProtoOnline(resp, online)
+			setNodeProtoConnection(resp, connections[node.ID])
+			resp.InvalidTags = invalidTags
+			resp.ValidTags = validTags
+			response = append(response, resp)
+		}
 
-		// Populate the online field based on
-		// currently connected nodes.
-		if val, ok := isLikelyConnected.Load(node.ID); ok && val {
-			resp.Online = true
+		if batchSize == 0 || len(nodes) < batchSize || len(response) > pageSize {
+			break
 		}
+	}
 
-		validTags, invalidTags := api.h.ACLPolicy.TagsOfNode(
-			node,
-		)
-		resp.InvalidTags = invalidTags
-		resp.ValidTags = validTags
-		response[index] = resp
+	var nextPageToken string
+	if pageSize > 0 && len(response) > pageSize {
+		response = response[:pageSize]
+		nextPageToken = pageToken(response[pageSize-1].GetId())
 	}
 
-	return &v1.ListNodesResponse{Nodes: response}, nil
+	return &v1.ListNodesResponse{Nodes: response, NextPageToken: nextPageToken}, nil
 }
 
 func (api headscaleV1APIServer) MoveNode(
@@ -469,144 +726,896 @@ func (api headscaleV1APIServer) MoveNode(
 		return nil, err
 	}
 
+	// A node moved to a user it was shared with is no longer shared.
+	api.h.refreshNodeShares()
+
 	return &v1.MoveNodeResponse{Node: node.Proto()}, nil
 }
 
-func (api headscaleV1APIServer) BackfillNodeIPs(
+func (api headscaleV1APIServer) QuarantineNode(
 	ctx context.Context,
-	request *v1.BackfillNodeIPsRequest,
-) (*v1.BackfillNodeIPsResponse, error) {
-	log.Trace().Msg("Backfill called")
-
-	if !request.Confirmed {
-		return nil, errors.New("not confirmed, aborting")
-	}
+	request *v1.QuarantineNodeRequest,
+) (*v1.QuarantineNodeResponse, error) {
+	node, err := db.Write(api.h.db.DB, func(tx *gorm.DB) (*types.Node, error) {
+		err := db.NodeSetQuarantined(
+			tx,
+			types.NodeID(request.GetNodeId()),
+			request.GetQuarantined(),
+		)
+		if err != nil {
+			return nil, err
+		}
 
-	changes, err := api.h.db.BackfillNodeIPs(api.h.ipAlloc)
+		return db.GetNodeByID(tx, types.NodeID(request.GetNodeId()))
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return &v1.BackfillNodeIPsResponse{Changes: changes}, nil
-}
-
-func (api headscaleV1APIServer) GetRoutes(
-	ctx context.Context,
-	request *v1.GetRoutesRequest,
-) (*v1.GetRoutesResponse, error) {
-	routes, err := db.Read(api.h.db.DB, func(rx *gorm.DB) (types.Routes, error) {
-		return db.GetRoutes(rx)
+	// A full update removes a quarantined node from the peers of all
+	// nodes and clears its own netmap and packet filter, or adds it
+	// back when it is released.
+	ctx = types.NotifyCtx(ctx, "cli-quarantinenode", node.Hostname)
+	api.h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+		Type: types.StateFullUpdate,
 	})
-	if err != nil {
-		return nil, err
-	}
 
-	return &v1.GetRoutesResponse{
-		Routes: types.Routes(routes).Proto(),
-	}, nil
+	// The primary routes of a quarantined node are failed over, and a
+	// released node takes over the routes without a primary.
+	api.h.routeManager.NodeIsolationChanged(node)
+
+	log.Info().
+		Str("node", node.Hostname).
+		Bool("quarantined", node.Quarantined).
+		Msg("node quarantine changed")
+
+	return &v1.QuarantineNodeResponse{Node: node.Proto()}, nil
 }
 
-func (api headscaleV1APIServer) EnableRoute(
+func (api headscaleV1APIServer) ListPendingNodes(
 	ctx context.Context,
-	request *v1.EnableRouteRequest,
-) (*v1.EnableRouteResponse, error) {
-	update, err := db.Write(api.h.db.DB, func(tx *gorm.DB) (*types.StateUpdate, error) {
-		return db.EnableRoute(tx, request.GetRouteId())
-	})
+	request *v1.ListPendingNodesRequest,
+) (*v1.ListPendingNodesResponse, error) {
+	pending, err := api.h.pendingNodes()
 	if err != nil {
 		return nil, err
 	}
 
-	if update != nil {
-		ctx := types.NotifyCtx(ctx, "cli-enableroute", "unknown")
-		api.h.nodeNotifier.NotifyAll(
-			ctx, *update)
+	response := make([]*v1.PendingNode, len(pending))
+	for index, node := range pending {
+		response[index] = &v1.PendingNode{
+			Id:               node.ID,
+			MachineKey:       node.MachineKey.String(),
+			NodeKey:          node.Node.NodeKey.String(),
+			Hostname:         node.Node.Hostname,
+			NodeId:           node.Node.ID.Uint64(),
+			AwaitingApproval: node.Node.AwaitingApproval,
+		}
+		if node.Node.AwaitingApproval {
+			response[index].User = node.Node.User.Name
+		}
+		if node.Node.LastSeen != nil {
+			response[index].RequestedAt = timestamppb.New(*node.Node.LastSeen)
+		}
 	}
 
-	return &v1.EnableRouteResponse{}, nil
+	return &v1.ListPendingNodesResponse{Nodes: response}, nil
 }
 
-func (api headscaleV1APIServer) DisableRoute(
+func (api headscaleV1APIServer) ApprovePendingNode(
 	ctx context.Context,
-	request *v1.DisableRouteRequest,
-) (*v1.DisableRouteResponse, error) {
-	update, err := db.Write(api.h.db.DB, func(tx *gorm.DB) ([]types.NodeID, error) {
-		return db.DisableRoute(tx, request.GetRouteId(), api.h.nodeNotifier.LikelyConnectedMap())
-	})
+	request *v1.ApprovePendingNodeRequest,
+) (*v1.ApprovePendingNodeResponse, error) {
+	pending, err := api.h.findPendingNode(request.GetId())
+	if errors.Is(err, ErrPendingNodeNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	if update != nil {
-		ctx := types.NotifyCtx(ctx, "cli-disableroute", "unknown")
-		api.h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
-			Type:        types.StatePeerChanged,
-			ChangeNodes: update,
-		})
-	}
+	// A registered node keeps its user, the user of the request can
+	// only confirm it.
+	if pending.Node.AwaitingApproval {
+		if request.GetUser() != "" && request.GetUser() != pending.Node.User.Name {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				"node is registered to user %q",
+				pending.Node.User.Name,
+			)
+		}
 
-	return &v1.DisableRouteResponse{}, nil
-}
+		node, err := api.h.approveNode(ctx, pending)
+		if err != nil {
+			return nil, err
+		}
 
-func (api headscaleV1APIServer) GetNodeRoutes(
-	ctx context.Context,
-	request *v1.GetNodeRoutesRequest,
-) (*v1.GetNodeRoutesResponse, error) {
-	node, err := api.h.db.GetNodeByID(types.NodeID(request.GetNodeId()))
-	if err != nil {
-		return nil, err
-	}
+		log.Info().
+			Str("node", node.Hostname).
+			Str("user", node.User.Name).
+			Msg("node awaiting approval approved")
 
-	routes, err := api.h.db.GetNodeRoutes(node)
-	if err != nil {
-		return nil, err
+		return &v1.ApprovePendingNodeResponse{Node: node.Proto()}, nil
 	}
 
-	return &v1.GetNodeRoutesResponse{
-		Routes: types.Routes(routes).Proto(),
-	}, nil
-}
+	if request.GetUser() == "" {
+		return nil, status.Error(codes.InvalidArgument, "user is required to register the node")
+	}
 
-func (api headscaleV1APIServer) DeleteRoute(
-	ctx context.Context,
-	request *v1.DeleteRouteRequest,
-) (*v1.DeleteRouteResponse, error) {
-	isConnected := api.h.nodeNotifier.LikelyConnectedMap()
-	update, err := db.Write(api.h.db.DB, func(tx *gorm.DB) ([]types.NodeID, error) {
-		return db.DeleteRoute(tx, request.GetRouteId(), isConnected)
+	registered, err := api.RegisterNode(ctx, &v1.RegisterNodeRequest{
+		User: request.GetUser(),
+		Key:  pending.MachineKey.String(),
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	if update != nil {
-		ctx := types.NotifyCtx(ctx, "cli-deleteroute", "unknown")
-		api.h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
-			Type:        types.StatePeerChanged,
-			ChangeNodes: update,
-		})
-	}
+	log.Info().
+		Str("node", pending.Node.Hostname).
+		Str("user", request.GetUser()).
+		Msg("pending node approved")
 
-	return &v1.DeleteRouteResponse{}, nil
+	return &v1.ApprovePendingNodeResponse{Node: registered.GetNode()}, nil
 }
 
-func (api headscaleV1APIServer) CreateApiKey(
+func (api headscaleV1APIServer) RejectPendingNode(
 	ctx context.Context,
-	request *v1.CreateApiKeyRequest,
-) (*v1.CreateApiKeyResponse, error) {
-	var expiration time.Time
-	if request.GetExpiration() != nil {
-		expiration = request.GetExpiration().AsTime()
+	request *v1.RejectPendingNodeRequest,
+) (*v1.RejectPendingNodeResponse, error) {
+	pending, err := api.h.rejectPendingNode(ctx, request.GetId())
+	if errors.Is(err, ErrPendingNodeNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
 	}
-
-	apiKey, _, err := api.h.db.CreateAPIKey(
-		&expiration,
-	)
 	if err != nil {
 		return nil, err
 	}
 
-	return &v1.CreateApiKeyResponse{ApiKey: apiKey}, nil
+	log.Info().
+		Str("node", pending.Node.Hostname).
+		Msg("pending node rejected")
+
+	return &v1.RejectPendingNodeResponse{}, nil
+}
+
+func (api headscaleV1APIServer) SetPosture(
+	ctx context.Context,
+	request *v1.SetPostureRequest,
+) (*v1.SetPostureResponse, error) {
+	for name := range request.GetAttributes() {
+		if !policy.IsCustomPostureAttribute(name) {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				"invalid posture attribute %q, must start with custom: followed by letters, digits, _ or -",
+				name,
+			)
+		}
+	}
+
+	node, err := db.Write(api.h.db.DB, func(tx *gorm.DB) (*types.Node, error) {
+		node, err := db.GetNodeByID(tx, types.NodeID(request.GetNodeId()))
+		if err != nil {
+			return nil, err
+		}
+
+		attrs := maps.Clone(node.PostureAttributes)
+		if attrs == nil {
+			attrs = make(types.PostureAttributes)
+		}
+		for _, name := range request.GetRemove() {
+			delete(attrs, name)
+		}
+		maps.Copy(attrs, request.GetAttributes())
+
+		if err := db.NodeSetPostureAttributes(tx, node.ID, attrs); err != nil {
+			return nil, err
+		}
+		node.PostureAttributes = attrs
+
+		return node, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The postures of a node change which rules it is a source of, so
+	// the packet filters of all nodes are recompiled.
+	ctx = types.NotifyCtx(ctx, "cli-setposture", node.Hostname)
+	api.h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+		Type: types.StateFullUpdate,
+	})
+
+	log.Info().
+		Str("node", node.Hostname).
+		Interface("posture_attributes", node.PostureAttributes).
+		Msg("node posture attributes changed")
+
+	return &v1.SetPostureResponse{Node: node.Proto()}, nil
+}
+
+func (api headscaleV1APIServer) SetNodeLabels(
+	ctx context.Context,
+	request *v1.SetNodeLabelsRequest,
+) (*v1.SetNodeLabelsResponse, error) {
+	for key, value := range request.GetLabels() {
+		if err := types.ValidateNodeLabel(key, value); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	node, err := db.Write(api.h.db.DB, func(tx *gorm.DB) (*types.Node, error) {
+		node, err := db.GetNodeByID(tx, types.NodeID(request.GetNodeId()))
+		if err != nil {
+			return nil, err
+		}
+
+		labels := maps.Clone(node.Labels)
+		if labels == nil {
+			labels = make(types.NodeLabels)
+		}
+		for _, key := range request.GetRemove() {
+			delete(labels, key)
+		}
+		maps.Copy(labels, request.GetLabels())
+
+		if err := db.NodeSetLabels(tx, node.ID, labels); err != nil {
+			return nil, err
+		}
+		node.Labels = labels
+
+		return node, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The label: aliases of the policy select the nodes by their
+	// labels, so the packet filters of all nodes are recompiled.
+	ctx = types.NotifyCtx(ctx, "cli-setlabels", node.Hostname)
+	api.h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+		Type: types.StateFullUpdate,
+	})
+
+	log.Info().
+		Str("node", node.Hostname).
+		Interface("labels", node.Labels).
+		Msg("node labels changed")
+
+	return &v1.SetNodeLabelsResponse{Node: node.Proto()}, nil
+}
+
+func (api headscaleV1APIServer) GetNodeHealth(
+	ctx context.Context,
+	request *v1.GetNodeHealthRequest,
+) (*v1.GetNodeHealthResponse, error) {
+	node, err := api.h.db.GetNodeByID(types.NodeID(request.GetNodeId()))
+	if err != nil {
+		return nil, err
+	}
+
+	metrics, err := api.h.db.GetNodeClientMetrics(node.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.GetNodeHealthResponse{Health: node.HealthProto(metrics)}, nil
+}
+
+func (api headscaleV1APIServer) ShareNode(
+	ctx context.Context,
+	request *v1.ShareNodeRequest,
+) (*v1.ShareNodeResponse, error) {
+	share, err := api.h.db.ShareNode(types.NodeID(request.GetNodeId()), request.GetUser())
+	if err != nil {
+		return nil, err
+	}
+
+	api.h.refreshNodeShares()
+
+	log.Info().
+		Str("node", share.Node.Hostname).
+		Str("user", share.User.Name).
+		Msg("node shared")
+
+	return &v1.ShareNodeResponse{Share: share.Proto()}, nil
+}
+
+func (api headscaleV1APIServer) UnshareNode(
+	ctx context.Context,
+	request *v1.UnshareNodeRequest,
+) (*v1.UnshareNodeResponse, error) {
+	err := api.h.db.UnshareNode(types.NodeID(request.GetNodeId()), request.GetUser())
+	if err != nil {
+		return nil, err
+	}
+
+	api.h.refreshNodeShares()
+
+	log.Info().
+		Uint64("node.id", request.GetNodeId()).
+		Str("user", request.GetUser()).
+		Msg("node unshared")
+
+	return &v1.UnshareNodeResponse{}, nil
+}
+
+func (api headscaleV1APIServer) ListNodeShares(
+	ctx context.Context,
+	request *v1.ListNodeSharesRequest,
+) (*v1.ListNodeSharesResponse, error) {
+	shares, err := api.h.db.ListNodeShares(types.NodeID(request.GetNodeId()))
+	if err != nil {
+		return nil, err
+	}
+
+	response := make([]*v1.NodeShare, len(shares))
+	for index := range shares {
+		response[index] = shares[index].Proto()
+	}
+
+	return &v1.ListNodeSharesResponse{Shares: response}, nil
+}
+
+func (api headscaleV1APIServer) ListDERPRegions(
+	ctx context.Context,
+	request *v1.ListDERPRegionsRequest,
+) (*v1.ListDERPRegionsResponse, error) {
+	statuses := api.h.derpManager.Regions()
+
+	response := make([]*v1.DERPRegion, len(statuses))
+	for index, regionStatus := range statuses {
+		response[index] = regionStatus.Proto()
+	}
+
+	return &v1.ListDERPRegionsResponse{Regions: response}, nil
+}
+
+func (api headscaleV1APIServer) AddDERPRegion(
+	ctx context.Context,
+	request *v1.AddDERPRegionRequest,
+) (*v1.AddDERPRegionResponse, error) {
+	region := derp.RegionFromProto(request.GetRegion())
+
+	err := api.h.derpManager.AddRegion(region)
+	switch {
+	case errors.Is(err, derp.ErrInvalidRegion):
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, derp.ErrRegionExists):
+		return nil, status.Error(codes.AlreadyExists, err.Error())
+	case err != nil:
+		return nil, err
+	}
+
+	err = api.h.db.SetCustomDERPRegions(api.h.derpManager.CustomRegions())
+	if err != nil {
+		// Do not keep a region which would be lost on restart.
+		_ = api.h.derpManager.RemoveRegion(region.RegionID)
+
+		return nil, err
+	}
+
+	log.Info().
+		Int("region_id", region.RegionID).
+		Str("region_code", region.RegionCode).
+		Msg("custom DERP region added")
+
+	return &v1.AddDERPRegionResponse{
+		Region: derp.RegionStatus{Region: region, Custom: true, Healthy: true}.Proto(),
+	}, nil
+}
+
+func (api headscaleV1APIServer) RemoveDERPRegion(
+	ctx context.Context,
+	request *v1.RemoveDERPRegionRequest,
+) (*v1.RemoveDERPRegionResponse, error) {
+	regionID := int(request.GetRegionId())
+
+	err := api.h.derpManager.RemoveRegion(regionID)
+	switch {
+	case errors.Is(err, derp.ErrRegionNotFound):
+		return nil, status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, derp.ErrRegionNotCustom):
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	case err != nil:
+		return nil, err
+	}
+
+	err = api.h.db.SetCustomDERPRegions(api.h.derpManager.CustomRegions())
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().
+		Int("region_id", regionID).
+		Msg("custom DERP region removed")
+
+	return &v1.RemoveDERPRegionResponse{}, nil
+}
+
+func (api headscaleV1APIServer) GetPolicy(
+	ctx context.Context,
+	request *v1.GetPolicyRequest,
+) (*v1.GetPolicyResponse, error) {
+	switch api.h.cfg.ACL.Mode {
+	case types.PolicyModeDB:
+		stored, err := api.h.db.GetPolicy()
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, status.Error(codes.NotFound, "no policy is stored in the database")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return &v1.GetPolicyResponse{Policy: stored.Proto()}, nil
+
+	default:
+		policyPath := api.h.policyPath()
+		if policyPath == "" {
+			return nil, status.Error(codes.NotFound, "no policy file is configured")
+		}
+
+		// The policy file has no versions.
+		data, err := os.ReadFile(util.AbsolutePathFromConfigPath(policyPath))
+		if err != nil {
+			return nil, err
+		}
+
+		return &v1.GetPolicyResponse{Policy: &v1.Policy{Policy: string(data)}}, nil
+	}
+}
+
+func (api headscaleV1APIServer) SetPolicy(
+	ctx context.Context,
+	request *v1.SetPolicyRequest,
+) (*v1.SetPolicyResponse, error) {
+	if request.GetIfNotExists() && api.h.cfg.ACL.Mode == types.PolicyModeDB {
+		current, err := api.h.db.GetPolicy()
+		if err == nil && current.Data == request.GetPolicy() {
+			return &v1.SetPolicyResponse{Policy: current.Proto()}, nil
+		}
+	}
+
+	stored, err := api.h.SetPolicy(request.GetPolicy())
+	if err != nil {
+		return nil, policyStatusError(err)
+	}
+
+	return &v1.SetPolicyResponse{Policy: stored.Proto()}, nil
+}
+
+func (api headscaleV1APIServer) ListPolicyVersions(
+	ctx context.Context,
+	request *v1.ListPolicyVersionsRequest,
+) (*v1.ListPolicyVersionsResponse, error) {
+	if api.h.cfg.ACL.Mode != types.PolicyModeDB {
+		return nil, status.Error(codes.FailedPrecondition, ErrPolicyNotInDB.Error())
+	}
+
+	versions, err := api.h.db.ListPolicyVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	response := make([]*v1.Policy, len(versions))
+	for index := range versions {
+		response[index] = versions[index].Proto()
+	}
+
+	return &v1.ListPolicyVersionsResponse{Versions: response}, nil
+}
+
+func (api headscaleV1APIServer) RollbackPolicy(
+	ctx context.Context,
+	request *v1.RollbackPolicyRequest,
+) (*v1.RollbackPolicyResponse, error) {
+	stored, err := api.h.RollbackPolicy(request.GetVersion())
+	if err != nil {
+		return nil, policyStatusError(err)
+	}
+
+	return &v1.RollbackPolicyResponse{Policy: stored.Proto()}, nil
+}
+
+func (api headscaleV1APIServer) DiffPolicy(
+	ctx context.Context,
+	request *v1.DiffPolicyRequest,
+) (*v1.DiffPolicyResponse, error) {
+	diffs, err := api.h.DiffPolicy(request.GetPolicy())
+	if err != nil {
+		return nil, policyStatusError(err)
+	}
+
+	response := make([]*v1.NodePolicyDiff, len(diffs))
+	for index, diff := range diffs {
+		response[index] = diff.Proto()
+	}
+
+	return &v1.DiffPolicyResponse{Nodes: response}, nil
+}
+
+func (api headscaleV1APIServer) CheckPolicy(
+	ctx context.Context,
+	request *v1.CheckPolicyRequest,
+) (*v1.CheckPolicyResponse, error) {
+	check, err := api.h.CheckPolicy(
+		request.GetSrc(),
+		request.GetDst(),
+		request.GetProto(),
+		request.GetPolicy(),
+	)
+	if err != nil {
+		return nil, policyStatusError(err)
+	}
+
+	return &v1.CheckPolicyResponse{
+		Allowed: check.Allowed,
+		Matches: check.Matches,
+		Denied:  check.Denied,
+	}, nil
+}
+
+// policyStatusError returns the gRPC status of an error setting the
+// policy.
+func policyStatusError(err error) error {
+	switch {
+	case errors.Is(err, ErrPolicyNotInDB):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrPolicyInvalid), errors.Is(err, ErrPolicyCheckInvalid):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, ErrPolicyVersionNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	default:
+		return err
+	}
+}
+
+func (api headscaleV1APIServer) ListDNSRecords(
+	ctx context.Context,
+	request *v1.ListDNSRecordsRequest,
+) (*v1.ListDNSRecordsResponse, error) {
+	records, err := api.h.db.ListDNSRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	response := make([]*v1.DNSRecord, len(records))
+	for index := range records {
+		response[index] = records[index].Proto()
+	}
+
+	return &v1.ListDNSRecordsResponse{Records: response}, nil
+}
+
+func (api headscaleV1APIServer) AddDNSRecord(
+	ctx context.Context,
+	request *v1.AddDNSRecordRequest,
+) (*v1.AddDNSRecordResponse, error) {
+	record, err := api.h.db.CreateDNSRecord(types.DNSRecord{
+		Name:  request.GetName(),
+		Type:  request.GetType(),
+		Value: request.GetValue(),
+	})
+	switch {
+	case errors.Is(err, types.ErrInvalidDNSRecord):
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, db.ErrDNSRecordExists):
+		return nil, status.Error(codes.AlreadyExists, err.Error())
+	case err != nil:
+		return nil, err
+	}
+
+	if err := api.h.dnsConfigChanged(); err != nil {
+		return nil, err
+	}
+
+	return &v1.AddDNSRecordResponse{Record: record.Proto()}, nil
+}
+
+func (api headscaleV1APIServer) DeleteDNSRecord(
+	ctx context.Context,
+	request *v1.DeleteDNSRecordRequest,
+) (*v1.DeleteDNSRecordResponse, error) {
+	err := api.h.db.DeleteDNSRecord(request.GetId())
+	if errors.Is(err, db.ErrDNSRecordNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := api.h.dnsConfigChanged(); err != nil {
+		return nil, err
+	}
+
+	return &v1.DeleteDNSRecordResponse{}, nil
+}
+
+func (api headscaleV1APIServer) ListScopedNameservers(
+	ctx context.Context,
+	request *v1.ListScopedNameserversRequest,
+) (*v1.ListScopedNameserversResponse, error) {
+	stored, err := api.h.db.ListScopedNameservers()
+	if err != nil {
+		return nil, err
+	}
+
+	var response []*v1.ScopedNameservers
+	for _, nameservers := range append(slices.Clone(api.h.cfg.DNSScopedNameservers), stored...) {
+		response = append(response, nameservers.Proto())
+	}
+
+	return &v1.ListScopedNameserversResponse{Nameservers: response}, nil
+}
+
+func (api headscaleV1APIServer) AddScopedNameservers(
+	ctx context.Context,
+	request *v1.AddScopedNameserversRequest,
+) (*v1.AddScopedNameserversResponse, error) {
+	nameservers, err := api.h.db.CreateScopedNameservers(types.ScopedNameservers{
+		Domain:      request.GetDomain(),
+		Nameservers: request.GetNameservers(),
+		Nodes:       request.GetNodes(),
+	})
+	if errors.Is(err, types.ErrInvalidScopedNameservers) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := api.h.dnsConfigChanged(); err != nil {
+		return nil, err
+	}
+
+	return &v1.AddScopedNameserversResponse{Nameservers: nameservers.Proto()}, nil
+}
+
+func (api headscaleV1APIServer) DeleteScopedNameservers(
+	ctx context.Context,
+	request *v1.DeleteScopedNameserversRequest,
+) (*v1.DeleteScopedNameserversResponse, error) {
+	err := api.h.db.DeleteScopedNameservers(request.GetId())
+	if errors.Is(err, db.ErrScopedNameserversNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := api.h.dnsConfigChanged(); err != nil {
+		return nil, err
+	}
+
+	return &v1.DeleteScopedNameserversResponse{}, nil
+}
+
+func (api headscaleV1APIServer) BackfillNodeIPs(
+	ctx context.Context,
+	request *v1.BackfillNodeIPsRequest,
+) (*v1.BackfillNodeIPsResponse, error) {
+	log.Trace().Msg("Backfill called")
+
+	if !request.Confirmed {
+		return nil, errors.New("not confirmed, aborting")
+	}
+
+	changes, err := api.h.db.BackfillNodeIPs(api.h.ipAlloc, api.h.ACLPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.BackfillNodeIPsResponse{Changes: changes}, nil
+}
+
+func (api headscaleV1APIServer) GetRoutes(
+	ctx context.Context,
+	request *v1.GetRoutesRequest,
+) (*v1.GetRoutesResponse, error) {
+	routes, err := db.Read(api.h.db.ReadDB(), func(rx *gorm.DB) (types.Routes, error) {
+		return db.GetRoutes(rx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.GetRoutesResponse{
+		Routes: types.Routes(routes).Proto(),
+	}, nil
+}
+
+func (api headscaleV1APIServer) EnableRoute(
+	ctx context.Context,
+	request *v1.EnableRouteRequest,
+) (*v1.EnableRouteResponse, error) {
+	update, err := db.Write(api.h.db.DB, func(tx *gorm.DB) (*types.StateUpdate, error) {
+		routeID, err := requestRouteID(tx, request.GetRouteId(), request.GetNodeId(), request.GetPrefix())
+		if err != nil {
+			return nil, err
+		}
+
+		return db.EnableRoute(tx, routeID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []types.NodeID
+	if update != nil {
+		ctx := types.NotifyCtx(ctx, "cli-enableroute", "unknown")
+		update.Interactive = true
+		api.h.nodeNotifier.NotifyAll(
+			ctx, *update)
+		api.h.sendNodeEventsByID(webhook.EventRoutesChanged, update.ChangeNodes...)
+		changed = update.ChangeNodes
+	}
+
+	return &v1.EnableRouteResponse{UpdatedNodeIds: nodeIDsProto(changed)}, nil
+}
+
+func (api headscaleV1APIServer) DisableRoute(
+	ctx context.Context,
+	request *v1.DisableRouteRequest,
+) (*v1.DisableRouteResponse, error) {
+	update, err := db.Write(api.h.db.DB, func(tx *gorm.DB) ([]types.NodeID, error) {
+		routeID, err := requestRouteID(tx, request.GetRouteId(), request.GetNodeId(), request.GetPrefix())
+		if err != nil {
+			return nil, err
+		}
+
+		return db.DisableRoute(tx, routeID, api.h.nodeNotifier.LikelyConnectedMap())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if update != nil {
+		ctx := types.NotifyCtx(ctx, "cli-disableroute", "unknown")
+		api.h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+			Type:        types.StatePeerChanged,
+			ChangeNodes: update,
+			Interactive: true,
+		})
+		api.h.sendNodeEventsByID(webhook.EventRoutesChanged, update...)
+	}
+
+	return &v1.DisableRouteResponse{UpdatedNodeIds: nodeIDsProto(update)}, nil
+}
+
+func (api headscaleV1APIServer) GetNodeRoutes(
+	ctx context.Context,
+	request *v1.GetNodeRoutesRequest,
+) (*v1.GetNodeRoutesResponse, error) {
+	node, err := api.h.db.GetNodeByID(types.NodeID(request.GetNodeId()))
+	if err != nil {
+		return nil, err
+	}
+
+	routes, err := api.h.db.GetNodeRoutes(node)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.GetNodeRoutesResponse{
+		Routes: types.Routes(routes).Proto(),
+	}, nil
+}
+
+func (api headscaleV1APIServer) DeleteRoute(
+	ctx context.Context,
+	request *v1.DeleteRouteRequest,
+) (*v1.DeleteRouteResponse, error) {
+	isConnected := api.h.nodeNotifier.LikelyConnectedMap()
+	update, err := db.Write(api.h.db.DB, func(tx *gorm.DB) ([]types.NodeID, error) {
+		routeID, err := requestRouteID(tx, request.GetRouteId(), request.GetNodeId(), request.GetPrefix())
+		if err != nil {
+			return nil, err
+		}
+
+		return db.DeleteRoute(tx, routeID, isConnected)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if update != nil {
+		ctx := types.NotifyCtx(ctx, "cli-deleteroute", "unknown")
+		api.h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+			Type:        types.StatePeerChanged,
+			ChangeNodes: update,
+			Interactive: true,
+		})
+		api.h.sendNodeEventsByID(webhook.EventRoutesChanged, update...)
+	}
+
+	return &v1.DeleteRouteResponse{UpdatedNodeIds: nodeIDsProto(update)}, nil
+}
+
+// requestRouteID returns the ID of the route of a request, given either
+// by its ID or by the node and prefix.
+func requestRouteID(tx *gorm.DB, routeID uint64, nodeID uint64, prefix string) (uint64, error) {
+	if routeID != 0 {
+		return routeID, nil
+	}
+
+	if nodeID == 0 || prefix == "" {
+		return 0, status.Error(codes.InvalidArgument, "a route ID, or a node ID and prefix, is required")
+	}
+
+	pref, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return 0, status.Errorf(codes.InvalidArgument, "parsing prefix: %s", err)
+	}
+
+	route, err := db.GetRouteByNodePrefix(tx, types.NodeID(nodeID), pref)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, status.Errorf(codes.NotFound, "node %d has no route for %s", nodeID, pref)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(route.ID), nil
+}
+
+func nodeIDsProto(nodeIDs []types.NodeID) []uint64 {
+	ids := make([]uint64, 0, len(nodeIDs))
+	for _, id := range nodeIDs {
+		ids = append(ids, id.Uint64())
+	}
+
+	return ids
+}
+
+// setNodeProtoConnection sets when the node last connected to and
+// disconnected from this instance.
+func setNodeProtoConnection(nodeProto *v1.Node, conn notifier.Connection) {
+	if !conn.ConnectedAt.IsZero() {
+		nodeProto.ConnectedAt = timestamppb.New(conn.ConnectedAt)
+	}
+	if !conn.DisconnectedAt.IsZero() {
+		nodeProto.DisconnectedAt = timestamppb.New(conn.DisconnectedAt)
+	}
+}
+
+// pageToken is the token of the page following the resource with the
+// given ID, the pages are ordered by ID.
+func pageToken(id uint64) string {
+	return strconv.FormatUint(id, 10)
+}
+
+func parsePageToken(token string) (uint64, error) {
+	if token == "" {
+		return 0, nil
+	}
+
+	id, err := strconv.ParseUint(token, 10, 64)
+	if err != nil {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid page token %q", token)
+	}
+
+	return id, nil
+}
+
+func (api headscaleV1APIServer) CreateApiKey(
+	ctx context.Context,
+	request *v1.CreateApiKeyRequest,
+) (*v1.CreateApiKeyResponse, error) {
+	var expiration time.Time
+	if request.GetExpiration() != nil {
+		expiration = request.GetExpiration().AsTime()
+	}
+
+	apiKey, _, err := api.h.db.CreateAPIKey(
+		&expiration,
+		request.GetScopes()...,
+	)
+	if errors.Is(err, types.ErrInvalidAPIScope) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.CreateApiKeyResponse{ApiKey: apiKey}, nil
 }
 
 func (api headscaleV1APIServer) ExpireApiKey(
@@ -737,4 +1746,80 @@ func (api headscaleV1APIServer) DebugCreateNode(
 	return &v1.DebugCreateNodeResponse{Node: newNode.Proto()}, nil
 }
 
+func (api headscaleV1APIServer) WatchEvents(
+	request *v1.WatchEventsRequest,
+	stream v1.HeadscaleService_WatchEventsServer,
+) error {
+	for _, eventType := range request.GetEvents() {
+		if !webhook.ValidEventType(eventType) {
+			return status.Errorf(codes.InvalidArgument, "unknown event %q", eventType)
+		}
+	}
+
+	events, stop := api.h.webhooks.Watch(request.GetEvents()...)
+	defer stop()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				return status.Error(
+					codes.Unavailable,
+					"event stream closed, the watcher fell behind or headscale is shutting down",
+				)
+			}
+
+			if err := stream.Send(watchEventProto(event)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// watchEventProto converts an event to the message sent to the watchers,
+// the node only carries the fields of the webhook payload.
+func watchEventProto(event webhook.Event) *v1.WatchEventsResponse {
+	resp := &v1.WatchEventsResponse{
+		Id:   event.ID,
+		Type: string(event.Type),
+		Time: timestamppb.New(event.Time),
+	}
+
+	if node := event.Node; node != nil {
+		resp.Node = &v1.Node{
+			Id:          node.ID,
+			Name:        node.Hostname,
+			GivenName:   node.Name,
+			User:        &v1.User{Name: node.User},
+			IpAddresses: node.IPAddresses,
+			ForcedTags:  node.Tags,
+			Online:      node.Online,
+		}
+		if node.LastSeen != nil {
+			resp.Node.LastSeen = timestamppb.New(*node.LastSeen)
+		}
+		if node.Expiry != nil {
+			resp.Node.Expiry = timestamppb.New(*node.Expiry)
+		}
+		for _, route := range node.Routes {
+			resp.Node.Routes = append(resp.Node.Routes, &v1.NodeRoute{
+				Prefix:   route.Prefix,
+				Approved: route.Enabled,
+				Primary:  route.IsPrimary,
+			})
+		}
+	}
+
+	if user := event.User; user != nil {
+		resp.User = &v1.User{
+			Id:   strconv.FormatUint(user.ID, util.Base10),
+			Name: user.Name,
+		}
+	}
+
+	return resp
+}
+
 func (api headscaleV1APIServer) mustEmbedUnimplementedHeadscaleServiceServer() {}
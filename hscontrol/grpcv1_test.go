@@ -1,6 +1,26 @@
 package hscontrol
 
-import "testing"
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	grpcRuntime "github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/juanfont/headscale/hscontrol/derp"
+	"github.com/juanfont/headscale/hscontrol/mapper"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/webhook"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gopkg.in/check.v1"
+	"tailscale.com/tailcfg"
+)
 
 func Test_validateTag(t *testing.T) {
 	type args struct {
@@ -40,3 +60,584 @@ func Test_validateTag(t *testing.T) {
 		})
 	}
 }
+
+func (s *Suite) TestGetUser(c *check.C) {
+	user, err := app.db.CreateUser("test-get")
+	c.Assert(err, check.IsNil)
+
+	api := newHeadscaleV1APIServer(app)
+
+	resp, err := api.GetUser(context.Background(), &v1.GetUserRequest{
+		Selector: &v1.GetUserRequest_Name{Name: "test-get"},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.GetUser().GetName(), check.Equals, "test-get")
+
+	resp, err = api.GetUser(context.Background(), &v1.GetUserRequest{
+		Selector: &v1.GetUserRequest_Id{Id: uint64(user.ID)},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.GetUser().GetName(), check.Equals, "test-get")
+
+	_, err = api.GetUser(context.Background(), &v1.GetUserRequest{
+		Selector: &v1.GetUserRequest_Id{Id: uint64(user.ID) + 100},
+	})
+	c.Assert(status.Code(err), check.Equals, codes.NotFound)
+
+	_, err = api.GetUser(context.Background(), &v1.GetUserRequest{})
+	c.Assert(status.Code(err), check.Equals, codes.InvalidArgument)
+}
+
+func (s *Suite) TestLookupNode(c *check.C) {
+	node, peer := createPollTestNodes(c)
+	c.Assert(app.db.DB.Model(peer).Update("hostname", node.Hostname+"-b").Error, check.IsNil)
+
+	api := newHeadscaleV1APIServer(app)
+
+	lookup := func(name string, prefix bool) (*v1.Node, error) {
+		resp, err := api.LookupNode(context.Background(), &v1.LookupNodeRequest{
+			Name:   name,
+			Prefix: prefix,
+		})
+
+		return resp.GetNode(), err
+	}
+
+	// The exact match wins over the other names starting with it.
+	found, err := lookup(node.Hostname, true)
+	c.Assert(err, check.IsNil)
+	c.Assert(found.GetId(), check.Equals, node.ID.Uint64())
+
+	found, err = lookup(peer.GivenName, false)
+	c.Assert(err, check.IsNil)
+	c.Assert(found.GetId(), check.Equals, peer.ID.Uint64())
+
+	_, err = lookup("testnode", true)
+	c.Assert(status.Code(err), check.Equals, codes.FailedPrecondition)
+
+	_, err = lookup("testnode", false)
+	c.Assert(status.Code(err), check.Equals, codes.NotFound)
+
+	_, err = lookup("", true)
+	c.Assert(status.Code(err), check.Equals, codes.InvalidArgument)
+}
+
+func (s *Suite) TestListNodesPages(c *check.C) {
+	node, peer := createPollTestNodes(c)
+
+	expired := time.Now().Add(-time.Hour)
+	c.Assert(app.db.DB.Model(node).Update("expiry", expired).Error, check.IsNil)
+	c.Assert(app.db.DB.Model(peer).Update("forced_tags", types.StringList{"tag:web"}).Error, check.IsNil)
+
+	ch := make(chan types.StateUpdate, 1)
+	app.nodeNotifier.AddNode(peer.ID, ch)
+	defer app.nodeNotifier.RemoveNode(peer.ID, ch)
+
+	api := newHeadscaleV1APIServer(app)
+
+	list := func(request *v1.ListNodesRequest) ([]uint64, string) {
+		resp, err := api.ListNodes(context.Background(), request)
+		c.Assert(err, check.IsNil)
+
+		ids := []uint64{}
+		for _, n := range resp.GetNodes() {
+			ids = append(ids, n.GetId())
+		}
+
+		return ids, resp.GetNextPageToken()
+	}
+
+	ids, next := list(&v1.ListNodesRequest{PageSize: 1})
+	c.Assert(ids, check.DeepEquals, []uint64{1})
+	c.Assert(next, check.Not(check.Equals), "")
+
+	ids, next = list(&v1.ListNodesRequest{PageSize: 1, PageToken: next})
+	c.Assert(ids, check.DeepEquals, []uint64{2})
+	c.Assert(next, check.Equals, "")
+
+	ids, _ = list(&v1.ListNodesRequest{})
+	c.Assert(ids, check.DeepEquals, []uint64{1, 2})
+
+	ids, _ = list(&v1.ListNodesRequest{ExpiredOnly: true})
+	c.Assert(ids, check.DeepEquals, []uint64{1})
+
+	ids, _ = list(&v1.ListNodesRequest{Tag: "tag:web"})
+	c.Assert(ids, check.DeepEquals, []uint64{2})
+
+	ids, next = list(&v1.ListNodesRequest{OnlineOnly: true, PageSize: 1})
+	c.Assert(ids, check.DeepEquals, []uint64{2})
+	c.Assert(next, check.Equals, "")
+
+	ids, _ = list(&v1.ListNodesRequest{IpPrefix: "100.64.0.2/32", User: "test"})
+	c.Assert(ids, check.DeepEquals, []uint64{2})
+
+	_, err := api.ListNodes(context.Background(), &v1.ListNodesRequest{PageToken: "nope"})
+	c.Assert(status.Code(err), check.Equals, codes.InvalidArgument)
+}
+
+func (s *Suite) TestListUsersPages(c *check.C) {
+	for _, name := range []string{"one", "two", "three"} {
+		_, err := app.db.CreateUser(name)
+		c.Assert(err, check.IsNil)
+	}
+
+	api := newHeadscaleV1APIServer(app)
+
+	var names []string
+	request := &v1.ListUsersRequest{PageSize: 2}
+	for pages := 1; ; pages++ {
+		resp, err := api.ListUsers(context.Background(), request)
+		c.Assert(err, check.IsNil)
+		for _, user := range resp.GetUsers() {
+			names = append(names, user.GetName())
+		}
+
+		if resp.GetNextPageToken() == "" {
+			c.Assert(pages, check.Equals, 2)
+
+			break
+		}
+		request.PageToken = resp.GetNextPageToken()
+	}
+
+	c.Assert(names, check.DeepEquals, []string{"one", "two", "three"})
+}
+
+type watchEventsStream struct {
+	v1.HeadscaleService_WatchEventsServer
+
+	ctx    context.Context
+	events chan *v1.WatchEventsResponse
+}
+
+func (s *watchEventsStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *watchEventsStream) Send(event *v1.WatchEventsResponse) error {
+	s.events <- event
+
+	return nil
+}
+
+func (s *Suite) TestWatchEvents(c *check.C) {
+	api := newHeadscaleV1APIServer(app)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &watchEventsStream{ctx: ctx, events: make(chan *v1.WatchEventsResponse, 10)}
+
+	err := api.WatchEvents(&v1.WatchEventsRequest{Events: []string{"nope"}}, stream)
+	c.Assert(status.Code(err), check.Equals, codes.InvalidArgument)
+
+	done := make(chan error)
+	go func() {
+		done <- api.WatchEvents(&v1.WatchEventsRequest{Events: []string{"user.created"}}, stream)
+	}()
+
+	// The watcher is registered in the background.
+	for !app.webhooks.Subscribed(webhook.EventUserCreated) {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err = api.CreateUser(context.Background(), &v1.CreateUserRequest{Name: "watched"})
+	c.Assert(err, check.IsNil)
+
+	event := <-stream.events
+	c.Assert(event.GetType(), check.Equals, "user.created")
+	c.Assert(event.GetUser().GetName(), check.Equals, "watched")
+	c.Assert(event.GetNode(), check.IsNil)
+
+	cancel()
+	c.Assert(<-done, check.IsNil)
+	c.Assert(app.webhooks.Subscribed(webhook.EventUserCreated), check.Equals, false)
+}
+
+func (s *Suite) TestRESTGatewayOpenAPI(c *check.C) {
+	router := app.createRouter(grpcRuntime.NewServeMux())
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/openapi.json", nil))
+	c.Assert(rec.Code, check.Equals, http.StatusOK)
+
+	var spec struct {
+		Paths               map[string]any `json:"paths"`
+		SecurityDefinitions map[string]any `json:"securityDefinitions"`
+	}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &spec), check.IsNil)
+	c.Assert(spec.Paths["/api/v1/node"], check.NotNil)
+	c.Assert(spec.SecurityDefinitions["Bearer"], check.NotNil)
+
+	// The API itself requires an API key.
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/node", nil))
+	c.Assert(rec.Code, check.Equals, http.StatusUnauthorized)
+}
+
+func (s *Suite) TestSetPosture(c *check.C) {
+	node, _ := createPollTestNodes(c)
+	api := newHeadscaleV1APIServer(app)
+
+	resp, err := api.SetPosture(context.Background(), &v1.SetPostureRequest{
+		NodeId: node.ID.Uint64(),
+		Attributes: map[string]string{
+			"custom:managed": "true",
+			"custom:team":    "infra",
+		},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.GetNode().GetPostureAttributes(), check.DeepEquals, map[string]string{
+		"custom:managed": "true",
+		"custom:team":    "infra",
+	})
+
+	// Attributes are merged with the existing ones, and removed.
+	_, err = api.SetPosture(context.Background(), &v1.SetPostureRequest{
+		NodeId:     node.ID.Uint64(),
+		Attributes: map[string]string{"custom:team": "ops"},
+		Remove:     []string{"custom:managed"},
+	})
+	c.Assert(err, check.IsNil)
+
+	stored, err := app.db.GetNodeByID(node.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(map[string]string(stored.PostureAttributes), check.DeepEquals, map[string]string{
+		"custom:team": "ops",
+	})
+
+	// Only custom attributes can be set, the node: attributes come
+	// from the client.
+	_, err = api.SetPosture(context.Background(), &v1.SetPostureRequest{
+		NodeId:     node.ID.Uint64(),
+		Attributes: map[string]string{"node:os": "linux"},
+	})
+	c.Assert(err, check.NotNil)
+}
+
+func (s *Suite) TestSetNodeLabels(c *check.C) {
+	node, peer := createPollTestNodes(c)
+	api := newHeadscaleV1APIServer(app)
+
+	resp, err := api.SetNodeLabels(context.Background(), &v1.SetNodeLabelsRequest{
+		NodeId: node.ID.Uint64(),
+		Labels: map[string]string{
+			"env":              "prod",
+			"example.com/team": "infra",
+		},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.GetNode().GetLabels(), check.DeepEquals, map[string]string{
+		"env":              "prod",
+		"example.com/team": "infra",
+	})
+
+	_, err = api.SetNodeLabels(context.Background(), &v1.SetNodeLabelsRequest{
+		NodeId: peer.ID.Uint64(),
+		Labels: map[string]string{"env": "staging"},
+	})
+	c.Assert(err, check.IsNil)
+
+	// Labels are merged with the existing ones, and removed.
+	_, err = api.SetNodeLabels(context.Background(), &v1.SetNodeLabelsRequest{
+		NodeId: node.ID.Uint64(),
+		Labels: map[string]string{"legacy": ""},
+		Remove: []string{"example.com/team"},
+	})
+	c.Assert(err, check.IsNil)
+
+	stored, err := app.db.GetNodeByID(node.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(map[string]string(stored.Labels), check.DeepEquals, map[string]string{
+		"env":    "prod",
+		"legacy": "",
+	})
+
+	for selector, want := range map[string][]uint64{
+		"env=prod":         {node.ID.Uint64()},
+		"env":              {node.ID.Uint64(), peer.ID.Uint64()},
+		"env!=prod":        {peer.ID.Uint64()},
+		"env=prod,!legacy": {},
+		"!legacy":          {peer.ID.Uint64()},
+	} {
+		list, err := api.ListNodes(context.Background(), &v1.ListNodesRequest{LabelSelector: selector})
+		c.Assert(err, check.IsNil)
+
+		got := []uint64{}
+		for _, listed := range list.GetNodes() {
+			got = append(got, listed.GetId())
+		}
+		c.Assert(got, check.DeepEquals, want, check.Commentf("selector %q", selector))
+	}
+
+	_, err = api.ListNodes(context.Background(), &v1.ListNodesRequest{LabelSelector: "env=a b"})
+	c.Assert(err, check.NotNil)
+
+	_, err = api.SetNodeLabels(context.Background(), &v1.SetNodeLabelsRequest{
+		NodeId: node.ID.Uint64(),
+		Labels: map[string]string{"env": "prod,staging"},
+	})
+	c.Assert(err, check.NotNil)
+}
+
+func (s *Suite) TestGetNodeHealth(c *check.C) {
+	node, _ := createPollTestNodes(c)
+	api := newHeadscaleV1APIServer(app)
+
+	// The node did not send its client metrics yet.
+	resp, err := api.GetNodeHealth(context.Background(), &v1.GetNodeHealthRequest{
+		NodeId: node.ID.Uint64(),
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.GetHealth().GetClientMetrics(), check.HasLen, 0)
+	c.Assert(resp.GetHealth().GetClientMetricsUpdatedAt(), check.IsNil)
+
+	updatedAt := time.Now().Truncate(time.Second)
+	err = app.db.SetNodeClientMetrics(&types.NodeClientMetrics{
+		NodeID:    node.ID,
+		Metrics:   types.ClientMetrics{"magicsock_send_udp": 1204},
+		UpdatedAt: updatedAt,
+	})
+	c.Assert(err, check.IsNil)
+
+	resp, err = api.GetNodeHealth(context.Background(), &v1.GetNodeHealthRequest{
+		NodeId: node.ID.Uint64(),
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.GetHealth().GetNodeId(), check.Equals, node.ID.Uint64())
+	c.Assert(resp.GetHealth().GetClientMetrics(), check.DeepEquals, map[string]float64{
+		"magicsock_send_udp": 1204,
+	})
+
+	_, err = api.GetNodeHealth(context.Background(), &v1.GetNodeHealthRequest{
+		NodeId: 1000,
+	})
+	c.Assert(err, check.NotNil)
+}
+
+func (s *Suite) TestSetNodeExpiry(c *check.C) {
+	node, _ := createPollTestNodes(c)
+	api := newHeadscaleV1APIServer(app)
+
+	expiry := time.Now().Add(90 * 24 * time.Hour).Truncate(time.Second)
+	resp, err := api.SetNodeExpiry(context.Background(), &v1.SetNodeExpiryRequest{
+		NodeId: node.ID.Uint64(),
+		Expiry: timestamppb.New(expiry),
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.GetNode().GetExpiry().AsTime().Equal(expiry), check.Equals, true)
+
+	stored, err := app.db.GetNodeByID(node.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(stored.Expiry.Equal(expiry), check.Equals, true)
+	c.Assert(stored.IsExpired(), check.Equals, false)
+
+	// A missing expiry disables expiry for the node.
+	_, err = api.SetNodeExpiry(context.Background(), &v1.SetNodeExpiryRequest{
+		NodeId: node.ID.Uint64(),
+	})
+	c.Assert(err, check.IsNil)
+
+	stored, err = app.db.GetNodeByID(node.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(stored.Expiry.IsZero(), check.Equals, true)
+
+	_, err = api.SetNodeExpiry(context.Background(), &v1.SetNodeExpiryRequest{
+		NodeId: node.ID.Uint64(),
+		Expiry: timestamppb.New(time.Now().Add(-time.Hour)),
+	})
+	c.Assert(status.Code(err), check.Equals, codes.InvalidArgument)
+
+	_, err = api.SetNodeExpiry(context.Background(), &v1.SetNodeExpiryRequest{
+		NodeId: 9999,
+		Expiry: timestamppb.New(expiry),
+	})
+	c.Assert(status.Code(err), check.Equals, codes.NotFound)
+}
+
+func (s *Suite) TestRoutesByNodePrefix(c *check.C) {
+	node, _ := createPollTestNodes(c)
+	api := newHeadscaleV1APIServer(app)
+
+	route := types.Route{
+		NodeID:     node.ID.Uint64(),
+		Prefix:     types.IPPrefix(netip.MustParsePrefix("10.0.0.0/24")),
+		Advertised: true,
+	}
+	c.Assert(app.db.DB.Save(&route).Error, check.IsNil)
+
+	enabled, err := api.EnableRoute(context.Background(), &v1.EnableRouteRequest{
+		NodeId: node.ID.Uint64(),
+		Prefix: "10.0.0.0/24",
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(enabled.GetUpdatedNodeIds(), check.DeepEquals, []uint64{node.ID.Uint64()})
+
+	routes, err := app.db.GetNodePrimaryRoutes(node)
+	c.Assert(err, check.IsNil)
+	c.Assert(routes, check.HasLen, 1)
+
+	_, err = api.DisableRoute(context.Background(), &v1.DisableRouteRequest{
+		NodeId: node.ID.Uint64(),
+		Prefix: "10.1.0.0/24",
+	})
+	c.Assert(status.Code(err), check.Equals, codes.NotFound)
+
+	_, err = api.DisableRoute(context.Background(), &v1.DisableRouteRequest{
+		NodeId: node.ID.Uint64(),
+	})
+	c.Assert(status.Code(err), check.Equals, codes.InvalidArgument)
+
+	_, err = api.DeleteRoute(context.Background(), &v1.DeleteRouteRequest{
+		NodeId: node.ID.Uint64(),
+		Prefix: "10.0.0.0/24",
+	})
+	c.Assert(err, check.IsNil)
+
+	routes, err = app.db.GetNodeRoutes(node)
+	c.Assert(err, check.IsNil)
+	c.Assert(routes, check.HasLen, 0)
+}
+
+func (s *Suite) TestDERPRegions(c *check.C) {
+	app.derpManager = derp.NewManager(app.cfg.DERP, &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {RegionID: 1, RegionCode: "base", Nodes: []*tailcfg.DERPNode{{HostName: "derp.example.com"}}},
+		},
+	}, app.derpMapChanged)
+	api := newHeadscaleV1APIServer(app)
+
+	addResp, err := api.AddDERPRegion(context.Background(), &v1.AddDERPRegionRequest{
+		Region: &v1.DERPRegion{
+			RegionId:   900,
+			RegionCode: "custom",
+			Nodes:      []*v1.DERPNode{{HostName: "derp.custom.example.com"}},
+		},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(addResp.GetRegion().GetNodes()[0].GetName(), check.Equals, "900a")
+	c.Assert(app.DERPMap.Regions[900], check.NotNil)
+
+	listResp, err := api.ListDERPRegions(context.Background(), &v1.ListDERPRegionsRequest{})
+	c.Assert(err, check.IsNil)
+	c.Assert(listResp.GetRegions(), check.HasLen, 2)
+	c.Assert(listResp.GetRegions()[1].GetCustom(), check.Equals, true)
+
+	// Custom regions are kept across restarts.
+	stored, err := app.db.GetCustomDERPRegions()
+	c.Assert(err, check.IsNil)
+	c.Assert(stored, check.HasLen, 1)
+	c.Assert(stored[0].RegionID, check.Equals, 900)
+
+	_, err = api.AddDERPRegion(context.Background(), &v1.AddDERPRegionRequest{
+		Region: &v1.DERPRegion{
+			RegionId:   1,
+			RegionCode: "duplicate",
+			Nodes:      []*v1.DERPNode{{HostName: "derp.custom.example.com"}},
+		},
+	})
+	c.Assert(status.Code(err), check.Equals, codes.AlreadyExists)
+
+	_, err = api.RemoveDERPRegion(context.Background(), &v1.RemoveDERPRegionRequest{RegionId: 1})
+	c.Assert(status.Code(err), check.Equals, codes.FailedPrecondition)
+
+	_, err = api.RemoveDERPRegion(context.Background(), &v1.RemoveDERPRegionRequest{RegionId: 900})
+	c.Assert(err, check.IsNil)
+	c.Assert(app.DERPMap.Regions[900], check.IsNil)
+
+	stored, err = app.db.GetCustomDERPRegions()
+	c.Assert(err, check.IsNil)
+	c.Assert(stored, check.HasLen, 0)
+}
+
+func (s *Suite) TestDNSRecords(c *check.C) {
+	app.mapper = mapper.NewMapper(app.db, app.cfg, &tailcfg.DERPMap{}, app.nodeNotifier)
+	api := newHeadscaleV1APIServer(app)
+
+	addResp, err := api.AddDNSRecord(context.Background(), &v1.AddDNSRecordRequest{
+		Name:  "Grafana.example.com.",
+		Type:  "a",
+		Value: "100.64.0.3",
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(addResp.GetRecord().GetName(), check.Equals, "grafana.example.com")
+	c.Assert(addResp.GetRecord().GetType(), check.Equals, "A")
+
+	_, err = api.AddDNSRecord(context.Background(), &v1.AddDNSRecordRequest{
+		Name:  "www.example.com",
+		Type:  "CNAME",
+		Value: "grafana.example.com",
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(app.mapper.ExtraRecords(), check.DeepEquals, []tailcfg.DNSRecord{
+		{Name: "grafana.example.com", Type: "A", Value: "100.64.0.3"},
+		{Name: "www.example.com", Type: "CNAME", Value: "grafana.example.com"},
+	})
+
+	_, err = api.AddDNSRecord(context.Background(), &v1.AddDNSRecordRequest{
+		Name:  "grafana.example.com",
+		Type:  "A",
+		Value: "100.64.0.3",
+	})
+	c.Assert(status.Code(err), check.Equals, codes.AlreadyExists)
+
+	for _, invalid := range []*v1.AddDNSRecordRequest{
+		{Name: "ipv6.example.com", Type: "A", Value: "fd7a:115c:a1e0::1"},
+		{Name: "mx.example.com", Type: "MX", Value: "mail.example.com"},
+		{Name: "", Type: "TXT", Value: "text"},
+	} {
+		_, err = api.AddDNSRecord(context.Background(), invalid)
+		c.Assert(status.Code(err), check.Equals, codes.InvalidArgument)
+	}
+
+	listResp, err := api.ListDNSRecords(context.Background(), &v1.ListDNSRecordsRequest{})
+	c.Assert(err, check.IsNil)
+	c.Assert(listResp.GetRecords(), check.HasLen, 2)
+
+	_, err = api.DeleteDNSRecord(context.Background(), &v1.DeleteDNSRecordRequest{
+		Id: addResp.GetRecord().GetId(),
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(app.mapper.ExtraRecords(), check.HasLen, 1)
+
+	_, err = api.DeleteDNSRecord(context.Background(), &v1.DeleteDNSRecordRequest{
+		Id: addResp.GetRecord().GetId(),
+	})
+	c.Assert(status.Code(err), check.Equals, codes.NotFound)
+}
+
+func (s *Suite) TestScopedNameservers(c *check.C) {
+	app.cfg.DNSScopedNameservers = []types.ScopedNameservers{
+		{Domain: "config.example.com", Nameservers: []string{"10.0.0.53"}, Nodes: []string{"*"}},
+	}
+	app.mapper = mapper.NewMapper(app.db, app.cfg, &tailcfg.DERPMap{}, app.nodeNotifier)
+	api := newHeadscaleV1APIServer(app)
+
+	addResp, err := api.AddScopedNameservers(context.Background(), &v1.AddScopedNameserversRequest{
+		Domain:      "office.example.com",
+		Nameservers: []string{"10.1.0.53"},
+		Nodes:       []string{"tag:office"},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(app.mapper.ScopedNameservers(), check.HasLen, 2)
+
+	_, err = api.AddScopedNameservers(context.Background(), &v1.AddScopedNameserversRequest{
+		Domain:      "office.example.com",
+		Nameservers: []string{"10.1.0.53"},
+	})
+	c.Assert(status.Code(err), check.Equals, codes.InvalidArgument)
+
+	listResp, err := api.ListScopedNameservers(context.Background(), &v1.ListScopedNameserversRequest{})
+	c.Assert(err, check.IsNil)
+	c.Assert(listResp.GetNameservers(), check.HasLen, 2)
+	c.Assert(listResp.GetNameservers()[0].GetId(), check.Equals, uint64(0))
+
+	_, err = api.DeleteScopedNameservers(context.Background(), &v1.DeleteScopedNameserversRequest{
+		Id: addResp.GetNameservers().GetId(),
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(app.mapper.ScopedNameservers(), check.HasLen, 1)
+
+	_, err = api.DeleteScopedNameservers(context.Background(), &v1.DeleteScopedNameserversRequest{
+		Id: addResp.GetNameservers().GetId(),
+	})
+	c.Assert(status.Code(err), check.Equals, codes.NotFound)
+}
@@ -0,0 +1,380 @@
+package hscontrol
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/notifier"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const (
+	haLeaderLease = "leader"
+
+	// haChangeWindow is how far back the changes of the other instances
+	// are read. Changes can be committed out of the order of their IDs,
+	// so the changes of the window are read again, and the ones already
+	// sent to the nodes are skipped.
+	haChangeWindow = 30 * time.Second
+
+	// haChangeRetention is how long the changes are kept.
+	haChangeRetention = 10 * time.Minute
+
+	haPublishQueueSize = 1024
+)
+
+// haCoordinator coordinates the headscale instances sharing the same
+// database, with ha.enabled:
+//   - the nodes connected to each instance are stored in the database,
+//     so all the instances know which nodes are online,
+//   - the updates of the notifier are published in the database, and
+//     sent by the other instances to the nodes connected to them,
+//   - one instance, holding the leader lease, runs the singleton tasks:
+//     expiring the nodes, and taking the nodes of the instances which
+//     stopped sending heartbeats offline, failing over their routes.
+type haCoordinator struct {
+	h   *Headscale
+	cfg types.HAConfig
+	// keys sign the changes published by the instance, and verify the
+	// ones of the other instances.
+	keys *types.ClusterKeyring
+
+	leader atomic.Bool
+
+	pending chan types.HAChange
+	// overflowed is set when an update was dropped because pending was
+	// full, a full update is published once it is drained.
+	overflowed atomic.Bool
+
+	// published are the connected nodes stored in the database.
+	published map[types.NodeID]bool
+	// seen are the changes of the other instances which were sent to
+	// the nodes, with the time they were first read.
+	seen    map[uint64]time.Time
+	started bool
+}
+
+func newHACoordinator(h *Headscale, cfg types.HAConfig, keys *types.ClusterKeyring) *haCoordinator {
+	return &haCoordinator{
+		h:         h,
+		cfg:       cfg,
+		keys:      keys,
+		pending:   make(chan types.HAChange, haPublishQueueSize),
+		published: make(map[types.NodeID]bool),
+		seen:      make(map[uint64]time.Time),
+	}
+}
+
+// isLeader reports if the instance runs the singleton tasks, it always
+// does without HA.
+func (h *Headscale) isLeader() bool {
+	return h.ha == nil || h.ha.leader.Load()
+}
+
+// relay queues the updates published on the notifier bus for the other
+// instances, except the ones delivered to a node connected to this one.
+// It drops the update if the queue is full.
+func (c *haCoordinator) relay(event notifier.ChangeEvent) {
+	if event.Delivered || event.Remote {
+		return
+	}
+
+	change, err := c.change(event.Update, event.NodeID)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to encode update for the other instances")
+
+		return
+	}
+
+	// The bus handlers must not block, the update is dropped if the
+	// database cannot keep up, and the nodes of the other instances
+	// are sent a full update once the queue is drained.
+	select {
+	case c.pending <- change:
+	default:
+		c.overflowed.Store(true)
+		haChangesDropped.Inc()
+		log.Warn().
+			Uint64("node_id", event.NodeID.Uint64()).
+			Msg("HA publish queue is full, dropping update for the other instances")
+	}
+}
+
+// change returns the signed change publishing the update for the other
+// instances, sent to all their nodes when nodeID is 0.
+func (c *haCoordinator) change(update types.StateUpdate, nodeID types.NodeID) (types.HAChange, error) {
+	data, err := json.Marshal(update)
+	if err != nil {
+		return types.HAChange{}, err
+	}
+
+	change := types.HAChange{
+		InstanceID: c.cfg.InstanceID,
+		NodeID:     nodeID,
+		Update:     string(data),
+	}
+	change.MAC = c.keys.Sign(change.SignedData())
+
+	return change, nil
+}
+
+// Run coordinates the instance with the others until the context is
+// done.
+func (c *haCoordinator) Run(ctx context.Context) {
+	log.Info().
+		Str("instance", c.cfg.InstanceID).
+		Msg("HA enabled, coordinating with the other instances through the database")
+
+	// A NATS or Redis change bus carries the updates to the other
+	// instances, they are only published in the database otherwise.
+	if !c.h.cfg.ChangeBus.Shared() {
+		unsubscribe := c.h.nodeNotifier.Bus().Subscribe(c.relay)
+		defer unsubscribe()
+		go c.publishChanges(ctx)
+	}
+
+	c.heartbeat()
+	c.sync()
+
+	heartbeat := time.NewTicker(c.cfg.HeartbeatInterval)
+	defer heartbeat.Stop()
+	sync := time.NewTicker(c.cfg.SyncInterval)
+	defer sync.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			c.stop()
+
+			return
+		case <-heartbeat.C:
+			c.heartbeat()
+		case <-sync.C:
+			c.sync()
+		}
+	}
+}
+
+func (c *haCoordinator) publishChanges(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case change := <-c.pending:
+			c.publish(change)
+
+			// The updates dropped while the queue was full are
+			// replaced with a full update of all the nodes.
+			if len(c.pending) == 0 && c.overflowed.CompareAndSwap(true, false) {
+				full, err := c.change(types.StateUpdate{Type: types.StateFullUpdate}, 0)
+				if err != nil {
+					log.Error().Err(err).Msg("failed to encode full update for the other instances")
+
+					continue
+				}
+
+				c.publish(full)
+			}
+		}
+	}
+}
+
+func (c *haCoordinator) publish(change types.HAChange) {
+	if err := c.h.db.Write(func(tx *gorm.DB) error {
+		return db.PublishChange(tx, &change)
+	}); err != nil {
+		log.Error().Err(err).Msg("failed to publish update for the other instances")
+	}
+}
+
+// heartbeat records that the instance is alive, and takes or renews the
+// leader lease.
+func (c *haCoordinator) heartbeat() {
+	now := time.Now()
+
+	var leader bool
+	err := c.h.db.Write(func(tx *gorm.DB) error {
+		if err := db.HeartbeatInstance(tx, c.cfg.InstanceID, now); err != nil {
+			return err
+		}
+
+		var err error
+		leader, err = db.AcquireLease(tx, haLeaderLease, c.cfg.InstanceID, now, c.cfg.InstanceTimeout)
+
+		return err
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to send HA heartbeat")
+
+		// Stop acting as the leader, the lease might expire before
+		// it can be renewed.
+		leader = false
+	}
+
+	if was := c.leader.Swap(leader); was != leader {
+		log.Info().
+			Str("instance", c.cfg.InstanceID).
+			Bool("leader", leader).
+			Msg("HA leadership changed")
+	}
+
+	if leader {
+		c.runLeaderTasks(now)
+	}
+}
+
+// runLeaderTasks takes the nodes of the dead instances offline, and
+// removes the old changes.
+func (c *haCoordinator) runLeaderTasks(now time.Time) {
+	var dead []types.NodeID
+	err := c.h.db.Write(func(tx *gorm.DB) error {
+		var err error
+		dead, err = db.DeleteDeadInstances(tx, now.Add(-c.cfg.InstanceTimeout))
+		if err != nil {
+			return err
+		}
+
+		return db.DeleteChangesOlderThan(tx, haChangeRetention)
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to clean up dead HA instances")
+
+		return
+	}
+
+	for _, nodeID := range dead {
+		// The node might have reconnected to another instance.
+		if c.h.nodeNotifier.IsLikelyConnected(nodeID) {
+			continue
+		}
+
+		node, err := c.h.db.GetNodeByID(nodeID)
+		if err != nil {
+			continue
+		}
+
+		log.Info().
+			Str("node", node.Hostname).
+			Msg("node of a dead HA instance is offline")
+
+		c.h.updateNodeOnlineStatus(false, node)
+		c.h.routeManager.NodeWentOffline(node)
+		if node.IsEphemeral() {
+			c.h.ephemeralGC.Schedule(node.ID, c.h.cfg.EphemeralNodeInactivityTimeout)
+		}
+	}
+}
+
+// sync stores the nodes connected to the instance, reads the nodes
+// connected to the other instances, and sends the changes of the other
+// instances to the connected nodes.
+func (c *haCoordinator) sync() {
+	now := time.Now()
+
+	var connected, disconnected []types.NodeID
+	local := make(map[types.NodeID]bool)
+	for _, nodeID := range c.h.nodeNotifier.LocalConnectedNodes() {
+		local[nodeID] = true
+		if !c.published[nodeID] {
+			connected = append(connected, nodeID)
+		}
+	}
+	for nodeID := range c.published {
+		if !local[nodeID] {
+			disconnected = append(disconnected, nodeID)
+		}
+	}
+
+	var remote []types.NodeID
+	var changes []types.HAChange
+	err := c.h.db.Write(func(tx *gorm.DB) error {
+		if err := db.UpdateNodeConnections(tx, c.cfg.InstanceID, connected, disconnected); err != nil {
+			return err
+		}
+
+		var err error
+		remote, err = db.RemoteConnectedNodes(tx, c.cfg.InstanceID, now.Add(-c.cfg.InstanceTimeout))
+		if err != nil {
+			return err
+		}
+
+		changes, err = db.ListChanges(tx, c.cfg.InstanceID, haChangeWindow)
+
+		return err
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to sync with the other HA instances")
+
+		return
+	}
+
+	c.published = local
+	c.h.nodeNotifier.SetRemoteConnected(remote)
+
+	for _, change := range changes {
+		if _, ok := c.seen[change.ID]; ok {
+			continue
+		}
+		c.seen[change.ID] = now
+
+		// The changes from before the instance started are not sent,
+		// the nodes get the full state when they connect.
+		if !c.started {
+			continue
+		}
+
+		if !c.keys.Verify(change.SignedData(), change.MAC) {
+			haChangesRejected.Inc()
+			log.Warn().
+				Str("instance", change.InstanceID).
+				Uint64("change", change.ID).
+				Msg("ignoring update of another instance not signed with a cluster key")
+
+			continue
+		}
+
+		var update types.StateUpdate
+		if err := json.Unmarshal([]byte(change.Update), &update); err != nil {
+			log.Error().Err(err).Uint64("change", change.ID).Msg("failed to decode update of another instance")
+
+			continue
+		}
+
+		ctx := types.NotifyCtx(context.Background(), "ha-relay", change.InstanceID)
+		c.h.nodeNotifier.NotifyRelayed(ctx, update, change.NodeID)
+	}
+	c.started = true
+
+	for id, read := range c.seen {
+		if read.Before(now.Add(-2 * haChangeWindow)) {
+			delete(c.seen, id)
+		}
+	}
+}
+
+// stop gives up the leadership, and removes the connected nodes of the
+// instance, as it shuts down.
+func (c *haCoordinator) stop() {
+	var published []types.NodeID
+	for nodeID := range c.published {
+		published = append(published, nodeID)
+	}
+
+	err := c.h.db.Write(func(tx *gorm.DB) error {
+		if err := db.UpdateNodeConnections(tx, c.cfg.InstanceID, nil, published); err != nil {
+			return err
+		}
+
+		return db.ReleaseLease(tx, haLeaderLease, c.cfg.InstanceID)
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to leave the HA instances")
+	}
+
+	c.leader.Store(false)
+}
@@ -0,0 +1,138 @@
+package hscontrol
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/notifier"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gopkg.in/check.v1"
+	"tailscale.com/tailcfg"
+)
+
+// testClusterKeys are the cluster keys of the coordinators of the
+// tests.
+var testClusterKeys = types.NewClusterKeyring(bytes.Repeat([]byte{1}, types.ClusterKeyMinLength))
+
+func (s *Suite) TestHACoordinatorRelay(c *check.C) {
+	node, peer := createPollTestNodes(c)
+
+	newCoordinator := func(id string) *haCoordinator {
+		return newHACoordinator(app, types.HAConfig{
+			Enabled:           true,
+			InstanceID:        id,
+			HeartbeatInterval: 5 * time.Second,
+			InstanceTimeout:   30 * time.Second,
+			SyncInterval:      time.Second,
+		}, testClusterKeys)
+	}
+	first, second := newCoordinator("first"), newCoordinator("second")
+
+	// Only one instance leads.
+	first.heartbeat()
+	second.heartbeat()
+	c.Assert(first.leader.Load(), check.Equals, true)
+	c.Assert(second.leader.Load(), check.Equals, false)
+
+	// The nodes connected to the first instance are seen by the second.
+	nodeCh := make(chan types.StateUpdate, 2)
+	app.nodeNotifier.AddNode(node.ID, nodeCh)
+	first.sync()
+	app.nodeNotifier.RemoveNode(node.ID, nodeCh)
+
+	remote, err := db.RemoteConnectedNodes(app.db.DB, "second", time.Now().Add(-time.Minute))
+	c.Assert(err, check.IsNil)
+	c.Assert(remote, check.DeepEquals, []types.NodeID{node.ID})
+
+	// An update published by the first instance is sent by the second
+	// to the nodes connected to it.
+	second.sync()
+	first.relay(notifier.ChangeEvent{
+		Update: types.StateUpdate{
+			Type: types.StatePeerChangedPatch,
+			ChangePatches: []*tailcfg.PeerChange{
+				{NodeID: node.ID.NodeID(), DERPRegion: 3},
+			},
+		},
+	})
+	change := <-first.pending
+	c.Assert(db.PublishChange(app.db.DB, &change), check.IsNil)
+
+	peerCh := make(chan types.StateUpdate, 2)
+	app.nodeNotifier.AddNode(peer.ID, peerCh)
+	second.sync()
+	app.nodeNotifier.Flush()
+
+	update := <-peerCh
+	c.Assert(update.Type, check.Equals, types.StatePeerChangedPatch)
+	c.Assert(update.ChangePatches[0].DERPRegion, check.Equals, 3)
+
+	// It is only sent once.
+	second.sync()
+	app.nodeNotifier.Flush()
+	c.Assert(len(peerCh), check.Equals, 0)
+
+	// A change not signed with the cluster keys is not sent.
+	forged := change
+	forged.ID = 0
+	forged.MAC = types.NewClusterKeyring(bytes.Repeat([]byte{2}, types.ClusterKeyMinLength)).
+		Sign(forged.SignedData())
+	c.Assert(db.PublishChange(app.db.DB, &forged), check.IsNil)
+
+	second.sync()
+	app.nodeNotifier.Flush()
+	c.Assert(len(peerCh), check.Equals, 0)
+	app.nodeNotifier.RemoveNode(peer.ID, peerCh)
+
+	// The leader stepping down lets the other instance take over.
+	first.stop()
+	second.heartbeat()
+	c.Assert(second.leader.Load(), check.Equals, true)
+}
+
+func (s *Suite) TestHACoordinatorRelayQueueFull(c *check.C) {
+	coordinator := newHACoordinator(app, types.HAConfig{
+		Enabled:    true,
+		InstanceID: "first",
+	}, testClusterKeys)
+
+	// Relaying more updates than the queue holds drops the extra ones
+	// instead of blocking the bus.
+	for range haPublishQueueSize + 1 {
+		coordinator.relay(notifier.ChangeEvent{
+			Update: types.StateUpdate{Type: types.StatePeerChanged, ChangeNodes: []types.NodeID{1}},
+			NodeID: 2,
+		})
+	}
+
+	c.Assert(len(coordinator.pending), check.Equals, haPublishQueueSize)
+
+	// Once the queue is drained, a full update replaces the dropped
+	// ones.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go coordinator.publishChanges(ctx)
+
+	var changes []types.HAChange
+	for range 100 {
+		var err error
+		changes, err = db.ListChanges(app.db.DB, "second", time.Minute)
+		c.Assert(err, check.IsNil)
+		if len(changes) == haPublishQueueSize+1 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.Assert(changes, check.HasLen, haPublishQueueSize+1)
+
+	last := changes[len(changes)-1]
+	c.Assert(last.NodeID, check.Equals, types.NodeID(0))
+
+	var update types.StateUpdate
+	c.Assert(json.Unmarshal([]byte(last.Update), &update), check.IsNil)
+	c.Assert(update.Type, check.Equals, types.StateFullUpdate)
+	c.Assert(coordinator.overflowed.Load(), check.Equals, false)
+}
@@ -136,6 +136,7 @@ func (h *Headscale) HealthHandler(
 
 type registerWebAPITemplateConfig struct {
 	Key string
+	ID  string
 }
 
 var registerWebAPITemplate = template.Must(
@@ -163,6 +164,10 @@ var registerWebAPITemplate = template.Must(
 			Run the command below in the headscale server to add this machine to your network:
 		</p>
 		<code>headscale nodes register --user USERNAME --key {{.Key}}</code>
+		<p>
+			The machine is also listed as <b>{{.ID}}</b> by <i>headscale nodes pending</i>,
+			and can be approved with <i>headscale nodes approve --id {{.ID}} --user USERNAME</i>.
+		</p>
 	</body>
 </html>
 `))
@@ -205,6 +210,7 @@ func (h *Headscale) RegisterWebAPI(
 	var content bytes.Buffer
 	if err := registerWebAPITemplate.Execute(&content, registerWebAPITemplateConfig{
 		Key: machineKey.String(),
+		ID:  pendingNodeID(machineKey),
 	}); err != nil {
 		log.Error().
 			Str("func", "RegisterWebAPI").
@@ -0,0 +1,143 @@
+package hscontrol
+
+import (
+	"context"
+	"strings"
+
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/policy"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/rs/zerolog/log"
+)
+
+// oidcClaimGroups returns the groups in the claim of the ID token, which
+// is either a list of groups or a single group.
+func oidcClaimGroups(claims map[string]interface{}, claim string) []string {
+	switch value := claims[claim].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		groups := make([]string, 0, len(value))
+		for _, group := range value {
+			if group, ok := group.(string); ok {
+				groups = append(groups, group)
+			}
+		}
+
+		return groups
+	}
+
+	return nil
+}
+
+// oidcPolicyGroups returns the policy groups the OIDC groups of the
+// users map to, with the users as members. Only the OIDC groups starting
+// with the prefix are mapped, without the prefix.
+func oidcPolicyGroups(users []types.User, prefix string) policy.Groups {
+	groups := policy.Groups{}
+	for _, user := range users {
+		for _, group := range user.OIDCGroups {
+			name, ok := strings.CutPrefix(group, prefix)
+			if !ok || name == "" {
+				continue
+			}
+
+			name = "group:" + name
+			groups[name] = append(groups[name], user.Name)
+		}
+	}
+
+	return groups
+}
+
+// applyIdPGroups adds the users of the groups given by the identity
+// provider, mapped from OIDC or provisioned with SCIM, to the policy,
+// and reports if they changed.
+func (h *Headscale) applyIdPGroups(pol *policy.ACLPolicy) (bool, error) {
+	if pol == nil || (!h.cfg.OIDC.MapGroups && !h.cfg.SCIM.Enabled) {
+		return false, nil
+	}
+
+	groups := policy.Groups{}
+
+	// The groups were just stored, they are read from the primary
+	// database rather than a replica.
+	if h.cfg.OIDC.MapGroups {
+		users, err := db.Read(h.db.DB, db.ListUsers)
+		if err != nil {
+			return false, err
+		}
+
+		groups = oidcPolicyGroups(users, h.cfg.OIDC.GroupsPrefix)
+	}
+
+	if h.cfg.SCIM.Enabled {
+		scimGroups, err := db.Read(h.db.DB, db.ListSCIMGroups)
+		if err != nil {
+			return false, err
+		}
+
+		for _, group := range scimGroups {
+			name := "group:" + group.DisplayName
+			for _, member := range group.Members {
+				groups[name] = append(groups[name], member.Name)
+			}
+		}
+	}
+
+	return pol.SetIdPGroups(groups), nil
+}
+
+// refreshIdPGroups updates the groups given by the identity provider in
+// the current policies, and sends the nodes their new rules if they
+// changed.
+func (h *Headscale) refreshIdPGroups() {
+	h.policyMu.Lock()
+	defer h.policyMu.Unlock()
+
+	changed := false
+	for tailnet, pol := range h.policies() {
+		polChanged, err := h.applyIdPGroups(pol)
+		if err != nil {
+			log.Error().Err(err).Str("tailnet", tailnet).Msg("Failed to update the groups of the ACL policy from the identity provider")
+
+			return
+		}
+		changed = changed || polChanged
+	}
+
+	if !changed {
+		return
+	}
+
+	log.Info().Msg("ACL policy groups from the identity provider changed, notifying nodes of change")
+
+	h.autoApproveRoutes()
+
+	ctx := types.NotifyCtx(context.Background(), "idp-groups", "na")
+	h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+		Type: types.StateFullUpdate,
+	})
+}
+
+// setOIDCUserGroups stores the groups the OIDC provider gave to the user
+// when they logged in, and updates the policy if they changed.
+func (h *Headscale) setOIDCUserGroups(userName string, groups []string) {
+	if !h.cfg.OIDC.MapGroups {
+		return
+	}
+
+	changed, err := h.db.SetUserOIDCGroups(userName, groups)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("user", userName).
+			Msg("Failed to store the OIDC groups of the user")
+
+		return
+	}
+
+	if changed {
+		h.refreshIdPGroups()
+	}
+}
@@ -0,0 +1,93 @@
+package hscontrol
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/policy"
+	"gopkg.in/check.v1"
+)
+
+func TestOIDCClaimGroups(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		claim  string
+		want   []string
+	}{
+		{
+			name:   "list",
+			claims: map[string]interface{}{"groups": []interface{}{"dev", "ops"}},
+			claim:  "groups",
+			want:   []string{"dev", "ops"},
+		},
+		{
+			name:   "single",
+			claims: map[string]interface{}{"roles": "admin"},
+			claim:  "roles",
+			want:   []string{"admin"},
+		},
+		{
+			name:   "not-strings",
+			claims: map[string]interface{}{"groups": []interface{}{"dev", 42.0}},
+			claim:  "groups",
+			want:   []string{"dev"},
+		},
+		{
+			name:   "missing",
+			claims: map[string]interface{}{"groups": []interface{}{"dev"}},
+			claim:  "roles",
+			want:   nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := oidcClaimGroups(tt.claims, tt.claim)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("oidcClaimGroups() unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func (s *Suite) TestOIDCGroupsPolicy(c *check.C) {
+	node1, node2 := createPollTestNodes(c)
+	nodes, err := app.db.ListNodes()
+	c.Assert(err, check.IsNil)
+
+	app.cfg.OIDC.MapGroups = true
+	app.cfg.OIDC.GroupsPrefix = "hs-"
+
+	pol, err := policy.LoadACLPolicyFromBytes([]byte(`{
+		"acls": [
+			{"action": "accept", "src": ["group:engineering"], "dst": ["*:22"]},
+		],
+	}`), "hujson")
+	c.Assert(err, check.IsNil)
+
+	_, err = app.applyIdPGroups(pol)
+	c.Assert(err, check.IsNil)
+	app.ACLPolicy = pol
+
+	ips, err := app.ACLPolicy.ExpandAlias(nodes, "group:engineering")
+	c.Assert(err, check.IsNil)
+	c.Assert(ips.Prefixes(), check.HasLen, 0)
+
+	// Only the groups with the prefix are mapped.
+	app.setOIDCUserGroups("test", []string{"hs-engineering", "engineering-all"})
+
+	ips, err = app.ACLPolicy.ExpandAlias(nodes, "group:engineering")
+	c.Assert(err, check.IsNil)
+	c.Assert(ips.Contains(*node1.IPv4), check.Equals, true)
+	c.Assert(ips.Contains(*node2.IPv4), check.Equals, true)
+
+	_, err = app.ACLPolicy.ExpandAlias(nodes, "group:engineering-all")
+	c.Assert(err, check.IsNil)
+
+	app.setOIDCUserGroups("test", nil)
+
+	ips, err = app.ACLPolicy.ExpandAlias(nodes, "group:engineering")
+	c.Assert(err, check.IsNil)
+	c.Assert(ips.Prefixes(), check.HasLen, 0)
+}
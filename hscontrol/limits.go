@@ -0,0 +1,120 @@
+package hscontrol
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"tailscale.com/types/key"
+)
+
+var ErrNodeLimitReached = errors.New("node limit reached")
+
+// NodeCapacity describes how many nodes are registered compared to
+// the configured limits.
+type NodeCapacity struct {
+	Nodes     int64 `json:"nodes"`
+	SoftLimit int   `json:"soft_limit"`
+	HardLimit int   `json:"hard_limit"`
+
+	// Remaining is the number of nodes that can still be registered
+	// before the hard limit is reached, -1 if there is no hard limit.
+	Remaining int64 `json:"remaining"`
+}
+
+func (c NodeCapacity) overSoftLimit() bool {
+	return c.SoftLimit > 0 && c.Nodes >= int64(c.SoftLimit)
+}
+
+func (c NodeCapacity) atHardLimit() bool {
+	return c.HardLimit > 0 && c.Nodes >= int64(c.HardLimit)
+}
+
+// nodeCapacity counts the registered nodes and updates the capacity
+// metrics.
+func (h *Headscale) nodeCapacity() (NodeCapacity, error) {
+	count, err := h.db.CountNodes()
+	if err != nil {
+		return NodeCapacity{}, fmt.Errorf("counting nodes: %w", err)
+	}
+
+	return h.capacityOf(count), nil
+}
+
+func (h *Headscale) capacityOf(count int64) NodeCapacity {
+	capacity := NodeCapacity{
+		Nodes:     count,
+		SoftLimit: h.cfg.NodeLimits.Soft,
+		HardLimit: h.cfg.NodeLimits.Hard,
+		Remaining: -1,
+	}
+
+	if capacity.HardLimit > 0 {
+		capacity.Remaining = max(int64(capacity.HardLimit)-count, 0)
+	}
+
+	nodesRegistered.Set(float64(count))
+	nodeLimit.WithLabelValues("soft").Set(float64(capacity.SoftLimit))
+	nodeLimit.WithLabelValues("hard").Set(float64(capacity.HardLimit))
+
+	return capacity
+}
+
+// checkNodeLimit must be called in the transaction registering a node,
+// it holds the registrations of the other transactions until it ends so
+// that they cannot go over the limit together. It returns
+// ErrNodeLimitReached if machineKey would be a new node and the tailnet
+// is at its hard limit. Nodes which are already registered can always
+// log in again.
+//
+// It is also called with the database before the addresses of the node
+// are allocated, so that a node which will be rejected does not take
+// them.
+func (h *Headscale) checkNodeLimit(tx *gorm.DB, machineKey key.MachinePublic) error {
+	if h.cfg.NodeLimits.Soft == 0 && h.cfg.NodeLimits.Hard == 0 {
+		return nil
+	}
+
+	if err := db.LockNodeRegistrations(tx); err != nil {
+		return fmt.Errorf("locking node registrations: %w", err)
+	}
+
+	if _, err := db.GetNodeByMachineKey(tx, machineKey); err == nil {
+		return nil
+	}
+
+	count, err := db.CountNodes(tx)
+	if err != nil {
+		return fmt.Errorf("counting nodes: %w", err)
+	}
+	capacity := h.capacityOf(count)
+
+	if capacity.atHardLimit() {
+		nodeRegistrationsRejected.Inc()
+		log.Error().
+			Str("machine_key", machineKey.ShortString()).
+			Int64("nodes", capacity.Nodes).
+			Int("hard_limit", capacity.HardLimit).
+			Msg("Refusing to register new node, the tailnet has reached its node limit")
+
+		return fmt.Errorf(
+			"%w: the tailnet has %d of %d allowed nodes, remove unused nodes or ask the administrator to raise node_limits.hard",
+			ErrNodeLimitReached,
+			capacity.Nodes,
+			capacity.HardLimit,
+		)
+	}
+
+	if capacity.overSoftLimit() {
+		log.Warn().
+			Str("machine_key", machineKey.ShortString()).
+			Int64("nodes", capacity.Nodes).
+			Int("soft_limit", capacity.SoftLimit).
+			Int("hard_limit", capacity.HardLimit).
+			Msg("Registering new node above the soft node limit")
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package hscontrol
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"gopkg.in/check.v1"
+	"gorm.io/gorm"
+	"tailscale.com/types/key"
+)
+
+func (s *Suite) TestCheckNodeLimit(c *check.C) {
+	user, err := app.db.CreateUser("test")
+	c.Assert(err, check.IsNil)
+
+	var registered []key.MachinePublic
+	for index := 0; index < 2; index++ {
+		machineKey := key.NewMachine()
+		node := types.Node{
+			MachineKey:     machineKey.Public(),
+			NodeKey:        key.NewNode().Public(),
+			Hostname:       fmt.Sprintf("testnode%d", index),
+			UserID:         user.ID,
+			RegisterMethod: util.RegisterMethodAuthKey,
+		}
+		c.Assert(app.db.DB.Save(&node).Error, check.IsNil)
+
+		registered = append(registered, machineKey.Public())
+	}
+
+	newNode := key.NewMachine().Public()
+
+	// No limits configured.
+	c.Assert(app.checkNodeLimit(app.db.DB, newNode), check.IsNil)
+
+	// Above the soft limit only warns.
+	app.cfg.NodeLimits = types.NodeLimitsConfig{Soft: 1, Hard: 3}
+	c.Assert(app.checkNodeLimit(app.db.DB, newNode), check.IsNil)
+
+	app.cfg.NodeLimits = types.NodeLimitsConfig{Soft: 1, Hard: 2}
+	err = app.checkNodeLimit(app.db.DB, newNode)
+	c.Assert(errors.Is(err, ErrNodeLimitReached), check.Equals, true)
+
+	// Nodes already registered can log in again.
+	c.Assert(app.checkNodeLimit(app.db.DB, registered[0]), check.IsNil)
+
+	// The nodes registered in the transaction count, and the limit
+	// rolls it back.
+	app.cfg.NodeLimits = types.NodeLimitsConfig{Hard: 3}
+	_, err = db.Write(app.db.DB, func(tx *gorm.DB) (*types.Node, error) {
+		if err := app.checkNodeLimit(tx, newNode); err != nil {
+			return nil, err
+		}
+
+		node := types.Node{
+			MachineKey:     newNode,
+			NodeKey:        key.NewNode().Public(),
+			Hostname:       "testnode2",
+			UserID:         user.ID,
+			RegisterMethod: util.RegisterMethodAuthKey,
+		}
+		if err := tx.Save(&node).Error; err != nil {
+			return nil, err
+		}
+
+		return nil, app.checkNodeLimit(tx, key.NewMachine().Public())
+	})
+	c.Assert(errors.Is(err, ErrNodeLimitReached), check.Equals, true)
+
+	app.cfg.NodeLimits = types.NodeLimitsConfig{Soft: 1, Hard: 2}
+
+	capacity, err := app.nodeCapacity()
+	c.Assert(err, check.IsNil)
+	c.Assert(capacity, check.Equals, NodeCapacity{
+		Nodes:     2,
+		SoftLimit: 1,
+		HardLimit: 2,
+		Remaining: 0,
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/fs"
+	"net/netip"
 	"net/url"
 	"os"
 	"path"
@@ -22,11 +23,11 @@ import (
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
 	"github.com/klauspost/compress/zstd"
-	"github.com/rs/zerolog/log"
 	"tailscale.com/envknob"
 	"tailscale.com/smallzstd"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/dnstype"
+	"tailscale.com/util/cmpver"
 )
 
 const (
@@ -53,10 +54,31 @@ type Mapper struct {
 	// Configuration
 	// TODO(kradalby): figure out if this is the format we want this in
 	db      *db.HSDatabase
-	cfg     *types.Config
 	derpMap *tailcfg.DERPMap
 	notif   *notifier.Notifier
 
+	// cfg is replaced when the configuration is reloaded.
+	cfg atomic.Pointer[types.Config]
+
+	// extraRecords are the extra DNS records managed through the API,
+	// sent with the ones of the configuration.
+	extraRecords atomic.Pointer[[]tailcfg.DNSRecord]
+
+	// scopedNameservers are the nameservers of the configuration and
+	// the API sent only to some of the nodes.
+	scopedNameservers atomic.Pointer[[]types.ScopedNameservers]
+
+	// tkaInfo is the state of network lock, nil if it was never
+	// enabled.
+	tkaInfo atomic.Pointer[tailcfg.TKAInfo]
+
+	// filters keeps the packet filter compiled for the nodes, which
+	// is the same for the maps of all the nodes of a tailnet. It is for
+	// the default tailnet, tailnetFilters are for the tailnets of the
+	// multi-tailnet mode, by name.
+	filters        policy.FilterCache
+	tailnetFilters sync.Map
+
 	uid     string
 	created time.Time
 	seq     uint64
@@ -75,9 +97,8 @@ func NewMapper(
 ) *Mapper {
 	uid, _ := util.GenerateRandomStringDNSSafe(mapperIDLength)
 
-	return &Mapper{
+	m := &Mapper{
 		db:      db,
-		cfg:     cfg,
 		derpMap: derpMap,
 		notif:   notif,
 
@@ -85,6 +106,62 @@ func NewMapper(
 		created: time.Now(),
 		seq:     0,
 	}
+	m.cfg.Store(cfg)
+
+	return m
+}
+
+// SetConfig replaces the configuration the map responses are built
+// with, it is used for the next map responses.
+func (m *Mapper) SetConfig(cfg *types.Config) {
+	m.cfg.Store(cfg)
+}
+
+// Config returns the configuration the map responses are built with.
+func (m *Mapper) Config() *types.Config {
+	return m.cfg.Load()
+}
+
+// SetExtraRecords sets the extra DNS records managed through the API,
+// they are sent with the next map responses.
+func (m *Mapper) SetExtraRecords(records []tailcfg.DNSRecord) {
+	m.extraRecords.Store(&records)
+}
+
+// ExtraRecords returns the extra DNS records managed through the API.
+func (m *Mapper) ExtraRecords() []tailcfg.DNSRecord {
+	if records := m.extraRecords.Load(); records != nil {
+		return *records
+	}
+
+	return nil
+}
+
+// SetScopedNameservers sets the nameservers sent only to some of the
+// nodes, they are sent with the next map responses.
+func (m *Mapper) SetScopedNameservers(nameservers []types.ScopedNameservers) {
+	m.scopedNameservers.Store(&nameservers)
+}
+
+// ScopedNameservers returns the nameservers sent only to some of the
+// nodes.
+func (m *Mapper) ScopedNameservers() []types.ScopedNameservers {
+	if nameservers := m.scopedNameservers.Load(); nameservers != nil {
+		return *nameservers
+	}
+
+	return nil
+}
+
+// SetTKAInfo sets the state of network lock, it is sent with the next
+// full map responses.
+func (m *Mapper) SetTKAInfo(info *tailcfg.TKAInfo) {
+	m.tkaInfo.Store(info)
+}
+
+// TKAInfo returns the state of network lock.
+func (m *Mapper) TKAInfo() *tailcfg.TKAInfo {
+	return m.tkaInfo.Load()
 }
 
 func (m *Mapper) String() string {
@@ -126,12 +203,24 @@ func generateDNSConfig(
 	baseDomain string,
 	node *types.Node,
 	peers types.Nodes,
+	extraRecords []tailcfg.DNSRecord,
 ) *tailcfg.DNSConfig {
 	if cfg.DNSConfig == nil {
 		return nil
 	}
 
 	dnsConfig := cfg.DNSConfig.Clone()
+	dnsConfig.ExtraRecords = append(dnsConfig.ExtraRecords, extraRecords...)
+
+	// The nodes of a tailnet with a base domain of its own search it
+	// instead of the one of the configuration.
+	if baseDomain != cfg.BaseDomain {
+		for index, domain := range dnsConfig.Domains {
+			if domain == cfg.BaseDomain {
+				dnsConfig.Domains[index] = baseDomain
+			}
+		}
+	}
 
 	// if MagicDNS is enabled
 	if dnsConfig.Proxied {
@@ -147,13 +236,13 @@ func generateDNSConfig(
 				),
 			)
 
-			userSet := mapset.NewSet[types.User]()
-			userSet.Add(node.User)
+			userSet := mapset.NewSet[string]()
+			userSet.Add(node.User.Name)
 			for _, p := range peers {
-				userSet.Add(p.User)
+				userSet.Add(p.User.Name)
 			}
 			for _, user := range userSet.ToSlice() {
-				dnsRoute := fmt.Sprintf("%v.%v", user.Name, baseDomain)
+				dnsRoute := fmt.Sprintf("%v.%v", user, baseDomain)
 				dnsConfig.Routes[dnsRoute] = nil
 			}
 		}
@@ -164,6 +253,42 @@ func generateDNSConfig(
 	return dnsConfig
 }
 
+// addScopedNameservers adds the routes of the scoped nameservers which
+// apply to the node, by its user or its tags, to its DNS configuration.
+// Like restricted nameservers, the domains are also search domains.
+func addScopedNameservers(
+	dnsConfig *tailcfg.DNSConfig,
+	scopedNameservers []types.ScopedNameservers,
+	pol *policy.ACLPolicy,
+	node *types.Node,
+) {
+	if dnsConfig == nil || len(scopedNameservers) == 0 {
+		return
+	}
+
+	tags, _ := pol.TagsOfNode(node)
+	tags = append(tags, node.ForcedTags...)
+
+	for index := range scopedNameservers {
+		scoped := &scopedNameservers[index]
+		if !scoped.Applies(node.User.Name, tags) {
+			continue
+		}
+
+		if dnsConfig.Routes == nil {
+			dnsConfig.Routes = make(map[string][]*dnstype.Resolver)
+		}
+		dnsConfig.Routes[scoped.Domain] = append(
+			dnsConfig.Routes[scoped.Domain],
+			scoped.Resolvers()...,
+		)
+
+		if !slices.Contains(dnsConfig.Domains, scoped.Domain) {
+			dnsConfig.Domains = append(dnsConfig.Domains, scoped.Domain)
+		}
+	}
+}
+
 // If any nextdns DoH resolvers are present in the list of resolvers it will
 // take metadata from the node metadata and instruct tailscale to add it
 // to the requests. This makes it possible to identify from which device the
@@ -171,6 +296,84 @@ func generateDNSConfig(
 //
 // This will produce a resolver like:
 // `https://dns.nextdns.io/<nextdns-id>?device_name=node-name&device_model=linux&device_ip=100.64.0.1`
+// addAppConnectorRoutes routes the DNS queries for the domains of the
+// app connectors of the node to the app connectors among its peers,
+// through the DNS over HTTP server of their peer API. The connectors
+// learn the addresses of the domains from the answers and advertise
+// them as routes.
+func addAppConnectorRoutes(
+	dnsConfig *tailcfg.DNSConfig,
+	pol *policy.ACLPolicy,
+	node *types.Node,
+	peers types.Nodes,
+) {
+	if dnsConfig == nil {
+		return
+	}
+
+	appConnectors, err := pol.AppConnectors(node)
+	if err != nil {
+		util.LogMapper.Error().
+			Caller().
+			Err(err).
+			Str("node", node.Hostname).
+			Msg("Failed to get the app connectors of the node")
+
+		return
+	}
+
+	for _, appConnector := range appConnectors {
+		var resolvers []*dnstype.Resolver
+		for _, peer := range peers {
+			if !pol.ServesAppConnector(peer, appConnector) {
+				continue
+			}
+
+			if addr := peerAPIDNSAddr(peer); addr != "" {
+				resolvers = append(resolvers, &dnstype.Resolver{Addr: addr})
+			}
+		}
+
+		if len(resolvers) == 0 {
+			continue
+		}
+
+		if dnsConfig.Routes == nil {
+			dnsConfig.Routes = make(map[string][]*dnstype.Resolver)
+		}
+
+		for _, domain := range appConnector.Domains {
+			domain = strings.TrimPrefix(domain, "*.")
+			dnsConfig.Routes[domain] = append(dnsConfig.Routes[domain], resolvers...)
+		}
+	}
+}
+
+// peerAPIDNSAddr returns the address of the DNS over HTTP server in the
+// peer API of the node, or an empty string if it does not advertise its
+// peer API.
+func peerAPIDNSAddr(node *types.Node) string {
+	if node.Hostinfo == nil {
+		return ""
+	}
+
+	for _, service := range node.Hostinfo.Services {
+		var addr *netip.Addr
+		switch service.Proto {
+		case tailcfg.PeerAPI4:
+			addr = node.IPv4
+		case tailcfg.PeerAPI6:
+			addr = node.IPv6
+		}
+
+		if addr != nil && service.Port != 0 {
+			return fmt.Sprintf("http://%s/dns-query", netip.AddrPortFrom(*addr, service.Port))
+		}
+	}
+
+	return ""
+}
+
 func addNextDNSMetadata(resolvers []*dnstype.Resolver, node *types.Node) {
 	for _, resolver := range resolvers {
 		if strings.HasPrefix(resolver.Addr, nextDNSDoHPrefix) {
@@ -205,23 +408,63 @@ func (m *Mapper) fullMapResponse(
 		resp,
 		true, // full change
 		pol,
+		m.filtersOf(node.User.Tailnet),
 		node,
 		capVer,
 		peers,
 		peers,
-		m.cfg,
+		m.Config(),
+		m.ExtraRecords(),
+		m.ScopedNameservers(),
 	)
 	if err != nil {
 		return nil, err
 	}
 
+	resp.TKAInfo = m.TKAInfo()
+
+	cfg := m.Config()
+	resp.DefaultAutoUpdate = cfg.ClientUpdates.DefaultAutoUpdate
+	resp.ClientVersion = clientVersion(node, cfg.ClientUpdates)
+
 	return resp, nil
 }
 
+// clientVersion tells the node if it runs the latest version of the
+// client, nil if the latest version is not configured or the version
+// of the node is not known.
+func clientVersion(node *types.Node, cfg types.ClientUpdatesConfig) *tailcfg.ClientVersion {
+	if node.Hostinfo == nil || node.Hostinfo.IPNVersion == "" {
+		return nil
+	}
+
+	latest := cfg.Latest(node.Hostinfo.OS)
+	if latest == "" {
+		return nil
+	}
+
+	// The version of the client has the commits it was built from
+	// after a dash, such as "1.66.4-t1234abcd-g5678efgh".
+	running, _, _ := strings.Cut(node.Hostinfo.IPNVersion, "-")
+	if cmpver.Compare(running, latest) >= 0 {
+		return &tailcfg.ClientVersion{RunningLatest: true}
+	}
+
+	return &tailcfg.ClientVersion{
+		LatestVersion:        latest,
+		UrgentSecurityUpdate: cfg.UrgentSecurityUpdate,
+		Notify:               cfg.Notify,
+		NotifyURL:            cfg.NotifyURL,
+		NotifyText:           cfg.NotifyText,
+	}
+}
+
 // FullMapResponse returns a MapResponse for the given node.
+// The peers sent are recorded in state, if given.
 func (m *Mapper) FullMapResponse(
 	mapRequest tailcfg.MapRequest,
 	node *types.Node,
+	state *MapState,
 	pol *policy.ACLPolicy,
 	messages ...string,
 ) ([]byte, error) {
@@ -235,6 +478,8 @@ func (m *Mapper) FullMapResponse(
 		return nil, err
 	}
 
+	state.setPeers(resp.Peers)
+
 	return m.marshalMapResponse(mapRequest, resp, node, mapRequest.Compress, messages...)
 }
 
@@ -278,9 +523,26 @@ func (m *Mapper) DERPMapResponse(
 	return m.marshalMapResponse(mapRequest, &resp, node, mapRequest.Compress)
 }
 
+// PingRequestResponse returns a MapResponse asking the node to answer
+// the PingRequest.
+func (m *Mapper) PingRequestResponse(
+	mapRequest tailcfg.MapRequest,
+	node *types.Node,
+	pingRequest *tailcfg.PingRequest,
+) ([]byte, error) {
+	resp := m.baseMapResponse()
+	resp.PingRequest = pingRequest
+
+	return m.marshalMapResponse(mapRequest, &resp, node, mapRequest.Compress)
+}
+
+// PeerChangedResponse returns a MapResponse with the changed and
+// removed peers. If state is given, only the delta against what the
+// client last received is sent.
 func (m *Mapper) PeerChangedResponse(
 	mapRequest tailcfg.MapRequest,
 	node *types.Node,
+	state *MapState,
 	changed map[types.NodeID]bool,
 	patches []*tailcfg.PeerChange,
 	pol *policy.ACLPolicy,
@@ -314,11 +576,14 @@ func (m *Mapper) PeerChangedResponse(
 		&resp,
 		false, // partial change
 		pol,
+		m.filtersOf(node.User.Tailnet),
 		node,
 		mapRequest.Version,
 		peers,
 		changedNodes,
-		m.cfg,
+		m.Config(),
+		m.ExtraRecords(),
+		m.ScopedNameservers(),
 	)
 	if err != nil {
 		return nil, err
@@ -341,31 +606,82 @@ func (m *Mapper) PeerChangedResponse(
 		resp.PeersChangedPatch = patches
 	}
 
+	state.diffPeersChanged(&resp, changedIDs)
+
 	// Add the node itself, it might have changed, and particularly
 	// if there are no patches or changes, this is a self update.
-	tailnode, err := tailNode(node, mapRequest.Version, pol, m.cfg)
+	cfg := m.Config()
+	tailnode, err := tailNode(node, mapRequest.Version, pol, cfg, true)
 	if err != nil {
 		return nil, err
 	}
 	resp.Node = tailnode
+	resp.Health = nodeHealth(node, mapRequest.Version, cfg)
 
 	return m.marshalMapResponse(mapRequest, &resp, node, mapRequest.Compress, messages...)
 }
 
 // PeerChangedPatchResponse creates a patch MapResponse with
-// incoming update from a state change.
+// incoming update from a state change. If state is given, patches
+// which do not change anything for the client are dropped, and nil
+// is returned if nothing is left to send.
 func (m *Mapper) PeerChangedPatchResponse(
 	mapRequest tailcfg.MapRequest,
 	node *types.Node,
+	state *MapState,
 	changed []*tailcfg.PeerChange,
 	pol *policy.ACLPolicy,
 ) ([]byte, error) {
+	changed = state.applyPatches(changed)
+	if len(changed) == 0 {
+		return nil, nil
+	}
+
 	resp := m.baseMapResponse()
 	resp.PeersChangedPatch = changed
 
 	return m.marshalMapResponse(mapRequest, &resp, node, mapRequest.Compress)
 }
 
+// healthyMapResponse is a MapResponse with an empty Health, which
+// restores the health of the node, tailcfg.MapResponse omits it.
+type healthyMapResponse struct {
+	*tailcfg.MapResponse
+	Health []string
+}
+
+// nodeHealth returns the health of the node as seen by headscale, the
+// warnings about its key expiry and its client version.
+func nodeHealth(
+	node *types.Node,
+	capVer tailcfg.CapabilityVersion,
+	cfg *types.Config,
+) []string {
+	health := expiryHealth(node, cfg.NodeExpiry.Warning)
+	if cfg.ClientVersions.Warned(capVer) {
+		health = append(health, cfg.ClientVersions.Message(capVer))
+	}
+
+	return health
+}
+
+// expiryHealth returns the health of the node as seen by headscale, a
+// warning when its key expires within the warning duration, shown by
+// the client in "tailscale status".
+func expiryHealth(node *types.Node, warning time.Duration) []string {
+	if warning > 0 && node.Expiry != nil && !node.Expiry.IsZero() {
+		until := time.Until(*node.Expiry)
+		if until > 0 && until <= warning {
+			return []string{fmt.Sprintf(
+				"The key of this node expires on %s, re-authenticate with \"tailscale up --force-reauth\" to keep it connected.",
+				node.Expiry.UTC().Format(time.RFC1123),
+			)}
+		}
+	}
+
+	return []string{}
+}
+
 func (m *Mapper) marshalMapResponse(
 	mapRequest tailcfg.MapRequest,
 	resp *tailcfg.MapResponse,
@@ -375,7 +691,13 @@ func (m *Mapper) marshalMapResponse(
 ) ([]byte, error) {
 	atomic.AddUint64(&m.seq, 1)
 
-	jsonBody, err := json.Marshal(resp)
+	var jsonBody []byte
+	var err error
+	if resp.Health != nil && len(resp.Health) == 0 {
+		jsonBody, err = json.Marshal(healthyMapResponse{MapResponse: resp, Health: resp.Health})
+	} else {
+		jsonBody, err = json.Marshal(resp)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("marshalling map response: %w", err)
 	}
@@ -421,7 +743,7 @@ func (m *Mapper) marshalMapResponse(
 			fmt.Sprintf("%s-%s-%d-%s.json", now, m.uid, atomic.LoadUint64(&m.seq), responseType),
 		)
 
-		log.Trace().Msgf("Writing MapResponse to %s", mapResponsePath)
+		util.LogMapper.Trace().Msgf("Writing MapResponse to %s", mapResponsePath)
 		err = os.WriteFile(mapResponsePath, body, perms)
 		if err != nil {
 			panic(err)
@@ -491,16 +813,18 @@ func (m *Mapper) baseWithConfigMapResponse(
 	capVer tailcfg.CapabilityVersion,
 ) (*tailcfg.MapResponse, error) {
 	resp := m.baseMapResponse()
+	cfg := m.Config()
 
-	tailnode, err := tailNode(node, capVer, pol, m.cfg)
+	tailnode, err := tailNode(node, capVer, pol, cfg, true)
 	if err != nil {
 		return nil, err
 	}
 	resp.Node = tailnode
+	resp.Health = nodeHealth(node, capVer, cfg)
 
 	resp.DERPMap = m.derpMap
 
-	resp.Domain = m.cfg.BaseDomain
+	resp.Domain = cfg.TailnetBaseDomain(node.User.Tailnet)
 
 	// Do not instruct clients to collect services we do not
 	// support or do anything with them
@@ -509,12 +833,24 @@ func (m *Mapper) baseWithConfigMapResponse(
 	resp.KeepAlive = false
 
 	resp.Debug = &tailcfg.Debug{
-		DisableLogTail: !m.cfg.LogTail.Enabled,
+		DisableLogTail: !cfg.LogTail.Enabled,
 	}
 
 	return &resp, nil
 }
 
+// filtersOf returns the cache of the packet filter of the nodes of the
+// tailnet.
+func (m *Mapper) filtersOf(tailnet string) *policy.FilterCache {
+	if tailnet == "" {
+		return &m.filters
+	}
+
+	filters, _ := m.tailnetFilters.LoadOrStore(tailnet, &policy.FilterCache{})
+
+	return filters.(*policy.FilterCache)
+}
+
 func (m *Mapper) ListPeers(nodeID types.NodeID) (types.Nodes, error) {
 	peers, err := m.db.ListPeers(nodeID)
 	if err != nil {
@@ -546,39 +882,77 @@ func appendPeerChanges(
 
 	fullChange bool,
 	pol *policy.ACLPolicy,
+	filters *policy.FilterCache,
 	node *types.Node,
 	capVer tailcfg.CapabilityVersion,
 	peers types.Nodes,
 	changed types.Nodes,
 	cfg *types.Config,
+	extraRecords []tailcfg.DNSRecord,
+	scopedNameservers []types.ScopedNameservers,
 ) error {
+	// A quarantined node, or a node awaiting approval, has no peers and
+	// its packet filter is empty, which blocks all traffic, while other
+	// nodes do not see it.
+	if node.IsIsolated() {
+		peers = types.Nodes{}
+		changed = types.Nodes{}
+
+		// The filter of the node alone is not worth keeping.
+		filters = nil
+	} else {
+		// The nodes of the other tailnets are never peers.
+		peers = withoutIsolated(peers.InTailnet(node.User.Tailnet))
+		changed = withoutIsolated(changed.InTailnet(node.User.Tailnet))
+	}
 
-	packetFilter, err := pol.CompileFilterRules(append(peers, node))
+	packetFilter, err := filters.CompileFilterRules(pol, append(peers, node))
 	if err != nil {
 		return err
 	}
 
-	sshPolicy, err := pol.CompileSSHPolicy(node, peers)
+	viaFilter, err := filters.CompileViaFilterRules(pol, append(peers, node))
+	if err != nil {
+		return err
+	}
+
+	sshPolicy, err := pol.CompileSSHPolicy(node, peers, cfg.SSHRecording)
 	if err != nil {
 		return err
 	}
 
 	// If there are filter rules present, see if there are any nodes that cannot
-	// access eachother at all and remove them from the peers.
-	if len(packetFilter) > 0 {
-		changed = policy.FilterNodesByACL(node, changed, packetFilter)
+	// access eachother at all and remove them from the peers, unless all the
+	// peers are visible in the configuration.
+	// Rules from via grants are included so the sources can see the routers.
+	if cfg.ACL.PeerVisibility != types.PeerVisibilityPermissive &&
+		(len(packetFilter) > 0 || len(viaFilter) > 0) {
+		visibilityFilter := slices.Clone(packetFilter)
+		for _, rules := range viaFilter {
+			visibilityFilter = append(visibilityFilter, rules...)
+		}
+
+		peers = policy.FilterNodesByACL(node, peers, visibilityFilter)
+		changed = visiblePeers(changed, peers)
 	}
 
-	profiles := generateUserProfiles(node, changed, cfg.BaseDomain)
+	baseDomain := cfg.TailnetBaseDomain(node.User.Tailnet)
+	profiles := generateUserProfiles(node, changed, baseDomain)
 
 	dnsConfig := generateDNSConfig(
 		cfg,
-		cfg.BaseDomain,
+		baseDomain,
 		node,
 		peers,
+		extraRecords,
 	)
+	addScopedNameservers(dnsConfig, scopedNameservers, pol, node)
+	addAppConnectorRoutes(dnsConfig, pol, node, peers)
+
+	// Exit routes are only sent to the nodes allowed to use exit nodes.
+	exitRoutes := policy.CanUseExitNodes(node, packetFilter)
 
-	tailPeers, err := tailNodes(changed, capVer, pol, cfg)
+	tailPeers, err := tailNodes(changed, capVer, pol, cfg, exitRoutes)
 	if err != nil {
 		return err
 	}
@@ -594,9 +968,57 @@ func appendPeerChanges(
 		resp.PeersChanged = tailPeers
 	}
 	resp.DNSConfig = dnsConfig
-	resp.PacketFilter = policy.ReduceFilterRules(node, packetFilter)
+	resp.PacketFilter = append(
+		policy.ReduceFilterRules(node, packetFilter),
+		viaFilter[node.ID]...,
+	)
 	resp.UserProfiles = profiles
 	resp.SSHPolicy = sshPolicy
 
+	if node.IsIsolated() {
+		resp.PacketFilter = denyAllFilter
+		resp.SSHPolicy = &tailcfg.SSHPolicy{}
+	}
+
 	return nil
 }
+
+// denyAllFilter is a packet filter blocking all traffic. An empty
+// filter would do the same, but it is omitted when the MapResponse is
+// marshalled and the client would keep the previous filter, so a rule
+// without any sources is used instead.
+var denyAllFilter = []tailcfg.FilterRule{
+	{
+		SrcIPs: []string{},
+	},
+}
+
+// visiblePeers returns the changed nodes which are in the visible peers.
+func visiblePeers(changed types.Nodes, visible types.Nodes) types.Nodes {
+	ids := make(map[types.NodeID]bool, len(visible))
+	for _, peer := range visible {
+		ids[peer.ID] = true
+	}
+
+	ret := make(types.Nodes, 0, len(changed))
+	for _, peer := range changed {
+		if ids[peer.ID] {
+			ret = append(ret, peer)
+		}
+	}
+
+	return ret
+}
+
+// withoutIsolated returns the nodes which are not quarantined or
+// awaiting approval.
+func withoutIsolated(nodes types.Nodes) types.Nodes {
+	ret := make(types.Nodes, 0, len(nodes))
+	for _, node := range nodes {
+		if !node.IsIsolated() {
+			ret = append(ret, node)
+		}
+	}
+
+	return ret
+}
@@ -15,6 +15,7 @@ import (
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/dnstype"
 	"tailscale.com/types/key"
+	"tailscale.com/types/opt"
 )
 
 var iap = func(ipStr string) *netip.Addr {
@@ -134,6 +135,7 @@ func TestDNSConfigMapResponse(t *testing.T) {
 				baseDomain,
 				nodeInShared1,
 				peersOfNodeInShared1,
+				nil,
 			)
 
 			if diff := cmp.Diff(tt.want, got, cmpopts.EquateEmpty()); diff != "" {
@@ -143,6 +145,356 @@ func TestDNSConfigMapResponse(t *testing.T) {
 	}
 }
 
+func TestDNSConfigExtraRecords(t *testing.T) {
+	cfg := &types.Config{
+		DNSConfig: &tailcfg.DNSConfig{
+			ExtraRecords: []tailcfg.DNSRecord{
+				{Name: "grafana.example.com", Type: "A", Value: "100.64.0.3"},
+			},
+		},
+	}
+	node := &types.Node{Hostname: "node", User: types.User{Name: "user"}}
+
+	got := generateDNSConfig(cfg, "example.com", node, types.Nodes{}, []tailcfg.DNSRecord{
+		{Name: "www.example.com", Type: "CNAME", Value: "grafana.example.com"},
+	})
+
+	want := []tailcfg.DNSRecord{
+		{Name: "grafana.example.com", Type: "A", Value: "100.64.0.3"},
+		{Name: "www.example.com", Type: "CNAME", Value: "grafana.example.com"},
+	}
+	if diff := cmp.Diff(want, got.ExtraRecords); diff != "" {
+		t.Errorf("generateDNSConfig() unexpected extra records (-want +got):\n%s", diff)
+	}
+
+	// The records of the configuration are not changed.
+	if len(cfg.DNSConfig.ExtraRecords) != 1 {
+		t.Errorf("configuration has %d extra records, want 1", len(cfg.DNSConfig.ExtraRecords))
+	}
+}
+
+func TestAddScopedNameservers(t *testing.T) {
+	scoped := []types.ScopedNameservers{
+		{
+			Domain:      "office.example.com",
+			Nameservers: []string{"10.0.0.53"},
+			Nodes:       []string{"tag:office"},
+		},
+		{
+			Domain:      "dev.example.com",
+			Nameservers: []string{"10.1.0.53"},
+			Nodes:       []string{"dev"},
+		},
+	}
+
+	tests := []struct {
+		name string
+		node *types.Node
+		want *tailcfg.DNSConfig
+	}{
+		{
+			name: "tagged-node",
+			node: &types.Node{
+				User:       types.User{Name: "ops"},
+				ForcedTags: []string{"tag:office"},
+			},
+			want: &tailcfg.DNSConfig{
+				Routes: map[string][]*dnstype.Resolver{
+					"office.example.com": {{Addr: "10.0.0.53"}},
+				},
+				Domains: []string{"example.com", "office.example.com"},
+			},
+		},
+		{
+			name: "user-node",
+			node: &types.Node{User: types.User{Name: "dev"}},
+			want: &tailcfg.DNSConfig{
+				Routes: map[string][]*dnstype.Resolver{
+					"dev.example.com": {{Addr: "10.1.0.53"}},
+				},
+				Domains: []string{"example.com", "dev.example.com"},
+			},
+		},
+		{
+			name: "other-node",
+			node: &types.Node{User: types.User{Name: "ops"}},
+			want: &tailcfg.DNSConfig{
+				Domains: []string{"example.com"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := &tailcfg.DNSConfig{Domains: []string{"example.com"}}
+			addScopedNameservers(got, scoped, nil, tt.node)
+
+			if diff := cmp.Diff(tt.want, got, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("addScopedNameservers() unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAddAppConnectorRoutes(t *testing.T) {
+	pol := &policy.ACLPolicy{
+		NodeAttrs: []policy.NodeAttr{
+			{
+				Targets: []string{"*"},
+				App: tailcfg.NodeCapMap{
+					"tailscale.com/app-connectors": []tailcfg.RawMessage{
+						`{"name":"github","connectors":["tag:connector"],"domains":["github.com","*.github.io"]}`,
+					},
+				},
+			},
+		},
+	}
+
+	node := &types.Node{
+		IPv4:     iap("100.64.0.1"),
+		User:     types.User{Name: "user1"},
+		Hostinfo: &tailcfg.Hostinfo{},
+	}
+	connector := &types.Node{
+		IPv4:       iap("100.64.0.2"),
+		User:       types.User{Name: "user1"},
+		ForcedTags: []string{"tag:connector"},
+		Hostinfo: &tailcfg.Hostinfo{
+			AppConnector: opt.NewBool(true),
+			Services: []tailcfg.Service{
+				{Proto: tailcfg.PeerAPI4, Port: 41641},
+			},
+		},
+	}
+	// Tagged as a connector, but not running the app connector.
+	other := &types.Node{
+		IPv4:       iap("100.64.0.3"),
+		User:       types.User{Name: "user1"},
+		ForcedTags: []string{"tag:connector"},
+		Hostinfo: &tailcfg.Hostinfo{
+			Services: []tailcfg.Service{
+				{Proto: tailcfg.PeerAPI4, Port: 41641},
+			},
+		},
+	}
+
+	got := &tailcfg.DNSConfig{}
+	addAppConnectorRoutes(got, pol, node, types.Nodes{connector, other})
+
+	want := &tailcfg.DNSConfig{
+		Routes: map[string][]*dnstype.Resolver{
+			"github.com": {{Addr: "http://100.64.0.2:41641/dns-query"}},
+			"github.io":  {{Addr: "http://100.64.0.2:41641/dns-query"}},
+		},
+	}
+	if diff := cmp.Diff(want, got, cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("addAppConnectorRoutes() unexpected result (-want +got):\n%s", diff)
+	}
+}
+
+func TestExpiryHealth(t *testing.T) {
+	in := func(d time.Duration) *time.Time {
+		t := time.Now().Add(d)
+		return &t
+	}
+
+	tests := []struct {
+		name    string
+		expiry  *time.Time
+		warning time.Duration
+		want    int
+	}{
+		{
+			name:    "no-expiry",
+			warning: 7 * 24 * time.Hour,
+			want:    0,
+		},
+		{
+			name:    "zero-expiry",
+			expiry:  &time.Time{},
+			warning: 7 * 24 * time.Hour,
+			want:    0,
+		},
+		{
+			name:    "outside-window",
+			expiry:  in(30 * 24 * time.Hour),
+			warning: 7 * 24 * time.Hour,
+			want:    0,
+		},
+		{
+			name:    "inside-window",
+			expiry:  in(2 * 24 * time.Hour),
+			warning: 7 * 24 * time.Hour,
+			want:    1,
+		},
+		{
+			name:    "already-expired",
+			expiry:  in(-time.Hour),
+			warning: 7 * 24 * time.Hour,
+			want:    0,
+		},
+		{
+			name:    "warning-disabled",
+			expiry:  in(time.Hour),
+			warning: 0,
+			want:    0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := expiryHealth(&types.Node{Expiry: tt.expiry}, tt.warning)
+
+			// An empty, non-nil slice clears earlier warnings on the client.
+			if got == nil {
+				t.Fatalf("expiryHealth() = nil, want non-nil")
+			}
+			if len(got) != tt.want {
+				t.Errorf("expiryHealth() = %v, want %d messages", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientVersion(t *testing.T) {
+	cfg := types.ClientUpdatesConfig{
+		LatestVersion:  "1.66.4",
+		LatestVersions: map[string]string{"windows": "1.68.0"},
+		Notify:         true,
+		NotifyURL:      "https://tailscale.com/download",
+	}
+
+	tests := []struct {
+		name     string
+		hostinfo *tailcfg.Hostinfo
+		cfg      types.ClientUpdatesConfig
+		want     *tailcfg.ClientVersion
+	}{
+		{
+			name:     "unknown-version",
+			hostinfo: &tailcfg.Hostinfo{OS: "linux"},
+			cfg:      cfg,
+		},
+		{
+			name:     "not-configured",
+			hostinfo: &tailcfg.Hostinfo{OS: "linux", IPNVersion: "1.60.0"},
+		},
+		{
+			name:     "running-latest",
+			hostinfo: &tailcfg.Hostinfo{OS: "linux", IPNVersion: "1.66.4-t1234abcd-g5678efgh"},
+			cfg:      cfg,
+			want:     &tailcfg.ClientVersion{RunningLatest: true},
+		},
+		{
+			name:     "outdated",
+			hostinfo: &tailcfg.Hostinfo{OS: "linux", IPNVersion: "1.64.2-t1234abcd"},
+			cfg:      cfg,
+			want: &tailcfg.ClientVersion{
+				LatestVersion: "1.66.4",
+				Notify:        true,
+				NotifyURL:     "https://tailscale.com/download",
+			},
+		},
+		{
+			name:     "outdated-os",
+			hostinfo: &tailcfg.Hostinfo{OS: "windows", IPNVersion: "1.66.4"},
+			cfg:      cfg,
+			want: &tailcfg.ClientVersion{
+				LatestVersion: "1.68.0",
+				Notify:        true,
+				NotifyURL:     "https://tailscale.com/download",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := clientVersion(&types.Node{Hostinfo: tt.hostinfo}, tt.cfg)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("clientVersion() unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAppendPeerChangesTailnets(t *testing.T) {
+	node := func(id types.NodeID, ip, user, tailnet string) *types.Node {
+		return &types.Node{
+			ID:        id,
+			IPv4:      iap(ip),
+			Hostname:  user,
+			GivenName: user,
+			UserID:    uint(id),
+			User:      types.User{Name: user, Tailnet: tailnet},
+			Hostinfo:  &tailcfg.Hostinfo{},
+		}
+	}
+	alice := node(1, "100.64.0.1", "alice", "")
+	bob := node(2, "100.80.0.1", "bob", "acme")
+	carol := node(3, "100.80.0.2", "carol", "acme")
+	nodes := types.Nodes{alice, bob, carol}
+
+	cfg := &types.Config{
+		BaseDomain: "example.com",
+		DNSConfig: &tailcfg.DNSConfig{
+			Domains: []string{"example.com"},
+		},
+		Tailnets: []types.TailnetConfig{
+			{Name: "acme", BaseDomain: "acme.example.com"},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		node        *types.Node
+		wantPeers   []tailcfg.NodeID
+		wantDomains []string
+	}{
+		{
+			name:        "default-tailnet",
+			node:        alice,
+			wantDomains: []string{"example.com"},
+		},
+		{
+			name:        "tailnet",
+			node:        bob,
+			wantPeers:   []tailcfg.NodeID{3},
+			wantDomains: []string{"acme.example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var peers types.Nodes
+			for _, peer := range nodes {
+				if peer.ID != tt.node.ID {
+					peers = append(peers, peer)
+				}
+			}
+
+			var resp tailcfg.MapResponse
+			err := appendPeerChanges(
+				&resp, true, nil, nil, tt.node, tailcfg.CurrentCapabilityVersion,
+				peers, peers, cfg, nil, nil,
+			)
+			if err != nil {
+				t.Fatalf("appendPeerChanges() error = %s", err)
+			}
+
+			var gotPeers []tailcfg.NodeID
+			for _, peer := range resp.Peers {
+				gotPeers = append(gotPeers, peer.ID)
+			}
+			if diff := cmp.Diff(tt.wantPeers, gotPeers); diff != "" {
+				t.Errorf("unexpected peers (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.wantDomains, resp.DNSConfig.Domains); diff != "" {
+				t.Errorf("unexpected domains (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
 func Test_fullMapResponse(t *testing.T) {
 	mustNK := func(str string) key.NodePublic {
 		var k key.NodePublic
@@ -332,6 +684,44 @@ func Test_fullMapResponse(t *testing.T) {
 		CreatedAt:  created,
 	}
 
+	tailPeer2 := &tailcfg.Node{
+		ID:       2,
+		StableID: "2",
+		Name:     "peer2",
+		User:     1,
+		Key: mustNK(
+			"nodekey:9b2ffa7e08cc421a3d2cca9012280f6a236fd0de0b4ce005b30a98ad930306fe",
+		),
+		KeyExpiry: expire,
+		Machine: mustMK(
+			"mkey:f08305b4ee4250b95a70f3b7504d048d75d899993c624a26d422c67af0422507",
+		),
+		DiscoKey: mustDK(
+			"discokey:cf7b0fd05da556fdc3bab365787b506fd82d64a70745db70e00e86c1b1c03084",
+		),
+		Addresses:         []netip.Prefix{netip.MustParsePrefix("100.64.0.3/32")},
+		AllowedIPs:        []netip.Prefix{netip.MustParsePrefix("100.64.0.3/32")},
+		DERP:              "127.3.3.40:0",
+		Hostinfo:          hiview(tailcfg.Hostinfo{}),
+		Created:           created,
+		Tags:              []string{},
+		PrimaryRoutes:     []netip.Prefix{},
+		LastSeen:          &lastSeen,
+		MachineAuthorized: true,
+		Capabilities: []tailcfg.NodeCapability{
+			tailcfg.CapabilityFileSharing,
+			tailcfg.CapabilityAdmin,
+			tailcfg.CapabilitySSH,
+			tailcfg.NodeAttrDisableUPnP,
+		},
+	}
+
+	quarantinedMini := *mini
+	quarantinedMini.Quarantined = true
+
+	quarantinedPeer1 := *peer1
+	quarantinedPeer1.Quarantined = true
+
 	tests := []struct {
 		name  string
 		pol   *policy.ACLPolicy
@@ -362,6 +752,7 @@ func Test_fullMapResponse(t *testing.T) {
 				BaseDomain:          "",
 				DNSConfig:           &tailcfg.DNSConfig{},
 				LogTail:             types.LogTailConfig{Enabled: false},
+				Taildrop:            types.TaildropConfig{Enabled: true},
 				RandomizeClientPort: false,
 			},
 			want: &tailcfg.MapResponse{
@@ -394,6 +785,7 @@ func Test_fullMapResponse(t *testing.T) {
 				BaseDomain:          "",
 				DNSConfig:           &tailcfg.DNSConfig{},
 				LogTail:             types.LogTailConfig{Enabled: false},
+				Taildrop:            types.TaildropConfig{Enabled: true},
 				RandomizeClientPort: false,
 			},
 			want: &tailcfg.MapResponse{
@@ -416,6 +808,72 @@ func Test_fullMapResponse(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "quarantined-peer-map-response",
+			pol:  &policy.ACLPolicy{},
+			node: mini,
+			peers: types.Nodes{
+				&quarantinedPeer1,
+			},
+			derpMap: &tailcfg.DERPMap{},
+			cfg: &types.Config{
+				BaseDomain:          "",
+				DNSConfig:           &tailcfg.DNSConfig{},
+				LogTail:             types.LogTailConfig{Enabled: false},
+				Taildrop:            types.TaildropConfig{Enabled: true},
+				RandomizeClientPort: false,
+			},
+			want: &tailcfg.MapResponse{
+				KeepAlive:       false,
+				Node:            tailMini,
+				DERPMap:         &tailcfg.DERPMap{},
+				Peers:           []*tailcfg.Node{},
+				DNSConfig:       &tailcfg.DNSConfig{},
+				Domain:          "",
+				CollectServices: "false",
+				PacketFilter:    []tailcfg.FilterRule{},
+				UserProfiles:    []tailcfg.UserProfile{{LoginName: "mini", DisplayName: "mini"}},
+				SSHPolicy:       &tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{}},
+				ControlTime:     &time.Time{},
+				Debug: &tailcfg.Debug{
+					DisableLogTail: true,
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "quarantined-node-map-response",
+			pol:  &policy.ACLPolicy{},
+			node: &quarantinedMini,
+			peers: types.Nodes{
+				peer1,
+			},
+			derpMap: &tailcfg.DERPMap{},
+			cfg: &types.Config{
+				BaseDomain:          "",
+				DNSConfig:           &tailcfg.DNSConfig{},
+				LogTail:             types.LogTailConfig{Enabled: false},
+				Taildrop:            types.TaildropConfig{Enabled: true},
+				RandomizeClientPort: false,
+			},
+			want: &tailcfg.MapResponse{
+				KeepAlive:       false,
+				Node:            tailMini,
+				DERPMap:         &tailcfg.DERPMap{},
+				Peers:           []*tailcfg.Node{},
+				DNSConfig:       &tailcfg.DNSConfig{},
+				Domain:          "",
+				CollectServices: "false",
+				PacketFilter:    []tailcfg.FilterRule{{SrcIPs: []string{}}},
+				UserProfiles:    []tailcfg.UserProfile{{LoginName: "mini", DisplayName: "mini"}},
+				SSHPolicy:       &tailcfg.SSHPolicy{},
+				ControlTime:     &time.Time{},
+				Debug: &tailcfg.Debug{
+					DisableLogTail: true,
+				},
+			},
+			wantErr: false,
+		},
 		{
 			name: "with-pol-map-response",
 			pol: &policy.ACLPolicy{
@@ -437,7 +895,62 @@ func Test_fullMapResponse(t *testing.T) {
 				BaseDomain:          "",
 				DNSConfig:           &tailcfg.DNSConfig{},
 				LogTail:             types.LogTailConfig{Enabled: false},
+				Taildrop:            types.TaildropConfig{Enabled: true},
+				RandomizeClientPort: false,
+			},
+			want: &tailcfg.MapResponse{
+				KeepAlive: false,
+				Node:      tailMini,
+				DERPMap:   &tailcfg.DERPMap{},
+				Peers: []*tailcfg.Node{
+					tailPeer1,
+				},
+				DNSConfig:       &tailcfg.DNSConfig{},
+				Domain:          "",
+				CollectServices: "false",
+				PacketFilter: []tailcfg.FilterRule{
+					{
+						SrcIPs: []string{"100.64.0.2/32"},
+						DstPorts: []tailcfg.NetPortRange{
+							{IP: "100.64.0.1/32", Ports: tailcfg.PortRangeAny},
+						},
+					},
+				},
+				UserProfiles: []tailcfg.UserProfile{
+					{LoginName: "mini", DisplayName: "mini"},
+				},
+				SSHPolicy:   &tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{}},
+				ControlTime: &time.Time{},
+				Debug: &tailcfg.Debug{
+					DisableLogTail: true,
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "with-pol-permissive-visibility-map-response",
+			pol: &policy.ACLPolicy{
+				ACLs: []policy.ACL{
+					{
+						Action:       "accept",
+						Sources:      []string{"100.64.0.2"},
+						Destinations: []string{"mini:*"},
+					},
+				},
+			},
+			node: mini,
+			peers: types.Nodes{
+				peer1,
+				peer2,
+			},
+			derpMap: &tailcfg.DERPMap{},
+			cfg: &types.Config{
+				BaseDomain:          "",
+				DNSConfig:           &tailcfg.DNSConfig{},
+				LogTail:             types.LogTailConfig{Enabled: false},
+				Taildrop:            types.TaildropConfig{Enabled: true},
 				RandomizeClientPort: false,
+				ACL:                 types.ACLConfig{PeerVisibility: types.PeerVisibilityPermissive},
 			},
 			want: &tailcfg.MapResponse{
 				KeepAlive: false,
@@ -445,6 +958,7 @@ func Test_fullMapResponse(t *testing.T) {
 				DERPMap:   &tailcfg.DERPMap{},
 				Peers: []*tailcfg.Node{
 					tailPeer1,
+					tailPeer2,
 				},
 				DNSConfig:       &tailcfg.DNSConfig{},
 				Domain:          "",
@@ -459,6 +973,7 @@ func Test_fullMapResponse(t *testing.T) {
 				},
 				UserProfiles: []tailcfg.UserProfile{
 					{LoginName: "mini", DisplayName: "mini"},
+					{LoginName: "peer2", DisplayName: "peer2"},
 				},
 				SSHPolicy:   &tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{}},
 				ControlTime: &time.Time{},
@@ -500,6 +1015,10 @@ func Test_fullMapResponse(t *testing.T) {
 				cmpopts.EquateEmpty(),
 				// Ignore ControlTime, it is set to now and we dont really need to mock it.
 				cmpopts.IgnoreFields(tailcfg.MapResponse{}, "ControlTime"),
+				// The user profiles are generated from a map.
+				cmpopts.SortSlices(func(a, b tailcfg.UserProfile) bool {
+					return a.LoginName < b.LoginName
+				}),
 			); diff != "" {
 				t.Errorf("fullMapResponse() unexpected result (-want +got):\n%s", diff)
 			}
@@ -0,0 +1,257 @@
+package mapper
+
+import (
+	"bytes"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+// MapState tracks the peers a connection has last received, so changes
+// can be sent as a delta against what the client already has, instead
+// of sending every changed peer in full.
+//
+// A MapState belongs to a single map session and is not safe for
+// concurrent use. A nil MapState disables the delta, everything is
+// sent as it is generated.
+type MapState struct {
+	// peers is nil until the first full MapResponse has been sent,
+	// before that there is nothing to compute a delta against.
+	peers map[tailcfg.NodeID]*tailcfg.Node
+}
+
+func NewMapState() *MapState {
+	return &MapState{}
+}
+
+func (s *MapState) tracking() bool {
+	return s != nil && s.peers != nil
+}
+
+// setPeers records the peers of a full MapResponse, which replaces
+// all the peers of the client.
+func (s *MapState) setPeers(peers []*tailcfg.Node) {
+	if s == nil {
+		return
+	}
+
+	s.peers = make(map[tailcfg.NodeID]*tailcfg.Node, len(peers))
+	for _, peer := range peers {
+		s.peers[peer.ID] = peer
+	}
+}
+
+// diffPeersChanged reduces the peers of a MapResponse to what the
+// client does not have yet:
+//   - changed peers which are equal to what was last sent are dropped,
+//   - changed peers which only differ in fields which can be patched are
+//     sent as PeersChangedPatch,
+//   - peers which were requested as changed, but are no longer visible
+//     to the node, are removed if the client has them,
+//   - removed peers and patches the client does not have are dropped.
+func (s *MapState) diffPeersChanged(
+	resp *tailcfg.MapResponse,
+	requested []types.NodeID,
+) {
+	if !s.tracking() {
+		return
+	}
+
+	var changed []*tailcfg.Node
+	var patches []*tailcfg.PeerChange
+	var removed []tailcfg.NodeID
+
+	visible := make(map[tailcfg.NodeID]bool, len(resp.PeersChanged))
+	for _, peer := range resp.PeersChanged {
+		visible[peer.ID] = true
+
+		prev, ok := s.peers[peer.ID]
+		switch {
+		case !ok:
+			changed = append(changed, peer)
+		case prev.Equal(peer):
+			// The client already has this peer.
+		default:
+			if change, ok := peerChange(prev, peer); ok {
+				patches = append(patches, change)
+			} else {
+				changed = append(changed, peer)
+			}
+		}
+
+		s.peers[peer.ID] = peer
+	}
+
+	for _, nodeID := range resp.PeersRemoved {
+		if _, ok := s.peers[nodeID]; ok {
+			removed = append(removed, nodeID)
+			delete(s.peers, nodeID)
+		}
+	}
+
+	for _, nodeID := range requested {
+		if visible[nodeID.NodeID()] {
+			continue
+		}
+
+		if _, ok := s.peers[nodeID.NodeID()]; ok {
+			removed = append(removed, nodeID.NodeID())
+			delete(s.peers, nodeID.NodeID())
+		}
+	}
+
+	resp.PeersChanged = changed
+	resp.PeersRemoved = removed
+	resp.PeersChangedPatch = append(patches, s.applyPatches(resp.PeersChangedPatch)...)
+}
+
+// applyPatches records the patches sent to the client and returns the
+// ones changing a peer the client has.
+func (s *MapState) applyPatches(patches []*tailcfg.PeerChange) []*tailcfg.PeerChange {
+	if !s.tracking() {
+		return patches
+	}
+
+	var applied []*tailcfg.PeerChange
+	for _, change := range patches {
+		prev, ok := s.peers[change.NodeID]
+		if !ok {
+			continue
+		}
+
+		patched := prev.Clone()
+		applyPeerChange(patched, change)
+		if patched.Equal(prev) {
+			continue
+		}
+
+		s.peers[change.NodeID] = patched
+		applied = append(applied, change)
+	}
+
+	return applied
+}
+
+// peerChange returns the patch turning prev into cur, if cur only
+// differs from prev in fields which can be patched.
+func peerChange(prev, cur *tailcfg.Node) (*tailcfg.PeerChange, bool) {
+	change := &tailcfg.PeerChange{NodeID: cur.ID}
+
+	if prev.DERP != cur.DERP {
+		change.DERPRegion = derpRegion(cur.DERP)
+	}
+	if prev.Cap != cur.Cap {
+		change.Cap = cur.Cap
+	}
+	if !prev.CapMap.Equal(cur.CapMap) {
+		change.CapMap = cur.CapMap
+	}
+	if !slices.Equal(prev.Endpoints, cur.Endpoints) {
+		change.Endpoints = cur.Endpoints
+	}
+	if prev.Key != cur.Key {
+		nodeKey := cur.Key
+		change.Key = &nodeKey
+	}
+	if !bytes.Equal(prev.KeySignature, cur.KeySignature) {
+		change.KeySignature = cur.KeySignature
+	}
+	if prev.DiscoKey != cur.DiscoKey {
+		discoKey := cur.DiscoKey
+		change.DiscoKey = &discoKey
+	}
+	if !equalPtr(prev.Online, cur.Online) {
+		change.Online = cur.Online
+	}
+	if !equalTimePtr(prev.LastSeen, cur.LastSeen) {
+		change.LastSeen = cur.LastSeen
+	}
+	if !prev.KeyExpiry.Equal(cur.KeyExpiry) {
+		keyExpiry := cur.KeyExpiry
+		change.KeyExpiry = &keyExpiry
+	}
+
+	// Fields which cannot be expressed in a patch, or changes which
+	// are lost on the wire, such as going back to zero, leave the
+	// patched node different from the current one.
+	patched := prev.Clone()
+	applyPeerChange(patched, change)
+	if !patched.Equal(cur) {
+		return nil, false
+	}
+
+	return change, true
+}
+
+// applyPeerChange applies a patch to a node the way the client does
+// after it has been sent, where empty fields are omitted.
+func applyPeerChange(node *tailcfg.Node, change *tailcfg.PeerChange) {
+	if change.DERPRegion != 0 {
+		node.DERP = tailcfg.DerpMagicIP + ":" + strconv.Itoa(change.DERPRegion)
+	}
+	if change.Cap != 0 {
+		node.Cap = change.Cap
+	}
+	if len(change.CapMap) > 0 {
+		node.CapMap = change.CapMap
+	}
+	if len(change.Endpoints) > 0 {
+		node.Endpoints = change.Endpoints
+	}
+	if change.Key != nil {
+		node.Key = *change.Key
+	}
+	if len(change.KeySignature) > 0 {
+		node.KeySignature = change.KeySignature
+	}
+	if change.DiscoKey != nil {
+		node.DiscoKey = *change.DiscoKey
+	}
+	if change.Online != nil {
+		online := *change.Online
+		node.Online = &online
+	}
+	if change.LastSeen != nil {
+		lastSeen := *change.LastSeen
+		node.LastSeen = &lastSeen
+	}
+	if change.KeyExpiry != nil {
+		node.KeyExpiry = *change.KeyExpiry
+	}
+}
+
+// derpRegion returns the region of a DERP address as set by tailNode,
+// or zero if it cannot be parsed.
+func derpRegion(derp string) int {
+	region, ok := strings.CutPrefix(derp, tailcfg.DerpMagicIP+":")
+	if !ok {
+		return 0
+	}
+
+	id, err := strconv.Atoi(region)
+	if err != nil {
+		return 0
+	}
+
+	return id
+}
+
+func equalPtr[T comparable](a, b *T) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return *a == *b
+}
+
+func equalTimePtr(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.Equal(*b)
+}
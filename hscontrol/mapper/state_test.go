@@ -0,0 +1,203 @@
+package mapper
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func TestMapStateDiffPeersChanged(t *testing.T) {
+	online := true
+	offline := false
+	nodeKey := key.NewNode().Public()
+
+	peer := func(id tailcfg.NodeID, mutate ...func(*tailcfg.Node)) *tailcfg.Node {
+		node := &tailcfg.Node{
+			ID:        id,
+			Name:      "peer",
+			Key:       nodeKey,
+			DERP:      "127.3.3.40:1",
+			Endpoints: []netip.AddrPort{netip.MustParseAddrPort("192.168.0.1:41641")},
+			Online:    &online,
+			Hostinfo:  (&tailcfg.Hostinfo{Hostname: "peer"}).View(),
+		}
+		for _, fn := range mutate {
+			fn(node)
+		}
+
+		return node
+	}
+
+	tests := []struct {
+		name      string
+		sent      []*tailcfg.Node
+		resp      tailcfg.MapResponse
+		requested []types.NodeID
+		want      tailcfg.MapResponse
+	}{
+		{
+			name: "unchanged-peer-dropped",
+			sent: []*tailcfg.Node{peer(1), peer(2)},
+			resp: tailcfg.MapResponse{
+				PeersChanged: []*tailcfg.Node{peer(1)},
+			},
+			requested: []types.NodeID{1},
+			want:      tailcfg.MapResponse{},
+		},
+		{
+			name: "new-peer-sent",
+			sent: []*tailcfg.Node{peer(1)},
+			resp: tailcfg.MapResponse{
+				PeersChanged: []*tailcfg.Node{peer(2)},
+			},
+			requested: []types.NodeID{2},
+			want: tailcfg.MapResponse{
+				PeersChanged: []*tailcfg.Node{peer(2)},
+			},
+		},
+		{
+			name: "endpoints-and-derp-patched",
+			sent: []*tailcfg.Node{peer(1)},
+			resp: tailcfg.MapResponse{
+				PeersChanged: []*tailcfg.Node{peer(1, func(n *tailcfg.Node) {
+					n.DERP = "127.3.3.40:2"
+					n.Endpoints = []netip.AddrPort{netip.MustParseAddrPort("192.168.0.2:41641")}
+					n.Online = &offline
+				})},
+			},
+			requested: []types.NodeID{1},
+			want: tailcfg.MapResponse{
+				PeersChangedPatch: []*tailcfg.PeerChange{
+					{
+						NodeID:     1,
+						DERPRegion: 2,
+						Endpoints:  []netip.AddrPort{netip.MustParseAddrPort("192.168.0.2:41641")},
+						Online:     &offline,
+					},
+				},
+			},
+		},
+		{
+			name: "hostinfo-change-sent-in-full",
+			sent: []*tailcfg.Node{peer(1)},
+			resp: tailcfg.MapResponse{
+				PeersChanged: []*tailcfg.Node{peer(1, func(n *tailcfg.Node) {
+					n.Hostinfo = (&tailcfg.Hostinfo{Hostname: "renamed"}).View()
+				})},
+			},
+			requested: []types.NodeID{1},
+			want: tailcfg.MapResponse{
+				PeersChanged: []*tailcfg.Node{peer(1, func(n *tailcfg.Node) {
+					n.Hostinfo = (&tailcfg.Hostinfo{Hostname: "renamed"}).View()
+				})},
+			},
+		},
+		{
+			name: "derp-going-away-sent-in-full",
+			sent: []*tailcfg.Node{peer(1)},
+			resp: tailcfg.MapResponse{
+				PeersChanged: []*tailcfg.Node{peer(1, func(n *tailcfg.Node) {
+					n.DERP = "127.3.3.40:0"
+				})},
+			},
+			requested: []types.NodeID{1},
+			want: tailcfg.MapResponse{
+				PeersChanged: []*tailcfg.Node{peer(1, func(n *tailcfg.Node) {
+					n.DERP = "127.3.3.40:0"
+				})},
+			},
+		},
+		{
+			name: "no-longer-visible-peer-removed",
+			sent: []*tailcfg.Node{peer(1), peer(2)},
+			resp: tailcfg.MapResponse{
+				PeersChanged: []*tailcfg.Node{peer(1)},
+			},
+			requested: []types.NodeID{1, 2},
+			want: tailcfg.MapResponse{
+				PeersRemoved: []tailcfg.NodeID{2},
+			},
+		},
+		{
+			name: "unknown-removed-and-patches-dropped",
+			sent: []*tailcfg.Node{peer(1)},
+			resp: tailcfg.MapResponse{
+				PeersRemoved: []tailcfg.NodeID{1, 3},
+				PeersChangedPatch: []*tailcfg.PeerChange{
+					{NodeID: 4, Online: &offline},
+				},
+			},
+			want: tailcfg.MapResponse{
+				PeersRemoved: []tailcfg.NodeID{1},
+			},
+		},
+		{
+			name: "noop-patch-dropped",
+			sent: []*tailcfg.Node{peer(1), peer(2)},
+			resp: tailcfg.MapResponse{
+				PeersChangedPatch: []*tailcfg.PeerChange{
+					{NodeID: 1, Online: &online},
+					{NodeID: 2, Online: &offline},
+				},
+			},
+			want: tailcfg.MapResponse{
+				PeersChangedPatch: []*tailcfg.PeerChange{
+					{NodeID: 2, Online: &offline},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := NewMapState()
+			state.setPeers(tt.sent)
+
+			resp := tt.resp
+			state.diffPeersChanged(&resp, tt.requested)
+
+			if diff := cmp.Diff(tt.want, resp, util.Comparers...); diff != "" {
+				t.Errorf("diffPeersChanged() unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMapStateTracksPatches(t *testing.T) {
+	online := true
+	offline := false
+
+	state := NewMapState()
+
+	// Nothing is dropped before a full MapResponse has been sent.
+	patches := []*tailcfg.PeerChange{{NodeID: 1, Online: &offline}}
+	if got := state.applyPatches(patches); len(got) != 1 {
+		t.Fatalf("expected patches to be passed through, got %v", got)
+	}
+
+	state.setPeers([]*tailcfg.Node{{ID: 1, Online: &online}})
+
+	if got := state.applyPatches(patches); len(got) != 1 {
+		t.Fatalf("expected the patch to be sent, got %v", got)
+	}
+
+	// The peer went offline with the previous patch, sending it
+	// again does not change anything for the client.
+	if got := state.applyPatches(patches); len(got) != 0 {
+		t.Fatalf("expected the patch to be dropped, got %v", got)
+	}
+
+	// A full peer equal to the patched one is not sent again.
+	resp := tailcfg.MapResponse{
+		PeersChanged: []*tailcfg.Node{{ID: 1, Online: &offline}},
+	}
+	state.diffPeersChanged(&resp, []types.NodeID{1})
+	if len(resp.PeersChanged) != 0 || len(resp.PeersChangedPatch) != 0 {
+		t.Fatalf("expected nothing to be sent, got %v %v", resp.PeersChanged, resp.PeersChangedPatch)
+	}
+}
@@ -2,7 +2,9 @@ package mapper
 
 import (
 	"fmt"
+	"maps"
 	"net/netip"
+	"slices"
 	"time"
 
 	"github.com/juanfont/headscale/hscontrol/policy"
@@ -16,6 +18,7 @@ func tailNodes(
 	capVer tailcfg.CapabilityVersion,
 	pol *policy.ACLPolicy,
 	cfg *types.Config,
+	exitRoutes bool,
 ) ([]*tailcfg.Node, error) {
 	tNodes := make([]*tailcfg.Node, len(nodes))
 
@@ -25,6 +28,7 @@ func tailNodes(
 			capVer,
 			pol,
 			cfg,
+			exitRoutes,
 		)
 		if err != nil {
 			return nil, err
@@ -38,11 +42,14 @@ func tailNodes(
 
 // tailNode converts a Node into a Tailscale Node. includeRoutes is false for shared nodes
 // as per the expected behaviour in the official SaaS.
+// The exit routes of the node are only included with exitRoutes, when
+// the node receiving it can use exit nodes.
 func tailNode(
 	node *types.Node,
 	capVer tailcfg.CapabilityVersion,
 	pol *policy.ACLPolicy,
 	cfg *types.Config,
+	exitRoutes bool,
 ) (*tailcfg.Node, error) {
 	addrs := node.Prefixes()
 
@@ -57,7 +64,7 @@ func tailNode(
 			if route.IsPrimary {
 				allowedIPs = append(allowedIPs, netip.Prefix(route.Prefix))
 				primaryPrefixes = append(primaryPrefixes, netip.Prefix(route.Prefix))
-			} else if route.IsExitRoute() {
+			} else if route.IsExitRoute() && exitRoutes {
 				allowedIPs = append(allowedIPs, netip.Prefix(route.Prefix))
 			}
 		}
@@ -77,7 +84,7 @@ func tailNode(
 		keyExpiry = time.Time{}
 	}
 
-	hostname, err := node.GetFQDN(cfg, cfg.BaseDomain)
+	hostname, err := node.GetFQDN(cfg, cfg.TailnetBaseDomain(node.User.Tailnet))
 	if err != nil {
 		return nil, fmt.Errorf("tailNode, failed to create FQDN: %s", err)
 	}
@@ -85,6 +92,11 @@ func tailNode(
 	tags, _ := pol.TagsOfNode(node)
 	tags = lo.Uniq(append(tags, node.ForcedTags...))
 
+	attrs, err := pol.NodeAttributes(node)
+	if err != nil {
+		return nil, fmt.Errorf("tailNode, failed to compile node attributes: %w", err)
+	}
+
 	tNode := tailcfg.Node{
 		ID:       tailcfg.NodeID(node.ID), // this is the actual ID
 		StableID: node.ID.StableID(),
@@ -93,8 +105,9 @@ func tailNode(
 
 		User: tailcfg.UserID(node.UserID),
 
-		Key:       node.NodeKey,
-		KeyExpiry: keyExpiry,
+		Key:          node.NodeKey,
+		KeyExpiry:    keyExpiry,
+		KeySignature: node.KeySignature,
 
 		Machine:    node.MachineKey,
 		DiscoKey:   node.DiscoKey,
@@ -111,31 +124,51 @@ func tailNode(
 
 		PrimaryRoutes: primaryPrefixes,
 
-		MachineAuthorized: !node.IsExpired(),
+		MachineAuthorized: !node.IsExpired() && !node.AwaitingApproval,
 		Expired:           node.IsExpired(),
 	}
 
 	//   - 74: 2023-09-18: Client understands NodeCapMap
 	if capVer >= 74 {
 		tNode.CapMap = tailcfg.NodeCapMap{
-			tailcfg.CapabilityFileSharing: []tailcfg.RawMessage{},
-			tailcfg.CapabilityAdmin:       []tailcfg.RawMessage{},
-			tailcfg.CapabilitySSH:         []tailcfg.RawMessage{},
+			tailcfg.CapabilityAdmin: []tailcfg.RawMessage{},
+			tailcfg.CapabilitySSH:   []tailcfg.RawMessage{},
+		}
+
+		if cfg.Taildrop.Enabled {
+			tNode.CapMap[tailcfg.CapabilityFileSharing] = []tailcfg.RawMessage{}
 		}
 
 		if cfg.RandomizeClientPort {
 			tNode.CapMap[tailcfg.NodeAttrRandomizeClientPort] = []tailcfg.RawMessage{}
 		}
+
+		if cfg.TailnetLock {
+			tNode.CapMap[tailcfg.CapabilityTailnetLock] = []tailcfg.RawMessage{}
+		}
+
+		maps.Copy(tNode.CapMap, attrs)
 	} else {
-		tNode.Capabilities = []tailcfg.NodeCapability{
-			tailcfg.CapabilityFileSharing,
+		if cfg.Taildrop.Enabled {
+			tNode.Capabilities = append(tNode.Capabilities, tailcfg.CapabilityFileSharing)
+		}
+
+		tNode.Capabilities = append(tNode.Capabilities,
 			tailcfg.CapabilityAdmin,
 			tailcfg.CapabilitySSH,
-		}
+		)
 
 		if cfg.RandomizeClientPort {
 			tNode.Capabilities = append(tNode.Capabilities, tailcfg.NodeAttrRandomizeClientPort)
 		}
+
+		if cfg.TailnetLock {
+			tNode.Capabilities = append(tNode.Capabilities, tailcfg.CapabilityTailnetLock)
+		}
+
+		attrCaps := lo.Keys(attrs)
+		slices.Sort(attrCaps)
+		tNode.Capabilities = append(tNode.Capabilities, attrCaps...)
 	}
 
 	//   - 72: 2023-08-23: TS-2023-006 UPnP issue fixed; UPnP can now be used again
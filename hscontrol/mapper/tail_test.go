@@ -2,6 +2,7 @@ package mapper
 
 import (
 	"net/netip"
+	"slices"
 	"testing"
 	"time"
 
@@ -9,6 +10,7 @@ import (
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/juanfont/headscale/hscontrol/policy"
 	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
 )
@@ -183,12 +185,14 @@ func TestTailNode(t *testing.T) {
 				BaseDomain:          tt.baseDomain,
 				DNSConfig:           tt.dnsConfig,
 				RandomizeClientPort: false,
+				Taildrop:            types.TaildropConfig{Enabled: true},
 			}
 			got, err := tailNode(
 				tt.node,
 				0,
 				tt.pol,
 				cfg,
+				true,
 			)
 
 			if (err != nil) != tt.wantErr {
@@ -203,3 +207,109 @@ func TestTailNode(t *testing.T) {
 		})
 	}
 }
+
+func TestTailNodeExitRoutes(t *testing.T) {
+	node := &types.Node{
+		IPv4:     iap("100.64.0.1"),
+		Hostinfo: &tailcfg.Hostinfo{},
+		Routes: []types.Route{
+			{
+				Prefix:  types.IPPrefix(netip.MustParsePrefix("0.0.0.0/0")),
+				Enabled: true,
+			},
+			{
+				Prefix:    types.IPPrefix(netip.MustParsePrefix("192.168.0.0/24")),
+				Enabled:   true,
+				IsPrimary: true,
+			},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		exitRoutes bool
+		want       []netip.Prefix
+	}{
+		{
+			name:       "with-exit-routes",
+			exitRoutes: true,
+			want: []netip.Prefix{
+				netip.MustParsePrefix("100.64.0.1/32"),
+				netip.MustParsePrefix("0.0.0.0/0"),
+				netip.MustParsePrefix("192.168.0.0/24"),
+			},
+		},
+		{
+			name: "without-exit-routes",
+			want: []netip.Prefix{
+				netip.MustParsePrefix("100.64.0.1/32"),
+				netip.MustParsePrefix("192.168.0.0/24"),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tailNode(node, 0, &policy.ACLPolicy{}, &types.Config{}, tt.exitRoutes)
+			if err != nil {
+				t.Fatalf("tailNode() error = %v", err)
+			}
+
+			if diff := cmp.Diff(tt.want, got.AllowedIPs, util.PrefixComparer); diff != "" {
+				t.Errorf("tailNode() unexpected AllowedIPs (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTailNodeTaildrop(t *testing.T) {
+	node := &types.Node{
+		IPv4:     iap("100.64.0.1"),
+		Hostinfo: &tailcfg.Hostinfo{},
+	}
+
+	for _, enabled := range []bool{true, false} {
+		cfg := &types.Config{Taildrop: types.TaildropConfig{Enabled: enabled}}
+
+		got, err := tailNode(node, 74, &policy.ACLPolicy{}, cfg, true)
+		if err != nil {
+			t.Fatalf("tailNode() error = %v", err)
+		}
+
+		if got.CapMap.Contains(tailcfg.CapabilityFileSharing) != enabled {
+			t.Errorf("tailNode() with taildrop enabled %t, CapMap = %v", enabled, got.CapMap)
+		}
+	}
+}
+
+func TestTailNodeAttributes(t *testing.T) {
+	node := &types.Node{
+		IPv4:       iap("100.64.0.1"),
+		User:       types.User{Name: "user1"},
+		ForcedTags: []string{"tag:web"},
+		Hostinfo:   &tailcfg.Hostinfo{},
+	}
+	pol := &policy.ACLPolicy{
+		NodeAttrs: []policy.NodeAttr{
+			{Targets: []string{"tag:web"}, Attrs: []string{"funnel"}},
+		},
+	}
+
+	got, err := tailNode(node, 74, pol, &types.Config{}, true)
+	if err != nil {
+		t.Fatalf("tailNode() error = %v", err)
+	}
+
+	if !got.CapMap.Contains(tailcfg.NodeAttrFunnel) {
+		t.Errorf("tailNode() CapMap = %v, want funnel", got.CapMap)
+	}
+
+	got, err = tailNode(node, 0, pol, &types.Config{}, true)
+	if err != nil {
+		t.Fatalf("tailNode() error = %v", err)
+	}
+
+	if !slices.Contains(got.Capabilities, tailcfg.NodeAttrFunnel) {
+		t.Errorf("tailNode() Capabilities = %v, want funnel", got.Capabilities)
+	}
+}
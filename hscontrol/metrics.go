@@ -52,6 +52,11 @@ var (
 		Name:      "mapresponse_readonly_requests_total",
 		Help:      "total count of readonly requests received",
 	}, []string{"status"})
+	mapResponseOneShot = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "mapresponse_oneshot_requests_total",
+		Help:      "total count of non-streaming requests for a full map received",
+	}, []string{"status"})
 	mapResponseEnded = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: prometheusNamespace,
 		Name:      "mapresponse_ended_total",
@@ -73,6 +78,41 @@ var (
 		Help:      "Total number of http requests processed",
 	}, []string{"code", "method", "path"},
 	)
+	nodesRegistered = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: prometheusNamespace,
+		Name:      "nodes_registered",
+		Help:      "number of nodes registered in the tailnet",
+	})
+	nodeLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: prometheusNamespace,
+		Name:      "node_limit",
+		Help:      "configured node limit, 0 is unlimited",
+	}, []string{"type"})
+	nodeRegistrationsRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "node_registrations_rejected_total",
+		Help:      "total count of new node registrations rejected by the hard node limit",
+	})
+	clientCapabilityVersions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "client_capability_version_requests_total",
+		Help:      "total count of register and map requests by capability version of the client, and if it was accepted, warned or refused",
+	}, []string{"capver", "result"})
+	routeFlapsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "route_flaps_total",
+		Help:      "total count of nodes going offline again while their routes were dampened after a previous disconnection",
+	})
+	haChangesDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "ha_changes_dropped_total",
+		Help:      "total count of updates not published for the other HA instances because the publish queue was full",
+	})
+	haChangesRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "ha_changes_rejected_total",
+		Help:      "total count of updates of the other HA instances which were not signed with a cluster key",
+	})
 )
 
 // prometheusMiddleware implements mux.MiddlewareFunc.
@@ -0,0 +1,64 @@
+package hscontrol
+
+import (
+	"context"
+
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/policy"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// applyNodeShares sets the users the nodes are shared with in the
+// policy, and reports if they changed. Without a policy all the nodes
+// see each other, sharing makes no difference.
+func (h *Headscale) applyNodeShares(pol *policy.ACLPolicy) (bool, error) {
+	if pol == nil {
+		return false, nil
+	}
+
+	shares, err := db.Read(h.db.DB, func(rx *gorm.DB) ([]types.NodeShare, error) {
+		return db.ListNodeShares(rx, 0)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	users := make(map[types.NodeID][]string)
+	for _, share := range shares {
+		users[share.NodeID] = append(users[share.NodeID], share.User.Name)
+	}
+
+	return pol.SetNodeShares(users), nil
+}
+
+// refreshNodeShares updates the users the nodes are shared with in the
+// current policies, and sends the nodes their new peers and rules if
+// they changed.
+func (h *Headscale) refreshNodeShares() {
+	h.policyMu.Lock()
+	defer h.policyMu.Unlock()
+
+	changed := false
+	for tailnet, pol := range h.policies() {
+		polChanged, err := h.applyNodeShares(pol)
+		if err != nil {
+			log.Error().Err(err).Str("tailnet", tailnet).Msg("Failed to update the node shares of the ACL policy")
+
+			return
+		}
+		changed = changed || polChanged
+	}
+
+	if !changed {
+		return
+	}
+
+	log.Info().Msg("Node shares changed, notifying nodes of change")
+
+	ctx := types.NotifyCtx(context.Background(), "node-shares", "na")
+	h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+		Type: types.StateFullUpdate,
+	})
+}
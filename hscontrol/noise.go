@@ -5,10 +5,13 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
 	"tailscale.com/control/controlbase"
@@ -100,6 +103,21 @@ func (h *Headscale) NoiseUpgradeHandler(
 	router.HandleFunc("/machine/register", noiseServer.NoiseRegistrationHandler).
 		Methods(http.MethodPost)
 	router.HandleFunc("/machine/map", noiseServer.NoisePollNetMapHandler)
+	router.HandleFunc("/machine/ssh/action/from/{src}/to/{dst}", noiseServer.SSHActionHandler).
+		Methods(http.MethodGet)
+	router.HandleFunc("/machine/ssh/wait/{id}", noiseServer.SSHWaitHandler).
+		Methods(http.MethodGet)
+	router.HandleFunc(clientMetricsPath+"{nonce}", noiseServer.ClientMetricsHandler).
+		Methods(http.MethodPost)
+
+	router.HandleFunc("/machine/tka/init/begin", noiseServer.TKAInitBeginHandler)
+	router.HandleFunc("/machine/tka/init/finish", noiseServer.TKAInitFinishHandler)
+	router.HandleFunc("/machine/tka/bootstrap", noiseServer.TKABootstrapHandler)
+	router.HandleFunc("/machine/tka/sync/offer", noiseServer.TKASyncOfferHandler)
+	router.HandleFunc("/machine/tka/sync/send", noiseServer.TKASyncSendHandler)
+	router.HandleFunc("/machine/tka/disable", noiseServer.TKADisableHandler)
+	router.HandleFunc("/machine/tka/sign", noiseServer.TKASignHandler)
+	router.HandleFunc("/machine/tka/affected-sigs", noiseServer.TKAAffectedSigsHandler)
 
 	server := http.Server{
 		ReadTimeout: types.HTTPTimeout,
@@ -169,6 +187,40 @@ const (
 	MinimumCapVersion tailcfg.CapabilityVersion = 58
 )
 
+// checkClientVersion counts the request of a client in the metrics,
+// and reports if its capability version is refused by the
+// configuration.
+func (h *Headscale) checkClientVersion(
+	version tailcfg.CapabilityVersion,
+	hostname string,
+) bool {
+	result := "accepted"
+	switch {
+	case h.cfg.ClientVersions.Refused(version):
+		result = "refused"
+	case h.cfg.ClientVersions.Warned(version):
+		result = "warned"
+	}
+	clientCapabilityVersions.WithLabelValues(strconv.Itoa(int(version)), result).Inc()
+
+	switch result {
+	case "refused":
+		log.Warn().
+			Caller().
+			Int("client_version", int(version)).
+			Str("hostname", hostname).
+			Msg("client with a refused capability version connected")
+	case "warned":
+		log.Debug().
+			Caller().
+			Int("client_version", int(version)).
+			Str("hostname", hostname).
+			Msg("client with a deprecated capability version connected")
+	}
+
+	return result == "refused"
+}
+
 // NoisePollNetMapHandler takes care of /machine/:id/map using the Noise protocol
 //
 // This is the busiest endpoint, as it keeps the HTTP long poll that updates
@@ -191,10 +243,16 @@ func (ns *noiseServer) NoisePollNetMapHandler(
 		Caller().
 		Msg("Headers")
 
+	// The span of a streaming request ends once the stream is set up,
+	// the updates sent on it have their own traces.
+	ctx, span := tracer.Start(req.Context(), "noise.map_request")
+	defer span.End()
+
 	body, _ := io.ReadAll(req.Body)
 
 	mapRequest := tailcfg.MapRequest{}
 	if err := json.Unmarshal(body, &mapRequest); err != nil {
+		span.SetStatus(codes.Error, err.Error())
 		log.Error().
 			Caller().
 			Err(err).
@@ -204,8 +262,15 @@ func (ns *noiseServer) NoisePollNetMapHandler(
 		return
 	}
 
+	span.SetAttributes(
+		attribute.Int("capver", int(mapRequest.Version)),
+		attribute.Bool("stream", mapRequest.Stream),
+		attribute.Bool("omit_peers", mapRequest.OmitPeers),
+	)
+
 	// Reject unsupported versions
 	if mapRequest.Version < MinimumCapVersion {
+		span.SetStatus(codes.Error, "unsupported client version")
 		log.Info().
 			Caller().
 			Int("min_version", int(MinimumCapVersion)).
@@ -216,6 +281,17 @@ func (ns *noiseServer) NoisePollNetMapHandler(
 		return
 	}
 
+	var hostname string
+	if mapRequest.Hostinfo != nil {
+		hostname = mapRequest.Hostinfo.Hostname
+	}
+	if ns.headscale.checkClientVersion(mapRequest.Version, hostname) {
+		span.SetStatus(codes.Error, "refused client version")
+		http.Error(writer, ns.headscale.cfg.ClientVersions.Message(mapRequest.Version), http.StatusBadRequest)
+
+		return
+	}
+
 	ns.nodeKey = mapRequest.NodeKey
 
 	node, err := ns.headscale.db.GetNodeByAnyKey(
@@ -224,6 +300,7 @@ func (ns *noiseServer) NoisePollNetMapHandler(
 		key.NodePublic{},
 	)
 	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
 		log.Error().
 			Str("handler", "NoisePollNetMap").
 			Msgf("Failed to fetch node from the database with node key: %s", mapRequest.NodeKey.String())
@@ -232,11 +309,14 @@ func (ns *noiseServer) NoisePollNetMapHandler(
 		return
 	}
 
-	sess := ns.headscale.newMapSession(req.Context(), mapRequest, writer, node)
+	span.SetAttributes(attribute.Int64("node.id", int64(node.ID)))
+
+	sess := ns.headscale.newMapSession(ctx, mapRequest, writer, node)
 	sess.tracef("a node sending a MapRequest with Noise protocol")
 	if !sess.isStreaming() {
 		sess.serve()
 	} else {
+		span.End()
 		sess.serveLongPoll()
 	}
 }
@@ -0,0 +1,332 @@
+package notifier
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+)
+
+// changeBusQueueSize is the number of events waiting to be sent to a
+// NATS or Redis bus, the new events are dropped when it is full.
+const changeBusQueueSize = 1024
+
+// changeBusRetryInterval is how long receiving from a NATS or Redis
+// bus waits before trying again after an error.
+const changeBusRetryInterval = 5 * time.Second
+
+// ChangeEvent is a state update sent through the notifier.
+type ChangeEvent struct {
+	Update types.StateUpdate `json:"update"`
+
+	// NodeID is set for the updates sent to a single node, and
+	// Delivered reports if that node was connected to this instance.
+	NodeID    types.NodeID `json:"node_id,omitempty"`
+	Delivered bool         `json:"delivered,omitempty"`
+
+	// Origin is the part of headscale the update came from.
+	Origin string `json:"origin,omitempty"`
+
+	// Remote is set on the events received from the other instances
+	// or external components through a NATS or Redis bus.
+	Remote bool `json:"-"`
+}
+
+// ChangeBus carries the changes sent through the notifier to the
+// components interested in them, like the other headscale instances
+// with HA.
+type ChangeBus interface {
+	// Publish sends the event to the subscribers.
+	Publish(event ChangeEvent)
+
+	// Subscribe calls the handler for every published event until the
+	// returned function is called. The handler must not block.
+	Subscribe(handler func(ChangeEvent)) (unsubscribe func())
+
+	// Close stops publishing the events outside of the process.
+	Close() error
+}
+
+// NewChangeBus returns the bus configured by change_bus, the NATS and
+// Redis buses are only available when headscale is built with the nats
+// or redis build tag, and authenticate the changes with the cluster
+// keys.
+func NewChangeBus(cfg types.ChangeBusConfig, keys *types.ClusterKeyring) (ChangeBus, error) {
+	var transport busTransport
+	var err error
+
+	if cfg.Shared() && keys == nil {
+		return nil, fmt.Errorf("the %s change bus requires cluster keys", cfg.Type)
+	}
+
+	switch cfg.Type {
+	case "", types.ChangeBusLocal:
+		return NewLocalBus(), nil
+	case types.ChangeBusNATS:
+		transport, err = newNATSTransport(cfg.NATS, cfg.InstanceID)
+	case types.ChangeBusRedis:
+		transport, err = newRedisTransport(cfg.Redis)
+	default:
+		return nil, fmt.Errorf("unknown change bus %q", cfg.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connecting to the %s change bus: %w", cfg.Type, err)
+	}
+
+	return newRemoteBus(cfg.InstanceID, transport, keys), nil
+}
+
+// localBus is the in-process ChangeBus, the handlers are called in
+// the goroutine publishing the event.
+type localBus struct {
+	mu       sync.RWMutex
+	handlers map[uint64]func(ChangeEvent)
+	next     uint64
+}
+
+// NewLocalBus returns an in-process ChangeBus.
+func NewLocalBus() ChangeBus {
+	return &localBus{
+		handlers: make(map[uint64]func(ChangeEvent)),
+	}
+}
+
+func (b *localBus) Publish(event ChangeEvent) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, handler := range b.handlers {
+		handler(event)
+	}
+}
+
+func (b *localBus) Subscribe(handler func(ChangeEvent)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.next
+	b.next++
+	b.handlers[id] = handler
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		delete(b.handlers, id)
+	}
+}
+
+func (b *localBus) Close() error {
+	return nil
+}
+
+// busTransport sends the events to a NATS subject or a Redis stream,
+// and receives the events published there.
+type busTransport interface {
+	send(ctx context.Context, data []byte) error
+
+	// receive calls handle with the events published on the bus,
+	// until ctx is done or receiving fails.
+	receive(ctx context.Context, handle func(data []byte)) error
+
+	close() error
+}
+
+// busTLSConfig returns the TLS configuration of the connection to NATS
+// or Redis, nil when TLS is not enabled.
+func busTLSConfig(cfg types.BusTLSConfig) (*tls.Config, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if cfg.CAPath != "" {
+		caPEM, err := os.ReadFile(cfg.CAPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading change bus CA: %w", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in change bus CA %s", cfg.CAPath)
+		}
+	}
+
+	if cfg.CertPath != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertPath, cfg.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("loading change bus client certificate: %w", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// busMessage is a ChangeEvent as it is sent on a NATS or Redis bus.
+type busMessage struct {
+	// Instance is the headscale instance which published the event.
+	Instance string      `json:"instance"`
+	Event    ChangeEvent `json:"event"`
+}
+
+// busEnvelope is an encoded busMessage with its MAC, computed with the
+// cluster keys, authenticating the instance which published it.
+type busEnvelope struct {
+	Message json.RawMessage `json:"message"`
+	MAC     string          `json:"mac"`
+}
+
+// remoteBus is a ChangeBus which delivers the events to the in-process
+// subscribers, and publishes them on a NATS or Redis bus for the other
+// instances and external components. The events published there by
+// others are delivered to the subscribers with Remote set, once they
+// are authenticated with the cluster keys.
+//
+// The events are sent from a queue, so publishing does not wait for the
+// bus, they are dropped if the queue is full.
+type remoteBus struct {
+	*localBus
+
+	instance  string
+	transport busTransport
+	keys      *types.ClusterKeyring
+	queue     chan []byte
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newRemoteBus(instance string, transport busTransport, keys *types.ClusterKeyring) *remoteBus {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	b := &remoteBus{
+		localBus: &localBus{
+			handlers: make(map[uint64]func(ChangeEvent)),
+		},
+		instance:  instance,
+		transport: transport,
+		keys:      keys,
+		queue:     make(chan []byte, changeBusQueueSize),
+		cancel:    cancel,
+	}
+
+	b.wg.Add(2)
+	go b.sendQueued(ctx)
+	go b.receive(ctx)
+
+	return b
+}
+
+func (b *remoteBus) Publish(event ChangeEvent) {
+	b.localBus.Publish(event)
+
+	msg, err := json.Marshal(busMessage{Instance: b.instance, Event: event})
+	if err != nil {
+		util.LogBatcher.Error().Err(err).Msg("failed to encode change for the change bus")
+		changeBusDropped.WithLabelValues("error").Inc()
+
+		return
+	}
+
+	data, err := json.Marshal(busEnvelope{Message: msg, MAC: b.keys.Sign(msg)})
+	if err != nil {
+		util.LogBatcher.Error().Err(err).Msg("failed to encode change for the change bus")
+		changeBusDropped.WithLabelValues("error").Inc()
+
+		return
+	}
+
+	select {
+	case b.queue <- data:
+	default:
+		changeBusDropped.WithLabelValues("queue_full").Inc()
+	}
+}
+
+// Close stops sending and receiving the events, the queued events are
+// dropped.
+func (b *remoteBus) Close() error {
+	b.cancel()
+	b.wg.Wait()
+
+	return b.transport.close()
+}
+
+func (b *remoteBus) sendQueued(ctx context.Context) {
+	defer b.wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case data := <-b.queue:
+			if err := b.transport.send(ctx, data); err != nil {
+				util.LogBatcher.Error().Err(err).Msg("failed to send change to the change bus")
+				changeBusDropped.WithLabelValues("error").Inc()
+			}
+		}
+	}
+}
+
+func (b *remoteBus) receive(ctx context.Context) {
+	defer b.wg.Done()
+
+	for {
+		err := b.transport.receive(ctx, b.deliver)
+		if ctx.Err() != nil {
+			return
+		}
+
+		util.LogBatcher.Error().Err(err).Msg("failed to receive changes from the change bus, retrying")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(changeBusRetryInterval):
+		}
+	}
+}
+
+// deliver passes an event received from the bus to the subscribers,
+// unless this instance published it or it is not authenticated.
+func (b *remoteBus) deliver(data []byte) {
+	var envelope busEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		util.LogBatcher.Warn().Err(err).Msg("failed to decode change from the change bus")
+
+		return
+	}
+
+	if !b.keys.Verify(envelope.Message, envelope.MAC) {
+		util.LogBatcher.Warn().Msg("ignoring change from the change bus not signed with a cluster key")
+		changeBusRejected.Inc()
+
+		return
+	}
+
+	var msg busMessage
+	if err := json.Unmarshal(envelope.Message, &msg); err != nil {
+		util.LogBatcher.Warn().Err(err).Msg("failed to decode change from the change bus")
+
+		return
+	}
+
+	if msg.Instance == b.instance {
+		return
+	}
+
+	msg.Event.Remote = true
+	b.localBus.Publish(msg.Event)
+}
@@ -0,0 +1,77 @@
+//go:build nats
+
+package notifier
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/nats-io/nats.go"
+)
+
+// natsTransport publishes the events on a NATS subject. The client
+// reconnects by itself, and restores the subscription when it does.
+type natsTransport struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func newNATSTransport(cfg types.NATSBusConfig, instance string) (busTransport, error) {
+	opts := []nats.Option{
+		nats.Name("headscale " + instance),
+		nats.MaxReconnects(-1),
+	}
+
+	tlsConfig, err := busTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts = append(opts, nats.Secure(tlsConfig))
+	}
+
+	if cfg.CredsPath != "" {
+		opts = append(opts, nats.UserCredentials(cfg.CredsPath))
+	}
+
+	if cfg.NKeySeedPath != "" {
+		opt, err := nats.NkeyOptionFromSeed(cfg.NKeySeedPath)
+		if err != nil {
+			return nil, fmt.Errorf("loading NKey seed: %w", err)
+		}
+		opts = append(opts, opt)
+	}
+
+	conn, err := nats.Connect(cfg.URL, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &natsTransport{
+		conn:    conn,
+		subject: cfg.Subject,
+	}, nil
+}
+
+func (t *natsTransport) send(_ context.Context, data []byte) error {
+	return t.conn.Publish(t.subject, data)
+}
+
+func (t *natsTransport) receive(ctx context.Context, handle func(data []byte)) error {
+	sub, err := t.conn.Subscribe(t.subject, func(msg *nats.Msg) {
+		handle(msg.Data)
+	})
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe() //nolint:errcheck
+
+	<-ctx.Done()
+
+	return ctx.Err()
+}
+
+func (t *natsTransport) close() error {
+	return t.conn.Drain()
+}
@@ -0,0 +1,13 @@
+//go:build !nats
+
+package notifier
+
+import (
+	"errors"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+)
+
+func newNATSTransport(types.NATSBusConfig, string) (busTransport, error) {
+	return nil, errors.New("headscale was built without NATS support, build it with -tags nats")
+}
@@ -0,0 +1,102 @@
+//go:build redis
+
+package notifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// redisEventField is the field of the stream entries holding the
+	// encoded event.
+	redisEventField = "event"
+
+	// redisReadBlock is how long reading the stream waits for new
+	// entries, before checking if the bus is closed.
+	redisReadBlock = time.Second
+
+	redisReadCount = 100
+)
+
+// redisTransport publishes the events on a Redis stream, trimmed to
+// about MaxLen entries. Only the entries added after headscale started
+// are received.
+type redisTransport struct {
+	client *redis.Client
+	stream string
+	maxLen int64
+	lastID string
+}
+
+func newRedisTransport(cfg types.RedisBusConfig) (busTransport, error) {
+	tlsConfig, err := busTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:      cfg.Addr,
+		Username:  cfg.Username,
+		Password:  cfg.Password,
+		DB:        cfg.DB,
+		TLSConfig: tlsConfig,
+	})
+
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+
+		return nil, err
+	}
+
+	return &redisTransport{
+		client: client,
+		stream: cfg.Stream,
+		maxLen: cfg.MaxLen,
+		lastID: "$",
+	}, nil
+}
+
+func (t *redisTransport) send(ctx context.Context, data []byte) error {
+	return t.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: t.stream,
+		MaxLen: t.maxLen,
+		Approx: true,
+		Values: map[string]any{redisEventField: data},
+	}).Err()
+}
+
+func (t *redisTransport) receive(ctx context.Context, handle func(data []byte)) error {
+	for {
+		streams, err := t.client.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{t.stream, t.lastID},
+			Count:   redisReadCount,
+			Block:   redisReadBlock,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("reading stream %s: %w", t.stream, err)
+		}
+
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				t.lastID = msg.ID
+
+				if data, ok := msg.Values[redisEventField].(string); ok {
+					handle([]byte(data))
+				}
+			}
+		}
+	}
+}
+
+func (t *redisTransport) close() error {
+	return t.client.Close()
+}
@@ -0,0 +1,13 @@
+//go:build !redis
+
+package notifier
+
+import (
+	"errors"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+)
+
+func newRedisTransport(types.RedisBusConfig) (busTransport, error) {
+	return nil, errors.New("headscale was built without Redis support, build it with -tags redis")
+}
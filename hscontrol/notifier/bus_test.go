@@ -0,0 +1,179 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/types"
+)
+
+// fakeTransport is a busTransport keeping the sent events, and
+// receiving the events written to in.
+type fakeTransport struct {
+	sent chan []byte
+	in   chan []byte
+}
+
+func newFakeTransport() *fakeTransport {
+	return &fakeTransport{
+		sent: make(chan []byte, 10),
+		in:   make(chan []byte),
+	}
+}
+
+func (t *fakeTransport) send(_ context.Context, data []byte) error {
+	t.sent <- data
+
+	return nil
+}
+
+func (t *fakeTransport) receive(ctx context.Context, handle func(data []byte)) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case data := <-t.in:
+			handle(data)
+		}
+	}
+}
+
+func (t *fakeTransport) close() error {
+	return nil
+}
+
+func TestRemoteBus(t *testing.T) {
+	keys := types.NewClusterKeyring(bytes.Repeat([]byte{1}, types.ClusterKeyMinLength))
+	transport := newFakeTransport()
+	bus := newRemoteBus("first", transport, keys)
+	defer bus.Close()
+
+	events := make(chan ChangeEvent, 10)
+	bus.Subscribe(func(event ChangeEvent) {
+		events <- event
+	})
+
+	full := types.StateUpdate{Type: types.StateFullUpdate}
+
+	// A published event is delivered in the process, and sent.
+	bus.Publish(ChangeEvent{Update: full, NodeID: 1, Origin: "test"})
+	if got := <-events; got.Remote || got.NodeID != 1 {
+		t.Errorf("unexpected local event %+v", got)
+	}
+
+	var sent busMessage
+	select {
+	case data := <-transport.sent:
+		var envelope busEnvelope
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			t.Fatalf("decoding sent event: %s", err)
+		}
+		if !keys.Verify(envelope.Message, envelope.MAC) {
+			t.Error("sent event is not signed with the cluster key")
+		}
+		if err := json.Unmarshal(envelope.Message, &sent); err != nil {
+			t.Fatalf("decoding sent event: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event was not sent")
+	}
+	if diff := cmp.Diff(busMessage{
+		Instance: "first",
+		Event:    ChangeEvent{Update: full, NodeID: 1, Origin: "test"},
+	}, sent); diff != "" {
+		t.Errorf("unexpected sent event (-want +got):\n%s", diff)
+	}
+
+	receive := func(msg busMessage, keys *types.ClusterKeyring) {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("encoding event: %s", err)
+		}
+		data, err = json.Marshal(busEnvelope{Message: data, MAC: keys.Sign(data)})
+		if err != nil {
+			t.Fatalf("encoding event: %s", err)
+		}
+		transport.in <- data
+	}
+
+	// The events of this instance coming back from the bus are
+	// ignored, and so are the ones not signed with a cluster key. The
+	// ones of the others are delivered as remote.
+	other := types.NewClusterKeyring(bytes.Repeat([]byte{2}, types.ClusterKeyMinLength))
+	receive(busMessage{Instance: "first", Event: ChangeEvent{Update: full, NodeID: 2}}, keys)
+	receive(busMessage{Instance: "second", Event: ChangeEvent{Update: full, NodeID: 4}}, other)
+	receive(busMessage{Instance: "second", Event: ChangeEvent{Update: full, NodeID: 3}}, keys)
+
+	select {
+	case got := <-events:
+		if !got.Remote || got.NodeID != 3 {
+			t.Errorf("unexpected remote event %+v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("remote event was not delivered")
+	}
+
+	if len(events) != 0 {
+		t.Errorf("expected only the signed event of the other instance, got %+v", <-events)
+	}
+}
+
+func TestNotifierRemoteEvents(t *testing.T) {
+	n := NewNotifier(&types.Config{
+		Tuning: types.Tuning{
+			BatchChangeDelay:    time.Hour,
+			NotifierSendTimeout: time.Second,
+		},
+	})
+	defer n.Close()
+
+	bus := NewLocalBus()
+	n.SetBus(bus)
+
+	ch := make(chan types.StateUpdate, 2)
+	n.AddNode(1, ch)
+	defer n.RemoveNode(1, ch)
+
+	full := types.StateUpdate{Type: types.StateFullUpdate}
+
+	// Only the remote events which were not delivered are sent.
+	bus.Publish(ChangeEvent{Update: full, NodeID: 1})
+	bus.Publish(ChangeEvent{Update: full, NodeID: 1, Remote: true, Delivered: true})
+	bus.Publish(ChangeEvent{Update: full, NodeID: 1, Remote: true})
+
+	if len(ch) != 1 {
+		t.Fatalf("expected one update, got %d", len(ch))
+	}
+}
+
+func TestBusTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	invalidCA := filepath.Join(dir, "invalid.pem")
+	if err := os.WriteFile(invalidCA, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tlsConfig, err := busTLSConfig(types.BusTLSConfig{})
+	if err != nil || tlsConfig != nil {
+		t.Errorf("expected no TLS when it is disabled, got %v, %v", tlsConfig, err)
+	}
+
+	tlsConfig, err = busTLSConfig(types.BusTLSConfig{Enabled: true})
+	if err != nil || tlsConfig == nil || tlsConfig.RootCAs != nil {
+		t.Errorf("expected TLS with the system CAs, got %v, %v", tlsConfig, err)
+	}
+
+	if _, err := busTLSConfig(types.BusTLSConfig{Enabled: true, CAPath: invalidCA}); err == nil {
+		t.Error("expected an error for a CA without certificates")
+	}
+
+	if _, err := busTLSConfig(types.BusTLSConfig{Enabled: true, CAPath: filepath.Join(dir, "missing.pem")}); err == nil {
+		t.Error("expected an error for a missing CA")
+	}
+}
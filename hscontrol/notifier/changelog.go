@@ -0,0 +1,177 @@
+package notifier
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+)
+
+// ChangeLogEntry describes a state update received by the notifier.
+type ChangeLogEntry struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Origin   string    `json:"origin,omitempty"`
+	Hostname string    `json:"hostname,omitempty"`
+	Message  string    `json:"message,omitempty"`
+
+	// Target is set if the update was only sent to a single node.
+	Target types.NodeID `json:"target,omitempty"`
+
+	ChangedNodes []types.NodeID `json:"changed_nodes,omitempty"`
+	PatchedNodes []types.NodeID `json:"patched_nodes,omitempty"`
+	RemovedNodes []types.NodeID `json:"removed_nodes,omitempty"`
+
+	Interactive bool `json:"interactive,omitempty"`
+}
+
+// changeLog is a fixed size ring buffer of the most recent state
+// updates, used to answer what happened to the network at a given
+// time when debugging. If it has a path, it is loaded from it when
+// created and saved to it when headscale shuts down.
+type changeLog struct {
+	mu      sync.Mutex
+	entries []ChangeLogEntry
+	next    int
+	full    bool
+	path    string
+}
+
+func newChangeLog(size int, path string) *changeLog {
+	c := &changeLog{
+		entries: make([]ChangeLogEntry, max(size, 0)),
+		path:    path,
+	}
+
+	if err := c.load(); err != nil {
+		util.LogBatcher.Warn().
+			Err(err).
+			Str("path", path).
+			Msg("Could not load the change log, starting with an empty one")
+	}
+
+	return c
+}
+
+// load adds the entries saved at the path of the log, if any.
+func (c *changeLog) load() error {
+	if c.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var entries []ChangeLogEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("decoding %s: %w", c.path, err)
+	}
+
+	for _, entry := range entries {
+		c.add(entry)
+	}
+
+	return nil
+}
+
+// save writes the entries of the log to its path, if it has one. The
+// file is replaced atomically.
+func (c *changeLog) save() error {
+	if c == nil || c.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(c.list())
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), c.path)
+}
+
+func (c *changeLog) add(entry ChangeLogEntry) {
+	if c == nil || len(c.entries) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[c.next] = entry
+	c.next = (c.next + 1) % len(c.entries)
+	if c.next == 0 {
+		c.full = true
+	}
+}
+
+// list returns the entries in the log, oldest first.
+func (c *changeLog) list() []ChangeLogEntry {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.full {
+		return append([]ChangeLogEntry{}, c.entries[:c.next]...)
+	}
+
+	ret := make([]ChangeLogEntry, 0, len(c.entries))
+	ret = append(ret, c.entries[c.next:]...)
+	ret = append(ret, c.entries[:c.next]...)
+
+	return ret
+}
+
+func newChangeLogEntry(
+	origin, hostname string,
+	update types.StateUpdate,
+	target types.NodeID,
+) ChangeLogEntry {
+	entry := ChangeLogEntry{
+		Time:         time.Now(),
+		Type:         update.Type.String(),
+		Origin:       origin,
+		Hostname:     hostname,
+		Message:      update.Message,
+		Target:       target,
+		ChangedNodes: slices.Clone(update.ChangeNodes),
+		RemovedNodes: slices.Clone(update.Removed),
+		Interactive:  update.Interactive,
+	}
+
+	for _, patch := range update.ChangePatches {
+		entry.PatchedNodes = append(entry.PatchedNodes, types.NodeID(patch.NodeID))
+	}
+
+	return entry
+}
@@ -0,0 +1,96 @@
+package notifier
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+)
+
+func TestChangeLog(t *testing.T) {
+	entry := func(target types.NodeID) ChangeLogEntry {
+		return ChangeLogEntry{Target: target}
+	}
+
+	targets := func(entries []ChangeLogEntry) []types.NodeID {
+		var ret []types.NodeID
+		for _, e := range entries {
+			ret = append(ret, e.Target)
+		}
+
+		return ret
+	}
+
+	tests := []struct {
+		name string
+		size int
+		add  []types.NodeID
+		want []types.NodeID
+	}{
+		{
+			name: "empty",
+			size: 3,
+		},
+		{
+			name: "not-full",
+			size: 3,
+			add:  []types.NodeID{1, 2},
+			want: []types.NodeID{1, 2},
+		},
+		{
+			name: "exactly-full",
+			size: 3,
+			add:  []types.NodeID{1, 2, 3},
+			want: []types.NodeID{1, 2, 3},
+		},
+		{
+			name: "wrapped",
+			size: 3,
+			add:  []types.NodeID{1, 2, 3, 4, 5},
+			want: []types.NodeID{3, 4, 5},
+		},
+		{
+			name: "disabled",
+			size: 0,
+			add:  []types.NodeID{1, 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := newChangeLog(tt.size, "")
+			for _, id := range tt.add {
+				log.add(entry(id))
+			}
+
+			got := targets(log.list())
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestChangeLogSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "changes.json")
+
+	log := newChangeLog(3, path)
+	for _, id := range []types.NodeID{1, 2, 3, 4} {
+		log.add(ChangeLogEntry{Target: id})
+	}
+
+	if err := log.save(); err != nil {
+		t.Fatalf("saving change log: %s", err)
+	}
+
+	// A smaller log only keeps the most recent saved entries.
+	loaded := newChangeLog(2, path).list()
+	if len(loaded) != 2 || loaded[0].Target != 3 || loaded[1].Target != 4 {
+		t.Fatalf("got %v, want the entries of 3 and 4", loaded)
+	}
+}
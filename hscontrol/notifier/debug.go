@@ -0,0 +1,130 @@
+package notifier
+
+import (
+	"sort"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+)
+
+// nodeStats is what the notifier knows about the connections of a
+// node, kept after the node disconnects to tell when it was last seen.
+type nodeStats struct {
+	connections    uint64
+	connectedAt    time.Time
+	disconnectedAt time.Time
+	lastSent       time.Time
+	seq            uint64
+}
+
+// DebugInfo describes the state of the notifier and its batcher.
+type DebugInfo struct {
+	Time          time.Time       `json:"time"`
+	BatchInterval time.Duration   `json:"batch_interval"`
+	Nodes         []NodeDebugInfo `json:"nodes"`
+
+	// Changes and patches waiting for the next flush of the batcher.
+	PendingChanges []types.NodeID `json:"pending_changes"`
+	PendingPatches []types.NodeID `json:"pending_patches"`
+}
+
+// NodeDebugInfo describes the connections of a node to the notifier.
+type NodeDebugInfo struct {
+	ID        types.NodeID `json:"id"`
+	Connected bool         `json:"connected"`
+
+	// Connections is the number of times the node has connected,
+	// more than one means it has reconnected.
+	Connections    uint64    `json:"connections"`
+	ConnectedAt    time.Time `json:"connected_at"`
+	DisconnectedAt time.Time `json:"disconnected_at,omitempty"`
+	// ConnectedFor is the age of the current connection.
+	ConnectedFor time.Duration `json:"connected_for,omitempty"`
+
+	// LastSent is when an update was last put on the channel of the
+	// node, and Seq the number of updates put on it since the node
+	// connected.
+	LastSent time.Time `json:"last_sent,omitempty"`
+	Seq      uint64    `json:"seq"`
+
+	// QueueDepth is the number of updates the map session of the node
+	// has not picked up yet, a full queue means it is stuck.
+	QueueDepth int `json:"queue_depth"`
+	QueueSize  int `json:"queue_size"`
+}
+
+// recordSent records that an update was put on the channel of a node.
+// The caller must hold n.l.
+func (n *Notifier) recordSent(nodeID types.NodeID) {
+	if stats, ok := n.stats[nodeID]; ok {
+		stats.lastSent = time.Now()
+		stats.seq++
+	}
+}
+
+// Debug returns the state of the notifier and its batcher, nodes are
+// sorted by ID.
+func (n *Notifier) Debug() DebugInfo {
+	now := time.Now()
+	info := DebugInfo{
+		Time:          now,
+		BatchInterval: n.cfg.Tuning.BatchChangeDelay,
+	}
+
+	notifierWaitersForLock.WithLabelValues("lock", "debug").Inc()
+	n.l.Lock()
+	notifierWaitersForLock.WithLabelValues("lock", "debug").Dec()
+
+	for nodeID, stats := range n.stats {
+		node := NodeDebugInfo{
+			ID:             nodeID,
+			Connections:    stats.connections,
+			ConnectedAt:    stats.connectedAt,
+			DisconnectedAt: stats.disconnectedAt,
+			LastSent:       stats.lastSent,
+			Seq:            stats.seq,
+		}
+
+		if c, ok := n.nodes[nodeID]; ok {
+			node.Connected = true
+			node.ConnectedFor = now.Sub(stats.connectedAt)
+			node.QueueDepth = len(c)
+			node.QueueSize = cap(c)
+		}
+
+		info.Nodes = append(info.Nodes, node)
+	}
+	n.l.Unlock()
+
+	sort.Slice(info.Nodes, func(i, j int) bool {
+		return info.Nodes[i].ID < info.Nodes[j].ID
+	})
+
+	info.PendingChanges, info.PendingPatches = n.b.pending()
+
+	return info
+}
+
+// pending returns the nodes with changes and patches waiting for the
+// next flush, sorted by ID.
+func (b *batcher) pending() ([]types.NodeID, []types.NodeID) {
+	notifierBatcherWaitersForLock.WithLabelValues("lock", "debug").Inc()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	notifierBatcherWaitersForLock.WithLabelValues("lock", "debug").Dec()
+
+	changes := b.changedNodeIDs.Slice().AsSlice()
+	patches := make([]types.NodeID, 0, len(b.patches))
+	for nodeID := range b.patches {
+		patches = append(patches, nodeID)
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i] < changes[j]
+	})
+	sort.Slice(patches, func(i, j int) bool {
+		return patches[i] < patches[j]
+	})
+
+	return changes, patches
+}
@@ -65,4 +65,45 @@ var (
 		Name:      "notifier_batcher_patches_pending",
 		Help:      "gauge of patches pending in the notifier batcher",
 	}, []string{})
+	notifierBatcherQueued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "notifier_batcher_queued_total",
+		Help:      "total count of updates queued in the notifier batcher, or passed through if not batched",
+	}, []string{"type", "batched"})
+	notifierBatcherFlushes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "notifier_batcher_flushes_total",
+		Help:      "total count of flushes of the notifier batcher which sent pending updates",
+	})
+	notifierBatcherDelayed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "notifier_batcher_delayed_total",
+		Help:      "total count of node changes kept for a later flush as the node changed less than the minimum interval ago",
+	})
+	notifierSendAllDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: prometheusNamespace,
+		Name:      "notifier_send_all_duration_seconds",
+		Help:      "histogram of time spent sending an update to all connected nodes",
+		Buckets:   []float64{0.001, 0.01, 0.1, 0.3, 0.5, 1, 3, 5, 10},
+	}, []string{"type"})
+	notifierSendTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "notifier_send_timeouts_total",
+		Help:      "total count of updates which timed out being sent to a node",
+	}, []string{"type"})
+	notifierStaleChannels = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "notifier_stale_channels_total",
+		Help:      "total count of stale channels of nodes which reconnected, closed when replaced or ignored when removed",
+	}, []string{"action"})
+	changeBusDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "change_bus_dropped_total",
+		Help:      "total count of changes not sent to the NATS or Redis change bus, because its queue was full or sending failed",
+	}, []string{"reason"})
+	changeBusRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "change_bus_rejected_total",
+		Help:      "total count of changes received from the NATS or Redis change bus which were not signed with a cluster key",
+	})
 )
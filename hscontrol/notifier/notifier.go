@@ -6,17 +6,35 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
 	"github.com/puzpuzpuz/xsync/v3"
-	"github.com/rs/zerolog/log"
 	"github.com/sasha-s/go-deadlock"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"tailscale.com/envknob"
 	"tailscale.com/tailcfg"
 	"tailscale.com/util/set"
 )
 
+// drainPollInterval is how often draining checks if the nodes have
+// disconnected.
+const drainPollInterval = 50 * time.Millisecond
+
+// maxBatchLinks is the number of updates of a batch whose traces are
+// linked to the span of the batch.
+const maxBatchLinks = 128
+
+// tracerName is the name of the tracer creating the spans which follow
+// the updates from the moment they are sent to the notifier until they
+// are on the channels of the nodes.
+const tracerName = "github.com/juanfont/headscale/hscontrol/notifier"
+
 var debugDeadlock = envknob.Bool("HEADSCALE_DEBUG_DEADLOCK")
 var debugDeadlockTimeout = envknob.RegisterDuration("HEADSCALE_DEBUG_DEADLOCK_TIMEOUT")
 
@@ -34,13 +52,30 @@ type Notifier struct {
 	connected *xsync.MapOf[types.NodeID, bool]
 	b         *batcher
 	cfg       *types.Config
+	changes   *changeLog
+	stats     map[types.NodeID]*nodeStats
+
+	// remote are the nodes connected to the other instances, with HA.
+	remote *xsync.MapOf[types.NodeID, bool]
+	bus    ChangeBus
+
+	// draining is set when headscale shuts down, new updates are
+	// dropped as the nodes are about to be disconnected.
+	draining atomic.Bool
+
+	tracer trace.Tracer
 }
 
 func NewNotifier(cfg *types.Config) *Notifier {
 	n := &Notifier{
 		nodes:     make(map[types.NodeID]chan<- types.StateUpdate),
 		connected: xsync.NewMapOf[types.NodeID, bool](),
+		remote:    xsync.NewMapOf[types.NodeID, bool](),
+		bus:       NewLocalBus(),
 		cfg:       cfg,
+		changes:   newChangeLog(cfg.Tuning.NotifierChangeLogSize, cfg.Tuning.NotifierChangeLogPath),
+		stats:     make(map[types.NodeID]*nodeStats),
+		tracer:    otel.Tracer(tracerName),
 	}
 	b := newBatcher(cfg.Tuning.BatchChangeDelay, n)
 	n.b = b
@@ -49,13 +84,51 @@ func NewNotifier(cfg *types.Config) *Notifier {
 	return n
 }
 
-// Close stops the batcher inside the notifier.
+// Close stops the batcher inside the notifier, pending changes are
+// not sent.
 func (n *Notifier) Close() {
 	n.b.close()
 }
 
+// Drain stops accepting updates, sends the pending changes of the
+// batcher and tells the connected nodes that headscale is going away.
+// It waits for the nodes to disconnect until ctx is done, and stops
+// the batcher.
+func (n *Notifier) Drain(ctx context.Context) error {
+	defer n.b.close()
+
+	n.draining.Store(true)
+	n.b.flush()
+	n.sendAll(types.StateUpdate{Type: types.StateGoingAway})
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for {
+		n.l.Lock()
+		remaining := len(n.nodes)
+		n.l.Unlock()
+
+		if remaining == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d nodes still connected: %w", remaining, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// IsDraining reports if the notifier is draining as headscale is
+// shutting down.
+func (n *Notifier) IsDraining() bool {
+	return n.draining.Load()
+}
+
 func (n *Notifier) tracef(nID types.NodeID, msg string, args ...any) {
-	log.Trace().
+	util.LogBatcher.Trace().
 		Uint64("node.id", nID.Uint64()).
 		Int("open_chans", len(n.nodes)).Msgf(msg, args...)
 }
@@ -73,11 +146,21 @@ func (n *Notifier) AddNode(nodeID types.NodeID, c chan<- types.StateUpdate) {
 	if curr, ok := n.nodes[nodeID]; ok {
 		n.tracef(nodeID, "channel present, closing and replacing")
 		close(curr)
+		notifierStaleChannels.WithLabelValues("replaced").Inc()
 	}
 
 	n.nodes[nodeID] = c
 	n.connected.Store(nodeID, true)
 
+	stats, ok := n.stats[nodeID]
+	if !ok {
+		stats = &nodeStats{}
+		n.stats[nodeID] = stats
+	}
+	stats.connections++
+	stats.connectedAt = time.Now()
+	stats.seq = 0
+
 	n.tracef(nodeID, "added new channel")
 	notifierNodeUpdateChans.Inc()
 }
@@ -103,12 +186,16 @@ func (n *Notifier) RemoveNode(nodeID types.NodeID, c chan<- types.StateUpdate) b
 	if curr, ok := n.nodes[nodeID]; ok {
 		if curr != c {
 			n.tracef(nodeID, "channel has been replaced, not removing")
+			notifierStaleChannels.WithLabelValues("ignored").Inc()
 			return false
 		}
 	}
 
 	delete(n.nodes, nodeID)
 	n.connected.Store(nodeID, false)
+	if stats, ok := n.stats[nodeID]; ok {
+		stats.disconnectedAt = time.Now()
+	}
 
 	n.tracef(nodeID, "removed channel")
 	notifierNodeUpdateChans.Dec()
@@ -124,23 +211,165 @@ func (n *Notifier) IsConnected(nodeID types.NodeID) bool {
 	defer n.l.Unlock()
 	notifierWaitersForLock.WithLabelValues("lock", "conncheck").Dec()
 
-	if val, ok := n.connected.Load(nodeID); ok {
-		return val
+	if val, ok := n.connected.Load(nodeID); ok && val {
+		return true
 	}
-	return false
+
+	return n.isRemoteConnected(nodeID)
 }
 
 // IsLikelyConnected reports if a node is connected to headscale and has a
 // poll session open, but doesnt lock, so might be wrong.
 func (n *Notifier) IsLikelyConnected(nodeID types.NodeID) bool {
-	if val, ok := n.connected.Load(nodeID); ok {
-		return val
+	if val, ok := n.connected.Load(nodeID); ok && val {
+		return true
 	}
-	return false
+
+	return n.isRemoteConnected(nodeID)
 }
 
+// LikelyConnectedMap returns the connected state of the nodes, the nodes
+// connected to other instances are included with HA.
 func (n *Notifier) LikelyConnectedMap() *xsync.MapOf[types.NodeID, bool] {
-	return n.connected
+	if n.remote.Size() == 0 {
+		return n.connected
+	}
+
+	merged := xsync.NewMapOf[types.NodeID, bool]()
+	n.connected.Range(func(nodeID types.NodeID, val bool) bool {
+		merged.Store(nodeID, val)
+		return true
+	})
+	n.remote.Range(func(nodeID types.NodeID, _ bool) bool {
+		merged.Store(nodeID, true)
+		return true
+	})
+
+	return merged
+}
+
+// Connection is when a node last connected to this instance, and when
+// it last disconnected from it.
+type Connection struct {
+	ConnectedAt    time.Time
+	DisconnectedAt time.Time
+}
+
+// Connection returns the last connection of a node to this instance.
+func (n *Notifier) Connection(nodeID types.NodeID) Connection {
+	notifierWaitersForLock.WithLabelValues("lock", "connections").Inc()
+	n.l.Lock()
+	defer n.l.Unlock()
+	notifierWaitersForLock.WithLabelValues("lock", "connections").Dec()
+
+	stats, ok := n.stats[nodeID]
+	if !ok {
+		return Connection{}
+	}
+
+	return Connection{
+		ConnectedAt:    stats.connectedAt,
+		DisconnectedAt: stats.disconnectedAt,
+	}
+}
+
+// Connections returns the last connection of the nodes which have
+// connected to this instance since it started.
+func (n *Notifier) Connections() map[types.NodeID]Connection {
+	notifierWaitersForLock.WithLabelValues("lock", "connections").Inc()
+	n.l.Lock()
+	defer n.l.Unlock()
+	notifierWaitersForLock.WithLabelValues("lock", "connections").Dec()
+
+	conns := make(map[types.NodeID]Connection, len(n.stats))
+	for nodeID, stats := range n.stats {
+		conns[nodeID] = Connection{
+			ConnectedAt:    stats.connectedAt,
+			DisconnectedAt: stats.disconnectedAt,
+		}
+	}
+
+	return conns
+}
+
+// LocalConnectedNodes returns the nodes connected to this instance,
+// sorted by ID.
+func (n *Notifier) LocalConnectedNodes() []types.NodeID {
+	var nodeIDs []types.NodeID
+	n.connected.Range(func(nodeID types.NodeID, val bool) bool {
+		if val {
+			nodeIDs = append(nodeIDs, nodeID)
+		}
+		return true
+	})
+	sort.Slice(nodeIDs, func(i, j int) bool { return nodeIDs[i] < nodeIDs[j] })
+
+	return nodeIDs
+}
+
+func (n *Notifier) isRemoteConnected(nodeID types.NodeID) bool {
+	_, ok := n.remote.Load(nodeID)
+
+	return ok
+}
+
+// SetRemoteConnected replaces the nodes connected to the other
+// headscale instances sharing the database.
+func (n *Notifier) SetRemoteConnected(nodeIDs []types.NodeID) {
+	current := make(map[types.NodeID]bool, len(nodeIDs))
+	for _, nodeID := range nodeIDs {
+		current[nodeID] = true
+		n.remote.Store(nodeID, true)
+	}
+
+	n.remote.Range(func(nodeID types.NodeID, _ bool) bool {
+		if !current[nodeID] {
+			n.remote.Delete(nodeID)
+		}
+		return true
+	})
+}
+
+// Bus returns the bus the updates sent through the notifier are
+// published on.
+func (n *Notifier) Bus() ChangeBus {
+	return n.bus
+}
+
+// SetBus replaces the in-process bus, it must be set before the
+// notifier is used. The updates received from the other instances or
+// external components through the bus are sent to the nodes connected
+// to this instance.
+func (n *Notifier) SetBus(bus ChangeBus) {
+	n.bus = bus
+	bus.Subscribe(n.notifyRemote)
+}
+
+// notifyRemote sends an update received through the bus to the nodes
+// connected to this instance, unless it was delivered already.
+func (n *Notifier) notifyRemote(event ChangeEvent) {
+	if !event.Remote || event.Delivered {
+		return
+	}
+
+	ctx := types.NotifyCtx(context.Background(), "change-bus", event.Origin)
+	n.NotifyRelayed(ctx, event.Update, event.NodeID)
+}
+
+// NotifyRelayed sends an update published by another instance to the
+// nodes connected to this one, without publishing it on the bus.
+func (n *Notifier) NotifyRelayed(
+	ctx context.Context,
+	update types.StateUpdate,
+	nodeID types.NodeID,
+) {
+	if nodeID == 0 {
+		n.notifyAll(ctx, update)
+
+		return
+	}
+
+	n.notifyNode(ctx, update, nodeID)
 }
 
 func (n *Notifier) NotifyAll(ctx context.Context, update types.StateUpdate) {
@@ -152,7 +381,39 @@ func (n *Notifier) NotifyWithIgnore(
 	update types.StateUpdate,
 	ignoreNodeIDs ...types.NodeID,
 ) {
+	n.notifyAll(ctx, update)
+
+	n.bus.Publish(ChangeEvent{
+		Update: update,
+		Origin: types.NotifyOriginKey.Value(ctx),
+	})
+}
+
+func (n *Notifier) notifyAll(ctx context.Context, update types.StateUpdate) {
+	ctx, span := n.tracer.Start(ctx, "notifier.notify", trace.WithAttributes(
+		attribute.String("update.type", update.Type.String()),
+		attribute.String("origin", types.NotifyOriginKey.Value(ctx)),
+		attribute.Bool("interactive", update.Interactive),
+	))
+	defer span.End()
+	update.SpanContext = span.SpanContext()
+
 	notifierUpdateReceived.WithLabelValues(update.Type.String(), types.NotifyOriginKey.Value(ctx)).Inc()
+	if n.draining.Load() {
+		util.LogBatcher.Debug().
+			Any("origin", types.NotifyOriginKey.Value(ctx)).
+			Msgf("update %s dropped, notifier is draining", update.Type.String())
+		span.AddEvent("dropped, notifier is draining")
+
+		return
+	}
+
+	n.changes.add(newChangeLogEntry(
+		types.NotifyOriginKey.Value(ctx),
+		types.NotifyHostnameKey.Value(ctx),
+		update,
+		0,
+	))
 	n.b.addOrPassthrough(update)
 }
 
@@ -161,6 +422,48 @@ func (n *Notifier) NotifyByNodeID(
 	update types.StateUpdate,
 	nodeID types.NodeID,
 ) {
+	delivered := n.notifyNode(ctx, update, nodeID)
+
+	n.bus.Publish(ChangeEvent{
+		Update:    update,
+		NodeID:    nodeID,
+		Delivered: delivered,
+		Origin:    types.NotifyOriginKey.Value(ctx),
+	})
+}
+
+// notifyNode sends the update to the node, and reports if the node is
+// connected to this instance.
+func (n *Notifier) notifyNode(
+	ctx context.Context,
+	update types.StateUpdate,
+	nodeID types.NodeID,
+) bool {
+	ctx, span := n.tracer.Start(ctx, "notifier.notify_node", trace.WithAttributes(
+		attribute.String("update.type", update.Type.String()),
+		attribute.String("origin", types.NotifyOriginKey.Value(ctx)),
+		attribute.Int64("node.id", int64(nodeID)),
+	))
+	defer span.End()
+	update.SpanContext = span.SpanContext()
+
+	if n.draining.Load() {
+		util.LogBatcher.Debug().
+			Uint64("node.id", nodeID.Uint64()).
+			Any("origin", types.NotifyOriginKey.Value(ctx)).
+			Msgf("update %s dropped, notifier is draining", update.Type.String())
+		span.AddEvent("dropped, notifier is draining")
+
+		return true
+	}
+
+	n.changes.add(newChangeLogEntry(
+		types.NotifyOriginKey.Value(ctx),
+		types.NotifyHostnameKey.Value(ctx),
+		update,
+		nodeID,
+	))
+
 	start := time.Now()
 	notifierWaitersForLock.WithLabelValues("lock", "notify").Inc()
 	n.l.Lock()
@@ -171,20 +474,21 @@ func (n *Notifier) NotifyByNodeID(
 	if c, ok := n.nodes[nodeID]; ok {
 		select {
 		case <-ctx.Done():
-			log.Error().
+			util.LogBatcher.Error().
 				Err(ctx.Err()).
 				Uint64("node.id", nodeID.Uint64()).
 				Any("origin", types.NotifyOriginKey.Value(ctx)).
 				Any("origin-hostname", types.NotifyHostnameKey.Value(ctx)).
 				Msgf("update not sent, context cancelled")
+			span.SetStatus(codes.Error, "update not sent, context cancelled")
+			notifierSendTimeouts.WithLabelValues(update.Type.String()).Inc()
 			if debugHighCardinalityMetrics {
 				notifierUpdateSent.WithLabelValues("cancelled", update.Type.String(), types.NotifyOriginKey.Value(ctx), nodeID.String()).Inc()
 			} else {
 				notifierUpdateSent.WithLabelValues("cancelled", update.Type.String(), types.NotifyOriginKey.Value(ctx)).Inc()
 			}
-
-			return
 		case c <- update:
+			n.recordSent(nodeID)
 			n.tracef(nodeID, "update successfully sent on chan, origin: %s, origin-hostname: %s", ctx.Value("origin"), ctx.Value("hostname"))
 			if debugHighCardinalityMetrics {
 				notifierUpdateSent.WithLabelValues("ok", update.Type.String(), types.NotifyOriginKey.Value(ctx), nodeID.String()).Inc()
@@ -192,16 +496,33 @@ func (n *Notifier) NotifyByNodeID(
 				notifierUpdateSent.WithLabelValues("ok", update.Type.String(), types.NotifyOriginKey.Value(ctx)).Inc()
 			}
 		}
+
+		return true
 	}
+	span.AddEvent("node not connected")
+
+	return false
 }
 
 func (n *Notifier) sendAll(update types.StateUpdate) {
+	_, span := n.tracer.Start(
+		trace.ContextWithSpanContext(context.Background(), update.SpanContext),
+		"notifier.send_all",
+		trace.WithAttributes(attribute.String("update.type", update.Type.String())),
+	)
+	defer span.End()
+	update.SpanContext = span.SpanContext()
+
 	start := time.Now()
+	defer func() {
+		notifierSendAllDuration.WithLabelValues(update.Type.String()).Observe(time.Since(start).Seconds())
+	}()
 	notifierWaitersForLock.WithLabelValues("lock", "send-all").Inc()
 	n.l.Lock()
 	defer n.l.Unlock()
 	notifierWaitersForLock.WithLabelValues("lock", "send-all").Dec()
 	notifierWaitForLock.WithLabelValues("send-all").Observe(time.Since(start).Seconds())
+	span.SetAttributes(attribute.Int("nodes", len(n.nodes)))
 
 	for id, c := range n.nodes {
 		// Whenever an update is sent to all nodes, there is a chance that the node
@@ -215,10 +536,15 @@ func (n *Notifier) sendAll(update types.StateUpdate) {
 		defer cancel()
 		select {
 		case <-ctx.Done():
-			log.Error().
+			util.LogBatcher.Error().
 				Err(ctx.Err()).
 				Uint64("node.id", id.Uint64()).
 				Msgf("update not sent, context cancelled")
+			span.SetStatus(codes.Error, "update not sent, context cancelled")
+			span.AddEvent("send timeout", trace.WithAttributes(
+				attribute.Int64("node.id", int64(id)),
+			))
+			notifierSendTimeouts.WithLabelValues(update.Type.String()).Inc()
 			if debugHighCardinalityMetrics {
 				notifierUpdateSent.WithLabelValues("cancelled", update.Type.String(), "send-all", id.String()).Inc()
 			} else {
@@ -227,6 +553,7 @@ func (n *Notifier) sendAll(update types.StateUpdate) {
 
 			return
 		case c <- update:
+			n.recordSent(id)
 			if debugHighCardinalityMetrics {
 				notifierUpdateSent.WithLabelValues("ok", update.Type.String(), "send-all", id.String()).Inc()
 			} else {
@@ -236,6 +563,25 @@ func (n *Notifier) sendAll(update types.StateUpdate) {
 	}
 }
 
+// Flush sends the batched changes to the nodes immediately instead of
+// waiting for the next batch.
+func (n *Notifier) Flush() {
+	n.b.flush()
+}
+
+// Changes returns the most recent state updates received by the
+// notifier, oldest first.
+func (n *Notifier) Changes() []ChangeLogEntry {
+	return n.changes.list()
+}
+
+// SaveChanges writes the change log to batcher.change_log_path, so it
+// is loaded again when headscale starts. It does nothing if the path is
+// not set.
+func (n *Notifier) SaveChanges() error {
+	return n.changes.save()
+}
+
 func (n *Notifier) String() string {
 	notifierWaitersForLock.WithLabelValues("lock", "string").Inc()
 	n.l.Lock()
@@ -272,6 +618,8 @@ func (n *Notifier) String() string {
 type batcher struct {
 	tick *time.Ticker
 
+	closeOnce sync.Once
+
 	mu sync.Mutex
 
 	cancelCh chan struct{}
@@ -281,6 +629,15 @@ type batcher struct {
 	patches        map[types.NodeID]tailcfg.PeerChange
 	patchesChanged bool
 
+	// minInterval is the minimum time between two flushes sending the
+	// changes of a node, lastSent is when they were last sent.
+	minInterval time.Duration
+	lastSent    map[types.NodeID]time.Time
+
+	// links are the traces of the batched updates, the span of the
+	// flush sending them is linked to them.
+	links []trace.Link
+
 	n *Notifier
 }
 
@@ -290,12 +647,17 @@ func newBatcher(batchTime time.Duration, n *Notifier) *batcher {
 		cancelCh: make(chan struct{}),
 		patches:  make(map[types.NodeID]tailcfg.PeerChange),
 		n:        n,
+
+		minInterval: n.cfg.Tuning.NodeMinInterval,
+		lastSent:    make(map[types.NodeID]time.Time),
 	}
 
 }
 
 func (b *batcher) close() {
-	b.cancelCh <- struct{}{}
+	b.closeOnce.Do(func() {
+		b.cancelCh <- struct{}{}
+	})
 }
 
 // addOrPassthrough adds the update to the batcher, if it is not a
@@ -306,13 +668,24 @@ func (b *batcher) addOrPassthrough(update types.StateUpdate) {
 	defer b.mu.Unlock()
 	notifierBatcherWaitersForLock.WithLabelValues("lock", "add").Dec()
 
+	if update.Interactive {
+		notifierBatcherQueued.WithLabelValues(update.Type.String(), "false").Inc()
+		b.fastTrack(update)
+
+		return
+	}
+
 	switch update.Type {
 	case types.StatePeerChanged:
+		notifierBatcherQueued.WithLabelValues(update.Type.String(), "true").Inc()
+		b.addLink(update.SpanContext)
 		b.changedNodeIDs.Add(update.ChangeNodes...)
 		b.nodesChanged = true
 		notifierBatcherChanges.WithLabelValues().Set(float64(b.changedNodeIDs.Len()))
 
 	case types.StatePeerChangedPatch:
+		notifierBatcherQueued.WithLabelValues(update.Type.String(), "true").Inc()
+		b.addLink(update.SpanContext)
 		for _, newPatch := range update.ChangePatches {
 			if curr, ok := b.patches[types.NodeID(newPatch.NodeID)]; ok {
 				overwritePatch(&curr, newPatch)
@@ -325,39 +698,126 @@ func (b *batcher) addOrPassthrough(update types.StateUpdate) {
 		notifierBatcherPatches.WithLabelValues().Set(float64(len(b.patches)))
 
 	default:
+		notifierBatcherQueued.WithLabelValues(update.Type.String(), "false").Inc()
 		b.n.sendAll(update)
 	}
 }
 
+// addLink records the trace of a batched update. The caller must hold
+// b.mu.
+func (b *batcher) addLink(sc trace.SpanContext) {
+	if !sc.IsValid() || len(b.links) >= maxBatchLinks {
+		return
+	}
+
+	b.links = append(b.links, trace.Link{SpanContext: sc})
+}
+
+// fastTrack sends an interactive update immediately, removing any pending
+// batched work for the same nodes so it is not sent again, or older patches
+// overwriting the newer state. The caller must hold b.mu.
+func (b *batcher) fastTrack(update types.StateUpdate) {
+	switch update.Type {
+	case types.StatePeerChanged:
+		// The full node is sent now, so pending changes and
+		// patches for the node are included.
+		for _, nodeID := range update.ChangeNodes {
+			b.changedNodeIDs.Remove(nodeID)
+			delete(b.patches, nodeID)
+		}
+		notifierBatcherChanges.WithLabelValues().Set(float64(b.changedNodeIDs.Len()))
+		notifierBatcherPatches.WithLabelValues().Set(float64(len(b.patches)))
+
+	case types.StatePeerChangedPatch:
+		// Merge the new patch on top of any pending patch for the
+		// node so the fields only present in the pending one are
+		// not lost.
+		patches := make([]*tailcfg.PeerChange, 0, len(update.ChangePatches))
+		for _, newPatch := range update.ChangePatches {
+			nodeID := types.NodeID(newPatch.NodeID)
+			if curr, ok := b.patches[nodeID]; ok {
+				overwritePatch(&curr, newPatch)
+				patches = append(patches, &curr)
+				delete(b.patches, nodeID)
+			} else {
+				patches = append(patches, newPatch)
+			}
+		}
+		update.ChangePatches = patches
+		notifierBatcherPatches.WithLabelValues().Set(float64(len(b.patches)))
+	}
+
+	b.n.sendAll(update)
+}
+
 // flush sends all the accumulated patches to all
 // nodes in the notifier.
 func (b *batcher) flush() {
+	b.flushNodes(true)
+}
+
+// flushNodes sends the accumulated changes to all nodes in the
+// notifier. Unless force is set, the changes of the nodes which were
+// sent less than minInterval ago are kept for a later flush.
+func (b *batcher) flushNodes(force bool) {
 	notifierBatcherWaitersForLock.WithLabelValues("lock", "flush").Inc()
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	notifierBatcherWaitersForLock.WithLabelValues("lock", "flush").Dec()
 
 	if b.nodesChanged || b.patchesChanged {
+		notifierBatcherFlushes.Inc()
+
+		_, span := b.n.tracer.Start(context.Background(), "notifier.batch.flush",
+			trace.WithNewRoot(),
+			trace.WithLinks(b.links...),
+			trace.WithAttributes(
+				attribute.Int("changes", b.changedNodeIDs.Len()),
+				attribute.Int("patches", len(b.patches)),
+			),
+		)
+		defer span.End()
+
+		now := time.Now()
+		delayed := func(nodeID types.NodeID) bool {
+			return !force && b.minInterval > 0 && now.Sub(b.lastSent[nodeID]) < b.minInterval
+		}
+
 		var patches []*tailcfg.PeerChange
+		heldPatches := make(map[types.NodeID]tailcfg.PeerChange)
 		// If a node is getting a full update from a change
 		// node update, then the patch can be dropped.
 		for nodeID, patch := range b.patches {
-			if b.changedNodeIDs.Contains(nodeID) {
-				delete(b.patches, nodeID)
-			} else {
+			switch {
+			case b.changedNodeIDs.Contains(nodeID):
+			case delayed(nodeID):
+				heldPatches[nodeID] = patch
+			default:
 				patches = append(patches, &patch)
+				b.lastSent[nodeID] = now
 			}
 		}
 
-		changedNodes := b.changedNodeIDs.Slice().AsSlice()
+		var changedNodes []types.NodeID
+		var heldNodes set.Slice[types.NodeID]
+		for _, nodeID := range b.changedNodeIDs.Slice().AsSlice() {
+			if delayed(nodeID) {
+				heldNodes.Add(nodeID)
+			} else {
+				changedNodes = append(changedNodes, nodeID)
+				b.lastSent[nodeID] = now
+			}
+		}
 		sort.Slice(changedNodes, func(i, j int) bool {
 			return changedNodes[i] < changedNodes[j]
 		})
+		notifierBatcherDelayed.Add(float64(heldNodes.Len() + len(heldPatches)))
 
-		if b.changedNodeIDs.Slice().Len() > 0 {
+		if len(changedNodes) > 0 {
 			update := types.StateUpdate{
 				Type:        types.StatePeerChanged,
 				ChangeNodes: changedNodes,
+				SpanContext: span.SpanContext(),
 			}
 
 			b.n.sendAll(update)
@@ -367,17 +827,26 @@ func (b *batcher) flush() {
 			patchUpdate := types.StateUpdate{
 				Type:          types.StatePeerChangedPatch,
 				ChangePatches: patches,
+				SpanContext:   span.SpanContext(),
 			}
 
 			b.n.sendAll(patchUpdate)
 		}
 
-		b.changedNodeIDs = set.Slice[types.NodeID]{}
-		notifierBatcherChanges.WithLabelValues().Set(0)
-		b.nodesChanged = false
-		b.patches = make(map[types.NodeID]tailcfg.PeerChange, len(b.patches))
-		notifierBatcherPatches.WithLabelValues().Set(0)
-		b.patchesChanged = false
+		b.changedNodeIDs = heldNodes
+		notifierBatcherChanges.WithLabelValues().Set(float64(heldNodes.Len()))
+		b.nodesChanged = heldNodes.Len() > 0
+		b.patches = heldPatches
+		notifierBatcherPatches.WithLabelValues().Set(float64(len(heldPatches)))
+		b.patchesChanged = len(heldPatches) > 0
+		b.links = nil
+
+		// Only the nodes sent within minInterval are needed.
+		for nodeID, sent := range b.lastSent {
+			if now.Sub(sent) >= b.minInterval {
+				delete(b.lastSent, nodeID)
+			}
+		}
 	}
 }
 
@@ -387,7 +856,7 @@ func (b *batcher) doWork() {
 		case <-b.cancelCh:
 			return
 		case <-b.tick.C:
-			b.flush()
+			b.flushNodes(false)
 		}
 	}
 }
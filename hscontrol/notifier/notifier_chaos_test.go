@@ -0,0 +1,254 @@
+package notifier
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+// chaosSession is a poll session consuming updates from the notifier,
+// like the map sessions in poll.go.
+type chaosSession struct {
+	ch   chan types.StateUpdate
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startChaosSession(n *Notifier, nodeID types.NodeID) *chaosSession {
+	s := &chaosSession{
+		ch:   make(chan types.StateUpdate, 8),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(s.done)
+		for {
+			select {
+			case _, ok := <-s.ch:
+				// The channel is closed when the session is
+				// replaced by a new one for the same node.
+				if !ok {
+					return
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+
+	n.AddNode(nodeID, s.ch)
+
+	return s
+}
+
+// end stops consuming updates and drains what was sent before the
+// session was removed from the notifier.
+func (s *chaosSession) end() {
+	close(s.stop)
+	<-s.done
+
+	for len(s.ch) > 0 {
+		<-s.ch
+	}
+}
+
+// TestNotifierChaos hammers the notifier with concurrent poll sessions
+// and updates from many goroutines, and checks the guarantees the rest
+// of headscale relies on:
+//   - a session removing itself is never lost, and a session which has
+//     been replaced cannot remove the newer one,
+//   - the connected state of a node follows the order of its sessions,
+//   - nothing is sent on a channel after it has been removed, and
+//     nothing is sent after the notifier is closed,
+//   - the batched work is bounded by the number of nodes.
+func TestNotifierChaos(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping chaos test in short mode")
+	}
+
+	const (
+		nodeCount       = 100
+		sessionsPerNode = 50
+		updaterCount    = 200
+		updatesPerRound = 100
+		changeLogSize   = 64
+		batchChangeTime = time.Millisecond
+	)
+
+	n := NewNotifier(&types.Config{
+		Tuning: types.Tuning{
+			BatchChangeDelay:      batchChangeTime,
+			NotifierSendTimeout:   time.Second,
+			NotifierChangeLogSize: changeLogSize,
+		},
+	})
+
+	var (
+		sessionsMu sync.Mutex
+		sessions   []*chaosSession
+	)
+
+	var wg sync.WaitGroup
+	for i := 1; i <= nodeCount; i++ {
+		nodeID := types.NodeID(i)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var prev *chaosSession
+			for range sessionsPerNode {
+				next := startChaosSession(n, nodeID)
+				sessionsMu.Lock()
+				sessions = append(sessions, next)
+				sessionsMu.Unlock()
+
+				if !n.IsConnected(nodeID) {
+					t.Errorf("node %d: not connected after adding session", nodeID)
+				}
+
+				// The previous session notices it was replaced and
+				// ends, which must not disconnect the node.
+				if prev != nil {
+					if n.RemoveNode(nodeID, prev.ch) {
+						t.Errorf("node %d: replaced session removed the new session", nodeID)
+					}
+					prev.end()
+
+					if !n.IsConnected(nodeID) {
+						t.Errorf("node %d: not connected after replaced session ended", nodeID)
+					}
+					prev = nil
+				}
+
+				// Either the session ends before the next one
+				// starts, or the next one replaces it.
+				if rand.IntN(2) == 0 {
+					if !n.RemoveNode(nodeID, next.ch) {
+						t.Errorf("node %d: session was not removed", nodeID)
+					}
+					next.end()
+
+					if n.IsConnected(nodeID) {
+						t.Errorf("node %d: connected after session was removed", nodeID)
+					}
+				} else {
+					prev = next
+				}
+			}
+
+			if prev != nil {
+				if !n.RemoveNode(nodeID, prev.ch) {
+					t.Errorf("node %d: last session was not removed", nodeID)
+				}
+				prev.end()
+			}
+		}()
+	}
+
+	for range updaterCount {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for range updatesPerRound {
+				nodeID := types.NodeID(rand.IntN(nodeCount) + 1)
+
+				var update types.StateUpdate
+				switch rand.IntN(4) {
+				case 0:
+					update = types.StateUpdate{
+						Type:        types.StatePeerChanged,
+						ChangeNodes: []types.NodeID{nodeID},
+					}
+				case 1:
+					update = types.StateUpdate{
+						Type: types.StatePeerChangedPatch,
+						ChangePatches: []*tailcfg.PeerChange{
+							{
+								NodeID:     nodeID.NodeID(),
+								DERPRegion: rand.IntN(10) + 1,
+							},
+						},
+					}
+				case 2:
+					update = types.StateUpdate{
+						Type: types.StateFullUpdate,
+					}
+				case 3:
+					update = types.StateUpdate{
+						Type:        types.StatePeerChanged,
+						ChangeNodes: []types.NodeID{nodeID},
+						Interactive: true,
+					}
+				}
+
+				n.NotifyAll(context.Background(), update)
+
+				// Pending work never grows past the nodes it
+				// refers to.
+				n.b.mu.Lock()
+				changes, patches := n.b.changedNodeIDs.Len(), len(n.b.patches)
+				n.b.mu.Unlock()
+				if changes > nodeCount || patches > nodeCount {
+					t.Errorf("batcher has %d changes and %d patches pending for %d nodes", changes, patches, nodeCount)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	n.l.Lock()
+	chans := len(n.nodes)
+	n.l.Unlock()
+	if chans != 0 {
+		t.Errorf("expected no channels after all sessions ended, got %d", chans)
+	}
+
+	for i := 1; i <= nodeCount; i++ {
+		if n.IsConnected(types.NodeID(i)) {
+			t.Errorf("node %d: connected after all sessions ended", i)
+		}
+	}
+
+	if changes := len(n.Changes()); changes > changeLogSize {
+		t.Errorf("change log has %d entries, want at most %d", changes, changeLogSize)
+	}
+
+	n.b.flush()
+	n.b.mu.Lock()
+	if n.b.changedNodeIDs.Len() != 0 || len(n.b.patches) != 0 {
+		t.Errorf("batcher has pending work after flush")
+	}
+	n.b.mu.Unlock()
+
+	// Once closed, the batched work is no longer sent.
+	n.Close()
+
+	closed := make(chan types.StateUpdate, 8)
+	n.AddNode(1, closed)
+	n.NotifyAll(context.Background(), types.StateUpdate{
+		Type:        types.StatePeerChanged,
+		ChangeNodes: []types.NodeID{2},
+	})
+	time.Sleep(10 * batchChangeTime)
+	if len(closed) != 0 {
+		t.Errorf("update sent after the notifier was closed")
+	}
+	n.RemoveNode(1, closed)
+
+	// Every session drained its channel when it ended, anything in it
+	// now was sent after the session was removed.
+	for _, s := range sessions {
+		if len(s.ch) != 0 {
+			t.Errorf("%d updates sent to a session after it was removed", len(s.ch))
+		}
+	}
+}
@@ -2,6 +2,7 @@ package notifier
 
 import (
 	"context"
+	"errors"
 	"net/netip"
 	"sort"
 	"testing"
@@ -10,6 +11,11 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 	"tailscale.com/tailcfg"
 )
 
@@ -213,6 +219,76 @@ func TestBatcher(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "interactive-node-update-skips-batch",
+			updates: []types.StateUpdate{
+				{
+					Type: types.StatePeerChanged,
+					ChangeNodes: []types.NodeID{
+						2, 3,
+					},
+				},
+				{
+					Type: types.StatePeerChanged,
+					ChangeNodes: []types.NodeID{
+						2,
+					},
+					Interactive: true,
+				},
+			},
+			want: []types.StateUpdate{
+				{
+					Type: types.StatePeerChanged,
+					ChangeNodes: []types.NodeID{
+						2,
+					},
+					Interactive: true,
+				},
+				{
+					Type: types.StatePeerChanged,
+					ChangeNodes: []types.NodeID{
+						3,
+					},
+				},
+			},
+		},
+		{
+			name: "interactive-patch-merges-pending",
+			updates: []types.StateUpdate{
+				{
+					Type: types.StatePeerChangedPatch,
+					ChangePatches: []*tailcfg.PeerChange{
+						{
+							NodeID:     2,
+							DERPRegion: 5,
+						},
+					},
+				},
+				{
+					Type: types.StatePeerChangedPatch,
+					ChangePatches: []*tailcfg.PeerChange{
+						{
+							NodeID: 2,
+							Cap:    tailcfg.CapabilityVersion(90),
+						},
+					},
+					Interactive: true,
+				},
+			},
+			want: []types.StateUpdate{
+				{
+					Type: types.StatePeerChangedPatch,
+					ChangePatches: []*tailcfg.PeerChange{
+						{
+							NodeID:     2,
+							DERPRegion: 5,
+							Cap:        tailcfg.CapabilityVersion(90),
+						},
+					},
+					Interactive: true,
+				},
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -263,3 +339,438 @@ func TestBatcher(t *testing.T) {
 		})
 	}
 }
+
+func TestBatcherNodeMinInterval(t *testing.T) {
+	n := NewNotifier(&types.Config{
+		Tuning: types.Tuning{
+			BatchChangeDelay:    time.Hour,
+			NotifierSendTimeout: time.Second,
+			NodeMinInterval:     time.Hour,
+		},
+	})
+
+	ch := make(chan types.StateUpdate, 30)
+	defer close(ch)
+	n.AddNode(1, ch)
+	defer n.RemoveNode(1, ch)
+
+	received := func() []types.StateUpdate {
+		var got []types.StateUpdate
+		for len(ch) > 0 {
+			got = append(got, <-ch)
+		}
+
+		return got
+	}
+
+	online := true
+	n.NotifyAll(context.Background(), types.StateUpdate{
+		Type:        types.StatePeerChanged,
+		ChangeNodes: []types.NodeID{2},
+	})
+	n.b.flushNodes(false)
+
+	want := []types.StateUpdate{
+		{
+			Type:        types.StatePeerChanged,
+			ChangeNodes: []types.NodeID{2},
+		},
+	}
+	if diff := cmp.Diff(want, received(), util.Comparers...); diff != "" {
+		t.Errorf("first change unexpected result (-want +got):\n%s", diff)
+	}
+
+	// Node 2 changed less than the interval ago, its changes are kept
+	// while the ones of node 3 are sent.
+	n.NotifyAll(context.Background(), types.StateUpdate{
+		Type:        types.StatePeerChanged,
+		ChangeNodes: []types.NodeID{2, 3},
+	})
+	n.NotifyAll(context.Background(), types.StateUpdate{
+		Type: types.StatePeerChangedPatch,
+		ChangePatches: []*tailcfg.PeerChange{
+			{NodeID: 2, Online: &online},
+		},
+	})
+	n.b.flushNodes(false)
+
+	want = []types.StateUpdate{
+		{
+			Type:        types.StatePeerChanged,
+			ChangeNodes: []types.NodeID{3},
+		},
+	}
+	if diff := cmp.Diff(want, received(), util.Comparers...); diff != "" {
+		t.Errorf("delayed change unexpected result (-want +got):\n%s", diff)
+	}
+
+	// Interactive updates are not delayed.
+	n.NotifyAll(context.Background(), types.StateUpdate{
+		Type:        types.StatePeerChanged,
+		ChangeNodes: []types.NodeID{3},
+		Interactive: true,
+	})
+
+	want = []types.StateUpdate{
+		{
+			Type:        types.StatePeerChanged,
+			ChangeNodes: []types.NodeID{3},
+			Interactive: true,
+		},
+	}
+	if diff := cmp.Diff(want, received(), util.Comparers...); diff != "" {
+		t.Errorf("interactive change unexpected result (-want +got):\n%s", diff)
+	}
+
+	// Flushing sends the kept changes.
+	n.Flush()
+
+	want = []types.StateUpdate{
+		{
+			Type:        types.StatePeerChanged,
+			ChangeNodes: []types.NodeID{2},
+		},
+	}
+	if diff := cmp.Diff(want, received(), util.Comparers...); diff != "" {
+		t.Errorf("flushed change unexpected result (-want +got):\n%s", diff)
+	}
+}
+
+func TestNotifierMetrics(t *testing.T) {
+	n := NewNotifier(&types.Config{
+		Tuning: types.Tuning{
+			BatchChangeDelay:    time.Hour,
+			NotifierSendTimeout: 10 * time.Millisecond,
+		},
+	})
+	defer n.Close()
+
+	counter := func(c prometheus.Counter) float64 {
+		return testutil.ToFloat64(c)
+	}
+
+	queued := counter(notifierBatcherQueued.WithLabelValues(types.StatePeerChanged.String(), "true"))
+	flushes := counter(notifierBatcherFlushes)
+	timeouts := counter(notifierSendTimeouts.WithLabelValues(types.StatePeerChanged.String()))
+	replaced := counter(notifierStaleChannels.WithLabelValues("replaced"))
+	ignored := counter(notifierStaleChannels.WithLabelValues("ignored"))
+
+	stale := make(chan types.StateUpdate, 1)
+	n.AddNode(1, stale)
+
+	// The node reconnects, and the previous session goes away after.
+	ch := make(chan types.StateUpdate)
+	n.AddNode(1, ch)
+	n.RemoveNode(1, stale)
+	defer n.RemoveNode(1, ch)
+
+	n.NotifyAll(context.Background(), types.StateUpdate{
+		Type:        types.StatePeerChanged,
+		ChangeNodes: []types.NodeID{2},
+	})
+
+	// Nothing reads the channel of the node, so the send times out.
+	n.Flush()
+
+	if got := counter(notifierBatcherQueued.WithLabelValues(types.StatePeerChanged.String(), "true")) - queued; got != 1 {
+		t.Errorf("expected 1 queued change, got %v", got)
+	}
+	if got := counter(notifierBatcherFlushes) - flushes; got != 1 {
+		t.Errorf("expected 1 flush, got %v", got)
+	}
+	if got := counter(notifierSendTimeouts.WithLabelValues(types.StatePeerChanged.String())) - timeouts; got != 1 {
+		t.Errorf("expected 1 send timeout, got %v", got)
+	}
+	if got := counter(notifierStaleChannels.WithLabelValues("replaced")) - replaced; got != 1 {
+		t.Errorf("expected 1 replaced channel, got %v", got)
+	}
+	if got := counter(notifierStaleChannels.WithLabelValues("ignored")) - ignored; got != 1 {
+		t.Errorf("expected 1 ignored channel removal, got %v", got)
+	}
+}
+
+func TestNotifierDebug(t *testing.T) {
+	n := NewNotifier(&types.Config{
+		Tuning: types.Tuning{
+			BatchChangeDelay:    time.Hour,
+			NotifierSendTimeout: time.Second,
+		},
+	})
+	defer n.Close()
+
+	ch1 := make(chan types.StateUpdate, 10)
+	n.AddNode(1, ch1)
+	defer n.RemoveNode(1, ch1)
+
+	ch2 := make(chan types.StateUpdate, 10)
+	n.AddNode(2, ch2)
+	n.RemoveNode(2, ch2)
+
+	n.NotifyAll(context.Background(), types.StateUpdate{
+		Type: types.StateFullUpdate,
+	})
+	n.NotifyByNodeID(context.Background(), types.StateUpdate{
+		Type: types.StateSelfUpdate,
+	}, 1)
+	n.NotifyAll(context.Background(), types.StateUpdate{
+		Type:        types.StatePeerChanged,
+		ChangeNodes: []types.NodeID{3},
+	})
+	n.NotifyAll(context.Background(), types.StateUpdate{
+		Type: types.StatePeerChangedPatch,
+		ChangePatches: []*tailcfg.PeerChange{
+			{NodeID: 4, DERPRegion: 1},
+		},
+	})
+
+	got := n.Debug()
+
+	if len(got.Nodes) != 2 {
+		t.Fatalf("expected 2 nodes, got %d", len(got.Nodes))
+	}
+
+	connected := got.Nodes[0]
+	if !connected.Connected || connected.Connections != 1 || connected.Seq != 2 {
+		t.Errorf("unexpected connected node: %+v", connected)
+	}
+	if connected.QueueDepth != 2 || connected.QueueSize != 10 {
+		t.Errorf("expected a queue of 2/10, got %d/%d", connected.QueueDepth, connected.QueueSize)
+	}
+
+	disconnected := got.Nodes[1]
+	if disconnected.Connected || disconnected.Connections != 1 || disconnected.QueueSize != 0 {
+		t.Errorf("unexpected disconnected node: %+v", disconnected)
+	}
+
+	want := []types.NodeID{3}
+	if diff := cmp.Diff(want, got.PendingChanges); diff != "" {
+		t.Errorf("unexpected pending changes (-want +got):\n%s", diff)
+	}
+	want = []types.NodeID{4}
+	if diff := cmp.Diff(want, got.PendingPatches); diff != "" {
+		t.Errorf("unexpected pending patches (-want +got):\n%s", diff)
+	}
+}
+
+func TestNotifierConnections(t *testing.T) {
+	n := NewNotifier(&types.Config{
+		Tuning: types.Tuning{
+			BatchChangeDelay:    time.Hour,
+			NotifierSendTimeout: time.Second,
+		},
+	})
+	defer n.Close()
+
+	before := time.Now()
+
+	ch1 := make(chan types.StateUpdate, 1)
+	n.AddNode(1, ch1)
+	defer n.RemoveNode(1, ch1)
+
+	ch2 := make(chan types.StateUpdate, 1)
+	n.AddNode(2, ch2)
+	n.RemoveNode(2, ch2)
+
+	conns := n.Connections()
+	if len(conns) != 2 {
+		t.Fatalf("expected 2 connections, got %d", len(conns))
+	}
+
+	if conn := conns[1]; conn.ConnectedAt.Before(before) || !conn.DisconnectedAt.IsZero() {
+		t.Errorf("unexpected connection of the connected node: %+v", conn)
+	}
+
+	conn := conns[2]
+	if conn.DisconnectedAt.Before(conn.ConnectedAt) {
+		t.Errorf("unexpected connection of the disconnected node: %+v", conn)
+	}
+	if diff := cmp.Diff(conn, n.Connection(2)); diff != "" {
+		t.Errorf("unexpected connection (-want +got):\n%s", diff)
+	}
+
+	if conn := n.Connection(3); !conn.ConnectedAt.IsZero() {
+		t.Errorf("expected no connection for an unknown node, got %+v", conn)
+	}
+}
+
+func TestNotifierDrain(t *testing.T) {
+	n := NewNotifier(&types.Config{
+		Tuning: types.Tuning{
+			BatchChangeDelay:    time.Hour,
+			NotifierSendTimeout: time.Second,
+		},
+	})
+
+	ch := make(chan types.StateUpdate, 10)
+	n.AddNode(1, ch)
+
+	n.NotifyAll(context.Background(), types.StateUpdate{
+		Type:        types.StatePeerChanged,
+		ChangeNodes: []types.NodeID{2},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	drained := make(chan error)
+	go func() {
+		drained <- n.Drain(ctx)
+	}()
+
+	// The pending change is sent before the notice.
+	if got := <-ch; got.Type != types.StatePeerChanged {
+		t.Fatalf("expected the pending change, got %s", got.Type)
+	}
+	if got := <-ch; got.Type != types.StateGoingAway {
+		t.Fatalf("expected the going away notice, got %s", got.Type)
+	}
+
+	// Updates are no longer accepted.
+	n.NotifyAll(context.Background(), types.StateUpdate{Type: types.StateFullUpdate})
+	n.NotifyByNodeID(context.Background(), types.StateUpdate{Type: types.StateFullUpdate}, 1)
+	if len(ch) != 0 {
+		t.Fatalf("expected no updates while draining, got %d", len(ch))
+	}
+
+	select {
+	case err := <-drained:
+		t.Fatalf("drain returned before the node disconnected: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	n.RemoveNode(1, ch)
+
+	if err := <-drained; err != nil {
+		t.Fatalf("unexpected drain error: %s", err)
+	}
+}
+
+func TestNotifierDrainTimeout(t *testing.T) {
+	n := NewNotifier(&types.Config{
+		Tuning: types.Tuning{
+			BatchChangeDelay:    time.Hour,
+			NotifierSendTimeout: time.Second,
+		},
+	})
+
+	ch := make(chan types.StateUpdate, 10)
+	n.AddNode(1, ch)
+	defer n.RemoveNode(1, ch)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := n.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the drain to time out, got %v", err)
+	}
+
+	// Closing after draining does not block.
+	n.Close()
+}
+
+func TestNotifierBus(t *testing.T) {
+	n := NewNotifier(&types.Config{
+		Tuning: types.Tuning{
+			BatchChangeDelay:    time.Hour,
+			NotifierSendTimeout: time.Second,
+		},
+	})
+	defer n.Close()
+
+	var events []ChangeEvent
+	unsubscribe := n.Bus().Subscribe(func(event ChangeEvent) {
+		events = append(events, event)
+	})
+
+	ch := make(chan types.StateUpdate, 1)
+	n.AddNode(1, ch)
+	defer n.RemoveNode(1, ch)
+
+	ctx := types.NotifyCtx(context.Background(), "test", "host")
+	full := types.StateUpdate{Type: types.StateFullUpdate}
+	n.NotifyAll(ctx, full)
+	n.NotifyByNodeID(ctx, full, 1)
+	n.NotifyByNodeID(ctx, full, 2)
+
+	unsubscribe()
+	n.NotifyAll(ctx, full)
+
+	want := []ChangeEvent{
+		{Update: full, Origin: "test"},
+		{Update: full, NodeID: 1, Delivered: true, Origin: "test"},
+		{Update: full, NodeID: 2, Origin: "test"},
+	}
+	if diff := cmp.Diff(want, events); diff != "" {
+		t.Errorf("unexpected events (-want +got):\n%s", diff)
+	}
+}
+
+func TestNotifierTraces(t *testing.T) {
+	n := NewNotifier(&types.Config{
+		Tuning: types.Tuning{
+			BatchChangeDelay:    time.Hour,
+			NotifierSendTimeout: time.Second,
+		},
+	})
+	defer n.Close()
+
+	recorder := tracetest.NewSpanRecorder()
+	n.tracer = sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(recorder),
+	).Tracer(tracerName)
+
+	ch := make(chan types.StateUpdate, 1)
+	n.AddNode(1, ch)
+	defer n.RemoveNode(1, ch)
+
+	ctx := types.NotifyCtx(context.Background(), "test", "node")
+	n.NotifyAll(ctx, types.StateUpdate{
+		Type:        types.StatePeerChanged,
+		ChangeNodes: []types.NodeID{2},
+	})
+	n.NotifyAll(ctx, types.StateUpdate{
+		Type:        types.StatePeerChanged,
+		ChangeNodes: []types.NodeID{3},
+	})
+	n.Flush()
+
+	update := <-ch
+
+	spans := make(map[string][]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = append(spans[span.Name()], span)
+	}
+
+	notify := spans["notifier.notify"]
+	if len(notify) != 2 {
+		t.Fatalf("expected 2 notify spans, got %d", len(notify))
+	}
+	flush := spans["notifier.batch.flush"]
+	if len(flush) != 1 {
+		t.Fatalf("expected 1 flush span, got %d", len(flush))
+	}
+	sendAll := spans["notifier.send_all"]
+	if len(sendAll) != 1 {
+		t.Fatalf("expected 1 send all span, got %d", len(sendAll))
+	}
+
+	// The batch is linked to the traces of the updates it contains.
+	want := []trace.TraceID{
+		notify[0].SpanContext().TraceID(),
+		notify[1].SpanContext().TraceID(),
+	}
+	var got []trace.TraceID
+	for _, link := range flush[0].Links() {
+		got = append(got, link.SpanContext.TraceID())
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected flush links (-want +got):\n%s", diff)
+	}
+
+	if sendAll[0].Parent().SpanID() != flush[0].SpanContext().SpanID() {
+		t.Errorf("expected the send all span to be a child of the flush span")
+	}
+	if update.SpanContext.SpanID() != sendAll[0].SpanContext().SpanID() {
+		t.Errorf("expected the update to carry the send all span, got %s", update.SpanContext.SpanID())
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
+	"net/netip"
 	"strings"
 	"time"
 
@@ -18,6 +19,7 @@ import (
 	"github.com/juanfont/headscale/hscontrol/db"
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/juanfont/headscale/hscontrol/webhook"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/oauth2"
 	"gorm.io/gorm"
@@ -54,14 +56,14 @@ type IDTokenClaims struct {
 func (h *Headscale) initOIDC() error {
 	var err error
 	// grab oidc config if it hasn't been already
-	if h.oauth2Config == nil {
+	if h.oauth2Config.Load() == nil {
 		h.oidcProvider, err = oidc.NewProvider(context.Background(), h.cfg.OIDC.Issuer)
 
 		if err != nil {
 			return fmt.Errorf("creating OIDC provider from issuer config: %w", err)
 		}
 
-		h.oauth2Config = &oauth2.Config{
+		h.oauth2Config.Store(&oauth2.Config{
 			ClientID:     h.cfg.OIDC.ClientID,
 			ClientSecret: h.cfg.OIDC.ClientSecret,
 			Endpoint:     h.oidcProvider.Endpoint(),
@@ -70,7 +72,7 @@ func (h *Headscale) initOIDC() error {
 				strings.TrimSuffix(h.cfg.ServerURL, "/"),
 			),
 			Scopes: h.cfg.OIDC.Scope,
-		}
+		})
 	}
 
 	return nil
@@ -140,6 +142,10 @@ func (h *Headscale) RegisterOIDC(
 		registerCacheExpiration,
 	)
 
+	http.Redirect(writer, req, h.oidcAuthCodeURL(stateStr), http.StatusFound)
+}
+
+func (h *Headscale) oidcAuthCodeURL(state string) string {
 	// Add any extra parameter provided in the configuration to the Authorize Endpoint request
 	extras := make([]oauth2.AuthCodeOption, 0, len(h.cfg.OIDC.ExtraParams))
 
@@ -147,10 +153,10 @@ func (h *Headscale) RegisterOIDC(
 		extras = append(extras, oauth2.SetAuthURLParam(k, v))
 	}
 
-	authURL := h.oauth2Config.AuthCodeURL(stateStr, extras...)
+	authURL := h.oauth2Config.Load().AuthCodeURL(state, extras...)
 	log.Debug().Msgf("Redirecting to %s for authentication", authURL)
 
-	http.Redirect(writer, req, authURL, http.StatusFound)
+	return authURL
 }
 
 type oidcCallbackTemplateConfig struct {
@@ -179,7 +185,7 @@ func (h *Headscale) OIDCCallback(
 		return
 	}
 
-	rawIDToken, err := h.getIDTokenForOIDCCallback(req.Context(), writer, code, state)
+	oauth2Token, rawIDToken, err := h.getIDTokenForOIDCCallback(req.Context(), writer, code, state)
 	if err != nil {
 		return
 	}
@@ -214,32 +220,72 @@ func (h *Headscale) OIDCCallback(
 		return
 	}
 
+	// The user authenticated for a held SSH connection, not to register
+	// a node.
+	if cached, ok := h.registrationCache.Get(state); ok {
+		if checkID, ok := cached.(sshCheckOIDCState); ok {
+			h.registrationCache.Delete(state)
+			h.approveSSHCheckForOIDCCallback(writer, string(checkID), claims)
+
+			return
+		}
+	}
+
+	userName, err := getUserName(writer, claims, h.cfg.OIDC.StripEmaildomain)
+	if err != nil {
+		return
+	}
+
+	if err := h.validateOIDCUserActive(writer, userName); err != nil {
+		return
+	}
+
+	var rawClaims map[string]interface{}
+	if h.cfg.OIDC.MapGroups || h.cfg.OIDC.TailnetClaim != "" {
+		if err := idToken.Claims(&rawClaims); err != nil {
+			util.LogErr(err, "Failed to decode id token claims")
+		}
+	}
+
+	var groups []string
+	if h.cfg.OIDC.MapGroups {
+		groups = oidcClaimGroups(rawClaims, h.cfg.OIDC.GroupsClaim)
+	}
+
+	tailnet, err := h.oidcTailnet(writer, rawClaims, userName)
+	if err != nil {
+		return
+	}
+
 	machineKey, nodeExists, err := h.validateNodeForOIDCCallback(
 		writer,
 		state,
 		claims,
 		idTokenExpiry,
 	)
-	if err != nil || nodeExists {
+	if err != nil {
 		return
 	}
+	if nodeExists {
+		h.setOIDCUserGroups(userName, groups)
+		h.storeOIDCSession(*machineKey, oauth2Token.RefreshToken)
 
-	userName, err := getUserName(writer, claims, h.cfg.OIDC.StripEmaildomain)
-	if err != nil {
 		return
 	}
 
 	// register the node if it's new
 	log.Debug().Msg("Registering new node after successful callback")
 
-	user, err := h.findOrCreateNewUserForOIDCCallback(writer, userName)
+	user, err := h.findOrCreateNewUserForOIDCCallback(writer, userName, tailnet)
 	if err != nil {
 		return
 	}
+	h.setOIDCUserGroups(userName, groups)
 
 	if err := h.registerNodeForOIDCCallback(writer, user, machineKey, idTokenExpiry); err != nil {
 		return
 	}
+	h.storeOIDCSession(*machineKey, oauth2Token.RefreshToken)
 
 	content, err := renderOIDCCallbackTemplate(writer, claims)
 	if err != nil {
@@ -278,8 +324,8 @@ func (h *Headscale) getIDTokenForOIDCCallback(
 	ctx context.Context,
 	writer http.ResponseWriter,
 	code, state string,
-) (string, error) {
-	oauth2Token, err := h.oauth2Config.Exchange(ctx, code)
+) (*oauth2.Token, string, error) {
+	oauth2Token, err := h.oauth2Config.Load().Exchange(ctx, code)
 	if err != nil {
 		util.LogErr(err, "Could not exchange code for token")
 		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
@@ -289,7 +335,7 @@ func (h *Headscale) getIDTokenForOIDCCallback(
 			util.LogErr(err, "Failed to write response")
 		}
 
-		return "", err
+		return nil, "", err
 	}
 
 	log.Trace().
@@ -307,10 +353,10 @@ func (h *Headscale) getIDTokenForOIDCCallback(
 			util.LogErr(err, "Failed to write response")
 		}
 
-		return "", errNoOIDCIDToken
+		return nil, "", errNoOIDCIDToken
 	}
 
-	return rawIDToken, nil
+	return oauth2Token, rawIDToken, nil
 }
 
 func (h *Headscale) verifyIDTokenForOIDCCallback(
@@ -435,6 +481,28 @@ func validateOIDCAllowedUsers(
 	return nil
 }
 
+// validateOIDCUserActive checks that the user was not deactivated, e.g.
+// by the identity provider with SCIM.
+func (h *Headscale) validateOIDCUserActive(
+	writer http.ResponseWriter,
+	userName string,
+) error {
+	user, err := h.db.GetUser(userName)
+	if err != nil || !user.Deactivated {
+		return nil
+	}
+
+	log.Trace().Str("user", userName).Msg("authenticated principal is deactivated")
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writer.WriteHeader(http.StatusForbidden)
+	_, werr := writer.Write([]byte("user is deactivated"))
+	if werr != nil {
+		util.LogErr(werr, "Failed to write response")
+	}
+
+	return db.ErrUserDeactivated
+}
+
 // validateNode retrieves node information if it exist
 // The error is not important, because if it does not
 // exist, then this is a new node and we will move
@@ -529,7 +597,7 @@ func (h *Headscale) validateNodeForOIDCCallback(
 		ctx := types.NotifyCtx(context.Background(), "oidc-expiry", "na")
 		h.nodeNotifier.NotifyWithIgnore(ctx, types.StateUpdateExpire(node.ID, expiry), node.ID)
 
-		return nil, true, nil
+		return &machineKey, true, nil
 	}
 
 	return &machineKey, false, nil
@@ -563,10 +631,11 @@ func getUserName(
 func (h *Headscale) findOrCreateNewUserForOIDCCallback(
 	writer http.ResponseWriter,
 	userName string,
+	tailnet string,
 ) (*types.User, error) {
 	user, err := h.db.GetUser(userName)
 	if errors.Is(err, db.ErrUserNotFound) {
-		user, err = h.db.CreateUser(userName)
+		user, err = h.db.CreateTailnetUser(userName, tailnet)
 		if err != nil {
 			writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
 			writer.WriteHeader(http.StatusInternalServerError)
@@ -577,6 +646,7 @@ func (h *Headscale) findOrCreateNewUserForOIDCCallback(
 
 			return nil, fmt.Errorf("creating new user: %w", err)
 		}
+		h.sendUserEvent(webhook.EventUserCreated, user)
 	} else if err != nil {
 		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		writer.WriteHeader(http.StatusInternalServerError)
@@ -597,13 +667,57 @@ func (h *Headscale) registerNodeForOIDCCallback(
 	machineKey *key.MachinePublic,
 	expiry time.Time,
 ) error {
-	ipv4, ipv6, err := h.ipAlloc.Next()
-	if err != nil {
+	if err := h.checkNodeLimit(h.db.DB, *machineKey); err != nil {
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if errors.Is(err, ErrNodeLimitReached) {
+			writer.WriteHeader(http.StatusForbidden)
+			_, werr := writer.Write([]byte(err.Error()))
+			if werr != nil {
+				util.LogErr(err, "Failed to write response")
+			}
+
+			return err
+		}
+
+		writer.WriteHeader(http.StatusInternalServerError)
+		_, werr := writer.Write([]byte("could not register node"))
+		if werr != nil {
+			util.LogErr(err, "Failed to write response")
+		}
+
+		return err
+	}
+
+	if err := h.checkPendingNodeTags(*machineKey, user.Name); err != nil {
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writer.WriteHeader(http.StatusForbidden)
+		_, werr := writer.Write([]byte(err.Error()))
+		if werr != nil {
+			util.LogErr(err, "Failed to write response")
+		}
+
 		return err
 	}
 
+	// A new node awaiting approval gets its addresses when it is
+	// approved.
+	var ipv4, ipv6 *netip.Addr
+	var err error
+	awaitingApproval := h.holdForApproval(*machineKey)
+	if !awaitingApproval {
+		ipv4, ipv6, err = h.nextRegistrationIPs(*machineKey, user.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	var node *types.Node
 	if err := h.db.Write(func(tx *gorm.DB) error {
-		if _, err := db.RegisterNodeFromAuthCallback(
+		if err := h.checkNodeLimit(tx, *machineKey); err != nil {
+			return err
+		}
+
+		node, err = db.RegisterNodeFromAuthCallback(
 			// TODO(kradalby): find a better way to use the cache across modules
 			tx,
 			h.registrationCache,
@@ -612,14 +726,22 @@ func (h *Headscale) registerNodeForOIDCCallback(
 			&expiry,
 			util.RegisterMethodOIDC,
 			ipv4, ipv6,
-		); err != nil {
+		)
+
+		return err
+	}); err != nil {
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if errors.Is(err, ErrNodeLimitReached) {
+			writer.WriteHeader(http.StatusForbidden)
+			_, werr := writer.Write([]byte(err.Error()))
+			if werr != nil {
+				util.LogErr(err, "Failed to write response")
+			}
+
 			return err
 		}
 
-		return nil
-	}); err != nil {
 		util.LogErr(err, "could not register node")
-		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		writer.WriteHeader(http.StatusInternalServerError)
 		_, werr := writer.Write([]byte("could not register node"))
 		if werr != nil {
@@ -629,6 +751,10 @@ func (h *Headscale) registerNodeForOIDCCallback(
 		return err
 	}
 
+	if !awaitingApproval {
+		h.sendNodeEvent(webhook.EventNodeRegistered, node)
+	}
+
 	return nil
 }
 
@@ -0,0 +1,257 @@
+package hscontrol
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/webhook"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+	"tailscale.com/types/key"
+)
+
+var errOIDCSessionInvalid = errors.New("invalid encrypted refresh token")
+
+// oidcSessionKey returns the key encrypting the refresh tokens, derived
+// from the noise private key of the server.
+func (h *Headscale) oidcSessionKey() ([]byte, error) {
+	noiseKey, err := h.noisePrivateKey.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(append([]byte("headscale oidc refresh token\n"), noiseKey...))
+
+	return sum[:], nil
+}
+
+// encryptRefreshToken encrypts the token with AES-GCM, the nonce is
+// prepended to the result.
+func encryptRefreshToken(secret []byte, token string) ([]byte, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, []byte(token), nil), nil
+}
+
+func decryptRefreshToken(secret []byte, data []byte) (string, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return "", errOIDCSessionInvalid
+	}
+
+	token, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errOIDCSessionInvalid, err)
+	}
+
+	return string(token), nil
+}
+
+// storeOIDCSession keeps the refresh token of the user who authenticated
+// the node with the machine key, to revalidate their access later.
+func (h *Headscale) storeOIDCSession(machineKey key.MachinePublic, refreshToken string) {
+	if h.cfg.OIDC.RevalidateInterval <= 0 {
+		return
+	}
+
+	if refreshToken == "" {
+		log.Warn().
+			Msg("The OIDC provider did not give a refresh token, the node cannot be revalidated, is the offline_access scope missing?")
+
+		return
+	}
+
+	node, err := h.db.GetNodeByMachineKey(machineKey)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to find the node to store its OIDC session")
+
+		return
+	}
+
+	if err := h.setOIDCSession(node.ID, refreshToken); err != nil {
+		log.Error().
+			Err(err).
+			Str("node", node.Hostname).
+			Msg("Failed to store the OIDC session of the node")
+	}
+}
+
+func (h *Headscale) setOIDCSession(nodeID types.NodeID, refreshToken string) error {
+	secret, err := h.oidcSessionKey()
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := encryptRefreshToken(secret, refreshToken)
+	if err != nil {
+		return err
+	}
+
+	return h.db.SetOIDCSession(&types.OIDCSession{
+		NodeID:       nodeID,
+		RefreshToken: encrypted,
+		ValidatedAt:  time.Now(),
+	})
+}
+
+// revalidateOIDCSessions regularly checks that the OIDC provider still
+// gives access to the users who authenticated the nodes.
+func (h *Headscale) revalidateOIDCSessions(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+
+	for {
+		select {
+		case <-ctx.Done():
+			ticker.Stop()
+			return
+		case <-ticker.C:
+			// With HA, only the leader revalidates the sessions.
+			if !h.isLeader() {
+				continue
+			}
+
+			h.revalidateOIDCSessionsOnce(ctx)
+		}
+	}
+}
+
+// revalidateOIDCSessionsOnce refreshes the token of every session. The
+// node is expired when the provider answers the refresh token is no
+// longer valid, but not on other errors, e.g. when the provider cannot
+// be reached, it is tried again the next time.
+func (h *Headscale) revalidateOIDCSessionsOnce(ctx context.Context) {
+	sessions, err := h.db.ListOIDCSessions()
+	if err != nil {
+		log.Error().Err(err).Msg("database error while listing OIDC sessions")
+
+		return
+	}
+
+	secret, err := h.oidcSessionKey()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to derive the key of the OIDC sessions")
+
+		return
+	}
+
+	for _, session := range sessions {
+		token, err := decryptRefreshToken(secret, session.RefreshToken)
+		if err != nil {
+			// The noise private key might have changed, the session
+			// cannot be revalidated anymore.
+			log.Warn().
+				Err(err).
+				Uint64("node_id", session.NodeID.Uint64()).
+				Msg("Cannot decrypt the OIDC session of the node, dropping it")
+
+			if err := h.db.DeleteOIDCSession(session.NodeID); err != nil {
+				log.Error().Err(err).Msg("database error while deleting OIDC session")
+			}
+
+			continue
+		}
+
+		refreshed, err := h.oauth2Config.Load().TokenSource(ctx, &oauth2.Token{RefreshToken: token}).Token()
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) && retrieveErr.ErrorCode == "invalid_grant" {
+			log.Info().
+				Err(err).
+				Uint64("node_id", session.NodeID.Uint64()).
+				Msg("The OIDC provider refused to refresh the session of the node, expiring it")
+
+			h.expireOIDCSessionNode(session.NodeID)
+
+			continue
+		}
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Uint64("node_id", session.NodeID.Uint64()).
+				Msg("Failed to refresh the OIDC session of the node, will retry")
+
+			continue
+		}
+
+		// Providers rotating the refresh tokens give a new one.
+		if refreshed.RefreshToken != "" {
+			token = refreshed.RefreshToken
+		}
+
+		if err := h.setOIDCSession(session.NodeID, token); err != nil {
+			log.Error().Err(err).Msg("database error while storing OIDC session")
+		}
+	}
+}
+
+// expireOIDCSessionNode expires the node whose OIDC session was revoked,
+// and deletes the session.
+func (h *Headscale) expireOIDCSessionNode(nodeID types.NodeID) {
+	now := time.Now()
+
+	node, err := db.Write(h.db.DB, func(tx *gorm.DB) (*types.Node, error) {
+		if err := db.DeleteOIDCSession(tx, nodeID); err != nil {
+			return nil, err
+		}
+
+		if err := db.NodeSetExpiry(tx, nodeID, now); err != nil {
+			return nil, err
+		}
+
+		return db.GetNodeByID(tx, nodeID)
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("database error while expiring node of revoked OIDC session")
+
+		return
+	}
+
+	h.notifyNodeExpired(node, now)
+}
+
+// notifyNodeExpired tells the node and its peers that the node expired.
+func (h *Headscale) notifyNodeExpired(node *types.Node, expiry time.Time) {
+	ctx := types.NotifyCtx(context.Background(), "node-expired-self", node.Hostname)
+	h.nodeNotifier.NotifyByNodeID(
+		ctx,
+		types.StateUpdate{
+			Type:        types.StateSelfUpdate,
+			ChangeNodes: []types.NodeID{node.ID},
+		},
+		node.ID)
+
+	ctx = types.NotifyCtx(context.Background(), "node-expired-peers", node.Hostname)
+	h.nodeNotifier.NotifyWithIgnore(ctx, types.StateUpdateExpire(node.ID, expiry), node.ID)
+
+	h.sendNodeEvent(webhook.EventNodeExpired, node)
+}
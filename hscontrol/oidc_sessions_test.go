@@ -0,0 +1,85 @@
+package hscontrol
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"golang.org/x/oauth2"
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestEncryptRefreshToken(c *check.C) {
+	secret, err := app.oidcSessionKey()
+	c.Assert(err, check.IsNil)
+
+	encrypted, err := encryptRefreshToken(secret, "refresh-token")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(encrypted), check.Not(check.Matches), ".*refresh-token.*")
+
+	token, err := decryptRefreshToken(secret, encrypted)
+	c.Assert(err, check.IsNil)
+	c.Assert(token, check.Equals, "refresh-token")
+
+	other := make([]byte, len(secret))
+	_, err = decryptRefreshToken(other, encrypted)
+	c.Assert(err, check.ErrorMatches, ".*invalid encrypted refresh token.*")
+}
+
+func (s *Suite) TestRevalidateOIDCSessions(c *check.C) {
+	node, revoked := createPollTestNodes(c)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.FormValue("refresh_token") {
+		case "valid":
+			fmt.Fprint(w, `{"access_token": "access", "token_type": "Bearer", "refresh_token": "rotated"}`)
+		case "revoked":
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "invalid_grant"}`)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	app.cfg.OIDC.RevalidateInterval = time.Hour
+	app.oauth2Config.Store(&oauth2.Config{
+		ClientID: "headscale",
+		Endpoint: oauth2.Endpoint{TokenURL: srv.URL, AuthStyle: oauth2.AuthStyleInParams},
+	})
+
+	c.Assert(app.setOIDCSession(node.ID, "valid"), check.IsNil)
+	c.Assert(app.setOIDCSession(revoked.ID, "revoked"), check.IsNil)
+
+	app.revalidateOIDCSessionsOnce(context.Background())
+
+	sessions, err := app.db.ListOIDCSessions()
+	c.Assert(err, check.IsNil)
+	c.Assert(sessions, check.HasLen, 1)
+	c.Assert(sessions[0].NodeID, check.Equals, node.ID)
+
+	secret, err := app.oidcSessionKey()
+	c.Assert(err, check.IsNil)
+	token, err := decryptRefreshToken(secret, sessions[0].RefreshToken)
+	c.Assert(err, check.IsNil)
+	c.Assert(token, check.Equals, "rotated")
+
+	expired, err := app.db.GetNodeByID(revoked.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(expired.IsExpired(), check.Equals, true)
+
+	valid, err := app.db.GetNodeByID(node.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(valid.IsExpired(), check.Equals, false)
+
+	// The session is kept when the provider cannot answer.
+	c.Assert(app.setOIDCSession(revoked.ID, "unavailable"), check.IsNil)
+	app.revalidateOIDCSessionsOnce(context.Background())
+
+	sessions, err = app.db.ListOIDCSessions()
+	c.Assert(err, check.IsNil)
+	c.Assert(sessions, check.HasLen, 2)
+}
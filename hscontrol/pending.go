@@ -0,0 +1,242 @@
+package hscontrol
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+	"sort"
+
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/webhook"
+	"gorm.io/gorm"
+	"tailscale.com/types/key"
+)
+
+// pendingNodeIDLength is the number of bytes of the machine key used as
+// the identifier of a pending node.
+const pendingNodeIDLength = 6
+
+var ErrPendingNodeNotFound = errors.New("pending node not found")
+
+// pendingNode is a node waiting in the registration cache for its
+// interactive registration to be completed, or a registered node
+// awaiting approval.
+type pendingNode struct {
+	ID         string
+	MachineKey key.MachinePublic
+	Node       types.Node
+}
+
+// pendingNodeID returns the short identifier of a pending node, used to
+// approve or reject it.
+func pendingNodeID(machineKey key.MachinePublic) string {
+	return hex.EncodeToString(machineKey.UntypedBytes()[:pendingNodeIDLength])
+}
+
+func rejectedRegistrationKey(machineKey key.MachinePublic) string {
+	return "rejected/" + machineKey.String()
+}
+
+// pendingNodes returns the nodes waiting for their registration to be
+// approved, oldest first.
+func (h *Headscale) pendingNodes() ([]pendingNode, error) {
+	awaiting, err := h.db.ListNodesAwaitingApproval()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make([]pendingNode, 0, len(awaiting))
+	for _, node := range awaiting {
+		pending = append(pending, pendingNode{
+			ID:         pendingNodeID(node.MachineKey),
+			MachineKey: node.MachineKey,
+			Node:       *node,
+		})
+	}
+
+	for cacheKey, item := range h.registrationCache.Items() {
+		node, ok := item.Object.(types.Node)
+		if !ok {
+			continue
+		}
+
+		var machineKey key.MachinePublic
+		if err := machineKey.UnmarshalText([]byte(cacheKey)); err != nil {
+			continue
+		}
+
+		pending = append(pending, pendingNode{
+			ID:         pendingNodeID(machineKey),
+			MachineKey: machineKey,
+			Node:       node,
+		})
+	}
+
+	sort.Slice(pending, func(i, j int) bool {
+		if pending[i].Node.LastSeen == nil || pending[j].Node.LastSeen == nil {
+			return pending[i].ID < pending[j].ID
+		}
+
+		return pending[i].Node.LastSeen.Before(*pending[j].Node.LastSeen)
+	})
+
+	return pending, nil
+}
+
+func (h *Headscale) findPendingNode(id string) (*pendingNode, error) {
+	pending, err := h.pendingNodes()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, node := range pending {
+		if node.ID == id {
+			return &node, nil
+		}
+	}
+
+	return nil, ErrPendingNodeNotFound
+}
+
+// rejectPendingNode removes the node from the registration cache, or
+// deletes it if it is awaiting approval. The node is told its
+// registration was rejected when it asks again, instead of being added
+// back as a new pending node.
+func (h *Headscale) rejectPendingNode(ctx context.Context, id string) (*pendingNode, error) {
+	pending, err := h.findPendingNode(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if pending.Node.AwaitingApproval {
+		if err := h.deleteNode(ctx, &pending.Node); err != nil {
+			return nil, err
+		}
+	}
+
+	h.rejectRegistration(pending.MachineKey, "registration was rejected by an administrator")
+
+	return pending, nil
+}
+
+// rejectRegistration removes the node from the registration cache and
+// remembers why it was rejected, to tell the node when it asks again.
+func (h *Headscale) rejectRegistration(machineKey key.MachinePublic, reason string) {
+	h.registrationCache.Delete(machineKey.String())
+	h.registrationCache.Set(
+		rejectedRegistrationKey(machineKey),
+		reason,
+		registerCacheExpiration,
+	)
+}
+
+// registrationRejection returns why the registration of the node was
+// rejected, if it was.
+func (h *Headscale) registrationRejection(machineKey key.MachinePublic) (string, bool) {
+	item, rejected := h.registrationCache.Get(rejectedRegistrationKey(machineKey))
+	if !rejected {
+		return "", false
+	}
+
+	reason, _ := item.(string)
+
+	return reason, true
+}
+
+func (h *Headscale) isRegistrationRejected(machineKey key.MachinePublic) bool {
+	_, rejected := h.registrationRejection(machineKey)
+
+	return rejected
+}
+
+// checkPendingNodeTags checks that the user the node is registered to
+// owns the tags the node advertises. If not, the registration is
+// rejected and the node is told which tags are not permitted.
+func (h *Headscale) checkPendingNodeTags(machineKey key.MachinePublic, user string) error {
+	item, ok := h.registrationCache.Get(machineKey.String())
+	if !ok {
+		return nil
+	}
+
+	node, ok := item.(types.Node)
+	if !ok || node.Hostinfo == nil {
+		return nil
+	}
+
+	pol := h.tailnetPolicy(h.userTailnet(user))
+	if err := pol.CheckRequestedTags(user, node.Hostinfo.RequestTags); err != nil {
+		h.rejectRegistration(machineKey, err.Error())
+
+		return err
+	}
+
+	return nil
+}
+
+// nextRegistrationIPs allocates the addresses of the node registering
+// with the machine key as a node of the user, from the IP pools of its
+// user or the tags it requests.
+func (h *Headscale) nextRegistrationIPs(machineKey key.MachinePublic, user string) (*netip.Addr, *netip.Addr, error) {
+	var node types.Node
+	if item, ok := h.registrationCache.Get(machineKey.String()); ok {
+		if cached, ok := item.(types.Node); ok {
+			node = cached
+		}
+	}
+	node.User = types.User{Name: user, Tailnet: h.userTailnet(user)}
+
+	return h.ipAlloc.NextForNode(h.policyOf(&node), &node)
+}
+
+// holdForApproval marks the node in the registration cache as awaiting
+// approval if node approval is enabled and it is a new node, and returns
+// if it did. Nodes registered again keep their approval.
+func (h *Headscale) holdForApproval(machineKey key.MachinePublic) bool {
+	if !h.cfg.NodeApproval {
+		return false
+	}
+
+	item, ok := h.registrationCache.Get(machineKey.String())
+	if !ok {
+		return false
+	}
+
+	node, ok := item.(types.Node)
+	if !ok || node.ID != 0 {
+		return false
+	}
+
+	node.AwaitingApproval = true
+	h.registrationCache.Set(machineKey.String(), node, registerCacheExpiration)
+
+	return true
+}
+
+// approveNode lets a node awaiting approval in the tailnet. Its
+// addresses are allocated now, from its IP pools if it has some.
+func (h *Headscale) approveNode(ctx context.Context, pending *pendingNode) (*types.Node, error) {
+	ipv4, ipv6, err := h.ipAlloc.NextForNode(h.policyOf(&pending.Node), &pending.Node)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := db.Write(h.db.DB, func(tx *gorm.DB) (*types.Node, error) {
+		return db.ApproveNode(tx, pending.Node.ID, ipv4, ipv6)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// A full update gives the node its netmap and adds it to the peers
+	// of the other nodes.
+	ctx = types.NotifyCtx(ctx, "approve-node", node.Hostname)
+	h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+		Type: types.StateFullUpdate,
+	})
+
+	h.sendNodeEvent(webhook.EventNodeRegistered, node)
+
+	return node, nil
+}
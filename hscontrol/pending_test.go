@@ -0,0 +1,199 @@
+package hscontrol
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/juanfont/headscale/hscontrol/policy"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gopkg.in/check.v1"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func addPendingNode(hostname string) key.MachinePublic {
+	machineKey := key.NewMachine().Public()
+	now := time.Now()
+
+	app.registrationCache.Set(
+		machineKey.String(),
+		types.Node{
+			MachineKey: machineKey,
+			NodeKey:    key.NewNode().Public(),
+			Hostname:   hostname,
+			LastSeen:   &now,
+		},
+		registerCacheExpiration,
+	)
+
+	return machineKey
+}
+
+func (s *Suite) TestPendingNodes(c *check.C) {
+	api := newHeadscaleV1APIServer(app)
+
+	first := addPendingNode("first")
+	second := addPendingNode("second")
+
+	listed, err := api.ListPendingNodes(context.Background(), &v1.ListPendingNodesRequest{})
+	c.Assert(err, check.IsNil)
+	c.Assert(listed.GetNodes(), check.HasLen, 2)
+	c.Assert(listed.GetNodes()[0].GetId(), check.Equals, pendingNodeID(first))
+	c.Assert(listed.GetNodes()[0].GetHostname(), check.Equals, "first")
+	c.Assert(listed.GetNodes()[1].GetId(), check.Equals, pendingNodeID(second))
+
+	_, err = api.RejectPendingNode(context.Background(), &v1.RejectPendingNodeRequest{Id: "unknown"})
+	c.Assert(err, check.NotNil)
+
+	_, err = api.RejectPendingNode(context.Background(), &v1.RejectPendingNodeRequest{Id: pendingNodeID(first)})
+	c.Assert(err, check.IsNil)
+	c.Assert(app.isRegistrationRejected(first), check.Equals, true)
+	c.Assert(app.isRegistrationRejected(second), check.Equals, false)
+
+	listed, err = api.ListPendingNodes(context.Background(), &v1.ListPendingNodesRequest{})
+	c.Assert(err, check.IsNil)
+	c.Assert(listed.GetNodes(), check.HasLen, 1)
+	c.Assert(listed.GetNodes()[0].GetId(), check.Equals, pendingNodeID(second))
+
+	// A rejected node asking to register again is told it was rejected
+	// instead of becoming pending again.
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/machine/register", nil)
+	app.handleRegister(rec, req, tailcfg.RegisterRequest{
+		NodeKey:  key.NewNode().Public(),
+		Hostinfo: &tailcfg.Hostinfo{Hostname: "first"},
+	}, first)
+	c.Assert(rec.Code, check.Equals, http.StatusOK)
+
+	var resp tailcfg.RegisterResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	c.Assert(resp.Error, check.Not(check.Equals), "")
+	c.Assert(resp.AuthURL, check.Equals, "")
+
+	_, found := app.registrationCache.Get(first.String())
+	c.Assert(found, check.Equals, false)
+}
+
+func (s *Suite) TestPendingNodeTagsNotPermitted(c *check.C) {
+	api := newHeadscaleV1APIServer(app)
+	app.ACLPolicy = &policy.ACLPolicy{
+		TagOwners: policy.TagOwners{
+			"tag:server": []string{"user1"},
+		},
+	}
+
+	_, err := app.db.CreateUser("user2")
+	c.Assert(err, check.IsNil)
+
+	machineKey := key.NewMachine().Public()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/machine/register", nil)
+	app.handleRegister(rec, req, tailcfg.RegisterRequest{
+		NodeKey: key.NewNode().Public(),
+		Hostinfo: &tailcfg.Hostinfo{
+			Hostname:    "server",
+			RequestTags: []string{"tag:server"},
+		},
+	}, machineKey)
+	c.Assert(rec.Code, check.Equals, http.StatusOK)
+
+	_, err = api.ApprovePendingNode(context.Background(), &v1.ApprovePendingNodeRequest{
+		Id:   pendingNodeID(machineKey),
+		User: "user2",
+	})
+	c.Assert(err, check.ErrorMatches, ".*requested tags \\[tag:server\\] are invalid or not permitted")
+
+	// The node is told why when it asks again.
+	rec = httptest.NewRecorder()
+	app.handleRegister(rec, req, tailcfg.RegisterRequest{
+		NodeKey:  key.NewNode().Public(),
+		Hostinfo: &tailcfg.Hostinfo{Hostname: "server"},
+	}, machineKey)
+
+	var resp tailcfg.RegisterResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	c.Assert(resp.Error, check.Equals, "requested tags [tag:server] are invalid or not permitted")
+}
+
+func (s *Suite) TestNodeApproval(c *check.C) {
+	api := newHeadscaleV1APIServer(app)
+	app.cfg.NodeApproval = true
+	app.ACLPolicy = &policy.ACLPolicy{}
+
+	_, err := app.db.CreateUser("user1")
+	c.Assert(err, check.IsNil)
+
+	pak, err := app.db.CreatePreAuthKey("user1", true, false, nil, nil, nil)
+	c.Assert(err, check.IsNil)
+
+	register := func(machineKey key.MachinePublic, nodeKey key.NodePublic) tailcfg.RegisterResponse {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/machine/register", nil)
+		app.handleRegister(rec, req, tailcfg.RegisterRequest{
+			NodeKey:  nodeKey,
+			Auth:     &tailcfg.RegisterResponseAuth{AuthKey: pak.Key},
+			Hostinfo: &tailcfg.Hostinfo{Hostname: "laptop"},
+		}, machineKey)
+		c.Assert(rec.Code, check.Equals, http.StatusOK)
+
+		var resp tailcfg.RegisterResponse
+		c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+
+		return resp
+	}
+
+	// The node is registered without addresses and told it waits for
+	// approval.
+	approved := key.NewMachine().Public()
+	approvedNodeKey := key.NewNode().Public()
+	resp := register(approved, approvedNodeKey)
+	c.Assert(resp.Error, check.Equals, "")
+	c.Assert(resp.MachineAuthorized, check.Equals, false)
+
+	rejected := key.NewMachine().Public()
+	register(rejected, key.NewNode().Public())
+
+	listed, err := api.ListPendingNodes(context.Background(), &v1.ListPendingNodesRequest{})
+	c.Assert(err, check.IsNil)
+	c.Assert(listed.GetNodes(), check.HasLen, 2)
+	c.Assert(listed.GetNodes()[0].GetId(), check.Equals, pendingNodeID(approved))
+	c.Assert(listed.GetNodes()[0].GetAwaitingApproval(), check.Equals, true)
+	c.Assert(listed.GetNodes()[0].GetUser(), check.Equals, "user1")
+
+	node, err := app.db.GetNodeByMachineKey(approved)
+	c.Assert(err, check.IsNil)
+	c.Assert(node.AwaitingApproval, check.Equals, true)
+	c.Assert(node.IPs(), check.HasLen, 0)
+
+	_, err = api.ApprovePendingNode(context.Background(), &v1.ApprovePendingNodeRequest{
+		Id:   pendingNodeID(approved),
+		User: "user2",
+	})
+	c.Assert(err, check.ErrorMatches, `.*node is registered to user "user1"`)
+
+	approvedResp, err := api.ApprovePendingNode(context.Background(), &v1.ApprovePendingNodeRequest{
+		Id: pendingNodeID(approved),
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(approvedResp.GetNode().GetAwaitingApproval(), check.Equals, false)
+	c.Assert(approvedResp.GetNode().GetIpAddresses(), check.Not(check.HasLen), 0)
+
+	_, err = api.RejectPendingNode(context.Background(), &v1.RejectPendingNodeRequest{Id: pendingNodeID(rejected)})
+	c.Assert(err, check.IsNil)
+
+	_, err = app.db.GetNodeByMachineKey(rejected)
+	c.Assert(err, check.NotNil)
+	c.Assert(app.isRegistrationRejected(rejected), check.Equals, true)
+
+	listed, err = api.ListPendingNodes(context.Background(), &v1.ListPendingNodesRequest{})
+	c.Assert(err, check.IsNil)
+	c.Assert(listed.GetNodes(), check.HasLen, 0)
+
+	// The approved node is authorized when it registers again.
+	resp = register(approved, approvedNodeKey)
+	c.Assert(resp.MachineAuthorized, check.Equals, true)
+}
@@ -0,0 +1,370 @@
+package hscontrol
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/policy"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/webhook"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"tailscale.com/tailcfg"
+)
+
+var (
+	ErrPolicyInvalid         = errors.New("invalid policy")
+	ErrPolicyNotInDB         = errors.New("the policy is not stored in the database, acl_policy_mode is not database")
+	ErrPolicyVersionNotFound = errors.New("policy version not found")
+	ErrPolicyCheckInvalid    = errors.New("invalid policy check")
+)
+
+// loadDBPolicy loads the latest version of the policy stored in the
+// database. Its tests are not run again, they passed when it was set,
+// and failing to start because nodes changed since would leave no way
+// to fix the policy.
+func (h *Headscale) loadDBPolicy() error {
+	stored, err := h.db.GetPolicy()
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Info().Msg("No ACL policy stored in the database, all traffic is allowed")
+
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("loading ACL policy from the database: %w", err)
+	}
+
+	pol, err := policy.LoadACLPolicyFromBytes([]byte(stored.Data), "hujson")
+	if err != nil {
+		return fmt.Errorf("parsing ACL policy version %d: %w", stored.ID, err)
+	}
+
+	if _, err := h.applyIdPGroups(pol); err != nil {
+		return fmt.Errorf("adding the identity provider groups to the ACL policy: %w", err)
+	}
+
+	if _, err := h.applyNodeShares(pol); err != nil {
+		return fmt.Errorf("adding the node shares to the ACL policy: %w", err)
+	}
+
+	pol.KeepHostSources(h.ACLPolicy)
+
+	h.ACLPolicy = pol
+	h.refreshACLHostsSoon()
+
+	return nil
+}
+
+// SetPolicy stores a new version of the policy in the database and
+// applies it. The policy must be valid, its tests must pass and its
+// rules must compile for the current nodes of the default tailnet,
+// otherwise the current policy is kept and nothing is stored.
+func (h *Headscale) SetPolicy(data string) (*types.Policy, error) {
+	if h.cfg.ACL.Mode != types.PolicyModeDB {
+		return nil, ErrPolicyNotInDB
+	}
+
+	h.policyMu.Lock()
+	defer h.policyMu.Unlock()
+
+	pol, err := h.loadCandidatePolicy(data)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := db.Write(h.db.DB, func(tx *gorm.DB) (*types.Policy, error) {
+		nodes, err := db.ListNodes(tx)
+		if err != nil {
+			return nil, fmt.Errorf("listing nodes to check the policy: %w", err)
+		}
+		nodes = nodes.InTailnet("")
+
+		if err := pol.RunTests(nodes); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrPolicyInvalid, err)
+		}
+
+		if _, err := pol.CompileFilterRules(nodes); err != nil {
+			return nil, fmt.Errorf("%w: compiling rules: %w", ErrPolicyInvalid, err)
+		}
+
+		return db.SetPolicy(tx, data)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	h.ACLPolicy = pol
+	h.refreshACLHostsSoon()
+	h.autoApproveRoutes()
+
+	log.Info().
+		Uint64("version", stored.ID).
+		Msg("ACL policy updated, notifying nodes of change")
+
+	ctx := types.NotifyCtx(context.Background(), "acl-set", "na")
+	h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+		Type: types.StateFullUpdate,
+	})
+
+	return stored, nil
+}
+
+// RollbackPolicy sets the policy back to a previous version, it is
+// stored as a new version so the history is kept.
+func (h *Headscale) RollbackPolicy(version uint64) (*types.Policy, error) {
+	if h.cfg.ACL.Mode != types.PolicyModeDB {
+		return nil, ErrPolicyNotInDB
+	}
+
+	previous, err := h.db.GetPolicyVersion(version)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w: %d", ErrPolicyVersionNotFound, version)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return h.SetPolicy(previous.Data)
+}
+
+// loadCandidatePolicy parses a policy given through the API, with the
+// groups given by the identity provider and the node shares, like the
+// current policy.
+func (h *Headscale) loadCandidatePolicy(data string) (*policy.ACLPolicy, error) {
+	pol, err := policy.LoadACLPolicyFromBytes([]byte(data), "hujson")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrPolicyInvalid, err)
+	}
+
+	if _, err := h.applyIdPGroups(pol); err != nil {
+		return nil, fmt.Errorf("adding the identity provider groups to the ACL policy: %w", err)
+	}
+
+	if _, err := h.applyNodeShares(pol); err != nil {
+		return nil, fmt.Errorf("adding the node shares to the ACL policy: %w", err)
+	}
+
+	pol.KeepHostSources(h.ACLPolicy)
+
+	return pol, nil
+}
+
+// autoApproveRoutes enables the routes approved by the autoApprovers of
+// the current policies, for all the nodes of their tailnet. The
+// approvers are not only checked when a route is advertised, so
+// approvers added to the policy apply to the routes already advertised. Disabling routes which are
+// no longer approved is left to the admin.
+func (h *Headscale) autoApproveRoutes() {
+	var changed []types.NodeID
+	for tailnet, pol := range h.policies() {
+		enabled, err := h.db.EnableAllAutoApprovedRoutes(pol, tailnet)
+		if err != nil {
+			log.Error().Err(err).Str("tailnet", tailnet).Msg("Failed to enable auto approved routes")
+
+			continue
+		}
+		changed = append(changed, enabled...)
+	}
+
+	if len(changed) > 0 {
+		log.Info().
+			Int("nodes", len(changed)).
+			Msg("Enabled routes approved by the ACL policy")
+
+		ctx := types.NotifyCtx(context.Background(), "acl-autoapprove", "na")
+		h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+			Type:        types.StatePeerChanged,
+			ChangeNodes: changed,
+		})
+		h.sendNodeEventsByID(webhook.EventRoutesChanged, changed...)
+	}
+}
+
+// NodePolicyDiff lists the packet filter and SSH rules of a node added
+// and removed by a candidate policy. Rules are formatted as JSON, as
+// they are sent to the node.
+type NodePolicyDiff struct {
+	Node *types.Node
+
+	AddedRules      []string
+	RemovedRules    []string
+	AddedSSHRules   []string
+	RemovedSSHRules []string
+}
+
+func (d NodePolicyDiff) Proto() *v1.NodePolicyDiff {
+	return &v1.NodePolicyDiff{
+		NodeId:          d.Node.ID.Uint64(),
+		NodeName:        d.Node.GivenName,
+		User:            d.Node.User.Name,
+		AddedRules:      d.AddedRules,
+		RemovedRules:    d.RemovedRules,
+		AddedSshRules:   d.AddedSSHRules,
+		RemovedSshRules: d.RemovedSSHRules,
+	}
+}
+
+func (d NodePolicyDiff) empty() bool {
+	return len(d.AddedRules) == 0 && len(d.RemovedRules) == 0 &&
+		len(d.AddedSSHRules) == 0 && len(d.RemovedSSHRules) == 0
+}
+
+// DiffPolicy compiles a candidate policy for the current nodes and
+// returns the nodes whose packet filter or SSH rules would change
+// compared to the current policy. Nothing is applied.
+func (h *Headscale) DiffPolicy(data string) ([]NodePolicyDiff, error) {
+	candidate, err := h.loadCandidatePolicy(data)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := h.db.ListNodes()
+	if err != nil {
+		return nil, fmt.Errorf("listing nodes to compile the policy: %w", err)
+	}
+	nodes = nodes.InTailnet("")
+
+	current, err := h.compileNodeRules(h.ACLPolicy, nodes)
+	if err != nil {
+		return nil, fmt.Errorf("compiling the current policy: %w", err)
+	}
+
+	next, err := h.compileNodeRules(candidate, nodes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrPolicyInvalid, err)
+	}
+
+	var diffs []NodePolicyDiff
+	for _, node := range nodes {
+		diff := NodePolicyDiff{Node: node}
+		diff.AddedRules, diff.RemovedRules = diffRules(current[node.ID].filter, next[node.ID].filter)
+		diff.AddedSSHRules, diff.RemovedSSHRules = diffRules(current[node.ID].ssh, next[node.ID].ssh)
+
+		if !diff.empty() {
+			diffs = append(diffs, diff)
+		}
+	}
+
+	return diffs, nil
+}
+
+// CheckPolicy answers whether traffic from src to dst, an alias with a
+// single port, is allowed by the current policy for the current nodes,
+// or by the candidate policy if it is not empty.
+func (h *Headscale) CheckPolicy(src, dst, protocol, candidate string) (*policy.AccessCheck, error) {
+	pol := h.ACLPolicy
+	if candidate != "" {
+		var err error
+		pol, err = h.loadCandidatePolicy(candidate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	nodes, err := h.db.ListNodes()
+	if err != nil {
+		return nil, fmt.Errorf("listing nodes to check the policy: %w", err)
+	}
+	nodes = nodes.InTailnet("")
+
+	check, err := pol.CheckAccess(nodes, src, dst, protocol)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrPolicyCheckInvalid, err)
+	}
+
+	return check, nil
+}
+
+type nodeRules struct {
+	filter []string
+	ssh    []string
+}
+
+// compileNodeRules returns the packet filter and SSH rules of every
+// node under the policy, as the mapper sends them. Quarantined nodes and
+// nodes awaiting approval are left out, their rules do not depend on the
+// policy.
+func (h *Headscale) compileNodeRules(
+	pol *policy.ACLPolicy,
+	nodes types.Nodes,
+) (map[types.NodeID]nodeRules, error) {
+	var active types.Nodes
+	for _, node := range nodes {
+		if !node.IsIsolated() {
+			active = append(active, node)
+		}
+	}
+
+	packetFilter, err := pol.CompileFilterRules(active)
+	if err != nil {
+		return nil, err
+	}
+
+	viaFilter, err := pol.CompileViaFilterRules(active)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[types.NodeID]nodeRules, len(active))
+	for _, node := range active {
+		peers := slices.DeleteFunc(slices.Clone(active), func(peer *types.Node) bool {
+			return peer.ID == node.ID
+		})
+
+		sshPolicy, err := pol.CompileSSHPolicy(node, peers, h.cfg.SSHRecording)
+		if err != nil {
+			return nil, err
+		}
+
+		var rules nodeRules
+		filter := append(policy.ReduceFilterRules(node, packetFilter), viaFilter[node.ID]...)
+		if rules.filter, err = marshalRules(filter); err != nil {
+			return nil, err
+		}
+		if sshPolicy != nil {
+			if rules.ssh, err = marshalRules(sshPolicy.Rules); err != nil {
+				return nil, err
+			}
+		}
+
+		ret[node.ID] = rules
+	}
+
+	return ret, nil
+}
+
+func marshalRules[T tailcfg.FilterRule | *tailcfg.SSHRule](rules []T) ([]string, error) {
+	ret := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		data, err := json.Marshal(rule)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, string(data))
+	}
+
+	return ret, nil
+}
+
+// diffRules returns the rules only in next, and the rules only in
+// current.
+func diffRules(current, next []string) ([]string, []string) {
+	var added, removed []string
+	for _, rule := range next {
+		if !slices.Contains(current, rule) {
+			added = append(added, rule)
+		}
+	}
+	for _, rule := range current {
+		if !slices.Contains(next, rule) {
+			removed = append(removed, rule)
+		}
+	}
+
+	return added, removed
+}
@@ -8,13 +8,13 @@ import (
 	"net/netip"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
-	"github.com/rs/zerolog/log"
 	"github.com/tailscale/hujson"
 	"go4.org/netipx"
 	"gopkg.in/yaml.v3"
@@ -22,15 +22,27 @@ import (
 )
 
 var (
-	ErrEmptyPolicy       = errors.New("empty policy")
-	ErrInvalidAction     = errors.New("invalid action")
-	ErrInvalidGroup      = errors.New("invalid group")
-	ErrInvalidTag        = errors.New("invalid tag")
-	ErrInvalidPortFormat = errors.New("invalid port format")
-	ErrWildcardIsNeeded  = errors.New("wildcard as port is required for the protocol")
+	ErrEmptyPolicy        = errors.New("empty policy")
+	ErrInvalidAction      = errors.New("invalid action")
+	ErrInvalidGroup       = errors.New("invalid group")
+	ErrInvalidTag         = errors.New("invalid tag")
+	ErrInvalidPortFormat  = errors.New("invalid port format")
+	ErrWildcardIsNeeded   = errors.New("wildcard as port is required for the protocol")
+	ErrDangerAllAsDest    = errors.New("autogroup:danger-all can't be used as a destination")
+	ErrAutogroupSelfSrc   = errors.New("autogroup:self can only be used with users, groups, or supported autogroups")
+	ErrAutogroupSelfAlias = errors.New("autogroup:self can only be used as a destination")
+	ErrTagsNotPermitted   = errors.New("invalid or not permitted")
+	ErrInvalidSSHAction   = errors.New("invalid SSH action")
 )
 
 const (
+	autogroupInternet  = "autogroup:internet"
+	autogroupDangerAll = "autogroup:danger-all"
+	autogroupSelf      = "autogroup:self"
+	autogroupMember    = "autogroup:member"
+	autogroupTagged    = "autogroup:tagged"
+	autogroupNonRoot   = "autogroup:nonroot"
+
 	portRangeBegin     = 0
 	portRangeEnd       = 65535
 	expectedTokenItems = 2
@@ -87,7 +99,7 @@ const (
 
 // LoadACLPolicyFromPath loads the ACL policy from the specify path, and generates the ACL rules.
 func LoadACLPolicyFromPath(path string) (*ACLPolicy, error) {
-	log.Debug().
+	util.LogPolicy.Debug().
 		Str("func", "LoadACLPolicy").
 		Str("path", path).
 		Msg("Loading ACL policy from path")
@@ -103,7 +115,7 @@ func LoadACLPolicyFromPath(path string) (*ACLPolicy, error) {
 		return nil, err
 	}
 
-	log.Debug().
+	util.LogPolicy.Debug().
 		Str("path", path).
 		Bytes("file", policyBytes).
 		Msg("Loading ACLs")
@@ -143,9 +155,105 @@ func LoadACLPolicyFromBytes(acl []byte, format string) (*ACLPolicy, error) {
 		return nil, ErrEmptyPolicy
 	}
 
+	if err := policy.validate(); err != nil {
+		return nil, err
+	}
+
+	// The external IP sets are loaded by the refresher, a set which
+	// cannot be reached does not fail the load of the policy.
+	if policy.HasHostSources() {
+		policy.hostSources = &hostSources{}
+	}
+
 	return &policy, nil
 }
 
+// validate checks the parts of the policy which do not depend on the
+// nodes, so an invalid policy is rejected when it is loaded instead of
+// when the rules are compiled.
+func (pol *ACLPolicy) validate() error {
+	if err := pol.validateHosts(); err != nil {
+		return err
+	}
+
+	for index, grant := range pol.Grants {
+		if err := validateGrant(grant); err != nil {
+			return fmt.Errorf("%w, grant index: %d: %w", ErrInvalidGrant, index, err)
+		}
+	}
+
+	for index, acl := range pol.ACLs {
+		if err := pol.validateAutogroupSelf(acl); err != nil {
+			return fmt.Errorf("acl index: %d: %w", index, err)
+		}
+
+		if err := validateDenyRule(acl); err != nil {
+			return fmt.Errorf("acl index: %d: %w", index, err)
+		}
+	}
+
+	if err := pol.validatePostures(); err != nil {
+		return err
+	}
+
+	for index, acl := range pol.ACLs {
+		if err := validateLabelAliases(acl); err != nil {
+			return fmt.Errorf("acl index: %d: %w", index, err)
+		}
+	}
+
+	for index, autoTag := range pol.AutoTags {
+		if err := pol.validateAutoTag(autoTag); err != nil {
+			return fmt.Errorf("%w, autoTag index: %d: %w", ErrInvalidAutoTag, index, err)
+		}
+	}
+
+	for index, ssh := range pol.SSHs {
+		if err := validateSSHAction(ssh); err != nil {
+			return fmt.Errorf("%w, ssh index: %d: %w", ErrInvalidSSHAction, index, err)
+		}
+
+		if err := validateSSHRecorders(ssh); err != nil {
+			return fmt.Errorf("%w, ssh index: %d: %w", ErrInvalidSSHRecorder, index, err)
+		}
+	}
+
+	for index, nodeAttr := range pol.NodeAttrs {
+		if err := validateNodeAttr(nodeAttr); err != nil {
+			return fmt.Errorf("%w, nodeAttr index: %d: %w", ErrInvalidNodeAttr, index, err)
+		}
+	}
+
+	return nil
+}
+
+// validateAutogroupSelf checks that an ACL with autogroup:self as a
+// destination only has sources which resolve to users, as the rule is
+// compiled per user.
+func (pol *ACLPolicy) validateAutogroupSelf(acl ACL) error {
+	hasSelf := false
+	for _, dest := range acl.Destinations {
+		alias, _, err := parseDestination(dest)
+		if err == nil && alias == autogroupSelf {
+			hasSelf = true
+
+			break
+		}
+	}
+
+	if !hasSelf {
+		return nil
+	}
+
+	for _, src := range acl.Sources {
+		if !isGroup(src) && !pol.isUser(src) && src != autogroupMember {
+			return fmt.Errorf("%w, got source %q", ErrAutogroupSelfSrc, src)
+		}
+	}
+
+	return nil
+}
+
 func GenerateFilterAndSSHRulesForTests(
 	policy *ACLPolicy,
 	node *types.Node,
@@ -161,9 +269,9 @@ func GenerateFilterAndSSHRulesForTests(
 		return []tailcfg.FilterRule{}, &tailcfg.SSHPolicy{}, err
 	}
 
-	log.Trace().Interface("ACL", rules).Str("node", node.GivenName).Msg("ACL rules")
+	util.LogPolicy.Trace().Interface("ACL", rules).Str("node", node.GivenName).Msg("ACL rules")
 
-	sshPolicy, err := policy.CompileSSHPolicy(node, peers)
+	sshPolicy, err := policy.CompileSSHPolicy(node, peers, types.SSHRecordingConfig{})
 	if err != nil {
 		return []tailcfg.FilterRule{}, &tailcfg.SSHPolicy{}, err
 	}
@@ -181,42 +289,63 @@ func (pol *ACLPolicy) CompileFilterRules(
 	}
 
 	var rules []tailcfg.FilterRule
+	var denies []tailcfg.FilterRule
 
 	for index, acl := range pol.ACLs {
-		if acl.Action != "accept" {
+		deny := isDenyAction(acl.Action)
+		if acl.Action != "accept" && !deny {
 			return nil, ErrInvalidAction
 		}
 
 		var srcIPs []string
-		for srcIndex, src := range acl.Sources {
-			srcs, err := pol.expandSource(src, nodes)
+		if len(acl.SrcPosture) > 0 {
+			srcs, err := pol.expandPostureSources(acl.Sources, acl.SrcPosture, nodes)
 			if err != nil {
-				return nil, fmt.Errorf("parsing policy, acl index: %d->%d: %w", index, srcIndex, err)
+				return nil, fmt.Errorf("parsing policy, acl index: %d: %w", index, err)
+			}
+			for _, prefix := range srcs.Prefixes() {
+				srcIPs = append(srcIPs, prefix.String())
+			}
+		} else {
+			for srcIndex, src := range acl.Sources {
+				srcs, err := pol.expandSource(src, nodes)
+				if err != nil {
+					return nil, fmt.Errorf("parsing policy, acl index: %d->%d: %w", index, srcIndex, err)
+				}
+				srcIPs = append(srcIPs, srcs...)
 			}
-			srcIPs = append(srcIPs, srcs...)
 		}
 
-		protocols, isWildcard, err := parseProtocol(acl.Protocol)
+		protocols, isWildcard, err := parseProtocols(acl.Protocol)
 		if err != nil {
 			return nil, fmt.Errorf("parsing policy, protocol err: %w ", err)
 		}
 
 		destPorts := []tailcfg.NetPortRange{}
+		var selfPorts []tailcfg.PortRange
 		for _, dest := range acl.Destinations {
 			alias, port, err := parseDestination(dest)
 			if err != nil {
 				return nil, err
 			}
 
-			expanded, err := pol.ExpandAlias(
-				nodes,
-				alias,
-			)
+			ports, err := expandPorts(port, isWildcard)
 			if err != nil {
 				return nil, err
 			}
 
-			ports, err := expandPorts(port, isWildcard)
+			// autogroup:self depends on the source, it is compiled
+			// to a rule per user below.
+			if alias == autogroupSelf {
+				selfPorts = append(selfPorts, *ports...)
+
+				continue
+			}
+
+			expanded, err := pol.expandDestination(
+				nodes,
+				alias,
+			)
 			if err != nil {
 				return nil, err
 			}
@@ -234,6 +363,138 @@ func (pol *ACLPolicy) CompileFilterRules(
 			destPorts = append(destPorts, dests...)
 		}
 
+		if deny {
+			if len(selfPorts) > 0 {
+				return nil, fmt.Errorf("parsing policy, acl index: %d: %w", index, errDenyAutogroupSelf)
+			}
+
+			denies = append(denies, tailcfg.FilterRule{
+				SrcIPs:   srcIPs,
+				DstPorts: destPorts,
+				IPProto:  protocols,
+			})
+
+			continue
+		}
+
+		if len(selfPorts) > 0 {
+			selfRules, err := pol.compileAutogroupSelf(acl, selfPorts, protocols, nodes)
+			if err != nil {
+				return nil, fmt.Errorf("parsing policy, acl index: %d: %w", index, err)
+			}
+			rules = append(rules, subtractDenyRules(selfRules, denies)...)
+
+			// All the destinations were autogroup:self.
+			if len(destPorts) == 0 {
+				continue
+			}
+		}
+
+		rules = append(rules, subtractDenyRules([]tailcfg.FilterRule{{
+			SrcIPs:   srcIPs,
+			DstPorts: destPorts,
+			IPProto:  protocols,
+		}}, denies)...)
+	}
+
+	grantRules, err := pol.compileGrants(nodes)
+	if err != nil {
+		return nil, err
+	}
+	rules = append(rules, grantRules...)
+
+	return rules, nil
+}
+
+// compileAutogroupSelf generates the rules for the autogroup:self
+// destinations of an ACL, one per user in the sources, allowing the
+// user's untagged nodes to reach each other on the given ports.
+func (pol *ACLPolicy) compileAutogroupSelf(
+	acl ACL,
+	ports []tailcfg.PortRange,
+	protocols []int,
+	nodes types.Nodes,
+) ([]tailcfg.FilterRule, error) {
+	if err := pol.validateAutogroupSelf(acl); err != nil {
+		return nil, err
+	}
+
+	var users []string
+	for _, src := range acl.Sources {
+		if isGroup(src) {
+			groupUsers, err := pol.expandUsersFromGroup(src)
+			if err != nil {
+				return nil, err
+			}
+			users = append(users, groupUsers...)
+
+			continue
+		}
+
+		// autogroup:member is every user with an untagged node.
+		if src == autogroupMember {
+			for _, node := range nodes {
+				if !pol.isTagged(node) {
+					users = append(users, node.User.Name)
+				}
+			}
+
+			continue
+		}
+
+		users = append(users, src)
+	}
+
+	// With srcPosture, only the user's nodes matching the postures can
+	// reach the others.
+	srcNodes := nodes
+	if len(acl.SrcPosture) > 0 {
+		var err error
+		srcNodes, err = pol.nodesMatchingPostures(acl.SrcPosture, nodes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var rules []tailcfg.FilterRule
+	seen := make(map[string]bool)
+	for _, user := range users {
+		if seen[user] {
+			continue
+		}
+		seen[user] = true
+
+		ips, err := pol.expandIPsFromUser(user, nodes)
+		if err != nil {
+			return nil, err
+		}
+
+		srcs, err := pol.expandIPsFromUser(user, srcNodes)
+		if err != nil {
+			return nil, err
+		}
+
+		// The user has no untagged nodes, or none matching the
+		// postures.
+		if ips == nil || srcs == nil {
+			continue
+		}
+
+		var srcIPs []string
+		for _, prefix := range srcs.Prefixes() {
+			srcIPs = append(srcIPs, prefix.String())
+		}
+
+		var destPorts []tailcfg.NetPortRange
+		for _, prefix := range ips.Prefixes() {
+			for _, port := range ports {
+				destPorts = append(destPorts, tailcfg.NetPortRange{
+					IP:    prefix.String(),
+					Ports: port,
+				})
+			}
+		}
+
 		rules = append(rules, tailcfg.FilterRule{
 			SrcIPs:   srcIPs,
 			DstPorts: destPorts,
@@ -280,11 +541,14 @@ func ReduceFilterRules(node *types.Node, rules []tailcfg.FilterRule) []tailcfg.F
 			}
 		}
 
-		if len(dests) > 0 {
+		capGrants := reduceCapGrants(node, rule.CapGrant)
+
+		if len(dests) > 0 || len(capGrants) > 0 {
 			ret = append(ret, tailcfg.FilterRule{
 				SrcIPs:   rule.SrcIPs,
 				DstPorts: dests,
 				IPProto:  rule.IPProto,
+				CapGrant: capGrants,
 			})
 		}
 	}
@@ -295,6 +559,7 @@ func ReduceFilterRules(node *types.Node, rules []tailcfg.FilterRule) []tailcfg.F
 func (pol *ACLPolicy) CompileSSHPolicy(
 	node *types.Node,
 	peers types.Nodes,
+	recording types.SSHRecordingConfig,
 ) (*tailcfg.SSHPolicy, error) {
 	if pol == nil {
 		return nil, nil
@@ -325,7 +590,7 @@ func (pol *ACLPolicy) CompileSSHPolicy(
 	for index, sshACL := range pol.SSHs {
 		var dest netipx.IPSetBuilder
 		for _, src := range sshACL.Destinations {
-			expanded, err := pol.ExpandAlias(append(peers, node), src)
+			expanded, err := pol.expandDestination(append(peers, node), src)
 			if err != nil {
 				return nil, err
 			}
@@ -356,6 +621,8 @@ func (pol *ACLPolicy) CompileSSHPolicy(
 			return nil, fmt.Errorf("parsing SSH policy, unknown action %q, index: %d: %w", sshACL.Action, index, err)
 		}
 
+		action = withSSHRecorders(action, sshACL, pol.sshRecorders(sshACL, peers, recording))
+
 		principals := make([]*tailcfg.SSHPrincipal, 0, len(sshACL.Sources))
 		for innerIndex, rawSrc := range sshACL.Sources {
 			if isWildcard(rawSrc) {
@@ -389,13 +656,9 @@ func (pol *ACLPolicy) CompileSSHPolicy(
 			}
 		}
 
-		userMap := make(map[string]string, len(sshACL.Users))
-		for _, user := range sshACL.Users {
-			userMap[user] = "="
-		}
 		rules = append(rules, &tailcfg.SSHRule{
 			Principals: principals,
-			SSHUsers:   userMap,
+			SSHUsers:   sshUsers(sshACL.Users),
 			Action:     &action,
 		})
 	}
@@ -405,19 +668,93 @@ func (pol *ACLPolicy) CompileSSHPolicy(
 	}, nil
 }
 
+// sshUsers maps the users of an SSH rule to the local users the node
+// allows logging in as. autogroup:nonroot allows any local user but
+// root, unless root is listed explicitly.
+func sshUsers(users []string) map[string]string {
+	userMap := make(map[string]string, len(users))
+	for _, user := range users {
+		if user == autogroupNonRoot {
+			userMap["*"] = "="
+			if _, ok := userMap["root"]; !ok {
+				userMap["root"] = ""
+			}
+
+			continue
+		}
+
+		userMap[user] = "="
+	}
+
+	return userMap
+}
+
+const (
+	defaultSSHCheckPeriod = 12 * time.Hour
+	minSSHCheckPeriod     = time.Minute
+	maxSSHCheckPeriod     = 7 * 24 * time.Hour
+)
+
+// validateSSHAction checks the action of an SSH rule, and that its
+// checkPeriod is only set for the check action and is between a minute
+// and a week.
+func validateSSHAction(ssh SSH) error {
+	switch ssh.Action {
+	case "accept":
+		if ssh.CheckPeriod != "" {
+			return errors.New("checkPeriod can only be used with the check action")
+		}
+
+		return nil
+
+	case "check":
+		if ssh.CheckPeriod == "" {
+			return nil
+		}
+
+		checkPeriod, err := time.ParseDuration(ssh.CheckPeriod)
+		if err != nil {
+			return fmt.Errorf("parsing checkPeriod: %w", err)
+		}
+
+		if checkPeriod < minSSHCheckPeriod || checkPeriod > maxSSHCheckPeriod {
+			return fmt.Errorf(
+				"checkPeriod must be between %s and %s, got %s",
+				minSSHCheckPeriod,
+				maxSSHCheckPeriod,
+				checkPeriod,
+			)
+		}
+
+		return nil
+
+	default:
+		return fmt.Errorf("unknown action %q", ssh.Action)
+	}
+}
+
+// sshCheckAction holds the connection and delegates the decision to
+// headscale, which asks the user to authenticate again unless they have
+// done so within the check period. The URL is fetched by the destination
+// node over Noise after tailscaled has expanded the variables, the host
+// is not used.
 func sshCheckAction(duration string) (*tailcfg.SSHAction, error) {
-	sessionLength, err := time.ParseDuration(duration)
-	if err != nil {
-		return nil, err
+	checkPeriod := defaultSSHCheckPeriod
+	if duration != "" {
+		var err error
+		checkPeriod, err = time.ParseDuration(duration)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return &tailcfg.SSHAction{
 		Message:                  "",
 		Reject:                   false,
-		Accept:                   true,
-		SessionDuration:          sessionLength,
+		Accept:                   false,
+		SessionDuration:          0,
 		AllowAgentForwarding:     false,
-		HoldAndDelegate:          "",
+		HoldAndDelegate:          "https://unused/machine/ssh/action/from/$SRC_NODE_ID/to/$DST_NODE_ID?ssh_user=$SSH_USER&local_user=$LOCAL_USER&check_period=" + checkPeriod.String(),
 		AllowLocalPortForwarding: true,
 	}, nil
 }
@@ -432,7 +769,7 @@ func parseDestination(dest string) (string, string, error) {
 		port := tokens[len(tokens)-1]
 
 		maybeIPv6Str := strings.TrimSuffix(dest, ":"+port)
-		log.Trace().Str("maybeIPv6Str", maybeIPv6Str).Msg("")
+		util.LogPolicy.Trace().Str("maybeIPv6Str", maybeIPv6Str).Msg("")
 
 		filteredMaybeIPv6Str := maybeIPv6Str
 		if strings.Contains(maybeIPv6Str, "/") {
@@ -441,7 +778,7 @@ func parseDestination(dest string) (string, string, error) {
 		}
 
 		if maybeIPv6, err := netip.ParseAddr(filteredMaybeIPv6Str); err != nil && !maybeIPv6.Is6() {
-			log.Trace().Err(err).Msg("trying to parse as IPv6")
+			util.LogPolicy.Trace().Err(err).Msg("trying to parse as IPv6")
 
 			return "", "", fmt.Errorf(
 				"failed to parse destination, tokens %v: %w",
@@ -471,6 +808,42 @@ func parseDestination(dest string) (string, string, error) {
 	return alias, tokens[len(tokens)-1], nil
 }
 
+// parseProtocols merges the protocols of the proto field of an ACL, see
+// parseProtocol. The destinations must use wildcard as port number if
+// any of the protocols does not support ports.
+func parseProtocols(protocols Protocols) ([]int, bool, error) {
+	if len(protocols) <= 1 {
+		var protocol string
+		if len(protocols) == 1 {
+			protocol = protocols[0]
+		}
+
+		return parseProtocol(protocol)
+	}
+
+	var merged []int
+	var needsWildcard bool
+	for _, protocol := range protocols {
+		if protocol == "" {
+			return nil, false, errors.New("empty protocol in a list of protocols")
+		}
+
+		numbers, wildcard, err := parseProtocol(protocol)
+		if err != nil {
+			return nil, false, err
+		}
+		needsWildcard = needsWildcard || wildcard
+
+		for _, number := range numbers {
+			if !slices.Contains(merged, number) {
+				merged = append(merged, number)
+			}
+		}
+	}
+
+	return merged, needsWildcard, nil
+}
+
 // parseProtocol reads the proto field of the ACL and generates a list of
 // protocols that will be allowed, following the IANA IP protocol number
 // https://www.iana.org/assignments/protocol-numbers/protocol-numbers.xhtml
@@ -540,10 +913,30 @@ func (pol *ACLPolicy) expandSource(
 	return prefixes, nil
 }
 
+// expandDestination expands an alias used as a destination, which can
+// be any alias except autogroup:danger-all. Users and groups also cover
+// the nodes shared with their users.
+func (pol *ACLPolicy) expandDestination(
+	nodes types.Nodes,
+	alias string,
+) (*netipx.IPSet, error) {
+	if alias == autogroupDangerAll {
+		return nil, ErrDangerAllAsDest
+	}
+
+	ips, err := pol.ExpandAlias(nodes, alias)
+	if err != nil {
+		return nil, err
+	}
+
+	return pol.withSharedNodes(ips, alias, nodes)
+}
+
 // expandalias has an input of either
 // - a user
 // - a group
 // - a tag
+// - a label selector
 // - a host
 // - an ip
 // - a cidr
@@ -559,7 +952,7 @@ func (pol *ACLPolicy) ExpandAlias(
 
 	build := netipx.IPSetBuilder{}
 
-	log.Debug().
+	util.LogPolicy.Debug().
 		Str("alias", alias).
 		Msg("Expanding")
 
@@ -573,8 +966,12 @@ func (pol *ACLPolicy) ExpandAlias(
 		return pol.expandIPsFromTag(alias, nodes)
 	}
 
+	if isLabel(alias) {
+		return expandIPsFromLabel(alias, nodes)
+	}
+
 	if isAutoGroup(alias) {
-		return expandAutoGroup(alias)
+		return pol.expandAutoGroup(alias, nodes)
 	}
 
 	// if alias is a user
@@ -583,11 +980,8 @@ func (pol *ACLPolicy) ExpandAlias(
 	}
 
 	// if alias is an host
-	// Note, this is recursive.
-	if h, ok := pol.Hosts[alias]; ok {
-		log.Trace().Str("host", h.String()).Msg("ExpandAlias got hosts entry")
-
-		return pol.ExpandAlias(nodes, h.String())
+	if _, ok := pol.Hosts[alias]; ok {
+		return pol.expandIPsFromHost(alias, nodes)
 	}
 
 	// if alias is an IP
@@ -600,7 +994,7 @@ func (pol *ACLPolicy) ExpandAlias(
 		return pol.expandIPsFromIPPrefix(prefix, nodes)
 	}
 
-	log.Warn().Msgf("No IPs found with the alias %v", alias)
+	util.LogPolicy.Warn().Msgf("No IPs found with the alias %v", alias)
 
 	return build.IPSet()
 }
@@ -630,7 +1024,7 @@ func excludeCorrectlyTaggedNodes(
 			continue
 		}
 
-		for _, t := range node.Hostinfo.RequestTags {
+		for _, t := range aclPolicy.requestedTags(node) {
 			if util.StringOrPrefixListContains(tags, t) {
 				found = true
 
@@ -661,7 +1055,7 @@ func expandPorts(portsStr string, isWild bool) (*[]tailcfg.PortRange, error) {
 
 	var ports []tailcfg.PortRange
 	for _, portStr := range strings.Split(portsStr, ",") {
-		log.Trace().Msgf("parsing portstring: %s", portStr)
+		util.LogPolicy.Trace().Msgf("parsing portstring: %s", portStr)
 		rang := strings.Split(portStr, "-")
 		switch len(rang) {
 		case 1:
@@ -736,9 +1130,9 @@ func (pol *ACLPolicy) expandUsersFromGroup(
 	group string,
 ) ([]string, error) {
 	var users []string
-	log.Trace().Caller().Interface("pol", pol).Msg("test")
+	util.LogPolicy.Trace().Caller().Interface("pol", pol).Msg("test")
 	aclGroups, ok := pol.Groups[group]
-	if !ok {
+	if !ok && pol.idpGroups == nil {
 		return []string{}, fmt.Errorf(
 			"group %v isn't registered. %w",
 			group,
@@ -763,6 +1157,9 @@ func (pol *ACLPolicy) expandUsersFromGroup(
 		users = append(users, grp)
 	}
 
+	// The members given by the identity provider are user names already.
+	users = append(users, pol.idpGroups.get(group)...)
+
 	return users, nil
 }
 
@@ -826,7 +1223,7 @@ func (pol *ACLPolicy) expandIPsFromTag(
 				continue
 			}
 
-			if util.StringOrPrefixListContains(node.Hostinfo.RequestTags, alias) {
+			if util.StringOrPrefixListContains(pol.requestedTags(node), alias) {
 				node.AppendToIPSet(&build)
 			}
 		}
@@ -860,7 +1257,7 @@ func (pol *ACLPolicy) expandIPsFromSingleIP(
 	ip netip.Addr,
 	nodes types.Nodes,
 ) (*netipx.IPSet, error) {
-	log.Trace().Str("ip", ip.String()).Msg("ExpandAlias got ip")
+	util.LogPolicy.Trace().Str("ip", ip.String()).Msg("ExpandAlias got ip")
 
 	matches := nodes.FilterByIP(ip)
 
@@ -878,7 +1275,7 @@ func (pol *ACLPolicy) expandIPsFromIPPrefix(
 	prefix netip.Prefix,
 	nodes types.Nodes,
 ) (*netipx.IPSet, error) {
-	log.Trace().Str("prefix", prefix.String()).Msg("expandAlias got prefix")
+	util.LogPolicy.Trace().Str("prefix", prefix.String()).Msg("expandAlias got prefix")
 	var build netipx.IPSetBuilder
 	build.AddPrefix(prefix)
 
@@ -886,7 +1283,7 @@ func (pol *ACLPolicy) expandIPsFromIPPrefix(
 	// addresses for the hosts that belong to tailscale. This doesnt really affect stuff like subnet routers.
 	for _, node := range nodes {
 		for _, ip := range node.IPs() {
-			// log.Trace().
+			// util.LogPolicy.Trace().
 			// 	Msgf("checking if node ip (%s) is part of prefix (%s): %v, is single ip prefix (%v), addr: %s", ip.String(), prefix.String(), prefix.Contains(ip), prefix.IsSingleIP(), prefix.Addr().String())
 			if prefix.Contains(ip) {
 				node.AppendToIPSet(&build)
@@ -897,11 +1294,34 @@ func (pol *ACLPolicy) expandIPsFromIPPrefix(
 	return build.IPSet()
 }
 
-func expandAutoGroup(alias string) (*netipx.IPSet, error) {
+// expandAutoGroup returns the IPs of an autogroup. autogroup:self
+// depends on the source and is compiled separately, and
+// autogroup:nonroot is only an SSH user.
+func (pol *ACLPolicy) expandAutoGroup(alias string, nodes types.Nodes) (*netipx.IPSet, error) {
 	switch {
-	case strings.HasPrefix(alias, "autogroup:internet"):
+	case strings.HasPrefix(alias, autogroupInternet):
 		return theInternet(), nil
 
+	// autogroup:danger-all matches all IP addresses, including the
+	// ones outside of the tailnet, and can only be used as a source.
+	case alias == autogroupDangerAll:
+		return util.ParseIPSet("*", nil)
+
+	// autogroup:member matches the nodes of users, autogroup:tagged the
+	// tagged nodes, the same split as the autoApprovers.
+	case alias == autogroupMember, alias == autogroupTagged:
+		var build netipx.IPSetBuilder
+		for _, node := range nodes {
+			if pol.isTagged(node) == (alias == autogroupTagged) {
+				node.AppendToIPSet(&build)
+			}
+		}
+
+		return build.IPSet()
+
+	case alias == autogroupSelf:
+		return nil, ErrAutogroupSelfAlias
+
 	default:
 		return nil, fmt.Errorf("unknown autogroup %q", alias)
 	}
@@ -923,6 +1343,32 @@ func isAutoGroup(str string) bool {
 	return strings.HasPrefix(str, "autogroup:")
 }
 
+func isLabel(str string) bool {
+	return strings.HasPrefix(str, labelPrefix)
+}
+
+// isUser reports if the alias can only be a user, as it is not any of
+// the other kinds of alias.
+func (pol *ACLPolicy) isUser(alias string) bool {
+	if isWildcard(alias) || isGroup(alias) || isTag(alias) || isAutoGroup(alias) || isLabel(alias) {
+		return false
+	}
+
+	if _, ok := pol.Hosts[alias]; ok {
+		return false
+	}
+
+	if _, err := netip.ParseAddr(alias); err == nil {
+		return false
+	}
+
+	if _, err := netip.ParsePrefix(alias); err == nil {
+		return false
+	}
+
+	return true
+}
+
 // TagsOfNode will return the tags of the current node.
 // Invalid tags are tags added by a user on a node, and that user doesn't have authority to add this tag.
 // Valid tags are tags added by a user that is allowed in the ACL policy to add this tag.
@@ -940,20 +1386,8 @@ func (pol *ACLPolicy) TagsOfNode(
 	validTagMap := make(map[string]bool)
 	invalidTagMap := make(map[string]bool)
 	if node.Hostinfo != nil {
-		for _, tag := range node.Hostinfo.RequestTags {
-			owners, err := expandOwnersFromTag(pol, tag)
-			if errors.Is(err, ErrInvalidTag) {
-				invalidTagMap[tag] = true
-
-				continue
-			}
-			var found bool
-			for _, owner := range owners {
-				if node.User.Name == owner {
-					found = true
-				}
-			}
-			if found {
+		for _, tag := range pol.requestedTags(node) {
+			if pol.isTagOwner(node.User.Name, tag) {
 				validTagMap[tag] = true
 			} else {
 				invalidTagMap[tag] = true
@@ -970,6 +1404,40 @@ func (pol *ACLPolicy) TagsOfNode(
 	return validTags, invalidTags
 }
 
+// isTagOwner reports if the user is allowed to give the tag to its
+// nodes, directly or through a group in tagOwners.
+func (pol *ACLPolicy) isTagOwner(user string, tag string) bool {
+	owners, err := expandOwnersFromTag(pol, tag)
+	if err != nil {
+		return false
+	}
+
+	return slices.Contains(owners, user)
+}
+
+// CheckRequestedTags returns an error listing the tags the user is not
+// allowed to give to a node it registers, because they are not defined
+// in tagOwners or the user does not own them. Without a policy, there
+// are no tag owners to check against and tags are not enforced.
+func (pol *ACLPolicy) CheckRequestedTags(user string, tags []string) error {
+	if pol == nil {
+		return nil
+	}
+
+	var invalid []string
+	for _, tag := range tags {
+		if !pol.isTagOwner(user, tag) && !slices.Contains(invalid, tag) {
+			invalid = append(invalid, tag)
+		}
+	}
+
+	if len(invalid) > 0 {
+		return fmt.Errorf("requested tags %v are %w", invalid, ErrTagsNotPermitted)
+	}
+
+	return nil
+}
+
 func filterNodesByUser(nodes types.Nodes, user string) types.Nodes {
 	var out types.Nodes
 	for _, node := range nodes {
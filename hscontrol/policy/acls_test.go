@@ -2,6 +2,7 @@ package policy
 
 import (
 	"errors"
+	"fmt"
 	"net/netip"
 	"testing"
 
@@ -179,6 +180,56 @@ func TestParsing(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name:   "parse-protocol-list",
+			format: "hujson",
+			acl: `
+{
+	"hosts": {
+		"host-1": "100.100.100.100",
+	},
+
+	"acls": [
+		{
+			"Action": "accept",
+			"src": [
+				"*",
+			],
+			"proto": ["tcp", "udp", "6"],
+			"dst": [
+				"host-1:53",
+			],
+		},
+		{
+			"Action": "accept",
+			"src": [
+				"*",
+			],
+			"proto": ["icmp", "47"],
+			"dst": [
+				"host-1:*",
+			],
+		},
+	],
+}`,
+			want: []tailcfg.FilterRule{
+				{
+					SrcIPs: []string{"0.0.0.0/0", "::/0"},
+					DstPorts: []tailcfg.NetPortRange{
+						{IP: "100.100.100.100/32", Ports: tailcfg.PortRange{First: 53, Last: 53}},
+					},
+					IPProto: []int{protocolTCP, protocolUDP},
+				},
+				{
+					SrcIPs: []string{"0.0.0.0/0", "::/0"},
+					DstPorts: []tailcfg.NetPortRange{
+						{IP: "100.100.100.100/32", Ports: tailcfg.PortRangeAny},
+					},
+					IPProto: []int{protocolICMP, protocolIPv6ICMP, protocolGRE},
+				},
+			},
+			wantErr: false,
+		},
 		{
 			name:   "port-wildcard",
 			format: "hujson",
@@ -416,6 +467,43 @@ acls:
 	}
 }
 
+func TestParseProtocols(t *testing.T) {
+	tests := []struct {
+		protocols     Protocols
+		want          []int
+		needsWildcard bool
+		wantErr       bool
+	}{
+		{protocols: nil, want: nil},
+		{protocols: Protocols{"tcp"}, want: []int{protocolTCP}},
+		{protocols: Protocols{"tcp", "udp"}, want: []int{protocolTCP, protocolUDP}},
+		{protocols: Protocols{"tcp", "6", "sctp"}, want: []int{protocolTCP, protocolSCTP}},
+		{
+			protocols:     Protocols{"udp", "icmp"},
+			want:          []int{protocolUDP, protocolICMP, protocolIPv6ICMP},
+			needsWildcard: true,
+		},
+		{protocols: Protocols{"tcp", ""}, wantErr: true},
+		{protocols: Protocols{"tcp", "quic"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.protocols), func(t *testing.T) {
+			got, needsWildcard, err := parseProtocols(tt.protocols)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseProtocols() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("parseProtocols() unexpected result (-want +got):\n%s", diff)
+			}
+			if needsWildcard != tt.needsWildcard {
+				t.Errorf("parseProtocols() needsWildcard = %v, want %v", needsWildcard, tt.needsWildcard)
+			}
+		})
+	}
+}
+
 func (s *Suite) TestRuleInvalidGeneration(c *check.C) {
 	acl := []byte(`
 {
@@ -1167,7 +1255,7 @@ func Test_expandAlias(t *testing.T) {
 			field: field{
 				pol: ACLPolicy{
 					Hosts: Hosts{
-						"testy": netip.MustParsePrefix("10.0.0.132/32"),
+						"testy": {Prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.132/32")}},
 					},
 				},
 			},
@@ -1183,7 +1271,7 @@ func Test_expandAlias(t *testing.T) {
 			field: field{
 				pol: ACLPolicy{
 					Hosts: Hosts{
-						"homeNetwork": netip.MustParsePrefix("192.168.1.0/24"),
+						"homeNetwork": {Prefixes: []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")}},
 					},
 				},
 			},
@@ -1397,6 +1485,106 @@ func Test_expandAlias(t *testing.T) {
 			want:    set([]string{"100.64.0.4"}, []string{}),
 			wantErr: false,
 		},
+		{
+			name: "autogroup:member",
+			field: field{
+				pol: ACLPolicy{},
+			},
+			args: args{
+				alias: "autogroup:member",
+				nodes: types.Nodes{
+					&types.Node{
+						IPv4:     iap("100.64.0.1"),
+						User:     types.User{Name: "joe"},
+						Hostinfo: &tailcfg.Hostinfo{},
+					},
+					&types.Node{
+						IPv4:       iap("100.64.0.2"),
+						User:       types.User{Name: "joe"},
+						ForcedTags: []string{"tag:server"},
+						Hostinfo:   &tailcfg.Hostinfo{},
+					},
+				},
+			},
+			want:    set([]string{"100.64.0.1"}, []string{}),
+			wantErr: false,
+		},
+		{
+			name: "autogroup:tagged",
+			field: field{
+				pol: ACLPolicy{},
+			},
+			args: args{
+				alias: "autogroup:tagged",
+				nodes: types.Nodes{
+					&types.Node{
+						IPv4:     iap("100.64.0.1"),
+						User:     types.User{Name: "joe"},
+						Hostinfo: &tailcfg.Hostinfo{},
+					},
+					&types.Node{
+						IPv4:       iap("100.64.0.2"),
+						User:       types.User{Name: "joe"},
+						ForcedTags: []string{"tag:server"},
+						Hostinfo:   &tailcfg.Hostinfo{},
+					},
+				},
+			},
+			want:    set([]string{"100.64.0.2"}, []string{}),
+			wantErr: false,
+		},
+		{
+			name: "autogroup:self outside of a destination",
+			field: field{
+				pol: ACLPolicy{},
+			},
+			args: args{
+				alias: "autogroup:self",
+				nodes: types.Nodes{},
+			},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name: "label selector",
+			field: field{
+				pol: ACLPolicy{},
+			},
+			args: args{
+				alias: "label:env=prod,!legacy",
+				nodes: types.Nodes{
+					&types.Node{
+						IPv4:   iap("100.64.0.1"),
+						Labels: types.NodeLabels{"env": "prod"},
+					},
+					&types.Node{
+						IPv4:   iap("100.64.0.2"),
+						Labels: types.NodeLabels{"env": "prod", "legacy": ""},
+					},
+					&types.Node{
+						IPv4:   iap("100.64.0.3"),
+						Labels: types.NodeLabels{"env": "staging"},
+					},
+					&types.Node{
+						IPv4: iap("100.64.0.4"),
+					},
+				},
+			},
+			want:    set([]string{"100.64.0.1"}, []string{}),
+			wantErr: false,
+		},
+		{
+			name: "invalid label selector",
+			field: field{
+				pol: ACLPolicy{},
+			},
+			args: args{
+				alias: "label:env=prod prod",
+				nodes: types.Nodes{},
+			},
+			want:    nil,
+			wantErr: true,
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -1409,6 +1597,9 @@ func Test_expandAlias(t *testing.T) {
 
 				return
 			}
+			if test.wantErr {
+				return
+			}
 			if diff := cmp.Diff(test.want, got); diff != "" {
 				t.Errorf("expandAlias() unexpected result (-want +got):\n%s", diff)
 			}
@@ -1692,6 +1883,230 @@ func TestACLPolicy_generateFilterRules(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "danger-all-source",
+			field: field{
+				pol: ACLPolicy{
+					ACLs: []ACL{
+						{
+							Action:       "accept",
+							Sources:      []string{"autogroup:danger-all"},
+							Destinations: []string{"100.64.0.1:443"},
+						},
+					},
+				},
+			},
+			args: args{
+				nodes: types.Nodes{
+					&types.Node{
+						IPv4: iap("100.64.0.1"),
+						IPv6: iap("fd7a:115c:a1e0:ab12:4843:2222:6273:2221"),
+					},
+				},
+			},
+			want: []tailcfg.FilterRule{
+				{
+					SrcIPs: []string{"0.0.0.0/0", "::/0"},
+					DstPorts: []tailcfg.NetPortRange{
+						{
+							IP: "100.64.0.1/32",
+							Ports: tailcfg.PortRange{
+								First: 443,
+								Last:  443,
+							},
+						},
+						{
+							IP: "fd7a:115c:a1e0:ab12:4843:2222:6273:2221/128",
+							Ports: tailcfg.PortRange{
+								First: 443,
+								Last:  443,
+							},
+						},
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "danger-all-destination",
+			field: field{
+				pol: ACLPolicy{
+					ACLs: []ACL{
+						{
+							Action:       "accept",
+							Sources:      []string{"*"},
+							Destinations: []string{"autogroup:danger-all:*"},
+						},
+					},
+				},
+			},
+			args: args{
+				nodes: types.Nodes{
+					&types.Node{
+						IPv4: iap("100.64.0.1"),
+						IPv6: iap("fd7a:115c:a1e0:ab12:4843:2222:6273:2221"),
+					},
+				},
+			},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name: "autogroup-self",
+			field: field{
+				pol: ACLPolicy{
+					Groups: Groups{
+						"group:admins": []string{"mickael", "joe"},
+					},
+					ACLs: []ACL{
+						{
+							Action:       "accept",
+							Sources:      []string{"group:admins", "joe"},
+							Destinations: []string{"autogroup:self:22"},
+						},
+					},
+				},
+			},
+			args: args{
+				nodes: types.Nodes{
+					&types.Node{
+						IPv4:     iap("100.64.0.1"),
+						User:     types.User{Name: "mickael"},
+						Hostinfo: &tailcfg.Hostinfo{},
+					},
+					&types.Node{
+						IPv4:     iap("100.64.0.2"),
+						User:     types.User{Name: "mickael"},
+						Hostinfo: &tailcfg.Hostinfo{},
+					},
+					&types.Node{
+						IPv4:       iap("100.64.0.3"),
+						User:       types.User{Name: "mickael"},
+						ForcedTags: []string{"tag:server"},
+						Hostinfo:   &tailcfg.Hostinfo{},
+					},
+					&types.Node{
+						IPv4:     iap("100.64.0.4"),
+						User:     types.User{Name: "joe"},
+						Hostinfo: &tailcfg.Hostinfo{},
+					},
+				},
+			},
+			want: []tailcfg.FilterRule{
+				{
+					SrcIPs: []string{"100.64.0.1/32", "100.64.0.2/32"},
+					DstPorts: []tailcfg.NetPortRange{
+						{
+							IP:    "100.64.0.1/32",
+							Ports: tailcfg.PortRange{First: 22, Last: 22},
+						},
+						{
+							IP:    "100.64.0.2/32",
+							Ports: tailcfg.PortRange{First: 22, Last: 22},
+						},
+					},
+				},
+				{
+					SrcIPs: []string{"100.64.0.4/32"},
+					DstPorts: []tailcfg.NetPortRange{
+						{
+							IP:    "100.64.0.4/32",
+							Ports: tailcfg.PortRange{First: 22, Last: 22},
+						},
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "autogroup-self-member-source",
+			field: field{
+				pol: ACLPolicy{
+					ACLs: []ACL{
+						{
+							Action:       "accept",
+							Sources:      []string{"autogroup:member"},
+							Destinations: []string{"autogroup:self:22"},
+						},
+					},
+				},
+			},
+			args: args{
+				nodes: types.Nodes{
+					&types.Node{
+						IPv4:     iap("100.64.0.1"),
+						User:     types.User{Name: "mickael"},
+						Hostinfo: &tailcfg.Hostinfo{},
+					},
+					&types.Node{
+						IPv4:     iap("100.64.0.2"),
+						User:     types.User{Name: "mickael"},
+						Hostinfo: &tailcfg.Hostinfo{},
+					},
+					&types.Node{
+						IPv4:       iap("100.64.0.3"),
+						User:       types.User{Name: "mickael"},
+						ForcedTags: []string{"tag:server"},
+						Hostinfo:   &tailcfg.Hostinfo{},
+					},
+					&types.Node{
+						IPv4:     iap("100.64.0.4"),
+						User:     types.User{Name: "joe"},
+						Hostinfo: &tailcfg.Hostinfo{},
+					},
+				},
+			},
+			want: []tailcfg.FilterRule{
+				{
+					SrcIPs: []string{"100.64.0.1/32", "100.64.0.2/32"},
+					DstPorts: []tailcfg.NetPortRange{
+						{
+							IP:    "100.64.0.1/32",
+							Ports: tailcfg.PortRange{First: 22, Last: 22},
+						},
+						{
+							IP:    "100.64.0.2/32",
+							Ports: tailcfg.PortRange{First: 22, Last: 22},
+						},
+					},
+				},
+				{
+					SrcIPs: []string{"100.64.0.4/32"},
+					DstPorts: []tailcfg.NetPortRange{
+						{
+							IP:    "100.64.0.4/32",
+							Ports: tailcfg.PortRange{First: 22, Last: 22},
+						},
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "autogroup-self-wildcard-source",
+			field: field{
+				pol: ACLPolicy{
+					ACLs: []ACL{
+						{
+							Action:       "accept",
+							Sources:      []string{"*"},
+							Destinations: []string{"autogroup:self:*"},
+						},
+					},
+				},
+			},
+			args: args{
+				nodes: types.Nodes{
+					&types.Node{
+						IPv4:     iap("100.64.0.1"),
+						User:     types.User{Name: "mickael"},
+						Hostinfo: &tailcfg.Hostinfo{},
+					},
+				},
+			},
+			want:    nil,
+			wantErr: true,
+		},
 		{
 			name: "host1-can-reach-host2-full",
 			field: field{
@@ -1976,7 +2391,7 @@ func TestReduceFilterRules(t *testing.T) {
 			pol: ACLPolicy{
 				Hosts: Hosts{
 					// Exit node
-					"internal": netip.MustParsePrefix("100.64.0.100/32"),
+					"internal": {Prefixes: []netip.Prefix{netip.MustParsePrefix("100.64.0.100/32")}},
 				},
 				Groups: Groups{
 					"group:team": {"user3", "user2", "user1"},
@@ -2026,7 +2441,7 @@ func TestReduceFilterRules(t *testing.T) {
 			pol: ACLPolicy{
 				Hosts: Hosts{
 					// Exit node
-					"internal": netip.MustParsePrefix("100.64.0.100/32"),
+					"internal": {Prefixes: []netip.Prefix{netip.MustParsePrefix("100.64.0.100/32")}},
 				},
 				Groups: Groups{
 					"group:team": {"user3", "user2", "user1"},
@@ -2093,7 +2508,7 @@ func TestReduceFilterRules(t *testing.T) {
 			pol: ACLPolicy{
 				Hosts: Hosts{
 					// Exit node
-					"internal": netip.MustParsePrefix("100.64.0.100/32"),
+					"internal": {Prefixes: []netip.Prefix{netip.MustParsePrefix("100.64.0.100/32")}},
 				},
 				Groups: Groups{
 					"group:team": {"user3", "user2", "user1"},
@@ -2223,7 +2638,7 @@ func TestReduceFilterRules(t *testing.T) {
 			pol: ACLPolicy{
 				Hosts: Hosts{
 					// Exit node
-					"internal": netip.MustParsePrefix("100.64.0.100/32"),
+					"internal": {Prefixes: []netip.Prefix{netip.MustParsePrefix("100.64.0.100/32")}},
 				},
 				Groups: Groups{
 					"group:team": {"user3", "user2", "user1"},
@@ -2300,7 +2715,7 @@ func TestReduceFilterRules(t *testing.T) {
 			pol: ACLPolicy{
 				Hosts: Hosts{
 					// Exit node
-					"internal": netip.MustParsePrefix("100.64.0.100/32"),
+					"internal": {Prefixes: []netip.Prefix{netip.MustParsePrefix("100.64.0.100/32")}},
 				},
 				Groups: Groups{
 					"group:team": {"user3", "user2", "user1"},
@@ -2376,8 +2791,8 @@ func TestReduceFilterRules(t *testing.T) {
 			name: "1817-reduce-breaks-32-mask",
 			pol: ACLPolicy{
 				Hosts: Hosts{
-					"vlan1": netip.MustParsePrefix("172.16.0.0/24"),
-					"dns1":  netip.MustParsePrefix("172.16.0.21/32"),
+					"vlan1": {Prefixes: []netip.Prefix{netip.MustParsePrefix("172.16.0.0/24")}},
+					"dns1":  {Prefixes: []netip.Prefix{netip.MustParsePrefix("172.16.0.21/32")}},
 				},
 				Groups: Groups{
 					"group:access": {"user1"},
@@ -2590,6 +3005,80 @@ func Test_getTags(t *testing.T) {
 	}
 }
 
+func TestCheckRequestedTags(t *testing.T) {
+	pol := &ACLPolicy{
+		Groups: Groups{
+			"group:admins": []string{"alice"},
+		},
+		TagOwners: TagOwners{
+			"tag:joe":    []string{"joe"},
+			"tag:admins": []string{"group:admins"},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		pol     *ACLPolicy
+		user    string
+		tags    []string
+		wantErr string
+	}{
+		{
+			name: "no-tags",
+			pol:  pol,
+			user: "joe",
+		},
+		{
+			name: "owned-by-user",
+			pol:  pol,
+			user: "joe",
+			tags: []string{"tag:joe"},
+		},
+		{
+			name: "owned-by-group",
+			pol:  pol,
+			user: "alice",
+			tags: []string{"tag:admins"},
+		},
+		{
+			name:    "not-owned",
+			pol:     pol,
+			user:    "joe",
+			tags:    []string{"tag:joe", "tag:admins"},
+			wantErr: "requested tags [tag:admins] are invalid or not permitted",
+		},
+		{
+			name:    "not-defined",
+			pol:     pol,
+			user:    "joe",
+			tags:    []string{"tag:unknown", "tag:unknown"},
+			wantErr: "requested tags [tag:unknown] are invalid or not permitted",
+		},
+		{
+			name: "no-policy",
+			user: "joe",
+			tags: []string{"tag:unknown"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.pol.CheckRequestedTags(tt.user, tt.tags)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("CheckRequestedTags() unexpected error: %s", err)
+				}
+
+				return
+			}
+
+			if !errors.Is(err, ErrTagsNotPermitted) || err.Error() != tt.wantErr {
+				t.Errorf("CheckRequestedTags() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func Test_getFilteredByACLPeers(t *testing.T) {
 	type args struct {
 		nodes types.Nodes
@@ -3263,11 +3752,12 @@ func Test_getFilteredByACLPeers(t *testing.T) {
 
 func TestSSHRules(t *testing.T) {
 	tests := []struct {
-		name  string
-		node  types.Node
-		peers types.Nodes
-		pol   ACLPolicy
-		want  *tailcfg.SSHPolicy
+		name      string
+		node      types.Node
+		peers     types.Nodes
+		pol       ACLPolicy
+		recording types.SSHRecordingConfig
+		want      *tailcfg.SSHPolicy
 	}{
 		{
 			name: "peers-can-connect",
@@ -3294,7 +3784,7 @@ func TestSSHRules(t *testing.T) {
 					"group:test": []string{"user1"},
 				},
 				Hosts: Hosts{
-					"client": netip.PrefixFrom(netip.MustParseAddr("100.64.99.42"), 32),
+					"client": {Prefixes: []netip.Prefix{netip.PrefixFrom(netip.MustParseAddr("100.64.99.42"), 32)}},
 				},
 				ACLs: []ACL{
 					{
@@ -3338,13 +3828,15 @@ func TestSSHRules(t *testing.T) {
 						},
 					},
 					SSHUsers: map[string]string{
-						"autogroup:nonroot": "=",
+						"*":    "=",
+						"root": "",
 					},
 					Action: &tailcfg.SSHAction{Accept: true, AllowLocalPortForwarding: true},
 				},
 				{
 					SSHUsers: map[string]string{
-						"autogroup:nonroot": "=",
+						"*":    "=",
+						"root": "",
 					},
 					Principals: []*tailcfg.SSHPrincipal{
 						{
@@ -3360,13 +3852,15 @@ func TestSSHRules(t *testing.T) {
 						},
 					},
 					SSHUsers: map[string]string{
-						"autogroup:nonroot": "=",
+						"*":    "=",
+						"root": "",
 					},
 					Action: &tailcfg.SSHAction{Accept: true, AllowLocalPortForwarding: true},
 				},
 				{
 					SSHUsers: map[string]string{
-						"autogroup:nonroot": "=",
+						"*":    "=",
+						"root": "",
 					},
 					Principals: []*tailcfg.SSHPrincipal{
 						{
@@ -3402,7 +3896,7 @@ func TestSSHRules(t *testing.T) {
 					"group:test": []string{"user1"},
 				},
 				Hosts: Hosts{
-					"client": netip.PrefixFrom(netip.MustParseAddr("100.64.99.42"), 32),
+					"client": {Prefixes: []netip.Prefix{netip.PrefixFrom(netip.MustParseAddr("100.64.99.42"), 32)}},
 				},
 				ACLs: []ACL{
 					{
@@ -3428,11 +3922,79 @@ func TestSSHRules(t *testing.T) {
 			},
 			want: &tailcfg.SSHPolicy{Rules: nil},
 		},
+		{
+			name: "check-delegates-to-headscale",
+			node: types.Node{
+				Hostname: "testnodes",
+				IPv4:     iap("100.64.99.42"),
+				User: types.User{
+					Name: "user1",
+				},
+			},
+			peers: types.Nodes{
+				&types.Node{
+					Hostname: "testnodes2",
+					IPv4:     iap("100.64.0.1"),
+					User: types.User{
+						Name: "user1",
+					},
+					Hostinfo: &tailcfg.Hostinfo{},
+				},
+			},
+			pol: ACLPolicy{
+				SSHs: []SSH{
+					{
+						Action:       "check",
+						Sources:      []string{"user1"},
+						Destinations: []string{"100.64.99.42"},
+						Users:        []string{"root"},
+						CheckPeriod:  "1h",
+					},
+					{
+						Action:       "check",
+						Sources:      []string{"user1"},
+						Destinations: []string{"100.64.99.42"},
+						Users:        []string{"autogroup:nonroot"},
+					},
+				},
+			},
+			want: &tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+				{
+					Principals: []*tailcfg.SSHPrincipal{
+						{
+							NodeIP: "100.64.0.1",
+						},
+					},
+					SSHUsers: map[string]string{
+						"root": "=",
+					},
+					Action: &tailcfg.SSHAction{
+						HoldAndDelegate:          "https://unused/machine/ssh/action/from/$SRC_NODE_ID/to/$DST_NODE_ID?ssh_user=$SSH_USER&local_user=$LOCAL_USER&check_period=1h0m0s",
+						AllowLocalPortForwarding: true,
+					},
+				},
+				{
+					Principals: []*tailcfg.SSHPrincipal{
+						{
+							NodeIP: "100.64.0.1",
+						},
+					},
+					SSHUsers: map[string]string{
+						"*":    "=",
+						"root": "",
+					},
+					Action: &tailcfg.SSHAction{
+						HoldAndDelegate:          "https://unused/machine/ssh/action/from/$SRC_NODE_ID/to/$DST_NODE_ID?ssh_user=$SSH_USER&local_user=$LOCAL_USER&check_period=12h0m0s",
+						AllowLocalPortForwarding: true,
+					},
+				},
+			}},
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := tt.pol.CompileSSHPolicy(&tt.node, tt.peers)
+			got, err := tt.pol.CompileSSHPolicy(&tt.node, tt.peers, tt.recording)
 			assert.NoError(t, err)
 
 			if diff := cmp.Diff(tt.want, got); diff != "" {
@@ -3442,6 +4004,74 @@ func TestSSHRules(t *testing.T) {
 	}
 }
 
+func TestValidateSSHAction(t *testing.T) {
+	tests := []struct {
+		name    string
+		ssh     string
+		wantErr bool
+	}{
+		{
+			name: "accept",
+			ssh:  `{"action": "accept", "src": ["*"], "dst": ["*"], "users": ["autogroup:nonroot"]}`,
+		},
+		{
+			name: "check-default-period",
+			ssh:  `{"action": "check", "src": ["*"], "dst": ["*"], "users": ["root"]}`,
+		},
+		{
+			name: "check-period",
+			ssh:  `{"action": "check", "src": ["*"], "dst": ["*"], "users": ["root"], "checkPeriod": "30m"}`,
+		},
+		{
+			name:    "accept-with-period",
+			ssh:     `{"action": "accept", "src": ["*"], "dst": ["*"], "users": ["root"], "checkPeriod": "30m"}`,
+			wantErr: true,
+		},
+		{
+			name:    "check-invalid-period",
+			ssh:     `{"action": "check", "src": ["*"], "dst": ["*"], "users": ["root"], "checkPeriod": "30"}`,
+			wantErr: true,
+		},
+		{
+			name:    "check-period-too-short",
+			ssh:     `{"action": "check", "src": ["*"], "dst": ["*"], "users": ["root"], "checkPeriod": "10s"}`,
+			wantErr: true,
+		},
+		{
+			name:    "check-period-too-long",
+			ssh:     `{"action": "check", "src": ["*"], "dst": ["*"], "users": ["root"], "checkPeriod": "200h"}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown-action",
+			ssh:     `{"action": "allow", "src": ["*"], "dst": ["*"], "users": ["root"]}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := `{
+				"acls": [{"action": "accept", "src": ["*"], "dst": ["*:*"]}],
+				"ssh": [` + tt.ssh + `],
+			}`
+
+			_, err := LoadACLPolicyFromBytes([]byte(policy), "hujson")
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidSSHAction) {
+					t.Errorf("expected ErrInvalidSSHAction, got %v", err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
 func TestParseDestination(t *testing.T) {
 	tests := []struct {
 		dest      string
@@ -3736,3 +4366,41 @@ func TestValidTagInvalidUser(t *testing.T) {
 		t.Errorf("TestValidTagInvalidUser() unexpected result (-want +got):\n%s", diff)
 	}
 }
+
+func TestLoadPolicyAutogroupSelfSources(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		wantErr bool
+	}{
+		{name: "user", src: "mickael"},
+		{name: "group", src: "group:admins"},
+		{name: "wildcard", src: "*", wantErr: true},
+		{name: "tag", src: "tag:server", wantErr: true},
+		{name: "host", src: "server", wantErr: true},
+		{name: "ip", src: "100.64.0.1", wantErr: true},
+		{name: "prefix", src: "100.64.0.0/24", wantErr: true},
+		{name: "autogroup", src: "autogroup:internet", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadACLPolicyFromBytes([]byte(fmt.Sprintf(`{
+				"groups": {"group:admins": ["mickael"]},
+				"tagOwners": {"tag:server": ["mickael"]},
+				"hosts": {"server": "100.64.0.10"},
+				"acls": [
+					{
+						"action": "accept",
+						"src": [%q],
+						"dst": ["tag:server:22", "autogroup:self:*"],
+					},
+				],
+			}`, tt.src)), "hujson")
+
+			if tt.wantErr != errors.Is(err, ErrAutogroupSelfSrc) {
+				t.Errorf("LoadACLPolicyFromBytes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/tailscale/hujson"
 	"gopkg.in/yaml.v3"
+	"tailscale.com/tailcfg"
 )
 
 // ACLPolicy represents a Tailscale ACL Policy.
@@ -15,29 +16,130 @@ type ACLPolicy struct {
 	Hosts         Hosts         `json:"hosts"         yaml:"hosts"`
 	TagOwners     TagOwners     `json:"tagOwners"     yaml:"tagOwners"`
 	ACLs          []ACL         `json:"acls"          yaml:"acls"`
+	Grants        []Grant       `json:"grants"        yaml:"grants"`
 	Tests         []ACLTest     `json:"tests"         yaml:"tests"`
 	AutoApprovers AutoApprovers `json:"autoApprovers" yaml:"autoApprovers"`
+	AutoTags      []AutoTag     `json:"autoTags"      yaml:"autoTags"`
 	SSHs          []SSH         `json:"ssh"           yaml:"ssh"`
+	NodeAttrs     []NodeAttr    `json:"nodeAttrs"     yaml:"nodeAttrs"`
+	Postures      Postures      `json:"postures"      yaml:"postures"`
+
+	hostSources *hostSources
+	idpGroups   *idpGroups
+	nodeShares  *nodeShares
 }
 
 // ACL is a basic rule for the ACL Policy.
+//
+// If SrcPosture is set, the sources are limited to the nodes satisfying
+// at least one of the postures.
 type ACL struct {
-	Action       string   `json:"action" yaml:"action"`
-	Protocol     string   `json:"proto"  yaml:"proto"`
-	Sources      []string `json:"src"    yaml:"src"`
-	Destinations []string `json:"dst"    yaml:"dst"`
+	Action       string    `json:"action"               yaml:"action"`
+	Protocol     Protocols `json:"proto"                yaml:"proto"`
+	Sources      []string  `json:"src"                  yaml:"src"`
+	Destinations []string  `json:"dst"                  yaml:"dst"`
+	SrcPosture   []string  `json:"srcPosture,omitempty" yaml:"srcPosture,omitempty"`
+}
+
+// Protocols are the protocols an ACL allows, names or IANA numbers,
+// written as a single string or a list of strings.
+type Protocols []string
+
+// Grant gives the sources access to the destinations, either on the
+// network layer (IP) or as application capabilities (App).
+//
+// If Via is set, the destinations must be subnets and the access is
+// only given through the subnet routers with one of the Via tags.
+// If SrcPosture is set, the sources are limited to the nodes satisfying
+// at least one of the postures.
+type Grant struct {
+	Sources      []string           `json:"src"                  yaml:"src"`
+	Destinations []string           `json:"dst"                  yaml:"dst"`
+	IP           []string           `json:"ip,omitempty"         yaml:"ip,omitempty"`
+	App          tailcfg.PeerCapMap `json:"app,omitempty"        yaml:"-"`
+	Via          []string           `json:"via,omitempty"        yaml:"via,omitempty"`
+	SrcPosture   []string           `json:"srcPosture,omitempty" yaml:"srcPosture,omitempty"`
+}
+
+// UnmarshalYAML decodes the free form capability values of App into
+// JSON, which is what is sent to the clients.
+func (grant *Grant) UnmarshalYAML(value *yaml.Node) error {
+	var raw struct {
+		Sources      []string         `yaml:"src"`
+		Destinations []string         `yaml:"dst"`
+		IP           []string         `yaml:"ip"`
+		App          map[string][]any `yaml:"app"`
+		Via          []string         `yaml:"via"`
+		SrcPosture   []string         `yaml:"srcPosture"`
+	}
+
+	if err := value.Decode(&raw); err != nil {
+		return err
+	}
+
+	app, err := capMapFromYAML[tailcfg.PeerCapability](raw.App)
+	if err != nil {
+		return err
+	}
+
+	grant.Sources = raw.Sources
+	grant.Destinations = raw.Destinations
+	grant.IP = raw.IP
+	grant.Via = raw.Via
+	grant.SrcPosture = raw.SrcPosture
+	grant.App = app
+
+	return nil
+}
+
+// capMapFromYAML encodes the free form capability values decoded from
+// YAML as JSON.
+func capMapFromYAML[K ~string](raw map[string][]any) (map[K][]tailcfg.RawMessage, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	capMap := make(map[K][]tailcfg.RawMessage, len(raw))
+	for capName, values := range raw {
+		for _, value := range values {
+			data, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+
+			capMap[K(capName)] = append(capMap[K(capName)], tailcfg.RawMessage(data))
+		}
+	}
+
+	return capMap, nil
 }
 
 // Groups references a series of alias in the ACL rules.
 type Groups map[string][]string
 
 // Hosts are alias for IP addresses or subnets.
-type Hosts map[string]netip.Prefix
+type Hosts map[string]Host
+
+// Host is a list of IP addresses or subnets, external IP sets (files
+// in the hosts directory or URLs) which are loaded and periodically
+// refreshed, see ACLPolicy.RefreshHostSources, and references to other
+// hosts and to groups.
+type Host struct {
+	Prefixes   []netip.Prefix
+	Sources    []string
+	References []string
+}
 
 // TagOwners specify what users (users?) are allow to use certain tags.
 type TagOwners map[string][]string
 
-// ACLTest is not implemented, but should be use to check if a certain rule is allowed.
+// Postures are named lists of conditions on the attributes of a node,
+// such as "node:os == 'macos'", which a node must all satisfy to match
+// the posture.
+type Postures map[string][]string
+
+// ACLTest checks that Source can reach the Accept destinations and
+// cannot reach the Deny destinations, see RunTests.
 type ACLTest struct {
 	Source string   `json:"src"            yaml:"src"`
 	Accept []string `json:"accept"         yaml:"accept"`
@@ -51,6 +153,51 @@ type AutoApprovers struct {
 	ExitNode []string            `json:"exitNode" yaml:"exitNode"`
 }
 
+// AutoTag gives Tag to the nodes with a Hostinfo matching all the
+// fields which are set, if the user of the node owns the tag.
+// Hostname is a regular expression and MinVersion the lowest
+// Tailscale version the node must run.
+type AutoTag struct {
+	Tag        string `json:"tag"                  yaml:"tag"`
+	OS         string `json:"os,omitempty"         yaml:"os,omitempty"`
+	Hostname   string `json:"hostname,omitempty"   yaml:"hostname,omitempty"`
+	MinVersion string `json:"minVersion,omitempty" yaml:"minVersion,omitempty"`
+}
+
+// NodeAttr gives the attributes in Attrs, and the capabilities with
+// values in App, to the nodes matching one of the Targets, which are
+// aliases like in ACLs.
+type NodeAttr struct {
+	Targets []string           `json:"target"        yaml:"target"`
+	Attrs   []string           `json:"attr"          yaml:"attr"`
+	App     tailcfg.NodeCapMap `json:"app,omitempty" yaml:"-"`
+}
+
+// UnmarshalYAML decodes the free form capability values of App into
+// JSON, like for grants.
+func (nodeAttr *NodeAttr) UnmarshalYAML(value *yaml.Node) error {
+	var raw struct {
+		Targets []string         `yaml:"target"`
+		Attrs   []string         `yaml:"attr"`
+		App     map[string][]any `yaml:"app"`
+	}
+
+	if err := value.Decode(&raw); err != nil {
+		return err
+	}
+
+	app, err := capMapFromYAML[tailcfg.NodeCapability](raw.App)
+	if err != nil {
+		return err
+	}
+
+	nodeAttr.Targets = raw.Targets
+	nodeAttr.Attrs = raw.Attrs
+	nodeAttr.App = app
+
+	return nil
+}
+
 // SSH controls who can ssh into which machines.
 type SSH struct {
 	Action       string   `json:"action"                yaml:"action"`
@@ -58,61 +205,178 @@ type SSH struct {
 	Destinations []string `json:"dst"                   yaml:"dst"`
 	Users        []string `json:"users"                 yaml:"users"`
 	CheckPeriod  string   `json:"checkPeriod,omitempty" yaml:"checkPeriod,omitempty"`
+
+	// Recorders are the tags of the nodes the sessions are recorded to,
+	// if EnforceRecorder is set sessions are rejected when they cannot
+	// be recorded.
+	Recorders       []string `json:"recorder,omitempty"        yaml:"recorder,omitempty"`
+	EnforceRecorder bool     `json:"enforceRecorder,omitempty" yaml:"enforceRecorder,omitempty"`
 }
 
 // UnmarshalJSON allows to parse the Hosts directly into netip objects.
 func (hosts *Hosts) UnmarshalJSON(data []byte) error {
-	newHosts := Hosts{}
-	hostIPPrefixMap := make(map[string]string)
 	ast, err := hujson.Parse(data)
 	if err != nil {
 		return err
 	}
 	ast.Standardize()
 	data = ast.Pack()
-	err = json.Unmarshal(data, &hostIPPrefixMap)
-	if err != nil {
+
+	newHosts := make(map[string]Host)
+	if err := json.Unmarshal(data, &newHosts); err != nil {
 		return err
 	}
-	for host, prefixStr := range hostIPPrefixMap {
-		if !strings.Contains(prefixStr, "/") {
-			prefixStr += "/32"
+	*hosts = newHosts
+
+	return nil
+}
+
+// UnmarshalJSON parses a host entry, which is either a single string or
+// a list of strings.
+func (host *Host) UnmarshalJSON(data []byte) error {
+	var entries []string
+	if err := json.Unmarshal(data, &entries); err != nil {
+		var entry string
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+		entries = []string{entry}
+	}
+
+	return host.parse(entries)
+}
+
+// UnmarshalYAML parses a host entry, which is either a single string or
+// a list of strings.
+func (host *Host) UnmarshalYAML(value *yaml.Node) error {
+	var entries []string
+	if value.Kind == yaml.ScalarNode {
+		var entry string
+		if err := value.Decode(&entry); err != nil {
+			return err
+		}
+		entries = []string{entry}
+	} else if err := value.Decode(&entries); err != nil {
+		return err
+	}
+
+	return host.parse(entries)
+}
+
+// MarshalJSON writes the host entry as a single string if possible.
+func (host Host) MarshalJSON() ([]byte, error) {
+	entries := host.entries()
+	if len(entries) == 1 {
+		return json.Marshal(entries[0])
+	}
+
+	return json.Marshal(entries)
+}
+
+func (host Host) entries() []string {
+	entries := make([]string, 0, len(host.Prefixes)+len(host.Sources)+len(host.References))
+	for _, prefix := range host.Prefixes {
+		entries = append(entries, prefix.String())
+	}
+	entries = append(entries, host.Sources...)
+
+	return append(entries, host.References...)
+}
+
+func (host *Host) parse(entries []string) error {
+	*host = Host{}
+
+	for _, entry := range entries {
+		if isHostSource(entry) {
+			if err := validateHostSource(entry); err != nil {
+				return err
+			}
+			host.Sources = append(host.Sources, entry)
+
+			continue
 		}
-		prefix, err := netip.ParsePrefix(prefixStr)
+
+		if isHostReference(entry) {
+			host.References = append(host.References, entry)
+
+			continue
+		}
+
+		prefix, err := parseHostPrefix(entry)
 		if err != nil {
 			return err
 		}
-		newHosts[host] = prefix
+		host.Prefixes = append(host.Prefixes, prefix)
 	}
-	*hosts = newHosts
 
 	return nil
 }
 
-// UnmarshalYAML allows to parse the Hosts directly into netip objects.
-func (hosts *Hosts) UnmarshalYAML(data []byte) error {
-	newHosts := Hosts{}
-	hostIPPrefixMap := make(map[string]string)
+// UnmarshalJSON parses the protocols, which are either a single string
+// or a list of strings.
+func (protocols *Protocols) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		var protocol string
+		if err := json.Unmarshal(data, &protocol); err != nil {
+			return err
+		}
+		list = []string{protocol}
+	}
+	*protocols = list
 
-	err := yaml.Unmarshal(data, &hostIPPrefixMap)
-	if err != nil {
+	return nil
+}
+
+// UnmarshalYAML parses the protocols, which are either a single string
+// or a list of strings.
+func (protocols *Protocols) UnmarshalYAML(value *yaml.Node) error {
+	var list []string
+	if value.Kind == yaml.ScalarNode {
+		var protocol string
+		if err := value.Decode(&protocol); err != nil {
+			return err
+		}
+		list = []string{protocol}
+	} else if err := value.Decode(&list); err != nil {
 		return err
 	}
-	for host, prefixStr := range hostIPPrefixMap {
-		prefix, err := netip.ParsePrefix(prefixStr)
+	*protocols = list
+
+	return nil
+}
+
+// MarshalJSON writes the protocols as a single string if possible.
+func (protocols Protocols) MarshalJSON() ([]byte, error) {
+	switch len(protocols) {
+	case 0:
+		return json.Marshal("")
+	case 1:
+		return json.Marshal(protocols[0])
+	default:
+		return json.Marshal([]string(protocols))
+	}
+}
+
+// parseHostPrefix parses a prefix, or a single IP address which is
+// turned into a prefix only containing that address.
+func parseHostPrefix(str string) (netip.Prefix, error) {
+	if !strings.Contains(str, "/") {
+		addr, err := netip.ParseAddr(str)
 		if err != nil {
-			return err
+			return netip.Prefix{}, err
 		}
-		newHosts[host] = prefix
+
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
 	}
-	*hosts = newHosts
 
-	return nil
+	return netip.ParsePrefix(str)
 }
 
 // IsZero is perhaps a bit naive here.
 func (pol ACLPolicy) IsZero() bool {
-	if len(pol.Groups) == 0 && len(pol.Hosts) == 0 && len(pol.ACLs) == 0 {
+	if len(pol.Groups) == 0 && len(pol.Hosts) == 0 && len(pol.ACLs) == 0 &&
+		len(pol.Grants) == 0 && len(pol.NodeAttrs) == 0 {
 		return true
 	}
 
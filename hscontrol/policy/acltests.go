@@ -0,0 +1,197 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"go4.org/netipx"
+	"tailscale.com/tailcfg"
+)
+
+var ErrPolicyTestFailed = errors.New("policy test failed")
+
+// RunTests evaluates the tests of the policy against the filter rules
+// compiled for the nodes. A test passes if its source can reach all of
+// the accept destinations over TCP, and none of the deny destinations.
+// The source and destinations are resolved with the nodes, so they
+// must match at least one node. All the failing tests are returned.
+func (pol *ACLPolicy) RunTests(nodes types.Nodes) error {
+	if pol == nil || len(pol.Tests) == 0 {
+		return nil
+	}
+
+	rules, err := pol.CompileFilterRules(nodes)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for index, test := range pol.Tests {
+		if err := pol.runTest(test, rules, nodes); err != nil {
+			errs = append(errs, fmt.Errorf("%w, test index: %d: %w", ErrPolicyTestFailed, index, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (pol *ACLPolicy) runTest(
+	test ACLTest,
+	rules []tailcfg.FilterRule,
+	nodes types.Nodes,
+) error {
+	srcs, err := pol.ExpandAlias(nodes, test.Source)
+	if err != nil {
+		return fmt.Errorf("expanding src %q: %w", test.Source, err)
+	}
+
+	if len(srcs.Prefixes()) == 0 {
+		return fmt.Errorf("src %q matches no nodes", test.Source)
+	}
+
+	for _, dest := range test.Accept {
+		dsts, port, err := pol.expandTestDestination(dest, nodes)
+		if err != nil {
+			return err
+		}
+
+		for _, dst := range dsts.Prefixes() {
+			var missing netipx.IPSetBuilder
+			missing.AddSet(srcs)
+			missing.RemoveSet(allowedSources(rules, tcp, port, func(set *netipx.IPSet) bool {
+				return set.ContainsPrefix(dst)
+			}))
+
+			missingSet, err := missing.IPSet()
+			if err != nil {
+				return err
+			}
+
+			if len(missingSet.Prefixes()) > 0 {
+				return fmt.Errorf("%q cannot reach %q, %s to %s is not allowed", test.Source, dest, missingSet.Prefixes()[0], dst)
+			}
+		}
+	}
+
+	for _, dest := range test.Deny {
+		dsts, port, err := pol.expandTestDestination(dest, nodes)
+		if err != nil {
+			return err
+		}
+
+		for _, dst := range dsts.Prefixes() {
+			allowed := allowedSources(rules, tcp, port, func(set *netipx.IPSet) bool {
+				return set.OverlapsPrefix(dst)
+			})
+			if allowed.Overlaps(srcs) {
+				return fmt.Errorf("%q can reach %q, which is denied", test.Source, dest)
+			}
+		}
+	}
+
+	return nil
+}
+
+// tcp is the protocol of the tests.
+var tcp = []int{protocolTCP}
+
+// expandTestDestination returns the IPs and the port of a destination
+// of a test, which like in Tailscale must have a single port.
+func (pol *ACLPolicy) expandTestDestination(
+	dest string,
+	nodes types.Nodes,
+) (*netipx.IPSet, uint16, error) {
+	alias, portStr, err := parseDestination(dest)
+	if err != nil {
+		return nil, 0, fmt.Errorf("parsing destination %q: %w", dest, err)
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("destination %q must have a single port: %w", dest, ErrInvalidPortFormat)
+	}
+
+	dsts, err := pol.ExpandAlias(nodes, alias)
+	if err != nil {
+		return nil, 0, fmt.Errorf("expanding destination %q: %w", dest, err)
+	}
+
+	if len(dsts.Prefixes()) == 0 {
+		return nil, 0, fmt.Errorf("destination %q matches no nodes", dest)
+	}
+
+	return dsts, uint16(port), nil
+}
+
+// allowedSources returns the sources which the rules allow to reach a
+// destination on the port with one of the protocols, the destination of
+// a rule is matched with the given function.
+func allowedSources(
+	rules []tailcfg.FilterRule,
+	protocols []int,
+	port uint16,
+	matchDest func(*netipx.IPSet) bool,
+) *netipx.IPSet {
+	var allowed netipx.IPSetBuilder
+
+	for _, rule := range rules {
+		if !ruleAllowsProtocol(rule, protocols) {
+			continue
+		}
+
+		applies := false
+		for _, dstPort := range rule.DstPorts {
+			if port < dstPort.Ports.First || port > dstPort.Ports.Last {
+				continue
+			}
+
+			set, err := util.ParseIPSet(dstPort.IP, nil)
+			if err != nil {
+				continue
+			}
+
+			if matchDest(set) {
+				applies = true
+
+				break
+			}
+		}
+
+		if !applies {
+			continue
+		}
+
+		for _, src := range rule.SrcIPs {
+			set, err := util.ParseIPSet(src, nil)
+			if err != nil {
+				continue
+			}
+			allowed.AddSet(set)
+		}
+	}
+
+	set, _ := allowed.IPSet()
+
+	return set
+}
+
+// ruleAllowsProtocol reports if the rule allows one of the protocols.
+// A rule without protocols allows TCP, UDP and ICMP.
+func ruleAllowsProtocol(rule tailcfg.FilterRule, protocols []int) bool {
+	ruleProtocols := rule.IPProto
+	if len(ruleProtocols) == 0 {
+		ruleProtocols = []int{protocolTCP, protocolUDP, protocolICMP, protocolIPv6ICMP}
+	}
+
+	for _, protocol := range protocols {
+		if slices.Contains(ruleProtocols, protocol) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,114 @@
+package policy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+func TestRunTests(t *testing.T) {
+	nodes := types.Nodes{
+		&types.Node{
+			IPv4:     iap("100.64.0.1"),
+			User:     types.User{Name: "dev"},
+			Hostinfo: &tailcfg.Hostinfo{},
+		},
+		&types.Node{
+			IPv4:     iap("100.64.0.2"),
+			User:     types.User{Name: "ops"},
+			Hostinfo: &tailcfg.Hostinfo{},
+		},
+		&types.Node{
+			IPv4:       iap("100.64.0.3"),
+			User:       types.User{Name: "ops"},
+			ForcedTags: []string{"tag:server"},
+			Hostinfo:   &tailcfg.Hostinfo{},
+		},
+	}
+
+	pol := func(tests ...ACLTest) *ACLPolicy {
+		return &ACLPolicy{
+			Groups: Groups{
+				"group:ops": []string{"ops"},
+			},
+			TagOwners: TagOwners{
+				"tag:server": []string{"ops"},
+			},
+			ACLs: []ACL{
+				{
+					Action:       "accept",
+					Sources:      []string{"group:ops"},
+					Destinations: []string{"tag:server:22,443"},
+				},
+				{
+					Action:       "accept",
+					Sources:      []string{"dev"},
+					Destinations: []string{"tag:server:443"},
+				},
+				{
+					Action:       "accept",
+					Protocol:     Protocols{"udp"},
+					Sources:      []string{"dev"},
+					Destinations: []string{"tag:server:22"},
+				},
+			},
+			Tests: tests,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		tests   []ACLTest
+		wantErr bool
+	}{
+		{
+			name: "no-tests",
+		},
+		{
+			name: "accept-and-deny-pass",
+			tests: []ACLTest{
+				{Source: "ops", Accept: []string{"tag:server:22", "100.64.0.3:443"}},
+				{Source: "dev", Accept: []string{"tag:server:443"}, Deny: []string{"tag:server:22", "ops:22"}},
+			},
+		},
+		{
+			name: "accept-fails",
+			tests: []ACLTest{
+				{Source: "dev", Accept: []string{"tag:server:22"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "deny-fails",
+			tests: []ACLTest{
+				{Source: "group:ops", Deny: []string{"tag:server:443"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "src-without-nodes",
+			tests: []ACLTest{
+				{Source: "nobody", Accept: []string{"tag:server:443"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "destination-without-port",
+			tests: []ACLTest{
+				{Source: "ops", Accept: []string{"tag:server:*"}},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := pol(tt.tests...).RunTests(nodes)
+			if tt.wantErr != errors.Is(err, ErrPolicyTestFailed) {
+				t.Errorf("RunTests() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/appctype"
+	"tailscale.com/util/dnsname"
+)
+
+// capAppConnectors is the capability of the app field of nodeAttrs
+// configuring the app connectors: the domains and routes they serve,
+// and the tags of the connectors serving them.
+const capAppConnectors tailcfg.NodeCapability = "tailscale.com/app-connectors"
+
+// validateAppConnectors checks that each app connector has connectors,
+// which are tags or "*", and domains or routes to serve.
+func validateAppConnectors(values []tailcfg.RawMessage) error {
+	for _, value := range values {
+		var appConnector appctype.AppConnectorAttr
+		if err := json.Unmarshal([]byte(value), &appConnector); err != nil {
+			return fmt.Errorf("parsing %s: %w", capAppConnectors, err)
+		}
+
+		if len(appConnector.Connectors) == 0 {
+			return fmt.Errorf("app connector %q: connectors must be set", appConnector.Name)
+		}
+
+		for _, connector := range appConnector.Connectors {
+			if connector != "*" && !isTag(connector) {
+				return fmt.Errorf("app connector %q: connectors must be tags or *, got %q", appConnector.Name, connector)
+			}
+		}
+
+		if len(appConnector.Domains) == 0 && len(appConnector.Routes) == 0 {
+			return fmt.Errorf("app connector %q: at least one of domains or routes must be set", appConnector.Name)
+		}
+
+		for _, domain := range appConnector.Domains {
+			if err := validateAppConnectorDomain(domain); err != nil {
+				return fmt.Errorf("app connector %q: domain %q: %w", appConnector.Name, domain, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateAppConnectorDomain checks that each label of the domain is made
+// of letters, digits and hyphens, does not start or end with a hyphen and
+// is not too long. A wildcard is only allowed as the first label.
+func validateAppConnectorDomain(domain string) error {
+	fqdn, err := dnsname.ToFQDN(domain)
+	if err != nil {
+		return err
+	}
+
+	labels := strings.Split(fqdn.WithoutTrailingDot(), ".")
+	if labels[0] == "*" {
+		labels = labels[1:]
+	}
+
+	if len(labels) == 0 {
+		return errors.New("a wildcard must be followed by a domain")
+	}
+
+	for _, label := range labels {
+		if err := dnsname.ValidLabel(label); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AppConnectors returns the app connectors given to the node by the
+// nodeAttrs rules it is a target of.
+func (pol *ACLPolicy) AppConnectors(node *types.Node) ([]appctype.AppConnectorAttr, error) {
+	attrs, err := pol.NodeAttributes(node)
+	if err != nil {
+		return nil, err
+	}
+
+	return tailcfg.UnmarshalNodeCapJSON[appctype.AppConnectorAttr](attrs, capAppConnectors)
+}
+
+// ServesAppConnector reports if the node serves the app connector: it
+// advertises itself as an app connector and has one of the tags of the
+// connectors, or any node can serve it.
+func (pol *ACLPolicy) ServesAppConnector(node *types.Node, appConnector appctype.AppConnectorAttr) bool {
+	if node.Hostinfo == nil || !node.Hostinfo.AppConnector.EqualBool(true) {
+		return false
+	}
+
+	if slices.Contains(appConnector.Connectors, "*") {
+		return true
+	}
+
+	tags, _ := pol.TagsOfNode(node)
+	tags = append(tags, node.ForcedTags...)
+
+	return slices.ContainsFunc(appConnector.Connectors, func(connector string) bool {
+		return slices.Contains(tags, connector)
+	})
+}
+
+// approvesAppConnectorRoute reports if the prefix is within the routes
+// of an app connector the node serves. The addresses the node learns
+// from the DNS answers for the domains are not known to the control
+// server, they are approved by the autoApprovers.
+func (pol *ACLPolicy) approvesAppConnectorRoute(node *types.Node, prefix netip.Prefix) (bool, error) {
+	if pol == nil || len(pol.NodeAttrs) == 0 || prefix.Bits() == 0 {
+		return false, nil
+	}
+
+	appConnectors, err := pol.AppConnectors(node)
+	if err != nil {
+		return false, err
+	}
+
+	for _, appConnector := range appConnectors {
+		if !pol.ServesAppConnector(node, appConnector) {
+			continue
+		}
+
+		for _, route := range appConnector.Routes {
+			if route.Bits() <= prefix.Bits() && route.Contains(prefix.Addr()) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// rejectsAppConnectorRoute reports if the prefix overlaps the addresses
+// of the tailnet and the node serves an app connector with domains. Such
+// a route is never approved, a connector could otherwise take over the
+// addresses of the other nodes by advertising them as learned routes.
+func (pol *ACLPolicy) rejectsAppConnectorRoute(node *types.Node, prefix netip.Prefix) (bool, error) {
+	if pol == nil || len(pol.NodeAttrs) == 0 {
+		return false, nil
+	}
+
+	if !prefix.Overlaps(tsaddr.CGNATRange()) && !prefix.Overlaps(tsaddr.TailscaleULARange()) {
+		return false, nil
+	}
+
+	appConnectors, err := pol.AppConnectors(node)
+	if err != nil {
+		return false, err
+	}
+
+	return slices.ContainsFunc(appConnectors, func(appConnector appctype.AppConnectorAttr) bool {
+		return len(appConnector.Domains) > 0 && pol.ServesAppConnector(node, appConnector)
+	}), nil
+}
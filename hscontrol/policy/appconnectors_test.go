@@ -0,0 +1,205 @@
+package policy
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/appctype"
+	"tailscale.com/types/opt"
+)
+
+const appConnectorPolicy = `{
+	"tagOwners": {"tag:connector": ["user1"]},
+	"autoApprovers": {
+		"routes": {
+			"140.82.112.0/20": ["tag:connector"],
+			"100.64.0.0/10": ["tag:connector"],
+		},
+	},
+	"nodeAttrs": [
+		{
+			"target": ["*"],
+			"app": {
+				"tailscale.com/app-connectors": [
+					{
+						"name": "github",
+						"connectors": ["tag:connector"],
+						"domains": ["github.com", "*.github.com"],
+					},
+					{
+						"name": "office",
+						"connectors": ["tag:connector"],
+						"routes": ["192.0.2.0/24"],
+					},
+				],
+			},
+		},
+	],
+}`
+
+func TestAppConnectors(t *testing.T) {
+	pol, err := LoadACLPolicyFromBytes([]byte(appConnectorPolicy), "hujson")
+	if err != nil {
+		t.Fatalf("loading policy: %s", err)
+	}
+
+	node := &types.Node{
+		IPv4:     iap("100.64.0.1"),
+		User:     types.User{Name: "user2"},
+		Hostinfo: &tailcfg.Hostinfo{},
+	}
+
+	got, err := pol.AppConnectors(node)
+	if err != nil {
+		t.Fatalf("AppConnectors() error = %v", err)
+	}
+
+	want := []appctype.AppConnectorAttr{
+		{
+			Name:       "github",
+			Connectors: []string{"tag:connector"},
+			Domains:    []string{"github.com", "*.github.com"},
+		},
+		{
+			Name:       "office",
+			Connectors: []string{"tag:connector"},
+			Routes:     []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		},
+	}
+	if diff := cmp.Diff(want, got, cmp.Comparer(func(x, y netip.Prefix) bool { return x == y })); diff != "" {
+		t.Errorf("AppConnectors() unexpected result (-want +got):\n%s", diff)
+	}
+}
+
+func TestApprovesAppConnectorRoute(t *testing.T) {
+	pol, err := LoadACLPolicyFromBytes([]byte(appConnectorPolicy), "hujson")
+	if err != nil {
+		t.Fatalf("loading policy: %s", err)
+	}
+
+	connector := &types.Node{
+		IPv4:       iap("100.64.0.1"),
+		User:       types.User{Name: "user1"},
+		ForcedTags: []string{"tag:connector"},
+		Hostinfo:   &tailcfg.Hostinfo{AppConnector: opt.NewBool(true)},
+	}
+	notAdvertising := &types.Node{
+		IPv4:       iap("100.64.0.2"),
+		User:       types.User{Name: "user1"},
+		ForcedTags: []string{"tag:connector"},
+		Hostinfo:   &tailcfg.Hostinfo{},
+	}
+	untagged := &types.Node{
+		IPv4:     iap("100.64.0.3"),
+		User:     types.User{Name: "user1"},
+		Hostinfo: &tailcfg.Hostinfo{AppConnector: opt.NewBool(true)},
+	}
+
+	tests := []struct {
+		name   string
+		node   *types.Node
+		prefix string
+		want   bool
+	}{
+		{name: "learned-route", node: connector, prefix: "140.82.112.3/32", want: true},
+		{name: "learned-route-without-approver", node: connector, prefix: "151.101.1.6/32", want: false},
+		{name: "configured-route", node: connector, prefix: "192.0.2.0/24", want: true},
+		{name: "within-configured-route", node: connector, prefix: "192.0.2.128/25", want: true},
+		{name: "tailnet-address", node: connector, prefix: "100.64.0.2/32", want: false},
+		{name: "tailnet-ula-address", node: connector, prefix: "fd7a:115c:a1e0::2/128", want: false},
+		{name: "exit-route", node: connector, prefix: "0.0.0.0/0", want: false},
+		{name: "not-advertising", node: notAdvertising, prefix: "192.0.2.0/24", want: false},
+		{name: "not-a-connector", node: untagged, prefix: "192.0.2.0/24", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pol.ApprovesRoute(tt.node, netip.MustParsePrefix(tt.prefix))
+			if err != nil {
+				t.Fatalf("ApprovesRoute() error = %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("ApprovesRoute() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadPolicyWithInvalidAppConnector(t *testing.T) {
+	tests := []struct {
+		name         string
+		appConnector string
+	}{
+		{
+			name:         "no-connectors",
+			appConnector: `{"name": "github", "domains": ["github.com"]}`,
+		},
+		{
+			name:         "user-connector",
+			appConnector: `{"name": "github", "connectors": ["user1"], "domains": ["github.com"]}`,
+		},
+		{
+			name:         "no-domains-or-routes",
+			appConnector: `{"name": "github", "connectors": ["tag:connector"]}`,
+		},
+		{
+			name:         "invalid-domain",
+			appConnector: `{"name": "github", "connectors": ["tag:connector"], "domains": ["git hub.com"]}`,
+		},
+		{
+			name:         "leading-hyphen",
+			appConnector: `{"name": "github", "connectors": ["tag:connector"], "domains": ["-github.com"]}`,
+		},
+		{
+			name:         "wildcard-not-first",
+			appConnector: `{"name": "github", "connectors": ["tag:connector"], "domains": ["api.*.github.com"]}`,
+		},
+		{
+			name:         "wildcard-only",
+			appConnector: `{"name": "github", "connectors": ["tag:connector"], "domains": ["*"]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadACLPolicyFromBytes([]byte(`{
+				"nodeAttrs": [
+					{"target": ["*"], "app": {"tailscale.com/app-connectors": [`+tt.appConnector+`]}},
+				],
+			}`), "hujson")
+			if !errors.Is(err, ErrInvalidNodeAttr) {
+				t.Errorf("expected ErrInvalidNodeAttr, got %v", err)
+			}
+		})
+	}
+}
+
+func TestParsingNodeAttrsYAML(t *testing.T) {
+	pol, err := LoadACLPolicyFromBytes([]byte(`
+nodeAttrs:
+  - target: ["*"]
+    app:
+      tailscale.com/app-connectors:
+        - name: github
+          connectors: ["tag:connector"]
+          domains: ["github.com"]
+`), "yaml")
+	if err != nil {
+		t.Fatalf("parsing policy: %s", err)
+	}
+
+	want := tailcfg.NodeCapMap{
+		"tailscale.com/app-connectors": []tailcfg.RawMessage{
+			`{"connectors":["tag:connector"],"domains":["github.com"],"name":"github"}`,
+		},
+	}
+
+	if diff := cmp.Diff(want, pol.NodeAttrs[0].App); diff != "" {
+		t.Errorf("unexpected app (-want +got):\n%s", diff)
+	}
+}
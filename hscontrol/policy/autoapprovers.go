@@ -0,0 +1,64 @@
+package policy
+
+import (
+	"net/netip"
+	"slices"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+)
+
+// ApprovesRoute reports if the autoApprovers of the policy approve the
+// prefix advertised by the node. The approvers of a prefix are users,
+// groups, tags, autogroup:member for the nodes which are not tagged and
+// autogroup:tagged for the ones which are. Exit routes are approved by
+// the exitNode approvers. The routes of the app connectors served by the
+// node are always approved, the routes within the addresses of the
+// tailnet advertised by a node serving app connectors with domains never
+// are.
+func (pol *ACLPolicy) ApprovesRoute(node *types.Node, prefix netip.Prefix) (bool, error) {
+	if pol == nil {
+		return false, nil
+	}
+
+	if approved, err := pol.approvesAppConnectorRoute(node, prefix); approved || err != nil {
+		return approved, err
+	}
+
+	if rejected, err := pol.rejectsAppConnectorRoute(node, prefix); rejected || err != nil {
+		return false, err
+	}
+
+	approvers, err := pol.AutoApprovers.GetRouteApprovers(prefix)
+	if err != nil {
+		return false, err
+	}
+
+	for _, alias := range approvers {
+		if alias == node.User.Name {
+			return true, nil
+		}
+
+		ips, err := pol.ExpandAlias(types.Nodes{node}, alias)
+		if err != nil {
+			return false, err
+		}
+
+		if slices.ContainsFunc(node.IPs(), ips.Contains) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// isTagged reports if the node has a forced tag, or a tag it requested
+// and is allowed to have.
+func (pol *ACLPolicy) isTagged(node *types.Node) bool {
+	if len(node.ForcedTags) > 0 {
+		return true
+	}
+
+	validTags, _ := pol.TagsOfNode(node)
+
+	return len(validTags) > 0
+}
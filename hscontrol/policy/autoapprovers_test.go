@@ -0,0 +1,153 @@
+package policy
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+func TestApprovesRoute(t *testing.T) {
+	pol := &ACLPolicy{
+		Groups:    Groups{"group:admins": []string{"ops"}},
+		TagOwners: TagOwners{"tag:router": []string{"ops"}},
+		AutoApprovers: AutoApprovers{
+			Routes: map[string][]string{
+				"10.0.0.0/8":     {"dev"},
+				"10.10.0.0/16":   {"group:admins"},
+				"172.16.0.0/12":  {"tag:router"},
+				"192.168.0.0/16": {"autogroup:member"},
+				"100.100.0.0/16": {"autogroup:tagged"},
+			},
+			ExitNode: []string{"tag:router"},
+		},
+	}
+
+	dev := &types.Node{
+		IPv4:     iap("100.64.0.1"),
+		User:     types.User{Name: "dev"},
+		Hostinfo: &tailcfg.Hostinfo{},
+	}
+	ops := &types.Node{
+		IPv4:     iap("100.64.0.2"),
+		User:     types.User{Name: "ops"},
+		Hostinfo: &tailcfg.Hostinfo{},
+	}
+	router := &types.Node{
+		IPv6:     iap("fd7a:115c:a1e0::3"),
+		User:     types.User{Name: "ops"},
+		Hostinfo: &tailcfg.Hostinfo{RequestTags: []string{"tag:router"}},
+	}
+	forced := &types.Node{
+		IPv4:       iap("100.64.0.4"),
+		User:       types.User{Name: "dev"},
+		ForcedTags: types.StringList{"tag:router"},
+		Hostinfo:   &tailcfg.Hostinfo{},
+	}
+
+	tests := []struct {
+		name   string
+		pol    *ACLPolicy
+		node   *types.Node
+		prefix string
+		want   bool
+	}{
+		{
+			name:   "no-policy",
+			node:   dev,
+			prefix: "10.0.0.0/24",
+			want:   false,
+		},
+		{
+			name:   "user",
+			pol:    pol,
+			node:   dev,
+			prefix: "10.1.0.0/24",
+			want:   true,
+		},
+		{
+			name:   "user-other-prefix",
+			pol:    pol,
+			node:   ops,
+			prefix: "10.1.0.0/24",
+			want:   false,
+		},
+		{
+			name:   "group",
+			pol:    pol,
+			node:   ops,
+			prefix: "10.10.1.0/24",
+			want:   true,
+		},
+		{
+			name:   "requested-tag-ipv6-only",
+			pol:    pol,
+			node:   router,
+			prefix: "172.16.1.0/24",
+			want:   true,
+		},
+		{
+			name:   "forced-tag",
+			pol:    pol,
+			node:   forced,
+			prefix: "172.16.1.0/24",
+			want:   true,
+		},
+		{
+			name:   "autogroup-member",
+			pol:    pol,
+			node:   dev,
+			prefix: "192.168.1.0/24",
+			want:   true,
+		},
+		{
+			name:   "autogroup-member-tagged-node",
+			pol:    pol,
+			node:   router,
+			prefix: "192.168.1.0/24",
+			want:   false,
+		},
+		{
+			name:   "autogroup-tagged",
+			pol:    pol,
+			node:   forced,
+			prefix: "100.100.1.0/24",
+			want:   true,
+		},
+		{
+			name:   "autogroup-tagged-member-node",
+			pol:    pol,
+			node:   ops,
+			prefix: "100.100.1.0/24",
+			want:   false,
+		},
+		{
+			name:   "exit-node",
+			pol:    pol,
+			node:   router,
+			prefix: "0.0.0.0/0",
+			want:   true,
+		},
+		{
+			name:   "exit-node-not-approver",
+			pol:    pol,
+			node:   dev,
+			prefix: "::/0",
+			want:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.pol.ApprovesRoute(tt.node, netip.MustParsePrefix(tt.prefix))
+			if err != nil {
+				t.Fatalf("ApprovesRoute() error = %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("ApprovesRoute() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/cmpver"
+)
+
+var ErrInvalidAutoTag = errors.New("invalid autoTag")
+
+// validateAutoTag checks that the rule gives a tag which has owners,
+// and that it matches on at least one valid attribute, so a rule does
+// not tag every node by mistake.
+func (pol *ACLPolicy) validateAutoTag(autoTag AutoTag) error {
+	if !isTag(autoTag.Tag) {
+		return fmt.Errorf("tag must start with tag:, got %q", autoTag.Tag)
+	}
+
+	if _, ok := pol.TagOwners[autoTag.Tag]; !ok {
+		return fmt.Errorf("%q is not defined in tagOwners", autoTag.Tag)
+	}
+
+	if autoTag.OS == "" && autoTag.Hostname == "" && autoTag.MinVersion == "" {
+		return errors.New("at least one of os, hostname or minVersion must be set")
+	}
+
+	if autoTag.Hostname != "" {
+		if _, err := regexp.Compile(autoTag.Hostname); err != nil {
+			return fmt.Errorf("parsing hostname %q: %w", autoTag.Hostname, err)
+		}
+	}
+
+	return nil
+}
+
+// matches reports if the Hostinfo has all the attributes of the rule.
+func (autoTag AutoTag) matches(hostinfo *tailcfg.Hostinfo) bool {
+	if hostinfo == nil {
+		return false
+	}
+
+	if autoTag.OS != "" && !strings.EqualFold(autoTag.OS, hostinfo.OS) {
+		return false
+	}
+
+	if autoTag.Hostname != "" {
+		matched, err := regexp.MatchString(autoTag.Hostname, hostinfo.Hostname)
+		if err != nil || !matched {
+			return false
+		}
+	}
+
+	if autoTag.MinVersion != "" {
+		if hostinfo.IPNVersion == "" || cmpver.Less(hostinfo.IPNVersion, autoTag.MinVersion) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// requestedTags returns the tags the node asks for, the ones it
+// advertises itself and the ones given by the autoTags rules matching
+// its Hostinfo. Like the advertised tags, the automatic tags are only
+// valid if the user of the node owns them.
+func (pol *ACLPolicy) requestedTags(node *types.Node) []string {
+	if node.Hostinfo == nil {
+		return nil
+	}
+
+	if pol == nil || len(pol.AutoTags) == 0 {
+		return node.Hostinfo.RequestTags
+	}
+
+	tags := slices.Clone(node.Hostinfo.RequestTags)
+	for _, autoTag := range pol.AutoTags {
+		if autoTag.matches(node.Hostinfo) && !slices.Contains(tags, autoTag.Tag) {
+			tags = append(tags, autoTag.Tag)
+		}
+	}
+
+	return tags
+}
@@ -0,0 +1,184 @@
+package policy
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+func TestAutoTagsOfNode(t *testing.T) {
+	pol := &ACLPolicy{
+		TagOwners: TagOwners{
+			"tag:server":  []string{"user1"},
+			"tag:laptop":  []string{"user1"},
+			"tag:modern":  []string{"user1"},
+			"tag:foreign": []string{"user2"},
+		},
+		AutoTags: []AutoTag{
+			{Tag: "tag:server", OS: "linux", Hostname: "^srv-"},
+			{Tag: "tag:laptop", OS: "macOS"},
+			{Tag: "tag:modern", MinVersion: "1.60.0"},
+			{Tag: "tag:foreign", OS: "linux"},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		hostinfo *tailcfg.Hostinfo
+		want     []string
+	}{
+		{
+			name: "no-hostinfo",
+		},
+		{
+			name: "linux-server",
+			hostinfo: &tailcfg.Hostinfo{
+				OS:         "linux",
+				Hostname:   "srv-db1",
+				IPNVersion: "1.58.2-t1234",
+			},
+			// tag:foreign matches, but is not owned by user1.
+			want: []string{"tag:server"},
+		},
+		{
+			name: "linux-not-server",
+			hostinfo: &tailcfg.Hostinfo{
+				OS:       "linux",
+				Hostname: "desktop",
+			},
+		},
+		{
+			name: "os-case-insensitive",
+			hostinfo: &tailcfg.Hostinfo{
+				OS:       "macos",
+				Hostname: "laptop",
+			},
+			want: []string{"tag:laptop"},
+		},
+		{
+			name: "min-version",
+			hostinfo: &tailcfg.Hostinfo{
+				OS:         "macOS",
+				Hostname:   "laptop",
+				IPNVersion: "1.66.4-t5678",
+			},
+			want: []string{"tag:laptop", "tag:modern"},
+		},
+		{
+			name: "merged-with-requested",
+			hostinfo: &tailcfg.Hostinfo{
+				OS:          "linux",
+				Hostname:    "srv-web",
+				RequestTags: []string{"tag:server", "tag:laptop"},
+			},
+			want: []string{"tag:laptop", "tag:server"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := &types.Node{
+				User:     types.User{Name: "user1"},
+				Hostinfo: tt.hostinfo,
+			}
+
+			got, _ := pol.TagsOfNode(node)
+			slices.Sort(got)
+
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("TagsOfNode() unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAutoTagsExpandAlias(t *testing.T) {
+	pol := &ACLPolicy{
+		TagOwners: TagOwners{
+			"tag:server": []string{"user1"},
+		},
+		AutoTags: []AutoTag{
+			{Tag: "tag:server", Hostname: "^srv-"},
+		},
+	}
+
+	server := &types.Node{
+		IPv4:     iap("100.64.0.1"),
+		User:     types.User{Name: "user1"},
+		Hostinfo: &tailcfg.Hostinfo{Hostname: "srv-db1"},
+	}
+	laptop := &types.Node{
+		IPv4:     iap("100.64.0.2"),
+		User:     types.User{Name: "user1"},
+		Hostinfo: &tailcfg.Hostinfo{Hostname: "laptop"},
+	}
+	nodes := types.Nodes{server, laptop}
+
+	tagged, err := pol.ExpandAlias(nodes, "tag:server")
+	if err != nil {
+		t.Fatalf("expanding tag: %s", err)
+	}
+	if !server.InIPSet(tagged) || laptop.InIPSet(tagged) {
+		t.Errorf("tag:server expanded to %v, want only the server", tagged.Prefixes())
+	}
+
+	// The server is tagged, so it no longer belongs to the user.
+	owned, err := pol.ExpandAlias(nodes, "user1")
+	if err != nil {
+		t.Fatalf("expanding user: %s", err)
+	}
+	if server.InIPSet(owned) || !laptop.InIPSet(owned) {
+		t.Errorf("user1 expanded to %v, want only the laptop", owned.Prefixes())
+	}
+}
+
+func TestLoadPolicyWithAutoTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		autoTag string
+		wantErr bool
+	}{
+		{
+			name:    "valid",
+			autoTag: `{"tag": "tag:server", "os": "linux", "hostname": "^srv-", "minVersion": "1.60"}`,
+		},
+		{
+			name:    "not-a-tag",
+			autoTag: `{"tag": "server", "os": "linux"}`,
+			wantErr: true,
+		},
+		{
+			name:    "tag-without-owners",
+			autoTag: `{"tag": "tag:other", "os": "linux"}`,
+			wantErr: true,
+		},
+		{
+			name:    "no-attributes",
+			autoTag: `{"tag": "tag:server"}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid-hostname",
+			autoTag: `{"tag": "tag:server", "hostname": "srv-("}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadACLPolicyFromBytes([]byte(`{
+				"tagOwners": {"tag:server": ["user1"]},
+				"acls": [{"action": "accept", "src": ["*"], "dst": ["*:*"]}],
+				"autoTags": [`+tt.autoTag+`],
+			}`), "hujson")
+
+			if tt.wantErr != errors.Is(err, ErrInvalidAutoTag) {
+				t.Errorf("LoadACLPolicyFromBytes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package policy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"go4.org/netipx"
+	"tailscale.com/tailcfg"
+)
+
+// AccessCheck is the answer to whether traffic from a source to a
+// destination is allowed by the policy.
+type AccessCheck struct {
+	// Allowed is true if all the IPs of the source can reach all the
+	// IPs of the destination.
+	Allowed bool
+
+	// Matches are the ACLs and grants allowing at least part of the
+	// traffic, such as "acls[2]" or "grants[0]", with their sources and
+	// destinations.
+	Matches []string
+
+	// Denied describes traffic which is not allowed, when Allowed is
+	// false.
+	Denied string
+}
+
+// CheckAccess evaluates if the source can reach the destination, a
+// single port on an alias such as "tag:server:443", with the protocol.
+// The protocol defaults to TCP. Like for the tests of the policy, the
+// source and the destination must match at least one node or IP.
+// Via grants are not evaluated, they only give access through
+// subnet routers.
+func (pol *ACLPolicy) CheckAccess(
+	nodes types.Nodes,
+	src string,
+	dst string,
+	protocol string,
+) (*AccessCheck, error) {
+	// All the traffic is allowed without a policy.
+	if pol == nil {
+		return &AccessCheck{
+			Allowed: true,
+			Matches: []string{"no policy, all traffic is allowed"},
+		}, nil
+	}
+
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	protocols, portless, err := parseProtocol(protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	// Accept the user@ form of the newer policy format.
+	src = strings.TrimSuffix(src, "@")
+
+	srcs, err := pol.ExpandAlias(nodes, src)
+	if err != nil {
+		return nil, fmt.Errorf("expanding src %q: %w", src, err)
+	}
+	if len(srcs.Prefixes()) == 0 {
+		return nil, fmt.Errorf("src %q matches no nodes", src)
+	}
+
+	dsts, port, err := pol.expandCheckDestination(dst, portless, nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := pol.CompileFilterRules(nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	check := &AccessCheck{Allowed: true}
+	for _, prefix := range dsts.Prefixes() {
+		var missing netipx.IPSetBuilder
+		missing.AddSet(srcs)
+		missing.RemoveSet(allowedSources(rules, protocols, port, func(set *netipx.IPSet) bool {
+			return set.ContainsPrefix(prefix)
+		}))
+
+		missingSet, err := missing.IPSet()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(missingSet.Prefixes()) > 0 {
+			check.Allowed = false
+			check.Denied = fmt.Sprintf("%s to %s is not allowed", missingSet.Prefixes()[0], prefix)
+
+			break
+		}
+	}
+
+	check.Matches, err = pol.matchingEntries(nodes, srcs, dsts, protocols, port)
+	if err != nil {
+		return nil, err
+	}
+
+	return check, nil
+}
+
+// expandCheckDestination returns the IPs and the port of a destination,
+// which must have a single port, or * for protocols without ports.
+func (pol *ACLPolicy) expandCheckDestination(
+	dest string,
+	portless bool,
+	nodes types.Nodes,
+) (*netipx.IPSet, uint16, error) {
+	alias, portStr, err := parseDestination(dest)
+	if err != nil {
+		return nil, 0, fmt.Errorf("parsing destination %q: %w", dest, err)
+	}
+
+	var port uint64
+	switch {
+	case portless && portStr == "*":
+	case portless:
+		return nil, 0, fmt.Errorf("destination %q must use * as port for the protocol: %w", dest, ErrInvalidPortFormat)
+	default:
+		port, err = strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return nil, 0, fmt.Errorf("destination %q must have a single port: %w", dest, ErrInvalidPortFormat)
+		}
+	}
+
+	dsts, err := pol.ExpandAlias(nodes, alias)
+	if err != nil {
+		return nil, 0, fmt.Errorf("expanding destination %q: %w", dest, err)
+	}
+
+	if len(dsts.Prefixes()) == 0 {
+		return nil, 0, fmt.Errorf("destination %q matches no nodes", dest)
+	}
+
+	return dsts, uint16(port), nil
+}
+
+// matchingEntries returns the ACLs and grants allowing some of the
+// sources to reach some of the destinations, each is compiled on its
+// own to find out.
+func (pol *ACLPolicy) matchingEntries(
+	nodes types.Nodes,
+	srcs *netipx.IPSet,
+	dsts *netipx.IPSet,
+	protocols []int,
+	port uint16,
+) ([]string, error) {
+	allows := func(rules []tailcfg.FilterRule) bool {
+		for _, prefix := range dsts.Prefixes() {
+			allowed := allowedSources(rules, protocols, port, func(set *netipx.IPSet) bool {
+				return set.OverlapsPrefix(prefix)
+			})
+			if allowed.Overlaps(srcs) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	var matches []string
+	for index, acl := range pol.ACLs {
+		single := *pol
+		single.ACLs = []ACL{acl}
+		single.Grants = nil
+
+		rules, err := single.CompileFilterRules(nodes)
+		if err != nil {
+			return nil, err
+		}
+
+		if allows(rules) {
+			matches = append(matches, fmt.Sprintf(
+				"acls[%d]: src %v, dst %v", index, acl.Sources, acl.Destinations,
+			))
+		}
+	}
+
+	for index, grant := range pol.Grants {
+		if len(grant.Via) > 0 {
+			continue
+		}
+
+		single := *pol
+		single.ACLs = nil
+		single.Grants = []Grant{grant}
+
+		rules, err := single.CompileFilterRules(nodes)
+		if err != nil {
+			return nil, err
+		}
+
+		if allows(rules) {
+			matches = append(matches, fmt.Sprintf(
+				"grants[%d]: src %v, dst %v, ip %v", index, grant.Sources, grant.Destinations, grant.IP,
+			))
+		}
+	}
+
+	return matches, nil
+}
@@ -0,0 +1,149 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+func TestCheckAccess(t *testing.T) {
+	nodes := types.Nodes{
+		&types.Node{
+			IPv4:     iap("100.64.0.1"),
+			User:     types.User{Name: "dev"},
+			Hostinfo: &tailcfg.Hostinfo{},
+		},
+		&types.Node{
+			IPv4:     iap("100.64.0.2"),
+			User:     types.User{Name: "ops"},
+			Hostinfo: &tailcfg.Hostinfo{},
+		},
+		&types.Node{
+			IPv4:       iap("100.64.0.3"),
+			User:       types.User{Name: "ops"},
+			ForcedTags: []string{"tag:server"},
+			Hostinfo:   &tailcfg.Hostinfo{},
+		},
+	}
+
+	pol := &ACLPolicy{
+		Groups: Groups{
+			"group:ops": []string{"ops"},
+		},
+		TagOwners: TagOwners{
+			"tag:server": []string{"ops"},
+		},
+		ACLs: []ACL{
+			{
+				Action:       "accept",
+				Sources:      []string{"group:ops"},
+				Destinations: []string{"tag:server:22,443"},
+			},
+		},
+		Grants: []Grant{
+			{
+				Sources:      []string{"dev"},
+				Destinations: []string{"tag:server"},
+				IP:           []string{"tcp:443", "icmp"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		pol         *ACLPolicy
+		src         string
+		dst         string
+		proto       string
+		wantAllowed bool
+		wantMatches []string
+		wantErr     bool
+	}{
+		{
+			name:        "acl-match",
+			pol:         pol,
+			src:         "ops@",
+			dst:         "tag:server:22",
+			wantAllowed: true,
+			wantMatches: []string{"acls[0]: src [group:ops], dst [tag:server:22,443]"},
+		},
+		{
+			// 100.64.0.0 and 100.64.0.3 are not allowed.
+			name: "partly-allowed",
+			pol:  pol,
+			src:  "100.64.0.0/30",
+			dst:  "tag:server:443",
+			wantMatches: []string{
+				"acls[0]: src [group:ops], dst [tag:server:22,443]",
+				"grants[0]: src [dev], dst [tag:server], ip [tcp:443 icmp]",
+			},
+		},
+		{
+			name:        "grant-icmp",
+			pol:         pol,
+			src:         "dev@",
+			dst:         "tag:server:*",
+			proto:       "icmp",
+			wantAllowed: true,
+			wantMatches: []string{"grants[0]: src [dev], dst [tag:server], ip [tcp:443 icmp]"},
+		},
+		{
+			name:  "denied-port",
+			pol:   pol,
+			src:   "dev@",
+			dst:   "tag:server:22",
+			proto: "tcp",
+		},
+		{
+			name:  "denied-protocol",
+			pol:   pol,
+			src:   "dev@",
+			dst:   "tag:server:443",
+			proto: "udp",
+		},
+		{
+			name:        "no-policy",
+			src:         "dev@",
+			dst:         "tag:server:22",
+			wantAllowed: true,
+			wantMatches: []string{"no policy, all traffic is allowed"},
+		},
+		{
+			name:    "port-range",
+			pol:     pol,
+			src:     "dev@",
+			dst:     "tag:server:22-443",
+			wantErr: true,
+		},
+		{
+			name:    "unknown-source",
+			pol:     pol,
+			src:     "nobody@",
+			dst:     "tag:server:22",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.pol.CheckAccess(nodes, tt.src, tt.dst, tt.proto)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CheckAccess() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if got.Allowed != tt.wantAllowed {
+				t.Errorf("CheckAccess() allowed = %v, want %v (denied: %s)", got.Allowed, tt.wantAllowed, got.Denied)
+			}
+			if !tt.wantAllowed && got.Denied == "" {
+				t.Errorf("CheckAccess() denied traffic without a reason")
+			}
+			if diff := cmp.Diff(tt.wantMatches, got.Matches); diff != "" {
+				t.Errorf("CheckAccess() matches unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
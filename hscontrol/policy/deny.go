@@ -0,0 +1,238 @@
+package policy
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+
+	"go4.org/netipx"
+	"tailscale.com/tailcfg"
+)
+
+// The packet filters of Tailscale only allow traffic, so the deny rules
+// are compiled by removing what they match from the accept rules listed
+// after them, the first rule matching a packet deciding if it is
+// allowed. The accept rules listed before a deny rule, and the grants,
+// are not changed by it.
+const (
+	denyAction = "deny"
+	dropAction = "drop"
+)
+
+var errDenyAutogroupSelf = errors.New("autogroup:self can't be used as a destination of a deny rule")
+
+func isDenyAction(action string) bool {
+	return action == denyAction || action == dropAction
+}
+
+// validateDenyRule checks that a deny rule has no autogroup:self
+// destination, which depends on the source and cannot be removed from
+// the accept rules.
+func validateDenyRule(acl ACL) error {
+	if !isDenyAction(acl.Action) {
+		return nil
+	}
+
+	for _, dest := range acl.Destinations {
+		alias, _, err := parseDestination(dest)
+		if err == nil && alias == autogroupSelf {
+			return errDenyAutogroupSelf
+		}
+	}
+
+	return nil
+}
+
+// subtractDenyRules removes from the rules the traffic matched by the
+// deny rules, splitting them by protocol, source and destination when
+// the deny rules only match part of them.
+func subtractDenyRules(rules []tailcfg.FilterRule, denies []tailcfg.FilterRule) []tailcfg.FilterRule {
+	for _, deny := range denies {
+		var remaining []tailcfg.FilterRule
+		for _, rule := range rules {
+			remaining = append(remaining, subtractDenyRule(rule, deny)...)
+		}
+		rules = remaining
+	}
+
+	return rules
+}
+
+func subtractDenyRule(rule, deny tailcfg.FilterRule) []tailcfg.FilterRule {
+	ruleProtocols := filterProtocols(rule.IPProto)
+	denyProtocols := filterProtocols(deny.IPProto)
+
+	var denied, allowed []int
+	for _, protocol := range ruleProtocols {
+		if slices.Contains(denyProtocols, protocol) {
+			denied = append(denied, protocol)
+		} else {
+			allowed = append(allowed, protocol)
+		}
+	}
+
+	if len(denied) == 0 {
+		return []tailcfg.FilterRule{rule}
+	}
+
+	var rules []tailcfg.FilterRule
+
+	// The protocols the deny rule does not match keep the rule as is.
+	if len(allowed) > 0 {
+		rules = append(rules, tailcfg.FilterRule{
+			SrcIPs:   rule.SrcIPs,
+			DstPorts: rule.DstPorts,
+			IPProto:  allowed,
+		})
+	}
+
+	// Keep the IPProto of the rule empty if all of its protocols are
+	// denied, for the default protocols.
+	protocols := rule.IPProto
+	if len(allowed) > 0 {
+		protocols = denied
+	}
+
+	srcs := prefixesIPSet(rule.SrcIPs)
+	denySrcs := prefixesIPSet(deny.SrcIPs)
+
+	// The sources the deny rule does not match keep all the
+	// destinations.
+	var outside netipx.IPSetBuilder
+	outside.AddSet(srcs)
+	outside.RemoveSet(denySrcs)
+	outsideSet, _ := outside.IPSet()
+	if len(outsideSet.Prefixes()) > 0 {
+		rules = append(rules, tailcfg.FilterRule{
+			SrcIPs:   prefixRuleStrings(outsideSet.Prefixes()),
+			DstPorts: rule.DstPorts,
+			IPProto:  protocols,
+		})
+	}
+
+	var inside netipx.IPSetBuilder
+	inside.AddSet(srcs)
+	inside.Intersect(denySrcs)
+	insideSet, _ := inside.IPSet()
+	if len(insideSet.Prefixes()) == 0 {
+		return rules
+	}
+
+	var dsts []tailcfg.NetPortRange
+	for _, dst := range rule.DstPorts {
+		dsts = append(dsts, subtractDenyDestinations(dst, deny.DstPorts)...)
+	}
+	if len(dsts) > 0 {
+		rules = append(rules, tailcfg.FilterRule{
+			SrcIPs:   prefixRuleStrings(insideSet.Prefixes()),
+			DstPorts: dsts,
+			IPProto:  protocols,
+		})
+	}
+
+	return rules
+}
+
+// subtractDenyDestinations removes the denied destinations from a
+// destination, the parts of its IPs which are denied keeping the ports
+// which are not.
+func subtractDenyDestinations(dst tailcfg.NetPortRange, denies []tailcfg.NetPortRange) []tailcfg.NetPortRange {
+	type piece struct {
+		ips   *netipx.IPSet
+		ports tailcfg.PortRange
+	}
+
+	pieces := []piece{{ips: prefixesIPSet([]string{dst.IP}), ports: dst.Ports}}
+	for _, deny := range denies {
+		denyIPs := prefixesIPSet([]string{deny.IP})
+
+		var next []piece
+		for _, p := range pieces {
+			if p.ports.Last < deny.Ports.First || p.ports.First > deny.Ports.Last || !p.ips.Overlaps(denyIPs) {
+				next = append(next, p)
+
+				continue
+			}
+
+			var outside netipx.IPSetBuilder
+			outside.AddSet(p.ips)
+			outside.RemoveSet(denyIPs)
+			if set, _ := outside.IPSet(); len(set.Prefixes()) > 0 {
+				next = append(next, piece{ips: set, ports: p.ports})
+			}
+
+			var inside netipx.IPSetBuilder
+			inside.AddSet(p.ips)
+			inside.Intersect(denyIPs)
+			insideSet, _ := inside.IPSet()
+			if p.ports.First < deny.Ports.First {
+				next = append(next, piece{
+					ips:   insideSet,
+					ports: tailcfg.PortRange{First: p.ports.First, Last: deny.Ports.First - 1},
+				})
+			}
+			if p.ports.Last > deny.Ports.Last {
+				next = append(next, piece{
+					ips:   insideSet,
+					ports: tailcfg.PortRange{First: deny.Ports.Last + 1, Last: p.ports.Last},
+				})
+			}
+		}
+		pieces = next
+	}
+
+	var dsts []tailcfg.NetPortRange
+	for _, p := range pieces {
+		for _, prefix := range p.ips.Prefixes() {
+			dsts = append(dsts, tailcfg.NetPortRange{
+				IP:    prefix.String(),
+				Ports: p.ports,
+			})
+		}
+	}
+
+	return dsts
+}
+
+// filterProtocols returns the protocols of a rule, the ones allowed by
+// Tailscale when IPProto is empty.
+func filterProtocols(protocols []int) []int {
+	if len(protocols) == 0 {
+		return []int{protocolTCP, protocolUDP, protocolICMP, protocolIPv6ICMP}
+	}
+
+	return protocols
+}
+
+// prefixesIPSet returns the IP set of the IPs of a filter rule, which
+// are prefixes, addresses or "*".
+func prefixesIPSet(ips []string) *netipx.IPSet {
+	var build netipx.IPSetBuilder
+	for _, ip := range ips {
+		if ip == "*" {
+			build.AddPrefix(netip.MustParsePrefix("0.0.0.0/0"))
+			build.AddPrefix(netip.MustParsePrefix("::/0"))
+
+			continue
+		}
+
+		if prefix, err := netip.ParsePrefix(ip); err == nil {
+			build.AddPrefix(prefix)
+		} else if addr, err := netip.ParseAddr(ip); err == nil {
+			build.Add(addr)
+		}
+	}
+
+	set, _ := build.IPSet()
+
+	return set
+}
+
+func prefixRuleStrings(prefixes []netip.Prefix) []string {
+	strs := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		strs = append(strs, prefix.String())
+	}
+
+	return strs
+}
@@ -0,0 +1,118 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+func TestCompileDenyRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		acls    string
+		want    []tailcfg.FilterRule
+		wantErr bool
+	}{
+		{
+			name: "deny-before-accept",
+			acls: `
+				{"action": "deny", "src": ["100.64.0.2"], "dst": ["server:22"]},
+				{"action": "accept", "src": ["100.64.0.0/30"], "dst": ["server:*"]},
+			`,
+			want: []tailcfg.FilterRule{
+				{
+					SrcIPs: []string{"100.64.0.0/31", "100.64.0.3/32"},
+					DstPorts: []tailcfg.NetPortRange{
+						{IP: "100.64.0.10/32", Ports: tailcfg.PortRangeAny},
+					},
+				},
+				{
+					SrcIPs: []string{"100.64.0.2/32"},
+					DstPorts: []tailcfg.NetPortRange{
+						{IP: "100.64.0.10/32", Ports: tailcfg.PortRange{First: 0, Last: 21}},
+						{IP: "100.64.0.10/32", Ports: tailcfg.PortRange{First: 23, Last: 65535}},
+					},
+				},
+			},
+		},
+		{
+			name: "accept-before-deny",
+			acls: `
+				{"action": "accept", "src": ["100.64.0.0/30"], "dst": ["server:*"]},
+				{"action": "deny", "src": ["100.64.0.2"], "dst": ["server:22"]},
+			`,
+			want: []tailcfg.FilterRule{
+				{
+					SrcIPs: []string{"100.64.0.0/30"},
+					DstPorts: []tailcfg.NetPortRange{
+						{IP: "100.64.0.10/32", Ports: tailcfg.PortRangeAny},
+					},
+				},
+			},
+		},
+		{
+			name: "drop-protocol",
+			acls: `
+				{"action": "drop", "proto": "tcp", "src": ["100.64.0.2"], "dst": ["server:*"]},
+				{"action": "accept", "src": ["100.64.0.2"], "dst": ["server:*"]},
+			`,
+			want: []tailcfg.FilterRule{
+				{
+					SrcIPs: []string{"100.64.0.2/32"},
+					DstPorts: []tailcfg.NetPortRange{
+						{IP: "100.64.0.10/32", Ports: tailcfg.PortRangeAny},
+					},
+					IPProto: []int{protocolUDP, protocolICMP, protocolIPv6ICMP},
+				},
+			},
+		},
+		{
+			name: "deny-part-of-destination",
+			acls: `
+				{"action": "deny", "src": ["*"], "dst": ["100.64.0.11:*"]},
+				{"action": "accept", "src": ["100.64.0.2"], "dst": ["100.64.0.10/31:443"]},
+			`,
+			want: []tailcfg.FilterRule{
+				{
+					SrcIPs: []string{"100.64.0.2/32"},
+					DstPorts: []tailcfg.NetPortRange{
+						{IP: "100.64.0.10/32", Ports: tailcfg.PortRange{First: 443, Last: 443}},
+					},
+				},
+			},
+		},
+		{
+			name: "deny-autogroup-self",
+			acls: `
+				{"action": "deny", "src": ["user1"], "dst": ["autogroup:self:*"]},
+			`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pol, err := LoadACLPolicyFromBytes([]byte(`{
+				"hosts": {"server": "100.64.0.10"},
+				"acls": [`+tt.acls+`],
+			}`), "hujson")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadACLPolicyFromBytes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			rules, err := pol.CompileFilterRules(types.Nodes{})
+			if err != nil {
+				t.Fatalf("CompileFilterRules() error = %v", err)
+			}
+
+			if diff := cmp.Diff(tt.want, rules); diff != "" {
+				t.Errorf("CompileFilterRules() unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
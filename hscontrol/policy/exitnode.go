@@ -0,0 +1,38 @@
+package policy
+
+import (
+	"github.com/juanfont/headscale/hscontrol/policy/matcher"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+// CanUseExitNodes reports if the rules give the node access to
+// autogroup:internet, all of the internet on any port, through an ACL
+// or a grant. Like in Tailscale, the exit routes of its peers are only
+// sent to such a node, the routes being approved only makes a node an
+// exit node.
+func CanUseExitNodes(node *types.Node, rules []tailcfg.FilterRule) bool {
+	internet := theInternet().Prefixes()
+
+	for _, rule := range rules {
+		match := matcher.MatchFromFilterRule(rule)
+		if !match.SrcsContainsIPs(node.IPs()) {
+			continue
+		}
+
+		reachesInternet := true
+		for _, prefix := range internet {
+			if !match.Dests.ContainsPrefix(prefix) {
+				reachesInternet = false
+
+				break
+			}
+		}
+
+		if reachesInternet {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,98 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+func TestCanUseExitNodes(t *testing.T) {
+	nodes := types.Nodes{
+		&types.Node{
+			IPv4:     iap("100.64.0.1"),
+			User:     types.User{Name: "dev"},
+			Hostinfo: &tailcfg.Hostinfo{},
+		},
+		&types.Node{
+			IPv4:     iap("100.64.0.2"),
+			User:     types.User{Name: "ops"},
+			Hostinfo: &tailcfg.Hostinfo{},
+		},
+	}
+
+	tests := []struct {
+		name string
+		pol  *ACLPolicy
+		want bool
+	}{
+		{
+			name: "no-policy",
+			want: true,
+		},
+		{
+			name: "wildcard",
+			pol: &ACLPolicy{
+				ACLs: []ACL{
+					{Action: "accept", Sources: []string{"*"}, Destinations: []string{"*:*"}},
+				},
+			},
+			want: true,
+		},
+		{
+			name: "acl-autogroup-internet",
+			pol: &ACLPolicy{
+				ACLs: []ACL{
+					{Action: "accept", Sources: []string{"dev"}, Destinations: []string{"autogroup:internet:443"}},
+				},
+			},
+			want: true,
+		},
+		{
+			name: "grant-autogroup-internet",
+			pol: &ACLPolicy{
+				Grants: []Grant{
+					{Sources: []string{"dev"}, Destinations: []string{"autogroup:internet"}, IP: []string{"*"}},
+				},
+			},
+			want: true,
+		},
+		{
+			name: "other-user",
+			pol: &ACLPolicy{
+				ACLs: []ACL{
+					{Action: "accept", Sources: []string{"ops"}, Destinations: []string{"autogroup:internet:*"}},
+				},
+			},
+		},
+		{
+			name: "part-of-the-internet",
+			pol: &ACLPolicy{
+				ACLs: []ACL{
+					{Action: "accept", Sources: []string{"dev"}, Destinations: []string{"8.8.8.8/32:53"}},
+				},
+			},
+		},
+		{
+			name: "tailnet-only",
+			pol: &ACLPolicy{
+				ACLs: []ACL{
+					{Action: "accept", Sources: []string{"dev"}, Destinations: []string{"ops:*"}},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := tt.pol.CompileFilterRules(nodes)
+			if err != nil {
+				t.Fatalf("CompileFilterRules() error = %v", err)
+			}
+
+			if got := CanUseExitNodes(nodes[0], rules); got != tt.want {
+				t.Errorf("CanUseExitNodes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package policy
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"tailscale.com/tailcfg"
+)
+
+var filterCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "headscale",
+	Name:      "policy_filter_cache_lookups_total",
+	Help:      "total count of packet filter lookups, by whether the filter had to be compiled",
+}, []string{"result"})
+
+// FilterCache keeps the last packet filter and via rules compiled from a
+// policy. They depend on all the nodes, but every node's map is generated
+// with the same nodes, and most changes to a node, like its endpoints,
+// do not change them. The rules are only compiled again when the policy
+// changes, or when a node changes one of the attributes the policy
+// depends on.
+//
+// The returned rules are shared, they must not be changed.
+type FilterCache struct {
+	mu sync.Mutex
+
+	pol  *ACLPolicy
+	deps filterDeps
+	key  [sha256.Size]byte
+
+	rules []tailcfg.FilterRule
+	via   map[types.NodeID][]tailcfg.FilterRule
+}
+
+// filterDeps are the attributes of the nodes, beside their addresses,
+// users and tags, which the rules compiled from a policy depend on.
+type filterDeps struct {
+	// routes are used by the grants, for the via rules and the
+	// wildcard sources.
+	routes bool
+	// posture is used by the srcPosture of the ACLs and the grants.
+	posture bool
+}
+
+func (pol *ACLPolicy) filterDeps() filterDeps {
+	deps := filterDeps{
+		routes: len(pol.Grants) > 0,
+	}
+
+	for _, acl := range pol.ACLs {
+		if len(acl.SrcPosture) > 0 {
+			deps.posture = true
+		}
+	}
+	for _, grant := range pol.Grants {
+		if len(grant.SrcPosture) > 0 {
+			deps.posture = true
+		}
+	}
+
+	return deps
+}
+
+// CompileFilterRules returns the packet filter of the policy for the
+// nodes, compiling it only if the policy or the nodes changed.
+func (c *FilterCache) CompileFilterRules(pol *ACLPolicy, nodes types.Nodes) ([]tailcfg.FilterRule, error) {
+	if c == nil || pol == nil {
+		return pol.CompileFilterRules(nodes)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.update(pol, nodes); err != nil {
+		return nil, err
+	}
+
+	return slices.Clip(c.rules), nil
+}
+
+// CompileViaFilterRules returns the via rules of the policy for the
+// nodes, compiling them only if the policy or the nodes changed.
+func (c *FilterCache) CompileViaFilterRules(
+	pol *ACLPolicy,
+	nodes types.Nodes,
+) (map[types.NodeID][]tailcfg.FilterRule, error) {
+	if c == nil || pol == nil {
+		return pol.CompileViaFilterRules(nodes)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.update(pol, nodes); err != nil {
+		return nil, err
+	}
+
+	return c.via, nil
+}
+
+func (c *FilterCache) update(pol *ACLPolicy, nodes types.Nodes) error {
+	if c.pol != pol {
+		c.deps = pol.filterDeps()
+	}
+
+	key := pol.filterKey(c.deps, nodes)
+	if c.pol == pol && c.key == key {
+		filterCacheLookups.WithLabelValues("hit").Inc()
+
+		return nil
+	}
+	filterCacheLookups.WithLabelValues("miss").Inc()
+
+	rules, err := pol.CompileFilterRules(nodes)
+	if err != nil {
+		return err
+	}
+
+	via, err := pol.CompileViaFilterRules(nodes)
+	if err != nil {
+		return err
+	}
+
+	c.pol = pol
+	c.key = key
+	c.rules = rules
+	c.via = via
+
+	return nil
+}
+
+// filterKey hashes what the rules compiled from the policy depend on:
+// the loaded host sources, identity provider groups and node shares, and
+// the attributes of the nodes the policy looks at, in the order of their
+// IDs.
+func (pol *ACLPolicy) filterKey(deps filterDeps, nodes types.Nodes) [sha256.Size]byte {
+	sorted := slices.Clone(nodes)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "hosts:%d\n", pol.hostSources.getVersion())
+	fmt.Fprintf(hash, "idpgroups:%d\n", pol.idpGroups.getVersion())
+	fmt.Fprintf(hash, "shares:%d\n", pol.nodeShares.getVersion())
+
+	for _, node := range sorted {
+		fmt.Fprintf(hash, "node:%d %v %v user:%d:%q forced:%q hostinfo:%t tags:%q\n",
+			node.ID,
+			node.IPv4,
+			node.IPv6,
+			node.UserID,
+			node.User.Name,
+			node.ForcedTags,
+			node.Hostinfo != nil,
+			pol.requestedTags(node),
+		)
+
+		if deps.routes {
+			for _, route := range node.Routes {
+				fmt.Fprintf(hash, "route:%s %t %t %t\n",
+					netip.Prefix(route.Prefix),
+					route.Advertised,
+					route.Enabled,
+					route.IsPrimary,
+				)
+			}
+		}
+
+		if deps.posture {
+			writeSortedMap(hash, postureAttributes(node))
+		}
+	}
+
+	var key [sha256.Size]byte
+	hash.Sum(key[:0])
+
+	return key
+}
+
+func writeSortedMap(w io.Writer, attrs map[string]string) {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(w, "%q=%q\n", name, attrs[name])
+	}
+}
@@ -0,0 +1,168 @@
+package policy
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+func TestFilterCache(t *testing.T) {
+	newNodes := func() types.Nodes {
+		return types.Nodes{
+			{
+				ID:       1,
+				IPv4:     iap("100.64.0.1"),
+				User:     types.User{Name: "user1"},
+				Hostinfo: &tailcfg.Hostinfo{OS: "linux"},
+			},
+			{
+				ID:       2,
+				IPv4:     iap("100.64.0.2"),
+				User:     types.User{Name: "user2"},
+				Hostinfo: &tailcfg.Hostinfo{OS: "linux"},
+			},
+		}
+	}
+
+	acls := []ACL{
+		{
+			Action:       "accept",
+			Sources:      []string{"user1"},
+			Destinations: []string{"*:22"},
+		},
+	}
+	plain := &ACLPolicy{
+		TagOwners: TagOwners{"tag:server": []string{"user2"}},
+		ACLs:      acls,
+	}
+	posture := &ACLPolicy{
+		Postures: Postures{"posture:mac": {"node:os == 'macos'"}},
+		ACLs: []ACL{
+			{
+				Action:       "accept",
+				Sources:      []string{"*"},
+				Destinations: []string{"*:22"},
+				SrcPosture:   []string{"posture:mac"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		pol         *ACLPolicy
+		change      func(nodes types.Nodes)
+		wantCompile bool
+	}{
+		{
+			name:        "unchanged",
+			pol:         plain,
+			change:      func(types.Nodes) {},
+			wantCompile: false,
+		},
+		{
+			name: "endpoints",
+			pol:  plain,
+			change: func(nodes types.Nodes) {
+				nodes[0].Endpoints = []netip.AddrPort{netip.MustParseAddrPort("192.0.2.1:41641")}
+				nodes[0].Hostinfo.NetInfo = &tailcfg.NetInfo{PreferredDERP: 2}
+			},
+			wantCompile: false,
+		},
+		{
+			name: "os-without-posture",
+			pol:  plain,
+			change: func(nodes types.Nodes) {
+				nodes[0].Hostinfo.OS = "macOS"
+			},
+			wantCompile: false,
+		},
+		{
+			name: "os-with-posture",
+			pol:  posture,
+			change: func(nodes types.Nodes) {
+				nodes[0].Hostinfo.OS = "macOS"
+			},
+			wantCompile: true,
+		},
+		{
+			name: "address",
+			pol:  plain,
+			change: func(nodes types.Nodes) {
+				nodes[1].IPv4 = iap("100.64.0.3")
+			},
+			wantCompile: true,
+		},
+		{
+			name: "user",
+			pol:  plain,
+			change: func(nodes types.Nodes) {
+				nodes[1].User.Name = "user1"
+			},
+			wantCompile: true,
+		},
+		{
+			name: "requested-tags",
+			pol:  plain,
+			change: func(nodes types.Nodes) {
+				nodes[1].Hostinfo.RequestTags = []string{"tag:server"}
+			},
+			wantCompile: true,
+		},
+		{
+			name: "node-added",
+			pol:  plain,
+			change: func(nodes types.Nodes) {
+				nodes[1].ID = 3
+			},
+			wantCompile: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cache FilterCache
+
+			if _, err := cache.CompileFilterRules(tt.pol, newNodes()); err != nil {
+				t.Fatalf("CompileFilterRules() error = %v", err)
+			}
+			key := cache.key
+
+			nodes := newNodes()
+			tt.change(nodes)
+
+			got, err := cache.CompileFilterRules(tt.pol, nodes)
+			if err != nil {
+				t.Fatalf("CompileFilterRules() error = %v", err)
+			}
+
+			if compiled := cache.key != key; compiled != tt.wantCompile {
+				t.Errorf("compiled = %t, want %t", compiled, tt.wantCompile)
+			}
+
+			// The cached rules are the rules compiled for the nodes.
+			want, err := tt.pol.CompileFilterRules(nodes)
+			if err != nil {
+				t.Fatalf("CompileFilterRules() error = %v", err)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("unexpected rules (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	// A new policy is always compiled.
+	var cache FilterCache
+	nodes := newNodes()
+	if _, err := cache.CompileFilterRules(plain, nodes); err != nil {
+		t.Fatalf("CompileFilterRules() error = %v", err)
+	}
+	if _, err := cache.CompileFilterRules(&ACLPolicy{ACLs: acls}, nodes); err != nil {
+		t.Fatalf("CompileFilterRules() error = %v", err)
+	}
+	if cache.pol == plain {
+		t.Errorf("expected the new policy to be compiled")
+	}
+}
@@ -0,0 +1,445 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"go4.org/netipx"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+)
+
+var ErrInvalidGrant = errors.New("invalid grant")
+
+// compileGrants generates the FilterRules for the grants in the policy.
+// Each entry in a grant's ip field results in a rule with DstPorts,
+// while the app field results in a single rule carrying the
+// capabilities as a CapGrant, which the destination node uses to
+// authorise application level access from the sources.
+// Grants with via are compiled separately by CompileViaFilterRules as
+// they only apply to specific routers.
+func (pol *ACLPolicy) compileGrants(
+	nodes types.Nodes,
+) ([]tailcfg.FilterRule, error) {
+	var rules []tailcfg.FilterRule
+
+	for index, grant := range pol.Grants {
+		if err := validateGrant(grant); err != nil {
+			return nil, fmt.Errorf("%w, grant index: %d: %w", ErrInvalidGrant, index, err)
+		}
+
+		if len(grant.Via) > 0 || isEmptyGrant(grant) {
+			continue
+		}
+
+		srcIPs, dsts, err := pol.expandGrant(index, grant, nodes)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ip := range grant.IP {
+			rule, err := grantIPRule(srcIPs, dsts, ip)
+			if err != nil {
+				return nil, fmt.Errorf("parsing policy, grant index: %d: %w", index, err)
+			}
+
+			rules = append(rules, rule)
+		}
+
+		app := grant.App
+		if _, ok := app[capTaildrop]; ok {
+			app = maps.Clone(app)
+			delete(app, capTaildrop)
+
+			rules = append(rules, taildropRules(srcIPs, dsts)...)
+		}
+
+		if len(app) > 0 {
+			rules = append(rules, tailcfg.FilterRule{
+				SrcIPs: srcIPs,
+				CapGrant: []tailcfg.CapGrant{
+					{
+						Dsts:   dsts.Prefixes(),
+						CapMap: app,
+					},
+				},
+			})
+		}
+	}
+
+	return rules, nil
+}
+
+// taildropRules generates the rules letting the sources send files to
+// the destinations of a grant with capTaildrop. The destinations are
+// given the capability to receive files from the sources, and the
+// sources see the destinations as targets they can send files to.
+func taildropRules(srcIPs []string, dsts *netipx.IPSet) []tailcfg.FilterRule {
+	var srcs []netip.Prefix
+	for _, src := range srcIPs {
+		if prefix, err := netip.ParsePrefix(src); err == nil {
+			srcs = append(srcs, prefix)
+		} else if addr, err := netip.ParseAddr(src); err == nil {
+			srcs = append(srcs, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+
+	return []tailcfg.FilterRule{
+		{
+			SrcIPs: srcIPs,
+			CapGrant: []tailcfg.CapGrant{
+				{
+					Dsts: dsts.Prefixes(),
+					CapMap: tailcfg.PeerCapMap{
+						tailcfg.PeerCapabilityFileSharingSend: nil,
+					},
+				},
+			},
+		},
+		{
+			SrcIPs: prefixStrings(dsts.Prefixes()),
+			CapGrant: []tailcfg.CapGrant{
+				{
+					Dsts: srcs,
+					CapMap: tailcfg.PeerCapMap{
+						tailcfg.PeerCapabilityFileSharingTarget: nil,
+					},
+				},
+			},
+		},
+	}
+}
+
+// CompileViaFilterRules generates the FilterRules for grants with via,
+// keyed by the router they apply to. A router gets the rules if it has
+// one of the via tags, and only for the destinations overlapping the
+// routes it advertises and has enabled.
+func (pol *ACLPolicy) CompileViaFilterRules(
+	nodes types.Nodes,
+) (map[types.NodeID][]tailcfg.FilterRule, error) {
+	if pol == nil {
+		return nil, nil
+	}
+
+	rules := make(map[types.NodeID][]tailcfg.FilterRule)
+
+	for index, grant := range pol.Grants {
+		if len(grant.Via) == 0 {
+			continue
+		}
+
+		if err := validateGrant(grant); err != nil {
+			return nil, fmt.Errorf("%w, grant index: %d: %w", ErrInvalidGrant, index, err)
+		}
+
+		if isEmptyGrant(grant) {
+			continue
+		}
+
+		srcIPs, dsts, err := pol.expandGrant(index, grant, nodes)
+		if err != nil {
+			return nil, err
+		}
+
+		var viaBuilder netipx.IPSetBuilder
+		for _, via := range grant.Via {
+			expanded, err := pol.ExpandAlias(nodes, via)
+			if err != nil {
+				return nil, fmt.Errorf("parsing policy, grant index: %d: %w", index, err)
+			}
+			viaBuilder.AddSet(expanded)
+		}
+
+		viaIPs, err := viaBuilder.IPSet()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, node := range nodes {
+			if !node.InIPSet(viaIPs) {
+				continue
+			}
+
+			var routeBuilder netipx.IPSetBuilder
+			for _, route := range node.Routes {
+				if route.Advertised && route.Enabled {
+					routeBuilder.AddPrefix(netip.Prefix(route.Prefix))
+				}
+			}
+			routeBuilder.Intersect(dsts)
+
+			routed, err := routeBuilder.IPSet()
+			if err != nil {
+				return nil, err
+			}
+
+			if len(routed.Prefixes()) == 0 {
+				continue
+			}
+
+			for _, ip := range grant.IP {
+				rule, err := grantIPRule(srcIPs, routed, ip)
+				if err != nil {
+					return nil, fmt.Errorf("parsing policy, grant index: %d: %w", index, err)
+				}
+
+				rules[node.ID] = append(rules[node.ID], rule)
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+func validateGrant(grant Grant) error {
+	if len(grant.IP) == 0 && len(grant.App) == 0 && !isEmptyGrant(grant) {
+		return errors.New("at least one of ip or app must be set")
+	}
+
+	for name := range grant.App {
+		if err := validateCapabilityName(name); err != nil {
+			return err
+		}
+	}
+
+	if len(grant.Via) > 0 {
+		if len(grant.App) > 0 {
+			return errors.New("via can only be used with ip")
+		}
+
+		for _, via := range grant.Via {
+			if !isTag(via) {
+				return fmt.Errorf("via must be a list of tags, got %q", via)
+			}
+		}
+	}
+
+	return nil
+}
+
+// isEmptyGrant reports if the grant has no sources or no destinations.
+// Tailscale accepts these, often as placeholders, and they give no
+// access, so no rules are generated for them.
+func isEmptyGrant(grant Grant) bool {
+	return len(grant.Sources) == 0 || len(grant.Destinations) == 0
+}
+
+// capabilityNameRegex matches capability names of the form
+// {domain}/{path}, like example.com/cap/foo.
+var capabilityNameRegex = regexp.MustCompile(
+	`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)+/[^\s]+$`,
+)
+
+// capTaildrop is the app capability of the grants letting the sources
+// send files with Taildrop to the destinations owned by other users. It
+// is not sent to the clients as is, it is compiled to the file sharing
+// capabilities they understand by taildropRules.
+const capTaildrop tailcfg.PeerCapability = "tailscale.com/cap/file-sharing"
+
+// grantableTailscaleCapabilities are the capabilities in the
+// tailscale.com domain which can be given in a grant.
+var grantableTailscaleCapabilities = []tailcfg.PeerCapability{
+	capTaildrop,
+	tailcfg.PeerCapabilityTaildrive,
+	tailcfg.PeerCapabilityWebUI,
+	"tailscale.com/cap/kubernetes",
+}
+
+// validateCapabilityName checks that the name of a capability in the
+// app field of a grant is a domain followed by a path, and is not in the
+// tailscale.com domain, which is reserved for the capabilities used by
+// Tailscale itself.
+func validateCapabilityName(name tailcfg.PeerCapability) error {
+	if strings.HasPrefix(string(name), "https://") {
+		return fmt.Errorf("capability name %q must not start with https://", name)
+	}
+
+	if !capabilityNameRegex.MatchString(string(name)) {
+		return fmt.Errorf("capability name %q must be of the form {domain}/{path}", name)
+	}
+
+	domain, _, _ := strings.Cut(string(name), "/")
+	domain = strings.ToLower(domain)
+	if (domain == "tailscale.com" || strings.HasSuffix(domain, ".tailscale.com")) &&
+		!slices.Contains(grantableTailscaleCapabilities, name) {
+		return fmt.Errorf("capability name %q is in the reserved tailscale.com domain", name)
+	}
+
+	return nil
+}
+
+// expandGrant returns the source IPs and destination set of a grant.
+func (pol *ACLPolicy) expandGrant(
+	index int,
+	grant Grant,
+	nodes types.Nodes,
+) ([]string, *netipx.IPSet, error) {
+	var srcIPs []string
+	if len(grant.SrcPosture) > 0 {
+		srcs, err := pol.expandPostureSources(grant.Sources, grant.SrcPosture, nodes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing policy, grant index: %d: %w", index, err)
+		}
+		srcIPs = prefixStrings(srcs.Prefixes())
+	} else {
+		for srcIndex, src := range grant.Sources {
+			srcs, err := pol.expandGrantSource(src, nodes)
+			if err != nil {
+				return nil, nil, fmt.Errorf("parsing policy, grant index: %d->%d: %w", index, srcIndex, err)
+			}
+			srcIPs = append(srcIPs, srcs...)
+		}
+	}
+
+	var dstBuilder netipx.IPSetBuilder
+	for dstIndex, dst := range grant.Destinations {
+		expanded, err := pol.expandDestination(nodes, dst)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing policy, grant index: %d->%d: %w", index, dstIndex, err)
+		}
+		dstBuilder.AddSet(expanded)
+	}
+
+	dsts, err := dstBuilder.IPSet()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return srcIPs, dsts, nil
+}
+
+// expandGrantSource returns the SrcIPs for a source of a grant, in the
+// same format as the Tailscale control plane so the packet filters
+// match: single IPs are written without a prefix length, and the
+// wildcard is expanded by wildcardSrcIPs.
+func (pol *ACLPolicy) expandGrantSource(
+	src string,
+	nodes types.Nodes,
+) ([]string, error) {
+	if isWildcard(src) {
+		return wildcardSrcIPs(nodes), nil
+	}
+
+	ipSet, err := pol.ExpandAlias(nodes, src)
+	if err != nil {
+		return nil, err
+	}
+
+	return prefixStrings(ipSet.Prefixes()), nil
+}
+
+// wildcardSrcIPs returns the SrcIPs matching any source: the CGNAT
+// range split around the range used by ChromeOS VMs, the Tailscale ULA
+// range and the subnet routes served in the tailnet.
+func wildcardSrcIPs(nodes types.Nodes) []string {
+	var cgnat netipx.IPSetBuilder
+	cgnat.AddPrefix(tsaddr.CGNATRange())
+	cgnat.RemovePrefix(tsaddr.ChromeOSVMRange())
+	cgnatSet, _ := cgnat.IPSet()
+
+	srcIPs := prefixStrings(cgnatSet.Prefixes())
+	srcIPs = append(srcIPs, tsaddr.TailscaleULARange().String())
+
+	var routes []netip.Prefix
+	for _, node := range nodes {
+		for _, route := range node.Routes {
+			if route.IsAnnouncable() && !route.IsExitRoute() {
+				routes = append(routes, netip.Prefix(route.Prefix))
+			}
+		}
+	}
+	slices.SortFunc(routes, netipx.ComparePrefix)
+	routes = slices.Compact(routes)
+
+	return append(srcIPs, prefixStrings(routes)...)
+}
+
+// prefixStrings formats the prefixes for a FilterRule, single IPs are
+// written as a bare address.
+func prefixStrings(prefixes []netip.Prefix) []string {
+	strs := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		if prefix.IsSingleIP() {
+			strs = append(strs, prefix.Addr().String())
+		} else {
+			strs = append(strs, prefix.String())
+		}
+	}
+
+	return strs
+}
+
+// grantIPRule generates the rule for a single entry of a grant's ip
+// field, which can be "*", a protocol ("icmp"), ports ("22", "80-90")
+// or a protocol with ports ("tcp:443").
+func grantIPRule(
+	srcIPs []string,
+	dsts *netipx.IPSet,
+	ip string,
+) (tailcfg.FilterRule, error) {
+	protocol, port, found := strings.Cut(ip, ":")
+	if !found {
+		if ip == "*" || (ip != "" && ip[0] >= '0' && ip[0] <= '9') {
+			protocol, port = "", ip
+		} else {
+			protocol, port = ip, "*"
+		}
+	}
+
+	protocols, needsWildcard, err := parseProtocol(protocol)
+	if err != nil {
+		return tailcfg.FilterRule{}, fmt.Errorf("%w, ip %q: %w", ErrInvalidGrant, ip, err)
+	}
+
+	ports, err := expandPorts(port, needsWildcard)
+	if err != nil {
+		return tailcfg.FilterRule{}, fmt.Errorf("%w, ip %q: %w", ErrInvalidGrant, ip, err)
+	}
+
+	destPorts := []tailcfg.NetPortRange{}
+	for _, dst := range prefixStrings(dsts.Prefixes()) {
+		for _, port := range *ports {
+			destPorts = append(destPorts, tailcfg.NetPortRange{
+				IP:    dst,
+				Ports: port,
+			})
+		}
+	}
+
+	return tailcfg.FilterRule{
+		SrcIPs:   srcIPs,
+		DstPorts: destPorts,
+		IPProto:  protocols,
+	}, nil
+}
+
+// reduceCapGrants returns the CapGrants whose destinations include the
+// node.
+func reduceCapGrants(node *types.Node, grants []tailcfg.CapGrant) []tailcfg.CapGrant {
+	var ret []tailcfg.CapGrant
+
+	for _, grant := range grants {
+		var dsts []netip.Prefix
+		for _, dst := range grant.Dsts {
+			if (node.IPv4 != nil && dst.Contains(*node.IPv4)) ||
+				(node.IPv6 != nil && dst.Contains(*node.IPv6)) {
+				dsts = append(dsts, dst)
+			}
+		}
+
+		if len(dsts) > 0 {
+			ret = append(ret, tailcfg.CapGrant{
+				Dsts:   dsts,
+				CapMap: grant.CapMap,
+			})
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,492 @@
+package policy
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"tailscale.com/tailcfg"
+)
+
+func TestCompileGrants(t *testing.T) {
+	node1 := &types.Node{
+		IPv4:     iap("100.64.0.1"),
+		IPv6:     iap("fd7a:115c:a1e0::1"),
+		User:     types.User{Name: "user1"},
+		Hostinfo: &tailcfg.Hostinfo{},
+	}
+	node2 := &types.Node{
+		IPv4:     iap("100.64.0.2"),
+		IPv6:     iap("fd7a:115c:a1e0::2"),
+		User:     types.User{Name: "user2"},
+		Hostinfo: &tailcfg.Hostinfo{},
+	}
+
+	tests := []struct {
+		name    string
+		pol     ACLPolicy
+		node    *types.Node
+		want    []tailcfg.FilterRule
+		wantErr bool
+	}{
+		{
+			name: "ip-grant",
+			pol: ACLPolicy{
+				Grants: []Grant{
+					{
+						Sources:      []string{"user1"},
+						Destinations: []string{"user2"},
+						IP:           []string{"tcp:443", "icmp"},
+					},
+				},
+			},
+			node: node2,
+			want: []tailcfg.FilterRule{
+				{
+					SrcIPs: []string{"100.64.0.1", "fd7a:115c:a1e0::1"},
+					DstPorts: []tailcfg.NetPortRange{
+						{IP: "100.64.0.2", Ports: tailcfg.PortRange{First: 443, Last: 443}},
+						{IP: "fd7a:115c:a1e0::2", Ports: tailcfg.PortRange{First: 443, Last: 443}},
+					},
+					IPProto: []int{protocolTCP},
+				},
+				{
+					SrcIPs: []string{"100.64.0.1", "fd7a:115c:a1e0::1"},
+					DstPorts: []tailcfg.NetPortRange{
+						{IP: "100.64.0.2", Ports: tailcfg.PortRangeAny},
+						{IP: "fd7a:115c:a1e0::2", Ports: tailcfg.PortRangeAny},
+					},
+					IPProto: []int{protocolICMP, protocolIPv6ICMP},
+				},
+			},
+		},
+		{
+			name: "app-grant",
+			pol: ACLPolicy{
+				Grants: []Grant{
+					{
+						Sources:      []string{"user1"},
+						Destinations: []string{"user2"},
+						App: tailcfg.PeerCapMap{
+							"tailscale.com/cap/drive": []tailcfg.RawMessage{
+								`{"shares":["*"],"access":"rw"}`,
+							},
+						},
+					},
+				},
+			},
+			node: node2,
+			want: []tailcfg.FilterRule{
+				{
+					SrcIPs: []string{"100.64.0.1", "fd7a:115c:a1e0::1"},
+					CapGrant: []tailcfg.CapGrant{
+						{
+							Dsts: []netip.Prefix{
+								netip.MustParsePrefix("100.64.0.2/32"),
+								netip.MustParsePrefix("fd7a:115c:a1e0::2/128"),
+							},
+							CapMap: tailcfg.PeerCapMap{
+								"tailscale.com/cap/drive": []tailcfg.RawMessage{
+									`{"shares":["*"],"access":"rw"}`,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "app-grant-not-for-source",
+			pol: ACLPolicy{
+				Grants: []Grant{
+					{
+						Sources:      []string{"user1"},
+						Destinations: []string{"user2"},
+						App: tailcfg.PeerCapMap{
+							"example.com/cap/test": []tailcfg.RawMessage{`{}`},
+						},
+					},
+				},
+			},
+			node: node1,
+			want: []tailcfg.FilterRule{},
+		},
+		{
+			name: "taildrop-grant-receiver",
+			pol: ACLPolicy{
+				Grants: []Grant{
+					{
+						Sources:      []string{"user1"},
+						Destinations: []string{"user2"},
+						App: tailcfg.PeerCapMap{
+							"tailscale.com/cap/file-sharing": []tailcfg.RawMessage{`{}`},
+						},
+					},
+				},
+			},
+			node: node2,
+			want: []tailcfg.FilterRule{
+				{
+					SrcIPs: []string{"100.64.0.1", "fd7a:115c:a1e0::1"},
+					CapGrant: []tailcfg.CapGrant{
+						{
+							Dsts: []netip.Prefix{
+								netip.MustParsePrefix("100.64.0.2/32"),
+								netip.MustParsePrefix("fd7a:115c:a1e0::2/128"),
+							},
+							CapMap: tailcfg.PeerCapMap{
+								tailcfg.PeerCapabilityFileSharingSend: nil,
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "taildrop-grant-sender",
+			pol: ACLPolicy{
+				Grants: []Grant{
+					{
+						Sources:      []string{"user1"},
+						Destinations: []string{"user2"},
+						App: tailcfg.PeerCapMap{
+							"tailscale.com/cap/file-sharing": []tailcfg.RawMessage{`{}`},
+						},
+					},
+				},
+			},
+			node: node1,
+			want: []tailcfg.FilterRule{
+				{
+					SrcIPs: []string{"100.64.0.2", "fd7a:115c:a1e0::2"},
+					CapGrant: []tailcfg.CapGrant{
+						{
+							Dsts: []netip.Prefix{
+								netip.MustParsePrefix("100.64.0.1/32"),
+								netip.MustParsePrefix("fd7a:115c:a1e0::1/128"),
+							},
+							CapMap: tailcfg.PeerCapMap{
+								tailcfg.PeerCapabilityFileSharingTarget: nil,
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "empty-grant",
+			pol: ACLPolicy{
+				Grants: []Grant{
+					{
+						Sources:      []string{"user1"},
+						Destinations: []string{"user2"},
+					},
+				},
+			},
+			node:    node1,
+			wantErr: true,
+		},
+		{
+			name: "empty-src",
+			pol: ACLPolicy{
+				Grants: []Grant{
+					{
+						Sources:      []string{},
+						Destinations: []string{"user2"},
+						IP:           []string{"*"},
+					},
+				},
+			},
+			node: node2,
+			want: []tailcfg.FilterRule{},
+		},
+		{
+			name: "empty-dst",
+			pol: ACLPolicy{
+				Grants: []Grant{
+					{
+						Sources:      []string{"user1"},
+						Destinations: []string{},
+						App: tailcfg.PeerCapMap{
+							"example.com/cap/test": []tailcfg.RawMessage{`{}`},
+						},
+					},
+				},
+			},
+			node: node2,
+			want: []tailcfg.FilterRule{},
+		},
+		{
+			name: "empty-placeholder",
+			pol: ACLPolicy{
+				Grants: []Grant{
+					{
+						Sources:      []string{},
+						Destinations: []string{},
+					},
+				},
+			},
+			node: node2,
+			want: []tailcfg.FilterRule{},
+		},
+		{
+			name: "invalid-ip",
+			pol: ACLPolicy{
+				Grants: []Grant{
+					{
+						Sources:      []string{"user1"},
+						Destinations: []string{"user2"},
+						IP:           []string{"icmp:22"},
+					},
+				},
+			},
+			node:    node1,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.pol.CompileFilterRules(types.Nodes{node1, node2})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CompileFilterRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			got = ReduceFilterRules(tt.node, got)
+
+			if diff := cmp.Diff(tt.want, got, util.Comparers...); diff != "" {
+				t.Errorf("TestCompileGrants() unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParsingGrantsYAML(t *testing.T) {
+	pol, err := LoadACLPolicyFromBytes([]byte(`
+grants:
+  - src: ["user1"]
+    dst: ["user2"]
+    app:
+      tailscale.com/cap/drive:
+        - shares: ["*"]
+          access: rw
+`), "yaml")
+	if err != nil {
+		t.Fatalf("parsing policy: %s", err)
+	}
+
+	want := tailcfg.PeerCapMap{
+		"tailscale.com/cap/drive": []tailcfg.RawMessage{
+			`{"access":"rw","shares":["*"]}`,
+		},
+	}
+
+	if diff := cmp.Diff(want, pol.Grants[0].App); diff != "" {
+		t.Errorf("unexpected app (-want +got):\n%s", diff)
+	}
+}
+
+func TestCompileViaFilterRules(t *testing.T) {
+	route := func(prefix string) types.Route {
+		return types.Route{
+			Prefix:     types.IPPrefix(netip.MustParsePrefix(prefix)),
+			Advertised: true,
+			Enabled:    true,
+		}
+	}
+
+	client := &types.Node{
+		ID:       1,
+		IPv4:     iap("100.64.0.1"),
+		IPv6:     iap("fd7a:115c:a1e0::1"),
+		User:     types.User{Name: "user1"},
+		Hostinfo: &tailcfg.Hostinfo{},
+	}
+	viaRouter := &types.Node{
+		ID:         2,
+		IPv4:       iap("100.64.0.2"),
+		IPv6:       iap("fd7a:115c:a1e0::2"),
+		User:       types.User{Name: "admin"},
+		ForcedTags: []string{"tag:router"},
+		Hostinfo:   &tailcfg.Hostinfo{},
+		Routes:     types.Routes{route("10.0.0.0/16"), route("192.168.0.0/24")},
+	}
+	otherRouter := &types.Node{
+		ID:       3,
+		IPv4:     iap("100.64.0.3"),
+		IPv6:     iap("fd7a:115c:a1e0::3"),
+		User:     types.User{Name: "admin"},
+		Hostinfo: &tailcfg.Hostinfo{},
+		Routes:   types.Routes{route("10.0.0.0/16")},
+	}
+	nodes := types.Nodes{client, viaRouter, otherRouter}
+
+	pol := ACLPolicy{
+		Grants: []Grant{
+			{
+				Sources:      []string{"user1"},
+				Destinations: []string{"10.0.1.0/24"},
+				IP:           []string{"tcp:443"},
+				Via:          []string{"tag:router"},
+			},
+		},
+	}
+
+	got, err := pol.CompileViaFilterRules(nodes)
+	if err != nil {
+		t.Fatalf("CompileViaFilterRules() error = %v", err)
+	}
+
+	want := map[types.NodeID][]tailcfg.FilterRule{
+		viaRouter.ID: {
+			{
+				SrcIPs: []string{"100.64.0.1", "fd7a:115c:a1e0::1"},
+				DstPorts: []tailcfg.NetPortRange{
+					{IP: "10.0.1.0/24", Ports: tailcfg.PortRange{First: 443, Last: 443}},
+				},
+				IPProto: []int{protocolTCP},
+			},
+		},
+	}
+
+	if diff := cmp.Diff(want, got, util.Comparers...); diff != "" {
+		t.Errorf("CompileViaFilterRules() unexpected result (-want +got):\n%s", diff)
+	}
+
+	// The via grant is not part of the rules sent to all nodes, so
+	// other routers for the same subnet do not get it.
+	rules, err := pol.CompileFilterRules(nodes)
+	if err != nil {
+		t.Fatalf("CompileFilterRules() error = %v", err)
+	}
+	if len(rules) != 0 {
+		t.Errorf("expected no rules for via grants, got %v", rules)
+	}
+
+	pol.Grants[0].Via = []string{"router"}
+	if _, err := pol.CompileViaFilterRules(nodes); err == nil {
+		t.Errorf("expected error for via that is not a tag")
+	}
+}
+
+func TestWildcardSrcIPs(t *testing.T) {
+	route := func(prefix string, enabled bool) types.Route {
+		return types.Route{
+			Prefix:     types.IPPrefix(netip.MustParsePrefix(prefix)),
+			Advertised: true,
+			Enabled:    enabled,
+		}
+	}
+
+	nodes := types.Nodes{
+		{
+			Routes: types.Routes{
+				route("192.168.0.0/24", true),
+				route("0.0.0.0/0", true),
+				route("::/0", true),
+			},
+		},
+		{
+			Routes: types.Routes{
+				route("10.0.0.0/16", true),
+				route("192.168.0.0/24", true),
+				route("172.16.0.0/12", false),
+			},
+		},
+	}
+
+	want := []string{
+		"100.64.0.0/11",
+		"100.96.0.0/12",
+		"100.112.0.0/15",
+		"100.114.0.0/16",
+		"100.115.0.0/18",
+		"100.115.64.0/20",
+		"100.115.80.0/21",
+		"100.115.88.0/22",
+		"100.115.94.0/23",
+		"100.115.96.0/19",
+		"100.115.128.0/17",
+		"100.116.0.0/14",
+		"100.120.0.0/13",
+		"fd7a:115c:a1e0::/48",
+		"10.0.0.0/16",
+		"192.168.0.0/24",
+	}
+
+	if diff := cmp.Diff(want, wildcardSrcIPs(nodes)); diff != "" {
+		t.Errorf("wildcardSrcIPs() unexpected result (-want +got):\n%s", diff)
+	}
+}
+
+func TestValidateCapabilityName(t *testing.T) {
+	tests := []struct {
+		name    tailcfg.PeerCapability
+		wantErr bool
+	}{
+		{name: "example.com/cap/test"},
+		{name: "sub.example.com/cap"},
+		{name: "tailscale.com/cap/drive"},
+		{name: "tailscale.com/cap/kubernetes"},
+		{name: "tailscale.com/cap/file-sharing"},
+		{name: "https://example.com/cap/test", wantErr: true},
+		{name: "example.com", wantErr: true},
+		{name: "example.com/", wantErr: true},
+		{name: "example/cap/test", wantErr: true},
+		{name: "cap-test", wantErr: true},
+		{name: "tailscale.com/cap/file-send", wantErr: true},
+		{name: "login.tailscale.com/cap/test", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.name), func(t *testing.T) {
+			err := validateCapabilityName(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateCapabilityName(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadPolicyWithInvalidGrant(t *testing.T) {
+	_, err := LoadACLPolicyFromBytes([]byte(`{
+		"grants": [
+			{
+				"src": ["*"],
+				"dst": ["*"],
+				"app": {"https://example.com/cap/test": [{}]},
+			},
+		],
+	}`), "hujson")
+	if !errors.Is(err, ErrInvalidGrant) {
+		t.Errorf("expected ErrInvalidGrant loading policy, got %v", err)
+	}
+}
+
+func TestLoadPolicyWithEmptyGrants(t *testing.T) {
+	pol, err := LoadACLPolicyFromBytes([]byte(`{
+		"grants": [
+			{"src": [], "dst": ["*"], "ip": ["*"]},
+			{"src": ["*"], "dst": [], "ip": ["*"]},
+			{"src": [], "dst": []},
+		],
+	}`), "hujson")
+	if err != nil {
+		t.Fatalf("loading policy with empty grants: %s", err)
+	}
+
+	rules, err := pol.CompileFilterRules(types.Nodes{})
+	if err != nil {
+		t.Fatalf("compiling policy with empty grants: %s", err)
+	}
+
+	if len(rules) != 0 {
+		t.Errorf("expected no rules for empty grants, got %v", rules)
+	}
+}
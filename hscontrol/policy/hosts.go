@@ -0,0 +1,471 @@
+package policy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"go4.org/netipx"
+)
+
+const (
+	hostSourceFetchTimeout = 30 * time.Second
+
+	// hostSourceMaxSize bounds the size of an external IP set, which
+	// holds at most a few hundred thousand prefixes.
+	hostSourceMaxSize = 16 << 20
+
+	hostSourceMaxRedirects = 5
+)
+
+var (
+	ErrInvalidHost = errors.New("invalid host")
+
+	errHostSourceTooLarge = fmt.Errorf("hosts source is larger than %d bytes", hostSourceMaxSize)
+	errHostSourceOutside  = errors.New("hosts source is outside of acl_hosts_dir")
+)
+
+// hostSourceClient fetches the external IP sets. It follows a few
+// redirects, to http or https URLs only, and never from https to http.
+var hostSourceClient = &http.Client{
+	Timeout: hostSourceFetchTimeout,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= hostSourceMaxRedirects {
+			return fmt.Errorf("stopped after %d redirects", hostSourceMaxRedirects)
+		}
+
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("redirected to unsupported scheme %q", req.URL.Scheme)
+		}
+
+		if via[0].URL.Scheme == "https" && req.URL.Scheme != "https" {
+			return errors.New("redirected from https to http")
+		}
+
+		return nil
+	},
+}
+
+// hostSources holds the prefixes loaded from the external IP sets
+// referenced in the hosts section of the policy.
+type hostSources struct {
+	mu       sync.RWMutex
+	prefixes map[string][]netip.Prefix
+
+	// version is increased every time the prefixes change.
+	version uint64
+}
+
+func (h *hostSources) get(source string) []netip.Prefix {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.prefixes[source]
+}
+
+func (h *hostSources) getVersion() uint64 {
+	if h == nil {
+		return 0
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.version
+}
+
+// isHostSource reports if the host entry references an external IP set
+// rather than being an IP address or subnet.
+func isHostSource(str string) bool {
+	return strings.HasPrefix(str, "file:") ||
+		strings.HasPrefix(str, "http://") ||
+		strings.HasPrefix(str, "https://")
+}
+
+// validateHostSource checks that an external IP set is a file relative
+// to the hosts directory of the configuration, or an http or https URL.
+func validateHostSource(source string) error {
+	if path, ok := strings.CutPrefix(source, "file:"); ok {
+		if !filepath.IsLocal(path) {
+			return fmt.Errorf("%w: %q must be a path relative to acl_hosts_dir", ErrInvalidHost, source)
+		}
+
+		return nil
+	}
+
+	u, err := url.Parse(source)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: %q is not an http or https URL", ErrInvalidHost, source)
+	}
+
+	return nil
+}
+
+// isHostReference reports if the host entry references another host or
+// a group rather than being an IP address or subnet. Host names start
+// with a letter and, unlike IPv6 addresses, do not contain a colon.
+func isHostReference(str string) bool {
+	if isGroup(str) {
+		return true
+	}
+
+	return str != "" && unicode.IsLetter(rune(str[0])) && !strings.ContainsAny(str, ":/")
+}
+
+// validateHosts checks that the hosts and groups referenced by the hosts
+// exist, and that no host references itself, directly or through other
+// hosts.
+func (pol *ACLPolicy) validateHosts() error {
+	const (
+		visiting = iota + 1
+		visited
+	)
+
+	state := make(map[string]int, len(pol.Hosts))
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			cycle := append(path[slices.Index(path, name):], name)
+
+			return fmt.Errorf("%w: %q references itself: %s", ErrInvalidHost, name, strings.Join(cycle, " -> "))
+		}
+
+		state[name] = visiting
+		path = append(path, name)
+		for _, ref := range pol.Hosts[name].References {
+			if isGroup(ref) {
+				if _, ok := pol.Groups[ref]; !ok {
+					return fmt.Errorf("%w: %q references unknown group %q", ErrInvalidHost, name, ref)
+				}
+
+				continue
+			}
+
+			if _, ok := pol.Hosts[ref]; !ok {
+				return fmt.Errorf("%w: %q references unknown host %q", ErrInvalidHost, name, ref)
+			}
+
+			if err := visit(ref, path); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+
+		return nil
+	}
+
+	names := make([]string, 0, len(pol.Hosts))
+	for name := range pol.Hosts {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expandIPsFromHost returns the IPs of a host: its prefixes, the ones
+// loaded from its external IP sets, and the IPs of the hosts and groups
+// it references.
+func (pol *ACLPolicy) expandIPsFromHost(
+	name string,
+	nodes types.Nodes,
+) (*netipx.IPSet, error) {
+	var build netipx.IPSetBuilder
+	if err := pol.addHostIPs(&build, name, nodes, make(map[string]bool)); err != nil {
+		return nil, err
+	}
+
+	return build.IPSet()
+}
+
+func (pol *ACLPolicy) addHostIPs(
+	build *netipx.IPSetBuilder,
+	name string,
+	nodes types.Nodes,
+	seen map[string]bool,
+) error {
+	// A host referenced several times is only expanded once, which
+	// also stops at the cycles of a policy which was not validated.
+	if seen[name] {
+		return nil
+	}
+	seen[name] = true
+
+	host := pol.Hosts[name]
+	util.LogPolicy.Trace().Str("name", name).Strs("host", host.entries()).Msg("ExpandAlias got hosts entry")
+
+	for _, prefix := range pol.hostPrefixes(host) {
+		ips, err := pol.expandIPsFromIPPrefix(prefix, nodes)
+		if err != nil {
+			return err
+		}
+		build.AddSet(ips)
+	}
+
+	for _, ref := range host.References {
+		if isGroup(ref) {
+			ips, err := pol.expandIPsFromGroup(ref, nodes)
+			if err != nil {
+				return err
+			}
+			build.AddSet(ips)
+
+			continue
+		}
+
+		if err := pol.addHostIPs(build, ref, nodes, seen); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// HasHostSources reports if any of the hosts reference an external IP
+// set which needs to be refreshed.
+func (pol *ACLPolicy) HasHostSources() bool {
+	if pol == nil {
+		return false
+	}
+
+	for _, host := range pol.Hosts {
+		if len(host.Sources) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// KeepHostSources gives the policy the external IP sets already loaded
+// by the previous policy, so the hosts of a policy which was reloaded
+// match the same IPs until its sets are refreshed.
+func (pol *ACLPolicy) KeepHostSources(previous *ACLPolicy) {
+	if !pol.HasHostSources() || previous == nil || previous.hostSources == nil {
+		return
+	}
+
+	if pol.hostSources == nil {
+		pol.hostSources = &hostSources{}
+	}
+
+	loaded := make(map[string][]netip.Prefix)
+	for _, host := range pol.Hosts {
+		for _, source := range host.Sources {
+			if prefixes := previous.hostSources.get(source); prefixes != nil {
+				loaded[source] = prefixes
+			}
+		}
+	}
+
+	pol.hostSources.mu.Lock()
+	pol.hostSources.prefixes = loaded
+	pol.hostSources.version++
+	pol.hostSources.mu.Unlock()
+}
+
+// RefreshHostSources loads all the external IP sets referenced in the
+// hosts section of the policy, the files being read from dir. It
+// reports if any of the sets changed, in which case the filter rules
+// need to be compiled again.
+// If a set cannot be loaded, the previously loaded prefixes are kept
+// and an error is returned after the remaining sets are loaded.
+func (pol *ACLPolicy) RefreshHostSources(ctx context.Context, dir string) (bool, error) {
+	if !pol.HasHostSources() {
+		return false, nil
+	}
+
+	if pol.hostSources == nil {
+		pol.hostSources = &hostSources{}
+	}
+
+	var sources []string
+	for _, host := range pol.Hosts {
+		sources = append(sources, host.Sources...)
+	}
+	slices.Sort(sources)
+	sources = slices.Compact(sources)
+
+	var errs []error
+	loaded := make(map[string][]netip.Prefix, len(sources))
+	for _, source := range sources {
+		prefixes, err := fetchHostSource(ctx, dir, source)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("loading hosts from %q: %w", source, err))
+			prefixes = pol.hostSources.get(source)
+		}
+		loaded[source] = prefixes
+	}
+
+	pol.hostSources.mu.Lock()
+	changed := len(loaded) != len(pol.hostSources.prefixes)
+	for source, prefixes := range loaded {
+		if !slices.Equal(prefixes, pol.hostSources.prefixes[source]) {
+			changed = true
+		}
+	}
+	pol.hostSources.prefixes = loaded
+	if changed {
+		pol.hostSources.version++
+	}
+	pol.hostSources.mu.Unlock()
+
+	if len(errs) > 0 {
+		return changed, errs[0]
+	}
+
+	return changed, nil
+}
+
+// hostPrefixes returns the prefixes of the host, including the ones
+// loaded from its external IP sets.
+func (pol *ACLPolicy) hostPrefixes(host Host) []netip.Prefix {
+	prefixes := slices.Clone(host.Prefixes)
+	for _, source := range host.Sources {
+		loaded := pol.hostSources.get(source)
+		if len(loaded) == 0 {
+			util.LogPolicy.Warn().
+				Str("source", source).
+				Msg("Hosts source has not been loaded, it will not match any IPs")
+		}
+		prefixes = append(prefixes, loaded...)
+	}
+
+	return prefixes
+}
+
+func fetchHostSource(ctx context.Context, dir, source string) ([]netip.Prefix, error) {
+	if err := validateHostSource(source); err != nil {
+		return nil, err
+	}
+
+	if path, ok := strings.CutPrefix(source, "file:"); ok {
+		if dir == "" {
+			return nil, errors.New("acl_hosts_dir is not set, files cannot be used as hosts")
+		}
+
+		path, err := hostSourcePath(dir, path)
+		if err != nil {
+			return nil, err
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		return readHostSource(file)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, hostSourceFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := hostSourceClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return readHostSource(resp.Body)
+}
+
+// hostSourcePath resolves the symlinks of the file of a hosts source,
+// and checks that it still is in dir.
+func hostSourcePath(dir, path string) (string, error) {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+
+	resolved, err := filepath.EvalSymlinks(filepath.Join(root, path))
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", errHostSourceOutside
+	}
+
+	return resolved, nil
+}
+
+// readHostSource parses an IP set, failing instead of truncating it if
+// it is larger than hostSourceMaxSize.
+func readHostSource(r io.Reader) ([]netip.Prefix, error) {
+	data, err := io.ReadAll(io.LimitReader(r, hostSourceMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > hostSourceMaxSize {
+		return nil, errHostSourceTooLarge
+	}
+
+	return parseHostSource(bytes.NewReader(data))
+}
+
+// parseHostSource reads an IP set with one IP address or subnet per
+// line. Empty lines and lines starting with # are ignored. The errors
+// only give the line number, the content of the set is not logged.
+func parseHostSource(r io.Reader) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		prefix, err := parseHostPrefix(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d is not an IP address or subnet", lineNumber)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return prefixes, nil
+}
@@ -0,0 +1,454 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+)
+
+func TestParsingHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		policy  string
+		want    Hosts
+		wantErr bool
+	}{
+		{
+			name:   "single-ip",
+			format: "hujson",
+			policy: `{"hosts": {"host-1": "100.100.100.100"}, "acls": []}`,
+			want: Hosts{
+				"host-1": {Prefixes: []netip.Prefix{netip.MustParsePrefix("100.100.100.100/32")}},
+			},
+		},
+		{
+			name:   "single-ipv6",
+			format: "hujson",
+			policy: `{"hosts": {"host-1": "fd7a:115c:a1e0::1"}, "acls": []}`,
+			want: Hosts{
+				"host-1": {Prefixes: []netip.Prefix{netip.MustParsePrefix("fd7a:115c:a1e0::1/128")}},
+			},
+		},
+		{
+			name:   "list",
+			format: "hujson",
+			policy: `{
+				"hosts": {
+					"cloud": ["10.0.0.0/8", "192.168.0.0/16"],
+				},
+				"acls": [],
+			}`,
+			want: Hosts{
+				"cloud": {
+					Prefixes: []netip.Prefix{
+						netip.MustParsePrefix("10.0.0.0/8"),
+						netip.MustParsePrefix("192.168.0.0/16"),
+					},
+				},
+			},
+		},
+		{
+			name:   "yaml",
+			format: "yaml",
+			policy: `
+hosts:
+  host-1: 100.100.100.100/32
+  cloud:
+    - 10.0.0.0/8
+    - 192.168.0.0/16
+acls: []
+`,
+			want: Hosts{
+				"host-1": {Prefixes: []netip.Prefix{netip.MustParsePrefix("100.100.100.100/32")}},
+				"cloud": {
+					Prefixes: []netip.Prefix{
+						netip.MustParsePrefix("10.0.0.0/8"),
+						netip.MustParsePrefix("192.168.0.0/16"),
+					},
+				},
+			},
+		},
+		{
+			name:   "references",
+			format: "hujson",
+			policy: `{
+				"groups": {"group:ops": ["alice"]},
+				"hosts": {
+					"office": "192.168.1.0/24",
+					"internal": ["office", "10.0.0.0/8", "group:ops"],
+				},
+				"acls": [],
+			}`,
+			want: Hosts{
+				"office": {Prefixes: []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")}},
+				"internal": {
+					Prefixes:   []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+					References: []string{"office", "group:ops"},
+				},
+			},
+		},
+		{
+			name:    "invalid",
+			format:  "hujson",
+			policy:  `{"hosts": {"host-1": ["not-an-ip"]}, "acls": []}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid-ip",
+			format:  "hujson",
+			policy:  `{"hosts": {"host-1": ["10.0.0.300"]}, "acls": []}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown-group",
+			format:  "hujson",
+			policy:  `{"hosts": {"host-1": ["group:ops"]}, "acls": []}`,
+			wantErr: true,
+		},
+		{
+			name:   "cycle",
+			format: "hujson",
+			policy: `{
+				"hosts": {
+					"a": ["10.0.0.0/8", "b"],
+					"b": ["c"],
+					"c": ["a"],
+				},
+				"acls": [],
+			}`,
+			wantErr: true,
+		},
+		{
+			name:   "sources",
+			format: "hujson",
+			policy: `{
+				"hosts": {
+					"cloud": ["https://example.com/ranges.txt", "file:ranges/cloud.txt"],
+				},
+				"acls": [],
+			}`,
+			want: Hosts{
+				"cloud": {Sources: []string{"https://example.com/ranges.txt", "file:ranges/cloud.txt"}},
+			},
+		},
+		{
+			name:    "absolute-file-source",
+			format:  "hujson",
+			policy:  `{"hosts": {"cloud": ["file:/etc/passwd"]}, "acls": []}`,
+			wantErr: true,
+		},
+		{
+			name:    "file-source-outside-dir",
+			format:  "hujson",
+			policy:  `{"hosts": {"cloud": ["file:../ranges.txt"]}, "acls": []}`,
+			wantErr: true,
+		},
+		{
+			name:    "url-source-without-host",
+			format:  "hujson",
+			policy:  `{"hosts": {"cloud": ["https:///ranges.txt"]}, "acls": []}`,
+			wantErr: true,
+		},
+		{
+			name:    "self-reference",
+			format:  "hujson",
+			policy:  `{"hosts": {"a": ["a"]}, "acls": []}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pol, err := LoadACLPolicyFromBytes([]byte(tt.policy), tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadACLPolicyFromBytes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if diff := cmp.Diff(tt.want, pol.Hosts, util.Comparers...); diff != "" {
+				t.Errorf("unexpected hosts (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRefreshHostSources(t *testing.T) {
+	ranges := "# cloud ranges\n10.0.0.0/8\n\n172.16.0.1\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, ranges)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ranges.txt"), []byte("192.168.0.0/16\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	pol, err := LoadACLPolicyFromBytes([]byte(fmt.Sprintf(`{
+		"hosts": {
+			"cloud": ["%s", "file:ranges.txt"],
+		},
+		"acls": [],
+	}`, srv.URL)), "hujson")
+	if err != nil {
+		t.Fatalf("loading policy: %s", err)
+	}
+
+	expand := func() []netip.Prefix {
+		t.Helper()
+
+		ips, err := pol.ExpandAlias(types.Nodes{}, "cloud")
+		if err != nil {
+			t.Fatalf("expanding alias: %s", err)
+		}
+
+		return ips.Prefixes()
+	}
+
+	// The sources are not loaded with the policy.
+	if got := expand(); len(got) != 0 {
+		t.Errorf("expected no prefixes before the sources are loaded, got %v", got)
+	}
+
+	changed, err := pol.RefreshHostSources(context.Background(), dir)
+	if err != nil {
+		t.Fatalf("refreshing: %s", err)
+	}
+	if !changed {
+		t.Errorf("expected change when the sources are loaded")
+	}
+
+	want := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("172.16.0.1/32"),
+		netip.MustParsePrefix("192.168.0.0/16"),
+	}
+	if diff := cmp.Diff(want, expand(), util.Comparers...); diff != "" {
+		t.Errorf("unexpected prefixes (-want +got):\n%s", diff)
+	}
+
+	changed, err = pol.RefreshHostSources(context.Background(), dir)
+	if err != nil {
+		t.Fatalf("refreshing: %s", err)
+	}
+	if changed {
+		t.Errorf("expected no change when the sources are the same")
+	}
+
+	// A policy loaded again keeps the sources of the previous one
+	// until they are refreshed.
+	reloaded, err := LoadACLPolicyFromBytes([]byte(fmt.Sprintf(`{
+		"hosts": {
+			"cloud": ["%s", "file:ranges.txt"],
+		},
+		"acls": [],
+	}`, srv.URL)), "hujson")
+	if err != nil {
+		t.Fatalf("loading policy: %s", err)
+	}
+	reloaded.KeepHostSources(pol)
+
+	ips, err := reloaded.ExpandAlias(types.Nodes{}, "cloud")
+	if err != nil {
+		t.Fatalf("expanding alias: %s", err)
+	}
+	if diff := cmp.Diff(want, ips.Prefixes(), util.Comparers...); diff != "" {
+		t.Errorf("unexpected prefixes of the reloaded policy (-want +got):\n%s", diff)
+	}
+
+	ranges = "10.0.0.0/8\n"
+	changed, err = pol.RefreshHostSources(context.Background(), dir)
+	if err != nil {
+		t.Fatalf("refreshing: %s", err)
+	}
+	if !changed {
+		t.Errorf("expected change after the source was updated")
+	}
+
+	want = []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.0.0/16"),
+	}
+	if diff := cmp.Diff(want, expand(), util.Comparers...); diff != "" {
+		t.Errorf("unexpected prefixes (-want +got):\n%s", diff)
+	}
+
+	// A source that fails to load keeps its previous prefixes.
+	srv.Close()
+	if _, err := pol.RefreshHostSources(context.Background(), dir); err == nil {
+		t.Errorf("expected error refreshing from a closed server")
+	}
+	if diff := cmp.Diff(want, expand(), util.Comparers...); diff != "" {
+		t.Errorf("unexpected prefixes (-want +got):\n%s", diff)
+	}
+
+	// Files cannot be read without a hosts directory.
+	if _, err := pol.RefreshHostSources(context.Background(), ""); err == nil {
+		t.Errorf("expected error refreshing a file without a hosts directory")
+	}
+}
+
+func TestRefreshHostSourcesInvalidLine(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ranges.txt"), []byte("10.0.0.0/8\nsecret-value\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	pol, err := LoadACLPolicyFromBytes([]byte(`{
+		"hosts": {"cloud": ["file:ranges.txt"]},
+		"acls": [],
+	}`), "hujson")
+	if err != nil {
+		t.Fatalf("loading policy: %s", err)
+	}
+
+	_, err = pol.RefreshHostSources(context.Background(), dir)
+	if err == nil {
+		t.Fatal("expected error refreshing a source with an invalid line")
+	}
+	if strings.Contains(err.Error(), "secret-value") {
+		t.Errorf("error contains the content of the source: %s", err)
+	}
+}
+
+func TestExpandNestedHosts(t *testing.T) {
+	pol, err := LoadACLPolicyFromBytes([]byte(`{
+		"groups": {"group:ops": ["alice"]},
+		"hosts": {
+			"office": ["192.168.1.0/24", "192.168.2.0/24"],
+			"vpn": "10.8.0.0/16",
+			"internal": ["office", "vpn", "group:ops"],
+			"everything": ["internal", "office"],
+		},
+		"acls": [],
+	}`), "hujson")
+	if err != nil {
+		t.Fatalf("loading policy: %s", err)
+	}
+
+	nodes := types.Nodes{
+		&types.Node{
+			IPv4: iap("100.64.0.1"),
+			User: types.User{Name: "alice"},
+		},
+		&types.Node{
+			IPv4: iap("100.64.0.2"),
+			User: types.User{Name: "bob"},
+		},
+	}
+
+	ips, err := pol.ExpandAlias(nodes, "everything")
+	if err != nil {
+		t.Fatalf("expanding alias: %s", err)
+	}
+
+	want := []netip.Prefix{
+		netip.MustParsePrefix("10.8.0.0/16"),
+		netip.MustParsePrefix("100.64.0.1/32"),
+		netip.MustParsePrefix("192.168.1.0/24"),
+		netip.MustParsePrefix("192.168.2.0/24"),
+	}
+	if diff := cmp.Diff(want, ips.Prefixes(), util.Comparers...); diff != "" {
+		t.Errorf("unexpected prefixes (-want +got):\n%s", diff)
+	}
+}
+
+func TestValidateHostsCycle(t *testing.T) {
+	pol := ACLPolicy{
+		Hosts: Hosts{
+			"a": {References: []string{"b"}},
+			"b": {References: []string{"c"}},
+			"c": {References: []string{"b"}},
+		},
+	}
+
+	err := pol.validateHosts()
+	if !errors.Is(err, ErrInvalidHost) {
+		t.Fatalf("validateHosts() error = %v, want %v", err, ErrInvalidHost)
+	}
+
+	if want := `"b" references itself: b -> c -> b`; !strings.Contains(err.Error(), want) {
+		t.Errorf("validateHosts() error = %q, want it to contain %q", err, want)
+	}
+}
+
+func TestFetchHostSourceLimits(t *testing.T) {
+	dir := t.TempDir()
+	outside := filepath.Join(t.TempDir(), "secret.txt")
+	if err := os.WriteFile(outside, []byte("10.0.0.0/8\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "escape.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "ranges.txt"), []byte("192.168.0.0/16\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("ranges.txt", filepath.Join(dir, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A symlink is followed inside the hosts directory only.
+	if _, err := fetchHostSource(context.Background(), dir, "file:link.txt"); err != nil {
+		t.Errorf("expected symlink inside the hosts directory to load, got %s", err)
+	}
+	if _, err := fetchHostSource(context.Background(), dir, "file:escape.txt"); !errors.Is(err, errHostSourceOutside) {
+		t.Errorf("expected error for a symlink outside the hosts directory, got %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ranges", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "10.0.0.0/8\n")
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("10.0.0.0/8\n"), hostSourceMaxSize/10))
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/ranges", http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	if _, err := fetchHostSource(context.Background(), dir, srv.URL+"/redirect"); err != nil {
+		t.Errorf("expected redirect to load, got %s", err)
+	}
+	if _, err := fetchHostSource(context.Background(), dir, srv.URL+"/loop"); err == nil {
+		t.Error("expected error for a redirect loop")
+	}
+	if _, err := fetchHostSource(context.Background(), dir, srv.URL+"/large"); !errors.Is(err, errHostSourceTooLarge) {
+		t.Errorf("expected error for a large source, got %v", err)
+	}
+
+	tlsSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, srv.URL+"/ranges", http.StatusFound)
+	}))
+	defer tlsSrv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, tlsSrv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := *hostSourceClient
+	client.Transport = tlsSrv.Client().Transport
+	if _, err := client.Do(req); err == nil {
+		t.Error("expected error for a redirect from https to http")
+	}
+}
@@ -0,0 +1,62 @@
+package policy
+
+import (
+	"maps"
+	"slices"
+	"sync"
+)
+
+// idpGroups holds the members of the groups given by the identity
+// provider, keyed by the name of the group in the policy.
+type idpGroups struct {
+	mu      sync.RWMutex
+	members Groups
+
+	// version is increased every time the members change.
+	version uint64
+}
+
+func (g *idpGroups) get(group string) []string {
+	if g == nil {
+		return nil
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return g.members[group]
+}
+
+func (g *idpGroups) getVersion() uint64 {
+	if g == nil {
+		return 0
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return g.version
+}
+
+// SetIdPGroups sets the members of the groups given by the identity
+// provider, they are added to the members of the groups of the policy.
+// Once set, groups the policy does not define are no longer an error,
+// their members all come from the identity provider. It reports if the
+// members changed, in which case the filter rules need to be compiled
+// again.
+func (pol *ACLPolicy) SetIdPGroups(groups Groups) bool {
+	if pol.idpGroups == nil {
+		pol.idpGroups = &idpGroups{}
+	}
+
+	pol.idpGroups.mu.Lock()
+	defer pol.idpGroups.mu.Unlock()
+
+	changed := !maps.EqualFunc(groups, pol.idpGroups.members, slices.Equal[[]string])
+	pol.idpGroups.members = groups
+	if changed {
+		pol.idpGroups.version++
+	}
+
+	return changed
+}
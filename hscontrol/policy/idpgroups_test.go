@@ -0,0 +1,83 @@
+package policy
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+)
+
+func TestSetIdPGroups(t *testing.T) {
+	pol, err := LoadACLPolicyFromBytes([]byte(`{
+		"groups": {
+			"group:admins": ["alice"],
+		},
+		"acls": [],
+	}`), "hujson")
+	if err != nil {
+		t.Fatalf("loading policy: %s", err)
+	}
+
+	ip := func(addr string) *netip.Addr {
+		ip := netip.MustParseAddr(addr)
+
+		return &ip
+	}
+	nodes := types.Nodes{
+		{ID: 1, IPv4: ip("100.64.0.1"), User: types.User{Name: "alice"}},
+		{ID: 2, IPv4: ip("100.64.0.2"), User: types.User{Name: "bob"}},
+		{ID: 3, IPv4: ip("100.64.0.3"), User: types.User{Name: "carol"}},
+	}
+
+	expand := func(group string) []netip.Prefix {
+		t.Helper()
+
+		ips, err := pol.ExpandAlias(nodes, group)
+		if err != nil {
+			t.Fatalf("expanding %s: %s", group, err)
+		}
+
+		return ips.Prefixes()
+	}
+
+	if _, err := pol.ExpandAlias(nodes, "group:engineering"); err == nil {
+		t.Errorf("expected error expanding a group missing from the policy")
+	}
+
+	changed := pol.SetIdPGroups(Groups{
+		"group:admins":      {"bob"},
+		"group:engineering": {"carol"},
+	})
+	if !changed {
+		t.Errorf("expected change after setting the groups")
+	}
+
+	want := []netip.Prefix{
+		netip.MustParsePrefix("100.64.0.1/32"),
+		netip.MustParsePrefix("100.64.0.2/32"),
+	}
+	if diff := cmp.Diff(want, expand("group:admins"), util.Comparers...); diff != "" {
+		t.Errorf("unexpected prefixes of group:admins (-want +got):\n%s", diff)
+	}
+
+	want = []netip.Prefix{netip.MustParsePrefix("100.64.0.3/32")}
+	if diff := cmp.Diff(want, expand("group:engineering"), util.Comparers...); diff != "" {
+		t.Errorf("unexpected prefixes of group:engineering (-want +got):\n%s", diff)
+	}
+
+	// Once the groups come from the identity provider, an unknown group
+	// has no members rather than being an error.
+	if got := expand("group:unknown"); len(got) != 0 {
+		t.Errorf("expected no prefixes for an unknown group, got %v", got)
+	}
+
+	changed = pol.SetIdPGroups(Groups{
+		"group:admins":      {"bob"},
+		"group:engineering": {"carol"},
+	})
+	if changed {
+		t.Errorf("expected no change when the groups are the same")
+	}
+}
@@ -0,0 +1,57 @@
+package policy
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"go4.org/netipx"
+)
+
+// labelPrefix is the prefix of the aliases selecting the nodes by their
+// labels, such as "label:env=prod,!legacy".
+const labelPrefix = "label:"
+
+// expandIPsFromLabel returns the IPs of the nodes whose labels match
+// the selector of the alias.
+func expandIPsFromLabel(alias string, nodes types.Nodes) (*netipx.IPSet, error) {
+	selector, err := types.ParseLabelSelector(strings.TrimPrefix(alias, labelPrefix))
+	if err != nil {
+		return nil, err
+	}
+
+	var build netipx.IPSetBuilder
+	for _, node := range nodes {
+		if selector.Matches(node.Labels) {
+			node.AppendToIPSet(&build)
+		}
+	}
+
+	return build.IPSet()
+}
+
+// validateLabelAliases checks the selectors of the label aliases of the
+// sources and destinations of an ACL.
+func validateLabelAliases(acl ACL) error {
+	aliases := slices.Clone(acl.Sources)
+	for _, dest := range acl.Destinations {
+		alias, _, err := parseDestination(dest)
+		if err != nil {
+			continue
+		}
+		aliases = append(aliases, alias)
+	}
+
+	for _, alias := range aliases {
+		if !isLabel(alias) {
+			continue
+		}
+
+		if _, err := types.ParseLabelSelector(strings.TrimPrefix(alias, labelPrefix)); err != nil {
+			return fmt.Errorf("alias %q: %w", alias, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+var ErrInvalidNodeAttr = errors.New("invalid nodeAttr")
+
+// funnelPorts are the ports a node can expose with Funnel, the same as
+// in Tailscale.
+const funnelPorts = "443,8443,10000"
+
+// nodeAttrCapabilities are the capabilities sent to the nodes for the
+// attributes which stand for more than one capability. Funnel needs
+// HTTPS, and is only allowed on the funnelPorts. Other attributes are
+// sent as they are.
+var nodeAttrCapabilities = map[string][]tailcfg.NodeCapability{
+	"funnel": {
+		tailcfg.NodeAttrFunnel,
+		tailcfg.CapabilityHTTPS,
+		tailcfg.CapabilityFunnelPorts + "?ports=" + funnelPorts,
+	},
+}
+
+// nodeAttrNameRegex matches the names of the attributes defined by
+// Tailscale, like funnel, drive:share, nextdns:abc123 or
+// one-cgnat?v=true.
+var nodeAttrNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*(:[a-zA-Z0-9._-]+)*(\?[^\s]+)?$`)
+
+// validateNodeAttr checks that the rule has targets and attributes, that
+// the attributes are either names like the ones defined by Tailscale or
+// https URLs, and that the capabilities in app are a domain followed by
+// a path.
+func validateNodeAttr(nodeAttr NodeAttr) error {
+	if len(nodeAttr.Targets) == 0 {
+		return errors.New("target must be set")
+	}
+
+	if len(nodeAttr.Attrs) == 0 && len(nodeAttr.App) == 0 {
+		return errors.New("at least one of attr or app must be set")
+	}
+
+	for _, attr := range nodeAttr.Attrs {
+		if err := validateNodeAttrName(attr); err != nil {
+			return err
+		}
+	}
+
+	for name, values := range nodeAttr.App {
+		if !capabilityNameRegex.MatchString(string(name)) {
+			return fmt.Errorf("capability name %q must be of the form {domain}/{path}", name)
+		}
+
+		if name == capAppConnectors {
+			if err := validateAppConnectors(values); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func validateNodeAttrName(attr string) error {
+	if strings.HasPrefix(attr, "https://") {
+		u, err := url.Parse(attr)
+		if err != nil || u.Host == "" || u.Path == "" || strings.ContainsAny(attr, " \t\n") {
+			return fmt.Errorf("attribute %q is not a valid URL", attr)
+		}
+
+		return nil
+	}
+
+	if !nodeAttrNameRegex.MatchString(attr) {
+		return fmt.Errorf("attribute %q must be a name like funnel or an https URL", attr)
+	}
+
+	return nil
+}
+
+// NodeAttributes returns the capabilities given to the node by the
+// nodeAttrs rules it is a target of, the values of a capability given by
+// several rules are merged.
+func (pol *ACLPolicy) NodeAttributes(node *types.Node) (tailcfg.NodeCapMap, error) {
+	if pol == nil || len(pol.NodeAttrs) == 0 {
+		return nil, nil
+	}
+
+	capMap := tailcfg.NodeCapMap{}
+
+	for index, nodeAttr := range pol.NodeAttrs {
+		matched := false
+		for _, target := range nodeAttr.Targets {
+			// A tag without owners is only invalid if no node has it
+			// forced, which cannot be told from a single node.
+			ips, err := pol.ExpandAlias(types.Nodes{node}, target)
+			if errors.Is(err, ErrInvalidTag) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%w, nodeAttr index: %d: %w", ErrInvalidNodeAttr, index, err)
+			}
+
+			if node.InIPSet(ips) {
+				matched = true
+
+				break
+			}
+		}
+
+		if !matched {
+			continue
+		}
+
+		for _, attr := range nodeAttr.Attrs {
+			capabilities, ok := nodeAttrCapabilities[attr]
+			if !ok {
+				capabilities = []tailcfg.NodeCapability{tailcfg.NodeCapability(attr)}
+			}
+
+			for _, capability := range capabilities {
+				if _, ok := capMap[capability]; !ok {
+					capMap[capability] = []tailcfg.RawMessage{}
+				}
+			}
+		}
+
+		for name, values := range nodeAttr.App {
+			capMap[name] = append(capMap[name], values...)
+		}
+	}
+
+	return capMap, nil
+}
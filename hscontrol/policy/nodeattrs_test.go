@@ -0,0 +1,114 @@
+package policy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+func TestNodeAttributes(t *testing.T) {
+	pol, err := LoadACLPolicyFromBytes([]byte(`{
+		"tagOwners": {"tag:web": ["user1"]},
+		"nodeAttrs": [
+			{"target": ["tag:web"], "attr": ["funnel"]},
+			{"target": ["*"], "attr": ["drive:access", "one-cgnat?v=true"]},
+			{"target": ["user1"], "attr": ["https://example.com/cap/test"]},
+		],
+	}`), "hujson")
+	if err != nil {
+		t.Fatalf("loading policy: %s", err)
+	}
+
+	web := &types.Node{
+		IPv4:       iap("100.64.0.1"),
+		User:       types.User{Name: "user1"},
+		ForcedTags: []string{"tag:web"},
+		Hostinfo:   &tailcfg.Hostinfo{},
+	}
+	// Tagged nodes are not targeted by their user.
+	other := &types.Node{
+		IPv4:     iap("100.64.0.2"),
+		User:     types.User{Name: "user1"},
+		Hostinfo: &tailcfg.Hostinfo{},
+	}
+
+	got, err := pol.NodeAttributes(web)
+	if err != nil {
+		t.Fatalf("NodeAttributes() error = %v", err)
+	}
+
+	want := tailcfg.NodeCapMap{
+		tailcfg.NodeAttrFunnel:  []tailcfg.RawMessage{},
+		tailcfg.CapabilityHTTPS: []tailcfg.RawMessage{},
+		"https://tailscale.com/cap/funnel-ports?ports=443,8443,10000": []tailcfg.RawMessage{},
+		tailcfg.NodeAttrsTaildriveAccess:                              []tailcfg.RawMessage{},
+		tailcfg.NodeAttrOneCGNATEnable:                                []tailcfg.RawMessage{},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("NodeAttributes() unexpected result (-want +got):\n%s", diff)
+	}
+
+	got, err = pol.NodeAttributes(other)
+	if err != nil {
+		t.Fatalf("NodeAttributes() error = %v", err)
+	}
+
+	want = tailcfg.NodeCapMap{
+		tailcfg.NodeAttrsTaildriveAccess: []tailcfg.RawMessage{},
+		tailcfg.NodeAttrOneCGNATEnable:   []tailcfg.RawMessage{},
+		"https://example.com/cap/test":   []tailcfg.RawMessage{},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("NodeAttributes() unexpected result (-want +got):\n%s", diff)
+	}
+}
+
+func TestLoadPolicyWithInvalidNodeAttr(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+	}{
+		{
+			name: "no-target",
+			policy: `{
+				"nodeAttrs": [{"target": [], "attr": ["funnel"]}],
+			}`,
+		},
+		{
+			name: "no-attr",
+			policy: `{
+				"nodeAttrs": [{"target": ["*"], "attr": []}],
+			}`,
+		},
+		{
+			name: "invalid-name",
+			policy: `{
+				"nodeAttrs": [{"target": ["*"], "attr": ["Not An Attr"]}],
+			}`,
+		},
+		{
+			name: "http-url",
+			policy: `{
+				"nodeAttrs": [{"target": ["*"], "attr": ["http://example.com/cap/test"]}],
+			}`,
+		},
+		{
+			name: "url-without-path",
+			policy: `{
+				"nodeAttrs": [{"target": ["*"], "attr": ["https://example.com"]}],
+			}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadACLPolicyFromBytes([]byte(tt.policy), "hujson")
+			if !errors.Is(err, ErrInvalidNodeAttr) {
+				t.Errorf("expected ErrInvalidNodeAttr, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,360 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"go4.org/netipx"
+	"tailscale.com/util/cmpver"
+)
+
+var ErrInvalidPosture = errors.New("invalid posture")
+
+const (
+	posturePrefix         = "posture:"
+	postureNodePrefix     = "node:"
+	postureCustomPrefix   = "custom:"
+	postureNodeOS         = "node:os"
+	postureNodeOSVersion  = "node:osVersion"
+	postureNodeTSVersion  = "node:tsVersion"
+	postureOperatorIsSet  = "IS SET"
+	postureOperatorNotSet = "NOT SET"
+	postureOperatorIn     = "IN"
+	postureOperatorNotIn  = "NOT IN"
+)
+
+var postureNodeAttributes = []string{
+	postureNodeOS,
+	postureNodeOSVersion,
+	postureNodeTSVersion,
+}
+
+var postureComparisons = []string{"==", "!=", "<", "<=", ">", ">="}
+
+// postureCondition is a single condition of a posture, such as
+// "node:os == 'macos'" or "custom:managed IS SET".
+type postureCondition struct {
+	attribute string
+	operator  string
+	values    []string
+}
+
+func isPosture(str string) bool {
+	return strings.HasPrefix(str, posturePrefix)
+}
+
+// IsCustomPostureAttribute reports if the name is a valid name for a
+// custom posture attribute, which can be set on a node through the API.
+func IsCustomPostureAttribute(name string) bool {
+	attr, ok := strings.CutPrefix(name, postureCustomPrefix)
+	if !ok || attr == "" {
+		return false
+	}
+
+	for _, r := range attr {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '_' || r == '-') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parsePostureCondition parses a condition of the form
+// "<attribute> <operator> <value>", where the value is a quoted
+// string, a number or a boolean, or a list of them in brackets for
+// IN and NOT IN. IS SET and NOT SET take no value.
+func parsePostureCondition(str string) (postureCondition, error) {
+	attribute, rest, _ := strings.Cut(strings.TrimSpace(str), " ")
+	rest = strings.TrimSpace(rest)
+
+	if !IsCustomPostureAttribute(attribute) && !slices.Contains(postureNodeAttributes, attribute) {
+		return postureCondition{}, fmt.Errorf("unknown attribute %q in %q", attribute, str)
+	}
+
+	cond := postureCondition{attribute: attribute}
+
+	switch {
+	case rest == postureOperatorIsSet, rest == postureOperatorNotSet:
+		cond.operator = rest
+
+		return cond, nil
+
+	case strings.HasPrefix(rest, postureOperatorNotIn+" "), strings.HasPrefix(rest, postureOperatorIn+" "):
+		cond.operator = postureOperatorIn
+		if strings.HasPrefix(rest, postureOperatorNotIn) {
+			cond.operator = postureOperatorNotIn
+		}
+
+		list := strings.TrimSpace(strings.TrimPrefix(rest, cond.operator))
+		inner, ok := strings.CutPrefix(list, "[")
+		inner, ok2 := strings.CutSuffix(inner, "]")
+		if !ok || !ok2 {
+			return postureCondition{}, fmt.Errorf("expected a list of values in brackets in %q", str)
+		}
+
+		for _, item := range strings.Split(inner, ",") {
+			value, err := parsePostureValue(item)
+			if err != nil {
+				return postureCondition{}, fmt.Errorf("parsing %q: %w", str, err)
+			}
+			cond.values = append(cond.values, value)
+		}
+
+		return cond, nil
+	}
+
+	operator, rawValue, _ := strings.Cut(rest, " ")
+	if !slices.Contains(postureComparisons, operator) {
+		return postureCondition{}, fmt.Errorf("unknown operator %q in %q", operator, str)
+	}
+
+	value, err := parsePostureValue(rawValue)
+	if err != nil {
+		return postureCondition{}, fmt.Errorf("parsing %q: %w", str, err)
+	}
+
+	cond.operator = operator
+	cond.values = []string{value}
+
+	return cond, nil
+}
+
+// parsePostureValue parses a quoted string, a number or a boolean.
+func parsePostureValue(str string) (string, error) {
+	str = strings.TrimSpace(str)
+
+	if len(str) >= 2 && (str[0] == '\'' || str[0] == '"') && str[len(str)-1] == str[0] {
+		return str[1 : len(str)-1], nil
+	}
+
+	if str == "true" || str == "false" {
+		return str, nil
+	}
+
+	if _, err := strconv.ParseFloat(str, 64); err == nil {
+		return str, nil
+	}
+
+	return "", fmt.Errorf("invalid value %q, strings must be quoted", str)
+}
+
+// matches reports if the attributes of a node satisfy the condition.
+// A condition on an attribute the node does not have is only
+// satisfied by NOT SET.
+func (cond postureCondition) matches(attrs map[string]string) bool {
+	value, ok := attrs[cond.attribute]
+
+	switch cond.operator {
+	case postureOperatorIsSet:
+		return ok
+	case postureOperatorNotSet:
+		return !ok
+	}
+
+	if !ok {
+		return false
+	}
+
+	switch cond.operator {
+	case postureOperatorIn:
+		return slices.Contains(cond.values, value)
+	case postureOperatorNotIn:
+		return !slices.Contains(cond.values, value)
+	case "==":
+		return value == cond.values[0]
+	case "!=":
+		return value != cond.values[0]
+	}
+
+	cmp := comparePostureValues(value, cond.values[0])
+	switch cond.operator {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+
+	return false
+}
+
+// comparePostureValues compares two values as numbers if both are
+// numbers, and as versions otherwise.
+func comparePostureValues(a, b string) int {
+	numA, errA := strconv.ParseFloat(a, 64)
+	numB, errB := strconv.ParseFloat(b, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case numA < numB:
+			return -1
+		case numA > numB:
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	return cmpver.Compare(a, b)
+}
+
+// postureAttributes returns the attributes of a node the conditions of
+// a posture are checked against: the attributes reported by the client
+// in its Hostinfo and the custom attributes set through the API.
+func postureAttributes(node *types.Node) map[string]string {
+	attrs := make(map[string]string, len(node.PostureAttributes)+len(postureNodeAttributes))
+	for name, value := range node.PostureAttributes {
+		attrs[name] = value
+	}
+
+	if node.Hostinfo != nil {
+		if node.Hostinfo.OS != "" {
+			attrs[postureNodeOS] = strings.ToLower(node.Hostinfo.OS)
+		}
+		if node.Hostinfo.OSVersion != "" {
+			attrs[postureNodeOSVersion] = node.Hostinfo.OSVersion
+		}
+		if node.Hostinfo.IPNVersion != "" {
+			// The short version, without the commit hashes.
+			version, _, _ := strings.Cut(node.Hostinfo.IPNVersion, "-")
+			attrs[postureNodeTSVersion] = version
+		}
+	}
+
+	return attrs
+}
+
+// validatePostures checks that the postures and their conditions can
+// be parsed, and that every srcPosture refers to a defined posture.
+func (pol *ACLPolicy) validatePostures() error {
+	for name, conditions := range pol.Postures {
+		if !isPosture(name) {
+			return fmt.Errorf("%w: name must start with %s, got %q", ErrInvalidPosture, posturePrefix, name)
+		}
+
+		for _, condition := range conditions {
+			if _, err := parsePostureCondition(condition); err != nil {
+				return fmt.Errorf("%w: %s: %w", ErrInvalidPosture, name, err)
+			}
+		}
+	}
+
+	for index, acl := range pol.ACLs {
+		if err := pol.validateSrcPosture(acl.SrcPosture); err != nil {
+			return fmt.Errorf("acl index: %d: %w", index, err)
+		}
+	}
+
+	for index, grant := range pol.Grants {
+		if err := pol.validateSrcPosture(grant.SrcPosture); err != nil {
+			return fmt.Errorf("grant index: %d: %w", index, err)
+		}
+	}
+
+	return nil
+}
+
+func (pol *ACLPolicy) validateSrcPosture(srcPosture []string) error {
+	for _, name := range srcPosture {
+		if _, ok := pol.Postures[name]; !ok {
+			return fmt.Errorf("%w: %q is not defined in postures", ErrInvalidPosture, name)
+		}
+	}
+
+	return nil
+}
+
+// matchesPosture reports if the node satisfies all the conditions of
+// the posture.
+func (pol *ACLPolicy) matchesPosture(node *types.Node, name string) (bool, error) {
+	conditions, ok := pol.Postures[name]
+	if !ok {
+		return false, fmt.Errorf("%w: %q is not defined in postures", ErrInvalidPosture, name)
+	}
+
+	attrs := postureAttributes(node)
+	for _, condition := range conditions {
+		cond, err := parsePostureCondition(condition)
+		if err != nil {
+			return false, fmt.Errorf("%w: %s: %w", ErrInvalidPosture, name, err)
+		}
+
+		if !cond.matches(attrs) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// nodesMatchingPostures returns the nodes satisfying at least one of
+// the postures.
+func (pol *ACLPolicy) nodesMatchingPostures(
+	srcPosture []string,
+	nodes types.Nodes,
+) (types.Nodes, error) {
+	var matching types.Nodes
+	for _, node := range nodes {
+		for _, name := range srcPosture {
+			ok, err := pol.matchesPosture(node, name)
+			if err != nil {
+				return nil, err
+			}
+
+			if ok {
+				matching = append(matching, node)
+
+				break
+			}
+		}
+	}
+
+	return matching, nil
+}
+
+// expandPostureSources expands the sources of a rule with srcPosture.
+// Only tailnet nodes can satisfy a posture, so the sources are limited
+// to the IPs of the nodes matching at least one of the postures, even
+// for the wildcard and IP ranges.
+func (pol *ACLPolicy) expandPostureSources(
+	sources []string,
+	srcPosture []string,
+	nodes types.Nodes,
+) (*netipx.IPSet, error) {
+	matching, err := pol.nodesMatchingPostures(srcPosture, nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	var srcs netipx.IPSetBuilder
+	for _, src := range sources {
+		ipSet, err := pol.ExpandAlias(matching, src)
+		if err != nil {
+			return nil, err
+		}
+
+		if ipSet != nil {
+			srcs.AddSet(ipSet)
+		}
+	}
+
+	var allowed netipx.IPSetBuilder
+	for _, node := range matching {
+		node.AppendToIPSet(&allowed)
+	}
+
+	allowedSet, err := allowed.IPSet()
+	if err != nil {
+		return nil, err
+	}
+	srcs.Intersect(allowedSet)
+
+	return srcs.IPSet()
+}
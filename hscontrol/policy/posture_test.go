@@ -0,0 +1,208 @@
+package policy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+func TestPostureConditions(t *testing.T) {
+	node := &types.Node{
+		Hostinfo: &tailcfg.Hostinfo{
+			OS:         "macOS",
+			OSVersion:  "14.5",
+			IPNVersion: "1.66.4-t1234abcd-g5678",
+		},
+		PostureAttributes: types.PostureAttributes{
+			"custom:managed": "true",
+			"custom:score":   "85",
+			"custom:team":    "infra",
+		},
+	}
+
+	tests := []struct {
+		condition string
+		want      bool
+		wantErr   bool
+	}{
+		{condition: "node:os == 'macos'", want: true},
+		{condition: "node:os != 'macos'", want: false},
+		{condition: "node:os IN ['linux', 'macos']", want: true},
+		{condition: "node:os NOT IN ['linux', 'windows']", want: true},
+		{condition: "node:osVersion >= '14.0'", want: true},
+		{condition: "node:tsVersion >= '1.66.4'", want: true},
+		{condition: "node:tsVersion < '1.60'", want: false},
+		{condition: "custom:managed == true", want: true},
+		{condition: "custom:score > 80", want: true},
+		{condition: "custom:score <= 80", want: false},
+		{condition: `custom:team == "infra"`, want: true},
+		{condition: "custom:team IS SET", want: true},
+		{condition: "custom:missing NOT SET", want: true},
+		{condition: "custom:missing != 'infra'", want: false},
+		{condition: "custom:missing NOT IN ['infra']", want: false},
+		{condition: "node:unknown == 'x'", wantErr: true},
+		{condition: "custom:team = 'infra'", wantErr: true},
+		{condition: "custom:team == infra", wantErr: true},
+		{condition: "custom:team IN 'infra'", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.condition, func(t *testing.T) {
+			cond, err := parsePostureCondition(tt.condition)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error parsing %q", tt.condition)
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsing %q: %s", tt.condition, err)
+			}
+
+			if got := cond.matches(postureAttributes(node)); got != tt.want {
+				t.Errorf("matches() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePostures(t *testing.T) {
+	tests := []struct {
+		name    string
+		pol     ACLPolicy
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			pol: ACLPolicy{
+				Postures: Postures{
+					"posture:latestMac": {"node:os == 'macos'", "node:tsVersion >= '1.60'"},
+				},
+				ACLs: []ACL{
+					{Action: "accept", Sources: []string{"*"}, Destinations: []string{"*:*"}, SrcPosture: []string{"posture:latestMac"}},
+				},
+			},
+		},
+		{
+			name: "undefined-posture",
+			pol: ACLPolicy{
+				Grants: []Grant{
+					{Sources: []string{"*"}, Destinations: []string{"*"}, IP: []string{"*"}, SrcPosture: []string{"posture:missing"}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid-name",
+			pol: ACLPolicy{
+				Postures: Postures{
+					"latestMac": {"node:os == 'macos'"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid-condition",
+			pol: ACLPolicy{
+				Postures: Postures{
+					"posture:latestMac": {"node:os is macos"},
+				},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.pol.validatePostures()
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("validatePostures() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidPosture) {
+				t.Errorf("expected ErrInvalidPosture, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCompileFilterRulesSrcPosture(t *testing.T) {
+	mac := &types.Node{
+		IPv4:     iap("100.64.0.1"),
+		IPv6:     iap("fd7a:115c:a1e0::1"),
+		User:     types.User{Name: "user1"},
+		Hostinfo: &tailcfg.Hostinfo{OS: "macOS"},
+	}
+	managed := &types.Node{
+		IPv4:              iap("100.64.0.2"),
+		IPv6:              iap("fd7a:115c:a1e0::2"),
+		User:              types.User{Name: "user1"},
+		Hostinfo:          &tailcfg.Hostinfo{OS: "linux"},
+		PostureAttributes: types.PostureAttributes{"custom:managed": "true"},
+	}
+	other := &types.Node{
+		IPv4:     iap("100.64.0.3"),
+		IPv6:     iap("fd7a:115c:a1e0::3"),
+		User:     types.User{Name: "user2"},
+		Hostinfo: &tailcfg.Hostinfo{OS: "linux"},
+	}
+	nodes := types.Nodes{mac, managed, other}
+
+	pol := &ACLPolicy{
+		Postures: Postures{
+			"posture:mac":     {"node:os == 'macos'"},
+			"posture:managed": {"custom:managed == true"},
+		},
+		ACLs: []ACL{
+			{
+				Action:       "accept",
+				Sources:      []string{"*"},
+				Destinations: []string{"user2:22"},
+				SrcPosture:   []string{"posture:mac", "posture:managed"},
+			},
+		},
+		Grants: []Grant{
+			{
+				Sources:      []string{"user1"},
+				Destinations: []string{"user2"},
+				IP:           []string{"tcp:443"},
+				SrcPosture:   []string{"posture:managed"},
+			},
+		},
+	}
+
+	want := []tailcfg.FilterRule{
+		{
+			SrcIPs: []string{
+				"100.64.0.1/32",
+				"100.64.0.2/32",
+				"fd7a:115c:a1e0::1/128",
+				"fd7a:115c:a1e0::2/128",
+			},
+			DstPorts: []tailcfg.NetPortRange{
+				{IP: "100.64.0.3/32", Ports: tailcfg.PortRange{First: 22, Last: 22}},
+				{IP: "fd7a:115c:a1e0::3/128", Ports: tailcfg.PortRange{First: 22, Last: 22}},
+			},
+		},
+		{
+			SrcIPs: []string{"100.64.0.2", "fd7a:115c:a1e0::2"},
+			DstPorts: []tailcfg.NetPortRange{
+				{IP: "100.64.0.3", Ports: tailcfg.PortRange{First: 443, Last: 443}},
+				{IP: "fd7a:115c:a1e0::3", Ports: tailcfg.PortRange{First: 443, Last: 443}},
+			},
+			IPProto: []int{protocolTCP},
+		},
+	}
+
+	got, err := pol.CompileFilterRules(nodes)
+	if err != nil {
+		t.Fatalf("CompileFilterRules() error: %s", err)
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("CompileFilterRules() unexpected result (-want +got):\n%s", diff)
+	}
+}
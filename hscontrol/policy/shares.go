@@ -0,0 +1,130 @@
+package policy
+
+import (
+	"maps"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"go4.org/netipx"
+)
+
+// nodeShares holds the names of the users the nodes are shared with,
+// keyed by the ID of the node.
+type nodeShares struct {
+	mu    sync.RWMutex
+	users map[types.NodeID][]string
+
+	// version is increased every time the shares change.
+	version uint64
+}
+
+func (s *nodeShares) sharedWith(nodeID types.NodeID, users []string) bool {
+	if s == nil {
+		return false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, user := range s.users[nodeID] {
+		if slices.Contains(users, user) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *nodeShares) getVersion() uint64 {
+	if s == nil {
+		return 0
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.version
+}
+
+// SetNodeShares sets the users the nodes are shared with. A destination
+// of the policy standing for users, a user or a group, also covers the
+// nodes shared with them. It reports if the shares changed, in which
+// case the filter rules need to be compiled again.
+func (pol *ACLPolicy) SetNodeShares(users map[types.NodeID][]string) bool {
+	if pol.nodeShares == nil {
+		pol.nodeShares = &nodeShares{}
+	}
+
+	pol.nodeShares.mu.Lock()
+	defer pol.nodeShares.mu.Unlock()
+
+	changed := !maps.EqualFunc(users, pol.nodeShares.users, slices.Equal[[]string])
+	pol.nodeShares.users = users
+	if changed {
+		pol.nodeShares.version++
+	}
+
+	return changed
+}
+
+// destinationUsers returns the users a destination alias stands for,
+// nil if it is not a user or a group.
+func (pol *ACLPolicy) destinationUsers(alias string) []string {
+	switch {
+	case isWildcard(alias), isTag(alias), isLabel(alias), isAutoGroup(alias):
+		return nil
+	case isGroup(alias):
+		users, err := pol.expandUsersFromGroup(alias)
+		if err != nil {
+			return nil
+		}
+
+		return users
+	}
+
+	if _, ok := pol.Hosts[alias]; ok {
+		return nil
+	}
+
+	if _, err := netip.ParseAddr(alias); err == nil {
+		return nil
+	}
+
+	if _, err := netip.ParsePrefix(alias); err == nil {
+		return nil
+	}
+
+	return []string{alias}
+}
+
+// withSharedNodes adds to the IPs of a destination alias the IPs of the
+// nodes shared with the users it stands for.
+func (pol *ACLPolicy) withSharedNodes(
+	ips *netipx.IPSet,
+	alias string,
+	nodes types.Nodes,
+) (*netipx.IPSet, error) {
+	if pol.nodeShares.getVersion() == 0 {
+		return ips, nil
+	}
+
+	users := pol.destinationUsers(alias)
+	if len(users) == 0 {
+		return ips, nil
+	}
+
+	var build netipx.IPSetBuilder
+	if ips != nil {
+		build.AddSet(ips)
+	}
+
+	for _, node := range nodes {
+		if pol.nodeShares.sharedWith(node.ID, users) {
+			node.AppendToIPSet(&build)
+		}
+	}
+
+	return build.IPSet()
+}
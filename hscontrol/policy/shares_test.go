@@ -0,0 +1,97 @@
+package policy
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"tailscale.com/tailcfg"
+)
+
+func TestSetNodeShares(t *testing.T) {
+	pol, err := LoadACLPolicyFromBytes([]byte(`{
+		"groups": {
+			"group:ops": ["carol"],
+		},
+		"acls": [
+			{"action": "accept", "src": ["bob"], "dst": ["bob:*"]},
+			{"action": "accept", "src": ["group:ops"], "dst": ["group:ops:22"]},
+		],
+	}`), "hujson")
+	if err != nil {
+		t.Fatalf("loading policy: %s", err)
+	}
+
+	ip := func(addr string) *netip.Addr {
+		ip := netip.MustParseAddr(addr)
+
+		return &ip
+	}
+	nodes := types.Nodes{
+		{ID: 1, IPv4: ip("100.64.0.1"), User: types.User{Name: "alice"}, Hostinfo: &tailcfg.Hostinfo{}},
+		{ID: 2, IPv4: ip("100.64.0.2"), User: types.User{Name: "bob"}, Hostinfo: &tailcfg.Hostinfo{}},
+		{ID: 3, IPv4: ip("100.64.0.3"), User: types.User{Name: "carol"}, Hostinfo: &tailcfg.Hostinfo{}},
+	}
+
+	peers := func(node *types.Node) []types.NodeID {
+		t.Helper()
+
+		rules, err := pol.CompileFilterRules(nodes)
+		if err != nil {
+			t.Fatalf("compiling rules: %s", err)
+		}
+
+		var ids []types.NodeID
+		for _, peer := range FilterNodesByACL(node, nodes, rules) {
+			ids = append(ids, peer.ID)
+		}
+
+		return ids
+	}
+
+	if got := peers(nodes[0]); len(got) != 0 {
+		t.Errorf("expected alice to have no peers before sharing, got %v", got)
+	}
+
+	if changed := pol.SetNodeShares(map[types.NodeID][]string{1: {"bob", "carol"}}); !changed {
+		t.Errorf("expected change after sharing the node")
+	}
+
+	if diff := cmp.Diff([]types.NodeID{2, 3}, peers(nodes[0])); diff != "" {
+		t.Errorf("unexpected peers of the shared node (-want +got):\n%s", diff)
+	}
+
+	// The shared node is only a destination, it cannot reach the nodes
+	// of the users it is shared with.
+	dsts, err := pol.expandDestination(nodes, "group:ops")
+	if err != nil {
+		t.Fatalf("expanding group:ops: %s", err)
+	}
+	want := []netip.Prefix{
+		netip.MustParsePrefix("100.64.0.1/32"),
+		netip.MustParsePrefix("100.64.0.3/32"),
+	}
+	if diff := cmp.Diff(want, dsts.Prefixes(), util.Comparers...); diff != "" {
+		t.Errorf("unexpected destinations of group:ops (-want +got):\n%s", diff)
+	}
+
+	srcs, err := pol.ExpandAlias(nodes, "group:ops")
+	if err != nil {
+		t.Fatalf("expanding group:ops: %s", err)
+	}
+	want = []netip.Prefix{netip.MustParsePrefix("100.64.0.3/32")}
+	if diff := cmp.Diff(want, srcs.Prefixes(), util.Comparers...); diff != "" {
+		t.Errorf("unexpected sources of group:ops (-want +got):\n%s", diff)
+	}
+
+	if changed := pol.SetNodeShares(map[types.NodeID][]string{1: {"bob", "carol"}}); changed {
+		t.Errorf("expected no change setting the same shares")
+	}
+
+	pol.SetNodeShares(map[types.NodeID][]string{})
+	if got := peers(nodes[0]); len(got) != 0 {
+		t.Errorf("expected alice to have no peers after unsharing, got %v", got)
+	}
+}
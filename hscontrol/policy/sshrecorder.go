@@ -0,0 +1,116 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"slices"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+var ErrInvalidSSHRecorder = errors.New("invalid SSH recorder")
+
+const sshNoRecorderMessage = "# Session recording is required, but no recorder is available.\n"
+
+// validateSSHRecorders checks that the recorders of an SSH rule are tags,
+// as recorders are nodes running tsrecorder and are never owned by users.
+func validateSSHRecorders(ssh SSH) error {
+	for _, recorder := range ssh.Recorders {
+		if !isTag(recorder) {
+			return fmt.Errorf("recorder must be a tag, got %q", recorder)
+		}
+	}
+
+	if ssh.EnforceRecorder && len(ssh.Recorders) == 0 {
+		return errors.New("enforceRecorder requires a recorder")
+	}
+
+	return nil
+}
+
+// SSHRecordingFailureAction is the action taken by the destination node
+// when recording a session of an SSH rule with enforceRecorder fails.
+func SSHRecordingFailureAction() *tailcfg.SSHRecorderFailureAction {
+	return &tailcfg.SSHRecorderFailureAction{
+		RejectSessionWithMessage:    "# Session recording is required, but the recorder is not available.\n",
+		TerminateSessionWithMessage: "# Session recording is required, but the recorder failed.\n",
+	}
+}
+
+// sshRecorders returns the addresses of the recorders of an SSH rule.
+// Only nodes which have a tag of the rule and a tag trusted by the
+// configuration are used.
+func (pol *ACLPolicy) sshRecorders(
+	ssh SSH,
+	nodes types.Nodes,
+	recording types.SSHRecordingConfig,
+) []netip.AddrPort {
+	var recorders []netip.AddrPort
+	for _, node := range nodes {
+		validTags, _ := pol.TagsOfNode(node)
+		tags := append(validTags, node.ForcedTags...)
+
+		trusted := slices.ContainsFunc(tags, func(tag string) bool {
+			return slices.Contains(ssh.Recorders, tag) &&
+				slices.Contains(recording.RecorderTags, tag)
+		})
+		if !trusted {
+			continue
+		}
+
+		if node.IPv4 != nil {
+			recorders = append(recorders, netip.AddrPortFrom(*node.IPv4, recording.RecorderPort))
+		} else if node.IPv6 != nil {
+			recorders = append(recorders, netip.AddrPortFrom(*node.IPv6, recording.RecorderPort))
+		}
+	}
+
+	return recorders
+}
+
+// withSSHRecorders adds the recorders of an SSH rule to its action. A
+// check action is answered by headscale, the recorders are passed along
+// in the URL of the check so the final action has them.
+func withSSHRecorders(
+	action tailcfg.SSHAction,
+	ssh SSH,
+	recorders []netip.AddrPort,
+) tailcfg.SSHAction {
+	if action.Reject || len(ssh.Recorders) == 0 {
+		return action
+	}
+
+	if len(recorders) == 0 {
+		if !ssh.EnforceRecorder {
+			return action
+		}
+
+		return tailcfg.SSHAction{
+			Reject:  true,
+			Message: sshNoRecorderMessage,
+		}
+	}
+
+	if action.HoldAndDelegate != "" {
+		query := url.Values{}
+		for _, recorder := range recorders {
+			query.Add("recorder", recorder.String())
+		}
+		if ssh.EnforceRecorder {
+			query.Set("enforce_recorder", "true")
+		}
+		action.HoldAndDelegate += "&" + query.Encode()
+
+		return action
+	}
+
+	action.Recorders = recorders
+	if ssh.EnforceRecorder {
+		action.OnRecordingFailure = SSHRecordingFailureAction()
+	}
+
+	return action
+}
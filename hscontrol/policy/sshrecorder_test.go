@@ -0,0 +1,203 @@
+package policy
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"tailscale.com/tailcfg"
+)
+
+func TestValidateSSHRecorders(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		wantErr bool
+	}{
+		{
+			name: "tag-recorder",
+			policy: `{
+				"acls": [
+					{"action": "accept", "src": ["*"], "dst": ["*:*"]},
+				],
+				"ssh": [
+					{"action": "accept", "src": ["*"], "dst": ["*"], "users": ["root"], "recorder": ["tag:recorder"], "enforceRecorder": true},
+				],
+			}`,
+		},
+		{
+			name: "user-recorder",
+			policy: `{
+				"acls": [
+					{"action": "accept", "src": ["*"], "dst": ["*:*"]},
+				],
+				"ssh": [
+					{"action": "accept", "src": ["*"], "dst": ["*"], "users": ["root"], "recorder": ["user1"]},
+				],
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "enforce-without-recorder",
+			policy: `{
+				"acls": [
+					{"action": "accept", "src": ["*"], "dst": ["*:*"]},
+				],
+				"ssh": [
+					{"action": "accept", "src": ["*"], "dst": ["*"], "users": ["root"], "enforceRecorder": true},
+				],
+			}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadACLPolicyFromBytes([]byte(tt.policy), "hujson")
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidSSHRecorder) {
+					t.Errorf("expected ErrInvalidSSHRecorder, got %v", err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestSSHRecorders(t *testing.T) {
+	node := &types.Node{
+		ID:       1,
+		Hostname: "server",
+		IPv4:     iap("100.64.0.1"),
+		User:     types.User{Name: "user1"},
+		Hostinfo: &tailcfg.Hostinfo{},
+	}
+	peers := types.Nodes{
+		&types.Node{
+			ID:       2,
+			Hostname: "laptop",
+			IPv4:     iap("100.64.0.2"),
+			User:     types.User{Name: "user1"},
+			Hostinfo: &tailcfg.Hostinfo{},
+		},
+		&types.Node{
+			ID:         3,
+			Hostname:   "recorder",
+			IPv4:       iap("100.64.0.3"),
+			User:       types.User{Name: "admin"},
+			ForcedTags: types.StringList{"tag:recorder"},
+			Hostinfo:   &tailcfg.Hostinfo{},
+		},
+		&types.Node{
+			ID:         4,
+			Hostname:   "untrusted",
+			IPv4:       iap("100.64.0.4"),
+			User:       types.User{Name: "admin"},
+			ForcedTags: types.StringList{"tag:untrusted"},
+			Hostinfo:   &tailcfg.Hostinfo{},
+		},
+	}
+	recording := types.SSHRecordingConfig{
+		RecorderTags: []string{"tag:recorder"},
+		RecorderPort: 80,
+	}
+
+	tests := []struct {
+		name string
+		ssh  SSH
+		want tailcfg.SSHAction
+	}{
+		{
+			name: "accept",
+			ssh: SSH{
+				Action:    "accept",
+				Recorders: []string{"tag:recorder"},
+			},
+			want: tailcfg.SSHAction{
+				Accept:                   true,
+				AllowLocalPortForwarding: true,
+				Recorders:                []netip.AddrPort{netip.MustParseAddrPort("100.64.0.3:80")},
+			},
+		},
+		{
+			name: "accept-enforced",
+			ssh: SSH{
+				Action:          "accept",
+				Recorders:       []string{"tag:recorder"},
+				EnforceRecorder: true,
+			},
+			want: tailcfg.SSHAction{
+				Accept:                   true,
+				AllowLocalPortForwarding: true,
+				Recorders:                []netip.AddrPort{netip.MustParseAddrPort("100.64.0.3:80")},
+				OnRecordingFailure:       SSHRecordingFailureAction(),
+			},
+		},
+		{
+			name: "untrusted-recorder-not-enforced",
+			ssh: SSH{
+				Action:    "accept",
+				Recorders: []string{"tag:untrusted"},
+			},
+			want: tailcfg.SSHAction{
+				Accept:                   true,
+				AllowLocalPortForwarding: true,
+			},
+		},
+		{
+			name: "untrusted-recorder-enforced",
+			ssh: SSH{
+				Action:          "accept",
+				Recorders:       []string{"tag:untrusted"},
+				EnforceRecorder: true,
+			},
+			want: tailcfg.SSHAction{
+				Reject:  true,
+				Message: sshNoRecorderMessage,
+			},
+		},
+		{
+			name: "check",
+			ssh: SSH{
+				Action:          "check",
+				CheckPeriod:     "1h",
+				Recorders:       []string{"tag:recorder"},
+				EnforceRecorder: true,
+			},
+			want: tailcfg.SSHAction{
+				HoldAndDelegate:          "https://unused/machine/ssh/action/from/$SRC_NODE_ID/to/$DST_NODE_ID?ssh_user=$SSH_USER&local_user=$LOCAL_USER&check_period=1h0m0s&enforce_recorder=true&recorder=100.64.0.3%3A80",
+				AllowLocalPortForwarding: true,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.ssh.Sources = []string{"user1"}
+			tt.ssh.Destinations = []string{"100.64.0.1"}
+			tt.ssh.Users = []string{"root"}
+
+			pol := ACLPolicy{SSHs: []SSH{tt.ssh}}
+			got, err := pol.CompileSSHPolicy(node, peers, recording)
+			if err != nil {
+				t.Fatalf("compiling SSH policy: %s", err)
+			}
+
+			if len(got.Rules) != 1 {
+				t.Fatalf("expected one rule, got %d", len(got.Rules))
+			}
+
+			if diff := cmp.Diff(tt.want, *got.Rules[0].Action, util.Comparers...); diff != "" {
+				t.Errorf("CompileSSHPolicy() unexpected action (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package hscontrol
+
+import (
+	"errors"
+	"net/netip"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestSetPolicyVersions(c *check.C) {
+	createPollTestNodes(c)
+
+	// The policy can only be set in the database policy mode.
+	_, err := app.SetPolicy(`{"acls": [{"action": "accept", "src": ["*"], "dst": ["*:*"]}]}`)
+	c.Assert(errors.Is(err, ErrPolicyNotInDB), check.Equals, true)
+
+	app.cfg.ACL.Mode = types.PolicyModeDB
+
+	first, err := app.SetPolicy(`{"acls": [{"action": "accept", "src": ["*"], "dst": ["*:*"]}]}`)
+	c.Assert(err, check.IsNil)
+	c.Assert(first.ID, check.Equals, uint64(1))
+
+	second, err := app.SetPolicy(`{
+		// Only SSH between the nodes.
+		"acls": [{"action": "accept", "src": ["test"], "dst": ["test:22"]}],
+	}`)
+	c.Assert(err, check.IsNil)
+	c.Assert(second.ID, check.Equals, uint64(2))
+	c.Assert(app.ACLPolicy.ACLs[0].Destinations, check.DeepEquals, []string{"test:22"})
+
+	// An invalid policy, or a policy failing its tests, is not stored
+	// and the current policy is kept.
+	_, err = app.SetPolicy(`{"acls": [{"action": "deny", "src": ["*"], "dst": ["*:*"]}]}`)
+	c.Assert(errors.Is(err, ErrPolicyInvalid), check.Equals, true)
+
+	_, err = app.SetPolicy(`{
+		"acls": [{"action": "accept", "src": ["test"], "dst": ["test:22"]}],
+		"tests": [{"src": "test", "accept": ["test:443"]}],
+	}`)
+	c.Assert(errors.Is(err, ErrPolicyInvalid), check.Equals, true)
+	c.Assert(app.ACLPolicy.ACLs[0].Destinations, check.DeepEquals, []string{"test:22"})
+
+	// Rolling back stores the previous version as a new version.
+	rolledBack, err := app.RollbackPolicy(first.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(rolledBack.ID, check.Equals, uint64(3))
+	c.Assert(rolledBack.Data, check.Equals, first.Data)
+	c.Assert(app.ACLPolicy.ACLs[0].Destinations, check.DeepEquals, []string{"*:*"})
+
+	_, err = app.RollbackPolicy(42)
+	c.Assert(errors.Is(err, ErrPolicyVersionNotFound), check.Equals, true)
+
+	versions, err := app.db.ListPolicyVersions()
+	c.Assert(err, check.IsNil)
+	c.Assert(versions, check.HasLen, 3)
+	c.Assert(versions[0].ID, check.Equals, uint64(3))
+
+	// The latest version is loaded on start.
+	app.ACLPolicy = nil
+	c.Assert(app.LoadACLPolicy(), check.IsNil)
+	c.Assert(app.ACLPolicy.ACLs[0].Destinations, check.DeepEquals, []string{"*:*"})
+}
+
+func (s *Suite) TestDiffPolicy(c *check.C) {
+	node1, node2 := createPollTestNodes(c)
+
+	app.cfg.ACL.Mode = types.PolicyModeDB
+	_, err := app.SetPolicy(`{"acls": [{"action": "accept", "src": ["test"], "dst": ["test:*"]}]}`)
+	c.Assert(err, check.IsNil)
+
+	// The same policy changes nothing.
+	diffs, err := app.DiffPolicy(`{"acls": [{"action": "accept", "src": ["test"], "dst": ["test:*"]}]}`)
+	c.Assert(err, check.IsNil)
+	c.Assert(diffs, check.HasLen, 0)
+
+	// Only node2 receives traffic, and SSH, with the candidate policy.
+	diffs, err = app.DiffPolicy(`{
+		"acls": [{"action": "accept", "src": ["test"], "dst": ["100.64.0.2:22"]}],
+		"ssh": [{"action": "accept", "src": ["test"], "dst": ["test"], "users": ["root"]}],
+	}`)
+	c.Assert(err, check.IsNil)
+	c.Assert(diffs, check.HasLen, 2)
+
+	c.Assert(diffs[0].Node.ID, check.Equals, node1.ID)
+	c.Assert(diffs[0].AddedRules, check.HasLen, 0)
+	c.Assert(diffs[0].RemovedRules, check.HasLen, 1)
+	c.Assert(diffs[0].AddedSSHRules, check.HasLen, 1)
+
+	c.Assert(diffs[1].Node.ID, check.Equals, node2.ID)
+	c.Assert(diffs[1].AddedRules, check.HasLen, 1)
+	c.Assert(diffs[1].RemovedRules, check.HasLen, 1)
+	c.Assert(diffs[1].AddedSSHRules, check.HasLen, 1)
+
+	// Nothing is applied.
+	c.Assert(app.ACLPolicy.ACLs[0].Destinations, check.DeepEquals, []string{"test:*"})
+
+	_, err = app.DiffPolicy(`{"acls": [{"action": "deny", "src": ["*"], "dst": ["*:*"]}]}`)
+	c.Assert(errors.Is(err, ErrPolicyInvalid), check.Equals, true)
+}
+
+func (s *Suite) TestSetPolicyAutoApprovesRoutes(c *check.C) {
+	node, _ := createPollTestNodes(c)
+
+	route := types.Route{
+		NodeID:     node.ID.Uint64(),
+		Prefix:     types.IPPrefix(netip.MustParsePrefix("10.0.0.0/24")),
+		Advertised: true,
+	}
+	c.Assert(app.db.DB.Save(&route).Error, check.IsNil)
+
+	app.cfg.ACL.Mode = types.PolicyModeDB
+	_, err := app.SetPolicy(`{"acls": [{"action": "accept", "src": ["*"], "dst": ["*:*"]}]}`)
+	c.Assert(err, check.IsNil)
+
+	enabled, err := app.db.GetEnabledRoutes(node)
+	c.Assert(err, check.IsNil)
+	c.Assert(enabled, check.HasLen, 0)
+
+	// The route is approved when an approver is added, without being
+	// advertised again.
+	_, err = app.SetPolicy(`{
+		"acls": [{"action": "accept", "src": ["*"], "dst": ["*:*"]}],
+		"autoApprovers": {"routes": {"10.0.0.0/8": ["autogroup:member"]}},
+	}`)
+	c.Assert(err, check.IsNil)
+
+	enabled, err = app.db.GetEnabledRoutes(node)
+	c.Assert(err, check.IsNil)
+	c.Assert(enabled, check.HasLen, 1)
+}
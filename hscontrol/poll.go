@@ -7,24 +7,24 @@ import (
 	"math/rand/v2"
 	"net/http"
 	"net/netip"
+	"slices"
 	"sort"
-	"strings"
 	"time"
 
 	"github.com/juanfont/headscale/hscontrol/db"
 	"github.com/juanfont/headscale/hscontrol/mapper"
 	"github.com/juanfont/headscale/hscontrol/types"
-	"github.com/rs/zerolog/log"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/juanfont/headscale/hscontrol/webhook"
 	"github.com/sasha-s/go-deadlock"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	xslices "golang.org/x/exp/slices"
 	"gorm.io/gorm"
 	"tailscale.com/tailcfg"
 )
 
-const (
-	keepAliveInterval = 50 * time.Second
-)
-
 type contextKey string
 
 const nodeNameContextKey = contextKey("nodeName")
@@ -36,6 +36,10 @@ type mapSession struct {
 	capVer tailcfg.CapabilityVersion
 	mapper *mapper.Mapper
 
+	// state is what the node has last received on the stream, used
+	// to only send what has changed since.
+	state *mapper.MapState
+
 	cancelChMu deadlock.Mutex
 
 	ch           chan types.StateUpdate
@@ -73,7 +77,7 @@ func (h *Headscale) newMapSession(
 		}
 	}
 
-	ka := keepAliveInterval + (time.Duration(rand.IntN(9000)) * time.Millisecond)
+	ka := h.cfg.Tuning.KeepAliveInterval + (time.Duration(rand.IntN(9000)) * time.Millisecond)
 
 	return &mapSession{
 		h:      h,
@@ -83,6 +87,7 @@ func (h *Headscale) newMapSession(
 		node:   node,
 		capVer: req.Version,
 		mapper: h.mapper,
+		state:  mapper.NewMapState(),
 
 		ch:           updateChan,
 		cancelCh:     make(chan struct{}),
@@ -113,7 +118,7 @@ func (m *mapSession) close() {
 	case m.cancelCh <- struct{}{}:
 		mapResponseClosed.WithLabelValues("sent").Inc()
 		m.tracef("mapSession (%p) sent message on cancel chan", m)
-	case <-time.After(30 * time.Second):
+	case <-time.After(m.h.cfg.Tuning.MapSessionCloseTimeout):
 		mapResponseClosed.WithLabelValues("timeout").Inc()
 		m.tracef("mapSession (%p) timed out sending close message", m)
 	}
@@ -131,6 +136,10 @@ func (m *mapSession) isReadOnlyUpdate() bool {
 	return !m.req.Stream && m.req.OmitPeers && m.req.ReadOnly
 }
 
+func (m *mapSession) isOneShotRequest() bool {
+	return !m.req.Stream && !m.req.OmitPeers
+}
+
 func (m *mapSession) resetKeepAlive() {
 	m.keepAliveTicker.Reset(m.keepAlive)
 }
@@ -173,6 +182,14 @@ func (m *mapSession) serve() {
 		return
 	}
 
+	// A non-streaming request with peers is a one-shot request for the
+	// complete state, the same as the first response of a stream. It is
+	// used by some automation and older clients.
+	if m.isOneShotRequest() {
+		m.handleOneShotRequest()
+
+		return
+	}
 }
 
 // serveLongPoll ensures the node gets the appropriate updates from either
@@ -192,9 +209,14 @@ func (m *mapSession) serveLongPoll() {
 		// reconnects, the channel might be of another connection.
 		// In that case, it is not closed and the node is still online.
 		if m.h.nodeNotifier.RemoveNode(m.node.ID, m.ch) {
-			// Failover the node's routes if any.
 			m.h.updateNodeOnlineStatus(false, m.node)
-			m.pollFailoverRoutes("node closing connection", m.node)
+			m.h.routeManager.NodeWentOffline(m.node)
+
+			// Ephemeral nodes are deleted if they do not come back
+			// within the inactivity timeout.
+			if m.node.IsEphemeral() {
+				m.h.ephemeralGC.Schedule(m.node.ID, m.h.cfg.EphemeralNodeInactivityTimeout)
+			}
 		}
 
 		m.infof("node has disconnected, mapSession: %p, chan: %p", m, m.ch)
@@ -219,8 +241,6 @@ func (m *mapSession) serveLongPoll() {
 	m.h.pollNetMapStreamWG.Add(1)
 	defer m.h.pollNetMapStreamWG.Done()
 
-	m.pollFailoverRoutes("node connected", m.node)
-
 	// Upgrade the writer to a ResponseController
 	rc := http.NewResponseController(m.w)
 
@@ -234,6 +254,8 @@ func (m *mapSession) serveLongPoll() {
 	m.keepAliveTicker = time.NewTicker(m.keepAlive)
 
 	m.h.nodeNotifier.AddNode(m.node.ID, m.ch)
+	m.h.ephemeralGC.Cancel(m.node.ID)
+	m.h.routeManager.NodeCameOnline(m.node)
 	go m.h.updateNodeOnlineStatus(true, m.node)
 
 	m.infof("node has connected, mapSession: %p, chan: %p", m, m.ch)
@@ -260,96 +282,21 @@ func (m *mapSession) serveLongPoll() {
 				return
 			}
 
-			m.tracef("received stream update: %s %s", update.Type.String(), update.Message)
-			mapResponseUpdateReceived.WithLabelValues(update.Type.String()).Inc()
-
-			var data []byte
-			var err error
-			var lastMessage string
-
-			// Ensure the node object is updated, for example, there
-			// might have been a hostinfo update in a sidechannel
-			// which contains data needed to generate a map response.
-			m.node, err = m.h.db.GetNodeByID(m.node.ID)
-			if err != nil {
-				m.errf(err, "Could not get machine from db")
-
-				return
-			}
-
-			updateType := "full"
-			switch update.Type {
-			case types.StateFullUpdate:
-				m.tracef("Sending Full MapResponse")
-				data, err = m.mapper.FullMapResponse(m.req, m.node, m.h.ACLPolicy, fmt.Sprintf("from mapSession: %p, stream: %t", m, m.isStreaming()))
-			case types.StatePeerChanged:
-				changed := make(map[types.NodeID]bool, len(update.ChangeNodes))
-
-				for _, nodeID := range update.ChangeNodes {
-					changed[nodeID] = true
-				}
-
-				lastMessage = update.Message
-				m.tracef(fmt.Sprintf("Sending Changed MapResponse: %v", lastMessage))
-				data, err = m.mapper.PeerChangedResponse(m.req, m.node, changed, update.ChangePatches, m.h.ACLPolicy, lastMessage)
-				updateType = "change"
-
-			case types.StatePeerChangedPatch:
-				m.tracef(fmt.Sprintf("Sending Changed Patch MapResponse: %v", lastMessage))
-				data, err = m.mapper.PeerChangedPatchResponse(m.req, m.node, update.ChangePatches, m.h.ACLPolicy)
-				updateType = "patch"
-			case types.StatePeerRemoved:
-				changed := make(map[types.NodeID]bool, len(update.Removed))
-
-				for _, nodeID := range update.Removed {
-					changed[nodeID] = false
+			// The changes already queued for the node are merged, so a
+			// burst of changes is sent in as few map responses as possible.
+			updates := []types.StateUpdate{update}
+			for queued := len(m.ch); queued > 0; queued-- {
+				update, ok := <-m.ch
+				if !ok {
+					break
 				}
-				m.tracef(fmt.Sprintf("Sending Changed MapResponse: %v", lastMessage))
-				data, err = m.mapper.PeerChangedResponse(m.req, m.node, changed, update.ChangePatches, m.h.ACLPolicy, lastMessage)
-				updateType = "remove"
-			case types.StateSelfUpdate:
-				lastMessage = update.Message
-				m.tracef(fmt.Sprintf("Sending Changed MapResponse: %v", lastMessage))
-				// create the map so an empty (self) update is sent
-				data, err = m.mapper.PeerChangedResponse(m.req, m.node, make(map[types.NodeID]bool), update.ChangePatches, m.h.ACLPolicy, lastMessage)
-				updateType = "remove"
-			case types.StateDERPUpdated:
-				m.tracef("Sending DERPUpdate MapResponse")
-				data, err = m.mapper.DERPMapResponse(m.req, m.node, m.h.DERPMap)
-				updateType = "derp"
-			}
-
-			if err != nil {
-				m.errf(err, "Could not get the create map update")
-
-				return
+				updates = append(updates, update)
 			}
 
-			// Only send update if there is change
-			if data != nil {
-				startWrite := time.Now()
-				_, err = m.w.Write(data)
-				if err != nil {
-					mapResponseSent.WithLabelValues("error", updateType).Inc()
-					m.errf(err, "could not write the map response(%s), for mapSession: %p", update.Type.String(), m)
-					return
-				}
-
-				err = rc.Flush()
-				if err != nil {
-					mapResponseSent.WithLabelValues("error", updateType).Inc()
-					m.errf(err, "flushing the map response to client, for mapSession: %p", m)
+			for _, update := range mergeUpdates(updates) {
+				if !m.handleUpdate(ctx, rc, update) {
 					return
 				}
-
-				log.Trace().Str("node", m.node.Hostname).TimeDiff("timeSpent", time.Now(), startWrite).Str("mkey", m.node.MachineKey.String()).Msg("finished writing mapresp to node")
-
-				if debugHighCardinalityMetrics {
-					mapResponseLastSentSeconds.WithLabelValues(updateType, m.node.ID.String()).Set(float64(time.Now().Unix()))
-				}
-				mapResponseSent.WithLabelValues("ok", updateType).Inc()
-				m.tracef("update sent")
-				m.resetKeepAlive()
 			}
 
 		case <-m.keepAliveTicker.C:
@@ -380,20 +327,190 @@ func (m *mapSession) serveLongPoll() {
 	}
 }
 
-func (m *mapSession) pollFailoverRoutes(where string, node *types.Node) {
-	update, err := db.Write(m.h.db.DB, func(tx *gorm.DB) (*types.StateUpdate, error) {
-		return db.FailoverNodeRoutesIfNeccessary(tx, m.h.nodeNotifier.LikelyConnectedMap(), node)
-	})
+// mergeUpdates merges the consecutive peer changes, and the consecutive
+// patches, of the updates. The other updates are kept as they are, in
+// order.
+func mergeUpdates(updates []types.StateUpdate) []types.StateUpdate {
+	var merged []types.StateUpdate
+	for _, update := range updates {
+		if len(merged) == 0 {
+			merged = append(merged, update)
+
+			continue
+		}
+
+		last := &merged[len(merged)-1]
+		if last.Type != update.Type ||
+			(update.Type != types.StatePeerChanged && update.Type != types.StatePeerChangedPatch) {
+			merged = append(merged, update)
+
+			continue
+		}
+
+		// The slices of an update are shared by the sessions of all
+		// the nodes, they are copied rather than appended to.
+		last.ChangeNodes = slices.Clone(last.ChangeNodes)
+		for _, nodeID := range update.ChangeNodes {
+			if !slices.Contains(last.ChangeNodes, nodeID) {
+				last.ChangeNodes = append(last.ChangeNodes, nodeID)
+			}
+		}
+		last.ChangePatches = slices.Concat(last.ChangePatches, update.ChangePatches)
+		last.Interactive = last.Interactive || update.Interactive
+		if update.Message != "" && update.Message != last.Message {
+			if last.Message != "" {
+				last.Message += ", "
+			}
+			last.Message += update.Message
+		}
+	}
+
+	return merged
+}
+
+// notifyParent is the parent context of the updates sent for the map
+// request, they are part of its trace but not cancelled with it.
+func (m *mapSession) notifyParent() context.Context {
+	return trace.ContextWithSpanContext(
+		context.Background(),
+		trace.SpanContextFromContext(m.ctx),
+	)
+}
+
+// handleUpdate writes the map response of the update to the node, in a
+// span of the trace of the update. It reports if the stream goes on.
+func (m *mapSession) handleUpdate(
+	ctx context.Context,
+	rc *http.ResponseController,
+	update types.StateUpdate,
+) bool {
+	ctx, span := tracer.Start(
+		trace.ContextWithSpanContext(ctx, update.SpanContext),
+		"mapsession.update",
+		trace.WithAttributes(
+			attribute.Int64("node.id", int64(m.node.ID)),
+			attribute.String("update.type", update.Type.String()),
+		),
+	)
+	defer span.End()
+
+	m.tracef("received stream update: %s %s", update.Type.String(), update.Message)
+	mapResponseUpdateReceived.WithLabelValues(update.Type.String()).Inc()
+
+	var data []byte
+	var err error
+	var lastMessage string
+
+	// Ensure the node object is updated, for example, there
+	// might have been a hostinfo update in a sidechannel
+	// which contains data needed to generate a map response.
+	m.node, err = m.h.db.GetNodeByID(m.node.ID)
 	if err != nil {
-		m.errf(err, fmt.Sprintf("failed to ensure failover routes, %s", where))
+		m.errf(err, "Could not get machine from db")
+		span.SetStatus(codes.Error, err.Error())
 
-		return
+		return false
 	}
 
-	if update != nil && !update.Empty() {
-		ctx := types.NotifyCtx(context.Background(), fmt.Sprintf("poll-%s-routes-ensurefailover", strings.ReplaceAll(where, " ", "-")), node.Hostname)
-		m.h.nodeNotifier.NotifyWithIgnore(ctx, *update, node.ID)
+	_, generateSpan := tracer.Start(ctx, "mapper.generate")
+
+	updateType := "full"
+	switch update.Type {
+	case types.StateFullUpdate:
+		m.tracef("Sending Full MapResponse")
+		data, err = m.mapper.FullMapResponse(m.req, m.node, m.state, m.h.policyOf(m.node), fmt.Sprintf("from mapSession: %p, stream: %t", m, m.isStreaming()))
+	case types.StatePeerChanged:
+		changed := make(map[types.NodeID]bool, len(update.ChangeNodes))
+
+		for _, nodeID := range update.ChangeNodes {
+			changed[nodeID] = true
+		}
+
+		lastMessage = update.Message
+		m.tracef(fmt.Sprintf("Sending Changed MapResponse: %v", lastMessage))
+		data, err = m.mapper.PeerChangedResponse(m.req, m.node, m.state, changed, update.ChangePatches, m.h.policyOf(m.node), lastMessage)
+		updateType = "change"
+
+	case types.StatePeerChangedPatch:
+		m.tracef(fmt.Sprintf("Sending Changed Patch MapResponse: %v", lastMessage))
+		data, err = m.mapper.PeerChangedPatchResponse(m.req, m.node, m.state, update.ChangePatches, m.h.policyOf(m.node))
+		updateType = "patch"
+	case types.StatePeerRemoved:
+		changed := make(map[types.NodeID]bool, len(update.Removed))
+
+		for _, nodeID := range update.Removed {
+			changed[nodeID] = false
+		}
+		m.tracef(fmt.Sprintf("Sending Changed MapResponse: %v", lastMessage))
+		data, err = m.mapper.PeerChangedResponse(m.req, m.node, m.state, changed, update.ChangePatches, m.h.policyOf(m.node), lastMessage)
+		updateType = "remove"
+	case types.StateSelfUpdate:
+		lastMessage = update.Message
+		m.tracef(fmt.Sprintf("Sending Changed MapResponse: %v", lastMessage))
+		// create the map so an empty (self) update is sent
+		data, err = m.mapper.PeerChangedResponse(m.req, m.node, m.state, make(map[types.NodeID]bool), update.ChangePatches, m.h.policyOf(m.node), lastMessage)
+		updateType = "remove"
+	case types.StateGoingAway:
+		generateSpan.End()
+		m.infof("headscale is shutting down, ending the stream so the node reconnects")
+		mapResponseEnded.WithLabelValues("going-away").Inc()
+
+		return false
+	case types.StateDERPUpdated:
+		m.tracef("Sending DERPUpdate MapResponse")
+		data, err = m.mapper.DERPMapResponse(m.req, m.node, m.h.DERPMap)
+		updateType = "derp"
+	case types.StatePingRequest:
+		m.tracef("Sending PingRequest MapResponse")
+		data, err = m.mapper.PingRequestResponse(m.req, m.node, update.PingRequest)
+		updateType = "ping"
+	}
+
+	generateSpan.SetAttributes(attribute.Int("bytes", len(data)))
+	generateSpan.End()
+
+	if err != nil {
+		m.errf(err, "Could not get the create map update")
+		span.SetStatus(codes.Error, err.Error())
+
+		return false
 	}
+
+	// Only send update if there is change
+	if data != nil {
+		_, writeSpan := tracer.Start(ctx, "mapsession.write")
+		defer writeSpan.End()
+
+		startWrite := time.Now()
+		_, err = m.w.Write(data)
+		if err != nil {
+			mapResponseSent.WithLabelValues("error", updateType).Inc()
+			m.errf(err, "could not write the map response(%s), for mapSession: %p", update.Type.String(), m)
+			writeSpan.SetStatus(codes.Error, err.Error())
+
+			return false
+		}
+
+		err = rc.Flush()
+		if err != nil {
+			mapResponseSent.WithLabelValues("error", updateType).Inc()
+			m.errf(err, "flushing the map response to client, for mapSession: %p", m)
+			writeSpan.SetStatus(codes.Error, err.Error())
+
+			return false
+		}
+
+		util.LogPoll.Trace().Str("node", m.node.Hostname).TimeDiff("timeSpent", time.Now(), startWrite).Str("mkey", m.node.MachineKey.String()).Msg("finished writing mapresp to node")
+
+		if debugHighCardinalityMetrics {
+			mapResponseLastSentSeconds.WithLabelValues(updateType, m.node.ID.String()).Set(float64(time.Now().Unix()))
+		}
+		mapResponseSent.WithLabelValues("ok", updateType).Inc()
+		m.tracef("update sent")
+		m.resetKeepAlive()
+	}
+
+	return true
 }
 
 // updateNodeOnlineStatus records the last seen status of a node and notifies peers
@@ -416,7 +533,7 @@ func (h *Headscale) updateNodeOnlineStatus(online bool, node *types.Node) {
 			return db.SetLastSeen(tx, node.ID, *node.LastSeen)
 		})
 		if err != nil {
-			log.Error().Err(err).Msg("Cannot update node LastSeen")
+			util.LogPoll.Error().Err(err).Msg("Cannot update node LastSeen")
 
 			return
 		}
@@ -429,6 +546,17 @@ func (h *Headscale) updateNodeOnlineStatus(online bool, node *types.Node) {
 			change,
 		},
 	}, node.ID)
+
+	// The nodes are not going offline when headscale shuts down.
+	if !h.nodeNotifier.IsDraining() {
+		eventType := webhook.EventNodeOffline
+		if online {
+			eventType = webhook.EventNodeOnline
+		}
+
+		node.IsOnline = &online
+		h.sendNodeEvent(eventType, node)
+	}
 }
 
 func (m *mapSession) handleEndpointUpdate() {
@@ -442,6 +570,7 @@ func (m *mapSession) handleEndpointUpdate() {
 	m.node.ApplyPeerChange(&change)
 
 	sendUpdate, routesChanged := hostInfoChanged(m.node.Hostinfo, m.req.Hostinfo)
+	oldTags := m.validTags()
 
 	// The node might not set NetInfo if it has not changed and if
 	// the full HostInfo object is overrwritten, the information is lost.
@@ -455,6 +584,11 @@ func (m *mapSession) handleEndpointUpdate() {
 	}
 	m.node.Hostinfo = m.req.Hostinfo
 
+	// The tags given by the autoTags of the policy, or requested by
+	// the node, can change with the Hostinfo.
+	tagsChanged := !xslices.Equal(oldTags, m.validTags())
+	sendUpdate = sendUpdate || tagsChanged
+
 	logTracePeerChange(m.node.Hostname, sendUpdate, &change)
 
 	// If there is no changes and nothing to save,
@@ -464,6 +598,36 @@ func (m *mapSession) handleEndpointUpdate() {
 		return
 	}
 
+	// The status of the node is written in batches, and the peers are
+	// told about it once written. Changes to the routes or the tags are
+	// written right away, as they change what the peers are sent.
+	if !routesChanged && !tagsChanged {
+		nodeID, hostname, parent := m.node.ID, m.node.Hostname, m.notifyParent()
+		err := m.h.nodeStatus.Queue(m.node, func() {
+			ctx := types.NotifyCtx(parent, "poll-nodeupdate-peers-patch", hostname)
+			m.h.nodeNotifier.NotifyWithIgnore(
+				ctx,
+				types.StateUpdate{
+					Type:        types.StatePeerChanged,
+					ChangeNodes: []types.NodeID{nodeID},
+					Message:     "called from handlePoll -> update",
+				},
+				nodeID)
+		})
+		if err != nil {
+			m.errf(err, "Failed to persist/update node in the database")
+			http.Error(m.w, "", http.StatusInternalServerError)
+			mapResponseEndpointUpdates.WithLabelValues("error").Inc()
+
+			return
+		}
+
+		m.w.WriteHeader(http.StatusOK)
+		mapResponseEndpointUpdates.WithLabelValues("ok").Inc()
+
+		return
+	}
+
 	// Check if the Hostinfo of the node has changed.
 	// If it has changed, check if there has been a change to
 	// the routable IPs of the host and update update them in
@@ -483,19 +647,21 @@ func (m *mapSession) handleEndpointUpdate() {
 			return
 		}
 
-		if m.h.ACLPolicy != nil {
+		if pol := m.h.policyOf(m.node); pol != nil {
 			// update routes with peer information
-			err := m.h.db.EnableAutoApprovedRoutes(m.h.ACLPolicy, m.node)
+			err := m.h.db.EnableAutoApprovedRoutes(pol, m.node)
 			if err != nil {
 				m.errf(err, "Error running auto approved routes")
 				mapResponseEndpointUpdates.WithLabelValues("error").Inc()
 			}
 		}
 
+		m.h.sendNodeEventsByID(webhook.EventRoutesChanged, m.node.ID)
+
 		// Send an update to the node itself with to ensure it
 		// has an updated packetfilter allowing the new route
 		// if it is defined in the ACL.
-		ctx := types.NotifyCtx(context.Background(), "poll-nodeupdate-self-hostinfochange", m.node.Hostname)
+		ctx := types.NotifyCtx(m.notifyParent(), "poll-nodeupdate-self-hostinfochange", m.node.Hostname)
 		m.h.nodeNotifier.NotifyByNodeID(
 			ctx,
 			types.StateUpdate{
@@ -505,6 +671,7 @@ func (m *mapSession) handleEndpointUpdate() {
 			m.node.ID)
 	}
 
+	m.h.nodeStatus.Discard(m.node.ID)
 	if err := m.h.db.DB.Save(m.node).Error; err != nil {
 		m.errf(err, "Failed to persist/update node in the database")
 		http.Error(m.w, "", http.StatusInternalServerError)
@@ -513,7 +680,20 @@ func (m *mapSession) handleEndpointUpdate() {
 		return
 	}
 
-	ctx := types.NotifyCtx(context.Background(), "poll-nodeupdate-peers-patch", m.node.Hostname)
+	// Send the node its new tags and the packet filter which
+	// follows from them, the peers get them with the update below.
+	if tagsChanged {
+		ctx := types.NotifyCtx(m.notifyParent(), "poll-nodeupdate-self-tagschange", m.node.Hostname)
+		m.h.nodeNotifier.NotifyByNodeID(
+			ctx,
+			types.StateUpdate{
+				Type:        types.StateSelfUpdate,
+				ChangeNodes: []types.NodeID{m.node.ID},
+			},
+			m.node.ID)
+	}
+
+	ctx := types.NotifyCtx(m.notifyParent(), "poll-nodeupdate-peers-patch", m.node.Hostname)
 	m.h.nodeNotifier.NotifyWithIgnore(
 		ctx,
 		types.StateUpdate{
@@ -546,7 +726,9 @@ func (m *mapSession) handleSaveNode() error {
 	m.node.ApplyPeerChange(&change)
 
 	sendUpdate, routesChanged := hostInfoChanged(m.node.Hostinfo, m.req.Hostinfo)
+	oldTags := m.validTags()
 	m.node.Hostinfo = m.req.Hostinfo
+	sendUpdate = sendUpdate || !xslices.Equal(oldTags, m.validTags())
 
 	// If there is no changes and nothing to save,
 	// return early.
@@ -569,20 +751,23 @@ func (m *mapSession) handleSaveNode() error {
 			return err
 		}
 
-		if m.h.ACLPolicy != nil {
+		if pol := m.h.policyOf(m.node); pol != nil {
 			// update routes with peer information
-			err := m.h.db.EnableAutoApprovedRoutes(m.h.ACLPolicy, m.node)
+			err := m.h.db.EnableAutoApprovedRoutes(pol, m.node)
 			if err != nil {
 				return err
 			}
 		}
+
+		m.h.sendNodeEventsByID(webhook.EventRoutesChanged, m.node.ID)
 	}
 
+	m.h.nodeStatus.Discard(m.node.ID)
 	if err := m.h.db.DB.Save(m.node).Error; err != nil {
 		return err
 	}
 
-	ctx := types.NotifyCtx(context.Background(), "pre-68-update-while-stream", m.node.Hostname)
+	ctx := types.NotifyCtx(m.notifyParent(), "pre-68-update-while-stream", m.node.Hostname)
 	m.h.nodeNotifier.NotifyWithIgnore(
 		ctx,
 		types.StateUpdate{
@@ -598,7 +783,7 @@ func (m *mapSession) handleSaveNode() error {
 func (m *mapSession) handleReadOnlyRequest() {
 	m.tracef("Client asked for a lite update, responding without peers")
 
-	mapResp, err := m.mapper.ReadOnlyMapResponse(m.req, m.node, m.h.ACLPolicy)
+	mapResp, err := m.mapper.ReadOnlyMapResponse(m.req, m.node, m.h.policyOf(m.node))
 	if err != nil {
 		m.errf(err, "Failed to create MapResponse")
 		http.Error(m.w, "", http.StatusInternalServerError)
@@ -621,8 +806,36 @@ func (m *mapSession) handleReadOnlyRequest() {
 	return
 }
 
+// handleOneShotRequest responds with a full MapResponse. The batched
+// changes are flushed first, so the streaming sessions are not behind
+// the state returned to the client.
+func (m *mapSession) handleOneShotRequest() {
+	m.tracef("Client asked for a one-shot update, responding with full map")
+
+	m.h.nodeNotifier.Flush()
+
+	mapResp, err := m.mapper.FullMapResponse(m.req, m.node, nil, m.h.policyOf(m.node))
+	if err != nil {
+		m.errf(err, "Failed to create MapResponse")
+		http.Error(m.w, "", http.StatusInternalServerError)
+		mapResponseOneShot.WithLabelValues("error").Inc()
+		return
+	}
+
+	m.w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	m.w.WriteHeader(http.StatusOK)
+	_, err = m.w.Write(mapResp)
+	if err != nil {
+		m.errf(err, "Failed to write response")
+		mapResponseOneShot.WithLabelValues("error").Inc()
+		return
+	}
+
+	mapResponseOneShot.WithLabelValues("ok").Inc()
+}
+
 func logTracePeerChange(hostname string, hostinfoChange bool, change *tailcfg.PeerChange) {
-	trace := log.Trace().Uint64("node.id", uint64(change.NodeID)).Str("hostname", hostname)
+	trace := util.LogPoll.Trace().Uint64("node.id", uint64(change.NodeID)).Str("hostname", hostname)
 
 	if change.Key != nil {
 		trace = trace.Str("node_key", change.Key.ShortString())
@@ -671,7 +884,7 @@ func logPollFunc(
 	node *types.Node,
 ) (func(string, ...any), func(string, ...any), func(string, ...any), func(error, string, ...any)) {
 	return func(msg string, a ...any) {
-			log.Warn().
+			util.LogPoll.Warn().
 				Caller().
 				Bool("readOnly", mapRequest.ReadOnly).
 				Bool("omitPeers", mapRequest.OmitPeers).
@@ -681,7 +894,7 @@ func logPollFunc(
 				Msgf(msg, a...)
 		},
 		func(msg string, a ...any) {
-			log.Info().
+			util.LogPoll.Info().
 				Caller().
 				Bool("readOnly", mapRequest.ReadOnly).
 				Bool("omitPeers", mapRequest.OmitPeers).
@@ -691,7 +904,7 @@ func logPollFunc(
 				Msgf(msg, a...)
 		},
 		func(msg string, a ...any) {
-			log.Trace().
+			util.LogPoll.Trace().
 				Caller().
 				Bool("readOnly", mapRequest.ReadOnly).
 				Bool("omitPeers", mapRequest.OmitPeers).
@@ -701,7 +914,7 @@ func logPollFunc(
 				Msgf(msg, a...)
 		},
 		func(err error, msg string, a ...any) {
-			log.Error().
+			util.LogPoll.Error().
 				Caller().
 				Bool("readOnly", mapRequest.ReadOnly).
 				Bool("omitPeers", mapRequest.OmitPeers).
@@ -718,6 +931,20 @@ func logPollFunc(
 // - second reports if there has been changes to routes
 // the caller can then use this info to save and update nodes
 // and routes as needed.
+// validTags returns the sorted tags of the node which are valid in the
+// policy, from its Hostinfo.
+func (m *mapSession) validTags() []string {
+	pol := m.h.policyOf(m.node)
+	if pol == nil {
+		return nil
+	}
+
+	tags, _ := pol.TagsOfNode(m.node)
+	xslices.Sort(tags)
+
+	return tags
+}
+
 func hostInfoChanged(old, new *tailcfg.Hostinfo) (bool, bool) {
 	if old.Equal(new) {
 		return false, false
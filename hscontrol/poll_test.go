@@ -0,0 +1,227 @@
+package hscontrol
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/mapper"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"gopkg.in/check.v1"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// createPollTestNodes creates a node and a peer it can see, and sets up
+// the mapper which is otherwise created when the server starts.
+func createPollTestNodes(c *check.C) (*types.Node, *types.Node) {
+	user, err := app.db.CreateUser("test")
+	c.Assert(err, check.IsNil)
+
+	var nodes []*types.Node
+	for index, ip := range []string{"100.64.0.1", "100.64.0.2"} {
+		ipv4 := netip.MustParseAddr(ip)
+		node := types.Node{
+			ID:             types.NodeID(index + 1),
+			MachineKey:     key.NewMachine().Public(),
+			NodeKey:        key.NewNode().Public(),
+			DiscoKey:       key.NewDisco().Public(),
+			Hostname:       "testnode" + ip,
+			GivenName:      "testnode" + ip,
+			UserID:         user.ID,
+			RegisterMethod: util.RegisterMethodAuthKey,
+			IPv4:           &ipv4,
+			Hostinfo:       &tailcfg.Hostinfo{},
+		}
+		c.Assert(app.db.DB.Save(&node).Error, check.IsNil)
+
+		nodes = append(nodes, &node)
+	}
+
+	app.mapper = mapper.NewMapper(app.db, app.cfg, &tailcfg.DERPMap{}, app.nodeNotifier)
+
+	return nodes[0], nodes[1]
+}
+
+func decodePollResponse(c *check.C, body []byte) tailcfg.MapResponse {
+	c.Assert(len(body) > 4, check.Equals, true)
+
+	size := binary.LittleEndian.Uint32(body[:4])
+	c.Assert(int(size), check.Equals, len(body)-4)
+
+	var resp tailcfg.MapResponse
+	c.Assert(json.Unmarshal(body[4:], &resp), check.IsNil)
+
+	return resp
+}
+
+func (s *Suite) TestServeOneShotRequest(c *check.C) {
+	node, peer := createPollTestNodes(c)
+
+	// A streaming session for the peer with a change pending in the
+	// batcher, which is flushed before the one-shot response.
+	ch := make(chan types.StateUpdate, 1)
+	app.nodeNotifier.AddNode(peer.ID, ch)
+	defer app.nodeNotifier.RemoveNode(peer.ID, ch)
+	app.nodeNotifier.NotifyAll(context.Background(), types.StateUpdate{
+		Type:        types.StatePeerChanged,
+		ChangeNodes: []types.NodeID{node.ID},
+	})
+	c.Assert(len(ch), check.Equals, 0)
+
+	rec := httptest.NewRecorder()
+	sess := app.newMapSession(context.Background(), tailcfg.MapRequest{
+		Version: tailcfg.CurrentCapabilityVersion,
+		NodeKey: node.NodeKey,
+	}, rec, node)
+	c.Assert(sess.isStreaming(), check.Equals, false)
+	sess.serve()
+
+	c.Assert(rec.Code, check.Equals, http.StatusOK)
+	c.Assert(len(ch), check.Equals, 1)
+
+	resp := decodePollResponse(c, rec.Body.Bytes())
+	c.Assert(resp.Node, check.NotNil)
+	c.Assert(resp.Node.ID, check.Equals, node.ID.NodeID())
+	c.Assert(resp.Peers, check.HasLen, 1)
+	c.Assert(resp.Peers[0].ID, check.Equals, peer.ID.NodeID())
+	c.Assert(resp.PacketFilter, check.NotNil)
+	c.Assert(resp.DERPMap, check.NotNil)
+}
+
+func (s *Suite) TestServeReadOnlyRequest(c *check.C) {
+	node, _ := createPollTestNodes(c)
+
+	rec := httptest.NewRecorder()
+	sess := app.newMapSession(context.Background(), tailcfg.MapRequest{
+		Version:   tailcfg.CurrentCapabilityVersion,
+		NodeKey:   node.NodeKey,
+		ReadOnly:  true,
+		OmitPeers: true,
+	}, rec, node)
+	sess.serve()
+
+	c.Assert(rec.Code, check.Equals, http.StatusOK)
+
+	resp := decodePollResponse(c, rec.Body.Bytes())
+	c.Assert(resp.Node, check.NotNil)
+	c.Assert(resp.Peers, check.HasLen, 0)
+}
+
+func (s *Suite) TestDeleteEphemeralNode(c *check.C) {
+	node, peer := createPollTestNodes(c)
+
+	pak, err := app.db.CreatePreAuthKey("test", false, true, nil, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(app.db.DB.Model(node).Update("auth_key_id", pak.ID).Error, check.IsNil)
+
+	ch := make(chan types.StateUpdate, 2)
+	app.nodeNotifier.AddNode(peer.ID, ch)
+	defer app.nodeNotifier.RemoveNode(peer.ID, ch)
+
+	// A node that has reconnected is not deleted.
+	nodeCh := make(chan types.StateUpdate, 2)
+	app.nodeNotifier.AddNode(node.ID, nodeCh)
+	app.deleteEphemeralNode(node.ID)
+	_, err = app.db.GetNodeByID(node.ID)
+	c.Assert(err, check.IsNil)
+	app.nodeNotifier.RemoveNode(node.ID, nodeCh)
+
+	app.deleteEphemeralNode(node.ID)
+	_, err = app.db.GetNodeByID(node.ID)
+	c.Assert(err, check.NotNil)
+
+	update := <-ch
+	c.Assert(update.Type, check.Equals, types.StatePeerRemoved)
+	c.Assert(update.Removed, check.DeepEquals, []types.NodeID{node.ID})
+
+	// Nodes that are not ephemeral are never deleted.
+	app.nodeNotifier.RemoveNode(peer.ID, ch)
+	app.deleteEphemeralNode(peer.ID)
+	_, err = app.db.GetNodeByID(peer.ID)
+	c.Assert(err, check.IsNil)
+}
+
+func TestMergeUpdates(t *testing.T) {
+	online := true
+
+	tests := []struct {
+		name    string
+		updates []types.StateUpdate
+		want    []types.StateUpdate
+	}{
+		{
+			name: "single",
+			updates: []types.StateUpdate{
+				{Type: types.StateFullUpdate},
+			},
+			want: []types.StateUpdate{
+				{Type: types.StateFullUpdate},
+			},
+		},
+		{
+			name: "peer-changes",
+			updates: []types.StateUpdate{
+				{Type: types.StatePeerChanged, ChangeNodes: []types.NodeID{1, 2}, Message: "a"},
+				{Type: types.StatePeerChanged, ChangeNodes: []types.NodeID{2, 3}, Message: "b"},
+				{Type: types.StatePeerChanged, ChangeNodes: []types.NodeID{4}, Interactive: true},
+			},
+			want: []types.StateUpdate{
+				{
+					Type:        types.StatePeerChanged,
+					ChangeNodes: []types.NodeID{1, 2, 3, 4},
+					Message:     "a, b",
+					Interactive: true,
+				},
+			},
+		},
+		{
+			name: "patches",
+			updates: []types.StateUpdate{
+				{Type: types.StatePeerChangedPatch, ChangePatches: []*tailcfg.PeerChange{{NodeID: 1, DERPRegion: 2}}},
+				{Type: types.StatePeerChangedPatch, ChangePatches: []*tailcfg.PeerChange{{NodeID: 1, Online: &online}}},
+			},
+			want: []types.StateUpdate{
+				{
+					Type: types.StatePeerChangedPatch,
+					ChangePatches: []*tailcfg.PeerChange{
+						{NodeID: 1, DERPRegion: 2},
+						{NodeID: 1, Online: &online},
+					},
+				},
+			},
+		},
+		{
+			name: "order-kept",
+			updates: []types.StateUpdate{
+				{Type: types.StatePeerChanged, ChangeNodes: []types.NodeID{1}},
+				{Type: types.StatePeerChangedPatch, ChangePatches: []*tailcfg.PeerChange{{NodeID: 1, DERPRegion: 2}}},
+				{Type: types.StatePeerChanged, ChangeNodes: []types.NodeID{2}},
+				{Type: types.StateDERPUpdated},
+				{Type: types.StateDERPUpdated},
+			},
+			want: []types.StateUpdate{
+				{Type: types.StatePeerChanged, ChangeNodes: []types.NodeID{1}},
+				{Type: types.StatePeerChangedPatch, ChangePatches: []*tailcfg.PeerChange{{NodeID: 1, DERPRegion: 2}}},
+				{Type: types.StatePeerChanged, ChangeNodes: []types.NodeID{2}},
+				{Type: types.StateDERPUpdated},
+				{Type: types.StateDERPUpdated},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeUpdates(tt.updates)
+			if diff := cmp.Diff(tt.want, got, util.Comparers...); diff != "" {
+				t.Errorf("mergeUpdates() unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package hscontrol
+
+import (
+	"context"
+	"reflect"
+	"slices"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// reloadConfig reloads the ACL policy and the settings of the
+// configuration which can change while running: the path of the policy,
+// the DNS settings, the DERP map sources, the log levels and sampling,
+// the OIDC client secret and the cluster keys. The nodes are sent what
+// changed. If the configuration is invalid, the current one is kept.
+func (h *Headscale) reloadConfig() {
+	h.reloadMu.Lock()
+	defer h.reloadMu.Unlock()
+
+	if viper.ConfigFileUsed() != "" {
+		if err := viper.ReadInConfig(); err != nil {
+			log.Error().Err(err).Msg("Failed to read the configuration, keeping the current one")
+
+			h.reloadPolicy(h.policyPath())
+
+			return
+		}
+	}
+
+	cfg, err := types.GetHeadscaleConfig()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to reload the configuration, keeping the current one")
+
+		h.reloadPolicy(h.policyPath())
+
+		return
+	}
+
+	current := h.mapper.Config()
+	reloaded := *current
+
+	addMagicDNSRoutes(cfg)
+	dnsChanged := !reflect.DeepEqual(cfg.DNSConfig, current.DNSConfig) ||
+		cfg.DNSUserNameInMagicDNS != current.DNSUserNameInMagicDNS ||
+		!reflect.DeepEqual(cfg.DNSScopedNameservers, current.DNSScopedNameservers)
+	if dnsChanged && cfg.BaseDomain != current.BaseDomain {
+		// The names of the nodes are in the base domain.
+		log.Warn().
+			Str("base_domain", current.BaseDomain).
+			Msg("Changing the base domain requires a restart, keeping the current DNS settings")
+
+		dnsChanged = false
+	}
+	if dnsChanged {
+		reloaded.DNSConfig = cfg.DNSConfig
+		reloaded.DNSUserNameInMagicDNS = cfg.DNSUserNameInMagicDNS
+		reloaded.DNSScopedNameservers = cfg.DNSScopedNameservers
+	}
+
+	derpChanged := !slices.Equal(cfg.DERP.Paths, current.DERP.Paths) ||
+		!slices.Equal(cfg.DERP.URLs, current.DERP.URLs)
+	reloaded.DERP.Paths = cfg.DERP.Paths
+	reloaded.DERP.URLs = cfg.DERP.URLs
+
+	// The format of the logs is kept, its output is already set.
+	reloaded.Log = cfg.Log
+	reloaded.Log.Format = current.Log.Format
+	util.SetLogLevels(
+		cfg.Log.Level,
+		cfg.Log.Subsystems,
+		cfg.Log.SamplingBurst,
+		cfg.Log.SamplingPeriod,
+	)
+
+	reloaded.OIDC.ClientSecret = cfg.OIDC.ClientSecret
+
+	h.mapper.SetConfig(&reloaded)
+
+	if oauth2Config := h.oauth2Config.Load(); oauth2Config != nil &&
+		oauth2Config.ClientSecret != cfg.OIDC.ClientSecret {
+		updated := *oauth2Config
+		updated.ClientSecret = cfg.OIDC.ClientSecret
+		h.oauth2Config.Store(&updated)
+
+		log.Info().Msg("OIDC client secret reloaded")
+	}
+
+	// The cluster keys are reloaded to rotate them, their path can
+	// change too.
+	if h.clusterKeys != nil {
+		if err := h.clusterKeys.Reload(cfg.HA.ClusterKeyPath); err != nil {
+			log.Error().Err(err).Msg("Failed to reload the cluster keys, keeping the current ones")
+		} else {
+			log.Info().Msg("Cluster keys reloaded")
+		}
+	}
+
+	if derpChanged {
+		log.Info().
+			Strs("paths", cfg.DERP.Paths).
+			Int("urls", len(cfg.DERP.URLs)).
+			Msg("DERP map sources changed, reloading the DERP map")
+
+		// The DERP manager sends the new map to the nodes.
+		h.updateDERPMap(reloaded.DERP)
+	}
+
+	// The scoped nameservers of the configuration are merged with the
+	// ones stored in the database, and a full update is sent with the
+	// new DNS settings to all the nodes.
+	if dnsChanged {
+		log.Info().Msg("DNS settings changed, notifying nodes of change")
+
+		if err := h.dnsConfigChanged(); err != nil {
+			log.Error().Err(err).Msg("Failed to send the new DNS settings")
+		}
+	}
+
+	h.reloadPolicy(cfg.ACL.PolicyPath)
+
+	log.Info().
+		Str("level", cfg.Log.Level.String()).
+		Msg("Configuration reloaded")
+}
+
+// reloadPolicy reloads the ACL policy in the file policy mode, from the
+// given path, with the policies of the tailnets, and sends the nodes
+// their new rules. The current policy and path are kept if the new
+// policy is invalid or its tests fail.
+func (h *Headscale) reloadPolicy(path string) {
+	if h.cfg.ACL.Mode != types.PolicyModeFile || (path == "" && len(h.cfg.Tailnets) == 0) {
+		return
+	}
+
+	h.policyMu.Lock()
+	previous := h.cfg.ACL.PolicyPath
+	h.cfg.ACL.PolicyPath = path
+	err := h.LoadACLPolicy()
+	if err != nil {
+		h.cfg.ACL.PolicyPath = previous
+	}
+	h.policyMu.Unlock()
+
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to reload ACL policy")
+
+		return
+	}
+
+	log.Info().
+		Str("path", path).
+		Msg("ACL policy successfully reloaded, notifying nodes of change")
+
+	ctx := types.NotifyCtx(context.Background(), "acl-sighup", "na")
+	h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+		Type: types.StateFullUpdate,
+	})
+}
+
+// policyPath returns the path of the ACL policy file, which can change
+// when the configuration is reloaded.
+func (h *Headscale) policyPath() string {
+	h.policyMu.Lock()
+	defer h.policyMu.Unlock()
+
+	return h.cfg.ACL.PolicyPath
+}
+
+// watchConfig reloads the configuration when its file changes. The
+// events of a single write are coalesced, a reload running when the
+// file changes again is followed by one more.
+func (h *Headscale) watchConfig(ctx context.Context) {
+	if viper.ConfigFileUsed() == "" {
+		log.Warn().Msg("watch_config is enabled but no configuration file is used")
+
+		return
+	}
+
+	changed := make(chan struct{}, 1)
+	viper.OnConfigChange(func(fsnotify.Event) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	viper.WatchConfig()
+
+	log.Info().
+		Str("path", viper.ConfigFileUsed()).
+		Msg("Watching the configuration for changes")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+			log.Info().Msg("Configuration changed, reloading")
+			h.reloadConfig()
+		}
+	}
+}
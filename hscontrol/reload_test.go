@@ -0,0 +1,57 @@
+package hscontrol
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juanfont/headscale/hscontrol/mapper"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/check.v1"
+	"tailscale.com/tailcfg"
+)
+
+func (s *Suite) TestReloadConfig(c *check.C) {
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+	defer func(logger zerolog.Logger) { log.Logger = logger }(log.Logger)
+
+	example, err := os.ReadFile("../config-example.yaml")
+	c.Assert(err, check.IsNil)
+
+	cfgFile := filepath.Join(tmpDir, "config.yaml")
+	c.Assert(os.WriteFile(cfgFile, example, 0o600), check.IsNil)
+	c.Assert(types.LoadConfig(cfgFile, true), check.IsNil)
+
+	cfg, err := types.GetHeadscaleConfig()
+	c.Assert(err, check.IsNil)
+	app.mapper = mapper.NewMapper(app.db, cfg, &tailcfg.DERPMap{}, app.nodeNotifier)
+	c.Assert(app.mapper.Config().DNSConfig.Resolvers[0].Addr, check.Equals, "1.1.1.1")
+
+	changed := strings.Replace(string(example), "    - 1.1.1.1\n", "    - 9.9.9.9\n", 1)
+	changed = strings.Replace(changed, "  level: info\n", "  level: debug\n", 1)
+	c.Assert(os.WriteFile(cfgFile, []byte(changed), 0o600), check.IsNil)
+
+	app.reloadConfig()
+
+	c.Assert(app.mapper.Config().DNSConfig.Resolvers[0].Addr, check.Equals, "9.9.9.9")
+	c.Assert(zerolog.GlobalLevel(), check.Equals, zerolog.DebugLevel)
+
+	// The settings requiring a restart are kept.
+	changed = strings.Replace(changed, "listen_addr: 127.0.0.1:8080", "listen_addr: 127.0.0.1:8081", 1)
+	changed = strings.Replace(changed, "    - 9.9.9.9\n", "    - 8.8.8.8\n", 1)
+	c.Assert(os.WriteFile(cfgFile, []byte(changed), 0o600), check.IsNil)
+
+	app.reloadConfig()
+
+	c.Assert(app.mapper.Config().Addr, check.Equals, "127.0.0.1:8080")
+	c.Assert(app.mapper.Config().DNSConfig.Resolvers[0].Addr, check.Equals, "8.8.8.8")
+
+	// An invalid configuration is not used.
+	c.Assert(os.WriteFile(cfgFile, []byte("server_url: [\n"), 0o600), check.IsNil)
+
+	app.reloadConfig()
+
+	c.Assert(app.mapper.Config().DNSConfig.Resolvers[0].Addr, check.Equals, "8.8.8.8")
+}
@@ -0,0 +1,217 @@
+package hscontrol
+
+import (
+	"context"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/webhook"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const routeManagerQueueSize = 1024
+
+// connectivityChange is a node connecting to or disconnecting from
+// headscale, or being isolated from the tailnet or released, which
+// takes it offline or back online for its routes.
+type connectivityChange struct {
+	node      *types.Node
+	online    bool
+	isolation bool
+}
+
+// routeManager fails over the primary routes of the nodes as they
+// connect and disconnect. The changes are handled one at a time in the
+// order they happened, so a node that quickly reconnects does not have
+// its routes failed over after it is back.
+type routeManager struct {
+	h *Headscale
+
+	changes chan connectivityChange
+	done    chan struct{}
+
+	dampener *routeDampener
+}
+
+func newRouteManager(h *Headscale) *routeManager {
+	return &routeManager{
+		h:        h,
+		changes:  make(chan connectivityChange, routeManagerQueueSize),
+		done:     make(chan struct{}),
+		dampener: newRouteDampener(h.cfg.RouteFailover, time.Now),
+	}
+}
+
+// NodeCameOnline queues a failover check for a node that connected, it
+// becomes the primary of the prefixes it shares with offline primaries.
+func (r *routeManager) NodeCameOnline(node *types.Node) {
+	r.enqueue(connectivityChange{node: node, online: true})
+}
+
+// NodeWentOffline queues the failover of the primary routes of a node
+// that disconnected.
+func (r *routeManager) NodeWentOffline(node *types.Node) {
+	r.enqueue(connectivityChange{node: node, online: false})
+}
+
+// NodeIsolationChanged queues a failover check for a node that was
+// quarantined, its primary routes are failed over as if it went offline,
+// or released, it takes over the prefixes without a primary as if it
+// came online.
+func (r *routeManager) NodeIsolationChanged(node *types.Node) {
+	r.enqueue(connectivityChange{node: node, online: !node.IsIsolated(), isolation: true})
+}
+
+func (r *routeManager) enqueue(change connectivityChange) {
+	select {
+	case r.changes <- change:
+	case <-r.done:
+	}
+}
+
+// Run handles the connectivity changes until the context is done.
+func (r *routeManager) Run(ctx context.Context) {
+	defer close(r.done)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case change := <-r.changes:
+			r.handle(change)
+		}
+	}
+}
+
+func (r *routeManager) handle(change connectivityChange) {
+	node := change.node
+
+	// The nodes are not going offline when headscale shuts down.
+	if !change.online && r.h.nodeNotifier.IsDraining() {
+		return
+	}
+
+	// Isolating a node is not a flap of its connection.
+	if !change.online && !change.isolation {
+		r.dampener.wentOffline(node.ID)
+	}
+
+	update, err := db.Write(r.h.db.DB, func(tx *gorm.DB) (*types.StateUpdate, error) {
+		return db.FailoverNodeRoutesIfNeccessary(
+			tx,
+			r.h.nodeNotifier.LikelyConnectedMap(),
+			node,
+			r.dampener.heldDown,
+		)
+	})
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("node", node.Hostname).
+			Bool("online", change.online).
+			Msg("failed to ensure failover routes")
+
+		return
+	}
+
+	if update == nil || update.Empty() {
+		return
+	}
+
+	log.Info().
+		Str("node", node.Hostname).
+		Bool("online", change.online).
+		Msgf("failed over primary routes, nodes changed: %v", update.ChangeNodes)
+
+	ctx := types.NotifyCtx(context.Background(), "routes-failover", node.Hostname)
+	r.h.nodeNotifier.NotifyWithIgnore(ctx, *update, node.ID)
+
+	// A node that came online might have become the primary of some
+	// routes, which are part of its own map.
+	if change.online {
+		r.h.nodeNotifier.NotifyByNodeID(ctx, types.StateUpdate{
+			Type:        types.StateSelfUpdate,
+			ChangeNodes: []types.NodeID{node.ID},
+		}, node.ID)
+	}
+
+	r.h.sendNodeEventsByID(webhook.EventRoutesChanged, update.ChangeNodes...)
+}
+
+// routeDampener holds down the routes of the nodes which went offline,
+// so a flapping router does not take the primary routes back and forth.
+// A node is held down for route_failover.hold_down after it went
+// offline, doubled for every time it went offline again before it was
+// stable for route_failover.max_hold_down, up to max_hold_down. Held
+// down routes only become primary if no other route is available.
+//
+// It is only used by the route manager goroutine.
+type routeDampener struct {
+	cfg types.RouteFailoverConfig
+	now func() time.Time
+
+	flaps map[types.NodeID]routeFlaps
+}
+
+// routeFlaps are the times a node went offline in a row, each less than
+// max_hold_down after the previous one.
+type routeFlaps struct {
+	count       int
+	lastOffline time.Time
+}
+
+func newRouteDampener(cfg types.RouteFailoverConfig, now func() time.Time) *routeDampener {
+	return &routeDampener{
+		cfg:   cfg,
+		now:   now,
+		flaps: make(map[types.NodeID]routeFlaps),
+	}
+}
+
+func (d *routeDampener) wentOffline(nodeID types.NodeID) {
+	if d.cfg.HoldDown <= 0 {
+		return
+	}
+
+	now := d.now()
+	for id, flaps := range d.flaps {
+		if now.Sub(flaps.lastOffline) >= d.cfg.MaxHoldDown {
+			delete(d.flaps, id)
+		}
+	}
+
+	flaps := d.flaps[nodeID]
+	flaps.count++
+	flaps.lastOffline = now
+	d.flaps[nodeID] = flaps
+
+	if flaps.count > 1 {
+		routeFlapsTotal.Inc()
+		log.Debug().
+			Uint64("node.id", nodeID.Uint64()).
+			Int("flaps", flaps.count).
+			Dur("hold_down", d.holdDown(flaps.count)).
+			Msg("node went offline again, holding down its routes")
+	}
+}
+
+// heldDown reports if the routes of the node are held down.
+func (d *routeDampener) heldDown(nodeID types.NodeID) bool {
+	flaps, ok := d.flaps[nodeID]
+	if !ok {
+		return false
+	}
+
+	return d.now().Sub(flaps.lastOffline) < d.holdDown(flaps.count)
+}
+
+func (d *routeDampener) holdDown(count int) time.Duration {
+	holdDown := d.cfg.HoldDown
+	for i := 1; i < count && holdDown < d.cfg.MaxHoldDown; i++ {
+		holdDown *= 2
+	}
+
+	return min(holdDown, d.cfg.MaxHoldDown)
+}
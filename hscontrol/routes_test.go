@@ -0,0 +1,181 @@
+package hscontrol
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestRouteManagerFailover(c *check.C) {
+	node, peer := createPollTestNodes(c)
+
+	prefix := types.IPPrefix(netip.MustParsePrefix("10.0.0.0/24"))
+	for _, r := range []types.Route{
+		{NodeID: node.ID.Uint64(), Prefix: prefix, Advertised: true, Enabled: true, IsPrimary: true},
+		{NodeID: peer.ID.Uint64(), Prefix: prefix, Advertised: true, Enabled: true},
+	} {
+		c.Assert(app.db.DB.Save(&r).Error, check.IsNil)
+	}
+
+	primaries := func(n *types.Node) int {
+		routes, err := app.db.GetNodePrimaryRoutes(n)
+		c.Assert(err, check.IsNil)
+
+		return len(routes)
+	}
+
+	manager := newRouteManager(app)
+
+	// The primary goes offline while the peer is connected, the peer
+	// takes over and is told about it.
+	peerCh := make(chan types.StateUpdate, 2)
+	app.nodeNotifier.AddNode(peer.ID, peerCh)
+	manager.handle(connectivityChange{node: node, online: false})
+
+	c.Assert(primaries(node), check.Equals, 0)
+	c.Assert(primaries(peer), check.Equals, 1)
+	update := <-peerCh
+	c.Assert(update.Type, check.Equals, types.StatePeerChanged)
+	c.Assert(update.ChangeNodes, check.DeepEquals, []types.NodeID{node.ID, peer.ID})
+
+	// The node coming back does not take over a connected primary.
+	nodeCh := make(chan types.StateUpdate, 2)
+	app.nodeNotifier.AddNode(node.ID, nodeCh)
+	manager.handle(connectivityChange{node: node, online: true})
+
+	c.Assert(primaries(peer), check.Equals, 1)
+	c.Assert(len(peerCh), check.Equals, 0)
+	c.Assert(len(nodeCh), check.Equals, 0)
+
+	// With the peer offline, the node takes over again.
+	app.nodeNotifier.RemoveNode(peer.ID, peerCh)
+	manager.handle(connectivityChange{node: peer, online: false})
+
+	c.Assert(primaries(node), check.Equals, 1)
+	c.Assert(primaries(peer), check.Equals, 0)
+	update = <-nodeCh
+	c.Assert(update.Type, check.Equals, types.StatePeerChanged)
+	app.nodeNotifier.RemoveNode(node.ID, nodeCh)
+
+	// A node coming online while the primary is offline takes over.
+	app.nodeNotifier.AddNode(peer.ID, peerCh)
+	manager.handle(connectivityChange{node: peer, online: true})
+
+	c.Assert(primaries(node), check.Equals, 0)
+	c.Assert(primaries(peer), check.Equals, 1)
+	update = <-peerCh
+	c.Assert(update.Type, check.Equals, types.StateSelfUpdate)
+	app.nodeNotifier.RemoveNode(peer.ID, peerCh)
+}
+
+func (s *Suite) TestRouteManagerIsolation(c *check.C) {
+	node, peer := createPollTestNodes(c)
+
+	prefix := types.IPPrefix(netip.MustParsePrefix("10.0.0.0/24"))
+	for _, r := range []types.Route{
+		{NodeID: node.ID.Uint64(), Prefix: prefix, Advertised: true, Enabled: true, IsPrimary: true},
+		{NodeID: peer.ID.Uint64(), Prefix: prefix, Advertised: true, Enabled: true},
+	} {
+		c.Assert(app.db.DB.Save(&r).Error, check.IsNil)
+	}
+
+	primaries := func(n *types.Node) int {
+		routes, err := app.db.GetNodePrimaryRoutes(n)
+		c.Assert(err, check.IsNil)
+
+		return len(routes)
+	}
+
+	setQuarantined := func(n *types.Node, quarantined bool) *types.Node {
+		c.Assert(app.db.NodeSetQuarantined(n.ID, quarantined), check.IsNil)
+		n, err := app.db.GetNodeByID(n.ID)
+		c.Assert(err, check.IsNil)
+
+		return n
+	}
+
+	manager := newRouteManager(app)
+
+	nodeCh := make(chan types.StateUpdate, 4)
+	app.nodeNotifier.AddNode(node.ID, nodeCh)
+	defer app.nodeNotifier.RemoveNode(node.ID, nodeCh)
+	peerCh := make(chan types.StateUpdate, 4)
+	app.nodeNotifier.AddNode(peer.ID, peerCh)
+
+	// The connected primary is quarantined, the peer takes over, and
+	// the node is not held down as if its connection flapped.
+	node = setQuarantined(node, true)
+	manager.handle(connectivityChange{node: node, online: !node.IsIsolated(), isolation: true})
+
+	c.Assert(primaries(node), check.Equals, 0)
+	c.Assert(primaries(peer), check.Equals, 1)
+	c.Assert(manager.dampener.heldDown(node.ID), check.Equals, false)
+
+	// With the peer offline, the quarantined node does not take over.
+	app.nodeNotifier.RemoveNode(peer.ID, peerCh)
+	manager.handle(connectivityChange{node: peer, online: false})
+
+	c.Assert(primaries(node), check.Equals, 0)
+	c.Assert(primaries(peer), check.Equals, 1)
+
+	// Once released, it takes over the routes of the offline peer.
+	node = setQuarantined(node, false)
+	manager.handle(connectivityChange{node: node, online: !node.IsIsolated(), isolation: true})
+
+	c.Assert(primaries(node), check.Equals, 1)
+	c.Assert(primaries(peer), check.Equals, 0)
+}
+
+func TestRouteDampener(t *testing.T) {
+	now := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	dampener := newRouteDampener(types.RouteFailoverConfig{
+		HoldDown:    time.Minute,
+		MaxHoldDown: 5 * time.Minute,
+	}, func() time.Time { return now })
+
+	wantHeldDown := func(want bool) {
+		t.Helper()
+		if got := dampener.heldDown(1); got != want {
+			t.Errorf("heldDown() at %s = %v, want %v", now, got, want)
+		}
+	}
+
+	wantHeldDown(false)
+
+	dampener.wentOffline(1)
+	wantHeldDown(true)
+	now = now.Add(time.Minute)
+	wantHeldDown(false)
+
+	// Going offline again doubles the hold down.
+	dampener.wentOffline(1)
+	now = now.Add(time.Minute)
+	wantHeldDown(true)
+	now = now.Add(time.Minute)
+	wantHeldDown(false)
+
+	// The hold down is capped at max_hold_down.
+	for range 4 {
+		dampener.wentOffline(1)
+	}
+	now = now.Add(5*time.Minute - time.Second)
+	wantHeldDown(true)
+	now = now.Add(time.Second)
+	wantHeldDown(false)
+
+	// Once stable for max_hold_down the flaps are forgotten.
+	now = now.Add(time.Minute)
+	dampener.wentOffline(1)
+	now = now.Add(time.Minute)
+	wantHeldDown(false)
+
+	// Dampening is disabled without a hold down.
+	disabled := newRouteDampener(types.RouteFailoverConfig{}, time.Now)
+	disabled.wentOffline(1)
+	if disabled.heldDown(1) {
+		t.Error("heldDown() = true with dampening disabled")
+	}
+}
@@ -0,0 +1,916 @@
+package hscontrol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/juanfont/headscale/hscontrol/webhook"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	scimPrefix = "/scim/v2"
+
+	scimSchemaUser      = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimSchemaGroup     = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimSchemaList      = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimSchemaPatchOp   = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimSchemaError     = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimSchemaSPConfig  = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimContentType     = "application/scim+json"
+	scimDefaultPageSize = 100
+)
+
+var (
+	errSCIMInvalidFilter = errors.New("unsupported filter")
+	errSCIMInvalidPatch  = errors.New("unsupported patch operation")
+	errSCIMMember        = errors.New("invalid group member")
+
+	// scimFilterRegex matches the only filters supported, an attribute
+	// equal to a value, which is what the identity providers use to find
+	// a resource before creating it.
+	scimFilterRegex = regexp.MustCompile(`(?i)^\s*(\w+)\s+eq\s+"((?:[^"\\]|\\.)*)"\s*$`)
+
+	// scimMemberPathRegex matches the path selecting a member of a group.
+	scimMemberPathRegex = regexp.MustCompile(`(?i)^members\[\s*value\s+eq\s+"([^"]*)"\s*\]$`)
+)
+
+type scimMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location"`
+}
+
+type scimUser struct {
+	Schemas  []string  `json:"schemas"`
+	ID       string    `json:"id,omitempty"`
+	UserName string    `json:"userName"`
+	Active   *bool     `json:"active,omitempty"`
+	Meta     *scimMeta `json:"meta,omitempty"`
+}
+
+type scimMember struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+}
+
+type scimGroup struct {
+	Schemas     []string     `json:"schemas"`
+	ID          string       `json:"id,omitempty"`
+	ExternalID  string       `json:"externalId,omitempty"`
+	DisplayName string       `json:"displayName"`
+	Members     []scimMember `json:"members"`
+	Meta        *scimMeta    `json:"meta,omitempty"`
+}
+
+type scimListResponse struct {
+	Schemas      []string    `json:"schemas"`
+	TotalResults int         `json:"totalResults"`
+	StartIndex   int         `json:"startIndex"`
+	ItemsPerPage int         `json:"itemsPerPage"`
+	Resources    interface{} `json:"Resources"`
+}
+
+type scimPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []scimPatchOperation `json:"Operations"`
+}
+
+type scimPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+type scimError struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail"`
+}
+
+// registerSCIMRoutes adds the SCIM server to the router, with its
+// authentication.
+func (h *Headscale) registerSCIMRoutes(router *mux.Router) {
+	scimRouter := router.PathPrefix(scimPrefix).Subrouter()
+	scimRouter.Use(h.scimAuthenticationMiddleware)
+
+	scimRouter.HandleFunc("/ServiceProviderConfig", h.scimServiceProviderConfig).Methods(http.MethodGet)
+
+	scimRouter.HandleFunc("/Users", h.scimListUsers).Methods(http.MethodGet)
+	scimRouter.HandleFunc("/Users", h.scimCreateUser).Methods(http.MethodPost)
+	scimRouter.HandleFunc("/Users/{id}", h.scimGetUser).Methods(http.MethodGet)
+	scimRouter.HandleFunc("/Users/{id}", h.scimReplaceUser).Methods(http.MethodPut)
+	scimRouter.HandleFunc("/Users/{id}", h.scimPatchUser).Methods(http.MethodPatch)
+	scimRouter.HandleFunc("/Users/{id}", h.scimDeleteUser).Methods(http.MethodDelete)
+
+	scimRouter.HandleFunc("/Groups", h.scimListGroups).Methods(http.MethodGet)
+	scimRouter.HandleFunc("/Groups", h.scimCreateGroup).Methods(http.MethodPost)
+	scimRouter.HandleFunc("/Groups/{id}", h.scimGetGroup).Methods(http.MethodGet)
+	scimRouter.HandleFunc("/Groups/{id}", h.scimReplaceGroup).Methods(http.MethodPut)
+	scimRouter.HandleFunc("/Groups/{id}", h.scimPatchGroup).Methods(http.MethodPatch)
+	scimRouter.HandleFunc("/Groups/{id}", h.scimDeleteGroup).Methods(http.MethodDelete)
+}
+
+// scimAuthenticationMiddleware checks the API key of the identity
+// provider, it must give write access to the users.
+func (h *Headscale) scimAuthenticationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		authHeader := req.Header.Get("authorization")
+		if !strings.HasPrefix(authHeader, AuthPrefix) {
+			scimErrorResponse(writer, http.StatusUnauthorized, "", "missing bearer token")
+
+			return
+		}
+
+		key, err := h.db.AuthenticateAPIKey(strings.TrimPrefix(authHeader, AuthPrefix))
+		if err != nil || key == nil {
+			log.Info().
+				Str("client_address", req.RemoteAddr).
+				Msg("invalid SCIM token")
+			scimErrorResponse(writer, http.StatusUnauthorized, "", "invalid token")
+
+			return
+		}
+
+		if !key.Allows(types.APIResourceUsers, true) {
+			scimErrorResponse(writer, http.StatusForbidden, "", "the API key does not allow writing users")
+
+			return
+		}
+
+		next.ServeHTTP(writer, req)
+	})
+}
+
+func scimResponse(writer http.ResponseWriter, status int, body interface{}) {
+	writer.Header().Set("Content-Type", scimContentType)
+	writer.WriteHeader(status)
+	if err := json.NewEncoder(writer).Encode(body); err != nil {
+		util.LogErr(err, "Failed to write response")
+	}
+}
+
+func scimErrorResponse(writer http.ResponseWriter, status int, scimType, detail string) {
+	scimResponse(writer, status, scimError{
+		Schemas:  []string{scimSchemaError},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	})
+}
+
+// scimDBErrorResponse answers with the SCIM error matching the error
+// returned by the database.
+func scimDBErrorResponse(writer http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, db.ErrUserNotFound) && errors.Is(err, errSCIMMember):
+		scimErrorResponse(writer, http.StatusBadRequest, "invalidValue", err.Error())
+	case errors.Is(err, db.ErrUserNotFound), errors.Is(err, db.ErrSCIMGroupNotFound):
+		scimErrorResponse(writer, http.StatusNotFound, "", err.Error())
+	case errors.Is(err, db.ErrUserExists), errors.Is(err, db.ErrSCIMGroupExists):
+		scimErrorResponse(writer, http.StatusConflict, "uniqueness", err.Error())
+	case errors.Is(err, errSCIMInvalidFilter):
+		scimErrorResponse(writer, http.StatusBadRequest, "invalidFilter", err.Error())
+	case errors.Is(err, errSCIMInvalidPatch):
+		scimErrorResponse(writer, http.StatusBadRequest, "invalidSyntax", err.Error())
+	case errors.Is(err, util.ErrInvalidUserName):
+		scimErrorResponse(writer, http.StatusBadRequest, "invalidValue", err.Error())
+	default:
+		log.Error().Err(err).Msg("SCIM request failed")
+		scimErrorResponse(writer, http.StatusInternalServerError, "", "internal error")
+	}
+}
+
+func decodeSCIMRequest(writer http.ResponseWriter, req *http.Request, body interface{}) bool {
+	if err := json.NewDecoder(req.Body).Decode(body); err != nil {
+		scimErrorResponse(writer, http.StatusBadRequest, "invalidSyntax", fmt.Sprintf("decoding request: %s", err))
+
+		return false
+	}
+
+	return true
+}
+
+// parseSCIMFilter returns the attribute and value of an "eq" filter,
+// empty if there is no filter.
+func parseSCIMFilter(filter string) (string, string, error) {
+	if filter == "" {
+		return "", "", nil
+	}
+
+	match := scimFilterRegex.FindStringSubmatch(filter)
+	if match == nil {
+		return "", "", fmt.Errorf("%w: %q", errSCIMInvalidFilter, filter)
+	}
+
+	value, err := strconv.Unquote(`"` + match[2] + `"`)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %q", errSCIMInvalidFilter, filter)
+	}
+
+	return strings.ToLower(match[1]), value, nil
+}
+
+// scimPage returns the page of the resources selected by the startIndex,
+// starting at 1, and count parameters.
+func scimPage[T any](req *http.Request, resources []T) scimListResponse {
+	start, err := strconv.Atoi(req.URL.Query().Get("startIndex"))
+	if err != nil || start < 1 {
+		start = 1
+	}
+
+	count, err := strconv.Atoi(req.URL.Query().Get("count"))
+	if err != nil || count < 0 {
+		count = scimDefaultPageSize
+	}
+
+	page := []T{}
+	if start <= len(resources) {
+		page = resources[start-1 : min(len(resources), start-1+count)]
+	}
+
+	return scimListResponse{
+		Schemas:      []string{scimSchemaList},
+		TotalResults: len(resources),
+		StartIndex:   start,
+		ItemsPerPage: len(page),
+		Resources:    page,
+	}
+}
+
+func (h *Headscale) scimServiceProviderConfig(writer http.ResponseWriter, req *http.Request) {
+	supported := func(ok bool) map[string]interface{} {
+		return map[string]interface{}{"supported": ok}
+	}
+
+	scimResponse(writer, http.StatusOK, map[string]interface{}{
+		"schemas":        []string{scimSchemaSPConfig},
+		"patch":          supported(true),
+		"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]interface{}{"supported": true, "maxResults": scimDefaultPageSize},
+		"changePassword": supported(false),
+		"sort":           supported(false),
+		"etag":           supported(false),
+		"authenticationSchemes": []map[string]interface{}{
+			{
+				"type":        "oauthbearertoken",
+				"name":        "API key",
+				"description": "A headscale API key, sent as a bearer token",
+			},
+		},
+	})
+}
+
+func scimUserID(user *types.User) string {
+	return strconv.FormatUint(uint64(user.ID), util.Base10)
+}
+
+func (h *Headscale) scimUser(user *types.User) scimUser {
+	active := !user.Deactivated
+	id := scimUserID(user)
+
+	return scimUser{
+		Schemas:  []string{scimSchemaUser},
+		ID:       id,
+		UserName: user.Name,
+		Active:   &active,
+		Meta: &scimMeta{
+			ResourceType: "User",
+			Created:      user.CreatedAt,
+			LastModified: user.UpdatedAt,
+			Location:     h.cfg.ServerURL + scimPrefix + "/Users/" + id,
+		},
+	}
+}
+
+func (h *Headscale) scimGroup(group *types.SCIMGroup) scimGroup {
+	id := strconv.FormatUint(group.ID, util.Base10)
+
+	members := make([]scimMember, 0, len(group.Members))
+	for _, member := range group.Members {
+		members = append(members, scimMember{
+			Value:   scimUserID(&member),
+			Display: member.Name,
+		})
+	}
+
+	return scimGroup{
+		Schemas:     []string{scimSchemaGroup},
+		ID:          id,
+		ExternalID:  group.ExternalID,
+		DisplayName: group.DisplayName,
+		Members:     members,
+		Meta: &scimMeta{
+			ResourceType: "Group",
+			Created:      group.CreatedAt,
+			LastModified: group.UpdatedAt,
+			Location:     h.cfg.ServerURL + scimPrefix + "/Groups/" + id,
+		},
+	}
+}
+
+// scimUserName returns the name of the headscale user for the SCIM user
+// name, normalised like the users logging in with OIDC.
+func (h *Headscale) scimUserName(userName string) (string, error) {
+	return util.NormalizeToFQDNRules(userName, h.cfg.OIDC.StripEmaildomain)
+}
+
+func (h *Headscale) scimUserByID(idStr string) (*types.User, error) {
+	id, err := strconv.ParseUint(idStr, util.Base10, 0)
+	if err != nil {
+		return nil, db.ErrUserNotFound
+	}
+
+	return h.db.GetUserByID(uint(id))
+}
+
+func (h *Headscale) scimListUsers(writer http.ResponseWriter, req *http.Request) {
+	attr, value, err := parseSCIMFilter(req.URL.Query().Get("filter"))
+	if err != nil {
+		scimDBErrorResponse(writer, err)
+
+		return
+	}
+	if attr != "" && attr != "username" {
+		scimDBErrorResponse(writer, fmt.Errorf("%w: only userName can be filtered", errSCIMInvalidFilter))
+
+		return
+	}
+
+	users, err := h.db.ListUsers()
+	if err != nil {
+		scimDBErrorResponse(writer, err)
+
+		return
+	}
+
+	var name string
+	if attr != "" {
+		name, err = h.scimUserName(value)
+		if err != nil {
+			// No user can have an invalid name.
+			name = ""
+		}
+	}
+
+	resources := []scimUser{}
+	for index := range users {
+		if attr != "" && users[index].Name != name {
+			continue
+		}
+		resources = append(resources, h.scimUser(&users[index]))
+	}
+
+	scimResponse(writer, http.StatusOK, scimPage(req, resources))
+}
+
+func (h *Headscale) scimGetUser(writer http.ResponseWriter, req *http.Request) {
+	user, err := h.scimUserByID(mux.Vars(req)["id"])
+	if err != nil {
+		scimDBErrorResponse(writer, err)
+
+		return
+	}
+
+	scimResponse(writer, http.StatusOK, h.scimUser(user))
+}
+
+func (h *Headscale) scimCreateUser(writer http.ResponseWriter, req *http.Request) {
+	var body scimUser
+	if !decodeSCIMRequest(writer, req, &body) {
+		return
+	}
+
+	name, err := h.scimUserName(body.UserName)
+	if err != nil {
+		scimDBErrorResponse(writer, err)
+
+		return
+	}
+
+	user, err := h.db.CreateUser(name)
+	if err != nil {
+		scimDBErrorResponse(writer, err)
+
+		return
+	}
+	h.sendUserEvent(webhook.EventUserCreated, user)
+
+	if body.Active != nil && !*body.Active {
+		user, err = h.scimSetUserActive(user, false)
+		if err != nil {
+			scimDBErrorResponse(writer, err)
+
+			return
+		}
+	}
+
+	scimResponse(writer, http.StatusCreated, h.scimUser(user))
+}
+
+func (h *Headscale) scimReplaceUser(writer http.ResponseWriter, req *http.Request) {
+	user, err := h.scimUserByID(mux.Vars(req)["id"])
+	if err != nil {
+		scimDBErrorResponse(writer, err)
+
+		return
+	}
+
+	var body scimUser
+	if !decodeSCIMRequest(writer, req, &body) {
+		return
+	}
+
+	active := true
+	if body.Active != nil {
+		active = *body.Active
+	}
+
+	user, err = h.scimUpdateUser(user, &body.UserName, &active)
+	if err != nil {
+		scimDBErrorResponse(writer, err)
+
+		return
+	}
+
+	scimResponse(writer, http.StatusOK, h.scimUser(user))
+}
+
+func (h *Headscale) scimPatchUser(writer http.ResponseWriter, req *http.Request) {
+	user, err := h.scimUserByID(mux.Vars(req)["id"])
+	if err != nil {
+		scimDBErrorResponse(writer, err)
+
+		return
+	}
+
+	var body scimPatchRequest
+	if !decodeSCIMRequest(writer, req, &body) {
+		return
+	}
+
+	var userName *string
+	var active *bool
+	for _, op := range body.Operations {
+		if err := scimPatchUserAttributes(op, &userName, &active); err != nil {
+			scimDBErrorResponse(writer, err)
+
+			return
+		}
+	}
+
+	user, err = h.scimUpdateUser(user, userName, active)
+	if err != nil {
+		scimDBErrorResponse(writer, err)
+
+		return
+	}
+
+	scimResponse(writer, http.StatusOK, h.scimUser(user))
+}
+
+// scimPatchUserAttributes reads the user name and the active status set
+// by a patch operation, the other attributes are ignored.
+func scimPatchUserAttributes(op scimPatchOperation, userName **string, active **bool) error {
+	switch strings.ToLower(op.Op) {
+	case "add", "replace":
+	default:
+		return fmt.Errorf("%w: %q on a user", errSCIMInvalidPatch, op.Op)
+	}
+
+	var values map[string]json.RawMessage
+	if op.Path == "" {
+		if err := json.Unmarshal(op.Value, &values); err != nil {
+			return fmt.Errorf("%w: %w", errSCIMInvalidPatch, err)
+		}
+	} else {
+		values = map[string]json.RawMessage{op.Path: op.Value}
+	}
+
+	for attr, value := range values {
+		switch strings.ToLower(attr) {
+		case "username":
+			var name string
+			if err := json.Unmarshal(value, &name); err != nil {
+				return fmt.Errorf("%w: userName: %w", errSCIMInvalidPatch, err)
+			}
+			*userName = &name
+
+		case "active":
+			// Some identity providers send the boolean as a string.
+			var state interface{}
+			if err := json.Unmarshal(value, &state); err != nil {
+				return fmt.Errorf("%w: active: %w", errSCIMInvalidPatch, err)
+			}
+
+			var isActive bool
+			switch state := state.(type) {
+			case bool:
+				isActive = state
+			case string:
+				parsed, err := strconv.ParseBool(state)
+				if err != nil {
+					return fmt.Errorf("%w: active: %w", errSCIMInvalidPatch, err)
+				}
+				isActive = parsed
+			default:
+				return fmt.Errorf("%w: active is not a boolean", errSCIMInvalidPatch)
+			}
+			*active = &isActive
+		}
+	}
+
+	return nil
+}
+
+// scimUpdateUser renames the user and changes its active status, when
+// they are set.
+func (h *Headscale) scimUpdateUser(user *types.User, userName *string, active *bool) (*types.User, error) {
+	if userName != nil {
+		name, err := h.scimUserName(*userName)
+		if err != nil {
+			return nil, err
+		}
+
+		if name != user.Name {
+			if err := h.db.RenameUser(user.Name, name); err != nil {
+				return nil, err
+			}
+
+			user, err = h.db.GetUser(name)
+			if err != nil {
+				return nil, err
+			}
+
+			h.sendUserEvent(webhook.EventUserRenamed, user)
+			h.refreshIdPGroups()
+		}
+	}
+
+	if active != nil && *active == user.Deactivated {
+		return h.scimSetUserActive(user, *active)
+	}
+
+	return user, nil
+}
+
+// scimSetUserActive reactivates or deactivates the user, deactivating
+// expires its nodes.
+func (h *Headscale) scimSetUserActive(user *types.User, active bool) (*types.User, error) {
+	expired, err := h.db.SetUserDeactivated(user.Name, !active)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().
+		Str("user", user.Name).
+		Bool("active", active).
+		Int("expired_nodes", len(expired)).
+		Msg("User provisioned with SCIM changed status")
+
+	for _, nodeID := range expired {
+		node, err := h.db.GetNodeByID(nodeID)
+		if err != nil {
+			return nil, err
+		}
+		h.notifyNodeExpired(node, *node.Expiry)
+	}
+
+	return h.db.GetUser(user.Name)
+}
+
+// scimDeleteUser deletes the user with its nodes.
+func (h *Headscale) scimDeleteUser(writer http.ResponseWriter, req *http.Request) {
+	user, err := h.scimUserByID(mux.Vars(req)["id"])
+	if err != nil {
+		scimDBErrorResponse(writer, err)
+
+		return
+	}
+
+	nodes, err := h.db.ListNodesByUser(user.Name)
+	if err != nil {
+		scimDBErrorResponse(writer, err)
+
+		return
+	}
+
+	for _, node := range nodes {
+		if err := h.deleteNode(req.Context(), node); err != nil {
+			scimDBErrorResponse(writer, err)
+
+			return
+		}
+	}
+
+	if err := h.db.DestroyUser(user.Name); err != nil {
+		scimDBErrorResponse(writer, err)
+
+		return
+	}
+	h.sendUserEvent(webhook.EventUserDeleted, user)
+	h.refreshIdPGroups()
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Headscale) scimGroupByID(idStr string) (*types.SCIMGroup, error) {
+	id, err := strconv.ParseUint(idStr, util.Base10, 64)
+	if err != nil {
+		return nil, db.ErrSCIMGroupNotFound
+	}
+
+	return h.db.GetSCIMGroup(id)
+}
+
+func (h *Headscale) scimListGroups(writer http.ResponseWriter, req *http.Request) {
+	attr, value, err := parseSCIMFilter(req.URL.Query().Get("filter"))
+	if err != nil {
+		scimDBErrorResponse(writer, err)
+
+		return
+	}
+	if attr != "" && attr != "displayname" && attr != "externalid" {
+		scimDBErrorResponse(writer, fmt.Errorf("%w: only displayName and externalId can be filtered", errSCIMInvalidFilter))
+
+		return
+	}
+
+	groups, err := h.db.ListSCIMGroups()
+	if err != nil {
+		scimDBErrorResponse(writer, err)
+
+		return
+	}
+
+	resources := []scimGroup{}
+	for index := range groups {
+		group := &groups[index]
+		if (attr == "displayname" && group.DisplayName != value) ||
+			(attr == "externalid" && group.ExternalID != value) {
+			continue
+		}
+		resources = append(resources, h.scimGroup(group))
+	}
+
+	scimResponse(writer, http.StatusOK, scimPage(req, resources))
+}
+
+func (h *Headscale) scimGetGroup(writer http.ResponseWriter, req *http.Request) {
+	group, err := h.scimGroupByID(mux.Vars(req)["id"])
+	if err != nil {
+		scimDBErrorResponse(writer, err)
+
+		return
+	}
+
+	scimResponse(writer, http.StatusOK, h.scimGroup(group))
+}
+
+func (h *Headscale) scimCreateGroup(writer http.ResponseWriter, req *http.Request) {
+	var body scimGroup
+	if !decodeSCIMRequest(writer, req, &body) {
+		return
+	}
+
+	group := &types.SCIMGroup{
+		DisplayName: body.DisplayName,
+		ExternalID:  body.ExternalID,
+	}
+	if err := h.scimSaveGroup(group, scimMemberValues(body.Members)); err != nil {
+		scimDBErrorResponse(writer, err)
+
+		return
+	}
+
+	scimResponse(writer, http.StatusCreated, h.scimGroup(group))
+}
+
+func (h *Headscale) scimReplaceGroup(writer http.ResponseWriter, req *http.Request) {
+	group, err := h.scimGroupByID(mux.Vars(req)["id"])
+	if err != nil {
+		scimDBErrorResponse(writer, err)
+
+		return
+	}
+
+	var body scimGroup
+	if !decodeSCIMRequest(writer, req, &body) {
+		return
+	}
+
+	group.DisplayName = body.DisplayName
+	group.ExternalID = body.ExternalID
+	if err := h.scimSaveGroup(group, scimMemberValues(body.Members)); err != nil {
+		scimDBErrorResponse(writer, err)
+
+		return
+	}
+
+	scimResponse(writer, http.StatusOK, h.scimGroup(group))
+}
+
+func (h *Headscale) scimPatchGroup(writer http.ResponseWriter, req *http.Request) {
+	group, err := h.scimGroupByID(mux.Vars(req)["id"])
+	if err != nil {
+		scimDBErrorResponse(writer, err)
+
+		return
+	}
+
+	var body scimPatchRequest
+	if !decodeSCIMRequest(writer, req, &body) {
+		return
+	}
+
+	members := make([]string, 0, len(group.Members))
+	for _, member := range group.Members {
+		members = append(members, scimUserID(&member))
+	}
+
+	for _, op := range body.Operations {
+		members, err = scimPatchGroup(group, members, op)
+		if err != nil {
+			scimDBErrorResponse(writer, err)
+
+			return
+		}
+	}
+
+	if err := h.scimSaveGroup(group, members); err != nil {
+		scimDBErrorResponse(writer, err)
+
+		return
+	}
+
+	scimResponse(writer, http.StatusOK, h.scimGroup(group))
+}
+
+// scimPatchGroup applies a patch operation to the group and its members,
+// the IDs of the member users.
+func scimPatchGroup(group *types.SCIMGroup, members []string, op scimPatchOperation) ([]string, error) {
+	path := strings.ToLower(op.Path)
+
+	// A member selected by the path, e.g. members[value eq "1"].
+	if match := scimMemberPathRegex.FindStringSubmatch(op.Path); match != nil {
+		if strings.ToLower(op.Op) != "remove" {
+			return nil, fmt.Errorf("%w: %q on a member", errSCIMInvalidPatch, op.Op)
+		}
+
+		return scimRemoveMembers(members, []string{match[1]}), nil
+	}
+
+	switch strings.ToLower(op.Op) {
+	case "add", "replace":
+		if path == "" {
+			var value scimGroup
+			if err := json.Unmarshal(op.Value, &value); err != nil {
+				return nil, fmt.Errorf("%w: %w", errSCIMInvalidPatch, err)
+			}
+			if value.DisplayName != "" {
+				group.DisplayName = value.DisplayName
+			}
+			if value.ExternalID != "" {
+				group.ExternalID = value.ExternalID
+			}
+			if value.Members != nil {
+				members = scimAddMembers(members, scimMemberValues(value.Members), strings.EqualFold(op.Op, "replace"))
+			}
+
+			return members, nil
+		}
+
+		switch path {
+		case "displayname":
+			if err := json.Unmarshal(op.Value, &group.DisplayName); err != nil {
+				return nil, fmt.Errorf("%w: displayName: %w", errSCIMInvalidPatch, err)
+			}
+		case "externalid":
+			if err := json.Unmarshal(op.Value, &group.ExternalID); err != nil {
+				return nil, fmt.Errorf("%w: externalId: %w", errSCIMInvalidPatch, err)
+			}
+		case "members":
+			var value []scimMember
+			if err := json.Unmarshal(op.Value, &value); err != nil {
+				return nil, fmt.Errorf("%w: members: %w", errSCIMInvalidPatch, err)
+			}
+			members = scimAddMembers(members, scimMemberValues(value), strings.EqualFold(op.Op, "replace"))
+		default:
+			return nil, fmt.Errorf("%w: unknown path %q", errSCIMInvalidPatch, op.Path)
+		}
+
+		return members, nil
+
+	case "remove":
+		if path != "members" {
+			return nil, fmt.Errorf("%w: cannot remove %q", errSCIMInvalidPatch, op.Path)
+		}
+
+		// Without a value, all the members are removed.
+		if len(op.Value) == 0 {
+			return nil, nil
+		}
+
+		var value []scimMember
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			return nil, fmt.Errorf("%w: members: %w", errSCIMInvalidPatch, err)
+		}
+
+		return scimRemoveMembers(members, scimMemberValues(value)), nil
+	}
+
+	return nil, fmt.Errorf("%w: %q", errSCIMInvalidPatch, op.Op)
+}
+
+func scimMemberValues(members []scimMember) []string {
+	values := make([]string, 0, len(members))
+	for _, member := range members {
+		values = append(values, member.Value)
+	}
+
+	return values
+}
+
+func scimAddMembers(members, added []string, replace bool) []string {
+	if replace {
+		members = nil
+	}
+
+	for _, member := range added {
+		if !util.IsStringInSlice(members, member) {
+			members = append(members, member)
+		}
+	}
+
+	return members
+}
+
+func scimRemoveMembers(members, removed []string) []string {
+	var kept []string
+	for _, member := range members {
+		if !util.IsStringInSlice(removed, member) {
+			kept = append(kept, member)
+		}
+	}
+
+	return kept
+}
+
+// scimSaveGroup stores the group with the members, the IDs of the member
+// users, and updates the groups of the policy.
+func (h *Headscale) scimSaveGroup(group *types.SCIMGroup, members []string) error {
+	if group.DisplayName == "" {
+		return fmt.Errorf("%w: the displayName of the group is required", errSCIMInvalidPatch)
+	}
+
+	ids := make([]uint, 0, len(members))
+	for _, member := range members {
+		id, err := strconv.ParseUint(member, util.Base10, 0)
+		if err != nil {
+			return fmt.Errorf("%w: %w %q", errSCIMMember, db.ErrUserNotFound, member)
+		}
+		ids = append(ids, uint(id))
+	}
+
+	if err := h.db.SaveSCIMGroup(group, ids); err != nil {
+		if errors.Is(err, db.ErrUserNotFound) {
+			return fmt.Errorf("%w: %w", errSCIMMember, err)
+		}
+
+		return err
+	}
+
+	h.refreshIdPGroups()
+
+	return nil
+}
+
+func (h *Headscale) scimDeleteGroup(writer http.ResponseWriter, req *http.Request) {
+	group, err := h.scimGroupByID(mux.Vars(req)["id"])
+	if err != nil {
+		scimDBErrorResponse(writer, err)
+
+		return
+	}
+
+	if err := h.db.DeleteSCIMGroup(group.ID); err != nil {
+		scimDBErrorResponse(writer, err)
+
+		return
+	}
+	h.refreshIdPGroups()
+
+	writer.WriteHeader(http.StatusNoContent)
+}
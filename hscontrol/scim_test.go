@@ -0,0 +1,220 @@
+package hscontrol
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/juanfont/headscale/hscontrol/policy"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gopkg.in/check.v1"
+)
+
+// scimRequest sends the request to the SCIM server and decodes the JSON
+// answer into out, if it is not nil.
+func scimRequest(c *check.C, token, method, path, body string, out interface{}) int {
+	router := mux.NewRouter()
+	app.registerSCIMRoutes(router)
+
+	req := httptest.NewRequest(method, scimPrefix+path, strings.NewReader(body))
+	req.Header.Set("Content-Type", scimContentType)
+	if token != "" {
+		req.Header.Set("Authorization", AuthPrefix+token)
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if out != nil {
+		c.Assert(json.Unmarshal(rec.Body.Bytes(), out), check.IsNil, check.Commentf("body: %s", rec.Body.String()))
+	}
+
+	return rec.Code
+}
+
+func scimTestToken(c *check.C, scopes ...string) string {
+	expiration := time.Now().Add(time.Hour)
+	token, _, err := app.db.CreateAPIKey(&expiration, scopes...)
+	c.Assert(err, check.IsNil)
+
+	return token
+}
+
+func (s *Suite) TestSCIMAuthentication(c *check.C) {
+	code := scimRequest(c, "", http.MethodGet, "/Users", "", nil)
+	c.Assert(code, check.Equals, http.StatusUnauthorized)
+
+	code = scimRequest(c, "invalid.token", http.MethodGet, "/Users", "", nil)
+	c.Assert(code, check.Equals, http.StatusUnauthorized)
+
+	readOnly := scimTestToken(c, "users:read")
+	var scimErr scimError
+	code = scimRequest(c, readOnly, http.MethodGet, "/Users", "", &scimErr)
+	c.Assert(code, check.Equals, http.StatusForbidden)
+	c.Assert(scimErr.Schemas, check.DeepEquals, []string{scimSchemaError})
+
+	code = scimRequest(c, scimTestToken(c, "users:write"), http.MethodGet, "/Users", "", nil)
+	c.Assert(code, check.Equals, http.StatusOK)
+}
+
+func (s *Suite) TestSCIMUsers(c *check.C) {
+	token := scimTestToken(c)
+
+	var created scimUser
+	code := scimRequest(c, token, http.MethodPost, "/Users",
+		`{"schemas": ["`+scimSchemaUser+`"], "userName": "Alice@Example.com", "active": true}`, &created)
+	c.Assert(code, check.Equals, http.StatusCreated)
+	c.Assert(created.UserName, check.Equals, "alice.example.com")
+	c.Assert(*created.Active, check.Equals, true)
+
+	code = scimRequest(c, token, http.MethodPost, "/Users", `{"userName": "alice@example.com"}`, nil)
+	c.Assert(code, check.Equals, http.StatusConflict)
+
+	var list scimListResponse
+	code = scimRequest(c, token, http.MethodGet, `/Users?filter=userName+eq+"alice@example.com"`, "", &list)
+	c.Assert(code, check.Equals, http.StatusOK)
+	c.Assert(list.TotalResults, check.Equals, 1)
+
+	code = scimRequest(c, token, http.MethodGet, `/Users?filter=userName+eq+"bob@example.com"`, "", &list)
+	c.Assert(code, check.Equals, http.StatusOK)
+	c.Assert(list.TotalResults, check.Equals, 0)
+
+	code = scimRequest(c, token, http.MethodGet, `/Users?filter=name+sw+"a"`, "", nil)
+	c.Assert(code, check.Equals, http.StatusBadRequest)
+
+	var renamed scimUser
+	code = scimRequest(c, token, http.MethodPatch, "/Users/"+created.ID, `{
+		"schemas": ["`+scimSchemaPatchOp+`"],
+		"Operations": [{"op": "Replace", "path": "userName", "value": "alice.smith@example.com"}]
+	}`, &renamed)
+	c.Assert(code, check.Equals, http.StatusOK)
+	c.Assert(renamed.UserName, check.Equals, "alice.smith.example.com")
+
+	code = scimRequest(c, token, http.MethodDelete, "/Users/"+created.ID, "", nil)
+	c.Assert(code, check.Equals, http.StatusNoContent)
+
+	code = scimRequest(c, token, http.MethodGet, "/Users/"+created.ID, "", nil)
+	c.Assert(code, check.Equals, http.StatusNotFound)
+}
+
+func (s *Suite) TestSCIMDeactivateUser(c *check.C) {
+	node1, node2 := createPollTestNodes(c)
+	token := scimTestToken(c)
+
+	user, err := app.db.GetUser("test")
+	c.Assert(err, check.IsNil)
+	id := scimUserID(user)
+
+	// Azure AD sends the status as a string, without a path.
+	var patched scimUser
+	code := scimRequest(c, token, http.MethodPatch, "/Users/"+id, `{
+		"schemas": ["`+scimSchemaPatchOp+`"],
+		"Operations": [{"op": "replace", "value": {"active": "False"}}]
+	}`, &patched)
+	c.Assert(code, check.Equals, http.StatusOK)
+	c.Assert(*patched.Active, check.Equals, false)
+
+	for _, nodeID := range []types.NodeID{node1.ID, node2.ID} {
+		node, err := app.db.GetNodeByID(nodeID)
+		c.Assert(err, check.IsNil)
+		c.Assert(node.IsExpired(), check.Equals, true)
+	}
+
+	var replaced scimUser
+	code = scimRequest(c, token, http.MethodPut, "/Users/"+id,
+		`{"schemas": ["`+scimSchemaUser+`"], "userName": "test", "active": true}`, &replaced)
+	c.Assert(code, check.Equals, http.StatusOK)
+	c.Assert(*replaced.Active, check.Equals, true)
+
+	user, err = app.db.GetUser("test")
+	c.Assert(err, check.IsNil)
+	c.Assert(user.Deactivated, check.Equals, false)
+}
+
+func (s *Suite) TestSCIMDeleteUserNodes(c *check.C) {
+	createPollTestNodes(c)
+	token := scimTestToken(c)
+
+	user, err := app.db.GetUser("test")
+	c.Assert(err, check.IsNil)
+
+	code := scimRequest(c, token, http.MethodDelete, "/Users/"+scimUserID(user), "", nil)
+	c.Assert(code, check.Equals, http.StatusNoContent)
+
+	nodes, err := app.db.ListNodes()
+	c.Assert(err, check.IsNil)
+	c.Assert(nodes, check.HasLen, 0)
+}
+
+func (s *Suite) TestSCIMGroups(c *check.C) {
+	node1, _ := createPollTestNodes(c)
+	nodes, err := app.db.ListNodes()
+	c.Assert(err, check.IsNil)
+	token := scimTestToken(c)
+
+	app.cfg.SCIM.Enabled = true
+
+	pol, err := policy.LoadACLPolicyFromBytes([]byte(`{
+		"acls": [
+			{"action": "accept", "src": ["group:engineering"], "dst": ["*:22"]},
+		],
+	}`), "hujson")
+	c.Assert(err, check.IsNil)
+	_, err = app.applyIdPGroups(pol)
+	c.Assert(err, check.IsNil)
+	app.ACLPolicy = pol
+
+	user, err := app.db.GetUser("test")
+	c.Assert(err, check.IsNil)
+
+	var group scimGroup
+	code := scimRequest(c, token, http.MethodPost, "/Groups",
+		`{"schemas": ["`+scimSchemaGroup+`"], "displayName": "engineering", "externalId": "ext-1", "members": []}`, &group)
+	c.Assert(code, check.Equals, http.StatusCreated)
+	c.Assert(group.Members, check.HasLen, 0)
+
+	code = scimRequest(c, token, http.MethodPost, "/Groups", `{"displayName": "engineering"}`, nil)
+	c.Assert(code, check.Equals, http.StatusConflict)
+
+	code = scimRequest(c, token, http.MethodPatch, "/Groups/"+group.ID, `{
+		"schemas": ["`+scimSchemaPatchOp+`"],
+		"Operations": [{"op": "add", "path": "members", "value": [{"value": "`+scimUserID(user)+`"}]}]
+	}`, &group)
+	c.Assert(code, check.Equals, http.StatusOK)
+	c.Assert(group.Members, check.DeepEquals, []scimMember{{Value: scimUserID(user), Display: "test"}})
+
+	ips, err := app.ACLPolicy.ExpandAlias(nodes, "group:engineering")
+	c.Assert(err, check.IsNil)
+	c.Assert(ips.Contains(*node1.IPv4), check.Equals, true)
+
+	var list scimListResponse
+	code = scimRequest(c, token, http.MethodGet, `/Groups?filter=externalId+eq+"ext-1"`, "", &list)
+	c.Assert(code, check.Equals, http.StatusOK)
+	c.Assert(list.TotalResults, check.Equals, 1)
+
+	code = scimRequest(c, token, http.MethodPatch, "/Groups/"+group.ID, `{
+		"schemas": ["`+scimSchemaPatchOp+`"],
+		"Operations": [{"op": "remove", "path": "members[value eq \"`+scimUserID(user)+`\"]"}]
+	}`, &group)
+	c.Assert(code, check.Equals, http.StatusOK)
+	c.Assert(group.Members, check.HasLen, 0)
+
+	ips, err = app.ACLPolicy.ExpandAlias(nodes, "group:engineering")
+	c.Assert(err, check.IsNil)
+	c.Assert(ips.Prefixes(), check.HasLen, 0)
+
+	code = scimRequest(c, token, http.MethodPatch, "/Groups/"+group.ID, `{
+		"schemas": ["`+scimSchemaPatchOp+`"],
+		"Operations": [{"op": "add", "path": "members", "value": [{"value": "4242"}]}]
+	}`, nil)
+	c.Assert(code, check.Equals, http.StatusBadRequest)
+
+	code = scimRequest(c, token, http.MethodDelete, "/Groups/"+group.ID, "", nil)
+	c.Assert(code, check.Equals, http.StatusNoContent)
+
+	code = scimRequest(c, token, http.MethodGet, "/Groups/"+group.ID, "", nil)
+	c.Assert(code, check.Equals, http.StatusNotFound)
+}
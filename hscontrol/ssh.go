@@ -0,0 +1,398 @@
+package hscontrol
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/juanfont/headscale/hscontrol/policy"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/rs/zerolog/log"
+	"tailscale.com/tailcfg"
+)
+
+const (
+	// sshCheckExpiration is how long the user has to authenticate before
+	// a held SSH connection is rejected.
+	sshCheckExpiration = 10 * time.Minute
+	sshCheckCleanup    = 15 * time.Minute
+
+	defaultSSHCheckPeriod = 12 * time.Hour
+)
+
+// sshCheck is an SSH connection held by the destination node until the
+// user of the source node has authenticated.
+type sshCheck struct {
+	ID          string
+	SrcNodeID   types.NodeID
+	DstNodeID   types.NodeID
+	SSHUser     string
+	LocalUser   string
+	CheckPeriod time.Duration
+	Expiry      time.Time
+
+	// Recording is added to the accepted action, the final action
+	// decides where the session is recorded to.
+	Recording sshRecording
+
+	once    sync.Once
+	done    chan struct{}
+	outcome *tailcfg.SSHAction
+}
+
+// sshCheckOIDCState is stored in the registration cache under the OIDC
+// state while the user authenticates for an SSH check.
+type sshCheckOIDCState string
+
+func sshCheckKey(id string) string {
+	return "check/" + id
+}
+
+// sshCheckApprovalKey is the key of the approval of a node, which is
+// kept for the check period of the SSH rule.
+func sshCheckApprovalKey(nodeID types.NodeID) string {
+	return "approved/" + nodeID.String()
+}
+
+// sshRecording are the recorders of the SSH rule with the check action,
+// passed along in the URL of the check.
+type sshRecording struct {
+	Recorders []netip.AddrPort
+	Enforce   bool
+}
+
+func sshRecordingFromQuery(query url.Values) (sshRecording, error) {
+	var recording sshRecording
+	for _, value := range query["recorder"] {
+		recorder, err := netip.ParseAddrPort(value)
+		if err != nil {
+			return sshRecording{}, err
+		}
+		recording.Recorders = append(recording.Recorders, recorder)
+	}
+	recording.Enforce = query.Get("enforce_recorder") == "true"
+
+	return recording, nil
+}
+
+func sshAcceptAction(recording sshRecording) *tailcfg.SSHAction {
+	action := &tailcfg.SSHAction{
+		Accept:                   true,
+		AllowLocalPortForwarding: true,
+		Recorders:                recording.Recorders,
+	}
+	if recording.Enforce {
+		action.OnRecordingFailure = policy.SSHRecordingFailureAction()
+	}
+
+	return action
+}
+
+func sshRejectAction(message string) *tailcfg.SSHAction {
+	return &tailcfg.SSHAction{
+		Reject:  true,
+		Message: message + "\n",
+	}
+}
+
+// finish records the outcome of the check and releases the nodes
+// waiting for it. Only the first outcome is kept.
+func (c *sshCheck) finish(outcome *tailcfg.SSHAction) {
+	c.once.Do(func() {
+		c.outcome = outcome
+		close(c.done)
+	})
+}
+
+func (h *Headscale) newSSHCheck(
+	src, dst types.NodeID,
+	sshUser, localUser string,
+	checkPeriod time.Duration,
+	recording sshRecording,
+) (*sshCheck, error) {
+	randomBlob := make([]byte, randomByteSize)
+	if _, err := rand.Read(randomBlob); err != nil {
+		return nil, err
+	}
+
+	check := &sshCheck{
+		ID:          hex.EncodeToString(randomBlob),
+		SrcNodeID:   src,
+		DstNodeID:   dst,
+		SSHUser:     sshUser,
+		LocalUser:   localUser,
+		CheckPeriod: checkPeriod,
+		Recording:   recording,
+		Expiry:      time.Now().Add(sshCheckExpiration),
+		done:        make(chan struct{}),
+	}
+
+	h.sshCheckCache.Set(sshCheckKey(check.ID), check, sshCheckExpiration)
+
+	return check, nil
+}
+
+func (h *Headscale) getSSHCheck(id string) (*sshCheck, bool) {
+	if cached, ok := h.sshCheckCache.Get(sshCheckKey(id)); ok {
+		if check, ok := cached.(*sshCheck); ok {
+			return check, true
+		}
+	}
+
+	return nil, false
+}
+
+// approveSSHCheck accepts the held connection and skips the check for
+// further connections from the source node for the check period.
+func (h *Headscale) approveSSHCheck(check *sshCheck) {
+	h.sshCheckCache.Set(sshCheckApprovalKey(check.SrcNodeID), true, check.CheckPeriod)
+	check.finish(sshAcceptAction(check.Recording))
+}
+
+func writeSSHAction(writer http.ResponseWriter, action *tailcfg.SSHAction) {
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(writer).Encode(action); err != nil {
+		util.LogErr(err, "Failed to write response")
+	}
+}
+
+// SSHActionHandler is fetched by the destination node of an SSH connection
+// matching a rule with the check action. It accepts the connection if the
+// source node has passed a check within the check period, otherwise it
+// asks the user to authenticate and holds the connection.
+// Listens in /machine/ssh/action/from/:src/to/:dst.
+func (ns *noiseServer) SSHActionHandler(
+	writer http.ResponseWriter,
+	req *http.Request,
+) {
+	vars := mux.Vars(req)
+	src, err := strconv.ParseUint(vars["src"], util.Base10, 64)
+	if err != nil {
+		http.Error(writer, "invalid source node", http.StatusBadRequest)
+
+		return
+	}
+	dst, err := strconv.ParseUint(vars["dst"], util.Base10, 64)
+	if err != nil {
+		http.Error(writer, "invalid destination node", http.StatusBadRequest)
+
+		return
+	}
+
+	node, err := ns.headscale.db.GetNodeByMachineKey(ns.machineKey)
+	if err != nil || node.ID != types.NodeID(dst) {
+		http.Error(writer, "SSH actions can only be fetched by the destination node", http.StatusForbidden)
+
+		return
+	}
+
+	checkPeriod := defaultSSHCheckPeriod
+	if value := req.URL.Query().Get("check_period"); value != "" {
+		checkPeriod, err = time.ParseDuration(value)
+		if err != nil {
+			http.Error(writer, "invalid check period", http.StatusBadRequest)
+
+			return
+		}
+	}
+
+	recording, err := sshRecordingFromQuery(req.URL.Query())
+	if err != nil {
+		http.Error(writer, "invalid recorder", http.StatusBadRequest)
+
+		return
+	}
+
+	logger := log.With().
+		Uint64("src_node_id", src).
+		Uint64("dst_node_id", dst).
+		Str("ssh_user", req.URL.Query().Get("ssh_user")).
+		Str("local_user", req.URL.Query().Get("local_user")).
+		Logger()
+
+	if _, ok := ns.headscale.sshCheckCache.Get(sshCheckApprovalKey(types.NodeID(src))); ok {
+		logger.Debug().Msg("SSH check passed within the check period, accepting")
+		writeSSHAction(writer, sshAcceptAction(recording))
+
+		return
+	}
+
+	if ns.headscale.oauth2Config.Load() == nil {
+		logger.Warn().Msg("SSH check requested, but OIDC is not configured, rejecting")
+		writeSSHAction(writer, sshRejectAction("# Headscale SSH check requires OIDC to be configured."))
+
+		return
+	}
+
+	check, err := ns.headscale.newSSHCheck(
+		types.NodeID(src),
+		types.NodeID(dst),
+		req.URL.Query().Get("ssh_user"),
+		req.URL.Query().Get("local_user"),
+		checkPeriod,
+		recording,
+	)
+	if err != nil {
+		util.LogErr(err, "could not create SSH check")
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+
+		return
+	}
+
+	logger.Info().Str("check", check.ID).Msg("SSH check requested, waiting for the user to authenticate")
+
+	writeSSHAction(writer, &tailcfg.SSHAction{
+		Message: fmt.Sprintf(
+			"# Headscale SSH requires an additional check.\n# To authenticate, visit: %s/ssh/check/%s\n",
+			strings.TrimSuffix(ns.headscale.cfg.ServerURL, "/"),
+			check.ID,
+		),
+		HoldAndDelegate: "https://unused/machine/ssh/wait/" + check.ID,
+	})
+}
+
+// SSHWaitHandler is long polled by the destination node while an SSH
+// connection is held, and returns once the user has authenticated or
+// the check has expired.
+// Listens in /machine/ssh/wait/:id.
+func (ns *noiseServer) SSHWaitHandler(
+	writer http.ResponseWriter,
+	req *http.Request,
+) {
+	check, ok := ns.headscale.getSSHCheck(mux.Vars(req)["id"])
+	if !ok {
+		writeSSHAction(writer, sshRejectAction("# SSH check has expired."))
+
+		return
+	}
+
+	node, err := ns.headscale.db.GetNodeByMachineKey(ns.machineKey)
+	if err != nil || node.ID != check.DstNodeID {
+		http.Error(writer, "SSH checks can only be waited on by the destination node", http.StatusForbidden)
+
+		return
+	}
+
+	timeout := time.NewTimer(time.Until(check.Expiry))
+	defer timeout.Stop()
+
+	select {
+	case <-check.done:
+		writeSSHAction(writer, check.outcome)
+	case <-timeout.C:
+		check.finish(sshRejectAction("# SSH check has expired."))
+		writeSSHAction(writer, check.outcome)
+	case <-req.Context().Done():
+		// tailscaled fetches the URL again while the SSH
+		// connection is open.
+	}
+}
+
+// SSHCheckHandler redirects the user to the OIDC provider to
+// authenticate for a held SSH connection.
+// Listens in /ssh/check/:id.
+func (h *Headscale) SSHCheckHandler(
+	writer http.ResponseWriter,
+	req *http.Request,
+) {
+	check, ok := h.getSSHCheck(mux.Vars(req)["id"])
+	if !ok {
+		http.Error(writer, "SSH check has expired", http.StatusNotFound)
+
+		return
+	}
+
+	if h.oauth2Config.Load() == nil {
+		http.Error(writer, "SSH check requires OIDC to be configured", http.StatusNotFound)
+
+		return
+	}
+
+	randomBlob := make([]byte, randomByteSize)
+	if _, err := rand.Read(randomBlob); err != nil {
+		util.LogErr(err, "could not read 16 bytes from rand")
+
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+
+		return
+	}
+
+	stateStr := hex.EncodeToString(randomBlob)[:32]
+	h.registrationCache.Set(
+		stateStr,
+		sshCheckOIDCState(check.ID),
+		sshCheckExpiration,
+	)
+
+	http.Redirect(writer, req, h.oidcAuthCodeURL(stateStr), http.StatusFound)
+}
+
+// approveSSHCheckForOIDCCallback approves the SSH check waiting for the
+// OIDC state if the authenticated user owns the source node.
+func (h *Headscale) approveSSHCheckForOIDCCallback(
+	writer http.ResponseWriter,
+	id string,
+	claims *IDTokenClaims,
+) {
+	check, ok := h.getSSHCheck(id)
+	if !ok {
+		http.Error(writer, "SSH check has expired", http.StatusNotFound)
+
+		return
+	}
+
+	userName, err := getUserName(writer, claims, h.cfg.OIDC.StripEmaildomain)
+	if err != nil {
+		return
+	}
+
+	node, err := h.db.GetNodeByID(check.SrcNodeID)
+	if err != nil {
+		check.finish(sshRejectAction("# SSH check failed, the source node was not found."))
+		http.Error(writer, "source node of the SSH connection not found", http.StatusNotFound)
+
+		return
+	}
+
+	if node.User.Name != userName {
+		log.Warn().
+			Str("check", check.ID).
+			Str("user", userName).
+			Str("node_user", node.User.Name).
+			Msg("SSH check authenticated as a user not owning the source node, rejecting")
+
+		check.finish(sshRejectAction("# SSH check failed, authenticated as a different user."))
+		http.Error(writer, "authenticated user does not own the source node of the SSH connection", http.StatusForbidden)
+
+		return
+	}
+
+	h.approveSSHCheck(check)
+
+	log.Info().
+		Str("check", check.ID).
+		Str("user", userName).
+		Msg("SSH check passed")
+
+	content, err := renderOIDCCallbackTemplate(writer, claims)
+	if err != nil {
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.WriteHeader(http.StatusOK)
+	if _, err := writer.Write(content.Bytes()); err != nil {
+		util.LogErr(err, "Failed to write response")
+	}
+}
@@ -0,0 +1,142 @@
+package hscontrol
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+	"gopkg.in/check.v1"
+	"tailscale.com/tailcfg"
+)
+
+func serveSSHAction(
+	c *check.C,
+	handler http.HandlerFunc,
+	url string,
+	vars map[string]string,
+) (int, *tailcfg.SSHAction) {
+	rec := httptest.NewRecorder()
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, url, nil), vars)
+	handler(rec, req)
+
+	if rec.Code != http.StatusOK {
+		return rec.Code, nil
+	}
+
+	var action tailcfg.SSHAction
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &action), check.IsNil)
+
+	return rec.Code, &action
+}
+
+func (s *Suite) TestSSHCheck(c *check.C) {
+	src, dst := createPollTestNodes(c)
+	app.cfg.ServerURL = "https://headscale.example.com"
+
+	dstNoise := &noiseServer{headscale: app, machineKey: dst.MachineKey}
+	srcNoise := &noiseServer{headscale: app, machineKey: src.MachineKey}
+
+	actionURL := fmt.Sprintf("/machine/ssh/action/from/%d/to/%d?ssh_user=root&local_user=root&check_period=1h", src.ID, dst.ID)
+	actionVars := map[string]string{
+		"src": src.ID.String(),
+		"dst": dst.ID.String(),
+	}
+
+	// Without OIDC nobody can authenticate.
+	code, action := serveSSHAction(c, dstNoise.SSHActionHandler, actionURL, actionVars)
+	c.Assert(code, check.Equals, http.StatusOK)
+	c.Assert(action.Reject, check.Equals, true)
+
+	app.oauth2Config.Store(&oauth2.Config{})
+	defer app.oauth2Config.Store(nil)
+
+	// Only the destination node can fetch the action.
+	code, _ = serveSSHAction(c, srcNoise.SSHActionHandler, actionURL, actionVars)
+	c.Assert(code, check.Equals, http.StatusForbidden)
+
+	code, action = serveSSHAction(c, dstNoise.SSHActionHandler, actionURL, actionVars)
+	c.Assert(code, check.Equals, http.StatusOK)
+	c.Assert(action.Accept, check.Equals, false)
+	c.Assert(action.Reject, check.Equals, false)
+	c.Assert(strings.HasPrefix(action.HoldAndDelegate, "https://unused/machine/ssh/wait/"), check.Equals, true)
+
+	checkID := strings.TrimPrefix(action.HoldAndDelegate, "https://unused/machine/ssh/wait/")
+	c.Assert(action.Message, check.Matches, "(?s).*https://headscale.example.com/ssh/check/"+checkID+".*")
+
+	pending, ok := app.getSSHCheck(checkID)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(pending.SrcNodeID, check.Equals, src.ID)
+	c.Assert(pending.DstNodeID, check.Equals, dst.ID)
+	c.Assert(pending.SSHUser, check.Equals, "root")
+	c.Assert(pending.CheckPeriod, check.Equals, time.Hour)
+
+	waitURL := "/machine/ssh/wait/" + checkID
+	waitVars := map[string]string{"id": checkID}
+
+	code, _ = serveSSHAction(c, srcNoise.SSHWaitHandler, waitURL, waitVars)
+	c.Assert(code, check.Equals, http.StatusForbidden)
+
+	type waitResult struct {
+		code   int
+		action *tailcfg.SSHAction
+	}
+	waited := make(chan waitResult)
+	go func() {
+		code, action := serveSSHAction(c, dstNoise.SSHWaitHandler, waitURL, waitVars)
+		waited <- waitResult{code, action}
+	}()
+
+	select {
+	case <-waited:
+		c.Fatal("wait returned before the check was approved")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	app.approveSSHCheck(pending)
+
+	result := <-waited
+	c.Assert(result.code, check.Equals, http.StatusOK)
+	c.Assert(result.action.Accept, check.Equals, true)
+	c.Assert(result.action.Recorders, check.HasLen, 0)
+
+	// The check is not repeated within the check period.
+	code, action = serveSSHAction(c, dstNoise.SSHActionHandler, actionURL, actionVars)
+	c.Assert(code, check.Equals, http.StatusOK)
+	c.Assert(action.Accept, check.Equals, true)
+	c.Assert(action.HoldAndDelegate, check.Equals, "")
+
+	// The recorders of the rule are passed along to the final action.
+	code, action = serveSSHAction(c, dstNoise.SSHActionHandler, actionURL+"&recorder=100.64.0.9%3A80&enforce_recorder=true", actionVars)
+	c.Assert(code, check.Equals, http.StatusOK)
+	c.Assert(action.Accept, check.Equals, true)
+	c.Assert(action.Recorders, check.DeepEquals, []netip.AddrPort{netip.MustParseAddrPort("100.64.0.9:80")})
+	c.Assert(action.OnRecordingFailure, check.NotNil)
+
+	// Checks which are gone are rejected.
+	code, action = serveSSHAction(c, dstNoise.SSHWaitHandler, "/machine/ssh/wait/unknown", map[string]string{"id": "unknown"})
+	c.Assert(code, check.Equals, http.StatusOK)
+	c.Assert(action.Reject, check.Equals, true)
+}
+
+func (s *Suite) TestSSHCheckWrongUser(c *check.C) {
+	src, dst := createPollTestNodes(c)
+
+	pending, err := app.newSSHCheck(src.ID, dst.ID, "root", "root", time.Hour, sshRecording{})
+	c.Assert(err, check.IsNil)
+
+	rec := httptest.NewRecorder()
+	app.approveSSHCheckForOIDCCallback(rec, pending.ID, &IDTokenClaims{Email: "someone-else@example.com"})
+	c.Assert(rec.Code, check.Equals, http.StatusForbidden)
+
+	<-pending.done
+	c.Assert(pending.outcome.Reject, check.Equals, true)
+
+	_, approved := app.sshCheckCache.Get(sshCheckApprovalKey(src.ID))
+	c.Assert(approved, check.Equals, false)
+}
@@ -3,6 +3,7 @@ package hscontrol
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/juanfont/headscale/hscontrol/types"
 	"gopkg.in/check.v1"
@@ -49,6 +50,12 @@ func (s *Suite) ResetDB(c *check.C) {
 		OIDC: types.OIDCConfig{
 			StripEmaildomain: false,
 		},
+		Tuning: types.Tuning{
+			BatchChangeDelay:       time.Second,
+			NotifierSendTimeout:    time.Second,
+			KeepAliveInterval:      50 * time.Second,
+			MapSessionCloseTimeout: 30 * time.Second,
+		},
 	}
 
 	app, err = NewHeadscale(&cfg)
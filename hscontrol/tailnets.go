@@ -0,0 +1,141 @@
+package hscontrol
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/policy"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+)
+
+var ErrTailnetNotFound = errors.New("tailnet not found")
+
+// tailnetPolicy returns the policy of the tailnet of the multi-tailnet
+// mode, or of the default tailnet if it is empty, nil if it has none.
+func (h *Headscale) tailnetPolicy(tailnet string) *policy.ACLPolicy {
+	if tailnet == "" {
+		return h.ACLPolicy
+	}
+
+	return h.tailnetPolicies[tailnet]
+}
+
+// policyOf returns the policy of the tailnet of the node.
+func (h *Headscale) policyOf(node *types.Node) *policy.ACLPolicy {
+	return h.tailnetPolicy(node.User.Tailnet)
+}
+
+// userTailnet returns the tailnet of the user, the default tailnet if
+// there is no such user.
+func (h *Headscale) userTailnet(userName string) string {
+	user, err := h.db.GetUser(userName)
+	if err != nil {
+		return ""
+	}
+
+	return user.Tailnet
+}
+
+// policies returns the policies of all the tailnets, by name, the
+// default tailnet being the empty name. The tailnets without a policy
+// are left out.
+func (h *Headscale) policies() map[string]*policy.ACLPolicy {
+	policies := make(map[string]*policy.ACLPolicy, len(h.tailnetPolicies)+1)
+	if h.ACLPolicy != nil {
+		policies[""] = h.ACLPolicy
+	}
+	for tailnet, pol := range h.tailnetPolicies {
+		policies[tailnet] = pol
+	}
+
+	return policies
+}
+
+// loadTailnetPolicies loads the policies of the tailnets of the
+// multi-tailnet mode from their paths, and runs their tests against the
+// nodes of the tailnet. The nodes of a tailnet without a policy can all
+// reach each other. None of the policies are used if one of them is
+// invalid or its tests fail.
+func (h *Headscale) loadTailnetPolicies() error {
+	if len(h.cfg.Tailnets) == 0 {
+		return nil
+	}
+
+	nodes, err := h.db.ListNodes()
+	if err != nil {
+		return fmt.Errorf("listing nodes to run policy tests: %w", err)
+	}
+
+	policies := make(map[string]*policy.ACLPolicy)
+	for _, tailnet := range h.cfg.Tailnets {
+		if tailnet.PolicyPath == "" {
+			continue
+		}
+
+		pol, err := policy.LoadACLPolicyFromPath(tailnet.PolicyPath)
+		if err != nil {
+			return fmt.Errorf("loading ACL policy of tailnet %s from %s: %w", tailnet.Name, tailnet.PolicyPath, err)
+		}
+
+		if _, err := h.applyIdPGroups(pol); err != nil {
+			return fmt.Errorf("adding the identity provider groups to the ACL policy of tailnet %s: %w", tailnet.Name, err)
+		}
+
+		if _, err := h.applyNodeShares(pol); err != nil {
+			return fmt.Errorf("adding the node shares to the ACL policy of tailnet %s: %w", tailnet.Name, err)
+		}
+
+		pol.KeepHostSources(h.tailnetPolicies[tailnet.Name])
+
+		if err := pol.RunTests(nodes.InTailnet(tailnet.Name)); err != nil {
+			return fmt.Errorf("running tests of ACL policy %s of tailnet %s: %w", tailnet.PolicyPath, tailnet.Name, err)
+		}
+
+		policies[tailnet.Name] = pol
+	}
+
+	h.tailnetPolicies = policies
+	h.refreshACLHostsSoon()
+
+	return nil
+}
+
+// oidcTailnet returns the tailnet the OIDC claim of the configuration
+// puts the user in, the default tailnet if the claim is not configured
+// or not set. A tailnet which is not configured is rejected, as is a
+// user of another tailnet.
+func (h *Headscale) oidcTailnet(
+	writer http.ResponseWriter,
+	claims map[string]interface{},
+	userName string,
+) (string, error) {
+	var tailnet string
+	if h.cfg.OIDC.TailnetClaim != "" {
+		tailnet, _ = claims[h.cfg.OIDC.TailnetClaim].(string)
+	}
+
+	var err error
+	if tailnet != "" && h.cfg.Tailnet(tailnet) == nil {
+		err = fmt.Errorf("%w: %s", ErrTailnetNotFound, tailnet)
+	} else if user, getErr := h.db.GetUser(userName); getErr == nil && user.Tailnet != tailnet {
+		err = fmt.Errorf("%w: %s is in tailnet %q", db.ErrUserOtherTailnet, userName, user.Tailnet)
+	}
+
+	if err != nil {
+		util.LogErr(err, "OIDC user rejected")
+
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writer.WriteHeader(http.StatusForbidden)
+		_, werr := writer.Write([]byte("unauthorized tailnet"))
+		if werr != nil {
+			util.LogErr(werr, "Failed to write response")
+		}
+
+		return "", err
+	}
+
+	return tailnet, nil
+}
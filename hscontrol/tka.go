@@ -0,0 +1,628 @@
+package hscontrol
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tka"
+	"tailscale.com/types/key"
+	"tailscale.com/types/tkatype"
+)
+
+// Network lock (tailnet lock) is enforced by the nodes, they only trust
+// the node keys signed by the trusted keys of the tailnet key authority
+// (TKA). Headscale stores the AUMs of the authority, which only the
+// nodes holding a trusted key can sign, and the signatures of the node
+// keys, and distributes them to the nodes.
+// https://tailscale.com/kb/1226/tailnet-lock
+
+var (
+	errTailnetLockNotAllowed = errors.New("network lock is not allowed, set tailnet_lock to enable it")
+	errTailnetLockTailnets   = errors.New("network lock is not supported with tailnets")
+	errTKAAlreadyEnabled     = errors.New("network lock is already enabled")
+	errTKAInitNotStarted     = errors.New("network lock initialisation was not started")
+	errTKAInvalidAUMs        = errors.New("invalid AUMs")
+)
+
+func tkaInitKey(machineKey key.MachinePublic) string {
+	return "tka-init/" + machineKey.String()
+}
+
+// tkaRequest decodes the body of a network lock request, and returns
+// the node making it. The node key of the request must be the one of
+// the node of the Noise session. The requests are rejected when tailnets
+// are configured, there is a single authority and it would span all of
+// them.
+func (ns *noiseServer) tkaRequest(
+	writer http.ResponseWriter,
+	req *http.Request,
+	body any,
+	nodeKey func() key.NodePublic,
+) (*types.Node, bool) {
+	if !ns.headscale.cfg.TailnetLock {
+		http.Error(writer, errTailnetLockNotAllowed.Error(), http.StatusForbidden)
+
+		return nil, false
+	}
+
+	if len(ns.headscale.cfg.Tailnets) > 0 {
+		http.Error(writer, errTailnetLockTailnets.Error(), http.StatusForbidden)
+
+		return nil, false
+	}
+
+	if err := json.NewDecoder(req.Body).Decode(body); err != nil {
+		http.Error(writer, "invalid request", http.StatusBadRequest)
+
+		return nil, false
+	}
+
+	node, err := ns.headscale.db.GetNodeByMachineKey(ns.machineKey)
+	if err != nil || node.NodeKey != nodeKey() {
+		http.Error(writer, "unknown node", http.StatusForbidden)
+
+		return nil, false
+	}
+
+	return node, true
+}
+
+func writeTKAResponse(writer http.ResponseWriter, resp any) {
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(writer).Encode(resp); err != nil {
+		util.LogErr(err, "Failed to write response")
+	}
+}
+
+// tkaError writes the error of a network lock request, ErrTKANotEnabled
+// is a bad request, other errors are internal.
+func tkaError(writer http.ResponseWriter, err error, msg string) {
+	if errors.Is(err, db.ErrTKANotEnabled) {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	log.Error().Err(err).Msg(msg)
+	http.Error(writer, "Internal server error", http.StatusInternalServerError)
+}
+
+// tkaInfo returns the state of network lock sent in the map responses,
+// nil if it was never enabled.
+func tkaInfo(tx *gorm.DB) (*tailcfg.TKAInfo, error) {
+	state, err := db.GetTKAState(tx)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if state.Disabled {
+		return &tailcfg.TKAInfo{Disabled: true}, nil
+	}
+
+	authority, _, err := db.OpenTKA(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := authority.Head().MarshalText()
+	if err != nil {
+		return nil, err
+	}
+
+	return &tailcfg.TKAInfo{Head: string(head)}, nil
+}
+
+// loadTKAInfo gives the state of network lock to the mapper.
+func (h *Headscale) loadTKAInfo() error {
+	info, err := db.Read(h.db.DB, tkaInfo)
+	if err != nil {
+		return fmt.Errorf("loading network lock state: %w", err)
+	}
+
+	h.mapper.SetTKAInfo(info)
+
+	return nil
+}
+
+// tkaChanged sends the new state of network lock to all the nodes, the
+// nodes behind synchronise with headscale.
+func (h *Headscale) tkaChanged(ctx context.Context) {
+	if err := h.loadTKAInfo(); err != nil {
+		log.Error().Err(err).Msg("failed to load network lock state")
+
+		return
+	}
+
+	ctx = types.NotifyCtx(ctx, "tka-changed", "na")
+	h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+		Type: types.StateFullUpdate,
+	})
+}
+
+// TKAInitBeginHandler starts enabling network lock with the genesis AUM
+// of the node, and returns the nodes it must sign.
+// Listens in /machine/tka/init/begin.
+func (ns *noiseServer) TKAInitBeginHandler(writer http.ResponseWriter, req *http.Request) {
+	var initReq tailcfg.TKAInitBeginRequest
+	node, ok := ns.tkaRequest(writer, req, &initReq, func() key.NodePublic { return initReq.NodeKey })
+	if !ok {
+		return
+	}
+
+	state, err := ns.headscale.db.GetTKAState()
+	if err == nil && !state.Disabled {
+		http.Error(writer, errTKAAlreadyEnabled.Error(), http.StatusBadRequest)
+
+		return
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		tkaError(writer, err, "failed to get network lock state")
+
+		return
+	}
+
+	var genesis tka.AUM
+	if err := genesis.Unserialize(initReq.GenesisAUM); err != nil {
+		http.Error(writer, "invalid genesis AUM", http.StatusBadRequest)
+
+		return
+	}
+	if _, err := tka.Bootstrap(&tka.Mem{}, genesis); err != nil {
+		http.Error(writer, fmt.Sprintf("invalid genesis AUM: %s", err), http.StatusBadRequest)
+
+		return
+	}
+
+	nodes, err := ns.headscale.db.ListNodes()
+	if err != nil {
+		tkaError(writer, err, "failed to list nodes")
+
+		return
+	}
+
+	resp := tailcfg.TKAInitBeginResponse{}
+	for _, node := range nodes {
+		resp.NeedSignatures = append(resp.NeedSignatures, tailcfg.TKASignInfo{
+			NodeID:     tailcfg.NodeID(node.ID),
+			NodePublic: node.NodeKey,
+		})
+	}
+
+	ns.headscale.registrationCache.Set(
+		tkaInitKey(ns.machineKey),
+		[]byte(initReq.GenesisAUM),
+		registerCacheExpiration,
+	)
+
+	log.Info().
+		Str("node", node.Hostname).
+		Int("signatures", len(resp.NeedSignatures)).
+		Msg("network lock initialisation started")
+
+	writeTKAResponse(writer, resp)
+}
+
+// TKAInitFinishHandler enables network lock with the genesis AUM of the
+// node once it signed the node keys of all the nodes.
+// Listens in /machine/tka/init/finish.
+func (ns *noiseServer) TKAInitFinishHandler(writer http.ResponseWriter, req *http.Request) {
+	var finishReq tailcfg.TKAInitFinishRequest
+	node, ok := ns.tkaRequest(writer, req, &finishReq, func() key.NodePublic { return finishReq.NodeKey })
+	if !ok {
+		return
+	}
+
+	item, ok := ns.headscale.registrationCache.Get(tkaInitKey(ns.machineKey))
+	if !ok {
+		http.Error(writer, errTKAInitNotStarted.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	var genesis tka.AUM
+	if err := genesis.Unserialize(item.([]byte)); err != nil {
+		tkaError(writer, err, "failed to decode genesis AUM")
+
+		return
+	}
+
+	// The signatures are checked against the authority before it is
+	// stored.
+	pending, err := tka.Bootstrap(&tka.Mem{}, genesis)
+	if err != nil {
+		tkaError(writer, err, "failed to bootstrap network lock")
+
+		return
+	}
+
+	nodes, err := ns.headscale.db.ListNodes()
+	if err != nil {
+		tkaError(writer, err, "failed to list nodes")
+
+		return
+	}
+
+	signatures := make(map[types.NodeID]tkatype.MarshaledSignature, len(nodes))
+	for _, signed := range nodes {
+		signature, ok := finishReq.Signatures[tailcfg.NodeID(signed.ID)]
+		if !ok {
+			http.Error(writer, fmt.Sprintf("missing signature of node %d", signed.ID), http.StatusBadRequest)
+
+			return
+		}
+
+		if err := pending.NodeKeyAuthorized(signed.NodeKey, signature); err != nil {
+			http.Error(writer, fmt.Sprintf("invalid signature of node %d: %s", signed.ID, err), http.StatusBadRequest)
+
+			return
+		}
+
+		signatures[signed.ID] = signature
+	}
+
+	if err := ns.headscale.db.Write(func(tx *gorm.DB) error {
+		_, err := db.EnableTKA(tx, genesis, signatures)
+
+		return err
+	}); err != nil {
+		tkaError(writer, err, "failed to enable network lock")
+
+		return
+	}
+
+	ns.headscale.registrationCache.Delete(tkaInitKey(ns.machineKey))
+
+	log.Info().
+		Str("node", node.Hostname).
+		Msg("network lock enabled")
+
+	ns.headscale.tkaChanged(req.Context())
+
+	writeTKAResponse(writer, tailcfg.TKAInitFinishResponse{})
+}
+
+// TKABootstrapHandler returns the genesis AUM to the nodes enabling
+// network lock, or the disablement secret to the nodes disabling it.
+// Listens in /machine/tka/bootstrap.
+func (ns *noiseServer) TKABootstrapHandler(writer http.ResponseWriter, req *http.Request) {
+	var bootstrapReq tailcfg.TKABootstrapRequest
+	if _, ok := ns.tkaRequest(writer, req, &bootstrapReq, func() key.NodePublic { return bootstrapReq.NodeKey }); !ok {
+		return
+	}
+
+	resp := tailcfg.TKABootstrapResponse{}
+
+	state, err := ns.headscale.db.GetTKAState()
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		tkaError(writer, err, "failed to get network lock state")
+
+		return
+	}
+
+	if state != nil {
+		if state.Disabled {
+			resp.DisablementSecret = state.DisablementSecret
+		} else {
+			resp.GenesisAUM = state.GenesisAUM
+		}
+	}
+
+	writeTKAResponse(writer, resp)
+}
+
+// TKASyncOfferHandler compares the AUMs of the node with the ones of
+// headscale, and returns the ones the node is missing.
+// Listens in /machine/tka/sync/offer.
+func (ns *noiseServer) TKASyncOfferHandler(writer http.ResponseWriter, req *http.Request) {
+	var offerReq tailcfg.TKASyncOfferRequest
+	if _, ok := ns.tkaRequest(writer, req, &offerReq, func() key.NodePublic { return offerReq.NodeKey }); !ok {
+		return
+	}
+
+	remoteOffer, err := toSyncOffer(offerReq.Head, offerReq.Ancestors)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	resp, err := db.Read(ns.headscale.db.DB, func(rx *gorm.DB) (*tailcfg.TKASyncOfferResponse, error) {
+		authority, chonk, err := db.OpenTKA(rx)
+		if err != nil {
+			return nil, err
+		}
+
+		offer, err := authority.SyncOffer(chonk)
+		if err != nil {
+			return nil, err
+		}
+
+		head, ancestors, err := fromSyncOffer(offer)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := tailcfg.TKASyncOfferResponse{
+			Head:      head,
+			Ancestors: ancestors,
+		}
+
+		// The node can be ahead of headscale, it sends the AUMs
+		// headscale is missing next.
+		missing, err := authority.MissingAUMs(chonk, remoteOffer)
+		if err != nil && !errors.Is(err, tka.ErrNoIntersection) {
+			return nil, err
+		}
+		for _, aum := range missing {
+			resp.MissingAUMs = append(resp.MissingAUMs, aum.Serialize())
+		}
+
+		return &resp, nil
+	})
+	if err != nil {
+		tkaError(writer, err, "failed to compute network lock sync offer")
+
+		return
+	}
+
+	writeTKAResponse(writer, resp)
+}
+
+// TKASyncSendHandler stores the AUMs headscale is missing, signed by
+// the node.
+// Listens in /machine/tka/sync/send.
+func (ns *noiseServer) TKASyncSendHandler(writer http.ResponseWriter, req *http.Request) {
+	var sendReq tailcfg.TKASyncSendRequest
+	node, ok := ns.tkaRequest(writer, req, &sendReq, func() key.NodePublic { return sendReq.NodeKey })
+	if !ok {
+		return
+	}
+
+	aums := make([]tka.AUM, len(sendReq.MissingAUMs))
+	for index, data := range sendReq.MissingAUMs {
+		if err := aums[index].Unserialize(data); err != nil {
+			http.Error(writer, fmt.Sprintf("invalid AUM %d", index), http.StatusBadRequest)
+
+			return
+		}
+	}
+
+	var changed bool
+	resp, err := db.Write(ns.headscale.db.DB, func(tx *gorm.DB) (*tailcfg.TKASyncSendResponse, error) {
+		authority, chonk, err := db.OpenTKA(tx)
+		if err != nil {
+			return nil, err
+		}
+
+		previous := authority.Head()
+		if len(aums) > 0 {
+			if err := authority.Inform(chonk, aums); err != nil {
+				return nil, fmt.Errorf("%w: %w", errTKAInvalidAUMs, err)
+			}
+		}
+		changed = authority.Head() != previous
+
+		head, err := authority.Head().MarshalText()
+		if err != nil {
+			return nil, err
+		}
+
+		return &tailcfg.TKASyncSendResponse{Head: string(head)}, nil
+	})
+	if errors.Is(err, errTKAInvalidAUMs) {
+		log.Warn().Err(err).Str("node", node.Hostname).Msg("rejected network lock AUMs")
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	if err != nil {
+		tkaError(writer, err, "failed to apply network lock AUMs")
+
+		return
+	}
+
+	if changed {
+		log.Info().
+			Str("node", node.Hostname).
+			Str("head", resp.Head).
+			Msg("network lock updated")
+
+		ns.headscale.tkaChanged(req.Context())
+	}
+
+	writeTKAResponse(writer, resp)
+}
+
+// TKADisableHandler disables network lock with a disablement secret of
+// the authority.
+// Listens in /machine/tka/disable.
+func (ns *noiseServer) TKADisableHandler(writer http.ResponseWriter, req *http.Request) {
+	var disableReq tailcfg.TKADisableRequest
+	node, ok := ns.tkaRequest(writer, req, &disableReq, func() key.NodePublic { return disableReq.NodeKey })
+	if !ok {
+		return
+	}
+
+	errInvalidSecret := errors.New("invalid disablement secret")
+	err := ns.headscale.db.Write(func(tx *gorm.DB) error {
+		authority, _, err := db.OpenTKA(tx)
+		if err != nil {
+			return err
+		}
+
+		if !authority.ValidDisablement(disableReq.DisablementSecret) {
+			return errInvalidSecret
+		}
+
+		return db.DisableTKA(tx, disableReq.DisablementSecret)
+	})
+	if errors.Is(err, errInvalidSecret) {
+		http.Error(writer, err.Error(), http.StatusForbidden)
+
+		return
+	}
+	if err != nil {
+		tkaError(writer, err, "failed to disable network lock")
+
+		return
+	}
+
+	log.Info().
+		Str("node", node.Hostname).
+		Msg("network lock disabled")
+
+	ns.headscale.tkaChanged(req.Context())
+
+	writeTKAResponse(writer, tailcfg.TKADisableResponse{})
+}
+
+// TKASignHandler stores the signature of a node key, signed by a
+// trusted key of the authority.
+// Listens in /machine/tka/sign.
+func (ns *noiseServer) TKASignHandler(writer http.ResponseWriter, req *http.Request) {
+	var signReq tailcfg.TKASubmitSignatureRequest
+	if _, ok := ns.tkaRequest(writer, req, &signReq, func() key.NodePublic { return signReq.NodeKey }); !ok {
+		return
+	}
+
+	var signature tka.NodeKeySignature
+	if err := signature.Unserialize(signReq.Signature); err != nil {
+		http.Error(writer, "invalid signature", http.StatusBadRequest)
+
+		return
+	}
+
+	var nodeKey key.NodePublic
+	if err := nodeKey.UnmarshalBinary(signature.Pubkey); err != nil {
+		http.Error(writer, "invalid signed node key", http.StatusBadRequest)
+
+		return
+	}
+
+	signed, err := ns.headscale.db.GetNodeByNodeKey(nodeKey)
+	if err != nil {
+		http.Error(writer, "unknown signed node key", http.StatusBadRequest)
+
+		return
+	}
+
+	if err := ns.headscale.setNodeKeySignature(signed.ID, nodeKey, signReq.Signature); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	ctx := types.NotifyCtx(req.Context(), "tka-sign", signed.Hostname)
+	ns.headscale.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+		Type:        types.StatePeerChanged,
+		ChangeNodes: []types.NodeID{signed.ID},
+	})
+
+	writeTKAResponse(writer, tailcfg.TKASubmitSignatureResponse{})
+}
+
+// TKAAffectedSigsHandler returns the signatures of the node keys signed
+// by a key of the authority.
+// Listens in /machine/tka/affected-sigs.
+func (ns *noiseServer) TKAAffectedSigsHandler(writer http.ResponseWriter, req *http.Request) {
+	var sigsReq tailcfg.TKASignaturesUsingKeyRequest
+	if _, ok := ns.tkaRequest(writer, req, &sigsReq, func() key.NodePublic { return sigsReq.NodeKey }); !ok {
+		return
+	}
+
+	nodes, err := ns.headscale.db.ListNodes()
+	if err != nil {
+		tkaError(writer, err, "failed to list nodes")
+
+		return
+	}
+
+	resp := tailcfg.TKASignaturesUsingKeyResponse{}
+	for _, node := range nodes {
+		if len(node.KeySignature) == 0 {
+			continue
+		}
+
+		var signature tka.NodeKeySignature
+		if err := signature.Unserialize(node.KeySignature); err != nil {
+			continue
+		}
+
+		keyID, err := signature.UnverifiedAuthorizingKeyID()
+		if err != nil || string(keyID) != string(sigsReq.KeyID) {
+			continue
+		}
+
+		resp.Signatures = append(resp.Signatures, node.KeySignature)
+	}
+
+	writeTKAResponse(writer, resp)
+}
+
+// setNodeKeySignature stores the signature of the node key of a node,
+// once checked against the authority.
+func (h *Headscale) setNodeKeySignature(
+	nodeID types.NodeID,
+	nodeKey key.NodePublic,
+	signature tkatype.MarshaledSignature,
+) error {
+	return h.db.Write(func(tx *gorm.DB) error {
+		authority, _, err := db.OpenTKA(tx)
+		if err != nil {
+			return err
+		}
+
+		if err := authority.NodeKeyAuthorized(nodeKey, signature); err != nil {
+			return fmt.Errorf("invalid node key signature: %w", err)
+		}
+
+		return db.NodeSetKeySignature(tx, nodeID, signature)
+	})
+}
+
+func toSyncOffer(head string, ancestors []string) (tka.SyncOffer, error) {
+	var offer tka.SyncOffer
+	if err := offer.Head.UnmarshalText([]byte(head)); err != nil {
+		return tka.SyncOffer{}, fmt.Errorf("invalid head: %w", err)
+	}
+
+	offer.Ancestors = make([]tka.AUMHash, len(ancestors))
+	for index, ancestor := range ancestors {
+		if err := offer.Ancestors[index].UnmarshalText([]byte(ancestor)); err != nil {
+			return tka.SyncOffer{}, fmt.Errorf("invalid ancestor %d: %w", index, err)
+		}
+	}
+
+	return offer, nil
+}
+
+func fromSyncOffer(offer tka.SyncOffer) (string, []string, error) {
+	head, err := offer.Head.MarshalText()
+	if err != nil {
+		return "", nil, err
+	}
+
+	ancestors := make([]string, len(offer.Ancestors))
+	for index, ancestor := range offer.Ancestors {
+		hash, err := ancestor.MarshalText()
+		if err != nil {
+			return "", nil, err
+		}
+		ancestors[index] = string(hash)
+	}
+
+	return string(head), ancestors, nil
+}
@@ -0,0 +1,208 @@
+package hscontrol
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var (
+	errGRPCClientCAWithoutTLS = errors.New(
+		"grpc_tls.client_ca_path requires the gRPC listener to have a certificate",
+	)
+	errGRPCNoClientCA          = errors.New("no certificates found in gRPC client CA")
+	errGRPCClientURINotAllowed = errors.New("client certificate has no allowed URI SAN")
+)
+
+func (h *Headscale) getTLSSettings(challenges acmeHTTPChallenges) (*tls.Config, error) {
+	if h.cfg.TLS.LetsEncrypt.Hostname != "" || h.cfg.TLS.CertPath != "" {
+		if !strings.HasPrefix(h.cfg.ServerURL, "https://") {
+			log.Warn().
+				Msg("Listening with TLS but ServerURL does not start with https://")
+		}
+	} else if !strings.HasPrefix(h.cfg.ServerURL, "http://") {
+		log.Warn().Msg("Listening without TLS but ServerURL does not start with http://")
+	}
+
+	return h.certificateTLSConfig(h.cfg.TLS, challenges)
+}
+
+// getGRPCTLSSettings returns the TLS configuration of the remote gRPC
+// listener, which uses the main TLS configuration unless it has a
+// certificate of its own.
+func (h *Headscale) getGRPCTLSSettings(
+	mainTLSConfig *tls.Config,
+	challenges acmeHTTPChallenges,
+) (*tls.Config, error) {
+	cfg := h.cfg.GRPCTLS
+
+	tlsConfig := mainTLSConfig
+	if cfg.HasCertificate() {
+		var err error
+		tlsConfig, err = h.certificateTLSConfig(cfg.TLSConfig, challenges)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.ClientCAPath == "" {
+		return tlsConfig, nil
+	}
+
+	if tlsConfig == nil {
+		return nil, errGRPCClientCAWithoutTLS
+	}
+
+	caPEM, err := os.ReadFile(cfg.ClientCAPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading gRPC client CA: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errGRPCNoClientCA
+	}
+
+	// The main TLS configuration is shared with the HTTP listener,
+	// which must not require client certificates.
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	tlsConfig.ClientCAs = pool
+
+	if len(cfg.ClientURISANs) > 0 {
+		tlsConfig.VerifyConnection = verifyClientURISANs(cfg.ClientURISANs)
+	}
+
+	return tlsConfig, nil
+}
+
+// certificateTLSConfig returns the TLS configuration serving the
+// certificate from the given settings, either from files or requested
+// from Let's Encrypt. It returns nil if no certificate is configured.
+func (h *Headscale) certificateTLSConfig(
+	cfg types.TLSConfig,
+	challenges acmeHTTPChallenges,
+) (*tls.Config, error) {
+	if cfg.LetsEncrypt.Hostname != "" {
+		certManager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.LetsEncrypt.Hostname),
+			Cache:      autocert.DirCache(cfg.LetsEncrypt.CacheDir),
+			Client: &acme.Client{
+				DirectoryURL: h.cfg.ACMEURL,
+			},
+			Email: h.cfg.ACMEEmail,
+		}
+
+		switch cfg.LetsEncrypt.ChallengeType {
+		case types.TLSALPN01ChallengeType:
+			// Configuration via autocert with TLS-ALPN-01 (https://tools.ietf.org/html/rfc8737)
+			// The RFC requires that the validation is done on port 443; in other words, headscale
+			// must be reachable on port 443.
+			return certManager.TLSConfig(), nil
+
+		case types.HTTP01ChallengeType:
+			// Configuration via autocert with HTTP-01. This requires listening on
+			// port 80 for the certificate validation in addition to the headscale
+			// service, which can be configured to run on any other port.
+			challenges[cfg.LetsEncrypt.Hostname] = certManager
+
+			return certManager.TLSConfig(), nil
+
+		default:
+			return nil, errUnsupportedLetsEncryptChallengeType
+		}
+	}
+
+	if cfg.CertPath == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		NextProtos:   []string{"http/1.1"},
+		Certificates: make([]tls.Certificate, 1),
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	var err error
+	tlsConfig.Certificates[0], err = tls.LoadX509KeyPair(cfg.CertPath, cfg.KeyPath)
+
+	return tlsConfig, err
+}
+
+// acmeHTTPChallenges are the certificate managers answering HTTP-01
+// challenges, by the hostname they request a certificate for. The main
+// and the gRPC listener can have different certificates, but there is
+// only one port 80 to validate them on.
+type acmeHTTPChallenges map[string]*autocert.Manager
+
+// handler serves the HTTP-01 challenges with the manager of the host
+// being validated, and passes everything else to fallback.
+func (c acmeHTTPChallenges) handler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host = req.Host
+		}
+
+		if certManager, ok := c[host]; ok {
+			certManager.HTTPHandler(fallback).ServeHTTP(writer, req)
+
+			return
+		}
+
+		fallback.ServeHTTP(writer, req)
+	})
+}
+
+// serveACMEHTTPChallenges starts the server answering the HTTP-01
+// challenges, if any certificate is requested with them.
+func (h *Headscale) serveACMEHTTPChallenges(challenges acmeHTTPChallenges) {
+	if len(challenges) == 0 {
+		return
+	}
+
+	server := &http.Server{
+		Addr:        h.cfg.TLS.LetsEncrypt.Listen,
+		Handler:     challenges.handler(http.HandlerFunc(h.redirect)),
+		ReadTimeout: types.HTTPTimeout,
+	}
+
+	go func() {
+		err := server.ListenAndServe()
+		log.Fatal().
+			Caller().
+			Err(err).
+			Msg("failed to set up a HTTP server")
+	}()
+}
+
+// verifyClientURISANs only accepts client certificates with one of the
+// allowed URI SANs, e.g. the SPIFFE IDs of the admin workloads. The
+// certificate chain has already been verified against the client CA.
+func verifyClientURISANs(allowed []string) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errGRPCClientURINotAllowed
+		}
+
+		for _, uri := range state.PeerCertificates[0].URIs {
+			if slices.Contains(allowed, uri.String()) {
+				return nil
+			}
+		}
+
+		return errGRPCClientURINotAllowed
+	}
+}
@@ -0,0 +1,217 @@
+package hscontrol
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func Test_verifyClientURISANs(t *testing.T) {
+	certWithURIs := func(uris ...string) *x509.Certificate {
+		cert := &x509.Certificate{}
+		for _, uri := range uris {
+			u, err := url.Parse(uri)
+			if err != nil {
+				t.Fatalf("parsing uri: %s", err)
+			}
+			cert.URIs = append(cert.URIs, u)
+		}
+
+		return cert
+	}
+
+	verify := verifyClientURISANs([]string{"spiffe://example.org/headscale/admin"})
+
+	tests := []struct {
+		name    string
+		certs   []*x509.Certificate
+		wantErr bool
+	}{
+		{
+			name:    "no-certificate",
+			wantErr: true,
+		},
+		{
+			name:    "no-uri",
+			certs:   []*x509.Certificate{certWithURIs()},
+			wantErr: true,
+		},
+		{
+			name:    "other-uri",
+			certs:   []*x509.Certificate{certWithURIs("spiffe://example.org/workload")},
+			wantErr: true,
+		},
+		{
+			name: "allowed-uri",
+			certs: []*x509.Certificate{
+				certWithURIs("spiffe://example.org/workload", "spiffe://example.org/headscale/admin"),
+			},
+		},
+		{
+			name: "allowed-uri-on-ca",
+			certs: []*x509.Certificate{
+				certWithURIs(),
+				certWithURIs("spiffe://example.org/headscale/admin"),
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verify(tls.ConnectionState{PeerCertificates: tt.certs})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyClientURISANs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_acmeHTTPChallenges(t *testing.T) {
+	challenges := acmeHTTPChallenges{
+		"grpc.example.com": &autocert.Manager{},
+	}
+
+	fallback := http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer.WriteHeader(http.StatusTeapot)
+	})
+	handler := challenges.handler(fallback)
+
+	tests := []struct {
+		name string
+		host string
+		path string
+		want int
+	}{
+		{
+			name: "challenge-for-other-host",
+			host: "headscale.example.com",
+			path: "/.well-known/acme-challenge/token",
+			want: http.StatusTeapot,
+		},
+		{
+			// The manager has no such token.
+			name: "challenge-for-host",
+			host: "grpc.example.com:80",
+			path: "/.well-known/acme-challenge/token",
+			want: http.StatusNotFound,
+		},
+		{
+			name: "other-path-for-host",
+			host: "grpc.example.com",
+			path: "/",
+			want: http.StatusTeapot,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://"+tt.host+tt.path, nil)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("got status %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getGRPCTLSSettings(t *testing.T) {
+	dir := t.TempDir()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, &x509.Certificate{Subject: pkix.Name{CommonName: "test ca"}}, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("creating certificate: %s", err)
+	}
+
+	caPath := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	if err := os.WriteFile(caPath, caPEM, 0o600); err != nil {
+		t.Fatalf("writing ca: %s", err)
+	}
+
+	mainTLSConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	tests := []struct {
+		name       string
+		cfg        types.GRPCTLSConfig
+		main       *tls.Config
+		wantShared bool
+		wantClient bool
+		wantErr    error
+	}{
+		{
+			name:       "uses-main",
+			main:       mainTLSConfig,
+			wantShared: true,
+		},
+		{
+			name: "no-tls",
+		},
+		{
+			name:       "client-ca",
+			cfg:        types.GRPCTLSConfig{ClientCAPath: caPath},
+			main:       mainTLSConfig,
+			wantClient: true,
+		},
+		{
+			name:    "client-ca-without-tls",
+			cfg:     types.GRPCTLSConfig{ClientCAPath: caPath},
+			wantErr: errGRPCClientCAWithoutTLS,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Headscale{cfg: &types.Config{GRPCTLS: tt.cfg}}
+
+			got, err := h.getGRPCTLSSettings(tt.main, make(acmeHTTPChallenges))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("getGRPCTLSSettings() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if tt.wantShared != (got != nil && got == tt.main) {
+				t.Errorf("getGRPCTLSSettings() shared with main = %v, want %v", got == tt.main, tt.wantShared)
+			}
+
+			if tt.wantClient {
+				if got.ClientAuth != tls.RequireAndVerifyClientCert || got.ClientCAs == nil {
+					t.Errorf("getGRPCTLSSettings() does not require client certificates")
+				}
+
+				if tt.main.ClientAuth != tls.NoClientCert {
+					t.Errorf("getGRPCTLSSettings() changed the main TLS config")
+				}
+			}
+		})
+	}
+}
@@ -1,12 +1,74 @@
 package types
 
 import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+// The resources of the API a scope can give access to.
+const (
+	APIResourceUsers       = "users"
+	APIResourceNodes       = "nodes"
+	APIResourceRoutes      = "routes"
+	APIResourcePreAuthKeys = "preauthkeys"
+	APIResourceAPIKeys     = "keys"
+	APIResourcePolicy      = "policy"
+	APIResourceDNS         = "dns"
+	APIResourceDERP        = "derp"
+	APIResourceEvents      = "events"
+)
+
+// APIScopeRead gives read access to all the resources.
+const APIScopeRead = "read"
+
+var apiResources = []string{
+	APIResourceUsers,
+	APIResourceNodes,
+	APIResourceRoutes,
+	APIResourcePreAuthKeys,
+	APIResourceAPIKeys,
+	APIResourcePolicy,
+	APIResourceDNS,
+	APIResourceDERP,
+	APIResourceEvents,
+}
+
+var ErrInvalidAPIScope = errors.New("invalid API key scope")
+
+// ValidateAPIScopes checks the scopes of an API key. A scope is either
+// "read", for read access to everything, or a resource followed by
+// ":read" or ":write", write including read. The API keys resource only
+// has "keys:read" and "keys:admin", as managing the keys gives access to
+// everything.
+func ValidateAPIScopes(scopes []string) error {
+	for _, scope := range scopes {
+		if scope == APIScopeRead {
+			continue
+		}
+
+		resource, access, _ := strings.Cut(scope, ":")
+		if !slices.Contains(apiResources, resource) {
+			return fmt.Errorf("%w: %q, unknown resource %q", ErrInvalidAPIScope, scope, resource)
+		}
+
+		write := "write"
+		if resource == APIResourceAPIKeys {
+			write = "admin"
+		}
+		if access != "read" && access != write {
+			return fmt.Errorf("%w: %q, expected %s:read or %s:%s", ErrInvalidAPIScope, scope, resource, resource, write)
+		}
+	}
+
+	return nil
+}
+
 // APIKey describes the datamodel for API keys used to remotely authenticate with
 // headscale.
 type APIKey struct {
@@ -14,6 +76,10 @@ type APIKey struct {
 	Prefix string `gorm:"uniqueIndex"`
 	Hash   []byte
 
+	// Scopes limit what the key gives access to, a key without scopes
+	// gives access to everything.
+	Scopes StringList
+
 	CreatedAt  *time.Time
 	Expiration *time.Time
 	LastSeen   *time.Time
@@ -23,6 +89,7 @@ func (key *APIKey) Proto() *v1.ApiKey {
 	protoKey := v1.ApiKey{
 		Id:     key.ID,
 		Prefix: key.Prefix,
+		Scopes: key.Scopes,
 	}
 
 	if key.Expiration != nil {
@@ -39,3 +106,27 @@ func (key *APIKey) Proto() *v1.ApiKey {
 
 	return &protoKey
 }
+
+// Allows reports if the key gives access to the resource, for writing
+// it or only reading it.
+func (key *APIKey) Allows(resource string, write bool) bool {
+	if len(key.Scopes) == 0 {
+		return true
+	}
+
+	for _, scope := range key.Scopes {
+		if scope == APIScopeRead && !write {
+			return true
+		}
+
+		scopeResource, access, _ := strings.Cut(scope, ":")
+		if scopeResource != resource {
+			continue
+		}
+		if access != "read" || !write {
+			return true
+		}
+	}
+
+	return false
+}
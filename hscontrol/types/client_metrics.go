@@ -0,0 +1,113 @@
+package types
+
+import (
+	"bufio"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var ErrInvalidClientMetrics = errors.New("invalid client metrics")
+
+// ClientMetrics are the counters and gauges of a Tailscale client, such
+// as magicsock_send_udp or derp_home_changed, keyed by their name.
+type ClientMetrics map[string]float64
+
+func (m *ClientMetrics) Scan(destination interface{}) error {
+	switch value := destination.(type) {
+	case nil:
+		*m = nil
+
+		return nil
+
+	case []byte:
+		return json.Unmarshal(value, m)
+
+	case string:
+		return json.Unmarshal([]byte(value), m)
+
+	default:
+		return fmt.Errorf("%w: unexpected data type %T", ErrInvalidClientMetrics, destination)
+	}
+}
+
+// Value return json value, implement driver.Valuer interface.
+func (m ClientMetrics) Value() (driver.Value, error) {
+	bytes, err := json.Marshal(m)
+
+	return string(bytes), err
+}
+
+// ParseClientMetrics parses the metrics a client writes in the Prometheus
+// text format, one "name value" line per metric, the comments being
+// skipped.
+func ParseClientMetrics(r io.Reader) (ClientMetrics, error) {
+	metrics := ClientMetrics{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidClientMetrics, line)
+		}
+
+		number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q: %w", ErrInvalidClientMetrics, line, err)
+		}
+
+		metrics[name] = number
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidClientMetrics, err)
+	}
+
+	return metrics, nil
+}
+
+// NodeClientMetrics are the client metrics a node last sent.
+type NodeClientMetrics struct {
+	NodeID NodeID `gorm:"primary_key;autoIncrement:false"`
+
+	Metrics ClientMetrics
+
+	UpdatedAt time.Time
+}
+
+// HealthProto returns the health of the node, from the network report in
+// its Hostinfo and the client metrics it last sent, which can be nil.
+func (node *Node) HealthProto(metrics *NodeClientMetrics) *v1.NodeHealth {
+	health := &v1.NodeHealth{
+		NodeId: node.ID.Uint64(),
+	}
+
+	if node.Hostinfo != nil && node.Hostinfo.NetInfo != nil {
+		netInfo := node.Hostinfo.NetInfo
+		health.PreferredDerp = int32(netInfo.PreferredDERP)
+		health.DerpLatency = netInfo.DERPLatency
+		health.WorkingUdp = netInfo.WorkingUDP.EqualBool(true)
+		health.WorkingIpv6 = netInfo.WorkingIPv6.EqualBool(true)
+		health.MappingVariesByDestIp = netInfo.MappingVariesByDestIP.EqualBool(true)
+	}
+
+	if metrics != nil {
+		health.ClientMetrics = metrics.Metrics
+		health.ClientMetricsUpdatedAt = timestamppb.New(metrics.UpdatedAt)
+	}
+
+	return health
+}
@@ -0,0 +1,123 @@
+package types
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/opt"
+)
+
+func TestParseClientMetrics(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    ClientMetrics
+		wantErr bool
+	}{
+		{
+			name: "counters-and-gauges",
+			input: `# TYPE magicsock_send_udp counter
+magicsock_send_udp 1204
+# TYPE derp_home_changed counter
+derp_home_changed 2
+# TYPE magicsock_disco_recv_pong gauge
+magicsock_disco_recv_pong 0.5
+`,
+			want: ClientMetrics{
+				"magicsock_send_udp":        1204,
+				"derp_home_changed":         2,
+				"magicsock_disco_recv_pong": 0.5,
+			},
+		},
+		{
+			name:  "empty",
+			input: "",
+			want:  ClientMetrics{},
+		},
+		{
+			name:    "missing-value",
+			input:   "magicsock_send_udp\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid-value",
+			input:   "magicsock_send_udp many\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseClientMetrics(strings.NewReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseClientMetrics() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("ParseClientMetrics() unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNodeHealthProto(t *testing.T) {
+	updatedAt := time.Date(2024, 7, 23, 12, 0, 0, 0, time.UTC)
+
+	node := &Node{
+		ID: 1,
+		Hostinfo: &tailcfg.Hostinfo{
+			NetInfo: &tailcfg.NetInfo{
+				PreferredDERP: 2,
+				DERPLatency:   map[string]float64{"2-v4": 0.012},
+				WorkingUDP:    opt.NewBool(true),
+				WorkingIPv6:   opt.NewBool(false),
+			},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		node    *Node
+		metrics *NodeClientMetrics
+		want    *v1.NodeHealth
+	}{
+		{
+			name: "netinfo-and-metrics",
+			node: node,
+			metrics: &NodeClientMetrics{
+				NodeID:    1,
+				Metrics:   ClientMetrics{"magicsock_send_udp": 1204},
+				UpdatedAt: updatedAt,
+			},
+			want: &v1.NodeHealth{
+				NodeId:                 1,
+				PreferredDerp:          2,
+				DerpLatency:            map[string]float64{"2-v4": 0.012},
+				WorkingUdp:             true,
+				ClientMetrics:          map[string]float64{"magicsock_send_udp": 1204},
+				ClientMetricsUpdatedAt: timestamppb.New(updatedAt),
+			},
+		},
+		{
+			name: "no-hostinfo-or-metrics",
+			node: &Node{ID: 2},
+			want: &v1.NodeHealth{NodeId: 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.node.HealthProto(tt.metrics)
+
+			if diff := cmp.Diff(tt.want, got, protocmp.Transform()); diff != "" {
+				t.Errorf("HealthProto() unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
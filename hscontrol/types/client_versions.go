@@ -0,0 +1,224 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/opt"
+)
+
+var ErrInvalidCapabilityVersionRange = errors.New("invalid capability version range")
+
+// CapabilityVersionRange is an inclusive range of client capability
+// versions.
+type CapabilityVersionRange struct {
+	Min tailcfg.CapabilityVersion
+	Max tailcfg.CapabilityVersion
+}
+
+// ParseCapabilityVersionRange parses a range written "min-max", or a
+// single version.
+func ParseCapabilityVersionRange(str string) (CapabilityVersionRange, error) {
+	minStr, maxStr, isRange := strings.Cut(strings.TrimSpace(str), "-")
+	if !isRange {
+		maxStr = minStr
+	}
+
+	minVer, err := strconv.Atoi(strings.TrimSpace(minStr))
+	if err != nil {
+		return CapabilityVersionRange{}, fmt.Errorf("%w: %q", ErrInvalidCapabilityVersionRange, str)
+	}
+
+	maxVer, err := strconv.Atoi(strings.TrimSpace(maxStr))
+	if err != nil {
+		return CapabilityVersionRange{}, fmt.Errorf("%w: %q", ErrInvalidCapabilityVersionRange, str)
+	}
+
+	if minVer < 0 || maxVer < minVer {
+		return CapabilityVersionRange{}, fmt.Errorf(
+			"%w: %q must be positive and start with the oldest version",
+			ErrInvalidCapabilityVersionRange,
+			str,
+		)
+	}
+
+	return CapabilityVersionRange{
+		Min: tailcfg.CapabilityVersion(minVer),
+		Max: tailcfg.CapabilityVersion(maxVer),
+	}, nil
+}
+
+func (r CapabilityVersionRange) Contains(version tailcfg.CapabilityVersion) bool {
+	return r.Min <= version && version <= r.Max
+}
+
+// ClientVersionsConfig restricts the capability versions of the clients
+// allowed to connect, on top of the oldest version headscale supports.
+type ClientVersionsConfig struct {
+	// Min and Max are the oldest and newest versions accepted, zero
+	// is no limit.
+	Min tailcfg.CapabilityVersion
+	Max tailcfg.CapabilityVersion
+
+	// Refuse are the ranges of versions which are refused, Warn the
+	// ranges of versions which are accepted but told to upgrade.
+	Refuse []CapabilityVersionRange
+	Warn   []CapabilityVersionRange
+
+	// UpgradeMessage is shown to the users of the refused and warned
+	// clients, a default message is used if it is empty.
+	UpgradeMessage string
+}
+
+// Refused reports if a client with the capability version is refused.
+func (c ClientVersionsConfig) Refused(version tailcfg.CapabilityVersion) bool {
+	if c.Min > 0 && version < c.Min {
+		return true
+	}
+
+	if c.Max > 0 && version > c.Max {
+		return true
+	}
+
+	return inVersionRanges(c.Refuse, version)
+}
+
+// Warned reports if a client with the capability version is accepted,
+// but warned to upgrade.
+func (c ClientVersionsConfig) Warned(version tailcfg.CapabilityVersion) bool {
+	return !c.Refused(version) && inVersionRanges(c.Warn, version)
+}
+
+// Message returns the message shown to the user of a refused or warned
+// client.
+func (c ClientVersionsConfig) Message(version tailcfg.CapabilityVersion) string {
+	if c.UpgradeMessage != "" {
+		return c.UpgradeMessage
+	}
+
+	if c.Refused(version) {
+		return fmt.Sprintf(
+			"This version of Tailscale (capability version %d) is not allowed to connect to this server, please upgrade Tailscale.",
+			version,
+		)
+	}
+
+	return fmt.Sprintf(
+		"This version of Tailscale (capability version %d) will soon not be allowed to connect to this server, please upgrade Tailscale.",
+		version,
+	)
+}
+
+func inVersionRanges(ranges []CapabilityVersionRange, version tailcfg.CapabilityVersion) bool {
+	for _, r := range ranges {
+		if r.Contains(version) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func getClientVersionsConfig() (ClientVersionsConfig, error) {
+	cfg := ClientVersionsConfig{
+		Min:            tailcfg.CapabilityVersion(viper.GetInt("client_versions.min")),
+		Max:            tailcfg.CapabilityVersion(viper.GetInt("client_versions.max")),
+		UpgradeMessage: viper.GetString("client_versions.upgrade_message"),
+	}
+
+	if cfg.Min < 0 || cfg.Max < 0 {
+		return ClientVersionsConfig{}, errors.New("client_versions.min and client_versions.max must not be negative")
+	}
+
+	if cfg.Max != 0 && cfg.Min > cfg.Max {
+		return ClientVersionsConfig{}, fmt.Errorf(
+			"client_versions.min (%d) must not be larger than client_versions.max (%d)",
+			cfg.Min,
+			cfg.Max,
+		)
+	}
+
+	for _, str := range viper.GetStringSlice("client_versions.refuse") {
+		r, err := ParseCapabilityVersionRange(str)
+		if err != nil {
+			return ClientVersionsConfig{}, fmt.Errorf("client_versions.refuse: %w", err)
+		}
+		cfg.Refuse = append(cfg.Refuse, r)
+	}
+
+	for _, str := range viper.GetStringSlice("client_versions.warn") {
+		r, err := ParseCapabilityVersionRange(str)
+		if err != nil {
+			return ClientVersionsConfig{}, fmt.Errorf("client_versions.warn: %w", err)
+		}
+		cfg.Warn = append(cfg.Warn, r)
+	}
+
+	return cfg, nil
+}
+
+// ClientUpdatesConfig is what the clients are told about their updates.
+type ClientUpdatesConfig struct {
+	// DefaultAutoUpdate is the auto-update setting of the new nodes,
+	// which can change it locally. Empty leaves it to the client.
+	DefaultAutoUpdate opt.Bool
+
+	// LatestVersion is the latest version of the clients, such as
+	// "1.66.4", LatestVersions the latest versions of the clients of
+	// an OS, keyed by the OS in the lowercase Hostinfo, such as
+	// "windows" or "macos". The clients are not told about the latest
+	// version if it is empty.
+	LatestVersion  string
+	LatestVersions map[string]string
+
+	// UrgentSecurityUpdate tells the clients not running the latest
+	// version that they miss an important security update.
+	UrgentSecurityUpdate bool
+
+	// Notify makes the clients not running the latest version show a
+	// notification, with NotifyText, which opens NotifyURL.
+	Notify     bool
+	NotifyURL  string
+	NotifyText string
+}
+
+// Latest returns the latest version of the clients of an OS.
+func (c ClientUpdatesConfig) Latest(os string) string {
+	if latest, ok := c.LatestVersions[strings.ToLower(os)]; ok {
+		return latest
+	}
+
+	return c.LatestVersion
+}
+
+func getClientUpdatesConfig() (ClientUpdatesConfig, error) {
+	cfg := ClientUpdatesConfig{
+		LatestVersion:        viper.GetString("client_updates.latest_version"),
+		LatestVersions:       map[string]string{},
+		UrgentSecurityUpdate: viper.GetBool("client_updates.urgent_security_update"),
+		Notify:               viper.GetBool("client_updates.notify"),
+		NotifyURL:            viper.GetString("client_updates.notify_url"),
+		NotifyText:           viper.GetString("client_updates.notify_text"),
+	}
+
+	switch autoUpdate := viper.GetString("client_updates.default_auto_update"); autoUpdate {
+	case "":
+	case "true", "false":
+		cfg.DefaultAutoUpdate = opt.Bool(autoUpdate)
+	default:
+		return ClientUpdatesConfig{}, fmt.Errorf(
+			"client_updates.default_auto_update is set to %q, allowed options: true, false or empty",
+			autoUpdate,
+		)
+	}
+
+	for os, latest := range viper.GetStringMapString("client_updates.latest_versions") {
+		cfg.LatestVersions[strings.ToLower(os)] = latest
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,79 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"tailscale.com/tailcfg"
+)
+
+func TestParseCapabilityVersionRange(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    CapabilityVersionRange
+		wantErr bool
+	}{
+		{input: "80-87", want: CapabilityVersionRange{Min: 80, Max: 87}},
+		{input: " 80 - 87 ", want: CapabilityVersionRange{Min: 80, Max: 87}},
+		{input: "90", want: CapabilityVersionRange{Min: 90, Max: 90}},
+		{input: "87-80", wantErr: true},
+		{input: "-5", wantErr: true},
+		{input: "a-b", wantErr: true},
+		{input: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseCapabilityVersionRange(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCapabilityVersionRange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("ParseCapabilityVersionRange() unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestClientVersionsConfig(t *testing.T) {
+	cfg := ClientVersionsConfig{
+		Min:    60,
+		Max:    100,
+		Refuse: []CapabilityVersionRange{{Min: 70, Max: 72}},
+		Warn:   []CapabilityVersionRange{{Min: 60, Max: 80}},
+	}
+
+	tests := []struct {
+		version tailcfg.CapabilityVersion
+		refused bool
+		warned  bool
+	}{
+		{version: 59, refused: true},
+		{version: 60, warned: true},
+		{version: 71, refused: true},
+		{version: 80, warned: true},
+		{version: 81},
+		{version: 100},
+		{version: 101, refused: true},
+	}
+
+	for _, tt := range tests {
+		if got := cfg.Refused(tt.version); got != tt.refused {
+			t.Errorf("Refused(%d) = %t, want %t", tt.version, got, tt.refused)
+		}
+
+		if got := cfg.Warned(tt.version); got != tt.warned {
+			t.Errorf("Warned(%d) = %t, want %t", tt.version, got, tt.warned)
+		}
+	}
+
+	if got := (ClientVersionsConfig{}).Refused(1); got {
+		t.Errorf("Refused() with no configuration = %t, want false", got)
+	}
+
+	cfg.UpgradeMessage = "Upgrade to 1.66 or newer"
+	if got := cfg.Message(71); got != cfg.UpgradeMessage {
+		t.Errorf("Message() = %q, want %q", got, cfg.UpgradeMessage)
+	}
+}
@@ -0,0 +1,136 @@
+package types
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ClusterKeyMinLength is the minimum length, in bytes, of a cluster
+// key.
+const ClusterKeyMinLength = 32
+
+var errNoClusterKeys = errors.New("no cluster key found")
+
+// ClusterKeyring holds the keys authenticating the messages the
+// headscale instances send each other, through the database or a NATS
+// or Redis change bus. The first key signs the messages, and all of
+// them verify them, so a key is rotated by adding the new key first on
+// all the instances, then removing the old one once they all sign with
+// the new key.
+type ClusterKeyring struct {
+	mu   sync.RWMutex
+	keys [][]byte
+}
+
+// LoadClusterKeyring reads the keys from the file at path, one hex
+// encoded key per line. Empty lines and lines starting with # are
+// ignored.
+func LoadClusterKeyring(path string) (*ClusterKeyring, error) {
+	keyring := &ClusterKeyring{}
+	if err := keyring.Reload(path); err != nil {
+		return nil, err
+	}
+
+	return keyring, nil
+}
+
+// NewClusterKeyring returns a keyring with the given keys, the first
+// one signing the messages.
+func NewClusterKeyring(keys ...[]byte) *ClusterKeyring {
+	return &ClusterKeyring{keys: keys}
+}
+
+// Reload replaces the keys with the ones of the file at path, the
+// current keys are kept if it cannot be read.
+func (k *ClusterKeyring) Reload(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading cluster keys: %w", err)
+	}
+
+	keys, err := parseClusterKeys(data)
+	if err != nil {
+		return fmt.Errorf("parsing cluster keys %s: %w", path, err)
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+
+	return nil
+}
+
+func parseClusterKeys(data []byte) ([][]byte, error) {
+	var keys [][]byte
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: key is not hex encoded", lineNum)
+		}
+
+		if len(key) < ClusterKeyMinLength {
+			return nil, fmt.Errorf("line %d: key must be at least %d bytes", lineNum, ClusterKeyMinLength)
+		}
+
+		keys = append(keys, key)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, errNoClusterKeys
+	}
+
+	return keys, nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of data with the first key.
+func (k *ClusterKeyring) Sign(data []byte) string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return hex.EncodeToString(clusterMAC(k.keys[0], data))
+}
+
+// Verify reports if mac is the HMAC of data with one of the keys.
+func (k *ClusterKeyring) Verify(data []byte, mac string) bool {
+	sum, err := hex.DecodeString(mac)
+	if err != nil {
+		return false
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range k.keys {
+		if hmac.Equal(sum, clusterMAC(key, data)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func clusterMAC(key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+
+	return mac.Sum(nil)
+}
@@ -0,0 +1,113 @@
+package types
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestClusterKeyring(t *testing.T) {
+	oldKey := strings.Repeat("01", ClusterKeyMinLength)
+	newKey := strings.Repeat("02", ClusterKeyMinLength)
+
+	path := filepath.Join(t.TempDir(), "cluster.keys")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("# cluster keys\n" + oldKey + "\n")
+	keys, err := LoadClusterKeyring(path)
+	if err != nil {
+		t.Fatalf("loading keys: %s", err)
+	}
+
+	data := []byte("update")
+	signedOld := keys.Sign(data)
+	if !keys.Verify(data, signedOld) {
+		t.Error("expected the signature to verify")
+	}
+	if keys.Verify([]byte("other update"), signedOld) {
+		t.Error("expected the signature of other data not to verify")
+	}
+	if keys.Verify(data, "not hex") {
+		t.Error("expected an invalid signature not to verify")
+	}
+
+	// While rotating, the new key signs and both keys verify.
+	write(newKey + "\n\n" + oldKey + "\n")
+	if err := keys.Reload(path); err != nil {
+		t.Fatalf("reloading keys: %s", err)
+	}
+
+	signedNew := keys.Sign(data)
+	if signedNew == signedOld {
+		t.Error("expected the new key to sign")
+	}
+	if !keys.Verify(data, signedOld) || !keys.Verify(data, signedNew) {
+		t.Error("expected the signatures of both keys to verify")
+	}
+
+	// Once the old key is removed, its signatures do not verify.
+	write(newKey + "\n")
+	if err := keys.Reload(path); err != nil {
+		t.Fatalf("reloading keys: %s", err)
+	}
+	if keys.Verify(data, signedOld) {
+		t.Error("expected the signature of the removed key not to verify")
+	}
+
+	// An invalid file keeps the current keys.
+	write("")
+	if err := keys.Reload(path); err == nil {
+		t.Error("expected an error for a file without keys")
+	}
+	if !keys.Verify(data, signedNew) {
+		t.Error("expected the current keys to be kept")
+	}
+}
+
+func TestParseClusterKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    int
+		wantErr bool
+	}{
+		{
+			name:    "keys",
+			content: "# comment\n" + strings.Repeat("ab", 32) + "\n  " + strings.Repeat("cd", 48) + "  \n",
+			want:    2,
+		},
+		{
+			name:    "empty",
+			content: "# no key\n",
+			wantErr: true,
+		},
+		{
+			name:    "not-hex",
+			content: strings.Repeat("zz", 32),
+			wantErr: true,
+		},
+		{
+			name:    "too-short",
+			content: strings.Repeat("ab", 16),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := parseClusterKeys([]byte(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseClusterKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(keys) != tt.want {
+				t.Errorf("parseClusterKeys() got %d keys, want %d", len(keys), tt.want)
+			}
+		})
+	}
+}
@@ -7,8 +7,11 @@ import (
 	"errors"
 	"fmt"
 	"net/netip"
+	"slices"
+	"strings"
 	"time"
 
+	"go.opentelemetry.io/otel/trace"
 	"tailscale.com/tailcfg"
 	"tailscale.com/util/ctxkey"
 )
@@ -71,6 +74,11 @@ type StringList []string
 
 func (i *StringList) Scan(destination interface{}) error {
 	switch value := destination.(type) {
+	case nil:
+		*i = nil
+
+		return nil
+
 	case []byte:
 		return json.Unmarshal(value, i)
 
@@ -89,6 +97,35 @@ func (i StringList) Value() (driver.Value, error) {
 	return string(bytes), err
 }
 
+// PostureAttributes are the custom posture attributes of a node, keyed
+// by their name, including the "custom:" prefix.
+type PostureAttributes map[string]string
+
+func (p *PostureAttributes) Scan(destination interface{}) error {
+	switch value := destination.(type) {
+	case nil:
+		*p = nil
+
+		return nil
+
+	case []byte:
+		return json.Unmarshal(value, p)
+
+	case string:
+		return json.Unmarshal([]byte(value), p)
+
+	default:
+		return fmt.Errorf("%w: unexpected data type %T", ErrNodeAddressesInvalid, destination)
+	}
+}
+
+// Value return json value, implement driver.Valuer interface.
+func (p PostureAttributes) Value() (driver.Value, error) {
+	bytes, err := json.Marshal(p)
+
+	return string(bytes), err
+}
+
 type StateUpdateType int
 
 func (su StateUpdateType) String() string {
@@ -105,6 +142,10 @@ func (su StateUpdateType) String() string {
 		return "StateSelfUpdate"
 	case StateDERPUpdated:
 		return "StateDERPUpdated"
+	case StateGoingAway:
+		return "StateGoingAway"
+	case StatePingRequest:
+		return "StatePingRequest"
 	}
 
 	return "unknown state update type"
@@ -126,6 +167,13 @@ const (
 	// which should have a length of one.
 	StateSelfUpdate
 	StateDERPUpdated
+	// StateGoingAway is sent to the connected nodes when headscale
+	// shuts down, the map sessions end their stream so the nodes
+	// reconnect as soon as headscale is back.
+	StateGoingAway
+	// StatePingRequest asks the node to answer the PingRequest, such
+	// as a c2n request for its client metrics.
+	StatePingRequest
 )
 
 // StateUpdate is an internal message containing information about
@@ -153,9 +201,23 @@ type StateUpdate struct {
 	// contain the new DERP Map.
 	DERPMap *tailcfg.DERPMap
 
+	// PingRequest must be set when Type is StatePingRequest.
+	PingRequest *tailcfg.PingRequest
+
 	// Additional message for tracking origin or what being
 	// updated, useful for ambiguous updates like StatePeerChanged.
 	Message string
+
+	// Interactive marks updates caused by an action where someone
+	// is waiting for the result, like an admin approving a route.
+	// Interactive updates skip the batching delay and are sent to
+	// the nodes immediately.
+	Interactive bool
+
+	// SpanContext is the span the update was sent in, the spans of
+	// the map responses generated for it are part of its trace. It is
+	// not shared with the other instances.
+	SpanContext trace.SpanContext `json:"-"`
 }
 
 // Empty reports if there are any updates in the StateUpdate.
@@ -195,3 +257,22 @@ func NotifyCtx(ctx context.Context, origin, hostname string) context.Context {
 	ctx2 = NotifyHostnameKey.WithValue(ctx2, hostname)
 	return ctx2
 }
+
+// nodesApply reports if a node of the user with the tags is one of the
+// nodes, given as user names, tags, or "*" for all the nodes.
+func nodesApply(nodes []string, user string, tags []string) bool {
+	for _, target := range nodes {
+		switch {
+		case target == "*":
+			return true
+		case strings.HasPrefix(target, "tag:"):
+			if slices.Contains(tags, target) {
+				return true
+			}
+		case target == user:
+			return true
+		}
+	}
+
+	return false
+}
@@ -4,9 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"io/fs"
+	"net"
 	"net/netip"
 	"net/url"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
@@ -38,6 +40,28 @@ const (
 	IPAllocationStrategyRandom     IPAllocationStrategy = "random"
 )
 
+// PolicyMode is where the ACL policy is loaded from.
+type PolicyMode string
+
+const (
+	// PolicyModeFile loads the policy from acl_policy_path.
+	PolicyModeFile PolicyMode = "file"
+	// PolicyModeDB stores the policy in the database, it is set and
+	// rolled back through the API.
+	PolicyModeDB PolicyMode = "database"
+)
+
+// PeerVisibility is which peers are sent to a node in its netmap.
+type PeerVisibility string
+
+const (
+	// PeerVisibilityStrict only sends the peers the node can reach, or
+	// which can reach it, under the policy.
+	PeerVisibilityStrict PeerVisibility = "strict"
+	// PeerVisibilityPermissive sends all the peers, whatever the policy.
+	PeerVisibilityPermissive PeerVisibility = "permissive"
+)
+
 // Config contains the initial Headscale configuration.
 type Config struct {
 	ServerURL                      string
@@ -49,28 +73,47 @@ type Config struct {
 	PrefixV4                       *netip.Prefix
 	PrefixV6                       *netip.Prefix
 	IPAllocation                   IPAllocationStrategy
+	IPPools                        []IPPool
 	NoisePrivateKeyPath            string
 	BaseDomain                     string
 	Log                            LogConfig
 	DisableUpdateCheck             bool
 
+	// WatchConfig reloads the configuration when its file changes, as
+	// on SIGHUP.
+	WatchConfig bool
+
+	// DebugAddr is the local listener of the pprof, expvar and batcher
+	// debug endpoints, see DebugListenAddr. Empty disables it.
+	DebugAddr string
+
 	Database DatabaseConfig
 
 	DERP DERPConfig
 
 	TLS TLSConfig
 
+	// GRPCTLS is the TLS configuration of the remote gRPC listener,
+	// if no certificate is set it uses the one from TLS.
+	GRPCTLS GRPCTLSConfig
+
 	ACMEURL   string
 	ACMEEmail string
 
 	DNSConfig             *tailcfg.DNSConfig
 	DNSUserNameInMagicDNS bool
 
+	// DNSScopedNameservers are the nameservers of the configuration
+	// sent only to some of the nodes.
+	DNSScopedNameservers []ScopedNameservers
+
 	UnixSocket           string
 	UnixSocketPermission fs.FileMode
 
 	OIDC OIDCConfig
 
+	SCIM SCIMConfig
+
 	LogTail             LogTailConfig
 	RandomizeClientPort bool
 
@@ -78,7 +121,43 @@ type Config struct {
 
 	ACL ACLConfig
 
+	NodeLimits NodeLimitsConfig
+
+	NodeExpiry NodeExpiryConfig
+
+	ClientVersions ClientVersionsConfig
+
+	ClientUpdates ClientUpdatesConfig
+
+	ClientMetrics ClientMetricsConfig
+
+	RouteFailover RouteFailoverConfig
+
+	// NodeApproval makes the new nodes registered with a pre auth key
+	// or OIDC wait for an administrator to approve them.
+	NodeApproval bool
+
+	// TailnetLock lets the nodes enable network lock, the tailnet key
+	// authority is kept by the nodes, headscale stores and distributes it.
+	TailnetLock bool
+
+	Taildrop TaildropConfig
+
+	SSHRecording SSHRecordingConfig
+
 	Tuning Tuning
+
+	Webhooks []WebhookConfig
+
+	HA HAConfig
+
+	ChangeBus ChangeBusConfig
+
+	Tracing TracingConfig
+
+	// Tailnets are the tailnets of the multi-tailnet mode, which is
+	// disabled if there are none.
+	Tailnets []TailnetConfig
 }
 
 type SqliteConfig struct {
@@ -96,6 +175,14 @@ type PostgresConfig struct {
 	MaxOpenConnections  int
 	MaxIdleConnections  int
 	ConnMaxIdleTimeSecs int
+
+	// ReadDSN is the connection string of a read replica, used for the
+	// heavy reads, like listing the nodes.
+	ReadDSN string
+
+	// StatementTimeout aborts the statements running longer, zero
+	// disables it.
+	StatementTimeout time.Duration
 }
 
 type DatabaseConfig struct {
@@ -103,6 +190,11 @@ type DatabaseConfig struct {
 	Type  string
 	Debug bool
 
+	// NodeStatusWriteInterval is how often the status updates of the
+	// nodes, like their endpoints, are written together. Zero writes
+	// every update right away.
+	NodeStatusWriteInterval time.Duration
+
 	Sqlite   SqliteConfig
 	Postgres PostgresConfig
 }
@@ -114,6 +206,25 @@ type TLSConfig struct {
 	LetsEncrypt LetsEncryptConfig
 }
 
+// GRPCTLSConfig is the TLS configuration of the remote gRPC listener.
+type GRPCTLSConfig struct {
+	TLSConfig
+
+	// ClientCAPath is the CA clients must present a certificate
+	// signed by, no client certificate is required if it is empty.
+	ClientCAPath string
+
+	// ClientURISANs limits the client certificates accepted to the
+	// ones with one of the URI SANs, e.g. a SPIFFE ID.
+	ClientURISANs []string
+}
+
+// HasCertificate reports if the gRPC listener has a certificate of
+// its own.
+func (c GRPCTLSConfig) HasCertificate() bool {
+	return c.CertPath != "" || c.LetsEncrypt.Hostname != ""
+}
+
 type LetsEncryptConfig struct {
 	Listen        string
 	Hostname      string
@@ -131,9 +242,14 @@ type OIDCConfig struct {
 	AllowedDomains             []string
 	AllowedUsers               []string
 	AllowedGroups              []string
+	MapGroups                  bool
+	GroupsClaim                string
+	GroupsPrefix               string
+	TailnetClaim               string
 	StripEmaildomain           bool
 	Expiry                     time.Duration
 	UseExpiryFromToken         bool
+	RevalidateInterval         time.Duration
 }
 
 type DERPConfig struct {
@@ -150,32 +266,265 @@ type DERPConfig struct {
 	UpdateFrequency                    time.Duration
 	IPv4                               string
 	IPv6                               string
+
+	// ServerVerifyClients only lets the nodes known to headscale
+	// connect to the embedded DERP server.
+	ServerVerifyClients bool
+
+	// ServerMeshKeyPath is the file holding the key shared by the DERP
+	// servers of the region, which forward packets to each other for
+	// the clients connected to a different server. ServerMeshWith are
+	// the hostnames of the other servers.
+	ServerMeshKeyPath string
+	ServerMeshWith    []string
+
+	// Regions failing ProbeFailureThreshold probes in a row are left
+	// out of the DERP map sent to the clients, until a probe succeeds.
+	// Probing is disabled if ProbeInterval is zero.
+	ProbeInterval         time.Duration
+	ProbeTimeout          time.Duration
+	ProbeFailureThreshold int
 }
 
 type LogTailConfig struct {
 	Enabled bool
 }
 
+// TaildropConfig configures sending files between nodes with Taildrop.
+// The nodes of a user can always send files to each other when it is
+// enabled, grants with the tailscale.com/cap/file-sharing app
+// capability allow it between different users.
+type TaildropConfig struct {
+	Enabled bool
+}
+
 type CLIConfig struct {
 	Address  string
 	APIKey   string
 	Timeout  time.Duration
 	Insecure bool
+
+	// CertPath and KeyPath are the client certificate presented to
+	// a remote headscale which requires one.
+	CertPath string
+	KeyPath  string
 }
 
 type ACLConfig struct {
+	Mode       PolicyMode
 	PolicyPath string
+
+	// HostsRefreshInterval is how often the external IP sets
+	// referenced in the hosts section of the policy are reloaded.
+	HostsRefreshInterval time.Duration
+
+	// HostsDir is the directory the files referenced as external IP
+	// sets in the hosts section of the policy are read from.
+	HostsDir string
+
+	// PeerVisibility is which peers are sent to the nodes.
+	PeerVisibility PeerVisibility
+}
+
+// NodeLimitsConfig bounds the total number of nodes in the tailnet,
+// a limit of zero means unlimited.
+type NodeLimitsConfig struct {
+	// Soft is the node count above which a warning is logged for
+	// every new registration.
+	Soft int
+	// Hard is the node count at which new registrations are refused.
+	Hard int
+}
+
+// NodeExpiryConfig configures the expiry of the node keys.
+type NodeExpiryConfig struct {
+	// Default is the key expiry of the nodes registered with a pre auth
+	// key or interactively, when the client does not ask for one. Zero
+	// means the keys do not expire.
+	Default time.Duration
+	// Warning is how long before their key expires the nodes are warned
+	// that they need to re-authenticate, zero disables the warning.
+	Warning time.Duration
+}
+
+// ClientMetricsConfig configures the collection of the client metrics
+// of the nodes.
+type ClientMetricsConfig struct {
+	// Interval is how often the connected nodes are asked for their
+	// client metrics, zero disables the collection.
+	Interval time.Duration
+}
+
+// RouteFailoverConfig dampens the failover of the primary routes when
+// subnet routers flap.
+type RouteFailoverConfig struct {
+	// HoldDown is how long the routes of a node which went offline
+	// are held down, doubled every time it goes offline again, up to
+	// MaxHoldDown. Zero disables the dampening.
+	HoldDown    time.Duration
+	MaxHoldDown time.Duration
+}
+
+// SCIMConfig configures the SCIM server provisioning the users and
+// groups from an identity provider.
+type SCIMConfig struct {
+	Enabled bool
+}
+
+// HAConfig configures running several headscale instances sharing the
+// same PostgreSQL database.
+type HAConfig struct {
+	Enabled bool
+	// InstanceID identifies the instance, the hostname by default.
+	InstanceID string
+	// HeartbeatInterval is how often the instance records that it is
+	// alive and renews its leadership.
+	HeartbeatInterval time.Duration
+	// InstanceTimeout is how long an instance can miss its heartbeats
+	// before its nodes are considered offline, and before another
+	// instance takes over as the leader.
+	InstanceTimeout time.Duration
+	// SyncInterval is how often the instance shares its connected nodes
+	// and reads the changes of the other instances.
+	SyncInterval time.Duration
+	// ClusterKeyPath is the file with the keys authenticating the
+	// changes exchanged by the instances, see ClusterKeyring.
+	ClusterKeyPath string
+}
+
+const (
+	ChangeBusLocal = "local"
+	ChangeBusNATS  = "nats"
+	ChangeBusRedis = "redis"
+)
+
+// ChangeBusConfig configures the bus the changes sent to the nodes are
+// published on. The NATS and Redis buses share them with the other
+// instances and external components, they are only available when
+// headscale is built with the nats or redis build tag.
+type ChangeBusConfig struct {
+	// Type is local, nats or redis.
+	Type string
+	// InstanceID tells apart the changes published by this instance
+	// from the ones received from the others, it is ha.instance_id.
+	InstanceID string
+	// ClusterKeyPath is ha.cluster_key_path, the NATS and Redis buses
+	// authenticate the changes with its keys.
+	ClusterKeyPath string
+
+	NATS  NATSBusConfig
+	Redis RedisBusConfig
+}
+
+// Shared reports if the changes are published outside of the process,
+// on NATS or Redis.
+func (c ChangeBusConfig) Shared() bool {
+	return c.Type == ChangeBusNATS || c.Type == ChangeBusRedis
+}
+
+// NATSBusConfig configures publishing the changes on a NATS subject.
+type NATSBusConfig struct {
+	URL     string
+	Subject string
+	TLS     BusTLSConfig
+	// CredsPath is the credentials file, with the JWT and the NKey
+	// seed, of the NATS user.
+	CredsPath string
+	// NKeySeedPath is the file with the NKey seed of the NATS user,
+	// when it is authenticated without a JWT.
+	NKeySeedPath string
+}
+
+// RedisBusConfig configures publishing the changes on a Redis stream.
+type RedisBusConfig struct {
+	Addr     string
+	Username string
+	Password string
+	DB       int
+	Stream   string
+	// MaxLen is the approximate number of changes kept in the stream.
+	MaxLen int64
+	TLS    BusTLSConfig
+}
+
+// BusTLSConfig configures the TLS connection to NATS or Redis.
+type BusTLSConfig struct {
+	Enabled bool
+	// CAPath is the CA verifying the server certificate, the system
+	// CAs are used when it is empty.
+	CAPath string
+	// CertPath and KeyPath are the client certificate, when the server
+	// requires one.
+	CertPath string
+	KeyPath  string
+}
+
+// TracingConfig configures exporting OpenTelemetry traces of the map
+// requests and of the distribution of the changes to the nodes.
+type TracingConfig struct {
+	Enabled bool
+	// Endpoint is the host:port of the OTLP gRPC collector.
+	Endpoint string
+	Insecure bool
+	// SampleRatio is the fraction of the traces started by headscale
+	// which are recorded, between 0 and 1.
+	SampleRatio float64
+}
+
+// SSHRecordingConfig configures the nodes trusted to record SSH sessions.
+type SSHRecordingConfig struct {
+	// RecorderTags are the tags of the nodes which can be used as
+	// recorders by the SSH rules of the policy. Recorders in the policy
+	// without one of these tags are ignored.
+	RecorderTags []string
+	// RecorderPort is the port the recorders accept recordings on.
+	RecorderPort uint16
 }
 
 type LogConfig struct {
 	Format string
 	Level  zerolog.Level
+
+	// Subsystems are the levels of the subsystems overriding Level.
+	Subsystems map[util.LogSubsystem]zerolog.Level
+
+	// SamplingBurst is the number of trace, debug and info events a
+	// subsystem logs per SamplingPeriod, 0 logs them all.
+	SamplingBurst  uint32
+	SamplingPeriod time.Duration
+}
+
+// WebhookConfig is an HTTP endpoint receiving events about the nodes.
+type WebhookConfig struct {
+	URL string `mapstructure:"url"`
+	// Secret signs the events, see webhook.SignatureHeader.
+	Secret string `mapstructure:"secret"`
+	// Events the webhook is subscribed to, all events if empty.
+	Events []string `mapstructure:"events"`
 }
 
 type Tuning struct {
 	NotifierSendTimeout            time.Duration
 	BatchChangeDelay               time.Duration
 	NodeMapSessionBufferedChanSize int
+	NotifierChangeLogSize          int
+	// NotifierChangeLogPath is the file the change log is saved to
+	// when headscale shuts down, and loaded from when it starts.
+	NotifierChangeLogPath string
+
+	// KeepAliveInterval is the base interval of the keep alives sent
+	// on a map session, a random jitter of up to 9s is added to it.
+	KeepAliveInterval time.Duration
+	// MapSessionCloseTimeout is how long closing a map session waits
+	// for the session to pick up the close before giving up.
+	MapSessionCloseTimeout time.Duration
+	// DrainTimeout is how long shutting down waits for the connected
+	// nodes to receive the pending changes and disconnect.
+	DrainTimeout time.Duration
+	// NodeMinInterval is the minimum time between two batched changes
+	// of the same node sent to its peers, the changes in between are
+	// merged and sent once it has passed. Zero sends them every batch.
+	NodeMinInterval time.Duration
 }
 
 func LoadConfig(path string, isFile bool) error {
@@ -202,6 +551,8 @@ func LoadConfig(path string, isFile bool) error {
 
 	viper.SetDefault("log.level", "info")
 	viper.SetDefault("log.format", TextLogFormat)
+	viper.SetDefault("log.sampling.burst", 0)
+	viper.SetDefault("log.sampling.period", time.Second)
 
 	viper.SetDefault("dns_config", nil)
 	viper.SetDefault("dns_config.override_local_dns", true)
@@ -210,6 +561,11 @@ func LoadConfig(path string, isFile bool) error {
 	viper.SetDefault("derp.server.enabled", false)
 	viper.SetDefault("derp.server.stun.enabled", true)
 	viper.SetDefault("derp.server.automatically_add_embedded_derp_region", true)
+	viper.SetDefault("derp.server.verify_clients", false)
+	viper.SetDefault("derp.probe.enabled", false)
+	viper.SetDefault("derp.probe.interval", "1m")
+	viper.SetDefault("derp.probe.timeout", "5s")
+	viper.SetDefault("derp.probe.failure_threshold", 3)
 
 	viper.SetDefault("unix_socket", "/var/run/headscale/headscale.sock")
 	viper.SetDefault("unix_socket_permission", "0o770")
@@ -220,10 +576,12 @@ func LoadConfig(path string, isFile bool) error {
 	viper.SetDefault("cli.timeout", "5s")
 	viper.SetDefault("cli.insecure", false)
 
+	viper.SetDefault("database.node_status_write_interval", "500ms")
 	viper.SetDefault("database.postgres.ssl", false)
 	viper.SetDefault("database.postgres.max_open_conns", 10)
 	viper.SetDefault("database.postgres.max_idle_conns", 10)
 	viper.SetDefault("database.postgres.conn_max_idle_time_secs", 3600)
+	viper.SetDefault("database.postgres.statement_timeout", 0)
 
 	viper.SetDefault("database.sqlite.write_ahead_log", true)
 
@@ -232,15 +590,55 @@ func LoadConfig(path string, isFile bool) error {
 	viper.SetDefault("oidc.only_start_if_oidc_is_available", true)
 	viper.SetDefault("oidc.expiry", "180d")
 	viper.SetDefault("oidc.use_expiry_from_token", false)
+	viper.SetDefault("oidc.groups_claim", "groups")
 
 	viper.SetDefault("logtail.enabled", false)
 	viper.SetDefault("randomize_client_port", false)
+	viper.SetDefault("taildrop.enabled", true)
 
 	viper.SetDefault("ephemeral_node_inactivity_timeout", "120s")
 
+	viper.SetDefault("acl_policy_mode", string(PolicyModeFile))
+	viper.SetDefault("acl_hosts_refresh_interval", "1h")
+	viper.SetDefault("acl_peer_visibility", string(PeerVisibilityStrict))
+
+	viper.SetDefault("node_limits.soft", 0)
+	viper.SetDefault("node_limits.hard", 0)
+
+	viper.SetDefault("node_expiry.default", "0")
+	viper.SetDefault("node_expiry.warning", "7d")
+
+	viper.SetDefault("client_metrics.interval", "0s")
+
+	viper.SetDefault("route_failover.hold_down", "0s")
+	viper.SetDefault("route_failover.max_hold_down", "10m")
+
+	viper.SetDefault("ssh_recording.recorder_port", 80)
+
+	viper.SetDefault("ha.enabled", false)
+	viper.SetDefault("ha.heartbeat_interval", "5s")
+	viper.SetDefault("ha.instance_timeout", "30s")
+	viper.SetDefault("ha.sync_interval", "1s")
+
+	viper.SetDefault("change_bus.type", ChangeBusLocal)
+	viper.SetDefault("change_bus.nats.subject", "headscale.changes")
+	viper.SetDefault("change_bus.redis.stream", "headscale:changes")
+	viper.SetDefault("change_bus.redis.max_len", 10000)
+
+	viper.SetDefault("tracing.enabled", false)
+	viper.SetDefault("tracing.endpoint", "localhost:4317")
+	viper.SetDefault("tracing.insecure", false)
+	viper.SetDefault("tracing.sample_ratio", 1.0)
+
 	viper.SetDefault("tuning.notifier_send_timeout", "800ms")
 	viper.SetDefault("tuning.batch_change_delay", "800ms")
 	viper.SetDefault("tuning.node_mapsession_buffered_chan_size", 30)
+	viper.SetDefault("tuning.notifier_change_log_size", 500)
+
+	viper.SetDefault("batcher.keepalive_interval", "50s")
+	viper.SetDefault("batcher.close_timeout", "30s")
+	viper.SetDefault("batcher.drain_timeout", "10s")
+	viper.SetDefault("batcher.node_min_interval", "0s")
 
 	viper.SetDefault("prefixes.allocation", string(IPAllocationStrategySequential))
 
@@ -273,6 +671,16 @@ func LoadConfig(path string, isFile bool) error {
 			Msg("Warning: when using tls_letsencrypt_hostname with TLS-ALPN-01 as challenge type, headscale must be reachable on port 443, i.e. listen_addr should probably end in :443")
 	}
 
+	if (viper.GetString("grpc_tls.letsencrypt_hostname") != "") &&
+		((viper.GetString("grpc_tls.cert_path") != "") || (viper.GetString("grpc_tls.key_path") != "")) {
+		errorText += "Fatal config error: set either grpc_tls.letsencrypt_hostname or grpc_tls.cert_path/grpc_tls.key_path, not both\n"
+	}
+
+	if len(viper.GetStringSlice("grpc_tls.client_uri_sans")) > 0 &&
+		viper.GetString("grpc_tls.client_ca_path") == "" {
+		errorText += "Fatal config error: grpc_tls.client_uri_sans requires grpc_tls.client_ca_path to be set\n"
+	}
+
 	if (viper.GetString("tls_letsencrypt_challenge_type") != HTTP01ChallengeType) &&
 		(viper.GetString("tls_letsencrypt_challenge_type") != TLSALPN01ChallengeType) {
 		errorText += "Fatal config error: the only supported values for tls_letsencrypt_challenge_type are HTTP-01 and TLS-ALPN-01\n"
@@ -281,6 +689,113 @@ func LoadConfig(path string, isFile bool) error {
 	if !strings.HasPrefix(viper.GetString("server_url"), "http://") &&
 		!strings.HasPrefix(viper.GetString("server_url"), "https://") {
 		errorText += "Fatal config error: server_url must start with https:// or http://\n"
+	} else if err := validateServerURL(viper.GetString("server_url")); err != nil {
+		errorText += fmt.Sprintf("Fatal config error: %s\n", err)
+	}
+
+	if err := validateNodeLimits(
+		viper.GetInt("node_limits.soft"),
+		viper.GetInt("node_limits.hard"),
+	); err != nil {
+		errorText += fmt.Sprintf("Fatal config error: %s\n", err)
+	}
+
+	if _, err := getClientVersionsConfig(); err != nil {
+		errorText += fmt.Sprintf("Fatal config error: %s\n", err)
+	}
+
+	if _, err := getClientUpdatesConfig(); err != nil {
+		errorText += fmt.Sprintf("Fatal config error: %s\n", err)
+	}
+
+	if viper.GetDuration("client_metrics.interval") < 0 {
+		errorText += "Fatal config error: client_metrics.interval must not be negative\n"
+	}
+
+	if err := validateRouteFailover(
+		viper.GetDuration("route_failover.hold_down"),
+		viper.GetDuration("route_failover.max_hold_down"),
+	); err != nil {
+		errorText += fmt.Sprintf("Fatal config error: %s\n", err)
+	}
+
+	for _, key := range []string{"node_expiry.default", "node_expiry.warning"} {
+		if _, err := model.ParseDuration(viper.GetString(key)); err != nil {
+			errorText += fmt.Sprintf("Fatal config error: %s must be a duration such as 90d: %s\n", key, err)
+		}
+	}
+
+	if err := validateBatcher(
+		viper.GetDuration(batcherKey("batch_interval", "tuning.batch_change_delay")),
+		viper.GetDuration(batcherKey("send_timeout", "tuning.notifier_send_timeout")),
+		viper.GetInt(batcherKey("node_queue_size", "tuning.node_mapsession_buffered_chan_size")),
+		viper.GetInt(batcherKey("change_log_size", "tuning.notifier_change_log_size")),
+		viper.GetDuration("batcher.keepalive_interval"),
+		viper.GetDuration("batcher.close_timeout"),
+		viper.GetDuration("batcher.drain_timeout"),
+		viper.GetDuration("batcher.node_min_interval"),
+	); err != nil {
+		errorText += fmt.Sprintf("Fatal config error: %s\n", err)
+	}
+
+	if err := validateHA(
+		viper.GetBool("ha.enabled"),
+		viper.GetString("database.type"),
+		viper.GetDuration("ha.heartbeat_interval"),
+		viper.GetDuration("ha.instance_timeout"),
+		viper.GetDuration("ha.sync_interval"),
+		viper.GetString("ha.cluster_key_path"),
+	); err != nil {
+		errorText += fmt.Sprintf("Fatal config error: %s\n", err)
+	}
+
+	if err := validateChangeBus(getChangeBusConfig()); err != nil {
+		errorText += fmt.Sprintf("Fatal config error: %s\n", err)
+	}
+
+	if err := validateDebugListenAddr(viper.GetString("debug_listen_addr")); err != nil {
+		errorText += fmt.Sprintf("Fatal config error: %s\n", err)
+	}
+
+	if ratio := viper.GetFloat64("tracing.sample_ratio"); ratio < 0 || ratio > 1 {
+		errorText += "Fatal config error: tracing.sample_ratio must be between 0 and 1\n"
+	}
+
+	switch mode := viper.GetString("acl_policy_mode"); mode {
+	case string(PolicyModeFile):
+	case string(PolicyModeDB):
+		if viper.GetString("acl_policy_path") != "" {
+			log.Warn().
+				Msg("acl_policy_path is ignored when acl_policy_mode is database")
+		}
+	default:
+		errorText += fmt.Sprintf(
+			"Fatal config error: acl_policy_mode is set to %s, allowed options: %s, %s\n",
+			mode,
+			PolicyModeFile,
+			PolicyModeDB,
+		)
+	}
+
+	switch visibility := viper.GetString("acl_peer_visibility"); visibility {
+	case string(PeerVisibilityStrict), string(PeerVisibilityPermissive):
+	default:
+		errorText += fmt.Sprintf(
+			"Fatal config error: acl_peer_visibility is set to %s, allowed options: %s, %s\n",
+			visibility,
+			PeerVisibilityStrict,
+			PeerVisibilityPermissive,
+		)
+	}
+
+	if viper.GetBool("derp.probe.enabled") {
+		if err := validateDERPProbe(
+			viper.GetDuration("derp.probe.interval"),
+			viper.GetDuration("derp.probe.timeout"),
+			viper.GetInt("derp.probe.failure_threshold"),
+		); err != nil {
+			errorText += fmt.Sprintf("Fatal config error: %s\n", err)
+		}
 	}
 
 	// Minimum inactivity time out is keepalive timeout (60s) plus a few seconds
@@ -302,6 +817,329 @@ func LoadConfig(path string, isFile bool) error {
 	}
 }
 
+// validateDERPProbe checks the settings of the DERP region probes, a
+// probe must time out before the next one starts.
+func validateDERPProbe(interval, timeout time.Duration, failureThreshold int) error {
+	if interval <= 0 {
+		return fmt.Errorf("derp.probe.interval must be positive, got %s", interval)
+	}
+
+	if timeout <= 0 || timeout >= interval {
+		return fmt.Errorf(
+			"derp.probe.timeout must be positive and shorter than derp.probe.interval (%s), got %s",
+			interval,
+			timeout,
+		)
+	}
+
+	if failureThreshold < 1 {
+		return fmt.Errorf("derp.probe.failure_threshold must be at least 1, got %d", failureThreshold)
+	}
+
+	return nil
+}
+
+// batcherKey returns the key of a setting in the batcher section, or
+// the key it had in the tuning section if it is only set there.
+func batcherKey(key, tuningKey string) string {
+	if viper.IsSet("batcher." + key) {
+		return "batcher." + key
+	}
+
+	return tuningKey
+}
+
+func validateBatcher(
+	batchInterval, sendTimeout time.Duration,
+	nodeQueueSize, changeLogSize int,
+	keepAliveInterval, closeTimeout, drainTimeout time.Duration,
+	nodeMinInterval time.Duration,
+) error {
+	if batchInterval <= 0 {
+		return errors.New("batcher.batch_interval must be positive")
+	}
+
+	if sendTimeout <= 0 {
+		return errors.New("batcher.send_timeout must be positive")
+	}
+
+	if nodeQueueSize < 0 {
+		return errors.New("batcher.node_queue_size must not be negative")
+	}
+
+	if changeLogSize < 0 {
+		return errors.New("batcher.change_log_size must not be negative")
+	}
+
+	if keepAliveInterval <= 0 {
+		return errors.New("batcher.keepalive_interval must be positive")
+	}
+
+	if closeTimeout <= 0 {
+		return errors.New("batcher.close_timeout must be positive")
+	}
+
+	if drainTimeout < 0 {
+		return errors.New("batcher.drain_timeout must not be negative")
+	}
+
+	if nodeMinInterval < 0 {
+		return errors.New("batcher.node_min_interval must not be negative")
+	}
+
+	return nil
+}
+
+func validateHA(
+	enabled bool,
+	dbType string,
+	heartbeatInterval, instanceTimeout, syncInterval time.Duration,
+	clusterKeyPath string,
+) error {
+	if !enabled {
+		return nil
+	}
+
+	if dbType != DatabasePostgres {
+		return errors.New("ha.enabled requires the postgres database, the instances share it")
+	}
+
+	if heartbeatInterval <= 0 || syncInterval <= 0 {
+		return errors.New("ha.heartbeat_interval and ha.sync_interval must be positive")
+	}
+
+	if instanceTimeout < 2*heartbeatInterval {
+		return errors.New("ha.instance_timeout must be at least twice ha.heartbeat_interval")
+	}
+
+	if clusterKeyPath == "" {
+		return errors.New("ha.cluster_key_path must be set, the instances authenticate their changes with its keys")
+	}
+
+	return nil
+}
+
+func validateChangeBus(cfg ChangeBusConfig) error {
+	switch cfg.Type {
+	case ChangeBusLocal:
+	case ChangeBusNATS:
+		if cfg.NATS.URL == "" || cfg.NATS.Subject == "" {
+			return errors.New("change_bus.nats.url and change_bus.nats.subject must be set")
+		}
+
+		if cfg.ClusterKeyPath == "" {
+			return errors.New("ha.cluster_key_path must be set to use the nats change bus")
+		}
+
+		if cfg.NATS.CredsPath != "" && cfg.NATS.NKeySeedPath != "" {
+			return errors.New("only one of change_bus.nats.creds_path and change_bus.nats.nkey_seed_path can be set")
+		}
+
+		if err := validateBusTLS("change_bus.nats.tls", cfg.NATS.TLS); err != nil {
+			return err
+		}
+	case ChangeBusRedis:
+		if cfg.Redis.Addr == "" || cfg.Redis.Stream == "" {
+			return errors.New("change_bus.redis.addr and change_bus.redis.stream must be set")
+		}
+
+		if cfg.ClusterKeyPath == "" {
+			return errors.New("ha.cluster_key_path must be set to use the redis change bus")
+		}
+
+		if cfg.Redis.MaxLen < 0 {
+			return errors.New("change_bus.redis.max_len must not be negative")
+		}
+
+		if err := validateBusTLS("change_bus.redis.tls", cfg.Redis.TLS); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("change_bus.type must be %s, %s or %s, got %q", ChangeBusLocal, ChangeBusNATS, ChangeBusRedis, cfg.Type)
+	}
+
+	return nil
+}
+
+func validateBusTLS(key string, cfg BusTLSConfig) error {
+	if (cfg.CertPath == "") != (cfg.KeyPath == "") {
+		return fmt.Errorf("%s.cert_path and %s.key_path must be set together", key, key)
+	}
+
+	if !cfg.Enabled && (cfg.CAPath != "" || cfg.CertPath != "") {
+		return fmt.Errorf("%s.enabled must be true to use a CA or a client certificate", key)
+	}
+
+	return nil
+}
+
+// DebugListenAddr returns the network and address of the debug
+// listener, a unix socket when addr starts with unix:, a TCP address
+// otherwise.
+func DebugListenAddr(addr string) (string, string) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return "unix", path
+	}
+
+	return "tcp", addr
+}
+
+// validateDebugListenAddr checks the debug listener is only reachable
+// from the host, the endpoints are not authenticated.
+func validateDebugListenAddr(addr string) error {
+	if addr == "" {
+		return nil
+	}
+
+	network, address := DebugListenAddr(addr)
+	if network == "unix" {
+		if address == "" {
+			return errors.New("debug_listen_addr must have the path of the socket after unix:")
+		}
+
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("debug_listen_addr is invalid: %w", err)
+	}
+
+	if host == "localhost" {
+		return nil
+	}
+
+	if ip, err := netip.ParseAddr(host); err != nil || !ip.IsLoopback() {
+		return fmt.Errorf("debug_listen_addr must be a unix socket or a loopback address, got %q", host)
+	}
+
+	return nil
+}
+
+func getChangeBusConfig() ChangeBusConfig {
+	ha := getHAConfig()
+
+	return ChangeBusConfig{
+		Type:           viper.GetString("change_bus.type"),
+		InstanceID:     ha.InstanceID,
+		ClusterKeyPath: ha.ClusterKeyPath,
+		NATS: NATSBusConfig{
+			URL:          viper.GetString("change_bus.nats.url"),
+			Subject:      viper.GetString("change_bus.nats.subject"),
+			TLS:          getBusTLSConfig("change_bus.nats.tls"),
+			CredsPath:    util.AbsolutePathFromConfigPath(viper.GetString("change_bus.nats.creds_path")),
+			NKeySeedPath: util.AbsolutePathFromConfigPath(viper.GetString("change_bus.nats.nkey_seed_path")),
+		},
+		Redis: RedisBusConfig{
+			Addr:     viper.GetString("change_bus.redis.addr"),
+			Username: viper.GetString("change_bus.redis.username"),
+			Password: viper.GetString("change_bus.redis.password"),
+			DB:       viper.GetInt("change_bus.redis.db"),
+			Stream:   viper.GetString("change_bus.redis.stream"),
+			MaxLen:   viper.GetInt64("change_bus.redis.max_len"),
+			TLS:      getBusTLSConfig("change_bus.redis.tls"),
+		},
+	}
+}
+
+func getBusTLSConfig(key string) BusTLSConfig {
+	return BusTLSConfig{
+		Enabled:  viper.GetBool(key + ".enabled"),
+		CAPath:   util.AbsolutePathFromConfigPath(viper.GetString(key + ".ca_path")),
+		CertPath: util.AbsolutePathFromConfigPath(viper.GetString(key + ".cert_path")),
+		KeyPath:  util.AbsolutePathFromConfigPath(viper.GetString(key + ".key_path")),
+	}
+}
+
+// getHAConfig returns the HA configuration, the instance ID defaults
+// to the hostname.
+func getHAConfig() HAConfig {
+	instanceID := viper.GetString("ha.instance_id")
+	if instanceID == "" {
+		instanceID, _ = os.Hostname()
+	}
+
+	return HAConfig{
+		Enabled:           viper.GetBool("ha.enabled"),
+		InstanceID:        instanceID,
+		HeartbeatInterval: viper.GetDuration("ha.heartbeat_interval"),
+		InstanceTimeout:   viper.GetDuration("ha.instance_timeout"),
+		SyncInterval:      viper.GetDuration("ha.sync_interval"),
+		ClusterKeyPath:    util.AbsolutePathFromConfigPath(viper.GetString("ha.cluster_key_path")),
+	}
+}
+
+// getModelDuration returns a duration of the configuration which can
+// use days and weeks, such as 90d, it is validated in LoadConfig.
+func getModelDuration(key string) time.Duration {
+	duration, _ := model.ParseDuration(viper.GetString(key))
+
+	return time.Duration(duration)
+}
+
+func validateNodeLimits(soft, hard int) error {
+	if soft < 0 || hard < 0 {
+		return errors.New("node_limits.soft and node_limits.hard must not be negative")
+	}
+
+	if hard != 0 && soft > hard {
+		return fmt.Errorf(
+			"node_limits.soft (%d) must not be larger than node_limits.hard (%d)",
+			soft,
+			hard,
+		)
+	}
+
+	return nil
+}
+
+func validateRouteFailover(holdDown, maxHoldDown time.Duration) error {
+	if holdDown < 0 || maxHoldDown < 0 {
+		return errors.New("route_failover.hold_down and route_failover.max_hold_down must not be negative")
+	}
+
+	if holdDown > 0 && maxHoldDown < holdDown {
+		return fmt.Errorf(
+			"route_failover.max_hold_down (%s) must not be shorter than route_failover.hold_down (%s)",
+			maxHoldDown,
+			holdDown,
+		)
+	}
+
+	return nil
+}
+
+// validateServerURL ensures that the server_url can be used by clients
+// regardless of the address family they have available. In particular,
+// IPv6 literals must be enclosed in brackets, otherwise the port cannot
+// be told apart from the address.
+func validateServerURL(serverURL string) error {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return fmt.Errorf("server_url is not a valid URL: %w", err)
+	}
+
+	if u.Hostname() == "" {
+		return errors.New("server_url must contain a hostname or IP address")
+	}
+
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil && addr.Is6() {
+		if !strings.HasPrefix(u.Host, "[") {
+			return fmt.Errorf(
+				"server_url IPv6 address must be enclosed in brackets, e.g. %s://[%s]:8080",
+				u.Scheme,
+				addr,
+			)
+		}
+
+		if addr.Zone() != "" {
+			return errors.New("server_url IPv6 address must not contain a zone")
+		}
+	}
+
+	return nil
+}
+
 func GetTLSConfig() TLSConfig {
 	return TLSConfig{
 		LetsEncrypt: LetsEncryptConfig{
@@ -321,6 +1159,38 @@ func GetTLSConfig() TLSConfig {
 	}
 }
 
+// GetGRPCTLSConfig returns the TLS configuration of the gRPC listener.
+// Let's Encrypt certificates are only requested with the HTTP-01
+// challenge, served on tls_letsencrypt_listen, as TLS-ALPN-01 requires
+// the listener to be on port 443.
+func GetGRPCTLSConfig() GRPCTLSConfig {
+	cacheDir := viper.GetString("grpc_tls.letsencrypt_cache_dir")
+	if cacheDir == "" {
+		cacheDir = viper.GetString("tls_letsencrypt_cache_dir")
+	}
+
+	return GRPCTLSConfig{
+		TLSConfig: TLSConfig{
+			LetsEncrypt: LetsEncryptConfig{
+				Hostname:      viper.GetString("grpc_tls.letsencrypt_hostname"),
+				Listen:        viper.GetString("tls_letsencrypt_listen"),
+				CacheDir:      util.AbsolutePathFromConfigPath(cacheDir),
+				ChallengeType: HTTP01ChallengeType,
+			},
+			CertPath: util.AbsolutePathFromConfigPath(
+				viper.GetString("grpc_tls.cert_path"),
+			),
+			KeyPath: util.AbsolutePathFromConfigPath(
+				viper.GetString("grpc_tls.key_path"),
+			),
+		},
+		ClientCAPath: util.AbsolutePathFromConfigPath(
+			viper.GetString("grpc_tls.client_ca_path"),
+		),
+		ClientURISANs: viper.GetStringSlice("grpc_tls.client_uri_sans"),
+	}
+}
+
 func GetDERPConfig() DERPConfig {
 	serverEnabled := viper.GetBool("derp.server.enabled")
 	serverRegionID := viper.GetInt("derp.server.region_id")
@@ -340,6 +1210,16 @@ func GetDERPConfig() DERPConfig {
 			Msg("derp.server.stun_listen_addr must be set if derp.server.enabled is true")
 	}
 
+	meshKeyPath := viper.GetString("derp.server.mesh_key_path")
+	if meshKeyPath != "" {
+		meshKeyPath = util.AbsolutePathFromConfigPath(meshKeyPath)
+	}
+	meshWith := viper.GetStringSlice("derp.server.mesh_with")
+	if len(meshWith) > 0 && meshKeyPath == "" {
+		log.Fatal().
+			Msg("derp.server.mesh_with requires derp.server.mesh_key_path to be set")
+	}
+
 	urlStrs := viper.GetStringSlice("derp.urls")
 
 	urls := make([]url.URL, len(urlStrs))
@@ -365,6 +1245,11 @@ func GetDERPConfig() DERPConfig {
 	autoUpdate := viper.GetBool("derp.auto_update_enabled")
 	updateFrequency := viper.GetDuration("derp.update_frequency")
 
+	var probeInterval time.Duration
+	if viper.GetBool("derp.probe.enabled") {
+		probeInterval = viper.GetDuration("derp.probe.interval")
+	}
+
 	return DERPConfig{
 		ServerEnabled:                      serverEnabled,
 		ServerRegionID:                     serverRegionID,
@@ -379,6 +1264,12 @@ func GetDERPConfig() DERPConfig {
 		IPv4:                               ipv4,
 		IPv6:                               ipv6,
 		AutomaticallyAddEmbeddedDerpRegion: automaticallyAddEmbeddedDerpRegion,
+		ServerVerifyClients:                viper.GetBool("derp.server.verify_clients"),
+		ServerMeshKeyPath:                  meshKeyPath,
+		ServerMeshWith:                     meshWith,
+		ProbeInterval:                      probeInterval,
+		ProbeTimeout:                       viper.GetDuration("derp.probe.timeout"),
+		ProbeFailureThreshold:              viper.GetInt("derp.probe.failure_threshold"),
 	}
 }
 
@@ -394,7 +1285,11 @@ func GetACLConfig() ACLConfig {
 	policyPath := viper.GetString("acl_policy_path")
 
 	return ACLConfig{
-		PolicyPath: policyPath,
+		Mode:                 PolicyMode(viper.GetString("acl_policy_mode")),
+		PolicyPath:           policyPath,
+		HostsRefreshInterval: viper.GetDuration("acl_hosts_refresh_interval"),
+		HostsDir:             util.AbsolutePathFromConfigPath(viper.GetString("acl_hosts_dir")),
+		PeerVisibility:       PeerVisibility(viper.GetString("acl_peer_visibility")),
 	}
 }
 
@@ -420,9 +1315,36 @@ func GetLogConfig() LogConfig {
 			Msgf("Could not parse log format: %s. Valid choices are 'json' or 'text'", logFormatOpt)
 	}
 
+	subsystems := make(map[util.LogSubsystem]zerolog.Level)
+	for name, levelStr := range viper.GetStringMapString("log.subsystems") {
+		subsystem := util.LogSubsystem(name)
+		if !slices.Contains(util.LogSubsystems, subsystem) {
+			log.Error().
+				Str("func", "GetLogConfig").
+				Msgf("Unknown log subsystem: %s. Valid choices are %v", name, util.LogSubsystems)
+
+			continue
+		}
+
+		level, err := zerolog.ParseLevel(levelStr)
+		if err != nil {
+			log.Error().
+				Str("func", "GetLogConfig").
+				Msgf("Could not parse log level of %s: %s", name, levelStr)
+
+			continue
+		}
+
+		subsystems[subsystem] = level
+	}
+
 	return LogConfig{
-		Format: logFormat,
-		Level:  logLevel,
+		Format:     logFormat,
+		Level:      logLevel,
+		Subsystems: subsystems,
+
+		SamplingBurst:  viper.GetUint32("log.sampling.burst"),
+		SamplingPeriod: viper.GetDuration("log.sampling.period"),
 	}
 }
 
@@ -442,8 +1364,9 @@ func GetDatabaseConfig() DatabaseConfig {
 	}
 
 	return DatabaseConfig{
-		Type:  type_,
-		Debug: debug,
+		Type:                    type_,
+		Debug:                   debug,
+		NodeStatusWriteInterval: viper.GetDuration("database.node_status_write_interval"),
 		Sqlite: SqliteConfig{
 			Path: util.AbsolutePathFromConfigPath(
 				viper.GetString("database.sqlite.path"),
@@ -462,10 +1385,45 @@ func GetDatabaseConfig() DatabaseConfig {
 			ConnMaxIdleTimeSecs: viper.GetInt(
 				"database.postgres.conn_max_idle_time_secs",
 			),
+			ReadDSN:          viper.GetString("database.postgres.read_dsn"),
+			StatementTimeout: viper.GetDuration("database.postgres.statement_timeout"),
 		},
 	}
 }
 
+// GetIPPools returns the pools of prefixes.pools, which must be in the
+// prefixes of the tailnet.
+func GetIPPools(prefix4, prefix6 *netip.Prefix) ([]IPPool, error) {
+	var pools []IPPool
+	if err := viper.UnmarshalKey("prefixes.pools", &pools); err != nil {
+		return nil, fmt.Errorf("parsing prefixes.pools: %w", err)
+	}
+
+	for index := range pools {
+		if err := pools[index].Validate(prefix4, prefix6); err != nil {
+			return nil, fmt.Errorf("prefixes.pools: %w", err)
+		}
+	}
+
+	return pools, nil
+}
+
+// GetScopedNameservers returns the nameservers of dns_config.scoped_nameservers.
+func GetScopedNameservers() ([]ScopedNameservers, error) {
+	var scoped []ScopedNameservers
+	if err := viper.UnmarshalKey("dns_config.scoped_nameservers", &scoped); err != nil {
+		return nil, fmt.Errorf("parsing dns_config.scoped_nameservers: %w", err)
+	}
+
+	for index := range scoped {
+		if err := scoped[index].Validate(); err != nil {
+			return nil, fmt.Errorf("dns_config.scoped_nameservers: %w", err)
+		}
+	}
+
+	return scoped, nil
+}
+
 func GetDNSConfig() (*tailcfg.DNSConfig, string) {
 	if viper.IsSet("dns_config") {
 		dnsConfig := &tailcfg.DNSConfig{}
@@ -644,6 +1602,8 @@ func GetHeadscaleConfig() (*Config, error) {
 				APIKey:   viper.GetString("cli.api_key"),
 				Timeout:  viper.GetDuration("cli.timeout"),
 				Insecure: viper.GetBool("cli.insecure"),
+				CertPath: util.AbsolutePathFromConfigPath(viper.GetString("cli.tls_cert_path")),
+				KeyPath:  util.AbsolutePathFromConfigPath(viper.GetString("cli.tls_key_path")),
 			},
 		}, nil
 	}
@@ -676,7 +1636,35 @@ func GetHeadscaleConfig() (*Config, error) {
 		return nil, fmt.Errorf("config error, prefixes.allocation is set to %s, which is not a valid strategy, allowed options: %s, %s", allocStr, IPAllocationStrategySequential, IPAllocationStrategyRandom)
 	}
 
+	ipPools, err := GetIPPools(prefix4, prefix6)
+	if err != nil {
+		return nil, err
+	}
+
+	tailnets, err := GetTailnets(prefix4, prefix6)
+	if err != nil {
+		return nil, err
+	}
+	if len(tailnets) > 0 && viper.GetBool("tailnet_lock") {
+		return nil, errors.New("config error, tailnet_lock cannot be used with tailnets, network lock is not scoped to a tailnet")
+	}
+	for _, tailnet := range tailnets {
+		ipPools = append(ipPools, tailnet.Pool)
+	}
+
 	dnsConfig, baseDomain := GetDNSConfig()
+	scopedNameservers, err := GetScopedNameservers()
+	if err != nil {
+		return nil, err
+	}
+	clientVersions, err := getClientVersionsConfig()
+	if err != nil {
+		return nil, err
+	}
+	clientUpdates, err := getClientUpdatesConfig()
+	if err != nil {
+		return nil, err
+	}
 	derpConfig := GetDERPConfig()
 	logTailConfig := GetLogTailConfig()
 	randomizeClientPort := viper.GetBool("randomize_client_port")
@@ -698,13 +1686,17 @@ func GetHeadscaleConfig() (*Config, error) {
 		ServerURL:          viper.GetString("server_url"),
 		Addr:               viper.GetString("listen_addr"),
 		MetricsAddr:        viper.GetString("metrics_listen_addr"),
+		DebugAddr:          viper.GetString("debug_listen_addr"),
 		GRPCAddr:           viper.GetString("grpc_listen_addr"),
 		GRPCAllowInsecure:  viper.GetBool("grpc_allow_insecure"),
 		DisableUpdateCheck: viper.GetBool("disable_check_updates"),
+		WatchConfig:        viper.GetBool("watch_config"),
 
 		PrefixV4:     prefix4,
 		PrefixV6:     prefix6,
 		IPAllocation: IPAllocationStrategy(alloc),
+		IPPools:      ipPools,
+		Tailnets:     tailnets,
 
 		NoisePrivateKeyPath: util.AbsolutePathFromConfigPath(
 			viper.GetString("noise.private_key_path"),
@@ -719,10 +1711,12 @@ func GetHeadscaleConfig() (*Config, error) {
 
 		Database: GetDatabaseConfig(),
 
-		TLS: GetTLSConfig(),
+		TLS:     GetTLSConfig(),
+		GRPCTLS: GetGRPCTLSConfig(),
 
 		DNSConfig:             dnsConfig,
 		DNSUserNameInMagicDNS: viper.GetBool("dns_config.use_username_in_magic_dns"),
+		DNSScopedNameservers:  scopedNameservers,
 
 		ACMEEmail: viper.GetString("acme_email"),
 		ACMEURL:   viper.GetString("acme_url"),
@@ -742,6 +1736,10 @@ func GetHeadscaleConfig() (*Config, error) {
 			AllowedDomains:   viper.GetStringSlice("oidc.allowed_domains"),
 			AllowedUsers:     viper.GetStringSlice("oidc.allowed_users"),
 			AllowedGroups:    viper.GetStringSlice("oidc.allowed_groups"),
+			MapGroups:        viper.GetBool("oidc.map_groups"),
+			GroupsClaim:      viper.GetString("oidc.groups_claim"),
+			GroupsPrefix:     viper.GetString("oidc.groups_prefix"),
+			TailnetClaim:     viper.GetString("oidc.tailnet_claim"),
 			StripEmaildomain: viper.GetBool("oidc.strip_email_domain"),
 			Expiry: func() time.Duration {
 				// if set to 0, we assume no expiry
@@ -759,6 +1757,11 @@ func GetHeadscaleConfig() (*Config, error) {
 				}
 			}(),
 			UseExpiryFromToken: viper.GetBool("oidc.use_expiry_from_token"),
+			RevalidateInterval: viper.GetDuration("oidc.revalidate_interval"),
+		},
+
+		SCIM: SCIMConfig{
+			Enabled: viper.GetBool("scim.enabled"),
 		},
 
 		LogTail:             logTailConfig,
@@ -771,19 +1774,87 @@ func GetHeadscaleConfig() (*Config, error) {
 			APIKey:   viper.GetString("cli.api_key"),
 			Timeout:  viper.GetDuration("cli.timeout"),
 			Insecure: viper.GetBool("cli.insecure"),
+			CertPath: util.AbsolutePathFromConfigPath(viper.GetString("cli.tls_cert_path")),
+			KeyPath:  util.AbsolutePathFromConfigPath(viper.GetString("cli.tls_key_path")),
 		},
 
 		Log: logConfig,
 
-		// TODO(kradalby): Document these settings when more stable
+		NodeLimits: NodeLimitsConfig{
+			Soft: viper.GetInt("node_limits.soft"),
+			Hard: viper.GetInt("node_limits.hard"),
+		},
+
+		NodeExpiry: NodeExpiryConfig{
+			Default: getModelDuration("node_expiry.default"),
+			Warning: getModelDuration("node_expiry.warning"),
+		},
+
+		ClientVersions: clientVersions,
+		ClientUpdates:  clientUpdates,
+
+		ClientMetrics: ClientMetricsConfig{
+			Interval: viper.GetDuration("client_metrics.interval"),
+		},
+
+		RouteFailover: RouteFailoverConfig{
+			HoldDown:    viper.GetDuration("route_failover.hold_down"),
+			MaxHoldDown: viper.GetDuration("route_failover.max_hold_down"),
+		},
+
+		NodeApproval: viper.GetBool("node_approval"),
+		TailnetLock:  viper.GetBool("tailnet_lock"),
+
+		Taildrop: TaildropConfig{
+			Enabled: viper.GetBool("taildrop.enabled"),
+		},
+
+		SSHRecording: SSHRecordingConfig{
+			RecorderTags: viper.GetStringSlice("ssh_recording.recorder_tags"),
+			RecorderPort: viper.GetUint16("ssh_recording.recorder_port"),
+		},
+
+		// The tuning section predates the batcher section, and is
+		// still read for the settings which are not in the latter.
 		Tuning: Tuning{
-			NotifierSendTimeout:            viper.GetDuration("tuning.notifier_send_timeout"),
-			BatchChangeDelay:               viper.GetDuration("tuning.batch_change_delay"),
-			NodeMapSessionBufferedChanSize: viper.GetInt("tuning.node_mapsession_buffered_chan_size"),
+			NotifierSendTimeout:            viper.GetDuration(batcherKey("send_timeout", "tuning.notifier_send_timeout")),
+			BatchChangeDelay:               viper.GetDuration(batcherKey("batch_interval", "tuning.batch_change_delay")),
+			NodeMapSessionBufferedChanSize: viper.GetInt(batcherKey("node_queue_size", "tuning.node_mapsession_buffered_chan_size")),
+			NotifierChangeLogSize:          viper.GetInt(batcherKey("change_log_size", "tuning.notifier_change_log_size")),
+			NotifierChangeLogPath:          util.AbsolutePathFromConfigPath(viper.GetString("batcher.change_log_path")),
+			KeepAliveInterval:              viper.GetDuration("batcher.keepalive_interval"),
+			MapSessionCloseTimeout:         viper.GetDuration("batcher.close_timeout"),
+			DrainTimeout:                   viper.GetDuration("batcher.drain_timeout"),
+			NodeMinInterval:                viper.GetDuration("batcher.node_min_interval"),
+		},
+
+		Webhooks: getWebhooksConfig(),
+
+		HA: getHAConfig(),
+
+		ChangeBus: getChangeBusConfig(),
+
+		Tracing: TracingConfig{
+			Enabled:     viper.GetBool("tracing.enabled"),
+			Endpoint:    viper.GetString("tracing.endpoint"),
+			Insecure:    viper.GetBool("tracing.insecure"),
+			SampleRatio: viper.GetFloat64("tracing.sample_ratio"),
 		},
 	}, nil
 }
 
+func getWebhooksConfig() []WebhookConfig {
+	var hooks []WebhookConfig
+	if err := viper.UnmarshalKey("webhooks", &hooks); err != nil {
+		log.Error().
+			Str("func", "getWebhooksConfig").
+			Err(err).
+			Msgf("Could not parse webhooks")
+	}
+
+	return hooks
+}
+
 func IsCLIConfigured() bool {
 	return viper.GetString("cli.address") != "" && viper.GetString("cli.api_key") != ""
 }
@@ -0,0 +1,521 @@
+package types
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestValidateServerURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{
+			url: "https://headscale.example.com",
+		},
+		{
+			url: "http://127.0.0.1:8080",
+		},
+		{
+			url: "http://[fd7a:115c:a1e0::1]:8080",
+		},
+		{
+			url: "https://[2001:db8::1]",
+		},
+		{
+			url:     "http://2001:db8::1:8080",
+			wantErr: true,
+		},
+		{
+			url:     "http://[fe80::1%25eth0]:8080",
+			wantErr: true,
+		},
+		{
+			url:     "http://:8080",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			err := validateServerURL(tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateServerURL(%q) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateNodeLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		soft    int
+		hard    int
+		wantErr bool
+	}{
+		{
+			name: "unlimited",
+		},
+		{
+			name: "soft-only",
+			soft: 100,
+		},
+		{
+			name: "hard-only",
+			hard: 100,
+		},
+		{
+			name: "soft-below-hard",
+			soft: 80,
+			hard: 100,
+		},
+		{
+			name:    "soft-above-hard",
+			soft:    120,
+			hard:    100,
+			wantErr: true,
+		},
+		{
+			name:    "negative",
+			hard:    -1,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateNodeLimits(tt.soft, tt.hard)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateNodeLimits(%d, %d) error = %v, wantErr %v", tt.soft, tt.hard, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateRouteFailover(t *testing.T) {
+	tests := []struct {
+		name        string
+		holdDown    time.Duration
+		maxHoldDown time.Duration
+		wantErr     bool
+	}{
+		{
+			name:        "disabled",
+			maxHoldDown: 10 * time.Minute,
+		},
+		{
+			name:        "hold-down-below-max",
+			holdDown:    time.Minute,
+			maxHoldDown: 10 * time.Minute,
+		},
+		{
+			name:        "hold-down-above-max",
+			holdDown:    time.Hour,
+			maxHoldDown: 10 * time.Minute,
+			wantErr:     true,
+		},
+		{
+			name:     "negative",
+			holdDown: -time.Minute,
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRouteFailover(tt.holdDown, tt.maxHoldDown)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateRouteFailover(%s, %s) error = %v, wantErr %v", tt.holdDown, tt.maxHoldDown, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateHA(t *testing.T) {
+	tests := []struct {
+		name      string
+		enabled   bool
+		dbType    string
+		heartbeat time.Duration
+		timeout   time.Duration
+		sync      time.Duration
+		keyPath   string
+		wantErr   bool
+	}{
+		{
+			name:   "disabled",
+			dbType: DatabaseSqlite,
+		},
+		{
+			name:      "postgres",
+			enabled:   true,
+			dbType:    DatabasePostgres,
+			heartbeat: 5 * time.Second,
+			timeout:   30 * time.Second,
+			sync:      time.Second,
+			keyPath:   "/etc/headscale/cluster.keys",
+		},
+		{
+			name:      "no-cluster-key",
+			enabled:   true,
+			dbType:    DatabasePostgres,
+			heartbeat: 5 * time.Second,
+			timeout:   30 * time.Second,
+			sync:      time.Second,
+			wantErr:   true,
+		},
+		{
+			name:      "sqlite",
+			enabled:   true,
+			dbType:    DatabaseSqlite,
+			heartbeat: 5 * time.Second,
+			timeout:   30 * time.Second,
+			sync:      time.Second,
+			wantErr:   true,
+		},
+		{
+			name:      "timeout-too-short",
+			enabled:   true,
+			dbType:    DatabasePostgres,
+			heartbeat: 5 * time.Second,
+			timeout:   5 * time.Second,
+			sync:      time.Second,
+			wantErr:   true,
+		},
+		{
+			name:      "no-sync",
+			enabled:   true,
+			dbType:    DatabasePostgres,
+			heartbeat: 5 * time.Second,
+			timeout:   30 * time.Second,
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateHA(tt.enabled, tt.dbType, tt.heartbeat, tt.timeout, tt.sync, tt.keyPath)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateHA() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateChangeBus(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     ChangeBusConfig
+		wantErr bool
+	}{
+		{
+			name: "local",
+			cfg:  ChangeBusConfig{Type: ChangeBusLocal},
+		},
+		{
+			name: "nats",
+			cfg: ChangeBusConfig{
+				Type:           ChangeBusNATS,
+				ClusterKeyPath: "/etc/headscale/cluster.keys",
+				NATS:           NATSBusConfig{URL: "nats://127.0.0.1:4222", Subject: "headscale.changes"},
+			},
+		},
+		{
+			name: "nats-no-cluster-key",
+			cfg: ChangeBusConfig{
+				Type: ChangeBusNATS,
+				NATS: NATSBusConfig{URL: "nats://127.0.0.1:4222", Subject: "headscale.changes"},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "nats-no-url",
+			cfg:     ChangeBusConfig{Type: ChangeBusNATS, NATS: NATSBusConfig{Subject: "headscale.changes"}},
+			wantErr: true,
+		},
+		{
+			name: "redis",
+			cfg: ChangeBusConfig{
+				Type:           ChangeBusRedis,
+				ClusterKeyPath: "/etc/headscale/cluster.keys",
+				Redis:          RedisBusConfig{Addr: "127.0.0.1:6379", Stream: "headscale:changes"},
+			},
+		},
+		{
+			name: "nats-creds-and-nkey",
+			cfg: ChangeBusConfig{
+				Type:           ChangeBusNATS,
+				ClusterKeyPath: "/etc/headscale/cluster.keys",
+				NATS: NATSBusConfig{
+					URL:          "tls://127.0.0.1:4222",
+					Subject:      "headscale.changes",
+					CredsPath:    "/etc/headscale/nats.creds",
+					NKeySeedPath: "/etc/headscale/nats.nk",
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "nats-tls-client-cert",
+			cfg: ChangeBusConfig{
+				Type:           ChangeBusNATS,
+				ClusterKeyPath: "/etc/headscale/cluster.keys",
+				NATS: NATSBusConfig{
+					URL:     "tls://127.0.0.1:4222",
+					Subject: "headscale.changes",
+					TLS: BusTLSConfig{
+						Enabled:  true,
+						CAPath:   "/etc/headscale/nats-ca.pem",
+						CertPath: "/etc/headscale/nats.pem",
+						KeyPath:  "/etc/headscale/nats.key",
+					},
+				},
+			},
+		},
+		{
+			name: "redis-tls-cert-without-key",
+			cfg: ChangeBusConfig{
+				Type:           ChangeBusRedis,
+				ClusterKeyPath: "/etc/headscale/cluster.keys",
+				Redis: RedisBusConfig{
+					Addr:   "127.0.0.1:6379",
+					Stream: "headscale:changes",
+					TLS:    BusTLSConfig{Enabled: true, CertPath: "/etc/headscale/redis.pem"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "redis-tls-ca-without-tls",
+			cfg: ChangeBusConfig{
+				Type:           ChangeBusRedis,
+				ClusterKeyPath: "/etc/headscale/cluster.keys",
+				Redis: RedisBusConfig{
+					Addr:   "127.0.0.1:6379",
+					Stream: "headscale:changes",
+					TLS:    BusTLSConfig{CAPath: "/etc/headscale/redis-ca.pem"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "redis-negative-max-len",
+			cfg: ChangeBusConfig{
+				Type:           ChangeBusRedis,
+				ClusterKeyPath: "/etc/headscale/cluster.keys",
+				Redis:          RedisBusConfig{Addr: "127.0.0.1:6379", Stream: "headscale:changes", MaxLen: -1},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "unknown",
+			cfg:     ChangeBusConfig{Type: "kafka"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateChangeBus(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateChangeBus() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateDebugListenAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		wantErr bool
+	}{
+		{addr: ""},
+		{addr: "unix:/var/run/headscale/debug.sock"},
+		{addr: "127.0.0.1:9092"},
+		{addr: "[::1]:9092"},
+		{addr: "localhost:9092"},
+		{addr: "unix:", wantErr: true},
+		{addr: "0.0.0.0:9092", wantErr: true},
+		{addr: ":9092", wantErr: true},
+		{addr: "10.0.0.1:9092", wantErr: true},
+		{addr: "127.0.0.1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			err := validateDebugListenAddr(tt.addr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateDebugListenAddr(%q) error = %v, wantErr %v", tt.addr, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBatcherKey(t *testing.T) {
+	defer viper.Reset()
+
+	viper.Set("tuning.batch_change_delay", "1s")
+	if got := viper.GetDuration(batcherKey("batch_interval", "tuning.batch_change_delay")); got != time.Second {
+		t.Errorf("expected the tuning setting to be used, got %s", got)
+	}
+
+	viper.Set("batcher.batch_interval", "2s")
+	if got := viper.GetDuration(batcherKey("batch_interval", "tuning.batch_change_delay")); got != 2*time.Second {
+		t.Errorf("expected the batcher setting to be used, got %s", got)
+	}
+}
+
+func TestValidateBatcher(t *testing.T) {
+	tests := []struct {
+		name              string
+		batchInterval     time.Duration
+		sendTimeout       time.Duration
+		nodeQueueSize     int
+		changeLogSize     int
+		keepAliveInterval time.Duration
+		closeTimeout      time.Duration
+		drainTimeout      time.Duration
+		nodeMinInterval   time.Duration
+		wantErr           bool
+	}{
+		{
+			name:              "defaults",
+			batchInterval:     800 * time.Millisecond,
+			sendTimeout:       800 * time.Millisecond,
+			nodeQueueSize:     30,
+			keepAliveInterval: 50 * time.Second,
+			closeTimeout:      30 * time.Second,
+			drainTimeout:      10 * time.Second,
+		},
+		{
+			name:              "unbuffered-queue",
+			batchInterval:     time.Second,
+			sendTimeout:       time.Second,
+			keepAliveInterval: time.Minute,
+			closeTimeout:      time.Second,
+		},
+		{
+			name:              "zero-batch-interval",
+			sendTimeout:       time.Second,
+			keepAliveInterval: time.Minute,
+			closeTimeout:      time.Second,
+			wantErr:           true,
+		},
+		{
+			name:              "negative-queue-size",
+			batchInterval:     time.Second,
+			sendTimeout:       time.Second,
+			nodeQueueSize:     -1,
+			keepAliveInterval: time.Minute,
+			closeTimeout:      time.Second,
+			wantErr:           true,
+		},
+		{
+			name:              "negative-change-log-size",
+			batchInterval:     time.Second,
+			sendTimeout:       time.Second,
+			changeLogSize:     -1,
+			keepAliveInterval: time.Minute,
+			closeTimeout:      time.Second,
+			wantErr:           true,
+		},
+		{
+			name:              "negative-drain-timeout",
+			batchInterval:     time.Second,
+			sendTimeout:       time.Second,
+			keepAliveInterval: time.Minute,
+			closeTimeout:      time.Second,
+			drainTimeout:      -time.Second,
+			wantErr:           true,
+		},
+		{
+			name:              "node-min-interval",
+			batchInterval:     time.Second,
+			sendTimeout:       time.Second,
+			keepAliveInterval: time.Minute,
+			closeTimeout:      time.Second,
+			nodeMinInterval:   5 * time.Second,
+		},
+		{
+			name:              "negative-node-min-interval",
+			batchInterval:     time.Second,
+			sendTimeout:       time.Second,
+			keepAliveInterval: time.Minute,
+			closeTimeout:      time.Second,
+			nodeMinInterval:   -time.Second,
+			wantErr:           true,
+		},
+		{
+			name:          "zero-keepalive",
+			batchInterval: time.Second,
+			sendTimeout:   time.Second,
+			closeTimeout:  time.Second,
+			wantErr:       true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateBatcher(
+				tt.batchInterval,
+				tt.sendTimeout,
+				tt.nodeQueueSize,
+				tt.changeLogSize,
+				tt.keepAliveInterval,
+				tt.closeTimeout,
+				tt.drainTimeout,
+				tt.nodeMinInterval,
+			)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateBatcher() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateDERPProbe(t *testing.T) {
+	tests := []struct {
+		name             string
+		interval         time.Duration
+		timeout          time.Duration
+		failureThreshold int
+		wantErr          bool
+	}{
+		{
+			name:             "defaults",
+			interval:         time.Minute,
+			timeout:          5 * time.Second,
+			failureThreshold: 3,
+		},
+		{
+			name:             "zero-interval",
+			timeout:          5 * time.Second,
+			failureThreshold: 3,
+			wantErr:          true,
+		},
+		{
+			name:             "timeout-longer-than-interval",
+			interval:         time.Second,
+			timeout:          5 * time.Second,
+			failureThreshold: 3,
+			wantErr:          true,
+		},
+		{
+			name:     "zero-failure-threshold",
+			interval: time.Minute,
+			timeout:  5 * time.Second,
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateDERPProbe(tt.interval, tt.timeout, tt.failureThreshold)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateDERPProbe() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package types
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+// DERPRegion is a custom DERP region added at runtime through the API,
+// it is stored to be restored on restart.
+type DERPRegion struct {
+	RegionID int `gorm:"primary_key;autoIncrement:false"`
+	Region   DERPRegionData
+
+	CreatedAt *time.Time
+}
+
+// DERPRegionData is the region sent to the clients, stored as JSON.
+type DERPRegionData tailcfg.DERPRegion
+
+func (r *DERPRegionData) Scan(destination interface{}) error {
+	switch value := destination.(type) {
+	case []byte:
+		return json.Unmarshal(value, r)
+
+	case string:
+		return json.Unmarshal([]byte(value), r)
+
+	default:
+		return fmt.Errorf("unexpected data type %T for DERP region", destination)
+	}
+}
+
+// Value return json value, implement driver.Valuer interface.
+func (r DERPRegionData) Value() (driver.Value, error) {
+	bytes, err := json.Marshal(r)
+
+	return string(bytes), err
+}
@@ -0,0 +1,167 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/dnstype"
+)
+
+var (
+	ErrInvalidDNSRecord         = errors.New("invalid DNS record")
+	ErrInvalidScopedNameservers = errors.New("invalid scoped nameservers")
+)
+
+// DNSRecordTypes are the types of the extra DNS records which can be
+// added through the API.
+var DNSRecordTypes = []string{"A", "AAAA", "CNAME", "TXT"}
+
+// DNSRecord is an extra DNS record added through the API, sent to the
+// nodes with the extra records of the configuration.
+type DNSRecord struct {
+	ID    uint64 `gorm:"primary_key"`
+	Name  string
+	Type  string
+	Value string
+
+	CreatedAt *time.Time
+}
+
+// Validate checks the record, and normalises its name and type.
+func (r *DNSRecord) Validate() error {
+	r.Name = strings.TrimSuffix(strings.ToLower(r.Name), ".")
+	r.Type = strings.ToUpper(r.Type)
+
+	if r.Name == "" {
+		return fmt.Errorf("%w: name is empty", ErrInvalidDNSRecord)
+	}
+	if r.Value == "" {
+		return fmt.Errorf("%w: value is empty", ErrInvalidDNSRecord)
+	}
+
+	switch r.Type {
+	case "A", "AAAA":
+		addr, err := netip.ParseAddr(r.Value)
+		if err != nil {
+			return fmt.Errorf("%w: value %q is not an IP address", ErrInvalidDNSRecord, r.Value)
+		}
+		if (r.Type == "A") != addr.Is4() {
+			return fmt.Errorf("%w: value %q is not an IP address of a %s record", ErrInvalidDNSRecord, r.Value, r.Type)
+		}
+	case "CNAME":
+		r.Value = strings.TrimSuffix(strings.ToLower(r.Value), ".")
+	case "TXT":
+	default:
+		return fmt.Errorf(
+			"%w: type %q is not one of %s",
+			ErrInvalidDNSRecord,
+			r.Type,
+			strings.Join(DNSRecordTypes, ", "),
+		)
+	}
+
+	return nil
+}
+
+func (r *DNSRecord) Tailcfg() tailcfg.DNSRecord {
+	return tailcfg.DNSRecord{
+		Name:  r.Name,
+		Type:  r.Type,
+		Value: r.Value,
+	}
+}
+
+func (r *DNSRecord) Proto() *v1.DNSRecord {
+	record := &v1.DNSRecord{
+		Id:    r.ID,
+		Name:  r.Name,
+		Type:  r.Type,
+		Value: r.Value,
+	}
+
+	if r.CreatedAt != nil {
+		record.CreatedAt = timestamppb.New(*r.CreatedAt)
+	}
+
+	return record
+}
+
+// ScopedNameservers are the nameservers resolving a domain, sent only to
+// the nodes of one of the users or with one of the tags of Nodes, or to
+// all the nodes with "*". They are set in dns_config.scoped_nameservers,
+// or added through the API and stored in the database.
+type ScopedNameservers struct {
+	ID          uint64     `gorm:"primary_key"  mapstructure:"-"`
+	Domain      string     `mapstructure:"domain"`
+	Nameservers StringList `mapstructure:"nameservers"`
+	Nodes       StringList `mapstructure:"nodes"`
+
+	CreatedAt *time.Time `mapstructure:"-"`
+}
+
+// Validate checks the nameservers, and normalises the domain.
+func (s *ScopedNameservers) Validate() error {
+	s.Domain = strings.TrimSuffix(strings.ToLower(s.Domain), ".")
+
+	if s.Domain == "" {
+		return fmt.Errorf("%w: domain is empty", ErrInvalidScopedNameservers)
+	}
+	if len(s.Nameservers) == 0 {
+		return fmt.Errorf("%w: %s has no nameservers", ErrInvalidScopedNameservers, s.Domain)
+	}
+	if len(s.Nodes) == 0 {
+		return fmt.Errorf("%w: %s has no nodes, use \"*\" for all the nodes", ErrInvalidScopedNameservers, s.Domain)
+	}
+
+	for _, nameserver := range s.Nameservers {
+		if strings.HasPrefix(nameserver, "https://") {
+			continue
+		}
+		if _, err := netip.ParseAddr(nameserver); err != nil {
+			return fmt.Errorf(
+				"%w: nameserver %q of %s is not an IP address or a DNS-over-HTTPS URL",
+				ErrInvalidScopedNameservers,
+				nameserver,
+				s.Domain,
+			)
+		}
+	}
+
+	return nil
+}
+
+// Applies reports if the nameservers are sent to a node of the user
+// with the tags.
+func (s *ScopedNameservers) Applies(user string, tags []string) bool {
+	return nodesApply(s.Nodes, user, tags)
+}
+
+func (s *ScopedNameservers) Resolvers() []*dnstype.Resolver {
+	resolvers := make([]*dnstype.Resolver, len(s.Nameservers))
+	for index, nameserver := range s.Nameservers {
+		resolvers[index] = &dnstype.Resolver{Addr: nameserver}
+	}
+
+	return resolvers
+}
+
+func (s *ScopedNameservers) Proto() *v1.ScopedNameservers {
+	nameservers := &v1.ScopedNameservers{
+		Id:          s.ID,
+		Domain:      s.Domain,
+		Nameservers: s.Nameservers,
+		Nodes:       s.Nodes,
+	}
+
+	if s.CreatedAt != nil {
+		nameservers.CreatedAt = timestamppb.New(*s.CreatedAt)
+	}
+
+	return nameservers
+}
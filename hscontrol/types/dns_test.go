@@ -0,0 +1,112 @@
+package types
+
+import (
+	"testing"
+)
+
+func TestScopedNameserversValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		nameservers ScopedNameservers
+		wantDomain  string
+		wantErr     bool
+	}{
+		{
+			name: "valid",
+			nameservers: ScopedNameservers{
+				Domain:      "Corp.Example.com.",
+				Nameservers: []string{"10.0.0.53", "https://dns.example.com/dns-query"},
+				Nodes:       []string{"tag:office"},
+			},
+			wantDomain: "corp.example.com",
+		},
+		{
+			name: "no-domain",
+			nameservers: ScopedNameservers{
+				Nameservers: []string{"10.0.0.53"},
+				Nodes:       []string{"*"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "no-nodes",
+			nameservers: ScopedNameservers{
+				Domain:      "corp.example.com",
+				Nameservers: []string{"10.0.0.53"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid-nameserver",
+			nameservers: ScopedNameservers{
+				Domain:      "corp.example.com",
+				Nameservers: []string{"dns.example.com"},
+				Nodes:       []string{"*"},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.nameservers.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && tt.nameservers.Domain != tt.wantDomain {
+				t.Errorf("Validate() domain = %q, want %q", tt.nameservers.Domain, tt.wantDomain)
+			}
+		})
+	}
+}
+
+func TestScopedNameserversApplies(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes []string
+		user  string
+		tags  []string
+		want  bool
+	}{
+		{
+			name:  "all",
+			nodes: []string{"*"},
+			user:  "alice",
+			want:  true,
+		},
+		{
+			name:  "user",
+			nodes: []string{"bob", "alice"},
+			user:  "alice",
+			want:  true,
+		},
+		{
+			name:  "tag",
+			nodes: []string{"tag:office"},
+			user:  "alice",
+			tags:  []string{"tag:server", "tag:office"},
+			want:  true,
+		},
+		{
+			name:  "other-user-and-tag",
+			nodes: []string{"bob", "tag:office"},
+			user:  "alice",
+			tags:  []string{"tag:server"},
+		},
+		{
+			// A user named like a tag does not match it.
+			name:  "tag-is-not-user",
+			nodes: []string{"tag:office"},
+			user:  "tag:office",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nameservers := ScopedNameservers{Nodes: tt.nodes}
+			if got := nameservers.Applies(tt.user, tt.tags); got != tt.want {
+				t.Errorf("Applies() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package types
+
+import (
+	"fmt"
+	"time"
+)
+
+// HAInstance is a headscale instance sharing the database with others,
+// it is alive as long as it keeps updating LastSeen.
+type HAInstance struct {
+	ID       string `gorm:"primary_key"`
+	LastSeen time.Time
+}
+
+// HALease is a lease held by one instance until it expires, the leader
+// is the instance holding the leader lease.
+type HALease struct {
+	Name      string `gorm:"primary_key"`
+	Holder    string
+	ExpiresAt time.Time
+}
+
+// HANodeConnection records which instance a node is connected to.
+type HANodeConnection struct {
+	NodeID     NodeID `gorm:"primary_key;autoIncrement:false"`
+	InstanceID string `gorm:"index"`
+}
+
+// HAChange is a state update published by an instance, for the nodes
+// connected to the other instances. NodeID is set for updates sent to
+// a single node. MAC authenticates the instance which published it
+// with the cluster keys.
+type HAChange struct {
+	ID         uint64 `gorm:"primary_key"`
+	InstanceID string
+	NodeID     NodeID
+	Update     string
+	MAC        string
+
+	CreatedAt time.Time `gorm:"index"`
+}
+
+// SignedData returns the content of the change covered by its MAC.
+func (c *HAChange) SignedData() []byte {
+	return []byte(fmt.Sprintf("%s\n%d\n%s", c.InstanceID, c.NodeID, c.Update))
+}
@@ -0,0 +1,67 @@
+package types
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// IPPool is a part of the prefixes of the tailnet the addresses of some
+// nodes are allocated from: the nodes of one of the users or with one of
+// the tags of Nodes, or all the nodes with "*". They are set in
+// prefixes.pools, the first pool applying to a node is used.
+type IPPool struct {
+	Prefixes StringList `mapstructure:"prefixes"`
+	Nodes    StringList `mapstructure:"nodes"`
+
+	// Prefix4 and Prefix6 are the parsed Prefixes, nil for the families
+	// without a pool.
+	Prefix4 *netip.Prefix `mapstructure:"-"`
+	Prefix6 *netip.Prefix `mapstructure:"-"`
+
+	// Tailnet is the tailnet of the multi-tailnet mode the pool is for,
+	// it only applies to the nodes of its users. Empty for the pools of
+	// prefixes.pools.
+	Tailnet string `mapstructure:"-"`
+}
+
+// Validate parses the prefixes of the pool, and checks that they are in
+// the prefixes of the tailnet.
+func (p *IPPool) Validate(prefix4, prefix6 *netip.Prefix) error {
+	if len(p.Prefixes) == 0 {
+		return fmt.Errorf("%w: no prefixes", ErrPreAuthKeyIPPoolInvalid)
+	}
+	if len(p.Nodes) == 0 {
+		return fmt.Errorf("%w: %v has no nodes, use \"*\" for all the nodes", ErrPreAuthKeyIPPoolInvalid, p.Prefixes)
+	}
+
+	pool4, pool6, err := ParseIPPools(p.Prefixes)
+	if err != nil {
+		return err
+	}
+
+	for _, pair := range []struct{ pool, prefix *netip.Prefix }{
+		{pool4, prefix4},
+		{pool6, prefix6},
+	} {
+		if pair.pool == nil {
+			continue
+		}
+
+		if pair.prefix == nil ||
+			pair.pool.Bits() < pair.prefix.Bits() ||
+			!pair.prefix.Contains(pair.pool.Addr()) {
+			return fmt.Errorf("%w: %s is not in the prefixes of the tailnet", ErrPreAuthKeyIPPoolInvalid, pair.pool)
+		}
+	}
+
+	p.Prefix4 = pool4
+	p.Prefix6 = pool6
+
+	return nil
+}
+
+// Applies reports if the addresses of a node of the user with the tags
+// are allocated from the pool.
+func (p *IPPool) Applies(user string, tags []string) bool {
+	return nodesApply(p.Nodes, user, tags)
+}
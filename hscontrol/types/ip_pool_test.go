@@ -0,0 +1,103 @@
+package types
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestIPPoolValidate(t *testing.T) {
+	prefix4 := netip.MustParsePrefix("100.64.0.0/10")
+	prefix6 := netip.MustParsePrefix("fd7a:115c:a1e0::/48")
+
+	tests := []struct {
+		name      string
+		pool      IPPool
+		wantPool4 string
+		wantPool6 string
+		wantErr   bool
+	}{
+		{
+			name: "valid",
+			pool: IPPool{
+				Prefixes: []string{"100.80.0.0/16", "fd7a:115c:a1e0:80::/64"},
+				Nodes:    []string{"tag:server"},
+			},
+			wantPool4: "100.80.0.0/16",
+			wantPool6: "fd7a:115c:a1e0:80::/64",
+		},
+		{
+			name: "ipv4-only",
+			pool: IPPool{
+				Prefixes: []string{"100.90.0.0/16"},
+				Nodes:    []string{"alice"},
+			},
+			wantPool4: "100.90.0.0/16",
+		},
+		{
+			name: "no-prefixes",
+			pool: IPPool{
+				Nodes: []string{"*"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "no-nodes",
+			pool: IPPool{
+				Prefixes: []string{"100.80.0.0/16"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "outside-prefix",
+			pool: IPPool{
+				Prefixes: []string{"10.0.0.0/16"},
+				Nodes:    []string{"*"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "larger-than-prefix",
+			pool: IPPool{
+				Prefixes: []string{"100.0.0.0/8"},
+				Nodes:    []string{"*"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "same-family",
+			pool: IPPool{
+				Prefixes: []string{"100.80.0.0/16", "100.90.0.0/16"},
+				Nodes:    []string{"*"},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.pool.Validate(&prefix4, &prefix6)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			for _, pair := range []struct {
+				got  *netip.Prefix
+				want string
+			}{
+				{tt.pool.Prefix4, tt.wantPool4},
+				{tt.pool.Prefix6, tt.wantPool6},
+			} {
+				got := ""
+				if pair.got != nil {
+					got = pair.got.String()
+				}
+				if got != pair.want {
+					t.Errorf("Validate() pool = %q, want %q", got, pair.want)
+				}
+			}
+		})
+	}
+}
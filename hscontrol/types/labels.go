@@ -0,0 +1,163 @@
+package types
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrInvalidNodeLabel     = errors.New("invalid node label")
+	ErrInvalidLabelSelector = errors.New("invalid label selector")
+)
+
+const maxLabelLength = 63
+
+// NodeLabels are the labels of a node, arbitrary key/value pairs set
+// through the API to organise the nodes. They are selected by a
+// LabelSelector in the API and with the label: alias in the policy.
+type NodeLabels map[string]string
+
+func (l *NodeLabels) Scan(destination interface{}) error {
+	switch value := destination.(type) {
+	case nil:
+		*l = nil
+
+		return nil
+
+	case []byte:
+		return json.Unmarshal(value, l)
+
+	case string:
+		return json.Unmarshal([]byte(value), l)
+
+	default:
+		return fmt.Errorf("%w: unexpected data type %T", ErrInvalidNodeLabel, destination)
+	}
+}
+
+// Value return json value, implement driver.Valuer interface.
+func (l NodeLabels) Value() (driver.Value, error) {
+	bytes, err := json.Marshal(l)
+
+	return string(bytes), err
+}
+
+// ValidateNodeLabel checks a label of a node. The key is made of
+// letters, digits, ".", "_", "-" and "/", and starts with a letter or
+// a digit, the value is made of letters, digits, ".", "_" and "-" and
+// can be empty. Both are at most 63 characters long, so they can be
+// written in a selector and in a policy alias.
+func ValidateNodeLabel(key, value string) error {
+	if key == "" || len(key) > maxLabelLength || !isLabelAlnum(rune(key[0])) {
+		return fmt.Errorf(
+			"%w: key %q must be 1 to %d characters starting with a letter or a digit",
+			ErrInvalidNodeLabel,
+			key,
+			maxLabelLength,
+		)
+	}
+
+	for _, r := range key {
+		if !isLabelAlnum(r) && !strings.ContainsRune("._-/", r) {
+			return fmt.Errorf("%w: key %q contains %q", ErrInvalidNodeLabel, key, r)
+		}
+	}
+
+	if len(value) > maxLabelLength {
+		return fmt.Errorf(
+			"%w: value of %q is longer than %d characters",
+			ErrInvalidNodeLabel,
+			key,
+			maxLabelLength,
+		)
+	}
+
+	for _, r := range value {
+		if !isLabelAlnum(r) && !strings.ContainsRune("._-", r) {
+			return fmt.Errorf("%w: value %q of %q contains %q", ErrInvalidNodeLabel, value, key, r)
+		}
+	}
+
+	return nil
+}
+
+func isLabelAlnum(r rune) bool {
+	return 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9'
+}
+
+type labelOperator int
+
+const (
+	labelExists labelOperator = iota
+	labelNotExists
+	labelEquals
+	labelNotEquals
+)
+
+// labelRequirement is a requirement of a LabelSelector on one label.
+type labelRequirement struct {
+	key      string
+	operator labelOperator
+	value    string
+}
+
+// LabelSelector selects the nodes whose labels satisfy all of its
+// requirements.
+type LabelSelector []labelRequirement
+
+// ParseLabelSelector parses a comma separated list of requirements, each
+// being "key=value" or "key!=value" to compare the value of a label,
+// "key" to require a label to be set, or "!key" to require it not to
+// be set. A node without the label does not satisfy "key!=value".
+func ParseLabelSelector(selector string) (LabelSelector, error) {
+	var requirements LabelSelector
+	for _, part := range strings.Split(selector, ",") {
+		part = strings.TrimSpace(part)
+
+		requirement := labelRequirement{key: part, operator: labelExists}
+		if key, value, ok := strings.Cut(part, "!="); ok {
+			requirement = labelRequirement{key: key, operator: labelNotEquals, value: value}
+		} else if key, value, ok := strings.Cut(part, "="); ok {
+			requirement = labelRequirement{key: key, operator: labelEquals, value: value}
+		} else if key, ok := strings.CutPrefix(part, "!"); ok {
+			requirement = labelRequirement{key: key, operator: labelNotExists}
+		}
+
+		if err := ValidateNodeLabel(requirement.key, requirement.value); err != nil {
+			return nil, fmt.Errorf("%w: %q: %w", ErrInvalidLabelSelector, part, err)
+		}
+
+		requirements = append(requirements, requirement)
+	}
+
+	return requirements, nil
+}
+
+// Matches reports if the labels satisfy all the requirements of the
+// selector.
+func (s LabelSelector) Matches(labels NodeLabels) bool {
+	for _, requirement := range s {
+		value, ok := labels[requirement.key]
+
+		var matches bool
+		switch requirement.operator {
+		case labelExists:
+			matches = ok
+		case labelNotExists:
+			matches = !ok
+		case labelEquals:
+			matches = ok && value == requirement.value
+		case labelNotEquals:
+			matches = ok && value != requirement.value
+		}
+
+		if !matches {
+			return false
+		}
+	}
+
+	return true
+}
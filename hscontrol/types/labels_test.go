@@ -0,0 +1,53 @@
+package types
+
+import (
+	"testing"
+)
+
+func TestLabelSelectorMatches(t *testing.T) {
+	labels := NodeLabels{
+		"env":                "prod",
+		"team":               "infra",
+		"example.com/legacy": "",
+	}
+
+	tests := []struct {
+		selector string
+		want     bool
+		wantErr  bool
+	}{
+		{selector: "env=prod", want: true},
+		{selector: "env=staging", want: false},
+		{selector: "env!=staging", want: true},
+		{selector: "env=prod,team=infra", want: true},
+		{selector: "env=prod,team=dev", want: false},
+		{selector: "team", want: true},
+		{selector: "!team", want: false},
+		{selector: "!owner", want: true},
+		{selector: "owner!=alice", want: false},
+		{selector: "example.com/legacy", want: true},
+		{selector: "example.com/legacy=", want: true},
+		{selector: " env=prod , !owner ", want: true},
+		{selector: "", wantErr: true},
+		{selector: "env=prod,", wantErr: true},
+		{selector: "env==prod", wantErr: true},
+		{selector: "-env", wantErr: true},
+		{selector: "env=prod prod", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			selector, err := ParseLabelSelector(tt.selector)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseLabelSelector() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if got := selector.Matches(labels); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
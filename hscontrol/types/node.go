@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
 	"net/netip"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -125,6 +127,29 @@ type Node struct {
 	LastSeen *time.Time
 	Expiry   *time.Time
 
+	// Quarantined nodes are cut off from the tailnet, they have no
+	// peers and are not visible to other nodes, but are kept in the
+	// database so they can be investigated and released.
+	Quarantined bool
+
+	// AwaitingApproval is set on the nodes registered when node approval
+	// is enabled, until an administrator approves them. They have no
+	// addresses and are cut off from the tailnet like quarantined nodes.
+	AwaitingApproval bool
+
+	// PostureAttributes are the custom posture attributes of the
+	// node, set through the API and checked by the srcPosture of the
+	// ACLs and grants of the policy.
+	PostureAttributes PostureAttributes
+
+	// Labels are arbitrary key/value pairs set through the API to
+	// organise the nodes.
+	Labels NodeLabels
+
+	// KeySignature is the network lock signature of the node key, sent
+	// to the peers which only trust the signed node keys.
+	KeySignature []byte
+
 	Routes []Route `gorm:"constraint:OnDelete:CASCADE;"`
 
 	CreatedAt time.Time
@@ -150,6 +175,12 @@ func (node Node) IsExpired() bool {
 	return time.Since(*node.Expiry) > 0
 }
 
+// IsIsolated returns if the node is cut off from the tailnet, because it
+// is quarantined or awaiting approval.
+func (node *Node) IsIsolated() bool {
+	return node.Quarantined || node.AwaitingApproval
+}
+
 // IsEphemeral returns if the node is registered as an Ephemeral node.
 // https://tailscale.com/kb/1111/ephemeral-nodes/
 func (node *Node) IsEphemeral() bool {
@@ -255,6 +286,19 @@ func (nodes Nodes) FilterByIP(ip netip.Addr) Nodes {
 	return found
 }
 
+// InTailnet returns the nodes of the users of the tailnet of the
+// multi-tailnet mode, or of the default tailnet if it is empty.
+func (nodes Nodes) InTailnet(tailnet string) Nodes {
+	found := make(Nodes, 0, len(nodes))
+	for _, node := range nodes {
+		if node.User.Tailnet == tailnet {
+			found = append(found, node)
+		}
+	}
+
+	return found
+}
+
 // BeforeSave is a hook that ensures that some values that
 // cannot be directly marshalled into database values are stored
 // correctly in the database.
@@ -377,6 +421,11 @@ func (node *Node) Proto() *v1.Node {
 		// RegisterMethod: ,
 
 		CreatedAt: timestamppb.New(node.CreatedAt),
+
+		Quarantined:       node.Quarantined,
+		PostureAttributes: node.PostureAttributes,
+		AwaitingApproval:  node.AwaitingApproval,
+		Labels:            node.Labels,
 	}
 
 	if node.AuthKey != nil {
@@ -391,9 +440,29 @@ func (node *Node) Proto() *v1.Node {
 		nodeProto.Expiry = timestamppb.New(*node.Expiry)
 	}
 
+	for _, route := range node.Routes {
+		nodeProto.Routes = append(nodeProto.Routes, &v1.NodeRoute{
+			Id:         uint64(route.ID),
+			Prefix:     netip.Prefix(route.Prefix).String(),
+			Advertised: route.Advertised,
+			Approved:   route.Enabled,
+			Primary:    route.IsPrimary,
+		})
+	}
+
 	return nodeProto
 }
 
+// SetNodeProtoOnline sets if the node is connected, and marks the
+// routes it is currently serving.
+func SetNodeProtoOnline(nodeProto *v1.Node, online bool) {
+	nodeProto.Online = online
+
+	for _, route := range nodeProto.GetRoutes() {
+		route.Served = online && route.GetApproved() && route.GetPrimary()
+	}
+}
+
 func (node *Node) GetFQDN(cfg *Config, baseDomain string) (string, error) {
 	var hostname string
 	if cfg.DNSConfig != nil && cfg.DNSConfig.Proxied { // MagicDNS
@@ -528,6 +597,39 @@ func (node *Node) ApplyPeerChange(change *tailcfg.PeerChange) {
 	node.LastSeen = change.LastSeen
 }
 
+// Clone returns a copy of the node which can be changed without
+// changing the original.
+func (node *Node) Clone() *Node {
+	ret := *node
+
+	ret.Endpoints = slices.Clone(node.Endpoints)
+	ret.Hostinfo = node.Hostinfo.Clone()
+	ret.IPv4 = clonePtr(node.IPv4)
+	ret.IPv6 = clonePtr(node.IPv6)
+	ret.ForcedTags = slices.Clone(node.ForcedTags)
+	ret.AuthKeyID = clonePtr(node.AuthKeyID)
+	ret.AuthKey = clonePtr(node.AuthKey)
+	ret.LastSeen = clonePtr(node.LastSeen)
+	ret.Expiry = clonePtr(node.Expiry)
+	ret.PostureAttributes = maps.Clone(node.PostureAttributes)
+	ret.Labels = maps.Clone(node.Labels)
+	ret.Routes = slices.Clone(node.Routes)
+	ret.DeletedAt = clonePtr(node.DeletedAt)
+	ret.IsOnline = clonePtr(node.IsOnline)
+
+	return &ret
+}
+
+func clonePtr[T any](v *T) *T {
+	if v == nil {
+		return nil
+	}
+
+	ret := *v
+
+	return &ret
+}
+
 func (nodes Nodes) String() string {
 	temp := make([]string, len(nodes))
 
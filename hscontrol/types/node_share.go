@@ -0,0 +1,31 @@
+package types
+
+import (
+	"time"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// NodeShare shares a node with a user other than its owner. The policy
+// rules with the user, or a group of the user, as destination also
+// cover the node, so the nodes of the user see it in their netmap and
+// can reach it as far as the policy lets them reach their own nodes.
+type NodeShare struct {
+	ID     uint64 `gorm:"primary_key"`
+	NodeID NodeID `gorm:"uniqueIndex:idx_node_shares_node_user"`
+	Node   Node   `gorm:"constraint:OnDelete:CASCADE;"`
+	UserID uint   `gorm:"uniqueIndex:idx_node_shares_node_user"`
+	User   User   `gorm:"constraint:OnDelete:CASCADE;"`
+
+	CreatedAt time.Time
+}
+
+func (share *NodeShare) Proto() *v1.NodeShare {
+	return &v1.NodeShare{
+		NodeId:    share.NodeID.Uint64(),
+		NodeName:  share.Node.GivenName,
+		User:      share.User.Proto(),
+		CreatedAt: timestamppb.New(share.CreatedAt),
+	}
+}
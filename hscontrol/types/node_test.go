@@ -540,3 +540,81 @@ func TestApplyPeerChange(t *testing.T) {
 		})
 	}
 }
+
+func TestSetNodeProtoOnline(t *testing.T) {
+	type routeState struct {
+		Prefix                                string
+		Advertised, Approved, Primary, Served bool
+	}
+
+	node := Node{
+		Routes: Routes{
+			{
+				Prefix:     IPPrefix(netip.MustParsePrefix("10.0.0.0/24")),
+				Advertised: true,
+				Enabled:    true,
+				IsPrimary:  true,
+			},
+			{
+				Prefix:     IPPrefix(netip.MustParsePrefix("10.0.1.0/24")),
+				Advertised: true,
+				Enabled:    true,
+			},
+			{
+				Prefix:     IPPrefix(netip.MustParsePrefix("10.0.2.0/24")),
+				Advertised: true,
+			},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		online bool
+		want   []routeState
+	}{
+		{
+			name:   "online",
+			online: true,
+			want: []routeState{
+				{Prefix: "10.0.0.0/24", Advertised: true, Approved: true, Primary: true, Served: true},
+				{Prefix: "10.0.1.0/24", Advertised: true, Approved: true},
+				{Prefix: "10.0.2.0/24", Advertised: true},
+			},
+		},
+		{
+			name:   "offline",
+			online: false,
+			want: []routeState{
+				{Prefix: "10.0.0.0/24", Advertised: true, Approved: true, Primary: true},
+				{Prefix: "10.0.1.0/24", Advertised: true, Approved: true},
+				{Prefix: "10.0.2.0/24", Advertised: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeProto := node.Proto()
+			SetNodeProtoOnline(nodeProto, tt.online)
+
+			if nodeProto.GetOnline() != tt.online {
+				t.Errorf("Online = %t, want %t", nodeProto.GetOnline(), tt.online)
+			}
+
+			var got []routeState
+			for _, route := range nodeProto.GetRoutes() {
+				got = append(got, routeState{
+					Prefix:     route.GetPrefix(),
+					Advertised: route.GetAdvertised(),
+					Approved:   route.GetApproved(),
+					Primary:    route.GetPrimary(),
+					Served:     route.GetServed(),
+				})
+			}
+
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("unexpected routes (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+package types
+
+import "time"
+
+// OIDCSession is the session with the OIDC provider of the user who
+// last authenticated a node, kept to check regularly that the provider
+// still gives the user access.
+type OIDCSession struct {
+	NodeID NodeID `gorm:"primary_key;autoIncrement:false"`
+
+	// RefreshToken is encrypted with a key derived from the noise
+	// private key of the server.
+	RefreshToken []byte
+
+	ValidatedAt time.Time
+}
@@ -0,0 +1,26 @@
+package types
+
+import (
+	"time"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Policy is a version of the ACL policy stored in the database, when
+// the policy mode is database. Versions are never changed, setting or
+// rolling back the policy adds a new version.
+type Policy struct {
+	ID   uint64 `gorm:"primary_key"`
+	Data string
+
+	CreatedAt time.Time
+}
+
+func (p *Policy) Proto() *v1.Policy {
+	return &v1.Policy{
+		Version:   p.ID,
+		Policy:    p.Data,
+		CreatedAt: timestamppb.New(p.CreatedAt),
+	}
+}
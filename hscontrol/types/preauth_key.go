@@ -1,14 +1,20 @@
 package types
 
 import (
+	"errors"
+	"fmt"
+	"net/netip"
 	"strconv"
 	"time"
 
 	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
 	"github.com/juanfont/headscale/hscontrol/util"
+	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+var ErrPreAuthKeyIPPoolInvalid = errors.New("invalid IP pool")
+
 // PreAuthKey describes a pre-authorization key usable in a particular user.
 type PreAuthKey struct {
 	ID        uint64 `gorm:"primary_key"`
@@ -20,10 +26,60 @@ type PreAuthKey struct {
 	Used      bool               `gorm:"default:false"`
 	ACLTags   []PreAuthKeyACLTag `gorm:"constraint:OnDelete:CASCADE;"`
 
+	// MaxUses is the number of times a reusable key can be used, 0 for
+	// no limit. UseCount counts the uses of the key.
+	MaxUses  int `gorm:"default:0"`
+	UseCount int `gorm:"default:0"`
+
+	// ExpireAfterFirstUse makes the key expire that long after it is
+	// used the first time, 0 to only use the expiration.
+	ExpireAfterFirstUse time.Duration `gorm:"default:0"`
+
+	// IPPools are the prefixes, at most one for each IP family, the
+	// addresses of the nodes registered with the key are taken from.
+	IPPools StringList
+
 	CreatedAt  *time.Time
 	Expiration *time.Time
 }
 
+// PreAuthKeyLimits are the optional restrictions of a new PreAuthKey.
+type PreAuthKeyLimits struct {
+	MaxUses             int
+	ExpireAfterFirstUse time.Duration
+	IPPools             []string
+}
+
+// ParseIPPools returns the IPv4 and IPv6 prefixes of the pools, nil for
+// the families without a pool.
+func ParseIPPools(pools []string) (*netip.Prefix, *netip.Prefix, error) {
+	var pool4, pool6 *netip.Prefix
+	for _, value := range pools {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", ErrPreAuthKeyIPPoolInvalid, err)
+		}
+		prefix = prefix.Masked()
+
+		family := &pool4
+		if prefix.Addr().Is6() {
+			family = &pool6
+		}
+
+		if *family != nil {
+			return nil, nil, fmt.Errorf(
+				"%w: %s and %s are in the same IP family",
+				ErrPreAuthKeyIPPoolInvalid,
+				*family,
+				prefix,
+			)
+		}
+		*family = &prefix
+	}
+
+	return pool4, pool6, nil
+}
+
 // PreAuthKeyACLTag describes an autmatic tag applied to a node when registered with the associated PreAuthKey.
 type PreAuthKeyACLTag struct {
 	ID           uint64 `gorm:"primary_key"`
@@ -40,6 +96,13 @@ func (key *PreAuthKey) Proto() *v1.PreAuthKey {
 		Reusable:  key.Reusable,
 		Used:      key.Used,
 		AclTags:   make([]string, len(key.ACLTags)),
+		MaxUses:   uint32(key.MaxUses),
+		UseCount:  uint32(key.UseCount),
+		IpPools:   key.IPPools,
+	}
+
+	if key.ExpireAfterFirstUse > 0 {
+		protoKey.ExpireAfterFirstUse = durationpb.New(key.ExpireAfterFirstUse)
 	}
 
 	if key.Expiration != nil {
@@ -0,0 +1,17 @@
+package types
+
+import "time"
+
+// SCIMGroup is a group of users provisioned by an identity provider
+// through SCIM. Its members are members of the ACL policy group of the
+// same name.
+type SCIMGroup struct {
+	ID          uint64 `gorm:"primary_key"`
+	DisplayName string `gorm:"unique"`
+	ExternalID  string
+
+	Members []User `gorm:"many2many:scim_group_members"`
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
@@ -0,0 +1,123 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/spf13/viper"
+)
+
+var ErrTailnetInvalid = errors.New("invalid tailnet")
+
+// TailnetConfig is one of the tailnets of the multi-tailnet mode, in
+// which a headscale serves several organizations isolated from each
+// other. The nodes of the users of a tailnet only see each other, their
+// addresses are allocated from its prefixes and they are under its own
+// policy. The users without a tailnet form the default tailnet, with the
+// prefixes, base domain and policy of the configuration.
+type TailnetConfig struct {
+	Name       string     `mapstructure:"name"`
+	Prefixes   StringList `mapstructure:"prefixes"`
+	BaseDomain string     `mapstructure:"base_domain"`
+	PolicyPath string     `mapstructure:"policy_path"`
+
+	// Pool holds the parsed Prefixes, for all the nodes of the tailnet.
+	Pool IPPool `mapstructure:"-"`
+}
+
+// Validate parses the prefixes of the tailnet, and checks that they are
+// in the prefixes of the configuration.
+func (t *TailnetConfig) Validate(prefix4, prefix6 *netip.Prefix) error {
+	if t.Name == "" {
+		return fmt.Errorf("%w: no name", ErrTailnetInvalid)
+	}
+	if err := util.CheckForFQDNRules(t.Name); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrTailnetInvalid, t.Name, err)
+	}
+
+	t.Pool = IPPool{
+		Prefixes: t.Prefixes,
+		Nodes:    StringList{"*"},
+		Tailnet:  t.Name,
+	}
+	if err := t.Pool.Validate(prefix4, prefix6); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrTailnetInvalid, t.Name, err)
+	}
+
+	t.BaseDomain = strings.TrimSuffix(t.BaseDomain, ".")
+	t.PolicyPath = util.AbsolutePathFromConfigPath(t.PolicyPath)
+
+	return nil
+}
+
+// overlaps reports if the tailnets have addresses in common.
+func (t *TailnetConfig) overlaps(other *TailnetConfig) bool {
+	for _, pair := range []struct{ a, b *netip.Prefix }{
+		{t.Pool.Prefix4, other.Pool.Prefix4},
+		{t.Pool.Prefix6, other.Pool.Prefix6},
+	} {
+		if pair.a != nil && pair.b != nil && pair.a.Overlaps(*pair.b) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetTailnets returns the tailnets of the multi-tailnet mode, which
+// must have unique names and prefixes in the prefixes of the
+// configuration that do not overlap.
+func GetTailnets(prefix4, prefix6 *netip.Prefix) ([]TailnetConfig, error) {
+	var tailnets []TailnetConfig
+	if err := viper.UnmarshalKey("tailnets", &tailnets); err != nil {
+		return nil, fmt.Errorf("parsing tailnets: %w", err)
+	}
+
+	for index := range tailnets {
+		if err := tailnets[index].Validate(prefix4, prefix6); err != nil {
+			return nil, fmt.Errorf("tailnets: %w", err)
+		}
+
+		for _, other := range tailnets[:index] {
+			if other.Name == tailnets[index].Name {
+				return nil, fmt.Errorf("tailnets: %w: %s is defined twice", ErrTailnetInvalid, other.Name)
+			}
+			if other.overlaps(&tailnets[index]) {
+				return nil, fmt.Errorf(
+					"tailnets: %w: the prefixes of %s and %s overlap",
+					ErrTailnetInvalid,
+					other.Name,
+					tailnets[index].Name,
+				)
+			}
+		}
+	}
+
+	return tailnets, nil
+}
+
+// Tailnet returns the tailnet of the multi-tailnet mode with the name,
+// nil if there is none.
+func (c *Config) Tailnet(name string) *TailnetConfig {
+	for index := range c.Tailnets {
+		if c.Tailnets[index].Name == name {
+			return &c.Tailnets[index]
+		}
+	}
+
+	return nil
+}
+
+// TailnetBaseDomain returns the base domain of the names of the nodes of
+// the tailnet, the base domain of the configuration for the default
+// tailnet or a tailnet without one.
+func (c *Config) TailnetBaseDomain(name string) string {
+	if tailnet := c.Tailnet(name); tailnet != nil && tailnet.BaseDomain != "" {
+		return tailnet.BaseDomain
+	}
+
+	return c.BaseDomain
+}
@@ -0,0 +1,102 @@
+package types
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestGetTailnets(t *testing.T) {
+	prefix4 := netip.MustParsePrefix("100.64.0.0/10")
+	prefix6 := netip.MustParsePrefix("fd7a:115c:a1e0::/48")
+
+	tests := []struct {
+		name     string
+		tailnets []map[string]interface{}
+		wantErr  bool
+	}{
+		{
+			name: "valid",
+			tailnets: []map[string]interface{}{
+				{
+					"name":        "acme",
+					"prefixes":    []string{"100.80.0.0/16", "fd7a:115c:a1e0:80::/64"},
+					"base_domain": "acme.example.com.",
+				},
+				{
+					"name":     "globex",
+					"prefixes": []string{"100.90.0.0/16"},
+				},
+			},
+		},
+		{
+			name: "no-name",
+			tailnets: []map[string]interface{}{
+				{"prefixes": []string{"100.80.0.0/16"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "no-prefixes",
+			tailnets: []map[string]interface{}{
+				{"name": "acme"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "outside-prefix",
+			tailnets: []map[string]interface{}{
+				{"name": "acme", "prefixes": []string{"10.0.0.0/16"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "duplicate-name",
+			tailnets: []map[string]interface{}{
+				{"name": "acme", "prefixes": []string{"100.80.0.0/16"}},
+				{"name": "acme", "prefixes": []string{"100.90.0.0/16"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "overlapping-prefixes",
+			tailnets: []map[string]interface{}{
+				{"name": "acme", "prefixes": []string{"100.80.0.0/16"}},
+				{"name": "globex", "prefixes": []string{"100.80.128.0/17"}},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer viper.Reset()
+
+			viper.Set("tailnets", tt.tailnets)
+			tailnets, err := GetTailnets(&prefix4, &prefix6)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetTailnets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !errors.Is(err, ErrTailnetInvalid) {
+					t.Errorf("GetTailnets() error = %v, want %v", err, ErrTailnetInvalid)
+				}
+
+				return
+			}
+
+			cfg := Config{BaseDomain: "example.com", Tailnets: tailnets}
+			if got := cfg.TailnetBaseDomain("acme"); got != "acme.example.com" {
+				t.Errorf("TailnetBaseDomain(acme) = %q, want %q", got, "acme.example.com")
+			}
+			if got := cfg.TailnetBaseDomain("globex"); got != "example.com" {
+				t.Errorf("TailnetBaseDomain(globex) = %q, want %q", got, "example.com")
+			}
+			if got := cfg.Tailnet("acme").Pool.Tailnet; got != "acme" {
+				t.Errorf("pool of acme is in tailnet %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package types
+
+import "time"
+
+// TKAState is the state of the tailnet key authority (TKA) of network
+// lock, there is at most one. The AUMs of the authority are stored as
+// TKAUpdates, the genesis AUM is kept to bootstrap the nodes enabling it.
+type TKAState struct {
+	ID         uint64 `gorm:"primary_key"`
+	GenesisAUM []byte
+
+	// LastActiveAncestor is the oldest AUM known to contribute to the
+	// state of the authority, as a hint to open it.
+	LastActiveAncestor string
+
+	// Disabled is set once a node disabled network lock with a valid
+	// disablement secret, which is given to the other nodes to disable
+	// it too.
+	Disabled          bool
+	DisablementSecret []byte
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// TKAUpdate is an authority update message (AUM) of the tailnet key
+// authority, identified by its hash.
+type TKAUpdate struct {
+	Hash     string `gorm:"primary_key"`
+	PrevHash string `gorm:"index"`
+	Data     []byte
+
+	CreatedAt time.Time
+}
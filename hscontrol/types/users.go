@@ -17,6 +17,18 @@ import (
 type User struct {
 	gorm.Model
 	Name string `gorm:"unique"`
+
+	// OIDCGroups are the groups of the user given by the OIDC provider
+	// when they last logged in.
+	OIDCGroups StringList `gorm:"column:oidc_groups"`
+
+	// Deactivated users cannot register or reauthenticate nodes, their
+	// nodes are expired when they are deactivated.
+	Deactivated bool
+
+	// Tailnet is the tailnet of the multi-tailnet mode the user, and
+	// its nodes, belong to. Empty for the default tailnet.
+	Tailnet string
 }
 
 func (n *User) TailscaleUser() *tailcfg.User {
@@ -50,5 +62,6 @@ func (n *User) Proto() *v1.User {
 		Id:        strconv.FormatUint(uint64(n.ID), util.Base10),
 		Name:      n.Name,
 		CreatedAt: timestamppb.New(n.CreatedAt),
+		Tailnet:   n.Tailnet,
 	}
 }
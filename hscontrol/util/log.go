@@ -1,10 +1,96 @@
 package util
 
 import (
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"tailscale.com/types/logger"
 )
 
+// LogSubsystem is a part of headscale whose logs have their own level,
+// set in log.subsystems, and are sampled.
+type LogSubsystem string
+
+const (
+	LogMapper  LogSubsystem = "mapper"
+	LogBatcher LogSubsystem = "batcher"
+	LogPoll    LogSubsystem = "poll"
+	LogDB      LogSubsystem = "db"
+	LogPolicy  LogSubsystem = "policy"
+)
+
+// LogSubsystems are all the subsystems with their own log level.
+var LogSubsystems = []LogSubsystem{LogMapper, LogBatcher, LogPoll, LogDB, LogPolicy}
+
+var subsystemLoggers atomic.Pointer[map[LogSubsystem]*zerolog.Logger]
+
+// SetLogLevels sets the level of the logs, and the levels of the
+// subsystems, which default to it. If burst is not 0, the trace, debug
+// and info events of every subsystem are limited to burst per period,
+// the warnings and errors are never dropped. It must be called once the
+// output of the global logger is set, the subsystems log to it.
+func SetLogLevels(
+	level zerolog.Level,
+	subsystems map[LogSubsystem]zerolog.Level,
+	burst uint32,
+	period time.Duration,
+) {
+	// Events below the global level are dropped by every logger, it
+	// must let through the most verbose of the subsystems.
+	minLevel := level
+	log.Logger = log.Logger.Level(level)
+
+	loggers := make(map[LogSubsystem]*zerolog.Logger, len(LogSubsystems))
+	for _, subsystem := range LogSubsystems {
+		subsystemLevel, ok := subsystems[subsystem]
+		if !ok {
+			subsystemLevel = level
+		}
+		minLevel = min(minLevel, subsystemLevel)
+
+		subsystemLogger := log.Logger.
+			Level(subsystemLevel).
+			With().
+			Str("subsystem", string(subsystem)).
+			Logger()
+
+		if burst > 0 {
+			sampler := &zerolog.BurstSampler{Burst: burst, Period: period}
+			subsystemLogger = subsystemLogger.Sample(&zerolog.LevelSampler{
+				TraceSampler: sampler,
+				DebugSampler: sampler,
+				InfoSampler:  sampler,
+			})
+		}
+
+		loggers[subsystem] = &subsystemLogger
+	}
+
+	zerolog.SetGlobalLevel(minLevel)
+	subsystemLoggers.Store(&loggers)
+}
+
+// Logger returns the logger of the subsystem, the global logger until
+// SetLogLevels is called.
+func (s LogSubsystem) Logger() *zerolog.Logger {
+	if loggers := subsystemLoggers.Load(); loggers != nil {
+		if subsystemLogger, ok := (*loggers)[s]; ok {
+			return subsystemLogger
+		}
+	}
+
+	return &log.Logger
+}
+
+func (s LogSubsystem) Trace() *zerolog.Event { return s.Logger().Trace() }
+func (s LogSubsystem) Debug() *zerolog.Event { return s.Logger().Debug() }
+func (s LogSubsystem) Info() *zerolog.Event  { return s.Logger().Info() }
+func (s LogSubsystem) Warn() *zerolog.Event  { return s.Logger().Warn() }
+func (s LogSubsystem) Error() *zerolog.Event { return s.Logger().Error() }
+func (s LogSubsystem) Fatal() *zerolog.Event { return s.Logger().Fatal() }
+
 func LogErr(err error, msg string) {
 	log.Error().Caller().Err(err).Msg(msg)
 }
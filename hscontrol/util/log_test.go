@@ -0,0 +1,89 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestSetLogLevels(t *testing.T) {
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+	defer func(logger zerolog.Logger) { log.Logger = logger }(log.Logger)
+	defer subsystemLoggers.Store(nil)
+
+	tests := []struct {
+		name       string
+		subsystems map[LogSubsystem]zerolog.Level
+		burst      uint32
+		log        func()
+		want       []string
+	}{
+		{
+			name: "subsystem-more-verbose",
+			subsystems: map[LogSubsystem]zerolog.Level{
+				LogBatcher: zerolog.DebugLevel,
+			},
+			log: func() {
+				LogBatcher.Debug().Msg("batcher debug")
+				LogMapper.Debug().Msg("mapper debug")
+				log.Debug().Msg("global debug")
+				log.Info().Msg("global info")
+			},
+			want: []string{"batcher debug", "global info"},
+		},
+		{
+			name: "subsystem-less-verbose",
+			subsystems: map[LogSubsystem]zerolog.Level{
+				LogDB: zerolog.WarnLevel,
+			},
+			log: func() {
+				LogDB.Info().Msg("db info")
+				LogDB.Warn().Msg("db warn")
+				LogPolicy.Info().Msg("policy info")
+			},
+			want: []string{"db warn", "policy info"},
+		},
+		{
+			name:  "sampling",
+			burst: 2,
+			log: func() {
+				for range 5 {
+					LogPoll.Info().Msg("poll info")
+				}
+				LogPoll.Warn().Msg("poll warn")
+			},
+			want: []string{"poll info", "poll info", "poll warn"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			log.Logger = zerolog.New(&buf)
+
+			SetLogLevels(zerolog.InfoLevel, tt.subsystems, tt.burst, time.Hour)
+			tt.log()
+
+			var got []string
+			decoder := json.NewDecoder(&buf)
+			for decoder.More() {
+				var event struct {
+					Message string `json:"message"`
+				}
+				if err := decoder.Decode(&event); err != nil {
+					t.Fatalf("decoding log event: %s", err)
+				}
+				got = append(got, event.Message)
+			}
+
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("SetLogLevels() unexpected events (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
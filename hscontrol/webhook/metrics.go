@@ -0,0 +1,14 @@
+package webhook
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const prometheusNamespace = "headscale"
+
+var webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: prometheusNamespace,
+	Name:      "webhook_deliveries_total",
+	Help:      "total count of webhook deliveries by event and status",
+}, []string{"event", "status"})
@@ -0,0 +1,472 @@
+// Package webhook sends events about the nodes and users of the tailnet
+// to the HTTP endpoints configured in the webhooks section of the config,
+// and to the watchers of the gRPC API.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	queueSize = 1000
+	workers   = 4
+
+	// watcherQueueSize is the number of events a watcher can fall
+	// behind before it is dropped.
+	watcherQueueSize = 256
+
+	requestTimeout = 10 * time.Second
+	maxAttempts    = 5
+	initialBackoff = time.Second
+
+	eventIDLength = 16
+
+	// SignatureHeader is the HMAC-SHA256 of the body, keyed with the
+	// secret of the webhook and hex encoded, prefixed with "sha256=".
+	SignatureHeader = "X-Headscale-Signature"
+	EventHeader     = "X-Headscale-Event"
+	DeliveryHeader  = "X-Headscale-Delivery"
+)
+
+var ErrInvalidWebhook = errors.New("invalid webhook")
+
+type EventType string
+
+const (
+	EventNodeOnline     EventType = "node.online"
+	EventNodeOffline    EventType = "node.offline"
+	EventNodeRegistered EventType = "node.registered"
+	EventNodeExpired    EventType = "node.expired"
+	EventRoutesChanged  EventType = "node.routes_changed"
+	EventNodeDeleted    EventType = "node.deleted"
+	EventUserCreated    EventType = "user.created"
+	EventUserRenamed    EventType = "user.renamed"
+	EventUserDeleted    EventType = "user.deleted"
+)
+
+var eventTypes = []EventType{
+	EventNodeOnline,
+	EventNodeOffline,
+	EventNodeRegistered,
+	EventNodeExpired,
+	EventRoutesChanged,
+	EventNodeDeleted,
+	EventUserCreated,
+	EventUserRenamed,
+	EventUserDeleted,
+}
+
+// ValidEventType reports if the event type is known.
+func ValidEventType(eventType string) bool {
+	return slices.Contains(eventTypes, EventType(eventType))
+}
+
+// Event is the body of a webhook, Node is set for the node events and
+// User for the user events.
+type Event struct {
+	ID   string    `json:"id"`
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	Node *Node     `json:"node,omitempty"`
+	User *User     `json:"user,omitempty"`
+}
+
+type User struct {
+	ID   uint64 `json:"id"`
+	Name string `json:"name"`
+}
+
+type Node struct {
+	ID          uint64     `json:"id"`
+	Name        string     `json:"name"`
+	Hostname    string     `json:"hostname"`
+	User        string     `json:"user"`
+	IPAddresses []string   `json:"ip_addresses"`
+	Tags        []string   `json:"tags,omitempty"`
+	Online      bool       `json:"online"`
+	LastSeen    *time.Time `json:"last_seen,omitempty"`
+	Expiry      *time.Time `json:"expiry,omitempty"`
+	Routes      []Route    `json:"routes,omitempty"`
+}
+
+type Route struct {
+	Prefix    string `json:"prefix"`
+	Enabled   bool   `json:"enabled"`
+	IsPrimary bool   `json:"is_primary"`
+}
+
+// NewNodeEvent returns an event of the given type about the node.
+func NewNodeEvent(eventType EventType, node *types.Node) Event {
+	id, _ := util.GenerateRandomStringDNSSafe(eventIDLength)
+
+	event := Event{
+		ID:   id,
+		Type: eventType,
+		Time: time.Now().UTC(),
+		Node: &Node{
+			ID:          node.ID.Uint64(),
+			Name:        node.GivenName,
+			Hostname:    node.Hostname,
+			User:        node.User.Name,
+			IPAddresses: node.IPsAsString(),
+			Tags:        node.ForcedTags,
+			LastSeen:    node.LastSeen,
+			Expiry:      node.Expiry,
+		},
+	}
+
+	if node.IsOnline != nil {
+		event.Node.Online = *node.IsOnline
+	}
+
+	for _, route := range node.Routes {
+		event.Node.Routes = append(event.Node.Routes, Route{
+			Prefix:    netip.Prefix(route.Prefix).String(),
+			Enabled:   route.Enabled,
+			IsPrimary: route.IsPrimary,
+		})
+	}
+
+	return event
+}
+
+// NewUserEvent returns an event of the given type about the user.
+func NewUserEvent(eventType EventType, user *types.User) Event {
+	id, _ := util.GenerateRandomStringDNSSafe(eventIDLength)
+
+	return Event{
+		ID:   id,
+		Type: eventType,
+		Time: time.Now().UTC(),
+		User: &User{
+			ID:   uint64(user.ID),
+			Name: user.Name,
+		},
+	}
+}
+
+// Sign returns the signature of a body, as sent in SignatureHeader.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type delivery struct {
+	hook    types.WebhookConfig
+	event   Event
+	body    []byte
+	attempt int
+}
+
+// Dispatcher sends events to the configured webhooks in the background.
+// Failed deliveries are retried with an exponential backoff, events
+// are dropped if the queue is full.
+type Dispatcher struct {
+	hooks  []types.WebhookConfig
+	client *http.Client
+
+	initialBackoff time.Duration
+
+	mu       sync.Mutex
+	closed   bool
+	queue    chan delivery
+	watchers map[*watcher]struct{}
+	wg       sync.WaitGroup
+}
+
+type watcher struct {
+	events     chan Event
+	eventTypes []string
+}
+
+// NewDispatcher validates the webhooks and starts sending events to
+// them.
+func NewDispatcher(hooks []types.WebhookConfig) (*Dispatcher, error) {
+	for _, hook := range hooks {
+		if err := validate(hook); err != nil {
+			return nil, err
+		}
+	}
+
+	d := &Dispatcher{
+		hooks:          hooks,
+		client:         &http.Client{Timeout: requestTimeout},
+		initialBackoff: initialBackoff,
+		queue:          make(chan delivery, queueSize),
+		watchers:       make(map[*watcher]struct{}),
+	}
+
+	for range workers {
+		d.wg.Add(1)
+		go d.work()
+	}
+
+	return d, nil
+}
+
+func validate(hook types.WebhookConfig) error {
+	if !strings.HasPrefix(hook.URL, "http://") && !strings.HasPrefix(hook.URL, "https://") {
+		return fmt.Errorf("%w: url must start with https:// or http://, got %q", ErrInvalidWebhook, hook.URL)
+	}
+
+	for _, event := range hook.Events {
+		if !ValidEventType(event) {
+			return fmt.Errorf("%w: unknown event %q for %s", ErrInvalidWebhook, event, hook.URL)
+		}
+	}
+
+	return nil
+}
+
+func subscribed(hook types.WebhookConfig, eventType EventType) bool {
+	return len(hook.Events) == 0 || slices.Contains(hook.Events, string(eventType))
+}
+
+// Subscribed reports if any webhook or watcher is subscribed to the
+// event type, to skip building events nobody receives.
+func (d *Dispatcher) Subscribed(eventType EventType) bool {
+	if d == nil {
+		return false
+	}
+
+	d.mu.Lock()
+	for w := range d.watchers {
+		if len(w.eventTypes) == 0 || slices.Contains(w.eventTypes, string(eventType)) {
+			d.mu.Unlock()
+
+			return true
+		}
+	}
+	d.mu.Unlock()
+
+	return slices.ContainsFunc(d.hooks, func(hook types.WebhookConfig) bool {
+		return subscribed(hook, eventType)
+	})
+}
+
+// Watch returns a channel receiving the events of the given types, all
+// events if none are given, until stop is called. A watcher which falls
+// behind has its channel closed rather than missing events, as does
+// closing the dispatcher.
+func (d *Dispatcher) Watch(eventTypes ...string) (<-chan Event, func()) {
+	w := &watcher{
+		events:     make(chan Event, watcherQueueSize),
+		eventTypes: eventTypes,
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		close(w.events)
+
+		return w.events, func() {}
+	}
+	d.watchers[w] = struct{}{}
+
+	return w.events, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		if _, ok := d.watchers[w]; ok {
+			delete(d.watchers, w)
+			close(w.events)
+		}
+	}
+}
+
+// Send queues the event for the webhooks and watchers subscribed to it.
+func (d *Dispatcher) Send(event Event) {
+	if d == nil {
+		return
+	}
+
+	d.sendWatchers(event)
+
+	if len(d.hooks) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Error().Err(err).Str("event", string(event.Type)).Msg("failed to marshal webhook event")
+
+		return
+	}
+
+	for _, hook := range d.hooks {
+		if subscribed(hook, event.Type) {
+			d.enqueue(delivery{
+				hook:  hook,
+				event: event,
+				body:  body,
+			})
+		}
+	}
+}
+
+func (d *Dispatcher) sendWatchers(event Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for w := range d.watchers {
+		if len(w.eventTypes) > 0 && !slices.Contains(w.eventTypes, string(event.Type)) {
+			continue
+		}
+
+		select {
+		case w.events <- event:
+		default:
+			log.Warn().
+				Str("event", string(event.Type)).
+				Msg("event watcher is not keeping up, dropping it")
+			delete(d.watchers, w)
+			close(w.events)
+		}
+	}
+}
+
+func (d *Dispatcher) enqueue(del delivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		webhookDeliveries.WithLabelValues(string(del.event.Type), "dropped").Inc()
+
+		return
+	}
+
+	select {
+	case d.queue <- del:
+	default:
+		log.Warn().
+			Str("event", string(del.event.Type)).
+			Str("url", del.hook.URL).
+			Msg("webhook queue is full, dropping event")
+		webhookDeliveries.WithLabelValues(string(del.event.Type), "dropped").Inc()
+	}
+}
+
+// Close stops sending events, queued events and pending retries are
+// dropped.
+func (d *Dispatcher) Close() {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+
+		return
+	}
+	d.closed = true
+	close(d.queue)
+	for w := range d.watchers {
+		delete(d.watchers, w)
+		close(w.events)
+	}
+	d.mu.Unlock()
+
+	d.wg.Wait()
+}
+
+func (d *Dispatcher) work() {
+	defer d.wg.Done()
+
+	for del := range d.queue {
+		d.mu.Lock()
+		closed := d.closed
+		d.mu.Unlock()
+		if closed {
+			webhookDeliveries.WithLabelValues(string(del.event.Type), "dropped").Inc()
+
+			continue
+		}
+
+		d.deliver(del)
+	}
+}
+
+func (d *Dispatcher) deliver(del delivery) {
+	logger := log.With().
+		Str("event", string(del.event.Type)).
+		Str("delivery", del.event.ID).
+		Str("url", del.hook.URL).
+		Int("attempt", del.attempt+1).
+		Logger()
+
+	retry, err := d.post(del)
+	if err == nil {
+		webhookDeliveries.WithLabelValues(string(del.event.Type), "ok").Inc()
+
+		return
+	}
+
+	del.attempt++
+	if !retry || del.attempt >= maxAttempts {
+		logger.Error().Err(err).Msg("webhook delivery failed, giving up")
+		webhookDeliveries.WithLabelValues(string(del.event.Type), "failed").Inc()
+
+		return
+	}
+
+	backoff := d.initialBackoff << (del.attempt - 1)
+	logger.Warn().Err(err).Dur("backoff", backoff).Msg("webhook delivery failed, retrying")
+	webhookDeliveries.WithLabelValues(string(del.event.Type), "retried").Inc()
+
+	time.AfterFunc(backoff, func() {
+		d.enqueue(del)
+	})
+}
+
+// post sends the delivery, and reports if it should be retried when
+// it fails.
+func (d *Dispatcher) post(del delivery) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, del.hook.URL, bytes.NewReader(del.body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "headscale")
+	req.Header.Set(EventHeader, string(del.event.Type))
+	req.Header.Set(DeliveryHeader, del.event.ID)
+	if del.hook.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(del.hook.Secret, del.body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= http.StatusInternalServerError:
+		return true, fmt.Errorf("unexpected status %s", resp.Status)
+	default:
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
@@ -0,0 +1,228 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+)
+
+func TestNewDispatcherValidates(t *testing.T) {
+	tests := []struct {
+		name    string
+		hook    types.WebhookConfig
+		wantErr bool
+	}{
+		{
+			name: "all-events",
+			hook: types.WebhookConfig{URL: "https://example.com/hook"},
+		},
+		{
+			name: "some-events",
+			hook: types.WebhookConfig{
+				URL:    "http://example.com/hook",
+				Events: []string{"node.online", "node.offline"},
+			},
+		},
+		{
+			name:    "no-scheme",
+			hook:    types.WebhookConfig{URL: "example.com/hook"},
+			wantErr: true,
+		},
+		{
+			name: "unknown-event",
+			hook: types.WebhookConfig{
+				URL:    "https://example.com/hook",
+				Events: []string{"node.renamed"},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewDispatcher([]types.WebhookConfig{tt.hook})
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidWebhook) {
+					t.Errorf("expected ErrInvalidWebhook, got %v", err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			d.Close()
+		})
+	}
+}
+
+type received struct {
+	event     Event
+	header    http.Header
+	signature string
+}
+
+func TestDispatcher(t *testing.T) {
+	var failures atomic.Int32
+	failures.Store(2)
+
+	got := make(chan received, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		// Fail the first deliveries to test the retries.
+		if failures.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+
+		var event Event
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("unmarshalling event: %s", err)
+		}
+
+		got <- received{
+			event:     event,
+			header:    r.Header,
+			signature: Sign("secret", body),
+		}
+	}))
+	defer server.Close()
+
+	d, err := NewDispatcher([]types.WebhookConfig{
+		{
+			URL:    server.URL,
+			Secret: "secret",
+			Events: []string{string(EventNodeOnline)},
+		},
+	})
+	if err != nil {
+		t.Fatalf("creating dispatcher: %s", err)
+	}
+	d.initialBackoff = 10 * time.Millisecond
+	defer d.Close()
+
+	if !d.Subscribed(EventNodeOnline) || d.Subscribed(EventNodeOffline) {
+		t.Fatalf("unexpected subscriptions")
+	}
+
+	node := &types.Node{
+		ID:        1,
+		Hostname:  "laptop",
+		GivenName: "laptop",
+		User:      types.User{Name: "user1"},
+	}
+
+	// Not subscribed, never delivered.
+	d.Send(NewNodeEvent(EventNodeOffline, node))
+	d.Send(NewNodeEvent(EventNodeOnline, node))
+
+	select {
+	case r := <-got:
+		if r.event.Type != EventNodeOnline {
+			t.Errorf("expected %s, got %s", EventNodeOnline, r.event.Type)
+		}
+		if r.event.Node.Hostname != "laptop" || r.event.Node.User != "user1" {
+			t.Errorf("unexpected node in event: %+v", r.event.Node)
+		}
+		if r.header.Get(EventHeader) != string(EventNodeOnline) {
+			t.Errorf("unexpected event header: %q", r.header.Get(EventHeader))
+		}
+		if r.header.Get(DeliveryHeader) != r.event.ID {
+			t.Errorf("unexpected delivery header: %q", r.header.Get(DeliveryHeader))
+		}
+		if r.header.Get(SignatureHeader) != r.signature {
+			t.Errorf("unexpected signature: %q, want %q", r.header.Get(SignatureHeader), r.signature)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not delivered")
+	}
+
+	select {
+	case r := <-got:
+		t.Fatalf("unexpected delivery: %+v", r.event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDispatcherGivesUp(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	d, err := NewDispatcher([]types.WebhookConfig{{URL: server.URL}})
+	if err != nil {
+		t.Fatalf("creating dispatcher: %s", err)
+	}
+	d.initialBackoff = time.Millisecond
+
+	d.Send(NewNodeEvent(EventNodeExpired, &types.Node{ID: 1}))
+	time.Sleep(200 * time.Millisecond)
+	d.Close()
+
+	// Client errors are not retried.
+	if got := requests.Load(); got != 1 {
+		t.Errorf("expected 1 request, got %d", got)
+	}
+}
+
+func TestDispatcherWatch(t *testing.T) {
+	d, err := NewDispatcher(nil)
+	if err != nil {
+		t.Fatalf("creating dispatcher: %s", err)
+	}
+	defer d.Close()
+
+	if d.Subscribed(EventUserCreated) {
+		t.Fatalf("subscribed without watchers")
+	}
+
+	users, stopUsers := d.Watch(string(EventUserCreated))
+	all, stopAll := d.Watch()
+	defer stopAll()
+
+	if !d.Subscribed(EventUserCreated) || !d.Subscribed(EventNodeOnline) {
+		t.Fatalf("expected the watchers to be subscribed")
+	}
+
+	d.Send(NewNodeEvent(EventNodeOnline, &types.Node{ID: 1, User: types.User{Name: "user1"}}))
+	d.Send(NewUserEvent(EventUserCreated, &types.User{Name: "user2"}))
+
+	if event := <-users; event.Type != EventUserCreated || event.User.Name != "user2" || event.Node != nil {
+		t.Errorf("unexpected event: %+v", event)
+	}
+	if event := <-all; event.Type != EventNodeOnline || event.Node.ID != 1 {
+		t.Errorf("unexpected event: %+v", event)
+	}
+	<-all
+
+	stopUsers()
+	if _, ok := <-users; ok {
+		t.Errorf("expected the channel to be closed after stop")
+	}
+
+	// A watcher falling behind is dropped.
+	for range watcherQueueSize + 1 {
+		d.Send(NewUserEvent(EventUserDeleted, &types.User{Name: "user2"}))
+	}
+
+	received := 0
+	for range all {
+		received++
+	}
+	if received != watcherQueueSize {
+		t.Errorf("expected %d events before the watcher was dropped, got %d", watcherQueueSize, received)
+	}
+}
@@ -0,0 +1,53 @@
+package hscontrol
+
+import (
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/webhook"
+	"github.com/rs/zerolog/log"
+)
+
+// sendNodeEvent sends an event about the node to the webhooks
+// subscribed to it.
+func (h *Headscale) sendNodeEvent(eventType webhook.EventType, node *types.Node) {
+	if !h.webhooks.Subscribed(eventType) {
+		return
+	}
+
+	h.webhooks.Send(webhook.NewNodeEvent(eventType, node))
+}
+
+// sendUserEvent sends an event about the user to the webhooks
+// subscribed to it.
+func (h *Headscale) sendUserEvent(eventType webhook.EventType, user *types.User) {
+	if !h.webhooks.Subscribed(eventType) {
+		return
+	}
+
+	h.webhooks.Send(webhook.NewUserEvent(eventType, user))
+}
+
+// sendNodeEventsByID sends an event about each of the nodes, for
+// callers which only know their IDs.
+func (h *Headscale) sendNodeEventsByID(eventType webhook.EventType, nodeIDs ...types.NodeID) {
+	if !h.webhooks.Subscribed(eventType) {
+		return
+	}
+
+	for _, nodeID := range nodeIDs {
+		node, err := h.db.GetNodeByID(nodeID)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Uint64("node.id", nodeID.Uint64()).
+				Str("event", string(eventType)).
+				Msg("could not get node to send webhook event")
+
+			continue
+		}
+
+		online := h.nodeNotifier.IsLikelyConnected(nodeID)
+		node.IsOnline = &online
+
+		h.webhooks.Send(webhook.NewNodeEvent(eventType, node))
+	}
+}
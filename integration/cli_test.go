@@ -634,6 +634,7 @@ func TestApiKeyCommand(t *testing.T) {
 			"delete",
 			"--prefix",
 			listedAPIKeys[0].GetPrefix(),
+			"--yes",
 		})
 	assert.Nil(t, err)
 
@@ -2,32 +2,119 @@ package dockertestutil
 
 import (
 	"errors"
+	"fmt"
 	"net"
 
 	"github.com/ory/dockertest/v3"
 	"github.com/ory/dockertest/v3/docker"
 )
 
-var ErrContainerNotFound = errors.New("container not found")
+var (
+	ErrContainerNotFound = errors.New("container not found")
+	ErrNetworkMismatch   = errors.New("network exists with different options")
+)
+
+// enableIPv4Option is the network option of Docker 28 and later
+// disabling IPv4 on a network.
+const enableIPv4Option = "com.docker.network.enable_ipv4"
+
+// NetworkOption modifies the options used when creating a new network.
+type NetworkOption = func(config *docker.CreateNetworkOptions)
 
-func GetFirstOrCreateNetwork(pool *dockertest.Pool, name string) (*dockertest.Network, error) {
+// WithIPv6Subnet enables IPv6 on the network and assigns it the given
+// subnet, allowing containers to be reached over IPv6.
+func WithIPv6Subnet(subnet string) NetworkOption {
+	return func(config *docker.CreateNetworkOptions) {
+		config.EnableIPv6 = true
+		if config.IPAM == nil {
+			config.IPAM = &docker.IPAMOptions{}
+		}
+		config.IPAM.Config = append(config.IPAM.Config, docker.IPAMConfig{
+			Subnet: subnet,
+		})
+	}
+}
+
+// WithoutIPv4 disables IPv4 on the network, which must have an IPv6
+// subnet. It requires Docker 28 or later.
+func WithoutIPv4() NetworkOption {
+	return func(config *docker.CreateNetworkOptions) {
+		if config.Options == nil {
+			config.Options = make(map[string]interface{})
+		}
+		config.Options[enableIPv4Option] = "false"
+	}
+}
+
+// GetFirstOrCreateNetwork returns the network with the given name,
+// creating it with the options if it does not exist. An existing
+// network which does not have the IP versions of the options is not
+// used, as the tests would not run on the network they expect. Its
+// subnets are not checked, the IPv6 subnets of the tests are random.
+func GetFirstOrCreateNetwork(
+	pool *dockertest.Pool,
+	name string,
+	opts ...NetworkOption,
+) (*dockertest.Network, error) {
 	networks, err := pool.NetworksByName(name)
 	if err != nil || len(networks) == 0 {
-		if _, err := pool.CreateNetwork(name); err == nil {
-			// Create does not give us an updated version of the resource, so we need to
-			// get it again.
-			networks, err := pool.NetworksByName(name)
-			if err != nil {
-				return nil, err
-			}
-
-			return &networks[0], nil
+		if _, err := pool.CreateNetwork(name, opts...); err != nil {
+			return nil, err
+		}
+
+		// Create does not give us an updated version of the resource, so we need to
+		// get it again.
+		networks, err = pool.NetworksByName(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(networks) == 0 {
+			return nil, fmt.Errorf("network %s was not created", name)
 		}
+
+		return &networks[0], nil
+	}
+
+	if err := checkNetworkOptions(networks[0].Network, opts...); err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrNetworkMismatch, name, err)
 	}
 
 	return &networks[0], nil
 }
 
+func checkNetworkOptions(network *docker.Network, opts ...NetworkOption) error {
+	var want docker.CreateNetworkOptions
+	for _, opt := range opts {
+		opt(&want)
+	}
+
+	if network.EnableIPv6 != want.EnableIPv6 {
+		return fmt.Errorf("IPv6 is %t, expected %t", network.EnableIPv6, want.EnableIPv6)
+	}
+
+	wantIPv4 := want.Options[enableIPv4Option] != "false"
+	hasIPv4 := network.Options[enableIPv4Option] != "false"
+	if hasIPv4 != wantIPv4 {
+		return fmt.Errorf("IPv4 is %t, expected %t", hasIPv4, wantIPv4)
+	}
+
+	return nil
+}
+
+// IPInNetwork returns the IP of the container in the network, its IPv6
+// address if it has no IPv4 address.
+func IPInNetwork(resource *dockertest.Resource, network *dockertest.Network) string {
+	if ip := resource.GetIPInNetwork(network); ip != "" {
+		return ip
+	}
+
+	if netCfg, ok := resource.Container.NetworkSettings.Networks[network.Network.Name]; ok {
+		return netCfg.GlobalIPv6Address
+	}
+
+	return ""
+}
+
 func AddContainerToNetwork(
 	pool *dockertest.Pool,
 	network *dockertest.Network,
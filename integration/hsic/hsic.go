@@ -71,6 +71,7 @@ type HeadscaleInContainer struct {
 	tlsKey           []byte
 	filesInContainer []fileInContainer
 	postgres         bool
+	ipv6             bool
 }
 
 // Option represent optional settings that can be given to a
@@ -176,6 +177,17 @@ func WithPostgres() Option {
 	}
 }
 
+// WithIPv6Endpoint makes Headscale listen on IPv6 and exposes
+// its IPv6 address as the endpoint clients connect to.
+// It requires the network to have IPv6 enabled.
+func WithIPv6Endpoint() Option {
+	return func(hsic *HeadscaleInContainer) {
+		hsic.ipv6 = true
+		hsic.env["HEADSCALE_LISTEN_ADDR"] = fmt.Sprintf("[::]:%d", hsic.port)
+		hsic.env["HEADSCALE_METRICS_LISTEN_ADDR"] = "[::]:9090"
+	}
+}
+
 // WithIPAllocationStrategy sets the tests IP Allocation strategy.
 func WithIPAllocationStrategy(strat types.IPAllocationStrategy) Option {
 	return func(hsic *HeadscaleInContainer) {
@@ -206,8 +218,8 @@ func WithEmbeddedDERPServerOnly() Option {
 // WithTuning allows changing the tuning settings easily.
 func WithTuning(batchTimeout time.Duration, mapSessionChanSize int) Option {
 	return func(hsic *HeadscaleInContainer) {
-		hsic.env["HEADSCALE_TUNING_BATCH_CHANGE_DELAY"] = batchTimeout.String()
-		hsic.env["HEADSCALE_TUNING_NODE_MAPSESSION_BUFFERED_CHAN_SIZE"] = strconv.Itoa(mapSessionChanSize)
+		hsic.env["HEADSCALE_BATCHER_BATCH_INTERVAL"] = batchTimeout.String()
+		hsic.env["HEADSCALE_BATCHER_NODE_QUEUE_SIZE"] = strconv.Itoa(mapSessionChanSize)
 	}
 }
 
@@ -558,7 +570,16 @@ func (t *HeadscaleInContainer) Execute(
 }
 
 // GetIP returns the docker container IP as a string.
+// If WithIPv6Endpoint is set, the IPv6 address is returned.
 func (t *HeadscaleInContainer) GetIP() string {
+	if t.ipv6 {
+		if netCfg, ok := t.container.Container.NetworkSettings.Networks[t.network.Network.Name]; ok {
+			return netCfg.GlobalIPv6Address
+		}
+
+		return ""
+	}
+
 	return t.container.GetIPInNetwork(t.network)
 }
 
@@ -575,9 +596,7 @@ func (t *HeadscaleInContainer) GetHealthEndpoint() string {
 
 // GetEndpoint returns the Headscale endpoint for the HeadscaleInContainer.
 func (t *HeadscaleInContainer) GetEndpoint() string {
-	hostEndpoint := fmt.Sprintf("%s:%d",
-		t.GetIP(),
-		t.port)
+	hostEndpoint := net.JoinHostPort(t.GetIP(), t.GetPort())
 
 	if t.hasTLS() {
 		return fmt.Sprintf("https://%s", hostEndpoint)
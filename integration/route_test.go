@@ -768,6 +768,7 @@ func TestHASubnetRouterFailover(t *testing.T) {
 			"delete",
 			"--route",
 			fmt.Sprintf("%d", routesAfterEnabling1[1].GetId()),
+			"--yes",
 		})
 	assertNoErr(t, err)
 
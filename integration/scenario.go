@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math/rand/v2"
 	"net/netip"
 	"os"
 	"sort"
@@ -24,6 +25,10 @@ import (
 
 const (
 	scenarioHashLength = 6
+
+	// scenarioIPv6SubnetFormat is given a random number so that the
+	// IPv6 networks of the tests running in parallel do not overlap.
+	scenarioIPv6SubnetFormat = "fd00:4853:%x::/64"
 )
 
 var usePostgresForTest = envknob.Bool("HEADSCALE_INTEGRATION_POSTGRES")
@@ -146,6 +151,30 @@ type Scenario struct {
 // NewScenario creates a test Scenario which can be used to bootstraps a ControlServer with
 // a set of Users and TailscaleClients.
 func NewScenario(maxWait time.Duration) (*Scenario, error) {
+	return newScenario(maxWait, "")
+}
+
+// NewIPv6OnlyScenario creates a test Scenario where the docker network
+// only has IPv6, so the ControlServer and the TailscaleClients can only
+// reach each other over IPv6.
+func NewIPv6OnlyScenario(maxWait time.Duration) (*Scenario, error) {
+	return newScenario(
+		maxWait,
+		"-v6",
+		dockertestutil.WithIPv6Subnet(fmt.Sprintf(scenarioIPv6SubnetFormat, rand.N(0x10000))),
+		dockertestutil.WithoutIPv4(),
+	)
+}
+
+// newScenario creates a test Scenario on a network created with
+// networkOpts. Its name, or the one set by HEADSCALE_TEST_NETWORK_NAME,
+// has suffix after it so that networks with different options are not
+// shared.
+func newScenario(
+	maxWait time.Duration,
+	suffix string,
+	networkOpts ...dockertestutil.NetworkOption,
+) (*Scenario, error) {
 	hash, err := util.GenerateRandomStringDNSSafe(scenarioHashLength)
 	if err != nil {
 		return nil, err
@@ -158,12 +187,12 @@ func NewScenario(maxWait time.Duration) (*Scenario, error) {
 
 	pool.MaxWait = maxWait
 
-	networkName := fmt.Sprintf("hs-%s", hash)
+	networkName := fmt.Sprintf("hs%s-%s", suffix, hash)
 	if overrideNetworkName := os.Getenv("HEADSCALE_TEST_NETWORK_NAME"); overrideNetworkName != "" {
-		networkName = overrideNetworkName
+		networkName = overrideNetworkName + suffix
 	}
 
-	network, err := dockertestutil.GetFirstOrCreateNetwork(pool, networkName)
+	network, err := dockertestutil.GetFirstOrCreateNetwork(pool, networkName, networkOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create or get network: %w", err)
 	}